@@ -11,6 +11,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/util"
@@ -74,6 +75,11 @@ type ServerConfig struct {
 	Enabled       bool   `yaml:"enabled"`
 	InterfaceName string `yaml:"interface_name"`
 
+	// LocalDomainName is the local search domain, for example "lan".  It's
+	// advertised to the DHCPv4 clients and used by the DNS server to
+	// resolve the hostnames of the leases.
+	LocalDomainName string `yaml:"local_domain_name"`
+
 	Conf4 V4ServerConf `yaml:"dhcpv4"`
 	Conf6 V6ServerConf `yaml:"dhcpv6"`
 
@@ -108,6 +114,11 @@ type Server struct {
 
 	// Called when the leases DB is modified
 	onLeaseChanged []OnLeaseChangedT
+
+	// ready is closed once the server has loaded its leases and started.
+	// readyOnce makes sure it's only closed once.
+	ready     chan struct{}
+	readyOnce sync.Once
 }
 
 // ServerInterface is an interface for servers.
@@ -118,10 +129,13 @@ type ServerInterface interface {
 
 // Create - create object
 func Create(config ServerConfig) *Server {
-	s := &Server{}
+	s := &Server{
+		ready: make(chan struct{}),
+	}
 
 	s.conf.Enabled = config.Enabled
 	s.conf.InterfaceName = config.InterfaceName
+	s.conf.LocalDomainName = config.LocalDomainName
 	s.conf.HTTPRegister = config.HTTPRegister
 	s.conf.ConfigModified = config.ConfigModified
 	s.conf.DBFilePath = filepath.Join(config.WorkDir, dbFilename)
@@ -151,6 +165,7 @@ func Create(config ServerConfig) *Server {
 		v4conf.Enabled = false
 	}
 	v4conf.InterfaceName = s.conf.InterfaceName
+	v4conf.domainName = s.conf.LocalDomainName
 	v4conf.notify = s.onNotify
 	s.srv4, err4 = v4Create(v4conf)
 
@@ -211,6 +226,7 @@ func (s *Server) notify(flags int) {
 func (s *Server) WriteDiskConfig(c *ServerConfig) {
 	c.Enabled = s.conf.Enabled
 	c.InterfaceName = s.conf.InterfaceName
+	c.LocalDomainName = s.conf.LocalDomainName
 	s.srv4.WriteDiskConfig4(&c.Conf4)
 	s.srv6.WriteDiskConfig6(&c.Conf6)
 }
@@ -229,9 +245,17 @@ func (s *Server) Start() error {
 		return err
 	}
 
+	s.readyOnce.Do(func() { close(s.ready) })
+
 	return nil
 }
 
+// Ready returns a channel which is closed once the server has loaded its
+// leases and started successfully.
+func (s *Server) Ready() (ready <-chan struct{}) {
+	return s.ready
+}
+
 // Stop closes the listening UDP socket
 func (s *Server) Stop() {
 	s.srv4.Stop()
@@ -118,6 +118,7 @@ func (s *Server) handleDHCPSetConfig(w http.ResponseWriter, r *http.Request) {
 		c4 := V4ServerConf{}
 		s.srv4.WriteDiskConfig4(&c4)
 		v4conf.notify = c4.notify
+		v4conf.domainName = s.conf.LocalDomainName
 		v4conf.ICMPTimeout = c4.ICMPTimeout
 
 		s4, err = v4Create(v4conf)
@@ -68,6 +68,10 @@ type V4ServerConf struct {
 	subnetMask net.IPMask    // value for Option SubnetMask
 	options    []dhcpOption
 
+	// domainName is the local search domain advertised in the options 15
+	// and 119.  Empty string means that it's not advertised.
+	domainName string
+
 	// Server calls this function when leases data changes
 	notify func(uint32)
 }
@@ -14,6 +14,7 @@ import (
 	"github.com/go-ping/ping"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	"github.com/insomniacslk/dhcp/rfc1035label"
 )
 
 // v4Server is a DHCPv4 server.
@@ -514,6 +515,12 @@ func (s *v4Server) process(req, resp *dhcpv4.DHCPv4) int {
 	resp.UpdateOption(dhcpv4.OptRouter(s.conf.routerIP))
 	resp.UpdateOption(dhcpv4.OptSubnetMask(s.conf.subnetMask))
 	resp.UpdateOption(dhcpv4.OptDNS(s.conf.dnsIPAddrs...))
+	if s.conf.domainName != "" {
+		resp.UpdateOption(dhcpv4.OptDomainName(s.conf.domainName))
+		resp.UpdateOption(dhcpv4.OptDomainSearch(&rfc1035label.Labels{
+			Labels: []string{s.conf.domainName},
+		}))
+	}
 
 	for _, opt := range s.conf.options {
 		resp.Options[opt.code] = opt.val
@@ -236,3 +236,37 @@ func TestV4DynamicLeaseGet(t *testing.T) {
 	assert.False(t, ip4InRange(start, stop, net.IP{192, 168, 11, 201}))
 	assert.True(t, ip4InRange(start, stop, net.IP{192, 168, 10, 100}))
 }
+
+func TestV4LocalDomainName(t *testing.T) {
+	conf := V4ServerConf{
+		Enabled:    true,
+		RangeStart: net.IP{192, 168, 10, 100},
+		RangeEnd:   net.IP{192, 168, 10, 200},
+		GatewayIP:  net.IP{192, 168, 10, 1},
+		SubnetMask: net.IP{255, 255, 255, 0},
+		notify:     notify4,
+		domainName: "lan",
+	}
+	sIface, err := v4Create(conf)
+	s := sIface.(*v4Server)
+	assert.Nil(t, err)
+	s.conf.dnsIPAddrs = []net.IP{{192, 168, 10, 1}}
+
+	mac, _ := net.ParseMAC("aa:aa:aa:aa:aa:aa")
+	req, _ := dhcpv4.NewDiscovery(mac)
+	resp, _ := dhcpv4.NewReplyFromRequest(req)
+	assert.Equal(t, 1, s.process(req, resp))
+
+	assert.Equal(t, "lan", resp.DomainName())
+	if search := resp.DomainSearch(); assert.NotNil(t, search) {
+		assert.Equal(t, []string{"lan"}, search.Labels)
+	}
+
+	// The domain isn't advertised if it's not configured.
+	s.conf.domainName = ""
+	resp, _ = dhcpv4.NewReplyFromRequest(req)
+	assert.Equal(t, 1, s.process(req, resp))
+
+	assert.Empty(t, resp.DomainName())
+	assert.Nil(t, resp.DomainSearch())
+}
@@ -0,0 +1,126 @@
+package dnsfilter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSFilter_ReturnAllMatches(t *testing.T) {
+	blockFilters := []Filter{{
+		ID:   1,
+		Data: []byte("||example.org^\n"),
+	}, {
+		ID:   2,
+		Data: []byte("0.0.0.0 www.example.org\n||example.org^$ctag=device_tv\n"),
+	}, {
+		ID:   3,
+		Data: []byte("||www.example.org^$important\n"),
+	}}
+
+	winning := []*ResultRule{{
+		FilterListID: 3,
+		Text:         "||www.example.org^$important",
+	}}
+
+	allBlock := []*ResultRule{{
+		FilterListID: 1,
+		Text:         "||example.org^",
+	}, {
+		FilterListID: 2,
+		Text:         "0.0.0.0 www.example.org",
+		IP:           net.IP{0, 0, 0, 0},
+	}, {
+		FilterListID: 3,
+		Text:         "||www.example.org^$important",
+	}}
+
+	assertRules := func(t *testing.T, want, got []*ResultRule) {
+		t.Helper()
+
+		if assert.Len(t, got, len(want)) {
+			for i, w := range want {
+				assert.Equal(t, w.FilterListID, got[i].FilterListID)
+				assert.Equal(t, w.Text, got[i].Text)
+				assert.True(t, w.IP.Equal(got[i].IP))
+			}
+		}
+	}
+
+	testCases := []struct {
+		name      string
+		allMatch  bool
+		monitor   []Filter
+		allow     []Filter
+		wantRules []*ResultRule
+		wantAll   []*ResultRule
+		wantRes   Reason
+	}{{
+		name:      "default",
+		allMatch:  false,
+		wantRules: winning,
+		wantAll:   nil,
+		wantRes:   FilteredBlockList,
+	}, {
+		name:      "all",
+		allMatch:  true,
+		wantRules: winning,
+		wantAll:   allBlock,
+		wantRes:   FilteredBlockList,
+	}, {
+		name:     "allowlist",
+		allMatch: true,
+		allow: []Filter{{
+			ID:   4,
+			Data: []byte("@@||www.example.org^\n"),
+		}},
+		wantRules: []*ResultRule{{
+			FilterListID: 4,
+			Text:         "@@||www.example.org^",
+		}},
+		wantAll: append(allBlock[:len(allBlock):len(allBlock)], &ResultRule{
+			FilterListID: 4,
+			Text:         "@@||www.example.org^",
+		}),
+		wantRes: NotFilteredAllowList,
+	}, {
+		name:     "monitor",
+		allMatch: true,
+		monitor: []Filter{{
+			ID:          5,
+			Data:        []byte("||example.org^$dnstype=A\n"),
+			MonitorOnly: true,
+		}},
+		wantRules: winning,
+		wantAll: append(allBlock[:len(allBlock):len(allBlock)], &ResultRule{
+			FilterListID: 5,
+			Text:         "||example.org^$dnstype=A",
+		}),
+		wantRes: FilteredBlockList,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewForTest(&Config{ReturnAllMatches: tc.allMatch}, nil)
+			t.Cleanup(d.Close)
+
+			filters := append(blockFilters[:len(blockFilters):len(blockFilters)], tc.monitor...)
+			assert.Nil(t, d.SetFilters(filters, tc.allow, false))
+
+			setts := d.GetConfig()
+			setts.FilteringEnabled = true
+			res, err := d.CheckHost("www.example.org", dns.TypeA, &setts)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.wantRes, res.Reason)
+			assert.Equal(t, tc.wantRes == FilteredBlockList, res.IsFiltered)
+
+			// The other matching rules, including the hosts ones,
+			// never make it into the answer.
+			assertRules(t, tc.wantRules, res.Rules)
+			assert.Empty(t, res.IPList)
+			assertRules(t, tc.wantAll, res.AllRules)
+		})
+	}
+}
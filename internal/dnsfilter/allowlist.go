@@ -0,0 +1,30 @@
+package dnsfilter
+
+import (
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// isImportant returns true if r is a network rule with the $important
+// modifier.
+func isImportant(r *rules.NetworkRule) (ok bool) {
+	return r != nil && r.IsOptionEnabled(rules.OptionImportant)
+}
+
+// overrideAllowImportant makes the blocklists win over the allowlist match m
+// if they have a matching blocking rule with the $important modifier, unless
+// the allowlist rule has it as well.  This is the same precedence as the one
+// of the rules within a single list.  d.engineLock is expected to be locked.
+func (d *DNSFilter) overrideAllowImportant(m *engineMatch) {
+	if !d.hasBlockEngines() || isImportant(m.dnsres.NetworkRule) {
+		return
+	}
+
+	dnsres, ok := d.matchBlockEngines(m.ureq)
+	if !ok {
+		return
+	}
+
+	if r := dnsres.NetworkRule; isImportant(r) && !r.Whitelist {
+		m.dnsres, m.ok, m.allowed = dnsres, true, false
+	}
+}
@@ -0,0 +1,86 @@
+package dnsfilter
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSFilter_allowlistGrammar(t *testing.T) {
+	const blockRules = `||example.com^
+||important.example.com^$important
+||important-allowed.example.com^$important
+`
+
+	const allowRules = `@@||*.trusted.example.com^
+/^regex[0-9]+\.example\.com$/
+@@||important.example.com^
+@@||important-allowed.example.com^$important
+`
+
+	filters := []Filter{{
+		ID: 0, Data: []byte(blockRules),
+	}}
+	d := NewForTest(nil, filters)
+	t.Cleanup(d.Close)
+
+	err := d.SetFilters(filters, []Filter{{
+		ID: 0, Data: []byte(allowRules),
+	}}, false)
+	assert.Nil(t, err)
+
+	testCases := []struct {
+		name     string
+		host     string
+		wantRule string
+		want     Reason
+	}{{
+		name:     "wildcard_allow",
+		host:     "www.trusted.example.com",
+		wantRule: "@@||*.trusted.example.com^",
+		want:     NotFilteredAllowList,
+	}, {
+		name:     "wildcard_allow_deep",
+		host:     "a.b.trusted.example.com",
+		wantRule: "@@||*.trusted.example.com^",
+		want:     NotFilteredAllowList,
+	}, {
+		name:     "wildcard_no_match",
+		host:     "untrusted.example.com",
+		wantRule: "||example.com^",
+		want:     FilteredBlockList,
+	}, {
+		name:     "regex_allow",
+		host:     "regex42.example.com",
+		wantRule: `/^regex[0-9]+\.example\.com$/`,
+		want:     NotFilteredAllowList,
+	}, {
+		name:     "regex_no_match",
+		host:     "regexabc.example.com",
+		wantRule: "||example.com^",
+		want:     FilteredBlockList,
+	}, {
+		name:     "important_beats_allow",
+		host:     "important.example.com",
+		wantRule: "||important.example.com^$important",
+		want:     FilteredBlockList,
+	}, {
+		name:     "important_allow_beats_important",
+		host:     "important-allowed.example.com",
+		wantRule: "@@||important-allowed.example.com^$important",
+		want:     NotFilteredAllowList,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, cerr := d.CheckHost(tc.host, dns.TypeA, &setts)
+			assert.Nil(t, cerr)
+			assert.Equal(t, tc.want, res.Reason)
+			assert.Equal(t, tc.want == FilteredBlockList, res.IsFiltered)
+			if assert.Len(t, res.Rules, 1) {
+				assert.Equal(t, tc.wantRule, res.Rules[0].Text)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/urlfilter/filterlist"
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// badfilterListID is the ID of the rule list which contains the $badfilter
+// rules from all filter lists.  It's added to every filtering engine, so that
+// a $badfilter rule disables the rule it negates in any filter list, not only
+// in the lists sharing an engine with it.
+const badfilterListID = -1
+
+// maxRuleLineLen is the maximum length of a line in the filter lists scanned
+// for the $badfilter and the $denyallow rules.
+const maxRuleLineLen = 1024 * 1024
+
+// listsScan is the result of scanning the filter lists.
+type listsScan struct {
+	// rulesCounts are the numbers of rules in the filter lists by their
+	// IDs.  The lists which files don't exist are omitted.
+	rulesCounts map[int64]int
+
+	// aliases are the alias lines in the /etc/hosts syntax from the filter
+	// lists by the aliased hosts.  See parseHostsAlias.
+	aliases map[string]hostsAlias
+
+	// reverse are the reverse lookup entries made of the lines in the
+	// /etc/hosts syntax from the filter lists by the addresses.  See
+	// parseHostsReverse.
+	reverse map[string]hostsReverse
+
+	// badfilters are the sorted $badfilter rules from the filter lists
+	// joined by newlines.  The duplicates are removed.
+	badfilters string
+
+	// denyallow are the blocking rules with the $denyallow modifier from
+	// the filter lists in their order.  See newDenyallowIndex.
+	denyallow []denyallowRule
+
+	// denyallowBad are the texts of the $denyallow rules disabled by the
+	// $badfilter rules.
+	denyallowBad map[string]struct{}
+
+	// hasDNSType is true if some of the lists may have the rules with the
+	// $dnstype modifier.
+	hasDNSType bool
+}
+
+// scanFilterLists scans the filter lists for the $badfilter rules, the
+// $denyallow rules, the $dnstype modifiers, the aliases, and the reverse
+// lookup entries and counts their rules.
+func scanFilterLists(lists ...[]Filter) (scan listsScan, err error) {
+	scan.rulesCounts = map[int64]int{}
+	scan.aliases = map[string]hostsAlias{}
+	scan.reverse = map[string]hostsReverse{}
+	scan.denyallowBad = map[string]struct{}{}
+	set := map[string]struct{}{}
+	for _, filters := range lists {
+		for _, f := range filters {
+			err = scanFilterList(f, set, &scan)
+			if err != nil {
+				return listsScan{}, err
+			}
+		}
+	}
+
+	if len(set) == 0 {
+		return scan, nil
+	}
+
+	rs := make([]string, 0, len(set))
+	for r := range set {
+		rs = append(rs, r)
+	}
+	sort.Strings(rs)
+	scan.badfilters = strings.Join(rs, "\n")
+
+	return scan, nil
+}
+
+// scanFilterList adds the $badfilter rules from the filter list f to set and
+// updates the rest of scan.
+func scanFilterList(f Filter, set map[string]struct{}, scan *listsScan) (err error) {
+	var r io.Reader
+	if f.ID == 0 || f.Data != nil {
+		var data []byte
+		data, err = decompressFilterData(f.Data)
+		if err != nil {
+			return fmt.Errorf("filter list %d: %w", f.ID, err)
+		}
+
+		r = bytes.NewReader(data)
+	} else if !fileExists(f.FilePath) {
+		return nil
+	} else {
+		var file *os.File
+		file, err = os.Open(f.FilePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		r = file
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxRuleLineLen)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '!' || line[0] == '#' {
+			continue
+		}
+
+		scan.rulesCounts[f.ID]++
+
+		if a, ok := parseHostsAlias(line, f.ID); ok {
+			// The first alias of a host wins, just like the
+			// first address in the /etc/hosts syntax does.
+			if _, ok = scan.aliases[a.host]; !ok {
+				scan.aliases[a.host] = a
+			}
+
+			continue
+		}
+
+		if ip, r, ok := parseHostsReverse(line, f.ID); ok {
+			// The first line with an address wins, just like
+			// the first address of a host does.
+			addr := ip.String()
+			if _, ok = scan.reverse[addr]; !ok {
+				scan.reverse[addr] = r
+			}
+		}
+
+		scanDenyallowLine(line, f, scan)
+
+		// False positives only make the matching for several query
+		// types slower, see matchHostTypes.
+		scan.hasDNSType = scan.hasDNSType || strings.Contains(line, "dnstype")
+		if !strings.Contains(line, "badfilter") {
+			continue
+		}
+
+		nr, nerr := rules.NewNetworkRule(line, int(f.ID))
+		if nerr != nil || !nr.IsOptionEnabled(rules.OptionBadfilter) {
+			continue
+		}
+
+		set[line] = struct{}{}
+	}
+
+	return s.Err()
+}
+
+// badfilterList returns the rule list with the $badfilter rules or nil if
+// there are none.
+func badfilterList(text string) (list filterlist.RuleList) {
+	if text == "" {
+		return nil
+	}
+
+	return &filterlist.StringRuleList{
+		ID:             badfilterListID,
+		RulesText:      text,
+		IgnoreCosmetic: true,
+	}
+}
@@ -0,0 +1,125 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBadfilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsfilter")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	newFilter := func(id int64, prio int, text string) (f Filter) {
+		f = Filter{
+			ID:       id,
+			FilePath: filepath.Join(dir, fmt.Sprintf("%d.txt", id)),
+			Priority: prio,
+		}
+		assert.Nil(t, ioutil.WriteFile(f.FilePath, []byte(text), 0o644))
+
+		return f
+	}
+
+	testCases := []struct {
+		name       string
+		a          string
+		b          string
+		prioA      int
+		prioB      int
+		wantReason Reason
+	}{{
+		name:       "other_list",
+		a:          "||example.org^\n",
+		b:          "||example.org^$badfilter\n",
+		wantReason: NotFilteredNotFound,
+	}, {
+		name:       "other_priority",
+		a:          "||example.org^\n",
+		b:          "||example.org^$badfilter\n",
+		prioA:      10,
+		wantReason: NotFilteredNotFound,
+	}, {
+		name:       "other_modifiers",
+		a:          "||example.org^$important\n",
+		b:          "||example.org^$badfilter\n",
+		wantReason: FilteredBlockList,
+	}, {
+		name:       "same_modifiers",
+		a:          "||example.org^$important\n",
+		b:          "||example.org^$important,badfilter\n",
+		wantReason: NotFilteredNotFound,
+	}, {
+		name:       "other_pattern",
+		a:          "||example.org^\n",
+		b:          "||example.com^$badfilter\n",
+		wantReason: FilteredBlockList,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewForTest(nil, []Filter{
+				newFilter(1, tc.prioA, tc.a),
+				newFilter(2, tc.prioB, tc.b),
+			})
+			defer d.Close()
+
+			res, cerr := d.CheckHost("example.org", dns.TypeA, &setts)
+			assert.Nil(t, cerr)
+			assert.Equal(t, tc.wantReason, res.Reason)
+		})
+	}
+
+	t.Run("allowlist", func(t *testing.T) {
+		d := NewForTest(nil, nil)
+		defer d.Close()
+
+		block := []Filter{
+			newFilter(1, 0, "||example.org^\n"),
+			newFilter(2, 0, "@@||example.org^$badfilter\n"),
+		}
+		allow := []Filter{
+			newFilter(3, 0, "@@||example.org^\n"),
+		}
+		assert.Nil(t, d.SetFilters(block, allow, false))
+
+		res, cerr := d.CheckHost("example.org", dns.TypeA, &setts)
+		assert.Nil(t, cerr)
+		assert.Equal(t, FilteredBlockList, res.Reason)
+	})
+}
+
+func TestScanFilterLists(t *testing.T) {
+	scan, err := scanFilterLists([]Filter{{
+		ID: 0,
+		Data: []byte("||b.example^$badfilter\n" +
+			"||a.example^$badfilter\n" +
+			"||badfilter.example^\n" +
+			"! ||c.example^$badfilter\n"),
+	}}, []Filter{{
+		ID:   0,
+		Data: []byte("||a.example^$badfilter\n"),
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, "||a.example^$badfilter\n||b.example^$badfilter", scan.badfilters)
+	assert.False(t, scan.hasDNSType)
+	assert.Equal(t, map[int64]int{0: 4}, scan.rulesCounts)
+
+	scan, err = scanFilterLists([]Filter{{
+		ID:       1,
+		FilePath: "non-existent",
+	}}, []Filter{{
+		ID:   0,
+		Data: []byte("||a.example^$dnstype=AAAA\n"),
+	}})
+	assert.Nil(t, err)
+	assert.Empty(t, scan.badfilters)
+	assert.True(t, scan.hasDNSType)
+	assert.Equal(t, map[int64]int{0: 1}, scan.rulesCounts)
+}
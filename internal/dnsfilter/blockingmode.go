@@ -0,0 +1,119 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Blocking modes, see RequestFilteringSettings.BlockingMode.
+const (
+	// BlockingModeDefault means that the blocked hosts are answered with
+	// the IP addresses from the matched rules in the /etc/hosts syntax, and
+	// with the unspecified IP addresses otherwise.
+	BlockingModeDefault = "default"
+
+	// BlockingModeNXDomain means that the blocked hosts are answered with
+	// NXDOMAIN.
+	BlockingModeNXDomain = "nxdomain"
+
+	// BlockingModeNullIP means that the blocked hosts are answered with the
+	// unspecified IP addresses, 0.0.0.0 and ::.
+	BlockingModeNullIP = "null_ip"
+
+	// BlockingModeCustomIP means that the blocked hosts are answered with
+	// RequestFilteringSettings.BlockingIPv4 and
+	// RequestFilteringSettings.BlockingIPv6.
+	BlockingModeCustomIP = "custom_ip"
+
+	// BlockingModeRefused means that the blocked hosts are answered with
+	// REFUSED.
+	BlockingModeRefused = "refused"
+)
+
+// ValidateBlockingMode returns an error if mode isn't a valid blocking mode or
+// if the custom IP addresses it requires are invalid.  An empty mode is valid
+// and means BlockingModeDefault.
+func ValidateBlockingMode(mode string, ipv4, ipv6 net.IP) (err error) {
+	switch mode {
+	case "", BlockingModeDefault, BlockingModeNXDomain, BlockingModeNullIP, BlockingModeRefused:
+		return nil
+	case BlockingModeCustomIP:
+		if ipv4.To4() == nil {
+			return fmt.Errorf("invalid blocking ipv4 %q", ipv4)
+		}
+
+		if ipv6 != nil && ipv6.To16() == nil {
+			return fmt.Errorf("invalid blocking ipv6 %q", ipv6)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("invalid blocking mode %q", mode)
+	}
+}
+
+// setBlocking sets the blocking mode of res and the IP addresses the blocked
+// host of qtype must be answered with, if res is blocking.  The blocking mode
+// is taken from setts, which the users of the package fill with the one of
+// the client or the global one.
+func (d *DNSFilter) setBlocking(res *Result, qtype uint16, setts *RequestFilteringSettings) {
+	if !res.IsFiltered ||
+		res.Reason == FilteredSafeSearch ||
+		res.DNSRewriteResult != nil {
+		return
+	}
+
+	mode := setts.BlockingMode
+	if mode == "" {
+		mode = BlockingModeDefault
+	}
+
+	res.BlockingMode = mode
+	res.BlockingIPs = blockingIPs(res, mode, qtype, setts.BlockingIPv4, setts.BlockingIPv6)
+}
+
+// blockingIPs returns the IP addresses the blocked host of qtype must be
+// answered with in mode.  If ipv6 isn't set in the BlockingModeCustomIP mode,
+// the AAAA queries are answered without any addresses.
+func blockingIPs(res *Result, mode string, qtype uint16, ipv4, ipv6 net.IP) (ips []net.IP) {
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		return nil
+	}
+
+	switch mode {
+	case BlockingModeNullIP:
+		// Go on.
+	case BlockingModeCustomIP:
+		if qtype == dns.TypeA {
+			return []net.IP{ipv4}
+		} else if ipv6 != nil {
+			return []net.IP{ipv6}
+		}
+
+		return nil
+	case BlockingModeDefault:
+		for _, r := range res.Rules {
+			if r.IP == nil {
+				continue
+			}
+
+			if isIPv4 := r.IP.To4() != nil; isIPv4 == (qtype == dns.TypeA) {
+				ips = append(ips, r.IP)
+			}
+		}
+
+		if len(ips) > 0 {
+			return ips
+		}
+	default:
+		return nil
+	}
+
+	if qtype == dns.TypeA {
+		return []net.IP{net.IPv4zero}
+	}
+
+	return []net.IP{net.IPv6zero}
+}
@@ -0,0 +1,120 @@
+package dnsfilter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBlockingMode(t *testing.T) {
+	assert.Nil(t, ValidateBlockingMode("", nil, nil))
+	assert.Nil(t, ValidateBlockingMode(BlockingModeNXDomain, nil, nil))
+	assert.Nil(t, ValidateBlockingMode(BlockingModeCustomIP, net.IP{1, 2, 3, 4}, nil))
+
+	assert.NotNil(t, ValidateBlockingMode(BlockingModeCustomIP, nil, nil))
+	assert.NotNil(t, ValidateBlockingMode("bad", nil, nil))
+}
+
+func TestDNSFilter_CheckHost_blockingMode(t *testing.T) {
+	const text = "||example.org^\n1.2.3.4 hosts.example.org\n"
+	d := NewForTest(nil, []Filter{{ID: 0, Data: []byte(text)}})
+	defer d.Close()
+
+	customIPv4 := net.IP{5, 6, 7, 8}
+	customIPv6 := net.ParseIP("2001:db8::1")
+
+	testCases := []struct {
+		name     string
+		mode     string
+		ipv6     net.IP
+		host     string
+		qtype    uint16
+		wantMode string
+		wantIPs  []net.IP
+	}{{
+		name:     "unset",
+		mode:     "",
+		host:     "example.org",
+		qtype:    dns.TypeA,
+		wantMode: BlockingModeDefault,
+		wantIPs:  []net.IP{net.IPv4zero},
+	}, {
+		name:     "default_hosts",
+		mode:     BlockingModeDefault,
+		host:     "hosts.example.org",
+		qtype:    dns.TypeA,
+		wantMode: BlockingModeDefault,
+		wantIPs:  []net.IP{net.IP{1, 2, 3, 4}.To16()},
+	}, {
+		name:     "default_hosts_aaaa",
+		mode:     BlockingModeDefault,
+		host:     "hosts.example.org",
+		qtype:    dns.TypeAAAA,
+		wantMode: BlockingModeDefault,
+		wantIPs:  []net.IP{net.IPv6zero},
+	}, {
+		name:     "nxdomain",
+		mode:     BlockingModeNXDomain,
+		host:     "example.org",
+		qtype:    dns.TypeA,
+		wantMode: BlockingModeNXDomain,
+		wantIPs:  nil,
+	}, {
+		name:     "null_ip",
+		mode:     BlockingModeNullIP,
+		host:     "example.org",
+		qtype:    dns.TypeAAAA,
+		wantMode: BlockingModeNullIP,
+		wantIPs:  []net.IP{net.IPv6zero},
+	}, {
+		name:     "custom_ip",
+		mode:     BlockingModeCustomIP,
+		ipv6:     customIPv6,
+		host:     "example.org",
+		qtype:    dns.TypeAAAA,
+		wantMode: BlockingModeCustomIP,
+		wantIPs:  []net.IP{customIPv6},
+	}, {
+		name:     "custom_ipv4_only",
+		mode:     BlockingModeCustomIP,
+		host:     "example.org",
+		qtype:    dns.TypeAAAA,
+		wantMode: BlockingModeCustomIP,
+		wantIPs:  nil,
+	}, {
+		name:     "refused_txt",
+		mode:     BlockingModeRefused,
+		host:     "example.org",
+		qtype:    dns.TypeTXT,
+		wantMode: BlockingModeRefused,
+		wantIPs:  nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			modeSetts := setts
+			modeSetts.BlockingMode = tc.mode
+			modeSetts.BlockingIPv4 = customIPv4
+			modeSetts.BlockingIPv6 = tc.ipv6
+
+			res, err := d.CheckHost(tc.host, tc.qtype, &modeSetts)
+			assert.Nil(t, err)
+			assert.True(t, res.IsFiltered)
+			assert.Equal(t, tc.wantMode, res.BlockingMode)
+			assert.Equal(t, tc.wantIPs, res.BlockingIPs)
+		})
+	}
+
+	t.Run("not_blocked", func(t *testing.T) {
+		modeSetts := setts
+		modeSetts.BlockingMode = BlockingModeNullIP
+
+		res, err := d.CheckHost("example.com", dns.TypeA, &modeSetts)
+		assert.Nil(t, err)
+		assert.False(t, res.IsFiltered)
+		assert.Empty(t, res.BlockingMode)
+		assert.Empty(t, res.BlockingIPs)
+	})
+}
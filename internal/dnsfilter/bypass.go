@@ -0,0 +1,33 @@
+package dnsfilter
+
+import "fmt"
+
+// bypassableReasons are the filtering reasons which a client may bypass.
+var bypassableReasons = []Reason{
+	FilteredBlockList,
+	FilteredSafeBrowsing,
+	FilteredParental,
+	FilteredSafeSearch,
+	FilteredBlockedService,
+	FilteredTLD,
+	FilteredDGA,
+}
+
+// ParseBypassReason returns the filtering reason named s, for example
+// "FilteredSafeBrowsing".  It returns an error if s isn't a name of a reason
+// which a client may bypass.
+func ParseBypassReason(s string) (r Reason, err error) {
+	for _, r = range bypassableReasons {
+		if r.String() == s {
+			return r, nil
+		}
+	}
+
+	return NotFilteredNotFound, fmt.Errorf("unknown or non-bypassable filtering reason %q", s)
+}
+
+// bypassed returns true if the result of a check with reason r must be
+// ignored for the client.
+func (setts *RequestFilteringSettings) bypassed(r Reason) (ok bool) {
+	return r.In(setts.BypassReasons...)
+}
@@ -0,0 +1,83 @@
+package dnsfilter
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBypassReason(t *testing.T) {
+	r, err := ParseBypassReason("FilteredSafeBrowsing")
+	assert.Nil(t, err)
+	assert.Equal(t, FilteredSafeBrowsing, r)
+
+	r, err = ParseBypassReason("FilteredBlackList")
+	assert.Nil(t, err)
+	assert.Equal(t, FilteredBlockList, r)
+
+	_, err = ParseBypassReason("Rewrite")
+	assert.NotNil(t, err)
+
+	_, err = ParseBypassReason("unknown")
+	assert.NotNil(t, err)
+}
+
+func TestDNSFilter_CheckHost_bypass(t *testing.T) {
+	const (
+		sbHost      = "malware.example"
+		blockedHost = "blocked.example"
+	)
+
+	d := NewForTest(&Config{SafeBrowsingEnabled: true}, []Filter{{
+		ID:   0,
+		Data: []byte("||" + blockedHost + "^\n"),
+	}})
+	t.Cleanup(d.Close)
+
+	ups := &testSbUpstream{
+		hostname: sbHost,
+		block:    true,
+	}
+	d.safeBrowsingUpstream = ups
+
+	sandbox := &RequestFilteringSettings{
+		FilteringEnabled:    true,
+		SafeBrowsingEnabled: true,
+		ClientName:          "sandbox",
+		BypassReasons:       []Reason{FilteredSafeBrowsing},
+	}
+	other := &RequestFilteringSettings{
+		FilteringEnabled:    true,
+		SafeBrowsingEnabled: true,
+		ClientName:          "other",
+	}
+
+	t.Run("sandbox_safebrowsing", func(t *testing.T) {
+		res, err := d.CheckHost(sbHost, dns.TypeA, sandbox)
+		assert.Nil(t, err)
+		assert.False(t, res.IsFiltered)
+		assert.Equal(t, NotFilteredNotFound, res.Reason)
+	})
+
+	t.Run("sandbox_blocklist", func(t *testing.T) {
+		res, err := d.CheckHost(blockedHost, dns.TypeA, sandbox)
+		assert.Nil(t, err)
+		assert.True(t, res.IsFiltered)
+		assert.Equal(t, FilteredBlockList, res.Reason)
+	})
+
+	t.Run("other_safebrowsing", func(t *testing.T) {
+		res, err := d.CheckHost(sbHost, dns.TypeA, other)
+		assert.Nil(t, err)
+		assert.True(t, res.IsFiltered)
+		assert.Equal(t, FilteredSafeBrowsing, res.Reason)
+	})
+
+	t.Run("other_blocklist", func(t *testing.T) {
+		res, err := d.CheckHost(blockedHost, dns.TypeA, other)
+		assert.Nil(t, err)
+		assert.True(t, res.IsFiltered)
+		assert.Equal(t, FilteredBlockList, res.Reason)
+	})
+}
@@ -0,0 +1,118 @@
+package dnsfilter
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/golibs/cache"
+)
+
+// cacheCounters are the counters of the lookups in a cache.  The zero value
+// is ready for use, and a nil *cacheCounters ignores all updates.
+type cacheCounters struct {
+	hits    uint64
+	misses  uint64
+	expired uint64
+}
+
+// hit counts a successful lookup.
+func (c *cacheCounters) hit() {
+	if c != nil {
+		atomic.AddUint64(&c.hits, 1)
+	}
+}
+
+// miss counts a failed lookup.
+func (c *cacheCounters) miss() {
+	if c != nil {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+// expire counts an expired entry found during a lookup.
+func (c *cacheCounters) expire() {
+	if c != nil {
+		atomic.AddUint64(&c.expired, 1)
+	}
+}
+
+// CacheStats are the statistics of a lookup cache.
+type CacheStats struct {
+	// Count is the number of entries in the cache.
+	Count int `json:"count"`
+	// Size is the total size of the entries in the cache, in bytes.
+	Size int `json:"size"`
+	// MaxSize is the configured maximum size of the cache, in bytes.
+	MaxSize uint `json:"max_size"`
+	// Hits is the number of lookups which found a fresh entry.
+	Hits uint64 `json:"hits"`
+	// Misses is the number of lookups which didn't.
+	Misses uint64 `json:"misses"`
+	// HitRate is Hits divided by the total number of lookups.
+	HitRate float64 `json:"hit_rate"`
+	// Expired is the number of expired entries found during the lookups,
+	// which are then removed or replaced.  The entries removed by the cache
+	// itself to free space for the new ones aren't counted, since the cache
+	// doesn't report them.
+	Expired uint64 `json:"expired"`
+}
+
+// newCacheStats returns the statistics of c with the lookup counters cnt.
+func newCacheStats(c cache.Cache, maxSize uint, cnt *cacheCounters) (s CacheStats) {
+	s = CacheStats{
+		MaxSize: maxSize,
+		Hits:    atomic.LoadUint64(&cnt.hits),
+		Misses:  atomic.LoadUint64(&cnt.misses),
+		Expired: atomic.LoadUint64(&cnt.expired),
+	}
+
+	if total := s.Hits + s.Misses; total != 0 {
+		s.HitRate = float64(s.Hits) / float64(total)
+	}
+
+	if c != nil {
+		cs := c.Stats()
+		s.Count = cs.Count
+		s.Size = cs.Size
+	}
+
+	return s
+}
+
+// LookupCachesStats are the statistics of the caches of the safe browsing,
+// parental control, and safe search lookups.
+type LookupCachesStats struct {
+	SafeBrowsing CacheStats `json:"safebrowsing"`
+	Parental     CacheStats `json:"parental"`
+	SafeSearch   CacheStats `json:"safesearch"`
+}
+
+// CachesStats returns the statistics of the lookup caches.
+func (d *DNSFilter) CachesStats() (s LookupCachesStats) {
+	return LookupCachesStats{
+		SafeBrowsing: newCacheStats(
+			gctx.safebrowsingCache,
+			d.Config.SafeBrowsingCacheSize,
+			&gctx.safebrowsingCounters,
+		),
+		Parental: newCacheStats(
+			gctx.parentalCache,
+			d.Config.ParentalCacheSize,
+			&gctx.parentalCounters,
+		),
+		SafeSearch: newCacheStats(
+			gctx.safeSearchCache,
+			d.Config.SafeSearchCacheSize,
+			&gctx.safeSearchCounters,
+		),
+	}
+}
+
+func (d *DNSFilter) handleCachesStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(d.CachesStats())
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
@@ -0,0 +1,98 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheStats(t *testing.T) {
+	const maxSize = 1024
+
+	c := cache.New(cache.Config{
+		MaxSize:   maxSize,
+		EnableLRU: true,
+	})
+	cnt := &cacheCounters{}
+	d := &DNSFilter{}
+	d.CacheTime = 30
+
+	_, ok := getCachedResult(c, cnt, "example.org")
+	assert.False(t, ok)
+
+	d.setCacheResult(c, "example.org", Result{IsFiltered: true})
+	_, ok = getCachedResult(c, cnt, "example.org")
+	assert.True(t, ok)
+
+	s := newCacheStats(c, maxSize, cnt)
+	assert.Equal(t, uint64(1), s.Hits)
+	assert.Equal(t, uint64(1), s.Misses)
+	assert.Equal(t, 0.5, s.HitRate)
+	assert.Equal(t, uint64(0), s.Expired)
+	assert.Equal(t, 1, s.Count)
+	assert.Greater(t, s.Size, 0)
+	assert.Equal(t, uint(maxSize), s.MaxSize)
+
+	t.Run("expired", func(t *testing.T) {
+		d.CacheTime = 0
+		d.setCacheResult(c, "expired.example.org", Result{})
+		_, ok = getCachedResult(c, cnt, "expired.example.org")
+		assert.False(t, ok)
+
+		s = newCacheStats(c, maxSize, cnt)
+		assert.Equal(t, uint64(1), s.Expired)
+		assert.Equal(t, uint64(2), s.Misses)
+		assert.Equal(t, 1, s.Count)
+	})
+
+	t.Run("cap", func(t *testing.T) {
+		d.CacheTime = 30
+		for i := 0; i < 100; i++ {
+			d.setCacheResult(c, fmt.Sprintf("host-%d.example.org", i), Result{})
+		}
+
+		s = newCacheStats(c, maxSize, cnt)
+		assert.Greater(t, s.Count, 1)
+		assert.LessOrEqual(t, s.Size, maxSize)
+	})
+}
+
+func TestCacheCounters_parallel(t *testing.T) {
+	const (
+		workers = 16
+		lookups = 1000
+	)
+
+	c := cache.New(cache.Config{
+		MaxSize:   64 * 1024,
+		EnableLRU: true,
+	})
+	cnt := &cacheCounters{}
+	d := &DNSFilter{}
+	d.CacheTime = 30
+
+	d.setCacheResult(c, "cached.example.org", Result{IsFiltered: true})
+
+	wg := &sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < lookups; j++ {
+				_, _ = getCachedResult(c, cnt, "cached.example.org")
+				_, _ = getCachedResult(c, cnt, "missing.example.org")
+			}
+		}()
+	}
+	wg.Wait()
+
+	s := newCacheStats(c, 64*1024, cnt)
+	assert.Equal(t, uint64(workers*lookups), s.Hits)
+	assert.Equal(t, uint64(workers*lookups), s.Misses)
+	assert.Equal(t, 0.5, s.HitRate)
+	assert.Equal(t, 1, s.Count)
+}
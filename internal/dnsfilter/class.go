@@ -0,0 +1,98 @@
+package dnsfilter
+
+import (
+	"strings"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/miekg/dns"
+)
+
+// classTagPrefix is the prefix of the client tags which are added to the
+// requests with classes other than IN.  Rules like
+//
+//	||version.bind^$ctag=class_chaos
+//
+// only block the requests of that class.  The rules without such a tag are
+// intended for the IN class and never match the requests of other classes.
+const classTagPrefix = "class_"
+
+// classNames are the names of the classes used in the client tags.  The other
+// classes use the lowercased names from the dns package.
+var classNames = map[uint16]string{
+	dns.ClassCHAOS:  "chaos",
+	dns.ClassHESIOD: "hesiod",
+}
+
+// isClassIN returns true if qclass is IN.  Zero is considered to be IN, so
+// that the settings without the class are handled as before.
+func isClassIN(qclass uint16) (ok bool) {
+	return qclass == 0 || qclass == dns.ClassINET
+}
+
+// classTag returns the client tag of the request class or an empty string if
+// the class is IN.
+func classTag(qclass uint16) (tag string) {
+	if isClassIN(qclass) {
+		return ""
+	}
+
+	name, ok := classNames[qclass]
+	if !ok {
+		name = strings.ToLower(dns.Class(qclass).String())
+	}
+
+	return classTagPrefix + name
+}
+
+// scopeToClass removes the rules which aren't scoped to the class of the
+// request by the class tag from res, which is the result of matching host and
+// qtype with setts.  If no rules are left, the result is reset.
+func scopeToClass(res Result, host string, qtype uint16, setts *RequestFilteringSettings) (scoped Result) {
+	tag := classTag(setts.QClass)
+	if tag == "" {
+		return res
+	}
+
+	withTag := newRulesRequest(newURLFilterRequest(host, qtype, setts))
+
+	withoutTag := *withTag
+	withoutTag.SortedClientTags = make([]string, 0, len(withTag.SortedClientTags))
+	for _, t := range withTag.SortedClientTags {
+		if t != tag {
+			withoutTag.SortedClientTags = append(withoutTag.SortedClientTags, t)
+		}
+	}
+
+	monitorRules := classRules(res.MonitorRules, withTag, &withoutTag)
+
+	scopedRules := classRules(res.Rules, withTag, &withoutTag)
+	if len(scopedRules) == 0 {
+		return Result{MonitorRules: monitorRules}
+	}
+
+	res.Rules = scopedRules
+	res.MonitorRules = monitorRules
+
+	return res
+}
+
+// classRules returns the network rules which match withTag, the request with
+// the class tag, but not withoutTag, the same request without it.  That is,
+// the rules with the class tag among the permitted $ctag values.  The rules
+// with the negated tag, the tags which only start with it, or without $ctag
+// at all are removed.
+func classRules(rs []*ResultRule, withTag, withoutTag *rules.Request) (filtered []*ResultRule) {
+	for _, r := range rs {
+		nr, err := rules.NewNetworkRule(r.Text, int(r.FilterListID))
+		if err != nil {
+			// Not a network rule, so it has no $ctag.
+			continue
+		}
+
+		if nr.Match(withTag) && !nr.Match(withoutTag) {
+			filtered = append(filtered, r)
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,131 @@
+package dnsfilter
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassRules(t *testing.T) {
+	const text = "||version.bind^\n" +
+		"||hostname.bind^$ctag=class_chaos\n" +
+		"||hesiod.example^$dnstype=TXT,ctag=class_hesiod\n" +
+		"0.0.0.0 hosts.bind\n" +
+		"||class_chaos.example^\n" +
+		"||negated.example^$ctag=~class_chaos_extra\n" +
+		"||prefix.example^$ctag=class_chaos_extra|device_pc\n" +
+		"||device.example^$ctag=class_chaos|device_pc\n"
+	d := NewForTest(nil, []Filter{{
+		ID: 0, Data: []byte(text),
+	}})
+	defer d.Close()
+
+	testCases := []struct {
+		name   string
+		host   string
+		qtype  uint16
+		tags   []string
+		qclass uint16
+		want   bool
+	}{{
+		name:   "in_rule_in",
+		host:   "version.bind",
+		qtype:  dns.TypeTXT,
+		qclass: dns.ClassINET,
+		want:   true,
+	}, {
+		name:   "in_rule_zero_class",
+		host:   "version.bind",
+		qtype:  dns.TypeTXT,
+		qclass: 0,
+		want:   true,
+	}, {
+		name:   "in_rule_chaos",
+		host:   "version.bind",
+		qtype:  dns.TypeTXT,
+		qclass: dns.ClassCHAOS,
+		want:   false,
+	}, {
+		name:   "hosts_rule_chaos",
+		host:   "hosts.bind",
+		qtype:  dns.TypeA,
+		qclass: dns.ClassCHAOS,
+		want:   false,
+	}, {
+		name:   "chaos_rule_chaos",
+		host:   "hostname.bind",
+		qtype:  dns.TypeTXT,
+		qclass: dns.ClassCHAOS,
+		want:   true,
+	}, {
+		name:   "chaos_rule_in",
+		host:   "hostname.bind",
+		qtype:  dns.TypeTXT,
+		qclass: dns.ClassINET,
+		want:   false,
+	}, {
+		name:   "chaos_rule_hesiod",
+		host:   "hostname.bind",
+		qtype:  dns.TypeTXT,
+		qclass: dns.ClassHESIOD,
+		want:   false,
+	}, {
+		name:   "hesiod_policy_txt",
+		host:   "hesiod.example",
+		qtype:  dns.TypeTXT,
+		qclass: dns.ClassHESIOD,
+		want:   true,
+	}, {
+		name:   "hesiod_policy_a",
+		host:   "hesiod.example",
+		qtype:  dns.TypeA,
+		qclass: dns.ClassHESIOD,
+		want:   false,
+	}, {
+		name:   "tag_in_host",
+		host:   "class_chaos.example",
+		qtype:  dns.TypeA,
+		qclass: dns.ClassCHAOS,
+		want:   false,
+	}, {
+		name:   "negated_tag_prefix",
+		host:   "negated.example",
+		qtype:  dns.TypeA,
+		qclass: dns.ClassCHAOS,
+		want:   false,
+	}, {
+		name:   "tag_prefix",
+		host:   "prefix.example",
+		qtype:  dns.TypeA,
+		tags:   []string{"device_pc"},
+		qclass: dns.ClassCHAOS,
+		want:   false,
+	}, {
+		name:   "tag_among_others",
+		host:   "device.example",
+		qtype:  dns.TypeA,
+		qclass: dns.ClassCHAOS,
+		want:   true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := setts
+			s.QClass = tc.qclass
+			s.ClientTags = tc.tags
+
+			res, err := d.CheckHost(tc.host, tc.qtype, &s)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, res.IsFiltered)
+		})
+	}
+}
+
+func TestClassTag(t *testing.T) {
+	assert.Equal(t, "", classTag(0))
+	assert.Equal(t, "", classTag(dns.ClassINET))
+	assert.Equal(t, "class_chaos", classTag(dns.ClassCHAOS))
+	assert.Equal(t, "class_hesiod", classTag(dns.ClassHESIOD))
+	assert.Equal(t, "class_any", classTag(dns.ClassANY))
+}
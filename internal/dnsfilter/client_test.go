@@ -0,0 +1,87 @@
+package dnsfilter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientRules(t *testing.T) {
+	const text = "||ip.example^$client=192.168.1.50\n" +
+		"||cidr.example^$client=192.168.2.0/24\n" +
+		"||name.example^\n" +
+		"@@||name.example^$client='Kids Tablet'\n" +
+		"||negation.example^$client=~192.168.1.50\n"
+	d := NewForTest(nil, []Filter{{
+		ID: 0, Data: []byte(text),
+	}})
+	defer d.Close()
+
+	testCases := []struct {
+		name       string
+		host       string
+		clientIP   net.IP
+		clientName string
+		want       bool
+	}{{
+		name:     "ip_match",
+		host:     "ip.example",
+		clientIP: net.IP{192, 168, 1, 50},
+		want:     true,
+	}, {
+		name:     "ip_mismatch",
+		host:     "ip.example",
+		clientIP: net.IP{192, 168, 1, 51},
+		want:     false,
+	}, {
+		name: "ip_no_client",
+		host: "ip.example",
+		want: false,
+	}, {
+		name:     "cidr_match",
+		host:     "cidr.example",
+		clientIP: net.IP{192, 168, 2, 10},
+		want:     true,
+	}, {
+		name:     "cidr_mismatch",
+		host:     "cidr.example",
+		clientIP: net.IP{192, 168, 3, 10},
+		want:     false,
+	}, {
+		name:       "name_match",
+		host:       "name.example",
+		clientIP:   net.IP{192, 168, 1, 60},
+		clientName: "Kids Tablet",
+		want:       false,
+	}, {
+		name:       "name_mismatch",
+		host:       "name.example",
+		clientIP:   net.IP{192, 168, 1, 60},
+		clientName: "Laptop",
+		want:       true,
+	}, {
+		name:     "negation_match",
+		host:     "negation.example",
+		clientIP: net.IP{192, 168, 1, 50},
+		want:     false,
+	}, {
+		name:     "negation_mismatch",
+		host:     "negation.example",
+		clientIP: net.IP{192, 168, 1, 51},
+		want:     true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := setts
+			s.ClientIP = tc.clientIP
+			s.ClientName = tc.clientName
+
+			res, err := d.CheckHost(tc.host, dns.TypeA, &s)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, res.IsFiltered)
+		})
+	}
+}
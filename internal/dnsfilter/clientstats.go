@@ -0,0 +1,172 @@
+package dnsfilter
+
+import (
+	"sort"
+	"sync"
+)
+
+// ClientStat are the filtering statistics of a client.
+type ClientStat struct {
+	// Name is the name of the client.
+	Name string `json:"name"`
+
+	// Requests is the number of the checked requests of the client.
+	Requests uint64 `json:"requests"`
+
+	// Blocked is the number of the blocked requests of the client with any
+	// of the filtering reasons.
+	Blocked uint64 `json:"blocked"`
+
+	// BlockedByBlockList is the number of the requests blocked by the
+	// filter lists.
+	BlockedByBlockList uint64 `json:"blocked_by_blocklist"`
+
+	// BlockedByService is the number of the requests blocked by the blocked
+	// services.
+	BlockedByService uint64 `json:"blocked_by_service"`
+
+	// BlockedByParental is the number of the requests blocked by the
+	// parental control.
+	BlockedByParental uint64 `json:"blocked_by_parental"`
+}
+
+// clientStatsCtx accumulates the filtering statistics of the clients.  The
+// zero value is ready for use.
+type clientStatsCtx struct {
+	// lock protects stats.
+	lock sync.Mutex
+
+	// stats are the statistics by the names of the clients.  It's created
+	// on first use.
+	stats map[string]*ClientStat
+}
+
+// update counts the result res of checking a request of the client with the
+// name name.  The requests of the unnamed clients aren't counted.  isResp is
+// true if res is the result of checking the response to the request, which
+// has already been counted, so only the blocking is counted.
+func (c *clientStatsCtx) update(name string, res Result, isResp bool) {
+	if name == "" {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.stats == nil {
+		c.stats = map[string]*ClientStat{}
+	}
+
+	s, ok := c.stats[name]
+	if !ok {
+		s = &ClientStat{Name: name}
+		c.stats[name] = s
+	}
+
+	if !isResp {
+		s.Requests++
+	}
+
+	if !res.IsFiltered {
+		return
+	}
+
+	s.Blocked++
+	switch res.Reason {
+	case FilteredBlockList:
+		s.BlockedByBlockList++
+	case FilteredBlockedService:
+		s.BlockedByService++
+	case FilteredParental:
+		s.BlockedByParental++
+	default:
+		// Go on.
+	}
+}
+
+// ClientStats returns the filtering statistics of the client with the name
+// name.  Only the Name of s is set if there are none.
+func (d *DNSFilter) ClientStats(name string) (s ClientStat) {
+	c := &d.clientStats
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if cs, ok := c.stats[name]; ok {
+		return *cs
+	}
+
+	return ClientStat{Name: name}
+}
+
+// TopBlockedClients returns the statistics of at most n clients with the most
+// blocked requests in descending order.  The clients without blocked requests
+// are omitted.
+func (d *DNSFilter) TopBlockedClients(n int) (top []ClientStat) {
+	if n <= 0 {
+		return nil
+	}
+
+	c := &d.clientStats
+	c.lock.Lock()
+	for _, cs := range c.stats {
+		if cs.Blocked != 0 {
+			top = append(top, *cs)
+		}
+	}
+	c.lock.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Blocked != top[j].Blocked {
+			return top[i].Blocked > top[j].Blocked
+		}
+
+		return top[i].Name < top[j].Name
+	})
+
+	if len(top) > n {
+		top = top[:n]
+	}
+
+	return top
+}
+
+// SetClientStats replaces the filtering statistics of the client with the name
+// s.Name with s, for example to restore them from an export.  The statistics of
+// the unnamed clients are ignored.
+func (d *DNSFilter) SetClientStats(s ClientStat) {
+	if s.Name == "" {
+		return
+	}
+
+	c := &d.clientStats
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.stats == nil {
+		c.stats = map[string]*ClientStat{}
+	}
+
+	c.stats[s.Name] = &s
+}
+
+// RenameClientStats moves the filtering statistics of the client with the name
+// prev to name, for example when the client is renamed.  The previous
+// statistics under name, if any, are replaced.
+func (d *DNSFilter) RenameClientStats(prev, name string) {
+	if prev == name || name == "" {
+		return
+	}
+
+	c := &d.clientStats
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s, ok := c.stats[prev]
+	if !ok {
+		return
+	}
+
+	delete(c.stats, prev)
+	s.Name = name
+	c.stats[name] = s
+}
@@ -0,0 +1,185 @@
+package dnsfilter
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSFilter_ClientStats(t *testing.T) {
+	d := NewForTest(&Config{ParentalEnabled: true}, []Filter{{
+		ID: 0, Data: []byte("||blocked.example^\n"),
+	}})
+	t.Cleanup(d.Close)
+
+	d.parentalUpstream = &testSbUpstream{
+		hostname: "adult.example",
+		block:    true,
+	}
+
+	rule, err := rules.NewNetworkRule("||service.example^", 0)
+	assert.Nil(t, err)
+
+	cliSetts := setts
+	cliSetts.ClientName = "cli"
+	cliSetts.ParentalEnabled = true
+	cliSetts.ServicesRules = []ServiceEntry{{
+		Name:  "service",
+		Rules: []*rules.NetworkRule{rule},
+	}}
+
+	for _, host := range []string{
+		"blocked.example",
+		"blocked.example",
+		"service.example",
+		"adult.example",
+		"allowed.example",
+	} {
+		_, err = d.CheckHost(host, dns.TypeA, &cliSetts)
+		assert.Nil(t, err)
+	}
+
+	otherSetts := setts
+	otherSetts.ClientName = "other"
+	_, err = d.CheckHost("blocked.example", dns.TypeA, &otherSetts)
+	assert.Nil(t, err)
+
+	// The unnamed clients aren't counted.
+	_, err = d.CheckHost("blocked.example", dns.TypeA, &setts)
+	assert.Nil(t, err)
+
+	assert.Equal(t, ClientStat{
+		Name:               "cli",
+		Requests:           5,
+		Blocked:            4,
+		BlockedByBlockList: 2,
+		BlockedByService:   1,
+		BlockedByParental:  1,
+	}, d.ClientStats("cli"))
+	assert.Equal(t, ClientStat{Name: "unknown"}, d.ClientStats("unknown"))
+	assert.Equal(t, ClientStat{Name: ""}, d.ClientStats(""))
+
+	top := d.TopBlockedClients(10)
+	if assert.Len(t, top, 2) {
+		assert.Equal(t, "cli", top[0].Name)
+		assert.Equal(t, "other", top[1].Name)
+	}
+
+	top = d.TopBlockedClients(1)
+	if assert.Len(t, top, 1) {
+		assert.Equal(t, "cli", top[0].Name)
+	}
+
+	assert.Empty(t, d.TopBlockedClients(0))
+}
+
+func TestDNSFilter_FinishResponseCheck(t *testing.T) {
+	var hosts []string
+	d := NewForTest(&Config{
+		OnResult: func(host string, _ uint16, _ Result, _ string) {
+			hosts = append(hosts, host)
+		},
+	}, []Filter{{
+		ID: 0, Data: []byte("||tracker.example^\n"),
+	}})
+	t.Cleanup(d.Close)
+
+	cliSetts := setts
+	cliSetts.ClientName = "cli"
+
+	_, err := d.CheckHost("alias.example", dns.TypeA, &cliSetts)
+	assert.Nil(t, err)
+
+	start := time.Now()
+	res, err := d.CheckCNAMETarget("tracker.example.", dns.TypeA, &cliSetts)
+	assert.Nil(t, err)
+	assert.True(t, res.IsFiltered)
+
+	d.FinishResponseCheck(res.CNAMETarget, dns.TypeA, res, &cliSetts, start)
+
+	assert.Equal(t, []string{"alias.example", "tracker.example"}, hosts)
+	assert.Equal(t, ClientStat{
+		Name:               "cli",
+		Requests:           1,
+		Blocked:            1,
+		BlockedByBlockList: 1,
+	}, d.ClientStats("cli"))
+}
+
+func TestDNSFilter_ClientStats_concurrent(t *testing.T) {
+	d := NewForTest(nil, []Filter{{
+		ID: 0, Data: []byte("||blocked.example^\n"),
+	}})
+	t.Cleanup(d.Close)
+
+	const goroutines, requests = 8, 100
+
+	wg := &sync.WaitGroup{}
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+
+			s := setts
+			s.ClientName = "cli"
+			for j := 0; j < requests; j++ {
+				_, _ = d.CheckHost("blocked.example", dns.TypeA, &s)
+				_ = d.TopBlockedClients(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	s := d.ClientStats("cli")
+	assert.Equal(t, uint64(goroutines*requests), s.Requests)
+	assert.Equal(t, uint64(goroutines*requests), s.BlockedByBlockList)
+}
+
+func TestDNSFilter_SetClientStats(t *testing.T) {
+	d := NewForTest(nil, []Filter{{
+		ID: 0, Data: []byte("||blocked.example^\n"),
+	}})
+	t.Cleanup(d.Close)
+
+	d.SetClientStats(ClientStat{
+		Name:               "cli",
+		Requests:           10,
+		Blocked:            3,
+		BlockedByBlockList: 3,
+	})
+	d.SetClientStats(ClientStat{Requests: 1})
+
+	cliSetts := setts
+	cliSetts.ClientName = "cli"
+	_, err := d.CheckHost("blocked.example", dns.TypeA, &cliSetts)
+	assert.Nil(t, err)
+
+	// The restored statistics keep being updated.
+	assert.Equal(t, ClientStat{
+		Name:               "cli",
+		Requests:           11,
+		Blocked:            4,
+		BlockedByBlockList: 4,
+	}, d.ClientStats("cli"))
+	assert.Equal(t, ClientStat{}, d.ClientStats(""))
+}
+
+func TestDNSFilter_RenameClientStats(t *testing.T) {
+	d := NewForTest(nil, nil)
+	t.Cleanup(d.Close)
+
+	d.SetClientStats(ClientStat{Name: "old", Requests: 10})
+	d.SetClientStats(ClientStat{Name: "taken", Requests: 1})
+
+	d.RenameClientStats("old", "taken")
+	assert.Equal(t, ClientStat{Name: "taken", Requests: 10}, d.ClientStats("taken"))
+	assert.Equal(t, ClientStat{Name: "old"}, d.ClientStats("old"))
+
+	// Renaming a client without statistics does nothing.
+	d.RenameClientStats("none", "taken")
+	assert.Equal(t, ClientStat{Name: "taken", Requests: 10}, d.ClientStats("taken"))
+}
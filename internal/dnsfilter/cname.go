@@ -0,0 +1,32 @@
+package dnsfilter
+
+import (
+	"strings"
+)
+
+// CheckCNAMETarget matches the CNAME target from an upstream answer against
+// the filtering rules only.  It's a lighter-weight alternative to resolving
+// the whole chain of CNAMEs, which still catches the trackers only
+// identifiable by the domain their CNAME points to.  If the target matches,
+// the result is attributed to it with CNAMETarget.
+func (d *DNSFilter) CheckCNAMETarget(
+	target string,
+	qtype uint16,
+	setts *RequestFilteringSettings,
+) (res Result, err error) {
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+	if target == "" {
+		return Result{}, nil
+	}
+
+	res, err = d.CheckHostRules(target, qtype, setts)
+	if err != nil {
+		return res, err
+	}
+
+	if res.Reason.Matched() {
+		res.CNAMETarget = target
+	}
+
+	return res, nil
+}
@@ -0,0 +1,73 @@
+package dnsfilter
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckCNAMETarget(t *testing.T) {
+	const text = "||tracker.example.com^\n@@||allowed.tracker.example.com^\n"
+	d := NewForTest(nil, []Filter{{
+		ID: 0, Data: []byte(text),
+	}})
+	defer d.Close()
+
+	testCases := []struct {
+		name         string
+		target       string
+		wantTarget   string
+		wantRule     string
+		wantFiltered bool
+	}{{
+		name:         "blocked",
+		target:       "Tracker.Example.Com.",
+		wantTarget:   "tracker.example.com",
+		wantRule:     "||tracker.example.com^",
+		wantFiltered: true,
+	}, {
+		name:         "blocked_subdomain",
+		target:       "cdn.tracker.example.com.",
+		wantTarget:   "cdn.tracker.example.com",
+		wantRule:     "||tracker.example.com^",
+		wantFiltered: true,
+	}, {
+		name:         "allowed",
+		target:       "allowed.tracker.example.com.",
+		wantTarget:   "allowed.tracker.example.com",
+		wantRule:     "@@||allowed.tracker.example.com^",
+		wantFiltered: false,
+	}, {
+		name:         "clean",
+		target:       "cdn.example.org.",
+		wantTarget:   "",
+		wantRule:     "",
+		wantFiltered: false,
+	}, {
+		name:         "root",
+		target:       ".",
+		wantTarget:   "",
+		wantRule:     "",
+		wantFiltered: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.CheckCNAMETarget(tc.target, dns.TypeA, &setts)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.wantFiltered, res.IsFiltered)
+			assert.Equal(t, tc.wantTarget, res.CNAMETarget)
+
+			if tc.wantRule == "" {
+				assert.Empty(t, res.Rules)
+
+				return
+			}
+
+			if assert.Len(t, res.Rules, 1) {
+				assert.Equal(t, tc.wantRule, res.Rules[0].Text)
+			}
+		})
+	}
+}
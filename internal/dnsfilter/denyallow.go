@@ -0,0 +1,294 @@
+package dnsfilter
+
+import (
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// denyallowOption is the prefix of the $denyallow modifier of a rule.
+const denyallowOption = "denyallow="
+
+// denyallowRule is a blocking rule with the $denyallow modifier, for example:
+//
+//	||org^$denyallow=example.org|example.net
+//
+// It blocks the hosts matched by its pattern except for the domains listed in
+// the modifier and their subdomains.  The exemption only applies to the rule
+// itself, so the exempted hosts are still blocked by the other rules.
+type denyallowRule struct {
+	// domain is the domain matched by the pattern of the rule.  It's empty
+	// if the pattern matches all hosts.
+	domain string
+
+	// text is the text of the line.
+	text string
+
+	// allowed are the domains exempted from the rule.
+	allowed []string
+
+	// listID is the ID of the filter list containing the line.
+	listID int64
+
+	// priority is the priority of the filter list containing the line.
+	priority int
+
+	// pos is the position of the rule among the $denyallow rules from all
+	// blocklists, which defines the precedence of the rules matching the
+	// same host.
+	pos int
+
+	// exact is true if the pattern only matches domain itself and not its
+	// subdomains.
+	exact bool
+}
+
+// parseDenyallowRule parses line as a blocking rule with the $denyallow
+// modifier.  ok is false if line isn't one.  The supported patterns are "*",
+// "||domain^", and "|domain^".  The rules with other modifiers are left to the
+// filtering engine.
+func parseDenyallowRule(line string, listID int64) (r denyallowRule, ok bool) {
+	if strings.HasPrefix(line, "@@") {
+		return denyallowRule{}, false
+	}
+
+	i := strings.LastIndexByte(line, '$')
+	if i < 0 {
+		return denyallowRule{}, false
+	}
+
+	pattern, opts := line[:i], line[i+1:]
+	if !strings.HasPrefix(opts, denyallowOption) {
+		return denyallowRule{}, false
+	}
+
+	allowed := strings.Split(strings.ToLower(opts[len(denyallowOption):]), "|")
+	for _, a := range allowed {
+		if !isPlainHost(a) {
+			log.Debug("dnsfilter: unsupported $denyallow rule %q", line)
+
+			return denyallowRule{}, false
+		}
+	}
+
+	r = denyallowRule{
+		text:    line,
+		allowed: allowed,
+		listID:  listID,
+	}
+
+	switch {
+	case pattern == "*":
+		// Go on.
+	case strings.HasPrefix(pattern, "||") && strings.HasSuffix(pattern, "^"):
+		r.domain = strings.ToLower(pattern[2 : len(pattern)-1])
+	case strings.HasPrefix(pattern, "|") && strings.HasSuffix(pattern, "^"):
+		r.domain = strings.ToLower(pattern[1 : len(pattern)-1])
+		r.exact = true
+	default:
+		log.Debug("dnsfilter: unsupported $denyallow rule %q", line)
+
+		return denyallowRule{}, false
+	}
+
+	if r.domain != "" && !isPlainHost(r.domain) {
+		log.Debug("dnsfilter: unsupported $denyallow rule %q", line)
+
+		return denyallowRule{}, false
+	}
+
+	return r, true
+}
+
+// isSubdomainOrSelf returns true if host is domain or its subdomain.
+func isSubdomainOrSelf(host, domain string) (ok bool) {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// matches returns true if r blocks host.
+func (r denyallowRule) matches(host string) (ok bool) {
+	if r.exact {
+		if host != r.domain {
+			return false
+		}
+	} else if r.domain != "" && !isSubdomainOrSelf(host, r.domain) {
+		return false
+	}
+
+	for _, a := range r.allowed {
+		if isSubdomainOrSelf(host, a) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// denyallowBadfilter returns the text of the $denyallow rule which line
+// disables if it's a $badfilter rule.
+func denyallowBadfilter(line string) (negated string, ok bool) {
+	i := strings.LastIndexByte(line, '$')
+	if i < 0 {
+		return "", false
+	}
+
+	opts := strings.Split(line[i+1:], ",")
+	kept := opts[:0]
+	for _, o := range opts {
+		if o == "badfilter" {
+			ok = true
+		} else {
+			kept = append(kept, o)
+		}
+	}
+
+	if !ok {
+		return "", false
+	}
+
+	return line[:i+1] + strings.Join(kept, ","), true
+}
+
+// scanDenyallowLine adds the $denyallow rule or the $badfilter rule disabling
+// one from the line of the filter list f to scan.
+func scanDenyallowLine(line string, f Filter, scan *listsScan) {
+	if !strings.Contains(line, denyallowOption) {
+		return
+	}
+
+	if negated, ok := denyallowBadfilter(line); ok {
+		scan.denyallowBad[negated] = struct{}{}
+	} else if r, ok := parseDenyallowRule(line, f.ID); ok {
+		r.priority = f.Priority
+		scan.denyallow = append(scan.denyallow, r)
+	}
+}
+
+// denyallowIndex contains the $denyallow rules from the blocklists indexed by
+// the domains matched by their patterns.
+type denyallowIndex struct {
+	// domains are the rules with the "||domain^" and the "|domain^"
+	// patterns by the domains.
+	domains map[string][]denyallowRule
+
+	// priorities are the priorities of the blocklists by their IDs.
+	priorities map[int64]int
+
+	// all are the rules with the "*" pattern.
+	all []denyallowRule
+}
+
+// newDenyallowIndex returns the index of the $denyallow rules from scan which
+// belong to the blocklists filters and aren't disabled by the $badfilter
+// rules.  It returns nil if there are no such rules.
+func newDenyallowIndex(scan listsScan, filters []Filter) (idx *denyallowIndex) {
+	if len(scan.denyallow) == 0 {
+		return nil
+	}
+
+	priorities := make(map[int64]int, len(filters))
+	for _, f := range filters {
+		priorities[f.ID] = f.Priority
+	}
+
+	idx = &denyallowIndex{
+		domains:    map[string][]denyallowRule{},
+		priorities: priorities,
+	}
+
+	pos := 0
+	for _, r := range scan.denyallow {
+		if _, ok := priorities[r.listID]; !ok {
+			continue
+		} else if _, ok = scan.denyallowBad[r.text]; ok {
+			continue
+		}
+
+		r.pos = pos
+		pos++
+
+		if r.domain == "" {
+			idx.all = append(idx.all, r)
+		} else {
+			idx.domains[r.domain] = append(idx.domains[r.domain], r)
+		}
+	}
+
+	if pos == 0 {
+		return nil
+	}
+
+	return idx
+}
+
+// match returns the first of the rules from idx in the order of the lists
+// which blocks host.  ok is false if there is none.
+func (idx *denyallowIndex) match(host string) (r denyallowRule, ok bool) {
+	if idx == nil {
+		return denyallowRule{}, false
+	}
+
+	consider := func(rs []denyallowRule) {
+		for _, c := range rs {
+			if (!ok || c.pos < r.pos) && c.matches(host) {
+				r, ok = c, true
+			}
+		}
+	}
+
+	for name := host; name != ""; {
+		consider(idx.domains[name])
+
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+
+		name = name[i+1:]
+	}
+
+	consider(idx.all)
+
+	return r, ok
+}
+
+// matchDenyallow returns the result of the first $denyallow rule blocking
+// host.  res is the result of matching host against the other rules in m,
+// which is returned if no such rule blocks it.  The other rules win, unless
+// they are from a blocklist with a lower priority than the one of the
+// $denyallow rule and don't have the $important modifier, see
+// matchBlockEngines.  The allowlists always win.  d.engineLock is expected to
+// be locked.
+func (d *DNSFilter) matchDenyallow(host string, m *engineMatch, res Result) (denyRes Result) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	r, ok := d.denyallow.match(host)
+	if !ok {
+		return res
+	}
+
+	if res.Reason.Matched() {
+		if m.allowed ||
+			len(d.priorityEngines) == 0 ||
+			len(res.Rules) == 0 ||
+			(!d.PriorityOverridesImportant && isImportant(m.dnsres.NetworkRule)) {
+			return res
+		}
+
+		prio, known := d.denyallow.priorities[res.Rules[0].FilterListID]
+		if !known || prio >= r.priority {
+			return res
+		}
+	}
+
+	log.Debug("Filtering: found rule for host %q: %q  list_id: %d", host, r.text, r.listID)
+
+	return Result{
+		IsFiltered: true,
+		Reason:     FilteredBlockList,
+		Rules: []*ResultRule{{
+			FilterListID: r.listID,
+			Text:         r.text,
+		}},
+		MonitorRules: res.MonitorRules,
+	}
+}
@@ -0,0 +1,265 @@
+package dnsfilter
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDenyallowRule(t *testing.T) {
+	testCases := []struct {
+		name   string
+		line   string
+		want   denyallowRule
+		wantOK bool
+	}{{
+		name: "all",
+		line: "*$denyallow=example.com|Example.ORG",
+		want: denyallowRule{
+			text:    "*$denyallow=example.com|Example.ORG",
+			allowed: []string{"example.com", "example.org"},
+			listID:  1,
+		},
+		wantOK: true,
+	}, {
+		name: "domain",
+		line: "||org^$denyallow=example.org",
+		want: denyallowRule{
+			domain:  "org",
+			text:    "||org^$denyallow=example.org",
+			allowed: []string{"example.org"},
+			listID:  1,
+		},
+		wantOK: true,
+	}, {
+		name: "exact",
+		line: "|example.net^$denyallow=sub.example.net",
+		want: denyallowRule{
+			domain:  "example.net",
+			text:    "|example.net^$denyallow=sub.example.net",
+			allowed: []string{"sub.example.net"},
+			listID:  1,
+			exact:   true,
+		},
+		wantOK: true,
+	}, {
+		name:   "no_modifier",
+		line:   "||org^",
+		wantOK: false,
+	}, {
+		name:   "other_modifier",
+		line:   "||org^$denyallow=example.org,client=127.0.0.1",
+		wantOK: false,
+	}, {
+		name:   "allowlist",
+		line:   "@@||org^$denyallow=example.org",
+		wantOK: false,
+	}, {
+		name:   "inverted_domain",
+		line:   "||org^$denyallow=~example.org",
+		wantOK: false,
+	}, {
+		name:   "empty_domain",
+		line:   "||org^$denyallow=example.org|",
+		wantOK: false,
+	}, {
+		name:   "unsupported_pattern",
+		line:   "/org/$denyallow=example.org",
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, ok := parseDenyallowRule(tc.line, 1)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.want, r)
+		})
+	}
+}
+
+func TestDNSFilter_CheckHost_denyallow(t *testing.T) {
+	const (
+		tldRule   = "||org^$denyallow=example.org|example.net"
+		allRule   = "*$denyallow=org|example.net|example.com"
+		blockRule = "||blocked.example.org^"
+	)
+
+	const text = tldRule + "\n" +
+		allRule + "\n" +
+		blockRule + "\n" +
+		"@@||allowed.org^\n" +
+		"||info^$denyallow=example.info\n" +
+		"||info^$denyallow=example.info,badfilter\n"
+
+	d := NewForTest(nil, []Filter{{ID: 0, Data: []byte(text)}})
+	t.Cleanup(d.Close)
+
+	testCases := []struct {
+		name     string
+		host     string
+		wantRule string
+	}{{
+		name:     "tld",
+		host:     "other.org",
+		wantRule: tldRule,
+	}, {
+		name:     "tld_itself",
+		host:     "org",
+		wantRule: tldRule,
+	}, {
+		name:     "all",
+		host:     "example.info",
+		wantRule: allRule,
+	}, {
+		name:     "other_rule",
+		host:     "blocked.example.org",
+		wantRule: blockRule,
+	}, {
+		name:     "exempted",
+		host:     "example.org",
+		wantRule: "",
+	}, {
+		name:     "exempted_subdomain",
+		host:     "www.example.org",
+		wantRule: "",
+	}, {
+		name:     "exempted_all",
+		host:     "example.com",
+		wantRule: "",
+	}, {
+		name:     "exempted_both",
+		host:     "example.net",
+		wantRule: "",
+	}, {
+		name:     "allowlisted",
+		host:     "allowed.org",
+		wantRule: "",
+	}, {
+		name:     "badfilter",
+		host:     "other.info",
+		wantRule: allRule,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.CheckHost(tc.host, dns.TypeA, &setts)
+			assert.Nil(t, err)
+
+			if tc.wantRule == "" {
+				assert.False(t, res.IsFiltered)
+
+				return
+			}
+
+			assert.True(t, res.IsFiltered)
+			assert.Equal(t, FilteredBlockList, res.Reason)
+			if assert.Len(t, res.Rules, 1) {
+				assert.Equal(t, tc.wantRule, res.Rules[0].Text)
+			}
+		})
+	}
+
+	t.Run("monitor", func(t *testing.T) {
+		md := NewForTest(nil, []Filter{{
+			ID: 1, Data: []byte(tldRule + "\n"),
+		}, {
+			ID: 2, Data: []byte("||other.org^\n"), MonitorOnly: true,
+		}})
+		t.Cleanup(md.Close)
+
+		res, err := md.CheckHost("other.org", dns.TypeA, &setts)
+		assert.Nil(t, err)
+		assert.True(t, res.IsFiltered)
+		assert.Len(t, res.MonitorRules, 1)
+	})
+
+	t.Run("multi", func(t *testing.T) {
+		results, err := d.CheckHostMulti("other.org", []uint16{dns.TypeA, dns.TypeAAAA}, &setts)
+		assert.Nil(t, err)
+
+		for _, qt := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			assert.True(t, results[qt].IsFiltered)
+		}
+	})
+}
+
+func TestDNSFilter_CheckHost_denyallowPriority(t *testing.T) {
+	const denyRule = "||org^$denyallow=example.org"
+
+	testCases := []struct {
+		name      string
+		other     string
+		denyPrio  int
+		otherPrio int
+		want      bool
+	}{{
+		name:      "denyallow_higher",
+		other:     "@@||other.org^",
+		denyPrio:  10,
+		otherPrio: 0,
+		want:      true,
+	}, {
+		name:      "denyallow_lower",
+		other:     "@@||other.org^",
+		denyPrio:  0,
+		otherPrio: 10,
+		want:      false,
+	}, {
+		name:      "important",
+		other:     "@@||other.org^$important",
+		denyPrio:  10,
+		otherPrio: 0,
+		want:      false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewForTest(nil, []Filter{{
+				ID: 1, Data: []byte(denyRule + "\n"), Priority: tc.denyPrio,
+			}, {
+				ID: 2, Data: []byte(tc.other + "\n"), Priority: tc.otherPrio,
+			}})
+			t.Cleanup(d.Close)
+
+			res, err := d.CheckHost("other.org", dns.TypeA, &setts)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, res.IsFiltered)
+		})
+	}
+}
+
+func TestDenyallowIndex_match(t *testing.T) {
+	scan := listsScan{
+		denyallowBad: map[string]struct{}{},
+	}
+	for _, line := range []string{
+		"*$denyallow=example.org",
+		"||sub.example.net^$denyallow=allowed.sub.example.net",
+		"||net^$denyallow=example.net",
+	} {
+		r, ok := parseDenyallowRule(line, 1)
+		assert.True(t, ok)
+		scan.denyallow = append(scan.denyallow, r)
+	}
+
+	idx := newDenyallowIndex(scan, []Filter{{ID: 1}})
+	if !assert.NotNil(t, idx) {
+		return
+	}
+
+	// The first rule in the order of the lists wins.
+	r, ok := idx.match("sub.example.net")
+	assert.True(t, ok)
+	assert.Equal(t, "*$denyallow=example.org", r.text)
+
+	// The rule from the list which isn't a blocklist is ignored.
+	assert.Nil(t, newDenyallowIndex(scan, []Filter{{ID: 2}}))
+
+	_, ok = idx.match("example.org")
+	assert.False(t, ok)
+
+	var nilIdx *denyallowIndex
+	_, ok = nilIdx.match("example.org")
+	assert.False(t, ok)
+}
@@ -0,0 +1,41 @@
+package dnsfilter
+
+import (
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// exceedsResolutionDepth returns true if hops is greater than
+// MaxResolutionDepth.  d.confLock is expected to be locked.
+func (d *DNSFilter) exceedsResolutionDepth(hops int) (ok bool) {
+	return d.MaxResolutionDepth != 0 && hops > int(d.MaxResolutionDepth)
+}
+
+// CheckResolutionDepth returns the result with ResolutionDepthExceeded if the
+// CNAME hops of the DNS rewrites in res along with the CNAME records in the
+// upstream answer resp exceed MaxResolutionDepth.  Otherwise it returns nil.
+func (d *DNSFilter) CheckResolutionDepth(res *Result, resp *dns.Msg) (exceeded *Result) {
+	hops := 0
+	if res != nil {
+		hops = res.CNAMEHops
+	}
+
+	if resp != nil {
+		for _, rr := range resp.Answer {
+			if rr.Header().Rrtype == dns.TypeCNAME {
+				hops++
+			}
+		}
+	}
+
+	d.confLock.RLock()
+	defer d.confLock.RUnlock()
+
+	if !d.exceedsResolutionDepth(hops) {
+		return nil
+	}
+
+	log.Debug("dnsfilter: resolution depth %d exceeds %d", hops, d.MaxResolutionDepth)
+
+	return &Result{Reason: ResolutionDepthExceeded}
+}
@@ -0,0 +1,59 @@
+package dnsfilter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSFilter_processRewrites_depth(t *testing.T) {
+	d := &DNSFilter{}
+	d.Rewrites = []RewriteEntry{
+		{Domain: "a.example", Answer: "b.example"},
+		{Domain: "b.example", Answer: "c.example"},
+		{Domain: "c.example", Answer: "1.2.3.4"},
+	}
+	d.prepareRewrites()
+
+	d.MaxResolutionDepth = 2
+	res := d.processRewrites("a.example", dns.TypeA)
+	assert.Equal(t, Rewritten, res.Reason)
+	assert.Equal(t, "c.example", res.CanonName)
+	assert.Equal(t, 2, res.CNAMEHops)
+	if assert.Len(t, res.IPList, 1) {
+		assert.True(t, net.IP{1, 2, 3, 4}.Equal(res.IPList[0]))
+	}
+
+	d.MaxResolutionDepth = 1
+	res = d.processRewrites("a.example", dns.TypeA)
+	assert.Equal(t, ResolutionDepthExceeded, res.Reason)
+	assert.Empty(t, res.IPList)
+}
+
+func TestDNSFilter_CheckResolutionDepth(t *testing.T) {
+	d := &DNSFilter{}
+
+	resp := &dns.Msg{
+		Answer: []dns.RR{
+			&dns.CNAME{Hdr: dns.RR_Header{Rrtype: dns.TypeCNAME}},
+			&dns.CNAME{Hdr: dns.RR_Header{Rrtype: dns.TypeCNAME}},
+			&dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA}},
+		},
+	}
+	res := &Result{CNAMEHops: 1}
+
+	assert.Nil(t, d.CheckResolutionDepth(res, resp))
+
+	d.MaxResolutionDepth = 3
+	assert.Nil(t, d.CheckResolutionDepth(res, resp))
+
+	d.MaxResolutionDepth = 2
+	exceeded := d.CheckResolutionDepth(res, resp)
+	if assert.NotNil(t, exceeded) {
+		assert.Equal(t, ResolutionDepthExceeded, exceeded.Reason)
+	}
+
+	assert.Nil(t, d.CheckResolutionDepth(nil, resp))
+}
@@ -0,0 +1,78 @@
+package dnsfilter
+
+import (
+	"math"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/publicsuffix"
+)
+
+// checkDGA returns a result with the FilteredDGA reason if the DGA heuristics
+// are configured and host without its public suffix is either longer than
+// DGAMaxLength or has an entropy higher than DGAEntropyThreshold.  If
+// DGALogOnly is true, such hosts are only logged.
+func (d *DNSFilter) checkDGA(host string) (res Result) {
+	if d.DGAMaxLength == 0 && d.DGAEntropyThreshold == 0 {
+		return Result{}
+	}
+
+	name := dgaName(host)
+	if name == "" {
+		return Result{}
+	}
+
+	var why string
+	if d.DGAMaxLength != 0 && len(name) > int(d.DGAMaxLength) {
+		why = "length"
+	} else if d.DGAEntropyThreshold != 0 && entropy(name) > d.DGAEntropyThreshold {
+		why = "entropy"
+	} else {
+		return Result{}
+	}
+
+	if d.DGALogOnly {
+		log.Info("dnsfilter: %q looks like a dga host by its %s", host, why)
+
+		return Result{}
+	}
+
+	return Result{
+		IsFiltered: true,
+		Reason:     FilteredDGA,
+	}
+}
+
+// dgaName returns the part of host checked by the DGA heuristics, which is
+// host without its public suffix and dots.
+func dgaName(host string) (name string) {
+	host = strings.TrimSuffix(host, ".")
+	suffix, _ := publicsuffix.PublicSuffix(host)
+	name = strings.TrimSuffix(strings.TrimSuffix(host, suffix), ".")
+
+	return strings.Replace(name, ".", "", -1)
+}
+
+// entropy returns the Shannon entropy of the bytes of s in bits per byte.
+func entropy(s string) (e float64) {
+	if s == "" {
+		return 0
+	}
+
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+
+	n := float64(len(s))
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+
+		p := float64(c) / n
+		e -= p * math.Log2(p)
+	}
+
+	return e
+}
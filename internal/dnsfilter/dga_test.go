@@ -0,0 +1,83 @@
+package dnsfilter
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSFilter_checkDGA(t *testing.T) {
+	filters := []Filter{{
+		ID: 0, Data: []byte("@@||q7z2k9x4w1v8m3p6j5tr.com^\n"),
+	}}
+	d := NewForTest(&Config{
+		DGAMaxLength:        30,
+		DGAEntropyThreshold: 4,
+	}, filters)
+	defer d.Close()
+
+	testCases := []struct {
+		name   string
+		host   string
+		reason Reason
+	}{{
+		name:   "normal",
+		host:   "www.example.com",
+		reason: NotFilteredNotFound,
+	}, {
+		name:   "high_entropy",
+		host:   "xj4k2q9zv7w1m8p3ld6r.com",
+		reason: FilteredDGA,
+	}, {
+		name:   "public_suffix_only",
+		host:   "co.uk",
+		reason: NotFilteredNotFound,
+	}, {
+		name:   "too_long",
+		host:   "aaaaaaaaaabbbbbbbbbbccccccccccdddd.example.com",
+		reason: FilteredDGA,
+	}, {
+		name:   "allowlist",
+		host:   "q7z2k9x4w1v8m3p6j5tr.com",
+		reason: NotFilteredAllowList,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.CheckHost(tc.host, dns.TypeA, &setts)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.reason, res.Reason)
+			assert.Equal(t, tc.reason == FilteredDGA, res.IsFiltered)
+		})
+	}
+
+	t.Run("log_only", func(t *testing.T) {
+		logOnly := NewForTest(&Config{
+			DGAEntropyThreshold: 4,
+			DGALogOnly:          true,
+		}, nil)
+		defer logOnly.Close()
+
+		res, err := logOnly.CheckHost("xj4k2q9zv7w1m8p3ld6r.com", dns.TypeA, &setts)
+		assert.Nil(t, err)
+		assert.False(t, res.IsFiltered)
+		assert.Equal(t, NotFilteredNotFound, res.Reason)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		disabled := NewForTest(nil, nil)
+		defer disabled.Close()
+
+		res, err := disabled.CheckHost("xj4k2q9zv7w1m8p3ld6r.com", dns.TypeA, &setts)
+		assert.Nil(t, err)
+		assert.False(t, res.IsFiltered)
+	})
+}
+
+func TestEntropy(t *testing.T) {
+	assert.Zero(t, entropy(""))
+	assert.Zero(t, entropy("aaaa"))
+	assert.InDelta(t, 1, entropy("abab"), 0.0001)
+	assert.InDelta(t, 4, entropy("0123456789abcdef"), 0.0001)
+}
@@ -2,15 +2,18 @@
 package dnsfilter
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
 	"runtime/debug"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/util"
 	"github.com/AdguardTeam/dnsproxy/upstream"
@@ -39,7 +42,45 @@ type RequestFilteringSettings struct {
 	ClientIP   net.IP
 	ClientTags []string
 
+	// ClientSubnet is the subnet of the real client from the EDNS Client
+	// Subnet option of the query.  If it's not nil, the $client rules are
+	// matched against it instead of ClientIP.
+	ClientSubnet *net.IPNet
+
+	// Transport is the transport of the request, one of the Transport*
+	// constants, or empty if unknown.  It's matched by the rules with the
+	// $ctag=transport_* modifiers.
+	Transport string
+
+	// Interface is the name of the network interface on which the request
+	// has been received, or empty if unknown.  It's matched by the rules
+	// with the $ctag=iface_* modifiers.
+	Interface string
+
+	// QClass is the class of the request.  Zero means IN.  The requests of
+	// the other classes are only matched by the filtering rules with the
+	// $ctag=class_* modifiers, see classTagPrefix.
+	QClass uint16
+
 	ServicesRules []ServiceEntry
+
+	// BypassReasons are the filtering reasons which are ignored for the
+	// client, so that it isn't blocked by the corresponding checks while
+	// the others still apply.
+	BypassReasons []Reason
+
+	// BlockingMode is the blocking mode reported in the results of the
+	// blocked hosts, see BlockingModeDefault and the other modes.  If
+	// empty, BlockingModeDefault is used.  BlockingIPv4 and BlockingIPv6
+	// are its IP addresses for BlockingModeCustomIP.  If BlockingIPv6 is
+	// nil, the AAAA queries are answered without any addresses.
+	BlockingMode string
+	BlockingIPv4 net.IP
+	BlockingIPv6 net.IP
+
+	// AllMatches makes the results of matching the filter lists have
+	// AllRules, which requires scanning all rules of the lists.
+	AllMatches bool
 }
 
 // Config allows you to configure DNS filtering with New() or just change variables directly.
@@ -56,6 +97,102 @@ type Config struct {
 
 	Rewrites []RewriteEntry `yaml:"rewrites"`
 
+	// RewritesShuffle makes the IP addresses of the rewrites answered in
+	// random order, which balances the load between the backends.
+	RewritesShuffle bool `yaml:"rewrites_shuffle"`
+
+	// PriorityOverridesImportant makes the rules from the lists with
+	// higher priorities win over the $important rules from the lists with
+	// lower priorities.
+	PriorityOverridesImportant bool `yaml:"filters_priority_overrides_important"`
+
+	// AllowedTLDs is the list of top-level domains, such as "com" or
+	// "co.uk", which may be resolved.  Hosts in all other TLDs are blocked.
+	// If the list is empty, all TLDs are allowed.
+	AllowedTLDs []string `yaml:"allowed_tlds"`
+
+	// DGAMaxLength is the maximum length of a host without its public
+	// suffix.  Longer hosts are suspected to be generated by a domain
+	// generation algorithm.  If zero, the length isn't checked.
+	DGAMaxLength uint32 `yaml:"dga_max_length"`
+
+	// DGAEntropyThreshold is the maximum Shannon entropy, in bits per
+	// character, of a host without its public suffix.  Hosts with a higher
+	// entropy are suspected to be generated by a domain generation
+	// algorithm.  If zero, the entropy isn't checked.
+	DGAEntropyThreshold float64 `yaml:"dga_entropy_threshold"`
+
+	// DGALogOnly makes the hosts suspected to be generated by a domain
+	// generation algorithm only logged instead of blocked.
+	DGALogOnly bool `yaml:"dga_log_only"`
+
+	// EtcHostsDuplicates is the policy for the multiple rules in the
+	// /etc/hosts syntax which match the same host and address family.  See
+	// EtcHostsDuplicatesFirst and the other policies.
+	EtcHostsDuplicates string `yaml:"etc_hosts_duplicates"`
+
+	// HostsRoundRobin makes CheckHost return the addresses from all rules
+	// in the /etc/hosts syntax which match the host and the query type,
+	// regardless of EtcHostsDuplicates, and rotate them on each call, so
+	// that the clients are spread across the addresses.
+	HostsRoundRobin bool `yaml:"hosts_round_robin"`
+
+	// MaxResolutionDepth is the maximum total number of the CNAME hops of
+	// the DNS rewrites and the CNAME records in the upstream answer for a
+	// single query.  The queries exceeding it are terminated with
+	// ResolutionDepthExceeded.  If zero, there is no limit.
+	MaxResolutionDepth uint32 `yaml:"max_resolution_depth"`
+
+	// SafeSearchCustomIPs are the addresses used instead of the built-in
+	// safe search addresses of the search engines.  The keys are the names
+	// of the engines, for example "google" or "yandex", see
+	// safeSearchEngines.  It's useful in the networks with split-horizon
+	// DNS.
+	SafeSearchCustomIPs map[string]net.IP `yaml:"safesearch_custom_ips"`
+
+	// YouTubeRestrictLevel is the YouTube Restricted Mode level enforced by
+	// the safe search, see YouTubeRestrictModerate and the other levels.
+	// If empty, YouTubeRestrictModerate is used.
+	YouTubeRestrictLevel string `yaml:"youtube_restrict_level"`
+
+	// ReturnAllMatches makes GetConfig return the settings with
+	// AllMatches set, so that the results of the DNS queries, which are
+	// recorded in the query log, and of the host checking API contain all
+	// matching rules from all blocklists and allowlists, which is useful
+	// for debugging the overlapping lists.
+	ReturnAllMatches bool `yaml:"return_all_matches"`
+
+	// SafeBrowsingLocalDB is the path to the local SafeBrowsing hash-prefix
+	// database.  If set, the hosts are checked against it instead of the
+	// SafeBrowsing upstream, which is only used to confirm the full hashes
+	// of the colliding prefixes.  See hashPrefixDB for the format.
+	SafeBrowsingLocalDB string `yaml:"safebrowsing_local_db"`
+
+	// ParentalLocalDB is the same as SafeBrowsingLocalDB, but for the
+	// parental control.
+	ParentalLocalDB string `yaml:"parental_local_db"`
+
+	// RPZZones are the locations of the response policy zones: the file
+	// paths, the HTTP(S) URLs, or the AXFR URLs like
+	// "axfr://192.168.1.2/rpz.example".  The QNAME policies are applied
+	// before the filtering rules, and the response IP address policies
+	// are applied to the answers.
+	RPZZones []string `yaml:"rpz_zones"`
+
+	// NoRulesAction is the action taken when the blocklists have no rules,
+	// see NoRulesActionNone and the other actions.  If empty,
+	// NoRulesActionNone is used.
+	NoRulesAction string `yaml:"no_rules_action"`
+
+	// FilterUpdateInterval is the interval between the updates of the
+	// filter lists with URLs.  If it is zero, the lists aren't updated by
+	// DNSFilter itself.  See Filter.URL and DNSFilter.FilterUpdateStatus.
+	FilterUpdateInterval time.Duration `yaml:"-"`
+
+	// HTTPClient is the client used to download the filter lists with
+	// URLs.  If it is nil, http.DefaultClient is used.
+	HTTPClient *http.Client `yaml:"-"`
+
 	// Names of services to block (globally).
 	// Per-client settings can override this configuration.
 	BlockedServices []string `yaml:"blocked_services"`
@@ -68,6 +205,14 @@ type Config struct {
 
 	// Register an HTTP handler
 	HTTPRegister func(string, string, func(http.ResponseWriter, *http.Request)) `yaml:"-"`
+
+	// OnResult, if not nil, is called synchronously by CheckHost with every
+	// result, including the ones which aren't filtered, and by
+	// FinishResponseCheck with the results which block the responses.  res
+	// is exactly the result returned to the caller of CheckHost, and client
+	// is the name of the client or, if it's unnamed, its IP address.  The
+	// panics in OnResult are recovered and logged.
+	OnResult func(host string, qtype uint16, res Result, client string) `yaml:"-"`
 }
 
 // LookupStats store stats collected during safebrowsing or parental checks
@@ -89,6 +234,7 @@ type Stats struct {
 type filtersInitializerParams struct {
 	allowFilters []Filter
 	blockFilters []Filter
+	changed      []int64
 }
 
 // DNSFilter matches hostnames and DNS requests against filtering rules.
@@ -97,16 +243,103 @@ type DNSFilter struct {
 	filteringEngine      *urlfilter.DNSEngine
 	rulesStorageAllow    *filterlist.RuleStorage
 	filteringEngineAllow *urlfilter.DNSEngine
-	engineLock           sync.RWMutex
+
+	// priorityEngines are the engines for the groups of blocklists with
+	// the same priority, sorted by descending priority.  They are used
+	// instead of rulesStorage and filteringEngine, which are nil then.  It
+	// is nil if all blocklists have the same priority.
+	priorityEngines []priorityEngine
+
+	// rulesStorageMonitor and filteringEngineMonitor are used for the
+	// monitor-only blocklists.  They are nil if there are none.
+	rulesStorageMonitor    *filterlist.RuleStorage
+	filteringEngineMonitor *urlfilter.DNSEngine
+
+	// blockFilters, allowFilters, and monitorFilters are the filters the
+	// engines have been created from.  They are used to only recreate the
+	// engines which filters have changed.
+	blockFilters   []Filter
+	allowFilters   []Filter
+	monitorFilters []Filter
+
+	engineLock sync.RWMutex
+
+	// badfilters are the $badfilter rules from all filter lists added to
+	// every engine.  See scanFilterLists.
+	badfilters string
+
+	// hasDNSTypeRules is true if the filter lists may have the rules with
+	// the $dnstype modifier, so the result of matching a host depends on
+	// the query type.
+	hasDNSTypeRules bool
+
+	// aliases are the alias lines in the /etc/hosts syntax from the
+	// blocklists by the aliased hosts.  See matchAlias.
+	aliases map[string]hostsAlias
+
+	// denyallow are the blocking rules with the $denyallow modifier from
+	// the blocklists.  It's nil if there are none.  See matchDenyallow.
+	denyallow *denyallowIndex
+
+	// reverse are the reverse lookup entries made of the lines in the
+	// /etc/hosts syntax from the blocklists by the addresses.  See
+	// matchReverse.
+	reverse map[string]hostsReverse
+
+	// filterNames are the names of all filter lists by their IDs.  See
+	// setFilterListNames.
+	filterNames map[int64]string
+
+	// blockRules is the number of rules in the blocklists except for the
+	// monitor-only ones.  See Degraded.
+	blockRules int
+
+	// downloaded are the last downloaded contents of the filter lists with
+	// URLs by their IDs.  updateStatus are the statuses of their updates.
+	// Both are protected by updateLock.  See filtersUpdater.
+	downloaded   map[int64][]byte
+	updateStatus map[int64]FilterUpdateStatus
+	updateLock   sync.Mutex
+
+	// updaterCancel stops the filters updater, if it's started.
+	// updaterWG is used to wait for it to exit.
+	updaterCancel context.CancelFunc
+	updaterWG     sync.WaitGroup
 
 	parentalServer       string // access via methods
 	safeBrowsingServer   string // access via methods
 	parentalUpstream     upstream.Upstream
 	safeBrowsingUpstream upstream.Upstream
 
+	// safeBrowsingDB and parentalDB are the local hash-prefix databases.
+	// They are nil if not configured.
+	safeBrowsingDB *hashPrefixDB
+	parentalDB     *hashPrefixDB
+
+	// rpz contains the loaded response policy zones.
+	rpz rpzCtx
+
 	Config   // for direct access by library users, even a = assignment
 	confLock sync.RWMutex
 
+	// rewritesRand is used to order the IP addresses of the rewrites.  It's
+	// created on first use.  rewritesRandLock protects it.
+	rewritesRand     *rand.Rand
+	rewritesRandLock sync.Mutex
+
+	// hostsRRIndexes are the starting indexes of the rotated rules in the
+	// /etc/hosts syntax by the hosts and the query types.  It's created on
+	// first use.  hostsRRLock protects it.  See HostsRoundRobin.
+	hostsRRIndexes map[hostsRRKey]uint32
+	hostsRRLock    sync.Mutex
+
+	// allowedTLDs is the set of normalized AllowedTLDs.  It is nil if all
+	// TLDs are allowed.
+	allowedTLDs map[string]struct{}
+
+	// clientStats are the filtering statistics of the named clients.
+	clientStats clientStatsCtx
+
 	// Channel for passing data to filters-initializer goroutine
 	filtersInitializerChan chan filtersInitializerParams
 	filtersInitializerLock sync.Mutex
@@ -117,6 +350,51 @@ type Filter struct {
 	ID       int64  // auto-assigned when filter is added (see nextFilterID)
 	Data     []byte `yaml:"-"` // List of rules divided by '\n'
 	FilePath string `yaml:"-"` // Path to a filtering rules file
+
+	// URL is the HTTP(S) URL the list is periodically downloaded from if
+	// Config.FilterUpdateInterval is set.  Once downloaded, the contents
+	// are used instead of Data and FilePath.
+	URL string `yaml:"-"`
+
+	// Headers are the additional HTTP headers, for example Authorization,
+	// sent when downloading the list.  Their values are secret, so they're
+	// never logged.
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// Name is the human-readable name of the list.  It's reported in the
+	// FilterListName of the matched rules.  The users of the package
+	// store it themselves, so it's not saved to the configuration.
+	Name string `yaml:"-"`
+
+	// Priority is the priority of the list.  When the rules from lists
+	// with different priorities match a request, the rules from the list
+	// with the highest priority are used.  The lists with the same
+	// priority are matched together.
+	Priority int `yaml:"priority"`
+
+	// MonitorOnly is true if the list is only monitored.  Its matches are
+	// reported in the MonitorRules of the result, but they don't block
+	// anything.
+	MonitorOnly bool `yaml:"monitor_only"`
+
+	// Categories are the categories of the list, for example "ads" or
+	// "tracking".  They're used to group the lists in the statistics and to
+	// enable or disable several lists at once.
+	Categories []string `yaml:"categories,omitempty"`
+
+	// Checksum is the hex-encoded SHA256 checksum of the last downloaded
+	// contents of the list.  If the downloaded contents have the same
+	// checksum, the list isn't reloaded.
+	Checksum string `yaml:"checksum,omitempty"`
+
+	// ETag is the entity tag of the last downloaded contents of the list.
+	// It's sent in the If-None-Match header to make the update conditional.
+	ETag string `yaml:"etag,omitempty"`
+
+	// LastModified is the value of the Last-Modified header of the last
+	// downloaded contents of the list.  It's sent in the If-Modified-Since
+	// header to make the update conditional.
+	LastModified string `yaml:"last_modified,omitempty"`
 }
 
 // Reason holds an enum detailing why it was filtered or not filtered
@@ -163,6 +441,22 @@ const (
 	//
 	// See https://github.com/AdguardTeam/AdGuardHome/issues/2499.
 	RewrittenRule
+
+	// FilteredTLD is returned when the top-level domain of the host isn't
+	// in the configured list of allowed TLDs.
+	FilteredTLD
+
+	// FilteredGeo is returned when the response contains an IP address
+	// located in one of the blocked countries.
+	FilteredGeo
+
+	// ResolutionDepthExceeded is returned when the chain of the CNAME
+	// rewrites and the CNAME records is longer than MaxResolutionDepth.
+	ResolutionDepthExceeded
+
+	// FilteredDGA is returned when the host looks like it's generated by a
+	// domain generation algorithm.  See checkDGA.
+	FilteredDGA
 )
 
 // TODO(a.garipov): Resync with actual code names or replace completely
@@ -182,6 +476,13 @@ var reasonNames = []string{
 	Rewritten:          "Rewrite",
 	RewrittenAutoHosts: "RewriteEtcHosts",
 	RewrittenRule:      "RewriteRule",
+
+	FilteredTLD: "FilteredTLD",
+	FilteredGeo: "FilteredGeo",
+
+	ResolutionDepthExceeded: "ResolutionDepthExceeded",
+
+	FilteredDGA: "FilteredDGA",
 }
 
 func (r Reason) String() string {
@@ -209,6 +510,7 @@ func (d *DNSFilter) GetConfig() RequestFilteringSettings {
 	c.SafeSearchEnabled = d.Config.SafeSearchEnabled
 	c.SafeBrowsingEnabled = d.Config.SafeBrowsingEnabled
 	c.ParentalEnabled = d.Config.ParentalEnabled
+	c.AllMatches = d.Config.ReturnAllMatches
 	// d.confLock.RUnlock()
 	return c
 }
@@ -226,19 +528,42 @@ func (d *DNSFilter) WriteDiskConfig(c *Config) {
 // When filters are set asynchronously, the old filters continue working until the new filters are ready.
 //  In this case the caller must ensure that the old filter files are intact.
 func (d *DNSFilter) SetFilters(blockFilters, allowFilters []Filter, async bool) error {
+	return d.UpdateFilters(blockFilters, allowFilters, nil, async)
+}
+
+// UpdateFilters is like SetFilters, but it keeps the engines for each kind of
+// filters, that is the blocklists, the allowlists, and the monitor-only lists,
+// if none of the filters of that kind have the IDs from changed and the set of
+// them hasn't changed.  If changed is nil, all engines are recreated.
+//
+// The rules of a list may affect the matching of the rules of other lists in
+// the same engine, for example with the exceptions and the $important
+// modifier, so an engine can't be composed of per-list parts.  If the
+// blocklists have different priorities, each priority group has its own
+// engine, and only the engines of the changed groups are recreated, so a list
+// with a priority of its own is swapped alone.  Otherwise, the common engine
+// for all blocklists is recreated, reloading the unchanged ones as well.  A
+// change in the $badfilter rules, which are added to every engine, recreates
+// all of them.
+func (d *DNSFilter) UpdateFilters(blockFilters, allowFilters []Filter, changed []int64, async bool) error {
 	if async {
 		params := filtersInitializerParams{
 			allowFilters: allowFilters,
 			blockFilters: blockFilters,
+			changed:      changed,
 		}
 
 		d.filtersInitializerLock.Lock() // prevent multiple writers from adding more than 1 task
-		// remove all pending tasks
+		// remove all pending tasks, but keep their changes
 		stop := false
 		for !stop {
 			select {
-			case <-d.filtersInitializerChan:
-				//
+			case pending := <-d.filtersInitializerChan:
+				if pending.changed == nil {
+					params.changed = nil
+				} else if params.changed != nil {
+					params.changed = append(params.changed, pending.changed...)
+				}
 			default:
 				stop = true
 			}
@@ -249,7 +574,7 @@ func (d *DNSFilter) SetFilters(blockFilters, allowFilters []Filter, async bool)
 		return nil
 	}
 
-	err := d.initFiltering(allowFilters, blockFilters)
+	err := d.initFiltering(allowFilters, blockFilters, changed)
 	if err != nil {
 		log.Error("Can't initialize filtering subsystem: %s", err)
 		return err
@@ -262,7 +587,7 @@ func (d *DNSFilter) SetFilters(blockFilters, allowFilters []Filter, async bool)
 func (d *DNSFilter) filtersInitializer() {
 	for {
 		params := <-d.filtersInitializerChan
-		err := d.initFiltering(params.allowFilters, params.blockFilters)
+		err := d.initFiltering(params.allowFilters, params.blockFilters, params.changed)
 		if err != nil {
 			log.Error("Can't initialize filtering subsystem: %s", err)
 			continue
@@ -272,33 +597,72 @@ func (d *DNSFilter) filtersInitializer() {
 
 // Close - close the object
 func (d *DNSFilter) Close() {
+	// Stop the updaters before locking, since they may be waiting for the
+	// lock themselves.
+	d.stopFiltersUpdater()
+	d.stopRPZUpdater()
+
 	d.engineLock.Lock()
 	defer d.engineLock.Unlock()
 	d.reset()
 }
 
 func (d *DNSFilter) reset() {
-	var err error
+	d.resetBlock(nil)
+	d.resetAllow()
+	d.resetMonitor()
+}
 
+// resetBlock closes the storages of the blocklists engines except the ones
+// of the priority engines reused in next.
+func (d *DNSFilter) resetBlock(next []priorityEngine) {
 	if d.rulesStorage != nil {
-		err = d.rulesStorage.Close()
+		err := d.rulesStorage.Close()
 		if err != nil {
 			log.Error("dnsfilter: rulesStorage.Close: %s", err)
 		}
 	}
 
+	for _, pe := range d.priorityEngines {
+		if priorityEngineReused(pe, next) {
+			continue
+		}
+
+		err := pe.rulesStorage.Close()
+		if err != nil {
+			log.Error("dnsfilter: priority %d: rulesStorage.Close: %s", pe.priority, err)
+		}
+	}
+}
+
+// resetAllow closes the storage of the allowlists engine.
+func (d *DNSFilter) resetAllow() {
 	if d.rulesStorageAllow != nil {
-		err = d.rulesStorageAllow.Close()
+		err := d.rulesStorageAllow.Close()
 		if err != nil {
 			log.Error("dnsfilter: rulesStorageAllow.Close: %s", err)
 		}
 	}
 }
 
+// resetMonitor closes the storage of the monitor-only lists engine.
+func (d *DNSFilter) resetMonitor() {
+	if d.rulesStorageMonitor != nil {
+		err := d.rulesStorageMonitor.Close()
+		if err != nil {
+			log.Error("dnsfilter: rulesStorageMonitor.Close: %s", err)
+		}
+	}
+}
+
 type dnsFilterContext struct {
 	safebrowsingCache cache.Cache
 	parentalCache     cache.Cache
 	safeSearchCache   cache.Cache
+
+	safebrowsingCounters cacheCounters
+	parentalCounters     cacheCounters
+	safeSearchCounters   cacheCounters
 }
 
 var gctx dnsFilterContext // global dnsfilter context
@@ -307,6 +671,9 @@ var gctx dnsFilterContext // global dnsfilter context
 type ResultRule struct {
 	// FilterListID is the ID of the rule's filter list.
 	FilterListID int64 `json:",omitempty"`
+	// FilterListName is the name of the rule's filter list, if it has
+	// one.
+	FilterListName string `json:",omitempty"`
 	// Text is the text of the rule.
 	Text string `json:",omitempty"`
 	// IP is the host IP.  It is nil unless the rule uses the
@@ -350,6 +717,41 @@ type Result struct {
 
 	// DNSRewriteResult is the $dnsrewrite filter rule result.
 	DNSRewriteResult *DNSRewriteResult `json:",omitempty"`
+
+	// CNAMETarget is the CNAME target from the upstream answer which has
+	// matched the rules.  It is empty unless the result is returned by
+	// CheckCNAMETarget.
+	CNAMETarget string `json:",omitempty"`
+
+	// MonitorRules are the rules from the monitor-only lists which would
+	// have blocked the request.  It is empty unless the request isn't
+	// otherwise matched.
+	MonitorRules []*ResultRule `json:",omitempty"`
+
+	// AllRules are all rules from the blocklists, the monitor-only
+	// blocklists, and the allowlists which match the request, including the
+	// ones in Rules and MonitorRules, if RequestFilteringSettings.AllMatches
+	// is set.  They're informational and never affect the response.
+	AllRules []*ResultRule `json:",omitempty"`
+
+	// CNAMEHops is the number of the CNAME hops of the DNS rewrites which
+	// have led to CanonName.
+	CNAMEHops int `json:"-"`
+
+	// BlockingMode is the blocking mode of the request, see
+	// RequestFilteringSettings.BlockingMode.  It is empty unless the request is blocked.
+	BlockingMode string `json:"-"`
+
+	// BlockingIPs are the IP addresses the blocked A or AAAA request must
+	// be answered with according to BlockingMode.  It is empty if the
+	// request must be answered without any addresses.
+	BlockingIPs []net.IP `json:"-"`
+
+	// TTL is the TTL of the answer in seconds from the TTL column of the
+	// matched rules in the /etc/hosts syntax, like "0.0.0.0 block.com 300".
+	// If several rules have it, the least one is used.  Zero means that the
+	// default TTL is used.
+	TTL uint32 `json:",omitempty"`
 }
 
 // Matched returns true if any match at all was found regardless of
@@ -364,92 +766,174 @@ func (d *DNSFilter) CheckHostRules(host string, qtype uint16, setts *RequestFilt
 		return Result{}, nil
 	}
 
-	return d.matchHost(host, qtype, *setts)
+	res, err := d.matchHost(host, qtype, *setts)
+	if err != nil {
+		return res, err
+	}
+
+	res = scopeToClass(res, host, qtype, setts)
+	d.setFilterListNames(&res)
+	d.setBlocking(&res, qtype, setts)
+	if !setts.bypassed(res.Reason) {
+		return res, nil
+	}
+
+	return Result{MonitorRules: res.MonitorRules}, nil
 }
 
 // CheckHost tries to match the host against filtering rules, then
 // safebrowsing and parental control rules, if they are enabled.
 func (d *DNSFilter) CheckHost(host string, qtype uint16, setts *RequestFilteringSettings) (Result, error) {
-	// sometimes DNS clients will try to resolve ".", which is a request to get root servers
-	if host == "" {
-		return Result{Reason: NotFilteredNotFound}, nil
-	}
-	host = strings.ToLower(host)
+	return d.CheckHostContext(context.Background(), host, qtype, setts)
+}
 
-	var result Result
-	var err error
+// CheckHostContext is like CheckHost, but the network lookups of the safe
+// browsing, the parental control, and the safe search are cancelled when ctx
+// is done.  In that case the error of ctx is returned.
+func (d *DNSFilter) CheckHostContext(
+	ctx context.Context,
+	host string,
+	qtype uint16,
+	setts *RequestFilteringSettings,
+) (res Result, err error) {
+	start := time.Now()
+	res, err = d.checkHost(ctx, host, qtype, setts)
+
+	return d.finishCheckHost(host, qtype, res, setts, start), err
+}
 
-	// first - check rewrites, they have the highest priority
-	result = d.processRewrites(host, qtype)
-	if result.Reason == Rewritten {
-		return result, nil
-	}
+// finishCheckHost sets the fields of res which depend on the configuration,
+// updates the metrics and the client statistics, and calls the OnResult hook.
+// start is the time when the check of host has started.
+func (d *DNSFilter) finishCheckHost(
+	host string,
+	qtype uint16,
+	res Result,
+	setts *RequestFilteringSettings,
+	start time.Time,
+) (finished Result) {
+	d.setFilterListNames(&res)
+	d.setBlocking(&res, qtype, setts)
+	observeCheckHost(res, start)
+	d.clientStats.update(setts.ClientName, res, false)
+	d.onResult(host, qtype, res, setts)
 
-	// Now check the hosts file -- do we have any rules for it?
-	// just like DNS rewrites, it has higher priority than filtering rules.
-	if d.Config.AutoHosts != nil {
-		matched := d.checkAutoHosts(host, qtype, &result)
-		if matched {
-			return result, nil
-		}
+	return res
+}
+
+// FinishResponseCheck updates the metrics and the client statistics and calls
+// the OnResult hook with res, the result of checking host, a CNAME target or an
+// IP address from the response to the request of type qtype.  Unlike the
+// results of CheckHost, the ones of CheckHostRules, CheckCNAMETarget, and
+// CheckResponseIP aren't reported, since most of the checked records don't
+// affect the request, so the callers only report the ones which do.  The
+// request itself isn't counted again in the client statistics.  start is the
+// time when the check of the response has started.
+func (d *DNSFilter) FinishResponseCheck(
+	host string,
+	qtype uint16,
+	res Result,
+	setts *RequestFilteringSettings,
+	start time.Time,
+) {
+	observeCheckHost(res, start)
+	d.clientStats.update(setts.ClientName, res, true)
+	d.onResult(host, qtype, res, setts)
+}
+
+// onResult calls the OnResult hook, if any, recovering from its panics.
+func (d *DNSFilter) onResult(host string, qtype uint16, res Result, setts *RequestFilteringSettings) {
+	if d.OnResult == nil {
+		return
 	}
 
-	if setts.FilteringEnabled {
-		result, err = d.matchHost(host, qtype, *setts)
-		if err != nil {
-			return result, err
-		}
-		if result.Reason.Matched() {
-			return result, nil
+	defer func() {
+		if v := recover(); v != nil {
+			log.Error("dnsfilter: recovered from a panic in the result hook: %v", v)
 		}
+	}()
+
+	client := setts.ClientName
+	if client == "" && setts.ClientIP != nil {
+		client = setts.ClientIP.String()
 	}
 
+	d.OnResult(host, qtype, res, client)
+}
+
+// checkHost is the implementation of CheckHostContext.  See checkHostTypes.
+func (d *DNSFilter) checkHost(
+	ctx context.Context,
+	host string,
+	qtype uint16,
+	setts *RequestFilteringSettings,
+) (res Result, err error) {
+	results, err := d.checkHostTypes(ctx, host, []uint16{qtype}, setts)
+
+	return results[qtype], err
+}
+
+// checkHostLookups checks host against the blocked services and, if they are
+// enabled, the safe browsing, the parental control, and the safe search.  If
+// stop is true, res is the final result of the check, either because host has
+// matched or because a lookup has failed.
+func (d *DNSFilter) checkHostLookups(
+	ctx context.Context,
+	host string,
+	setts *RequestFilteringSettings,
+) (res Result, stop bool, err error) {
 	// are there any blocked services?
-	if len(setts.ServicesRules) != 0 {
-		result = matchBlockedServicesRules(host, setts.ServicesRules)
-		if result.Reason.Matched() {
-			return result, nil
+	if len(setts.ServicesRules) != 0 && !setts.bypassed(FilteredBlockedService) {
+		res = matchBlockedServicesRules(host, setts.ServicesRules)
+		if res.Reason.Matched() {
+			return res, true, nil
 		}
 	}
 
 	// browsing security web service
-	if setts.SafeBrowsingEnabled {
-		result, err = d.checkSafeBrowsing(host)
-		if err != nil {
+	if setts.SafeBrowsingEnabled && !setts.bypassed(FilteredSafeBrowsing) {
+		res, err = d.checkSafeBrowsing(ctx, host)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return Result{}, true, ctxErr
+		} else if err != nil {
 			log.Info("SafeBrowsing: failed: %v", err)
-			return Result{}, nil
+			return Result{}, true, nil
 		}
-		if result.Reason.Matched() {
-			return result, nil
+		if res.Reason.Matched() {
+			return res, true, nil
 		}
 	}
 
 	// parental control web service
-	if setts.ParentalEnabled {
-		result, err = d.checkParental(host)
-		if err != nil {
+	if setts.ParentalEnabled && !setts.bypassed(FilteredParental) {
+		res, err = d.checkParental(ctx, host)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return Result{}, true, ctxErr
+		} else if err != nil {
 			log.Printf("Parental: failed: %v", err)
-			return Result{}, nil
+			return Result{}, true, nil
 		}
-		if result.Reason.Matched() {
-			return result, nil
+		if res.Reason.Matched() {
+			return res, true, nil
 		}
 	}
 
 	// apply safe search if needed
-	if setts.SafeSearchEnabled {
-		result, err = d.checkSafeSearch(host)
-		if err != nil {
+	if setts.SafeSearchEnabled && !setts.bypassed(FilteredSafeSearch) {
+		res, err = d.checkSafeSearch(ctx, host)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return Result{}, true, ctxErr
+		} else if err != nil {
 			log.Info("SafeSearch: failed: %v", err)
-			return Result{}, nil
+			return Result{}, true, nil
 		}
 
-		if result.Reason.Matched() {
-			return result, nil
+		if res.Reason.Matched() {
+			return res, true, nil
 		}
 	}
 
-	return Result{}, nil
+	return Result{}, false, nil
 }
 
 func (d *DNSFilter) checkAutoHosts(host string, qtype uint16, result *Result) (matched bool) {
@@ -484,6 +968,7 @@ func (d *DNSFilter) checkAutoHosts(host string, qtype uint16, result *Result) (m
 //  . repeat for the new domain name (Note: we return only the last CNAME)
 // . Find A or AAAA record for a domain name (exact match or by wildcard)
 //  . if found, set IP addresses (IPv4 or IPv6 depending on qtype) in Result.IPList array
+//  . order them by their weights, if any, or shuffle them if RewritesShuffle is true
 func (d *DNSFilter) processRewrites(host string, qtype uint16) (res Result) {
 	d.confLock.RLock()
 	defer d.confLock.RUnlock()
@@ -512,10 +997,41 @@ func (d *DNSFilter) processRewrites(host string, qtype uint16) (res Result) {
 		}
 		cnames[host] = false
 		res.CanonName = rr[0].Answer
+		res.CNAMEHops++
+		if d.exceedsResolutionDepth(res.CNAMEHops) {
+			log.Info("Rewrite: resolution depth exceeded for %s", origHost)
+
+			return Result{Reason: ResolutionDepthExceeded}
+		}
+
 		rr = findRewrites(d.Rewrites, host)
 	}
 
+	var weights []uint32
+	hasWeights := false
 	for _, r := range rr {
+		if r.Type != dns.TypeNone && isRewriteIPList(r.Answer) {
+			// The list has been validated in prepare.
+			ips, ipWeights, _ := parseRewriteIPs(r.Domain, r.Answer)
+			hasWeights = hasWeights || ipWeights != nil
+			for i, ip := range ips {
+				is4 := ip.To4() != nil
+				if (qtype == dns.TypeA && is4) || (qtype == dns.TypeAAAA && !is4) {
+					res.IPList = append(res.IPList, ip)
+
+					var w uint32 = 1
+					if ipWeights != nil {
+						w = ipWeights[i]
+					}
+					weights = append(weights, w)
+				}
+			}
+
+			log.Debug("Rewrite: A/AAAA for %s are %s", host, r.Answer)
+
+			continue
+		}
+
 		if (r.Type == dns.TypeA && qtype == dns.TypeA) ||
 			(r.Type == dns.TypeAAAA && qtype == dns.TypeAAAA) {
 
@@ -525,13 +1041,38 @@ func (d *DNSFilter) processRewrites(host string, qtype uint16) (res Result) {
 			}
 
 			res.IPList = append(res.IPList, r.IP)
+			weights = append(weights, 1)
 			log.Debug("Rewrite: A/AAAA for %s is %s", host, r.IP)
 		}
 	}
 
+	if hasWeights {
+		d.withRewritesRand(func(rng *rand.Rand) {
+			weightedShuffle(rng, res.IPList, weights)
+		})
+	} else if d.RewritesShuffle {
+		d.withRewritesRand(func(rng *rand.Rand) {
+			rng.Shuffle(len(res.IPList), func(i, j int) {
+				res.IPList[i], res.IPList[j] = res.IPList[j], res.IPList[i]
+			})
+		})
+	}
+
 	return res
 }
 
+// withRewritesRand calls f with the source of randomness for the rewrites.
+func (d *DNSFilter) withRewritesRand(f func(rng *rand.Rand)) {
+	d.rewritesRandLock.Lock()
+	defer d.rewritesRandLock.Unlock()
+
+	if d.rewritesRand == nil {
+		d.rewritesRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	f(d.rewritesRand)
+}
+
 func matchBlockedServicesRules(host string, svcs []ServiceEntry) Result {
 	req := rules.NewRequestForHostname(host)
 	res := Result{}
@@ -569,15 +1110,20 @@ func fileExists(fn string) bool {
 	return err == nil
 }
 
-func createFilteringEngine(filters []Filter) (*filterlist.RuleStorage, *urlfilter.DNSEngine, error) {
+func createFilteringEngine(filters []Filter, badfilters string) (*filterlist.RuleStorage, *urlfilter.DNSEngine, error) {
 	listArray := []filterlist.RuleList{}
 	for _, f := range filters {
 		var list filterlist.RuleList
 
-		if f.ID == 0 {
+		if f.ID == 0 || f.Data != nil {
+			data, err := decompressFilterData(f.Data)
+			if err != nil {
+				return nil, nil, fmt.Errorf("filter list %d: %w", f.ID, err)
+			}
+
 			list = &filterlist.StringRuleList{
-				ID:             0,
-				RulesText:      string(f.Data),
+				ID:             int(f.ID),
+				RulesText:      string(data),
 				IgnoreCosmetic: true,
 			}
 		} else if !fileExists(f.FilePath) {
@@ -609,6 +1155,10 @@ func createFilteringEngine(filters []Filter) (*filterlist.RuleStorage, *urlfilte
 		listArray = append(listArray, list)
 	}
 
+	if list := badfilterList(badfilters); list != nil {
+		listArray = append(listArray, list)
+	}
+
 	rulesStorage, err := filterlist.NewRuleStorage(listArray)
 	if err != nil {
 		return nil, nil, fmt.Errorf("filterlist.NewRuleStorage(): %w", err)
@@ -618,24 +1168,130 @@ func createFilteringEngine(filters []Filter) (*filterlist.RuleStorage, *urlfilte
 }
 
 // Initialize urlfilter objects.
-func (d *DNSFilter) initFiltering(allowFilters, blockFilters []Filter) error {
-	rulesStorage, filteringEngine, err := createFilteringEngine(blockFilters)
-	if err != nil {
-		return err
+// filtersChanged returns true if the engine created from cur must be recreated
+// to use next, that is if the set of the filters has changed or if any of them
+// has an ID from changed.
+func filtersChanged(cur, next []Filter, changed []int64) (ok bool) {
+	if len(cur) != len(next) {
+		return true
+	}
+
+	for i, f := range next {
+		c := cur[i]
+		if c.ID != f.ID ||
+			c.FilePath != f.FilePath ||
+			c.Priority != f.Priority ||
+			!bytes.Equal(c.Data, f.Data) {
+			return true
+		}
+
+		for _, id := range changed {
+			if f.ID == id {
+				return true
+			}
+		}
 	}
-	rulesStorageAllow, filteringEngineAllow, err := createFilteringEngine(allowFilters)
+
+	return false
+}
+
+// initFiltering creates the engines for the filters.  If changed isn't nil,
+// only the engines which need that are recreated.  See UpdateFilters.
+func (d *DNSFilter) initFiltering(allowFilters, blockFilters []Filter, changed []int64) error {
+	allowFilters = d.withDownloadedData(allowFilters)
+	blockFilters = d.withDownloadedData(blockFilters)
+
+	blockFilters, monitorFilters := splitMonitorFilters(blockFilters)
+
+	scan, err := scanFilterLists(blockFilters, allowFilters, monitorFilters)
 	if err != nil {
-		return err
+		return fmt.Errorf("scanning filter lists: %w", err)
+	}
+	badfilters := scan.badfilters
+	blockRules := countBlockRules(blockFilters, scan.rulesCounts)
+	engineFilters := d.withNoRulesFallback(blockFilters, blockRules)
+
+	d.engineLock.RLock()
+	// Recreate all engines if the $badfilter rules have changed, since they
+	// are added to each of them.
+	all := changed == nil || !d.hasBlockEngines() || badfilters != d.badfilters
+	needBlock := all || filtersChanged(d.blockFilters, blockFilters, changed)
+	needAllow := all || filtersChanged(d.allowFilters, allowFilters, changed)
+	needMonitor := all || filtersChanged(d.monitorFilters, monitorFilters, changed)
+
+	var curPriorityEngines []priorityEngine
+	if !all {
+		curPriorityEngines = d.priorityEngines
+	}
+	d.engineLock.RUnlock()
+
+	var rulesStorage *filterlist.RuleStorage
+	var filteringEngine *urlfilter.DNSEngine
+	var priorityEngines []priorityEngine
+	var denyallow *denyallowIndex
+	if needBlock {
+		priorityEngines, err = createPriorityEngines(engineFilters, badfilters, curPriorityEngines, changed)
+		if err != nil {
+			return err
+		}
+		if priorityEngines == nil {
+			rulesStorage, filteringEngine, err = createFilteringEngine(engineFilters, badfilters)
+			if err != nil {
+				return err
+			}
+		}
+		denyallow = newDenyallowIndex(scan, blockFilters)
+	}
+
+	var rulesStorageAllow *filterlist.RuleStorage
+	var filteringEngineAllow *urlfilter.DNSEngine
+	if needAllow {
+		rulesStorageAllow, filteringEngineAllow, err = createFilteringEngine(allowFilters, badfilters)
+		if err != nil {
+			return err
+		}
+	}
+
+	var rulesStorageMonitor *filterlist.RuleStorage
+	var filteringEngineMonitor *urlfilter.DNSEngine
+	if needMonitor && len(monitorFilters) > 0 {
+		rulesStorageMonitor, filteringEngineMonitor, err = createFilteringEngine(monitorFilters, badfilters)
+		if err != nil {
+			return err
+		}
 	}
 
 	d.engineLock.Lock()
-	d.reset()
-	d.rulesStorage = rulesStorage
-	d.filteringEngine = filteringEngine
-	d.rulesStorageAllow = rulesStorageAllow
-	d.filteringEngineAllow = filteringEngineAllow
+	if needBlock {
+		d.resetBlock(priorityEngines)
+		d.rulesStorage = rulesStorage
+		d.filteringEngine = filteringEngine
+		d.priorityEngines = priorityEngines
+		d.denyallow = denyallow
+		d.blockFilters = blockFilters
+	}
+	if needAllow {
+		d.resetAllow()
+		d.rulesStorageAllow = rulesStorageAllow
+		d.filteringEngineAllow = filteringEngineAllow
+		d.allowFilters = allowFilters
+	}
+	if needMonitor {
+		d.resetMonitor()
+		d.rulesStorageMonitor = rulesStorageMonitor
+		d.filteringEngineMonitor = filteringEngineMonitor
+		d.monitorFilters = monitorFilters
+	}
+	d.badfilters = badfilters
+	d.hasDNSTypeRules = scan.hasDNSType
+	d.aliases = blockListsAliases(scan.aliases, blockFilters)
+	d.reverse = blockListsReverse(scan.reverse, blockFilters)
+	d.filterNames = filterListNames(engineFilters, allowFilters, monitorFilters)
+	d.blockRules = blockRules
 	d.engineLock.Unlock()
 
+	setListRulesMetrics(scan.rulesCounts)
+
 	// Make sure that the OS reclaims memory as soon as possible
 	debug.FreeOSMemory()
 	log.Debug("initialized filtering engine")
@@ -668,32 +1324,107 @@ func (d *DNSFilter) matchHostProcessAllowList(host string, dnsres urlfilter.DNSR
 // matchHost is a low-level way to check only if hostname is filtered by rules,
 // skipping expensive safebrowsing and parental lookups.
 func (d *DNSFilter) matchHost(host string, qtype uint16, setts RequestFilteringSettings) (res Result, err error) {
-	d.engineLock.RLock()
-	// Keep in mind that this lock must be held no just when calling Match()
-	//  but also while using the rules returned by it.
-	defer d.engineLock.RUnlock()
+	results, err := d.matchHostTypes(host, []uint16{qtype}, setts)
+	if err != nil {
+		return Result{}, err
+	}
 
-	ureq := urlfilter.DNSRequest{
+	return results[0], nil
+}
+
+// newURLFilterRequest returns the request to match host against the filtering
+// engines.
+func newURLFilterRequest(host string, qtype uint16, setts *RequestFilteringSettings) (ureq urlfilter.DNSRequest) {
+	clientIP := setts.ClientIP
+	if setts.ClientSubnet != nil {
+		clientIP = setts.ClientSubnet.IP
+	}
+
+	ureq = urlfilter.DNSRequest{
 		Hostname:         host,
-		SortedClientTags: setts.ClientTags,
-		// TODO(e.burkov): Wait for urlfilter update to pass net.IP.
-		ClientIP:   setts.ClientIP.String(),
-		ClientName: setts.ClientName,
-		DNSType:    qtype,
+		SortedClientTags: requestClientTags(setts),
+		ClientName:       setts.ClientName,
+		DNSType:          qtype,
+	}
+
+	// Don't pass "<nil>" for the requests without the client address, so
+	// that the $client rules with addresses don't match them.
+	//
+	// TODO(e.burkov): Wait for urlfilter update to pass net.IP.
+	if clientIP != nil {
+		ureq.ClientIP = clientIP.String()
 	}
 
+	return ureq
+}
+
+// engineMatch is the result of matching a request against the filtering
+// engines.  It's only valid while d.engineLock is locked.
+type engineMatch struct {
+	// monitor is the result of matching the monitor-only lists.  It's nil
+	// until requested, see monitorResult.
+	monitor *Result
+
+	ureq   urlfilter.DNSRequest
+	dnsres urlfilter.DNSResult
+
+	// allowed is true if dnsres is the result of the allowlists.
+	allowed bool
+
+	// ok is true if the blocklists have matched.
+	ok bool
+}
+
+// matchEngines matches ureq against the allowlists and the blocklists.
+//
+// d.engineLock is expected to be locked.
+func (d *DNSFilter) matchEngines(ureq urlfilter.DNSRequest) (m engineMatch) {
+	m.ureq = ureq
+
 	if d.filteringEngineAllow != nil {
 		dnsres, ok := d.filteringEngineAllow.MatchRequest(ureq)
 		if ok {
-			return d.matchHostProcessAllowList(host, dnsres)
+			m.dnsres, m.allowed = dnsres, true
+			d.overrideAllowImportant(&m)
+
+			return m
 		}
 	}
 
-	if d.filteringEngine == nil {
-		return Result{}, nil
+	if d.hasBlockEngines() {
+		m.dnsres, m.ok = d.matchBlockEngines(ureq)
 	}
 
-	dnsres, ok := d.filteringEngine.MatchRequest(ureq)
+	return m
+}
+
+// monitorResult returns the result of matching the monitor-only lists.  The
+// lists are only matched once.
+//
+// d.engineLock is expected to be locked.
+func (m *engineMatch) monitorResult(d *DNSFilter) (res Result) {
+	if m.monitor == nil {
+		res = d.matchMonitor(m.ureq)
+		m.monitor = &res
+	}
+
+	return *m.monitor
+}
+
+// engineMatchResult returns the result of the filtering rules in m for the
+// query type qtype.
+//
+// d.engineLock is expected to be locked.
+func (d *DNSFilter) engineMatchResult(m *engineMatch, host string, qtype uint16) (res Result, err error) {
+	if m.allowed {
+		return d.matchHostProcessAllowList(host, m.dnsres)
+	}
+
+	if !d.hasBlockEngines() {
+		return m.monitorResult(d), nil
+	}
+
+	dnsres := m.dnsres
 
 	// Check DNS rewrites first, because the API there is a bit
 	// awkward.
@@ -705,8 +1436,8 @@ func (d *DNSFilter) matchHost(host string, qtype uint16, setts RequestFilteringS
 		} else {
 			return res, nil
 		}
-	} else if !ok {
-		return Result{}, nil
+	} else if !m.ok {
+		return m.monitorResult(d), nil
 	}
 
 	if dnsres.NetworkRule != nil {
@@ -720,44 +1451,35 @@ func (d *DNSFilter) matchHost(host string, qtype uint16, setts RequestFilteringS
 		return makeResult(dnsres.NetworkRule, reason), nil
 	}
 
-	if qtype == dns.TypeA && dnsres.HostRulesV4 != nil {
-		rule := dnsres.HostRulesV4[0] // note that we process only 1 matched rule
-		log.Debug("Filtering: found rule for host %q: %q  list_id: %d",
-			host, rule.Text(), rule.GetFilterListID())
-		res = makeResult(rule, FilteredBlockList)
-		res.Rules[0].IP = rule.IP.To4()
+	hostRulesV4 := withoutTTLColumnMatches(host, dnsres.HostRulesV4)
+	hostRulesV6 := withoutTTLColumnMatches(host, dnsres.HostRulesV6)
 
-		return res, nil
+	if qtype == dns.TypeA && hostRulesV4 != nil {
+		hostRules := d.selectHostRules(host, qtype, hostRulesV4)
+
+		return makeHostRulesResult(host, hostRules, net.IP.To4), nil
 	}
 
-	if qtype == dns.TypeAAAA && dnsres.HostRulesV6 != nil {
-		rule := dnsres.HostRulesV6[0] // note that we process only 1 matched rule
-		log.Debug("Filtering: found rule for host %q: %q  list_id: %d",
-			host, rule.Text(), rule.GetFilterListID())
-		res = makeResult(rule, FilteredBlockList)
-		res.Rules[0].IP = rule.IP
+	if qtype == dns.TypeAAAA && hostRulesV6 != nil {
+		hostRules := d.selectHostRules(host, qtype, hostRulesV6)
 
-		return res, nil
+		return makeHostRulesResult(host, hostRules, func(ip net.IP) net.IP { return ip }), nil
 	}
 
-	if dnsres.HostRulesV4 != nil || dnsres.HostRulesV6 != nil {
+	if hostRulesV4 != nil || hostRulesV6 != nil {
 		// Question Type doesn't match the host rules
-		// Return the first matched host rule, but without an IP address
-		var rule rules.Rule
-		if dnsres.HostRulesV4 != nil {
-			rule = dnsres.HostRulesV4[0]
-		} else if dnsres.HostRulesV6 != nil {
-			rule = dnsres.HostRulesV6[0]
+		// Return the matched host rules, but without IP addresses
+		hostRules := hostRulesV4
+		if hostRules == nil {
+			hostRules = hostRulesV6
 		}
-		log.Debug("Filtering: found rule for host %q: %q  list_id: %d",
-			host, rule.Text(), rule.GetFilterListID())
-		res = makeResult(rule, FilteredBlockList)
-		res.Rules[0].IP = net.IP{}
 
-		return res, nil
+		hostRules = d.selectHostRules(host, qtype, hostRules)
+
+		return makeHostRulesResult(host, hostRules, func(_ net.IP) net.IP { return net.IP{} }), nil
 	}
 
-	return Result{}, nil
+	return m.monitorResult(d), nil
 }
 
 // makeResult returns a properly constructed Result.
@@ -805,7 +1527,10 @@ func New(c *Config, blockFilters []Filter) *DNSFilter {
 		}
 	}
 
-	d := new(DNSFilter)
+	d := &DNSFilter{
+		downloaded:   map[int64][]byte{},
+		updateStatus: map[int64]FilterUpdateStatus{},
+	}
 
 	err := d.initSecurityServices()
 	if err != nil {
@@ -816,6 +1541,13 @@ func New(c *Config, blockFilters []Filter) *DNSFilter {
 	if c != nil {
 		d.Config = *c
 		d.prepareRewrites()
+		d.prepareAllowedTLDs()
+
+		err = d.initHashPrefixDBs()
+		if err != nil {
+			log.Error("dnsfilter: %s", err)
+			return nil
+		}
 	}
 
 	bsvcs := []string{}
@@ -829,7 +1561,7 @@ func New(c *Config, blockFilters []Filter) *DNSFilter {
 	d.BlockedServices = bsvcs
 
 	if blockFilters != nil {
-		err := d.initFiltering(nil, blockFilters)
+		err := d.initFiltering(nil, blockFilters, nil)
 		if err != nil {
 			log.Error("Can't initialize filtering subsystem: %s", err)
 			d.Close()
@@ -837,6 +1569,10 @@ func New(c *Config, blockFilters []Filter) *DNSFilter {
 		}
 	}
 
+	if d.FilterUpdateInterval > 0 {
+		d.startFiltersUpdater(d.FilterUpdateInterval)
+	}
+
 	return d
 }
 
@@ -847,6 +1583,10 @@ func (d *DNSFilter) Start() {
 	d.filtersInitializerChan = make(chan filtersInitializerParams, 1)
 	go d.filtersInitializer()
 
+	if len(d.RPZZones) != 0 {
+		d.startRPZUpdater(rpzRefreshInterval)
+	}
+
 	if d.Config.HTTPRegister != nil { // for tests
 		d.registerSecurityHandlers()
 		d.registerRewritesHandlers()
@@ -149,7 +149,7 @@ func TestEtcHostsMatching(t *testing.T) {
 		assert.Empty(t, res.Rules[0].IP)
 	}
 
-	// 2 IPv4 (return only the first one)
+	// 2 IPv4 (return only the first one by default)
 	res, err = d.CheckHost("host2", dns.TypeA, &setts)
 	assert.Nil(t, err)
 	assert.True(t, res.IsFiltered)
@@ -258,6 +258,28 @@ func TestCheckHostSafeSearchGoogle(t *testing.T) {
 	}
 }
 
+func TestCheckHostSafeSearchBing(t *testing.T) {
+	d := NewForTest(&Config{SafeSearchEnabled: true}, nil)
+	defer d.Close()
+
+	val, ok := d.SafeSearchDomain("www.bing.com")
+	assert.True(t, ok)
+	assert.Equal(t, "strict.bing.com", val)
+
+	// Slice of bing domains
+	bingDomains := []string{"www.bing.com", "bing.com", "WWW.Bing.COM"}
+
+	// Check host for each domain
+	for _, host := range bingDomains {
+		res, err := d.CheckHost(host, dns.TypeA, &setts)
+		assert.Nil(t, err)
+		assert.True(t, res.IsFiltered)
+		if assert.Len(t, res.Rules, 1) {
+			assert.NotEqual(t, res.Rules[0].IP.String(), "0.0.0.0")
+		}
+	}
+}
+
 func TestSafeSearchCacheYandex(t *testing.T) {
 	d := NewForTest(nil, nil)
 	defer d.Close()
@@ -283,7 +305,7 @@ func TestSafeSearchCacheYandex(t *testing.T) {
 	}
 
 	// Check cache.
-	cachedValue, isFound := getCachedResult(gctx.safeSearchCache, domain)
+	cachedValue, isFound := getCachedResult(gctx.safeSearchCache, &gctx.safeSearchCounters, domain)
 	assert.True(t, isFound)
 	if assert.Len(t, cachedValue.Rules, 1) {
 		assert.Equal(t, cachedValue.Rules[0].IP.String(), "213.180.193.56")
@@ -328,7 +350,181 @@ func TestSafeSearchCacheGoogle(t *testing.T) {
 	}
 
 	// Check cache.
-	cachedValue, isFound := getCachedResult(gctx.safeSearchCache, domain)
+	cachedValue, isFound := getCachedResult(gctx.safeSearchCache, &gctx.safeSearchCounters, domain)
+	assert.True(t, isFound)
+	if assert.Len(t, cachedValue.Rules, 1) {
+		assert.True(t, cachedValue.Rules[0].IP.Equal(ip))
+	}
+}
+
+func TestSafeSearchCustomIPs(t *testing.T) {
+	customIP := net.IP{10, 0, 0, 1}
+	d := NewForTest(&Config{
+		SafeSearchEnabled: true,
+		SafeSearchCustomIPs: map[string]net.IP{
+			"google": customIP,
+			"bing":   customIP,
+		},
+	}, nil)
+	defer d.Close()
+
+	testCases := []struct {
+		host   string
+		wantIP net.IP
+	}{{
+		host:   "www.google.com",
+		wantIP: customIP,
+	}, {
+		host:   "www.google.co.in",
+		wantIP: customIP,
+	}, {
+		host:   "www.bing.com",
+		wantIP: customIP,
+	}, {
+		host:   "yandex.ru",
+		wantIP: net.IP{213, 180, 193, 56},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			res, err := d.CheckHost(tc.host, dns.TypeA, &setts)
+			assert.Nil(t, err)
+			assert.True(t, res.IsFiltered)
+			assert.Equal(t, FilteredSafeSearch, res.Reason)
+			if assert.Len(t, res.Rules, 1) {
+				assert.True(t, tc.wantIP.Equal(res.Rules[0].IP))
+			}
+
+			cachedValue, isFound := getCachedResult(gctx.safeSearchCache, &gctx.safeSearchCounters, tc.host)
+			assert.True(t, isFound)
+			if assert.Len(t, cachedValue.Rules, 1) {
+				assert.True(t, tc.wantIP.Equal(cachedValue.Rules[0].IP))
+			}
+		})
+	}
+}
+
+func TestSafeSearch_youTubeRestrictLevel(t *testing.T) {
+	moderateIP, strictIP := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	youTubeHosts := []string{
+		"youtube.com",
+		"www.youtube.com",
+		"m.youtube.com",
+		"youtubei.googleapis.com",
+	}
+
+	testCases := []struct {
+		name     string
+		level    string
+		wantHost string
+		wantIP   net.IP
+	}{{
+		name:     "default",
+		level:    "",
+		wantHost: "restrictmoderate.youtube.com",
+		wantIP:   moderateIP,
+	}, {
+		name:     "moderate",
+		level:    YouTubeRestrictModerate,
+		wantHost: "restrictmoderate.youtube.com",
+		wantIP:   moderateIP,
+	}, {
+		name:     "strict",
+		level:    YouTubeRestrictStrict,
+		wantHost: "restrict.youtube.com",
+		wantIP:   strictIP,
+	}, {
+		name:     "off",
+		level:    YouTubeRestrictOff,
+		wantHost: "",
+		wantIP:   nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewForTest(&Config{
+				SafeSearchEnabled:    true,
+				YouTubeRestrictLevel: tc.level,
+			}, nil)
+			t.Cleanup(d.Close)
+
+			// Make the rewrites resolve without the network.
+			ip := moderateIP
+			if tc.level == YouTubeRestrictStrict {
+				ip = strictIP
+			}
+			d.SafeSearchCustomIPs = map[string]net.IP{"youtube": ip}
+
+			for _, host := range youTubeHosts {
+				safeHost, ok := d.SafeSearchDomain(host)
+				assert.Equal(t, tc.wantHost != "", ok, host)
+				assert.Equal(t, tc.wantHost, safeHost, host)
+
+				res, err := d.CheckHost(host, dns.TypeA, &setts)
+				assert.Nil(t, err)
+				if tc.wantIP == nil {
+					assert.False(t, res.IsFiltered, host)
+
+					continue
+				}
+
+				assert.Equal(t, FilteredSafeSearch, res.Reason, host)
+				if assert.Len(t, res.Rules, 1) {
+					assert.True(t, tc.wantIP.Equal(res.Rules[0].IP), host)
+				}
+			}
+
+			// The other search engines are still rewritten.
+			safeHost, ok := d.SafeSearchDomain("www.bing.com")
+			assert.True(t, ok)
+			assert.Equal(t, "strict.bing.com", safeHost)
+		})
+	}
+
+	assert.Nil(t, ValidateYouTubeRestrictLevel(""))
+	assert.Nil(t, ValidateYouTubeRestrictLevel(YouTubeRestrictStrict))
+	assert.NotNil(t, ValidateYouTubeRestrictLevel("extreme"))
+}
+
+func TestSafeSearchCacheBing(t *testing.T) {
+	d := NewForTest(nil, nil)
+	defer d.Close()
+	domain := "www.bing.com"
+	res, err := d.CheckHost(domain, dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.False(t, res.IsFiltered)
+	assert.Empty(t, res.Rules)
+
+	d = NewForTest(&Config{SafeSearchEnabled: true}, nil)
+	defer d.Close()
+
+	// Let's lookup for safesearch domain
+	safeDomain, ok := d.SafeSearchDomain(domain)
+	if !ok {
+		t.Fatalf("Failed to get safesearch domain for %s", domain)
+	}
+
+	ips, err := net.LookupIP(safeDomain)
+	if err != nil {
+		t.Fatalf("Failed to lookup for %s", safeDomain)
+	}
+
+	var ip net.IP
+	for _, i := range ips {
+		if i.To4() != nil {
+			ip = i
+			break
+		}
+	}
+
+	res, err = d.CheckHost(domain, dns.TypeA, &setts)
+	assert.Nil(t, err)
+	if assert.Len(t, res.Rules, 1) {
+		assert.True(t, res.Rules[0].IP.Equal(ip))
+	}
+
+	// Check cache.
+	cachedValue, isFound := getCachedResult(gctx.safeSearchCache, &gctx.safeSearchCounters, domain)
 	assert.True(t, isFound)
 	if assert.Len(t, cachedValue.Rules, 1) {
 		assert.True(t, cachedValue.Rules[0].IP.Equal(ip))
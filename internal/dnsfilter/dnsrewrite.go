@@ -42,6 +42,7 @@ func (d *DNSFilter) processDNSRewrites(dnsr []*rules.NetworkRule) (res Result) {
 				Reason:    RewrittenRule,
 				Rules:     rules,
 				CanonName: dr.NewCNAME,
+				CNAMEHops: 1,
 			}
 		}
 
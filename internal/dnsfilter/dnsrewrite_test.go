@@ -79,6 +79,19 @@ func TestDNSFilter_CheckHostRules_dnsrewrite(t *testing.T) {
 		}
 	})
 
+	t.Run("a-record-aaaa", func(t *testing.T) {
+		// The A rewrite matches the AAAA query, but has no records for
+		// it, so the response must be NOERROR without any answers.
+		res, err := f.CheckHostRules("a-record", dns.TypeAAAA, setts)
+		assert.Nil(t, err)
+		assert.Equal(t, RewrittenRule, res.Reason)
+
+		if dnsrr := res.DNSRewriteResult; assert.NotNil(t, dnsrr) {
+			assert.Equal(t, dns.RcodeSuccess, dnsrr.RCode)
+			assert.Empty(t, dnsrr.Response[dns.TypeAAAA])
+		}
+	})
+
 	t.Run("aaaa-record", func(t *testing.T) {
 		dtyp := dns.TypeAAAA
 		host := path.Base(t.Name())
@@ -0,0 +1,172 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/util"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// Policies for the multiple rules in the /etc/hosts syntax which match the
+// same host and address family.
+const (
+	// EtcHostsDuplicatesFirst means that only the first rule in the load
+	// order is used.  It's the default.
+	EtcHostsDuplicatesFirst = "first"
+
+	// EtcHostsDuplicatesLast means that only the last rule in the load
+	// order is used.
+	EtcHostsDuplicatesLast = "last"
+
+	// EtcHostsDuplicatesAll means that the addresses from all rules are
+	// used.
+	EtcHostsDuplicatesAll = "all"
+)
+
+// ValidateEtcHostsDuplicates returns an error if policy isn't a valid policy
+// for the duplicate /etc/hosts rules.  An empty policy is valid and means
+// EtcHostsDuplicatesFirst.
+func ValidateEtcHostsDuplicates(policy string) (err error) {
+	switch policy {
+	case "", EtcHostsDuplicatesFirst, EtcHostsDuplicatesLast, EtcHostsDuplicatesAll:
+		return nil
+	default:
+		return fmt.Errorf("invalid etc hosts duplicates policy %q", policy)
+	}
+}
+
+// selectHostRules returns the rules from hostRules, which must not be empty,
+// chosen according to the policy for the duplicate /etc/hosts rules or rotated
+// if HostsRoundRobin is enabled.  host and qtype are the question the rules
+// are selected for.
+func (d *DNSFilter) selectHostRules(
+	host string,
+	qtype uint16,
+	hostRules []*rules.HostRule,
+) (selected []*rules.HostRule) {
+	if d.HostsRoundRobin {
+		return d.rotateHostRules(host, qtype, hostRules)
+	}
+
+	switch d.EtcHostsDuplicates {
+	case EtcHostsDuplicatesLast:
+		return hostRules[len(hostRules)-1:]
+	case EtcHostsDuplicatesAll:
+		return hostRules
+	default:
+		return hostRules[:1]
+	}
+}
+
+// hostRuleFields returns the fields of the rule in the /etc/hosts syntax with
+// the text, without the comment.
+func hostRuleFields(text string) (fields []string) {
+	if i := strings.IndexByte(text, '#'); i >= 0 {
+		text = text[:i]
+	}
+
+	return strings.Fields(text)
+}
+
+// hostRuleTTL returns the TTL from the optional TTL column of the rule in the
+// /etc/hosts syntax with the text, which is the last field after the address
+// and at least one hostname, like in "0.0.0.0 block.com 300".  A zero TTL
+// isn't valid.
+func hostRuleTTL(text string) (ttl uint32, ok bool) {
+	fields := hostRuleFields(text)
+	if len(fields) < 3 {
+		return 0, false
+	}
+
+	ttl64, err := strconv.ParseUint(fields[len(fields)-1], 10, 32)
+	if err != nil || ttl64 == 0 {
+		return 0, false
+	}
+
+	return uint32(ttl64), true
+}
+
+// withoutTTLColumnMatches returns hostRules without the rules which have only
+// matched host because it's their TTL column, since the filtering engine
+// treats the TTL column as one more hostname.  It returns nil if there are no
+// rules left.
+func withoutTTLColumnMatches(host string, hostRules []*rules.HostRule) (filtered []*rules.HostRule) {
+	if _, err := strconv.ParseUint(host, 10, 32); err != nil {
+		// Only the numeric hosts may match the TTL column.
+		return hostRules
+	}
+
+	for _, rule := range hostRules {
+		_, hasTTL := hostRuleTTL(rule.Text())
+		fields := hostRuleFields(rule.Text())
+		if hasTTL && !util.ContainsString(fields[1:len(fields)-1], host) {
+			continue
+		}
+
+		filtered = append(filtered, rule)
+	}
+
+	return filtered
+}
+
+// hostsRRKey is the key of the rotation indexes of the rules in the
+// /etc/hosts syntax.
+type hostsRRKey struct {
+	host  string
+	qtype uint16
+}
+
+// rotateHostRules returns a copy of hostRules, which must not be empty,
+// starting with the next rule each call for the same host and qtype.
+func (d *DNSFilter) rotateHostRules(
+	host string,
+	qtype uint16,
+	hostRules []*rules.HostRule,
+) (rotated []*rules.HostRule) {
+	k := hostsRRKey{host: host, qtype: qtype}
+	n := uint32(len(hostRules))
+
+	d.hostsRRLock.Lock()
+	if d.hostsRRIndexes == nil {
+		d.hostsRRIndexes = map[hostsRRKey]uint32{}
+	}
+	i := d.hostsRRIndexes[k] % n
+	d.hostsRRIndexes[k] = i + 1
+	d.hostsRRLock.Unlock()
+
+	rotated = make([]*rules.HostRule, 0, n)
+	rotated = append(rotated, hostRules[i:]...)
+
+	return append(rotated, hostRules[:i]...)
+}
+
+// makeHostRulesResult returns the result for the rules in the /etc/hosts
+// syntax matching host.  Each rule is accompanied by its IP address converted
+// by conv.
+func makeHostRulesResult(host string, hostRules []*rules.HostRule, conv func(ip net.IP) net.IP) (res Result) {
+	res = Result{
+		IsFiltered: true,
+		Reason:     FilteredBlockList,
+	}
+
+	for _, rule := range hostRules {
+		log.Debug("Filtering: found rule for host %q: %q  list_id: %d",
+			host, rule.Text(), rule.GetFilterListID())
+
+		if ttl, ok := hostRuleTTL(rule.Text()); ok && (res.TTL == 0 || ttl < res.TTL) {
+			res.TTL = ttl
+		}
+
+		res.Rules = append(res.Rules, &ResultRule{
+			FilterListID: int64(rule.GetFilterListID()),
+			Text:         rule.Text(),
+			IP:           conv(rule.IP),
+		})
+	}
+
+	return res
+}
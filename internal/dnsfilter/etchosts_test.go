@@ -0,0 +1,220 @@
+package dnsfilter
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSFilter_EtcHostsDuplicates(t *testing.T) {
+	const text = "0.0.0.1 host2\n0.0.0.2 host2\n0.0.0.3 host2\n::1 host2\n" +
+		"0.0.0.4 host3\n0.0.0.5 host3\n"
+
+	testCases := []struct {
+		name    string
+		policy  string
+		wantIPs []net.IP
+	}{{
+		name:    "default",
+		policy:  "",
+		wantIPs: []net.IP{{0, 0, 0, 1}},
+	}, {
+		name:    "first",
+		policy:  EtcHostsDuplicatesFirst,
+		wantIPs: []net.IP{{0, 0, 0, 1}},
+	}, {
+		name:    "last",
+		policy:  EtcHostsDuplicatesLast,
+		wantIPs: []net.IP{{0, 0, 0, 3}},
+	}, {
+		name:    "all",
+		policy:  EtcHostsDuplicatesAll,
+		wantIPs: []net.IP{{0, 0, 0, 1}, {0, 0, 0, 2}, {0, 0, 0, 3}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewForTest(&Config{EtcHostsDuplicates: tc.policy}, []Filter{{
+				ID: 0, Data: []byte(text),
+			}})
+			t.Cleanup(d.Close)
+
+			res, err := d.CheckHost("host2", dns.TypeA, &setts)
+			assert.Nil(t, err)
+			assert.True(t, res.IsFiltered)
+
+			var ips []net.IP
+			for _, r := range res.Rules {
+				ips = append(ips, r.IP)
+			}
+			assert.Equal(t, tc.wantIPs, ips)
+
+			// The only IPv6 address isn't affected.
+			res, err = d.CheckHost("host2", dns.TypeAAAA, &setts)
+			assert.Nil(t, err)
+			if assert.Len(t, res.Rules, 1) {
+				assert.Equal(t, net.IPv6loopback, res.Rules[0].IP)
+			}
+		})
+	}
+}
+
+func TestDNSFilter_HostsRoundRobin(t *testing.T) {
+	const text = "0.0.0.1 host2\n0.0.0.2 host2\n0.0.0.3 host2\n::1 host2\n" +
+		"0.0.0.4 host3\n0.0.0.5 host3\n"
+
+	newFilter := func(t *testing.T) (d *DNSFilter) {
+		// The policy must not affect the round-robin.
+		d = NewForTest(&Config{
+			HostsRoundRobin:    true,
+			EtcHostsDuplicates: EtcHostsDuplicatesLast,
+		}, []Filter{{
+			ID: 0, Data: []byte(text),
+		}})
+		t.Cleanup(d.Close)
+
+		return d
+	}
+
+	hostIPs := func(t *testing.T, d *DNSFilter, host string) (ips []net.IP) {
+		res, err := d.CheckHost(host, dns.TypeA, &setts)
+		assert.Nil(t, err)
+		assert.True(t, res.IsFiltered)
+
+		for _, r := range res.Rules {
+			ips = append(ips, r.IP)
+		}
+
+		return ips
+	}
+
+	resultIPs := func(t *testing.T, d *DNSFilter) (ips []net.IP) {
+		return hostIPs(t, d, "host2")
+	}
+
+	t.Run("rotation", func(t *testing.T) {
+		d := newFilter(t)
+
+		assert.Equal(t, []net.IP{{0, 0, 0, 1}, {0, 0, 0, 2}, {0, 0, 0, 3}}, resultIPs(t, d))
+		assert.Equal(t, []net.IP{{0, 0, 0, 2}, {0, 0, 0, 3}, {0, 0, 0, 1}}, resultIPs(t, d))
+		assert.Equal(t, []net.IP{{0, 0, 0, 3}, {0, 0, 0, 1}, {0, 0, 0, 2}}, resultIPs(t, d))
+		assert.Equal(t, []net.IP{{0, 0, 0, 1}, {0, 0, 0, 2}, {0, 0, 0, 3}}, resultIPs(t, d))
+	})
+
+	t.Run("per_host", func(t *testing.T) {
+		d := newFilter(t)
+
+		// The queries for the other host don't affect the rotation.
+		assert.Equal(t, []net.IP{{0, 0, 0, 1}, {0, 0, 0, 2}, {0, 0, 0, 3}}, resultIPs(t, d))
+		assert.Equal(t, []net.IP{{0, 0, 0, 4}, {0, 0, 0, 5}}, hostIPs(t, d, "host3"))
+		assert.Equal(t, []net.IP{{0, 0, 0, 5}, {0, 0, 0, 4}}, hostIPs(t, d, "host3"))
+		assert.Equal(t, []net.IP{{0, 0, 0, 2}, {0, 0, 0, 3}, {0, 0, 0, 1}}, resultIPs(t, d))
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		d := newFilter(t)
+
+		const n = 30
+
+		firsts := make(chan byte, n)
+		wg := &sync.WaitGroup{}
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				ips := resultIPs(t, d)
+				if assert.Len(t, ips, 3) {
+					firsts <- ips[0][3]
+				}
+			}()
+		}
+		wg.Wait()
+		close(firsts)
+
+		// Every address must have started the same number of
+		// answers.
+		counts := map[byte]int{}
+		for f := range firsts {
+			counts[f]++
+		}
+		assert.Equal(t, map[byte]int{1: n / 3, 2: n / 3, 3: n / 3}, counts)
+	})
+}
+
+func TestDNSFilter_EtcHostsTTL(t *testing.T) {
+	const text = `0.0.0.0 block.example 300
+0.0.0.1 ttl.example other.example 60
+0.0.0.2 ttl.example 30
+0.0.0.3 nottl.example
+0.0.0.4 comment.example # 300
+0.0.0.5 zero.example 0
+`
+
+	d := NewForTest(&Config{
+		EtcHostsDuplicates: EtcHostsDuplicatesAll,
+	}, []Filter{{
+		ID: 0, Data: []byte(text),
+	}})
+	t.Cleanup(d.Close)
+
+	testCases := []struct {
+		host    string
+		wantTTL uint32
+		wantIP  net.IP
+	}{{
+		host:    "block.example",
+		wantTTL: 300,
+		wantIP:  net.IP{0, 0, 0, 0},
+	}, {
+		host:    "other.example",
+		wantTTL: 60,
+		wantIP:  net.IP{0, 0, 0, 1},
+	}, {
+		// The least TTL of the matched rules is used.
+		host:    "ttl.example",
+		wantTTL: 30,
+		wantIP:  net.IP{0, 0, 0, 1},
+	}, {
+		host:    "nottl.example",
+		wantTTL: 0,
+		wantIP:  net.IP{0, 0, 0, 3},
+	}, {
+		host:    "comment.example",
+		wantTTL: 0,
+		wantIP:  net.IP{0, 0, 0, 4},
+	}, {
+		host:    "zero.example",
+		wantTTL: 0,
+		wantIP:  net.IP{0, 0, 0, 5},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			res, err := d.CheckHost(tc.host, dns.TypeA, &setts)
+			assert.Nil(t, err)
+			assert.True(t, res.IsFiltered)
+			assert.Equal(t, tc.wantTTL, res.TTL)
+			if assert.NotEmpty(t, res.Rules) {
+				assert.Equal(t, tc.wantIP, res.Rules[0].IP)
+			}
+		})
+	}
+
+	t.Run("ttl_column_host", func(t *testing.T) {
+		// The TTL column isn't a hostname.
+		res, err := d.CheckHost("300", dns.TypeA, &setts)
+		assert.Nil(t, err)
+		assert.False(t, res.IsFiltered)
+		assert.False(t, res.Reason.Matched())
+	})
+}
+
+func TestValidateEtcHostsDuplicates(t *testing.T) {
+	assert.Nil(t, ValidateEtcHostsDuplicates(""))
+	assert.Nil(t, ValidateEtcHostsDuplicates(EtcHostsDuplicatesAll))
+	assert.NotNil(t, ValidateEtcHostsDuplicates("random"))
+}
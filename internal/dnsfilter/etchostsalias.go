@@ -0,0 +1,176 @@
+package dnsfilter
+
+import (
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter"
+)
+
+// hostsAlias is an alias line in the /etc/hosts syntax, which points a host to
+// another host instead of an IP address, for example:
+//
+//	alias.local target.local
+type hostsAlias struct {
+	// host is the aliased host.
+	host string
+
+	// target is the host the alias points to.
+	target string
+
+	// text is the text of the line.
+	text string
+
+	// listID is the ID of the filter list containing the line.
+	listID int64
+}
+
+// parseHostsAlias parses line as an alias line.  ok is false if line isn't
+// one, for example if its first field is an IP address, which makes it a
+// regular line in the /etc/hosts syntax.
+func parseHostsAlias(line string, listID int64) (a hostsAlias, ok bool) {
+	text := line
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 2 || net.ParseIP(fields[0]) != nil {
+		return hostsAlias{}, false
+	}
+
+	host, target := strings.ToLower(fields[0]), strings.ToLower(fields[1])
+	if !isPlainHost(host) || !isPlainHost(target) || host == target {
+		return hostsAlias{}, false
+	}
+
+	return hostsAlias{
+		host:   host,
+		target: target,
+		text:   text,
+		listID: listID,
+	}, true
+}
+
+// isPlainHost returns true if s is a plain lowercase hostname.  It must only
+// contain letters, digits, hyphens, underscores, and dots, so that the
+// filtering rules, which contain special characters like "|" or "$", are
+// never mistaken for the hosts.
+func isPlainHost(s string) (ok bool) {
+	if s == "" || s[0] == '.' || s[0] == '-' || net.ParseIP(s) != nil {
+		return false
+	}
+
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z',
+			c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.':
+			// Go on.
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// blockListsAliases returns the aliases from aliases which belong to the
+// blocklists filters, since only those are used to resolve the hosts.
+func blockListsAliases(aliases map[string]hostsAlias, filters []Filter) (blockAliases map[string]hostsAlias) {
+	if len(aliases) == 0 {
+		return nil
+	}
+
+	ids := make(map[int64]struct{}, len(filters))
+	for _, f := range filters {
+		ids[f.ID] = struct{}{}
+	}
+
+	for host, a := range aliases {
+		if _, ok := ids[a.listID]; !ok {
+			continue
+		}
+
+		if blockAliases == nil {
+			blockAliases = map[string]hostsAlias{}
+		}
+
+		blockAliases[host] = a
+	}
+
+	return blockAliases
+}
+
+// matchAlias follows the chain of the aliases starting at host until a host
+// matched by the rules in the /etc/hosts syntax and returns the result with
+// its addresses and the text of the alias line of host.  res is the result of
+// matching host itself, which is returned if host isn't an alias or if the
+// chain doesn't end at such rules, for example because it's a loop.
+// d.engineLock is expected to be locked.
+func (d *DNSFilter) matchAlias(
+	host string,
+	qtype uint16,
+	ureq urlfilter.DNSRequest,
+	res Result,
+) (aliasRes Result, err error) {
+	a, ok := d.aliases[host]
+	if !ok {
+		return res, nil
+	}
+
+	visited := map[string]struct{}{host: {}}
+	for target := a.target; ; {
+		if _, ok = visited[target]; ok {
+			log.Debug("dnsfilter: alias loop for host %q at %q", host, target)
+
+			return res, nil
+		}
+		visited[target] = struct{}{}
+
+		ureq.Hostname = target
+		m := d.matchEngines(ureq)
+
+		var targetRes Result
+		targetRes, err = d.engineMatchResult(&m, target, qtype)
+		if err != nil {
+			return res, err
+		}
+
+		if isHostRulesResult(targetRes) {
+			for _, r := range targetRes.Rules {
+				r.Text = a.text
+				r.FilterListID = a.listID
+			}
+
+			return targetRes, nil
+		} else if targetRes.Reason.Matched() {
+			return res, nil
+		}
+
+		var next hostsAlias
+		next, ok = d.aliases[target]
+		if !ok {
+			return res, nil
+		}
+
+		target = next.target
+	}
+}
+
+// isHostRulesResult returns true if res is the result of matching the rules in
+// the /etc/hosts syntax.
+func isHostRulesResult(res Result) (ok bool) {
+	if res.Reason != FilteredBlockList || len(res.Rules) == 0 {
+		return false
+	}
+
+	for _, r := range res.Rules {
+		if r.IP == nil {
+			return false
+		}
+	}
+
+	return true
+}
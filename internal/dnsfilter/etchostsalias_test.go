@@ -0,0 +1,152 @@
+package dnsfilter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHostsAlias(t *testing.T) {
+	testCases := []struct {
+		name   string
+		line   string
+		want   hostsAlias
+		wantOK bool
+	}{{
+		name: "alias",
+		line: "alias.local target.local",
+		want: hostsAlias{
+			host:   "alias.local",
+			target: "target.local",
+			text:   "alias.local target.local",
+			listID: 1,
+		},
+		wantOK: true,
+	}, {
+		name: "comment_case",
+		line: "Alias.LOCAL  target.local # comment",
+		want: hostsAlias{
+			host:   "alias.local",
+			target: "target.local",
+			text:   "Alias.LOCAL  target.local # comment",
+			listID: 1,
+		},
+		wantOK: true,
+	}, {
+		name:   "ip",
+		line:   "1.2.3.4 target.local",
+		wantOK: false,
+	}, {
+		name:   "ip_target",
+		line:   "alias.local 1.2.3.4",
+		wantOK: false,
+	}, {
+		name:   "network_rule",
+		line:   "||example.org^",
+		wantOK: false,
+	}, {
+		name:   "special_chars",
+		line:   "/regex/ target.local",
+		wantOK: false,
+	}, {
+		name:   "self",
+		line:   "alias.local alias.local",
+		wantOK: false,
+	}, {
+		name:   "three_fields",
+		line:   "alias.local target.local other.local",
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, ok := parseHostsAlias(tc.line, 1)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.want, a)
+		})
+	}
+}
+
+func TestEtcHostsAliases(t *testing.T) {
+	const text = `1.2.3.4 target.local
+::1 target.local
+alias.local target.local
+chain.local alias.local
+loop1.local loop2.local
+loop2.local loop1.local
+dangling.local missing.local
+blocked-alias.local blocked.local
+||blocked.local^
+alias.local other.local
+`
+
+	d := NewForTest(nil, []Filter{{
+		ID: 0, Data: []byte(text),
+	}})
+	t.Cleanup(d.Close)
+
+	testCases := []struct {
+		name     string
+		host     string
+		wantText string
+		wantIP   net.IP
+		qtype    uint16
+	}{{
+		name:     "alias",
+		host:     "alias.local",
+		wantText: "alias.local target.local",
+		wantIP:   net.IP{1, 2, 3, 4},
+		qtype:    dns.TypeA,
+	}, {
+		name:     "alias_ipv6",
+		host:     "alias.local",
+		wantText: "alias.local target.local",
+		wantIP:   net.IPv6loopback,
+		qtype:    dns.TypeAAAA,
+	}, {
+		name:     "chain",
+		host:     "chain.local",
+		wantText: "chain.local alias.local",
+		wantIP:   net.IP{1, 2, 3, 4},
+		qtype:    dns.TypeA,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.CheckHost(tc.host, tc.qtype, &setts)
+			assert.Nil(t, err)
+			assert.True(t, res.IsFiltered)
+			assert.Equal(t, FilteredBlockList, res.Reason)
+			if assert.Len(t, res.Rules, 1) {
+				assert.Equal(t, tc.wantText, res.Rules[0].Text)
+				assert.True(t, tc.wantIP.Equal(res.Rules[0].IP), res.Rules[0].IP)
+			}
+		})
+	}
+
+	for _, host := range []string{
+		"loop1.local",
+		"dangling.local",
+		"blocked-alias.local",
+	} {
+		t.Run(host, func(t *testing.T) {
+			res, err := d.CheckHost(host, dns.TypeA, &setts)
+			assert.Nil(t, err)
+			assert.False(t, res.IsFiltered)
+			assert.Equal(t, NotFilteredNotFound, res.Reason)
+		})
+	}
+
+	t.Run("multi", func(t *testing.T) {
+		results, err := d.CheckHostMulti("alias.local", []uint16{dns.TypeA, dns.TypeAAAA}, &setts)
+		assert.Nil(t, err)
+
+		for _, qt := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			want, cerr := d.CheckHost("alias.local", qt, &setts)
+			assert.Nil(t, cerr)
+			assert.Equal(t, want, results[qt])
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// gzipMagic is the magic number at the beginning of the gzip-compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompressFilterData returns the decompressed data if data is
+// gzip-compressed and data itself otherwise.
+func decompressFilterData(data []byte) (plain []byte, err error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("gzip: %w", err)
+	}
+	defer zr.Close()
+
+	plain, err = ioutil.ReadAll(io.LimitReader(zr, maxFilterSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("gzip: %w", err)
+	}
+
+	if len(plain) > maxFilterSize {
+		return nil, fmt.Errorf("decompressed filter list is larger than %d bytes", maxFilterSize)
+	}
+
+	return plain, nil
+}
+
+// NewFilterReader returns a reader of the decompressed contents of the filter
+// list from r if they are gzip-compressed and a reader of the contents as is
+// otherwise.  The decompressed contents can't be larger than maxFilterSize.
+func NewFilterReader(r io.Reader) (fr io.Reader, err error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if !bytes.Equal(magic, gzipMagic) {
+		return br, nil
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("gzip: %w", err)
+	}
+
+	return &filterSizeReader{r: zr, left: maxFilterSize}, nil
+}
+
+// filterSizeReader is an io.Reader which returns an error if the contents of
+// the filter list are larger than maxFilterSize.
+type filterSizeReader struct {
+	r    io.Reader
+	left int64
+}
+
+// Read implements the io.Reader interface for *filterSizeReader.
+func (r *filterSizeReader) Read(p []byte) (n int, err error) {
+	if r.left <= 0 {
+		// Make sure that there is no more data.
+		var b [1]byte
+		n, err = r.r.Read(b[:])
+		if n == 0 && err != nil {
+			return 0, err
+		}
+
+		return 0, fmt.Errorf("decompressed filter list is larger than %d bytes", maxFilterSize)
+	}
+
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+
+	n, err = r.r.Read(p)
+	r.left -= int64(n)
+
+	return n, err
+}
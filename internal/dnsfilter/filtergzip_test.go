@@ -0,0 +1,92 @@
+package dnsfilter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// gzipData returns data compressed with gzip.
+func gzipData(t *testing.T, data []byte) (compressed []byte) {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, zw.Close())
+
+	return buf.Bytes()
+}
+
+func TestDecompressFilterData(t *testing.T) {
+	const text = "||example.org^\n"
+
+	plain, err := decompressFilterData(gzipData(t, []byte(text)))
+	assert.Nil(t, err)
+	assert.Equal(t, text, string(plain))
+
+	plain, err = decompressFilterData([]byte(text))
+	assert.Nil(t, err)
+	assert.Equal(t, text, string(plain))
+
+	_, err = decompressFilterData(append(append([]byte{}, gzipMagic...), "garbage"...))
+	assert.NotNil(t, err)
+}
+
+func TestNewFilterReader(t *testing.T) {
+	const text = "||example.org^\n"
+
+	for _, data := range [][]byte{gzipData(t, []byte(text)), []byte(text)} {
+		r, err := NewFilterReader(bytes.NewReader(data))
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		plain, err := ioutil.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, text, string(plain))
+	}
+
+	r, err := NewFilterReader(bytes.NewReader(nil))
+	if assert.Nil(t, err) {
+		plain, rerr := ioutil.ReadAll(r)
+		assert.Nil(t, rerr)
+		assert.Empty(t, plain)
+	}
+
+	_, err = NewFilterReader(bytes.NewReader(append(append([]byte{}, gzipMagic...), "garbage"...)))
+	assert.NotNil(t, err)
+}
+
+func TestDNSFilter_CheckHost_gzip(t *testing.T) {
+	compressed := gzipData(t, []byte("||example.org^\n"))
+	d := NewForTest(nil, []Filter{{
+		ID:   1,
+		Data: compressed,
+	}, {
+		ID:   2,
+		Data: []byte("||example.net^\n"),
+	}})
+	t.Cleanup(d.Close)
+
+	for _, host := range []string{"example.org", "example.net"} {
+		res, err := d.CheckHost(host, dns.TypeA, &setts)
+		assert.Nil(t, err)
+		assert.True(t, res.IsFiltered, host)
+	}
+
+	res, err := d.CheckHost("example.com", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.False(t, res.IsFiltered)
+
+	// The stored lists aren't changed, so that the same lists aren't
+	// mistaken for the changed ones on the next update.
+	if assert.Len(t, d.blockFilters, 2) {
+		assert.Equal(t, compressed, d.blockFilters[0].Data)
+	}
+}
@@ -0,0 +1,40 @@
+package dnsfilter
+
+// filterListNames returns the names of the filter lists from lists by their
+// IDs.  The lists without names are omitted.
+func filterListNames(lists ...[]Filter) (names map[int64]string) {
+	names = map[int64]string{}
+	for _, filters := range lists {
+		for _, f := range filters {
+			if f.Name != "" {
+				names[f.ID] = f.Name
+			}
+		}
+	}
+
+	return names
+}
+
+// setFilterListNames sets the FilterListName of the rules of res, including
+// the monitor-only ones, from the names of the filter lists.
+func (d *DNSFilter) setFilterListNames(res *Result) {
+	if len(res.Rules) == 0 && len(res.MonitorRules) == 0 {
+		return
+	}
+
+	d.engineLock.RLock()
+	defer d.engineLock.RUnlock()
+
+	setRulesListNames(res.Rules, d.filterNames)
+	setRulesListNames(res.MonitorRules, d.filterNames)
+}
+
+// setRulesListNames sets the FilterListName of each of rules which doesn't
+// have one yet from names.
+func setRulesListNames(rules []*ResultRule, names map[int64]string) {
+	for _, r := range rules {
+		if r.FilterListName == "" {
+			r.FilterListName = names[r.FilterListID]
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package dnsfilter
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSFilter_filterListNames(t *testing.T) {
+	d := NewForTest(nil, []Filter{{
+		ID:   1,
+		Name: "Ads",
+		Data: []byte("||ads.example.org^\n"),
+	}, {
+		ID:   2,
+		Name: "Trackers",
+		Data: []byte("||tracker.example.org^\n"),
+	}, {
+		ID:   3,
+		Data: []byte("||unnamed.example.org^\n"),
+	}})
+	defer d.Close()
+
+	testCases := []struct {
+		name     string
+		host     string
+		wantName string
+		wantID   int64
+	}{{
+		name:     "first",
+		host:     "ads.example.org",
+		wantName: "Ads",
+		wantID:   1,
+	}, {
+		name:     "second",
+		host:     "tracker.example.org",
+		wantName: "Trackers",
+		wantID:   2,
+	}, {
+		name:     "unnamed",
+		host:     "unnamed.example.org",
+		wantName: "",
+		wantID:   3,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.CheckHost(tc.host, dns.TypeA, &setts)
+			assert.Nil(t, err)
+			assert.Equal(t, FilteredBlockList, res.Reason)
+			if assert.Len(t, res.Rules, 1) {
+				assert.Equal(t, tc.wantID, res.Rules[0].FilterListID)
+				assert.Equal(t, tc.wantName, res.Rules[0].FilterListName)
+			}
+
+			matched := d.MatchAllRules(tc.host)
+			if assert.Len(t, matched, 1) {
+				assert.Equal(t, tc.wantName, matched[0].FilterListName)
+			}
+		})
+	}
+
+	t.Run("multi", func(t *testing.T) {
+		qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+		results, err := d.CheckHostMulti("tracker.example.org", qtypes, &setts)
+		assert.Nil(t, err)
+		for _, qt := range qtypes {
+			res := results[qt]
+			if assert.Len(t, res.Rules, 1) {
+				assert.Equal(t, int64(2), res.Rules[0].FilterListID)
+				assert.Equal(t, "Trackers", res.Rules[0].FilterListName)
+			}
+		}
+	})
+}
@@ -0,0 +1,400 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// filterDownloadTimeout is the timeout for downloading a filter list.
+const filterDownloadTimeout = 1 * time.Minute
+
+// maxFilterSize is the maximum size of a downloaded filter list.
+const maxFilterSize = 256 * 1024 * 1024
+
+// FilterHeadSize is the size of the beginning of the contents of a filter list
+// checked by ValidateFilterHead.
+const FilterHeadSize = 4 * 1024
+
+// errNoRules is returned when a downloaded filter list has no valid rules.
+const errNoRules agherr.Error = "no valid rules"
+
+// FilterUpdateStatus is the status of the periodic updates of a filter list
+// with a URL.  See Config.FilterUpdateInterval.
+type FilterUpdateStatus struct {
+	// LastUpdated is the time of the last successful update.
+	LastUpdated time.Time
+
+	// LastFailed is the time of the last failed update.  If it's after
+	// LastUpdated, the previous version of the list is still used.
+	LastFailed time.Time
+
+	// LastError is the error of the last failed update.
+	LastError error
+
+	// url is the URL the last contents of the list have been downloaded
+	// from.  etag and lastModified are their validators, see Filter.ETag
+	// and Filter.LastModified.  Neither the validators nor the contents
+	// are used after the URL of the list changes.
+	url          string
+	etag         string
+	lastModified string
+}
+
+// FilterUpdateStatus returns the status of the periodic updates of the filter
+// list with the ID id.  ok is false if the list hasn't been updated yet.
+func (d *DNSFilter) FilterUpdateStatus(id int64) (st FilterUpdateStatus, ok bool) {
+	d.updateLock.Lock()
+	defer d.updateLock.Unlock()
+
+	st, ok = d.updateStatus[id]
+
+	return st, ok
+}
+
+// startFiltersUpdater starts the goroutine which updates the filter lists with
+// URLs every ivl.  Close stops it.
+func (d *DNSFilter) startFiltersUpdater(ivl time.Duration) {
+	var ctx context.Context
+	ctx, d.updaterCancel = context.WithCancel(context.Background())
+
+	d.updaterWG.Add(1)
+	go d.filtersUpdater(ctx, ivl)
+}
+
+// stopFiltersUpdater stops the goroutine started by startFiltersUpdater, if
+// any, and waits for it to exit.
+func (d *DNSFilter) stopFiltersUpdater() {
+	if d.updaterCancel == nil {
+		return
+	}
+
+	d.updaterCancel()
+	d.updaterWG.Wait()
+}
+
+// filtersUpdater updates the filter lists with URLs right away and then every
+// ivl until ctx is canceled.
+func (d *DNSFilter) filtersUpdater(ctx context.Context, ivl time.Duration) {
+	defer d.updaterWG.Done()
+
+	t := time.NewTicker(ivl)
+	defer t.Stop()
+
+	for {
+		d.refreshFilters(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			// Go on.
+		}
+	}
+}
+
+// refreshFilters downloads the current filter lists with URLs and recreates
+// the engines of the ones which contents have changed.
+func (d *DNSFilter) refreshFilters(ctx context.Context) {
+	d.engineLock.RLock()
+	blockFilters := make([]Filter, 0, len(d.blockFilters)+len(d.monitorFilters))
+	blockFilters = append(blockFilters, d.blockFilters...)
+	blockFilters = append(blockFilters, d.monitorFilters...)
+	allowFilters := append([]Filter(nil), d.allowFilters...)
+	d.engineLock.RUnlock()
+
+	var changed []int64
+	for _, filters := range [][]Filter{blockFilters, allowFilters} {
+		for _, f := range filters {
+			if f.URL != "" && d.refreshFilter(ctx, f) {
+				changed = append(changed, f.ID)
+			}
+		}
+	}
+
+	if len(changed) == 0 || ctx.Err() != nil {
+		return
+	}
+
+	// The errors are logged by UpdateFilters.  The engines are only
+	// replaced on success, so the previous versions keep being used.
+	_ = d.UpdateFilters(blockFilters, allowFilters, changed, false)
+}
+
+// refreshFilter downloads the filter list f and records the result in its
+// status.  ok is true if the list has been downloaded and its contents have
+// changed.
+func (d *DNSFilter) refreshFilter(ctx context.Context, f Filter) (ok bool) {
+	d.updateLock.Lock()
+	st := d.updateStatus[f.ID]
+	_, conditional := d.downloaded[f.ID]
+	d.updateLock.Unlock()
+
+	if st.url == f.URL {
+		f.ETag, f.LastModified = st.etag, st.lastModified
+	} else {
+		// Don't get a Not Modified response to the validators of the
+		// previous URL.
+		f.ETag, f.LastModified = "", ""
+		conditional = false
+	}
+	data, notModified, err := d.downloadFilter(ctx, &f, conditional)
+	if err == nil && !notModified {
+		err = validateFilter(data, f.ID)
+	}
+
+	if ctx.Err() != nil {
+		return false
+	}
+
+	now := time.Now()
+
+	d.updateLock.Lock()
+	defer d.updateLock.Unlock()
+
+	st = d.updateStatus[f.ID]
+	if err != nil {
+		log.Error("dnsfilter: updating filter list %d from %s: %s", f.ID, f.URL, err)
+
+		st.LastFailed, st.LastError = now, err
+		d.updateStatus[f.ID] = st
+
+		return false
+	}
+
+	st.LastUpdated = now
+	if notModified {
+		d.updateStatus[f.ID] = st
+
+		return false
+	}
+
+	sameURL := st.url == f.URL
+	st.url, st.etag, st.lastModified = f.URL, f.ETag, f.LastModified
+	d.updateStatus[f.ID] = st
+
+	if prev, has := d.downloaded[f.ID]; has && sameURL && bytes.Equal(prev, data) {
+		return false
+	}
+
+	log.Debug("dnsfilter: updated filter list %d from %s: %d bytes", f.ID, f.URL, len(data))
+	d.downloaded[f.ID] = data
+
+	return true
+}
+
+// withDownloadedData returns a copy of filters in which the lists with URLs
+// which have been downloaded have the downloaded contents as their data.
+func (d *DNSFilter) withDownloadedData(filters []Filter) (withData []Filter) {
+	d.updateLock.Lock()
+	defer d.updateLock.Unlock()
+
+	if len(d.downloaded) == 0 {
+		return filters
+	}
+
+	withData = make([]Filter, len(filters))
+	for i, f := range filters {
+		data, ok := d.downloaded[f.ID]
+		if ok && f.URL != "" && d.updateStatus[f.ID].url == f.URL {
+			f.Data = data
+		}
+
+		withData[i] = f
+	}
+
+	return withData
+}
+
+// downloadFilter downloads the contents of the filter list f from f.URL using
+// Config.HTTPClient.  If conditional is true, notModified is true if the list
+// hasn't changed since the download with the validators from f.  Otherwise,
+// they are set to the ones of the downloaded contents.
+func (d *DNSFilter) downloadFilter(
+	ctx context.Context,
+	f *Filter,
+	conditional bool,
+) (data []byte, notModified bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, filterDownloadTimeout)
+	defer cancel()
+
+	resp, err := FetchFilter(ctx, d.HTTPClient, f.URL, f, conditional)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, true, nil
+	}
+
+	data, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxFilterSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(data) > maxFilterSize {
+		return nil, false, fmt.Errorf("filter list is larger than %d bytes", maxFilterSize)
+	}
+
+	f.ETag = resp.Header.Get("ETag")
+	f.LastModified = resp.Header.Get("Last-Modified")
+
+	// The responses with the Content-Encoding: gzip header are decompressed
+	// by the HTTP client, but the lists may also be served as gzip files.
+	data, err = decompressFilterData(data)
+
+	return data, false, err
+}
+
+// FetchFilter requests the filter list f from rawurl using client, or
+// http.DefaultClient if it's nil.  The request has the headers of f, which
+// aren't sent after a redirect to another host.  If conditional is true, the
+// request also has the validators of the previous contents of f, see
+// Filter.ETag and Filter.LastModified.  resp is either 200 OK or, for the
+// conditional requests, 304 Not Modified, and the caller must close its body.
+func FetchFilter(
+	ctx context.Context,
+	client *http.Client,
+	rawurl string,
+	f *Filter,
+	conditional bool,
+) (resp *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	for name, val := range f.Headers {
+		req.Header.Set(name, val)
+	}
+
+	if conditional {
+		if f.ETag != "" {
+			req.Header.Set("If-None-Match", f.ETag)
+		}
+
+		if f.LastModified != "" {
+			req.Header.Set("If-Modified-Since", f.LastModified)
+		}
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err = withoutHeadersOnRedirect(client, f.Headers).Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch code := resp.StatusCode; {
+	case code == http.StatusOK, code == http.StatusNotModified && conditional:
+		return resp, nil
+	case code == http.StatusUnauthorized, code == http.StatusForbidden:
+		err = fmt.Errorf("authorization failed: got status code %d, check the headers of the filter", code)
+	default:
+		err = fmt.Errorf("got status code != 200: %d", code)
+	}
+
+	_ = resp.Body.Close()
+
+	return nil, err
+}
+
+// maxFilterRedirects is the maximum number of redirects followed when
+// downloading a filter list, the same as the default one of http.Client.
+const maxFilterRedirects = 10
+
+// withoutHeadersOnRedirect returns a copy of client which removes headers from
+// the requests redirected to another host, since the secrets are only meant
+// for the list's one.  If headers are empty, client itself is returned.
+func withoutHeadersOnRedirect(client *http.Client, headers map[string]string) (c *http.Client) {
+	if len(headers) == 0 {
+		return client
+	}
+
+	withHeaders := *client
+	withHeaders.CheckRedirect = func(req *http.Request, via []*http.Request) (err error) {
+		if len(via) >= maxFilterRedirects {
+			return errors.New("stopped after 10 redirects")
+		}
+
+		if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+			for name := range headers {
+				req.Header.Del(name)
+			}
+		}
+
+		return nil
+	}
+
+	return &withHeaders
+}
+
+// ValidateFilterHead returns an error if head, the beginning of the contents
+// of a filter list, contains non-printable characters or is HTML, for example
+// an error page.
+func ValidateFilterHead(head []byte) (err error) {
+	for _, c := range head {
+		if (c < ' ' && c != '\n' && c != '\r' && c != '\t') || c == 0x7f {
+			return errors.New("data contains non-printable characters")
+		}
+	}
+
+	s := strings.ToLower(string(head))
+	if strings.Contains(s, "<html") || strings.Contains(s, "<!doctype") {
+		return errors.New("data is HTML, not plain text")
+	}
+
+	return nil
+}
+
+// validateFilter returns an error if data isn't a filter list with at least one
+// valid rule.
+func validateFilter(data []byte, id int64) (err error) {
+	head := data
+	if len(head) > FilterHeadSize {
+		head = head[:FilterHeadSize]
+	}
+
+	err = ValidateFilterHead(head)
+	if err != nil {
+		return err
+	}
+
+	valid := 0
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, maxRuleLineLen)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '!' || line[0] == '#' {
+			continue
+		}
+
+		if r, rerr := rules.NewRule(line, int(id)); rerr == nil && r != nil {
+			valid++
+		}
+	}
+
+	if err = sc.Err(); err != nil {
+		return err
+	}
+
+	if valid == 0 {
+		return errNoRules
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package dnsfilter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateFilter(t *testing.T) {
+	assert.Nil(t, validateFilter([]byte("! Title\n||example.org^\n"), 1))
+	assert.Nil(t, validateFilter([]byte("0.0.0.0 example.org\n"), 1))
+
+	assert.Equal(t, errNoRules, validateFilter([]byte("! Only comments\n"), 1))
+	assert.NotNil(t, validateFilter([]byte("<!DOCTYPE html><html></html>\n"), 1))
+	assert.NotNil(t, validateFilter([]byte("||example.org^\x00\n"), 1))
+
+	assert.Nil(t, ValidateFilterHead([]byte("! Title\n||example.org^\n")))
+	assert.NotNil(t, ValidateFilterHead([]byte("<html><body></body></html>")))
+}
+
+func TestDNSFilter_filtersUpdater(t *testing.T) {
+	var mu sync.Mutex
+	text := "||one.example^\n"
+	status := http.StatusOK
+	reqs := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		reqs++
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(text))
+	}))
+	t.Cleanup(srv.Close)
+
+	serve := func(newText string, newStatus int) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		text, status = newText, newStatus
+	}
+
+	const listID = 1
+
+	d := NewForTest(&Config{
+		FilterUpdateInterval: 10 * time.Millisecond,
+	}, []Filter{{
+		ID:  listID,
+		URL: srv.URL,
+	}})
+
+	isBlocked := func(host string) (ok bool) {
+		res, err := d.CheckHost(host, dns.TypeA, &setts)
+		assert.Nil(t, err)
+
+		return res.IsFiltered
+	}
+
+	const waitFor, tick = 5 * time.Second, 10 * time.Millisecond
+
+	assert.Eventually(t, func() bool { return isBlocked("one.example") }, waitFor, tick)
+
+	st, ok := d.FilterUpdateStatus(listID)
+	assert.True(t, ok)
+	assert.False(t, st.LastUpdated.IsZero())
+	assert.True(t, st.LastFailed.IsZero())
+
+	serve("||two.example^\n", http.StatusOK)
+	assert.Eventually(t, func() bool { return isBlocked("two.example") }, waitFor, tick)
+	assert.False(t, isBlocked("one.example"))
+
+	failedWith := func(msg string) (cond func() bool) {
+		return func() bool {
+			st, ok := d.FilterUpdateStatus(listID)
+
+			return ok &&
+				st.LastFailed.After(st.LastUpdated) &&
+				strings.Contains(st.LastError.Error(), msg)
+		}
+	}
+
+	t.Run("download_error", func(t *testing.T) {
+		serve("", http.StatusInternalServerError)
+		assert.Eventually(t, failedWith("status code 500"), waitFor, tick)
+
+		// The previous version is still used.
+		assert.True(t, isBlocked("two.example"))
+	})
+
+	t.Run("parse_error", func(t *testing.T) {
+		serve("<html><body>Not found</body></html>\n", http.StatusOK)
+		assert.Eventually(t, failedWith("HTML"), waitFor, tick)
+
+		assert.True(t, isBlocked("two.example"))
+	})
+
+	// Close must stop the updater, so no more requests are made after it.
+	d.Close()
+
+	mu.Lock()
+	closedReqs := reqs
+	mu.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, closedReqs, reqs)
+}
+
+func TestFetchFilter(t *testing.T) {
+	const etag = `"v1"`
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte("||example.org^\n"))
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx := context.Background()
+	f := &Filter{
+		ID:      1,
+		URL:     srv.URL,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	}
+
+	resp, err := FetchFilter(ctx, nil, f.URL, f, false)
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, etag, resp.Header.Get("ETag"))
+		assert.Nil(t, resp.Body.Close())
+	}
+
+	f.ETag = etag
+	resp, err = FetchFilter(ctx, nil, f.URL, f, true)
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+		assert.Nil(t, resp.Body.Close())
+	}
+
+	f.Headers = nil
+	_, err = FetchFilter(ctx, nil, f.URL, f, false)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "authorization failed")
+	}
+}
+
+func TestDNSFilter_refreshFilter_urlChanged(t *testing.T) {
+	const etag = `"v1"`
+
+	newSrv := func(text string) (srv *httptest.Server) {
+		srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+
+				return
+			}
+
+			w.Header().Set("ETag", etag)
+			_, _ = w.Write([]byte(text))
+		}))
+		t.Cleanup(srv.Close)
+
+		return srv
+	}
+
+	first := newSrv("||first.example^\n")
+	second := newSrv("||second.example^\n")
+
+	d := NewForTest(nil, nil)
+	t.Cleanup(d.Close)
+
+	ctx := context.Background()
+	assert.True(t, d.refreshFilter(ctx, Filter{ID: 1, URL: first.URL}))
+	assert.False(t, d.refreshFilter(ctx, Filter{ID: 1, URL: first.URL}))
+
+	// The same ETag of the other URL doesn't mean that the contents of the
+	// list haven't changed.
+	f := Filter{ID: 1, URL: second.URL}
+	assert.True(t, d.refreshFilter(ctx, f))
+
+	withData := d.withDownloadedData([]Filter{f})
+	if assert.Len(t, withData, 1) {
+		assert.Equal(t, "||second.example^\n", string(withData[0].Data))
+	}
+
+	// The contents downloaded from the previous URL aren't used.
+	withData = d.withDownloadedData([]Filter{{ID: 1, URL: first.URL}})
+	if assert.Len(t, withData, 1) {
+		assert.Nil(t, withData[0].Data)
+	}
+}
@@ -0,0 +1,138 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// hashPrefixLen is the length of the prefixes of the SHA256 hashes of the
+// hosts in the local hash-prefix databases.
+const hashPrefixLen = 4
+
+// hashPrefix is a prefix of the SHA256 hash of a host.
+type hashPrefix [hashPrefixLen]byte
+
+// hashPrefixDB is the in-memory index of a local SafeBrowsing or parental
+// control hash-prefix database.
+//
+// The database file contains one hex-encoded hash per line.  A line is either
+// a full SHA256 hash of a host, which is matched locally, or a hash prefix of
+// at least hashPrefixLen bytes, which is known to collide and so requires the
+// confirmation of the full hash by the upstream.  Empty lines and lines
+// starting with "#" are ignored.
+type hashPrefixDB struct {
+	// hashes maps the prefixes to the full hashes with them.
+	hashes map[hashPrefix][][32]byte
+
+	// unconfirmed is the set of prefixes which require the confirmation by
+	// the upstream.
+	unconfirmed map[hashPrefix]struct{}
+}
+
+// loadHashPrefixDB loads the hash-prefix database from the file at path.
+func loadHashPrefixDB(path string) (db *hashPrefixDB, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	db, err = parseHashPrefixDB(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	return db, nil
+}
+
+// parseHashPrefixDB reads the hash-prefix database from r.
+func parseHashPrefixDB(r io.Reader) (db *hashPrefixDB, err error) {
+	db = &hashPrefixDB{
+		hashes:      map[hashPrefix][][32]byte{},
+		unconfirmed: map[hashPrefix]struct{}{},
+	}
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		var b []byte
+		b, err = hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		var prefix hashPrefix
+		switch l := len(b); {
+		case l == 32:
+			var hash [32]byte
+			copy(hash[:], b)
+			copy(prefix[:], b)
+			db.hashes[prefix] = append(db.hashes[prefix], hash)
+		case l >= hashPrefixLen && l < 32:
+			copy(prefix[:], b)
+			db.unconfirmed[prefix] = struct{}{}
+		default:
+			return nil, fmt.Errorf("line %d: bad hash length %d", n, l)
+		}
+	}
+
+	err = s.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// match checks the hashes of the host against the database.  If the host is
+// matched by a full hash, matched is true.  Otherwise, unconfirmed contains the
+// hashes which prefixes require the confirmation by the upstream.
+func (db *hashPrefixDB) match(hashToHost map[[32]byte]string) (matched bool, unconfirmed map[[32]byte]string) {
+	for hash, host := range hashToHost {
+		var prefix hashPrefix
+		copy(prefix[:], hash[:])
+
+		for _, h := range db.hashes[prefix] {
+			if h == hash {
+				return true, nil
+			}
+		}
+
+		if _, ok := db.unconfirmed[prefix]; ok {
+			if unconfirmed == nil {
+				unconfirmed = map[[32]byte]string{}
+			}
+
+			unconfirmed[hash] = host
+		}
+	}
+
+	return false, unconfirmed
+}
+
+// initHashPrefixDBs loads the local hash-prefix databases, if configured.
+func (d *DNSFilter) initHashPrefixDBs() (err error) {
+	if d.SafeBrowsingLocalDB != "" {
+		d.safeBrowsingDB, err = loadHashPrefixDB(d.SafeBrowsingLocalDB)
+		if err != nil {
+			return fmt.Errorf("loading safe browsing database: %w", err)
+		}
+	}
+
+	if d.ParentalLocalDB != "" {
+		d.parentalDB, err = loadHashPrefixDB(d.ParentalLocalDB)
+		if err != nil {
+			return fmt.Errorf("loading parental database: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package dnsfilter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHashPrefixDB(t *testing.T) {
+	full := sha256.Sum256([]byte("blocked.example"))
+	prefix := sha256.Sum256([]byte("collision.example"))
+
+	data := strings.Join([]string{
+		"# comment",
+		"",
+		hex.EncodeToString(full[:]),
+		hex.EncodeToString(prefix[:hashPrefixLen]),
+	}, "\n")
+
+	db, err := parseHashPrefixDB(strings.NewReader(data))
+	assert.Nil(t, err)
+	assert.Len(t, db.hashes, 1)
+	assert.Len(t, db.unconfirmed, 1)
+
+	t.Run("bad_hex", func(t *testing.T) {
+		_, err = parseHashPrefixDB(strings.NewReader("zz"))
+		assert.NotNil(t, err)
+	})
+
+	t.Run("bad_length", func(t *testing.T) {
+		_, err = parseHashPrefixDB(strings.NewReader("abcd"))
+		assert.NotNil(t, err)
+	})
+}
+
+func TestSBPC_localDB(t *testing.T) {
+	full := sha256.Sum256([]byte("blocked.example"))
+	prefix := sha256.Sum256([]byte("collision.example"))
+
+	data := hex.EncodeToString(full[:]) + "\n" + hex.EncodeToString(prefix[:hashPrefixLen])
+	db, err := parseHashPrefixDB(strings.NewReader(data))
+	assert.Nil(t, err)
+
+	res := Result{
+		IsFiltered: true,
+		Reason:     FilteredSafeBrowsing,
+	}
+
+	newCtx := func(host string) *sbCtx {
+		return &sbCtx{
+			host:      host,
+			svc:       "SafeBrowsing",
+			cache:     cache.New(cache.Config{}),
+			counters:  &cacheCounters{},
+			cacheTime: 10,
+			db:        db,
+		}
+	}
+
+	testCases := []struct {
+		name      string
+		host      string
+		block     bool
+		wantBlock bool
+		wantReqs  int
+	}{{
+		name:      "full_hash",
+		host:      "blocked.example",
+		block:     false,
+		wantBlock: true,
+		wantReqs:  0,
+	}, {
+		name:      "subdomain",
+		host:      "sub.blocked.example",
+		block:     false,
+		wantBlock: true,
+		wantReqs:  0,
+	}, {
+		name:      "not_found",
+		host:      "other.example",
+		block:     true,
+		wantBlock: false,
+		wantReqs:  0,
+	}, {
+		name:      "collision_confirmed",
+		host:      "collision.example",
+		block:     true,
+		wantBlock: true,
+		wantReqs:  1,
+	}, {
+		name:      "collision_not_confirmed",
+		host:      "collision.example",
+		block:     false,
+		wantBlock: false,
+		wantReqs:  1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ups := &testSbUpstream{
+				hostname: tc.host,
+				block:    tc.block,
+			}
+
+			r, cerr := check(context.Background(), newCtx(tc.host), res, ups)
+			assert.Nil(t, cerr)
+			assert.Equal(t, tc.wantBlock, r.IsFiltered)
+			assert.Equal(t, tc.wantReqs, ups.requestsCount)
+		})
+	}
+}
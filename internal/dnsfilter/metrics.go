@@ -0,0 +1,115 @@
+package dnsfilter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsPrefix is the prefix of the names of the metrics of the package.
+const metricsPrefix = "adguard_home_dnsfilter_"
+
+// checkHostDurationBuckets are the upper bounds of the buckets of the
+// CheckHost latency histogram, in seconds.
+var checkHostDurationBuckets = func() (b []float64) {
+	b = make([]float64, 10)
+	for i, bound := 0, 0.00001; i < len(b); i, bound = i+1, bound*4 {
+		b[i] = bound
+	}
+
+	return b
+}()
+
+// The metrics of the package.  They are shared by all DNSFilter instances,
+// just like the lookup caches in gctx.
+var (
+	// resultsTotal is the number of the results of CheckHost by their
+	// reasons.
+	resultsTotal = make([]uint64, len(reasonNames))
+
+	// checkHostBuckets are the numbers of the CheckHost calls by the
+	// buckets of checkHostDurationBuckets.  The last one is for the calls
+	// longer than all of them.
+	checkHostBuckets = make([]uint64, len(checkHostDurationBuckets)+1)
+
+	// checkHostNanos is the total time spent in CheckHost.
+	checkHostNanos uint64
+
+	// listRules is the number of rules in the loaded filter lists by
+	// their IDs.  It's protected by listRulesLock.
+	listRules     map[int64]int
+	listRulesLock sync.Mutex
+)
+
+// observeCheckHost updates the metrics with the result of a CheckHost call
+// which has started at start.
+func observeCheckHost(res Result, start time.Time) {
+	dur := time.Since(start)
+	atomic.AddUint64(&checkHostNanos, uint64(dur))
+
+	i := sort.SearchFloat64s(checkHostDurationBuckets, dur.Seconds())
+	atomic.AddUint64(&checkHostBuckets[i], 1)
+
+	if r := res.Reason; r >= 0 && int(r) < len(resultsTotal) {
+		atomic.AddUint64(&resultsTotal[r], 1)
+	}
+}
+
+// setListRulesMetrics sets the numbers of rules in the loaded filter lists by
+// their IDs.  The lists which aren't in counts anymore are removed.
+func setListRulesMetrics(counts map[int64]int) {
+	listRulesLock.Lock()
+	defer listRulesLock.Unlock()
+
+	listRules = counts
+}
+
+// WriteMetrics writes the metrics of the filtering outcomes to w in the
+// Prometheus text exposition format.
+func (d *DNSFilter) WriteMetrics(w io.Writer) (err error) {
+	buf := &bytes.Buffer{}
+
+	name := metricsPrefix + "results_total"
+	fmt.Fprintf(buf, "# HELP %s The number of the checked hosts by the reason of the result.\n", name)
+	fmt.Fprintf(buf, "# TYPE %s counter\n", name)
+	for r := range resultsTotal {
+		n := atomic.LoadUint64(&resultsTotal[r])
+		fmt.Fprintf(buf, "%s{reason=%q} %d\n", name, Reason(r).String(), n)
+	}
+
+	name = metricsPrefix + "check_host_duration_seconds"
+	fmt.Fprintf(buf, "# HELP %s The time spent checking a host.\n", name)
+	fmt.Fprintf(buf, "# TYPE %s histogram\n", name)
+	var total uint64
+	for i, bound := range checkHostDurationBuckets {
+		total += atomic.LoadUint64(&checkHostBuckets[i])
+		fmt.Fprintf(buf, "%s_bucket{le=\"%g\"} %d\n", name, bound, total)
+	}
+	total += atomic.LoadUint64(&checkHostBuckets[len(checkHostDurationBuckets)])
+	fmt.Fprintf(buf, "%s_bucket{le=\"+Inf\"} %d\n", name, total)
+	sum := time.Duration(atomic.LoadUint64(&checkHostNanos)).Seconds()
+	fmt.Fprintf(buf, "%s_sum %g\n", name, sum)
+	fmt.Fprintf(buf, "%s_count %d\n", name, total)
+
+	name = metricsPrefix + "list_rules"
+	fmt.Fprintf(buf, "# HELP %s The number of rules in the loaded filter list.\n", name)
+	fmt.Fprintf(buf, "# TYPE %s gauge\n", name)
+	listRulesLock.Lock()
+	ids := make([]int64, 0, len(listRules))
+	for id := range listRules {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		fmt.Fprintf(buf, "%s{list_id=\"%d\"} %d\n", name, id, listRules[id])
+	}
+	listRulesLock.Unlock()
+
+	_, err = w.Write(buf.Bytes())
+
+	return err
+}
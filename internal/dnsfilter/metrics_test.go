@@ -0,0 +1,55 @@
+package dnsfilter
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSFilter_WriteMetrics(t *testing.T) {
+	d := NewForTest(nil, []Filter{{
+		ID: 0, Data: []byte("||blocked.example^\n@@||allowed.example^\n"),
+	}})
+	t.Cleanup(d.Close)
+
+	prevBlocked := atomic.LoadUint64(&resultsTotal[FilteredBlockList])
+	prevAllowed := atomic.LoadUint64(&resultsTotal[NotFilteredAllowList])
+
+	_, err := d.CheckHost("blocked.example", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	_, err = d.CheckHost("allowed.example", dns.TypeA, &setts)
+	assert.Nil(t, err)
+
+	assert.Equal(t, prevBlocked+1, atomic.LoadUint64(&resultsTotal[FilteredBlockList]))
+	assert.Equal(t, prevAllowed+1, atomic.LoadUint64(&resultsTotal[NotFilteredAllowList]))
+
+	setListRulesMetrics(map[int64]int{1: 10, 2: 20})
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, d.WriteMetrics(buf))
+
+	out := buf.String()
+	assert.Contains(t, out, "# TYPE adguard_home_dnsfilter_results_total counter\n")
+	assert.Contains(t, out, fmt.Sprintf(
+		"adguard_home_dnsfilter_results_total{reason=%q} %d\n",
+		FilteredBlockList.String(),
+		prevBlocked+1,
+	))
+	assert.Contains(t, out, "# TYPE adguard_home_dnsfilter_check_host_duration_seconds histogram\n")
+	assert.Contains(t, out, "adguard_home_dnsfilter_check_host_duration_seconds_bucket{le=\"+Inf\"} ")
+	assert.Contains(t, out, "adguard_home_dnsfilter_list_rules{list_id=\"1\"} 10\n")
+	assert.Contains(t, out, "adguard_home_dnsfilter_list_rules{list_id=\"2\"} 20\n")
+
+	setListRulesMetrics(map[int64]int{2: 30})
+
+	buf.Reset()
+	assert.Nil(t, d.WriteMetrics(buf))
+
+	out = buf.String()
+	assert.NotContains(t, out, "list_id=\"1\"")
+	assert.Contains(t, out, "adguard_home_dnsfilter_list_rules{list_id=\"2\"} 30\n")
+}
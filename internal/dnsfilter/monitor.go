@@ -0,0 +1,62 @@
+package dnsfilter
+
+import (
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// splitMonitorFilters splits filters into the ones which are enforced and
+// the monitor-only ones.
+func splitMonitorFilters(filters []Filter) (enforced, monitored []Filter) {
+	for _, f := range filters {
+		if f.MonitorOnly {
+			monitored = append(monitored, f)
+		} else {
+			enforced = append(enforced, f)
+		}
+	}
+
+	return enforced, monitored
+}
+
+// matchMonitor matches ureq against the monitor-only blocklists and returns
+// the result of a request which isn't filtered, but with MonitorRules set to
+// the rules which would have blocked it.
+//
+// d.engineLock is expected to be locked.
+func (d *DNSFilter) matchMonitor(ureq urlfilter.DNSRequest) (res Result) {
+	if d.filteringEngineMonitor == nil {
+		return Result{}
+	}
+
+	dnsres, ok := d.filteringEngineMonitor.MatchRequest(ureq)
+	if !ok {
+		return Result{}
+	}
+
+	var rule rules.Rule
+	if dnsres.NetworkRule != nil {
+		if dnsres.NetworkRule.Whitelist {
+			return Result{}
+		}
+
+		rule = dnsres.NetworkRule
+	} else if len(dnsres.HostRulesV4) > 0 {
+		rule = dnsres.HostRulesV4[0]
+	} else if len(dnsres.HostRulesV6) > 0 {
+		rule = dnsres.HostRulesV6[0]
+	} else {
+		return Result{}
+	}
+
+	log.Debug("Filtering: found monitor-only rule for host %q: %q  list_id: %d",
+		ureq.Hostname, rule.Text(), rule.GetFilterListID())
+
+	return Result{
+		MonitorRules: []*ResultRule{{
+			FilterListID: int64(rule.GetFilterListID()),
+			Text:         rule.Text(),
+		}},
+	}
+}
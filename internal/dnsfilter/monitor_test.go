@@ -0,0 +1,83 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonitorOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsfilter")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	newFilter := func(id int64, monitor bool, text string) (f Filter) {
+		f = Filter{
+			ID:          id,
+			FilePath:    filepath.Join(dir, fmt.Sprintf("%d.txt", id)),
+			MonitorOnly: monitor,
+		}
+		assert.Nil(t, ioutil.WriteFile(f.FilePath, []byte(text), 0o644))
+
+		return f
+	}
+
+	d := NewForTest(nil, []Filter{
+		newFilter(1, false, "||blocked.example.org^\n"),
+		newFilter(2, true, "||monitored.example.org^\n||blocked.example.org^\n0.0.0.0 hosts.example.org\n"),
+	})
+	defer d.Close()
+
+	testCases := []struct {
+		name         string
+		host         string
+		wantFiltered bool
+		wantMonitor  string
+	}{{
+		name:         "monitored",
+		host:         "monitored.example.org",
+		wantFiltered: false,
+		wantMonitor:  "||monitored.example.org^",
+	}, {
+		name:         "monitored_hosts",
+		host:         "hosts.example.org",
+		wantFiltered: false,
+		wantMonitor:  "0.0.0.0 hosts.example.org",
+	}, {
+		name:         "blocked",
+		host:         "blocked.example.org",
+		wantFiltered: true,
+		wantMonitor:  "",
+	}, {
+		name:         "none",
+		host:         "example.org",
+		wantFiltered: false,
+		wantMonitor:  "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.CheckHost(tc.host, dns.TypeA, &setts)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.wantFiltered, res.IsFiltered)
+
+			if tc.wantMonitor == "" {
+				assert.Empty(t, res.MonitorRules)
+
+				return
+			}
+
+			assert.Equal(t, NotFilteredNotFound, res.Reason)
+			assert.Empty(t, res.Rules)
+			if assert.Len(t, res.MonitorRules, 1) {
+				assert.Equal(t, tc.wantMonitor, res.MonitorRules[0].Text)
+				assert.Equal(t, int64(2), res.MonitorRules[0].FilterListID)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package dnsfilter
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CheckHostMulti is like CheckHost, but for several query types of the same
+// host at once.  The filtering rules are only matched once unless the filter
+// lists have rules with the $dnstype modifier, and the safe browsing, the
+// parental control, and the safe search lookups are performed once and shared
+// between the query types.
+func (d *DNSFilter) CheckHostMulti(
+	host string,
+	qtypes []uint16,
+	setts *RequestFilteringSettings,
+) (results map[uint16]Result, err error) {
+	return d.CheckHostMultiContext(context.Background(), host, qtypes, setts)
+}
+
+// CheckHostMultiContext is like CheckHostMulti, but the network lookups are
+// cancelled when ctx is done.  See CheckHostContext.
+func (d *DNSFilter) CheckHostMultiContext(
+	ctx context.Context,
+	host string,
+	qtypes []uint16,
+	setts *RequestFilteringSettings,
+) (results map[uint16]Result, err error) {
+	start := time.Now()
+	results, err = d.checkHostTypes(ctx, host, uniqueQTypes(qtypes), setts)
+	if err != nil {
+		return nil, err
+	}
+
+	for qt, res := range results {
+		results[qt] = d.finishCheckHost(host, qt, res, setts, start)
+	}
+
+	return results, nil
+}
+
+// checkHostTypes is the implementation of CheckHostContext and
+// CheckHostMultiContext.  It returns the results for all of qtypes, which must
+// not contain duplicates.  The checks which don't depend on the query type are
+// only performed once.
+func (d *DNSFilter) checkHostTypes(
+	ctx context.Context,
+	host string,
+	qtypes []uint16,
+	setts *RequestFilteringSettings,
+) (results map[uint16]Result, err error) {
+	results = make(map[uint16]Result, len(qtypes))
+
+	// sometimes DNS clients will try to resolve ".", which is a request to get root servers
+	if host == "" {
+		for _, qt := range qtypes {
+			results[qt] = Result{Reason: NotFilteredNotFound}
+		}
+
+		return results, nil
+	}
+	host = strings.ToLower(host)
+
+	// The rewrites, the hosts files, and the other checks are only
+	// intended for the IN class.
+	if !isClassIN(setts.QClass) {
+		for _, qt := range qtypes {
+			results[qt], err = d.CheckHostRules(host, qt, setts)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return results, nil
+	}
+
+	// The rewrites have the highest priority, and the hosts files are
+	// checked right after them.  They depend on the query type, but
+	// they're cheap to check for each of them.
+	pending := make([]uint16, 0, len(qtypes))
+	for _, qt := range qtypes {
+		res := d.processRewrites(host, qt)
+		if res.Reason.In(Rewritten, ResolutionDepthExceeded) {
+			results[qt] = res
+
+			continue
+		}
+
+		if d.Config.AutoHosts != nil && d.checkAutoHosts(host, qt, &res) {
+			results[qt] = res
+
+			continue
+		}
+
+		pending = append(pending, qt)
+	}
+
+	if len(pending) > 0 {
+		err = d.checkHostShared(ctx, host, pending, setts, results)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// uniqueQTypes returns qtypes without the duplicates.
+func uniqueQTypes(qtypes []uint16) (unique []uint16) {
+	unique = make([]uint16, 0, len(qtypes))
+	for _, qt := range qtypes {
+		if !containsQType(unique, qt) {
+			unique = append(unique, qt)
+		}
+	}
+
+	return unique
+}
+
+// containsQType returns true if qtypes contain qtype.
+func containsQType(qtypes []uint16, qtype uint16) (ok bool) {
+	for _, qt := range qtypes {
+		if qt == qtype {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkHostShared performs the checks of checkHostTypes following the rewrites
+// and the hosts files for all of qtypes and sets their results.  The
+// checks which don't depend on the query type are only performed once.
+func (d *DNSFilter) checkHostShared(
+	ctx context.Context,
+	host string,
+	qtypes []uint16,
+	setts *RequestFilteringSettings,
+	results map[uint16]Result,
+) (err error) {
+	// setPending sets res as the result for every query type which doesn't
+	// have one yet.
+	setPending := func(res Result) {
+		for _, qt := range qtypes {
+			if _, ok := results[qt]; !ok {
+				results[qt] = res
+			}
+		}
+	}
+
+	var monitorRules [][]*ResultRule
+	if setts.FilteringEnabled {
+		res := d.matchRPZ(host)
+		if res.Reason.Matched() {
+			setPending(res)
+
+			return nil
+		}
+
+		var matched []Result
+		matched, err = d.matchHostTypes(host, qtypes, *setts)
+		if err != nil {
+			return err
+		}
+
+		monitorRules = make([][]*ResultRule, len(qtypes))
+		done := true
+		for i, qt := range qtypes {
+			res = matched[i]
+			if res.Reason.Matched() && !setts.bypassed(res.Reason) {
+				results[qt] = res
+
+				continue
+			}
+
+			monitorRules[i] = res.MonitorRules
+			if qt == dns.TypePTR {
+				res = d.matchReverse(host)
+				if res.Reason.Matched() {
+					results[qt] = res
+
+					continue
+				}
+			}
+
+			done = false
+		}
+
+		if done {
+			return nil
+		}
+
+		// Check the TLD after the rules, so that the allowlist rules
+		// could make exceptions for particular hosts.
+		if !setts.bypassed(FilteredTLD) {
+			res = d.checkTLD(host)
+			if res.Reason.Matched() {
+				setPending(res)
+
+				return nil
+			}
+		}
+
+		if !setts.bypassed(FilteredDGA) {
+			res = d.checkDGA(host)
+			if res.Reason.Matched() {
+				setPending(res)
+
+				return nil
+			}
+		}
+	}
+
+	res, stop, err := d.checkHostLookups(ctx, host, setts)
+	if err != nil {
+		return err
+	} else if stop {
+		setPending(res)
+
+		return nil
+	}
+
+	for i, qt := range qtypes {
+		if _, ok := results[qt]; ok {
+			continue
+		}
+
+		res = Result{}
+		if monitorRules != nil {
+			res.MonitorRules = monitorRules[i]
+		}
+
+		results[qt] = res
+	}
+
+	return nil
+}
+
+// matchHostTypes is like matchHost, but for several query types.  The engines
+// are only matched once unless the filter lists have rules with the $dnstype
+// modifier.  results are in the same order as qtypes.
+func (d *DNSFilter) matchHostTypes(
+	host string,
+	qtypes []uint16,
+	setts RequestFilteringSettings,
+) (results []Result, err error) {
+	d.engineLock.RLock()
+	defer d.engineLock.RUnlock()
+
+	ureq := newURLFilterRequest(host, qtypes[0], &setts)
+	m := d.matchEngines(ureq)
+
+	results = make([]Result, len(qtypes))
+	for i, qt := range qtypes {
+		if i > 0 && d.hasDNSTypeRules {
+			ureq.DNSType = qt
+			m = d.matchEngines(ureq)
+		}
+
+		var res Result
+		res, err = d.engineMatchResult(&m, host, qt)
+		if err == nil && !res.Reason.Matched() {
+			ureq.DNSType = qt
+			res, err = d.matchAlias(host, qt, ureq, res)
+		}
+
+		if err == nil {
+			res = d.matchDenyallow(host, &m, res)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if setts.AllMatches {
+			ureq.DNSType = qt
+			res.AllRules = d.matchAllStorages(ureq.Hostname, newRulesRequest(ureq))
+		}
+
+		results[i] = res
+	}
+
+	return results, nil
+}
@@ -0,0 +1,242 @@
+package dnsfilter
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const testMultiRules = `||blocked.example^
+0.0.0.0 hosts.example
+::1 hosts.example
+@@||allowed.example^
+||allowed.example^
+||rewrite.example^$dnsrewrite=1.2.3.4
+`
+
+var testMultiQTypes = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeMX}
+
+func TestDNSFilter_CheckHostMulti(t *testing.T) {
+	hosts := []string{
+		"",
+		"blocked.example",
+		"sub.blocked.example",
+		"hosts.example",
+		"allowed.example",
+		"rewrite.example",
+		"legacy.example",
+		"dnstype.example",
+		"other.example",
+	}
+
+	testCases := []struct {
+		name            string
+		rules           string
+		wantDNSTypeRule bool
+	}{{
+		name:            "no_dnstype",
+		rules:           testMultiRules,
+		wantDNSTypeRule: false,
+	}, {
+		name:            "dnstype",
+		rules:           testMultiRules + "||dnstype.example^$dnstype=AAAA\n",
+		wantDNSTypeRule: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewForTest(&Config{
+				Rewrites: []RewriteEntry{{
+					Domain: "legacy.example",
+					Answer: "1.2.3.4",
+				}},
+			}, []Filter{{
+				ID: 0, Data: []byte(tc.rules),
+			}})
+			t.Cleanup(d.Close)
+
+			assert.Equal(t, tc.wantDNSTypeRule, d.hasDNSTypeRules)
+
+			for _, host := range hosts {
+				results, err := d.CheckHostMulti(host, testMultiQTypes, &setts)
+				assert.Nil(t, err)
+				assert.Len(t, results, len(testMultiQTypes))
+
+				for _, qt := range testMultiQTypes {
+					want, cerr := d.CheckHost(host, qt, &setts)
+					assert.Nil(t, cerr)
+					assert.Equal(t, want, results[qt], "host %q, qtype %s", host, dns.Type(qt))
+				}
+			}
+		})
+	}
+
+	t.Run("dnstype_differs", func(t *testing.T) {
+		d := NewForTest(nil, []Filter{{
+			ID: 0, Data: []byte("||dnstype.example^$dnstype=AAAA\n"),
+		}})
+		t.Cleanup(d.Close)
+
+		results, err := d.CheckHostMulti("dnstype.example", []uint16{dns.TypeA, dns.TypeAAAA}, &setts)
+		assert.Nil(t, err)
+		assert.False(t, results[dns.TypeA].IsFiltered)
+		assert.True(t, results[dns.TypeAAAA].IsFiltered)
+	})
+
+	t.Run("duplicates", func(t *testing.T) {
+		d := NewForTest(nil, []Filter{{
+			ID: 0, Data: []byte(testMultiRules),
+		}})
+		t.Cleanup(d.Close)
+
+		results, err := d.CheckHostMulti("blocked.example", []uint16{dns.TypeA, dns.TypeA}, &setts)
+		assert.Nil(t, err)
+		assert.Len(t, results, 1)
+		assert.True(t, results[dns.TypeA].IsFiltered)
+	})
+}
+
+func TestDNSFilter_CheckHostMulti_sameAsCheckHost(t *testing.T) {
+	const rules = `192.168.1.2 nas.lan
+||blocked.example^
+`
+
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA, dns.TypePTR}
+
+	testCases := []struct {
+		name       string
+		host       string
+		wantReason map[uint16]Reason
+	}{{
+		name: "reverse",
+		host: "2.1.168.192.in-addr.arpa",
+		wantReason: map[uint16]Reason{
+			dns.TypeA:    NotFilteredNotFound,
+			dns.TypeAAAA: NotFilteredNotFound,
+			dns.TypePTR:  RewrittenRule,
+		},
+	}, {
+		name: "blocked",
+		host: "blocked.example",
+		wantReason: map[uint16]Reason{
+			dns.TypeA:    FilteredBlockList,
+			dns.TypeAAAA: FilteredBlockList,
+			dns.TypePTR:  FilteredBlockList,
+		},
+	}, {
+		name: "not_found",
+		host: "other.example",
+		wantReason: map[uint16]Reason{
+			dns.TypeA:    NotFilteredNotFound,
+			dns.TypeAAAA: NotFilteredNotFound,
+			dns.TypePTR:  NotFilteredNotFound,
+		},
+	}}
+
+	// checkFunc checks host for all of qtypes with either CheckHost or
+	// CheckHostMulti.
+	type checkFunc func(d *DNSFilter, host string, s *RequestFilteringSettings) (results map[uint16]Result)
+
+	checks := []struct {
+		name  string
+		check checkFunc
+	}{{
+		name: "check_host",
+		check: func(d *DNSFilter, host string, s *RequestFilteringSettings) (results map[uint16]Result) {
+			results = map[uint16]Result{}
+			for _, qt := range qtypes {
+				res, err := d.CheckHost(host, qt, s)
+				assert.Nil(t, err)
+
+				results[qt] = res
+			}
+
+			return results
+		},
+	}, {
+		name: "check_host_multi",
+		check: func(d *DNSFilter, host string, s *RequestFilteringSettings) (results map[uint16]Result) {
+			results, err := d.CheckHostMulti(host, qtypes, s)
+			assert.Nil(t, err)
+
+			return results
+		},
+	}}
+
+	for _, c := range checks {
+		for _, tc := range testCases {
+			t.Run(c.name+"_"+tc.name, func(t *testing.T) {
+				hookCalls := map[uint16]Reason{}
+				d := NewForTest(&Config{
+					OnResult: func(_ string, qtype uint16, res Result, _ string) {
+						hookCalls[qtype] = res.Reason
+					},
+				}, []Filter{{
+					ID: 0, Data: []byte(rules),
+				}})
+				t.Cleanup(d.Close)
+
+				namedSetts := setts
+				namedSetts.ClientName = "cli"
+
+				results := c.check(d, tc.host, &namedSetts)
+				assert.Len(t, results, len(qtypes))
+				for qt, want := range tc.wantReason {
+					assert.Equal(t, want, results[qt].Reason, dns.Type(qt).String())
+				}
+
+				assert.Equal(t, tc.wantReason, hookCalls)
+				assert.Equal(t, uint64(len(qtypes)), d.ClientStats("cli").Requests)
+			})
+		}
+	}
+}
+
+func TestDNSFilter_CheckHostMulti_safeBrowsing(t *testing.T) {
+	const sbHost = "malware.example"
+
+	d := NewForTest(&Config{SafeBrowsingEnabled: true}, nil)
+	t.Cleanup(d.Close)
+
+	ups := &testSbUpstream{
+		hostname: sbHost,
+		block:    true,
+	}
+	d.safeBrowsingUpstream = ups
+
+	results, err := d.CheckHostMulti(sbHost, testMultiQTypes, &setts)
+	assert.Nil(t, err)
+	for _, qt := range testMultiQTypes {
+		assert.True(t, results[qt].IsFiltered)
+		assert.Equal(t, FilteredSafeBrowsing, results[qt].Reason)
+	}
+
+	assert.Equal(t, 1, ups.requestsCount)
+}
+
+func BenchmarkDNSFilter_CheckHostMulti(b *testing.B) {
+	d := NewForTest(nil, []Filter{{
+		ID: 0, Data: []byte(testMultiRules),
+	}})
+	defer d.Close()
+
+	const host = "sub.blocked.example"
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+
+	b.Run("check_host", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, qt := range qtypes {
+				_, _ = d.CheckHost(host, qt, &setts)
+			}
+		}
+	})
+
+	b.Run("check_host_multi", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = d.CheckHostMulti(host, qtypes, &setts)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package dnsfilter
+
+import "github.com/AdguardTeam/golibs/log"
+
+// Actions taken when the filtering is enabled, but the blocklists have no
+// rules, see Config.NoRulesAction.
+const (
+	// NoRulesActionNone means that nothing is done.  It's the default.
+	NoRulesActionNone = "none"
+
+	// NoRulesActionDegraded means that the filtering is reported as
+	// degraded, see DNSFilter.Degraded.
+	NoRulesActionDegraded = "degraded"
+
+	// NoRulesActionFallback is like NoRulesActionDegraded, but the hosts
+	// from the built-in fallback list are also blocked until the
+	// blocklists have rules again.
+	NoRulesActionFallback = "fallback"
+)
+
+// NoRulesFallbackListID is the ID of the built-in fallback list used with
+// NoRulesActionFallback.
+const NoRulesFallbackListID int64 = -2
+
+// noRulesFallbackRules are the rules of the built-in fallback list.  It's a
+// minimal list of the well-known advertising and tracking domains.
+const noRulesFallbackRules = `||doubleclick.net^
+||googlesyndication.com^
+||googleadservices.com^
+||adservice.google.com^
+||app-measurement.com^
+||scorecardresearch.com^
+||adnxs.com^
+||criteo.com^
+`
+
+// noRulesFallbackFilter returns the built-in fallback list.
+func noRulesFallbackFilter() (f Filter) {
+	return Filter{
+		ID:   NoRulesFallbackListID,
+		Data: []byte(noRulesFallbackRules),
+		Name: "Built-in fallback list",
+	}
+}
+
+// countBlockRules returns the number of rules in the blocklists filters
+// according to counts.  See scanFilterLists.
+func countBlockRules(filters []Filter, counts map[int64]int) (n int) {
+	for _, f := range filters {
+		n += counts[f.ID]
+	}
+
+	return n
+}
+
+// withNoRulesFallback returns filters with the built-in fallback list added if
+// the blocklists filters have no rules and NoRulesActionFallback is used.
+func (d *DNSFilter) withNoRulesFallback(filters []Filter, rules int) (withFallback []Filter) {
+	if rules > 0 || d.NoRulesAction != NoRulesActionFallback {
+		return filters
+	}
+
+	log.Info("dnsfilter: blocklists have no rules, using the built-in fallback list")
+
+	withFallback = make([]Filter, 0, len(filters)+1)
+	withFallback = append(withFallback, filters...)
+
+	return append(withFallback, noRulesFallbackFilter())
+}
+
+// Degraded returns true if Config.NoRulesAction is NoRulesActionDegraded or
+// NoRulesActionFallback and the blocklists have no rules, so that nothing
+// except the built-in fallback list, if any, is blocked by the rules.
+func (d *DNSFilter) Degraded() (ok bool) {
+	switch d.NoRulesAction {
+	case NoRulesActionDegraded, NoRulesActionFallback:
+		// Go on.
+	default:
+		return false
+	}
+
+	d.engineLock.RLock()
+	defer d.engineLock.RUnlock()
+
+	return d.blockRules == 0
+}
@@ -0,0 +1,68 @@
+package dnsfilter
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSFilter_Degraded(t *testing.T) {
+	const (
+		fallbackHost = "doubleclick.net"
+		ruleHost     = "example.org"
+	)
+
+	noRules := []Filter{{ID: 0, Data: []byte("! Only a comment.\n")}}
+	withRules := []Filter{{ID: 0, Data: []byte("||" + ruleHost + "^\n")}}
+
+	isBlocked := func(t *testing.T, d *DNSFilter, host string) (ok bool) {
+		t.Helper()
+
+		res, err := d.CheckHost(host, dns.TypeA, &setts)
+		assert.Nil(t, err)
+
+		return res.IsFiltered
+	}
+
+	t.Run("none", func(t *testing.T) {
+		d := NewForTest(&Config{NoRulesAction: NoRulesActionNone}, noRules)
+		t.Cleanup(d.Close)
+
+		assert.False(t, d.Degraded())
+		assert.False(t, isBlocked(t, d, fallbackHost))
+	})
+
+	t.Run("degraded", func(t *testing.T) {
+		d := NewForTest(&Config{NoRulesAction: NoRulesActionDegraded}, noRules)
+		t.Cleanup(d.Close)
+
+		assert.True(t, d.Degraded())
+		assert.False(t, isBlocked(t, d, fallbackHost))
+
+		assert.Nil(t, d.SetFilters(withRules, nil, false))
+		assert.False(t, d.Degraded())
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		d := NewForTest(&Config{NoRulesAction: NoRulesActionFallback}, noRules)
+		t.Cleanup(d.Close)
+
+		assert.True(t, d.Degraded())
+
+		res, err := d.CheckHost(fallbackHost, dns.TypeA, &setts)
+		assert.Nil(t, err)
+		assert.True(t, res.IsFiltered)
+		if assert.Len(t, res.Rules, 1) {
+			assert.Equal(t, NoRulesFallbackListID, res.Rules[0].FilterListID)
+			assert.NotEmpty(t, res.Rules[0].FilterListName)
+		}
+
+		// The fallback list is only used while the blocklists have no
+		// rules.
+		assert.Nil(t, d.SetFilters(withRules, nil, false))
+		assert.False(t, d.Degraded())
+		assert.False(t, isBlocked(t, d, fallbackHost))
+		assert.True(t, isBlocked(t, d, ruleHost))
+	})
+}
@@ -0,0 +1,79 @@
+package dnsfilter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDecision is a filtering decision captured by the OnResult hook.
+type testDecision struct {
+	host   string
+	client string
+	res    Result
+	qtype  uint16
+}
+
+func TestDNSFilter_OnResult(t *testing.T) {
+	var decisions []testDecision
+	d := NewForTest(&Config{
+		OnResult: func(host string, qtype uint16, res Result, client string) {
+			decisions = append(decisions, testDecision{
+				host:   host,
+				client: client,
+				res:    res,
+				qtype:  qtype,
+			})
+		},
+	}, []Filter{{
+		ID: 0, Data: []byte("||blocked.example^\n"),
+	}})
+	t.Cleanup(d.Close)
+
+	namedSetts := setts
+	namedSetts.ClientName = "cli"
+	namedSetts.ClientIP = net.IP{1, 2, 3, 4}
+
+	blocked, err := d.CheckHost("blocked.example", dns.TypeA, &namedSetts)
+	assert.Nil(t, err)
+
+	unnamedSetts := setts
+	unnamedSetts.ClientIP = net.IP{1, 2, 3, 5}
+
+	allowed, err := d.CheckHost("allowed.example", dns.TypeAAAA, &unnamedSetts)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []testDecision{{
+		host:   "blocked.example",
+		client: "cli",
+		res:    blocked,
+		qtype:  dns.TypeA,
+	}, {
+		host:   "allowed.example",
+		client: "1.2.3.5",
+		res:    allowed,
+		qtype:  dns.TypeAAAA,
+	}}, decisions)
+	assert.True(t, decisions[0].res.IsFiltered)
+	assert.False(t, decisions[1].res.IsFiltered)
+
+	t.Run("panic", func(t *testing.T) {
+		pd := NewForTest(&Config{
+			OnResult: func(_ string, _ uint16, _ Result, _ string) {
+				panic("test")
+			},
+		}, []Filter{{
+			ID: 0, Data: []byte("||blocked.example^\n"),
+		}})
+		t.Cleanup(pd.Close)
+
+		var res Result
+		assert.NotPanics(t, func() {
+			res, err = pd.CheckHost("blocked.example", dns.TypeA, &setts)
+		})
+		assert.Nil(t, err)
+		assert.True(t, res.IsFiltered)
+	})
+}
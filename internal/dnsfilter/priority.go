@@ -0,0 +1,162 @@
+package dnsfilter
+
+import (
+	"sort"
+
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/AdguardTeam/urlfilter/filterlist"
+)
+
+// priorityEngine is the filtering engine for the blocklists with the same
+// priority.
+type priorityEngine struct {
+	rulesStorage *filterlist.RuleStorage
+	engine       *urlfilter.DNSEngine
+
+	// filters are the blocklists the engine is created from.
+	filters  []Filter
+	priority int
+}
+
+// createPriorityEngines creates the engines for the groups of filters with the
+// same priority sorted by descending priority.  They are used instead of the
+// common engine, so that the rules aren't stored twice.  If all filters have
+// the same priority, it returns nil, since the common engine is enough.
+// badfilters are the $badfilter rules added to every engine, see
+// scanFilterLists.
+//
+// The engines from cur which groups haven't changed and have none of the
+// filters with the IDs from changed are reused instead of being recreated, see
+// filtersChanged.  So an update of a list only recreates the engine of its
+// priority group.
+func createPriorityEngines(
+	filters []Filter,
+	badfilters string,
+	cur []priorityEngine,
+	changed []int64,
+) (engines []priorityEngine, err error) {
+	groups := map[int][]Filter{}
+	for _, f := range filters {
+		groups[f.Priority] = append(groups[f.Priority], f)
+	}
+
+	if len(groups) < 2 {
+		return nil, nil
+	}
+
+	var created []priorityEngine
+	for prio, group := range groups {
+		if pe, ok := reusablePriorityEngine(cur, prio, group, changed); ok {
+			engines = append(engines, pe)
+
+			continue
+		}
+
+		pe := priorityEngine{
+			filters:  group,
+			priority: prio,
+		}
+
+		pe.rulesStorage, pe.engine, err = createFilteringEngine(group, badfilters)
+		if err != nil {
+			for _, e := range created {
+				_ = e.rulesStorage.Close()
+			}
+
+			return nil, err
+		}
+
+		created = append(created, pe)
+		engines = append(engines, pe)
+	}
+
+	sort.Slice(engines, func(i, j int) bool {
+		return engines[i].priority > engines[j].priority
+	})
+
+	return engines, nil
+}
+
+// reusablePriorityEngine returns the engine from cur for the group of filters
+// with the priority prio if it can be reused, see createPriorityEngines.
+func reusablePriorityEngine(
+	cur []priorityEngine,
+	prio int,
+	group []Filter,
+	changed []int64,
+) (pe priorityEngine, ok bool) {
+	for _, pe = range cur {
+		if pe.priority == prio {
+			return pe, !filtersChanged(pe.filters, group, changed)
+		}
+	}
+
+	return priorityEngine{}, false
+}
+
+// priorityEngineReused returns true if the storage of pe is used by one of
+// engines.
+func priorityEngineReused(pe priorityEngine, engines []priorityEngine) (ok bool) {
+	for _, e := range engines {
+		if e.rulesStorage == pe.rulesStorage {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasBlockEngines returns true if the engines for the blocklists are created.
+//
+// d.engineLock is expected to be locked.
+func (d *DNSFilter) hasBlockEngines() (ok bool) {
+	return d.filteringEngine != nil || len(d.priorityEngines) != 0
+}
+
+// blockStorages returns the rule storages of the blocklists engines.
+//
+// d.engineLock is expected to be locked.
+func (d *DNSFilter) blockStorages() (storages []*filterlist.RuleStorage) {
+	if d.rulesStorage != nil {
+		return []*filterlist.RuleStorage{d.rulesStorage}
+	}
+
+	for _, pe := range d.priorityEngines {
+		storages = append(storages, pe.rulesStorage)
+	}
+
+	return storages
+}
+
+// matchBlockEngines matches ureq against the blocklists.  If the blocklists
+// have different priorities, the result is taken from the group with the
+// highest priority which has matched.  The $important rules, the first of
+// them in the order of the priorities, still win over the priorities unless
+// PriorityOverridesImportant is true.
+//
+// d.engineLock is expected to be locked.
+func (d *DNSFilter) matchBlockEngines(ureq urlfilter.DNSRequest) (dnsres urlfilter.DNSResult, ok bool) {
+	if len(d.priorityEngines) == 0 {
+		return d.filteringEngine.MatchRequest(ureq)
+	}
+
+	matched := false
+	for _, pe := range d.priorityEngines {
+		pres, pok := pe.engine.MatchRequest(ureq)
+		if !pok && len(pres.DNSRewrites()) == 0 {
+			continue
+		}
+
+		if d.PriorityOverridesImportant || isImportant(pres.NetworkRule) {
+			return pres, pok
+		}
+
+		// Go on looking for the $important rules in the groups with
+		// lower priorities.
+		if !matched {
+			dnsres, ok, matched = pres, pok, true
+		}
+	}
+
+	return dnsres, ok
+}
@@ -0,0 +1,108 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriorityEngines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsfilter")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	newFilter := func(id int64, prio int, text string) (f Filter) {
+		f = Filter{
+			ID:       id,
+			FilePath: filepath.Join(dir, fmt.Sprintf("%d.txt", id)),
+			Priority: prio,
+		}
+		assert.Nil(t, ioutil.WriteFile(f.FilePath, []byte(text), 0o644))
+
+		return f
+	}
+
+	testCases := []struct {
+		name              string
+		low               string
+		high              string
+		overrideImportant bool
+		want              bool
+	}{{
+		name: "high_blocks",
+		low:  "@@||example.org^\n",
+		high: "||example.org^\n",
+		want: true,
+	}, {
+		name: "high_allows",
+		low:  "||example.org^\n",
+		high: "@@||example.org^\n",
+		want: false,
+	}, {
+		name: "low_important",
+		low:  "@@||example.org^$important\n",
+		high: "||example.org^\n",
+		want: false,
+	}, {
+		name:              "low_important_overridden",
+		low:               "@@||example.org^$important\n",
+		high:              "||example.org^\n",
+		overrideImportant: true,
+		want:              true,
+	}, {
+		name: "low_only",
+		low:  "||example.org^\n",
+		high: "||example.com^\n",
+		want: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewForTest(&Config{
+				PriorityOverridesImportant: tc.overrideImportant,
+			}, []Filter{
+				newFilter(1, 0, tc.low),
+				newFilter(2, 10, tc.high),
+			})
+			defer d.Close()
+
+			assert.Len(t, d.priorityEngines, 2)
+			assert.Nil(t, d.filteringEngine)
+
+			res, err := d.CheckHost("example.org", dns.TypeA, &setts)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, res.IsFiltered)
+		})
+	}
+
+	t.Run("same_priority", func(t *testing.T) {
+		d := NewForTest(nil, []Filter{
+			newFilter(1, 5, "@@||example.org^\n"),
+			newFilter(2, 5, "||example.org^\n"),
+		})
+		defer d.Close()
+
+		assert.Nil(t, d.priorityEngines)
+		assert.NotNil(t, d.filteringEngine)
+
+		res, err := d.CheckHost("example.org", dns.TypeA, &setts)
+		assert.Nil(t, err)
+		assert.False(t, res.IsFiltered)
+	})
+
+	t.Run("all_rules", func(t *testing.T) {
+		d := NewForTest(nil, []Filter{
+			newFilter(1, 0, "||example.org^\n"),
+			newFilter(2, 10, "@@||example.org^\n"),
+		})
+		defer d.Close()
+
+		// The rules are found in all priority engines.
+		assert.Len(t, d.MatchAllRules("example.org"), 2)
+	})
+}
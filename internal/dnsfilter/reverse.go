@@ -0,0 +1,118 @@
+package dnsfilter
+
+import (
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/util"
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/miekg/dns"
+)
+
+// hostsReverse is the reverse lookup entry made of a line in the /etc/hosts
+// syntax, which maps its address back to the first, canonical, hostname of the
+// line, for example:
+//
+//	192.168.1.2 nas.lan nas
+type hostsReverse struct {
+	// host is the canonical hostname of the address.
+	host string
+
+	// text is the text of the line.
+	text string
+
+	// listID is the ID of the filter list containing the line.
+	listID int64
+}
+
+// parseHostsReverse parses line as a line in the /etc/hosts syntax and returns
+// the reverse lookup entry for its address.  ok is false if line isn't one or
+// if its address is unspecified or a loopback one, since the blocklists use
+// lines like "0.0.0.0 block.example" and "127.0.0.1 block.example" to block
+// the hosts and not to name the addresses.
+func parseHostsReverse(line string, listID int64) (ip net.IP, r hostsReverse, ok bool) {
+	fields := hostRuleFields(line)
+	if len(fields) < 2 {
+		return nil, hostsReverse{}, false
+	}
+
+	ip = net.ParseIP(fields[0])
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() {
+		return nil, hostsReverse{}, false
+	}
+
+	host := strings.ToLower(fields[1])
+	if !isPlainHost(host) {
+		return nil, hostsReverse{}, false
+	}
+
+	return ip, hostsReverse{
+		host:   host,
+		text:   line,
+		listID: listID,
+	}, true
+}
+
+// blockListsReverse returns the reverse lookup entries from reverse which
+// belong to the blocklists filters, since only those are used to resolve the
+// hosts.
+func blockListsReverse(
+	reverse map[string]hostsReverse,
+	filters []Filter,
+) (blockReverse map[string]hostsReverse) {
+	if len(reverse) == 0 {
+		return nil
+	}
+
+	ids := make(map[int64]struct{}, len(filters))
+	for _, f := range filters {
+		ids[f.ID] = struct{}{}
+	}
+
+	for addr, r := range reverse {
+		if _, ok := ids[r.listID]; !ok {
+			continue
+		}
+
+		if blockReverse == nil {
+			blockReverse = map[string]hostsReverse{}
+		}
+
+		blockReverse[addr] = r
+	}
+
+	return blockReverse
+}
+
+// matchReverse returns the result with the PTR record for the address of the
+// in-addr.arpa or ip6.arpa host from the rules in the /etc/hosts syntax.  res
+// is empty if host isn't a reverse lookup domain or if there is no such rule
+// for the address, so that the resolver could ask the upstream.
+func (d *DNSFilter) matchReverse(host string) (res Result) {
+	ip := util.DNSUnreverseAddr(host)
+	if ip == nil {
+		return Result{}
+	}
+
+	d.engineLock.RLock()
+	defer d.engineLock.RUnlock()
+
+	r, ok := d.reverse[ip.String()]
+	if !ok {
+		return Result{}
+	}
+
+	return Result{
+		Reason: RewrittenRule,
+		Rules: []*ResultRule{{
+			FilterListID: r.listID,
+			Text:         r.text,
+		}},
+		DNSRewriteResult: &DNSRewriteResult{
+			RCode: dns.RcodeSuccess,
+			Response: DNSRewriteResultResponse{
+				dns.TypePTR: []rules.RRValue{dns.Fqdn(r.host)},
+			},
+		},
+	}
+}
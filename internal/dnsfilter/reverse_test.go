@@ -0,0 +1,134 @@
+package dnsfilter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHostsReverse(t *testing.T) {
+	testCases := []struct {
+		name   string
+		line   string
+		wantIP net.IP
+		want   hostsReverse
+		wantOK bool
+	}{{
+		name:   "canonical",
+		line:   "192.168.1.2 NAS.lan nas 300",
+		wantIP: net.IP{192, 168, 1, 2},
+		want: hostsReverse{
+			host:   "nas.lan",
+			text:   "192.168.1.2 NAS.lan nas 300",
+			listID: 1,
+		},
+		wantOK: true,
+	}, {
+		name:   "ipv6",
+		line:   "fe80::1 router.lan # comment",
+		wantIP: net.ParseIP("fe80::1"),
+		want: hostsReverse{
+			host:   "router.lan",
+			text:   "fe80::1 router.lan # comment",
+			listID: 1,
+		},
+		wantOK: true,
+	}, {
+		name:   "unspecified",
+		line:   "0.0.0.0 block.example",
+		wantOK: false,
+	}, {
+		name:   "loopback",
+		line:   "127.0.0.1 block.example",
+		wantOK: false,
+	}, {
+		name:   "no_host",
+		line:   "192.168.1.2",
+		wantOK: false,
+	}, {
+		name:   "alias",
+		line:   "alias.local target.local",
+		wantOK: false,
+	}, {
+		name:   "rule",
+		line:   "||example.org^",
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ip, r, ok := parseHostsReverse(tc.line, 1)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.True(t, tc.wantIP.Equal(ip))
+			assert.Equal(t, tc.want, r)
+		})
+	}
+}
+
+func TestDNSFilter_CheckHost_reverse(t *testing.T) {
+	const text = `192.168.1.2 nas.lan nas
+192.168.1.2 other.lan
+fe80::1 router.lan
+0.0.0.0 block.example
+|3.1.168.192.in-addr.arpa^$dnsrewrite=NOERROR;PTR;printer.lan.
+`
+
+	d := NewForTest(nil, []Filter{{
+		ID: 0, Data: []byte(text),
+	}})
+	t.Cleanup(d.Close)
+
+	testCases := []struct {
+		name     string
+		host     string
+		wantText string
+		wantPTR  string
+	}{{
+		name:     "hosts",
+		host:     "2.1.168.192.in-addr.arpa",
+		wantText: "192.168.1.2 nas.lan nas",
+		wantPTR:  "nas.lan.",
+	}, {
+		name:     "hosts_ipv6",
+		host:     "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.e.f.ip6.arpa",
+		wantText: "fe80::1 router.lan",
+		wantPTR:  "router.lan.",
+	}, {
+		name:     "dnsrewrite",
+		host:     "3.1.168.192.in-addr.arpa",
+		wantText: "|3.1.168.192.in-addr.arpa^$dnsrewrite=NOERROR;PTR;printer.lan.",
+		wantPTR:  "printer.lan.",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.CheckHost(tc.host, dns.TypePTR, &setts)
+			assert.Nil(t, err)
+			assert.Equal(t, RewrittenRule, res.Reason)
+
+			if assert.Len(t, res.Rules, 1) {
+				assert.Equal(t, tc.wantText, res.Rules[0].Text)
+			}
+
+			if assert.NotNil(t, res.DNSRewriteResult) {
+				assert.Equal(t, rules.RCode(dns.RcodeSuccess), res.DNSRewriteResult.RCode)
+				assert.Equal(t, []rules.RRValue{tc.wantPTR}, res.DNSRewriteResult.Response[dns.TypePTR])
+			}
+		})
+	}
+
+	t.Run("not_found", func(t *testing.T) {
+		for _, host := range []string{
+			"9.1.168.192.in-addr.arpa",
+			"0.0.0.0.in-addr.arpa",
+			"nas.lan",
+		} {
+			res, err := d.CheckHost(host, dns.TypePTR, &setts)
+			assert.Nil(t, err)
+			assert.Equal(t, NotFilteredNotFound, res.Reason, host)
+		}
+	})
+}
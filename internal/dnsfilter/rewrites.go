@@ -4,9 +4,11 @@ package dnsfilter
 
 import (
 	"encoding/json"
+	"math/rand"
 	"net"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/AdguardTeam/golibs/log"
@@ -16,8 +18,8 @@ import (
 // RewriteEntry is a rewrite array element
 type RewriteEntry struct {
 	Domain string `yaml:"domain"`
-	Answer string `yaml:"answer"` // IP address or canonical name
-	Type   uint16 `yaml:"-"`      // DNS record type: CNAME, A or AAAA
+	Answer string `yaml:"answer"` // IP address, comma-separated list of IP addresses, or canonical name
+	Type   uint16 `yaml:"-"`      // DNS record type: CNAME, A, AAAA, or ANY for a list of addresses of both families
 	IP     net.IP `yaml:"-"`      // Parsed IP address (if Type is A or AAAA)
 }
 
@@ -69,6 +71,13 @@ func (a rewritesArray) Less(i, j int) bool {
 
 // Prepare entry for use
 func (r *RewriteEntry) prepare() {
+	if isRewriteIPList(r.Answer) {
+		r.IP = nil
+		_, _, r.Type = parseRewriteIPs(r.Domain, r.Answer)
+
+		return
+	}
+
 	if r.Answer == "AAAA" {
 		r.IP = nil
 		r.Type = dns.TypeAAAA
@@ -95,6 +104,94 @@ func (r *RewriteEntry) prepare() {
 	}
 }
 
+// isRewriteIPList returns true if answer is a comma-separated list of IP
+// addresses or an IP address with a weight.
+func isRewriteIPList(answer string) (ok bool) {
+	return strings.ContainsAny(answer, ",=")
+}
+
+// parseRewriteIPs parses the answer of the rewrite for domain which is a
+// comma-separated list of IP addresses with optional weights, for example
+// "1.2.3.4=70, 1.2.3.5=30".  The default weight is 1, and weights are nil if
+// none is set.  typ is A or AAAA if all addresses are of that family, ANY if
+// they are of both, and None if any of them is invalid.
+func parseRewriteIPs(domain, answer string) (ips []net.IP, weights []uint32, typ uint16) {
+	var has4, has6, hasWeights bool
+	for _, s := range strings.Split(answer, ",") {
+		s = strings.TrimSpace(s)
+
+		var w uint32 = 1
+		if i := strings.IndexByte(s, '='); i >= 0 {
+			w64, err := strconv.ParseUint(strings.TrimSpace(s[i+1:]), 10, 32)
+			if err != nil || w64 == 0 {
+				log.Info("rewrite: %s: invalid weight in %q", domain, s)
+
+				return nil, nil, dns.TypeNone
+			}
+
+			w = uint32(w64)
+			hasWeights = true
+			s = strings.TrimSpace(s[:i])
+		}
+
+		ip := net.ParseIP(s)
+		if ip == nil {
+			log.Info("rewrite: %s: invalid ip address %q", domain, s)
+
+			return nil, nil, dns.TypeNone
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			has4 = true
+		} else {
+			has6 = true
+		}
+
+		ips = append(ips, ip)
+		weights = append(weights, w)
+	}
+
+	if !hasWeights {
+		weights = nil
+	}
+
+	switch {
+	case has4 && has6:
+		return ips, weights, dns.TypeANY
+	case has4:
+		return ips, weights, dns.TypeA
+	default:
+		return ips, weights, dns.TypeAAAA
+	}
+}
+
+// weightedShuffle reorders ips so that the probability of each of them to be
+// at any position, considering the ones before it, is proportional to its
+// weight.  weights are reordered along with ips.
+func weightedShuffle(rng *rand.Rand, ips []net.IP, weights []uint32) {
+	var total uint64
+	for _, w := range weights {
+		total += uint64(w)
+	}
+
+	for i := range ips {
+		n := uint64(rng.Int63n(int64(total)))
+		j := i
+		for ; j < len(ips)-1; j++ {
+			if n < uint64(weights[j]) {
+				break
+			}
+
+			n -= uint64(weights[j])
+		}
+
+		total -= uint64(weights[j])
+		ips[i], ips[j] = ips[j], ips[i]
+		weights[i], weights[j] = weights[j], weights[i]
+	}
+}
+
 func (d *DNSFilter) prepareRewrites() {
 	for i := range d.Rewrites {
 		d.Rewrites[i].prepare()
@@ -108,6 +205,11 @@ func (d *DNSFilter) prepareRewrites() {
 func findRewrites(a []RewriteEntry, host string) []RewriteEntry {
 	rr := rewritesArray{}
 	for _, r := range a {
+		if r.Type == dns.TypeNone {
+			// An invalid entry.
+			continue
+		}
+
 		if r.Domain != host {
 			if !matchDomainWildcard(host, r.Domain) {
 				continue
@@ -182,6 +284,12 @@ func (d *DNSFilter) handleRewriteAdd(w http.ResponseWriter, r *http.Request) {
 		Answer: jsent.Answer,
 	}
 	ent.prepare()
+	if ent.Type == dns.TypeNone {
+		httpError(r, w, http.StatusBadRequest, "invalid answer %q", ent.Answer)
+
+		return
+	}
+
 	d.confLock.Lock()
 	d.Config.Rewrites = append(d.Config.Rewrites, ent)
 	d.confLock.Unlock()
@@ -1,6 +1,7 @@
 package dnsfilter
 
 import (
+	"math/rand"
 	"net"
 	"testing"
 
@@ -103,6 +104,46 @@ func TestRewrites(t *testing.T) {
 	assert.True(t, r.IPList[0].Equal(net.IP{1, 2, 3, 4}))
 }
 
+func TestRewritesMultipleIPs(t *testing.T) {
+	d := DNSFilter{}
+	d.Rewrites = []RewriteEntry{
+		{Domain: "host.com", Answer: "1.2.3.4, 1:2:3::4,1.2.3.5"},
+		{Domain: "host4.com", Answer: "1.2.3.4, 1.2.3.5"},
+		{Domain: "bad.com", Answer: "1.2.3.4, bad"},
+	}
+	d.prepareRewrites()
+	assert.Equal(t, dns.TypeANY, d.Rewrites[0].Type)
+	assert.Equal(t, dns.TypeA, d.Rewrites[1].Type)
+	assert.Equal(t, dns.TypeNone, d.Rewrites[2].Type)
+
+	r := d.processRewrites("host.com", dns.TypeA)
+	assert.Equal(t, Rewritten, r.Reason)
+	if assert.Len(t, r.IPList, 2) {
+		assert.True(t, r.IPList[0].Equal(net.IP{1, 2, 3, 4}))
+		assert.True(t, r.IPList[1].Equal(net.IP{1, 2, 3, 5}))
+	}
+
+	r = d.processRewrites("host.com", dns.TypeAAAA)
+	assert.Equal(t, Rewritten, r.Reason)
+	if assert.Len(t, r.IPList, 1) {
+		assert.True(t, r.IPList[0].Equal(net.ParseIP("1:2:3::4")))
+	}
+
+	// no addresses of the other family
+	r = d.processRewrites("host4.com", dns.TypeAAAA)
+	assert.Equal(t, Rewritten, r.Reason)
+	assert.Empty(t, r.IPList)
+
+	// invalid entries are ignored
+	r = d.processRewrites("bad.com", dns.TypeA)
+	assert.Equal(t, NotFilteredNotFound, r.Reason)
+
+	d.RewritesShuffle = true
+	r = d.processRewrites("host.com", dns.TypeA)
+	assert.Equal(t, Rewritten, r.Reason)
+	assert.Len(t, r.IPList, 2)
+}
+
 func TestRewritesLevels(t *testing.T) {
 	d := DNSFilter{}
 	// exact host, wildcard L2, wildcard L3
@@ -213,3 +254,65 @@ func TestRewritesExceptionIP(t *testing.T) {
 	assert.Equal(t, Rewritten, r.Reason)
 	assert.Empty(t, r.IPList)
 }
+
+func TestRewritesWeights(t *testing.T) {
+	d := DNSFilter{}
+	d.Rewrites = []RewriteEntry{
+		{Domain: "host.com", Answer: "1.2.3.4=70, 1.2.3.5=30"},
+		{Domain: "mixed.com", Answer: "1.2.3.4=3, 1.2.3.5, 1:2:3::4=5"},
+		{Domain: "zero.com", Answer: "1.2.3.4=0, 1.2.3.5"},
+		{Domain: "bad.com", Answer: "1.2.3.4=x, 1.2.3.5"},
+	}
+	d.prepareRewrites()
+	d.rewritesRand = rand.New(rand.NewSource(1))
+
+	assert.Equal(t, dns.TypeA, d.Rewrites[0].Type)
+	_, weights, _ := parseRewriteIPs(d.Rewrites[0].Domain, d.Rewrites[0].Answer)
+	assert.Equal(t, []uint32{70, 30}, weights)
+	assert.Equal(t, dns.TypeANY, d.Rewrites[1].Type)
+	_, weights, _ = parseRewriteIPs(d.Rewrites[1].Domain, d.Rewrites[1].Answer)
+	assert.Equal(t, []uint32{3, 1, 5}, weights)
+	assert.Equal(t, dns.TypeNone, d.Rewrites[2].Type)
+	assert.Equal(t, dns.TypeNone, d.Rewrites[3].Type)
+
+	const n = 10000
+	first := map[string]int{}
+	for i := 0; i < n; i++ {
+		r := d.processRewrites("host.com", dns.TypeA)
+		assert.Equal(t, Rewritten, r.Reason)
+		if !assert.Len(t, r.IPList, 2) {
+			return
+		}
+
+		first[r.IPList[0].String()]++
+	}
+
+	assert.InDelta(t, 0.7, float64(first["1.2.3.4"])/n, 0.02)
+	assert.InDelta(t, 0.3, float64(first["1.2.3.5"])/n, 0.02)
+
+	// Only the addresses of the requested family are weighted.
+	first = map[string]int{}
+	for i := 0; i < n; i++ {
+		r := d.processRewrites("mixed.com", dns.TypeA)
+		if !assert.Len(t, r.IPList, 2) {
+			return
+		}
+
+		first[r.IPList[0].String()]++
+	}
+
+	assert.InDelta(t, 0.75, float64(first["1.2.3.4"])/n, 0.02)
+	assert.InDelta(t, 0.25, float64(first["1.2.3.5"])/n, 0.02)
+
+	// The same seed gives the same order.
+	order := func(seed int64) (ips []string) {
+		d.rewritesRand = rand.New(rand.NewSource(seed))
+		for i := 0; i < 10; i++ {
+			r := d.processRewrites("host.com", dns.TypeA)
+			ips = append(ips, r.IPList[0].String())
+		}
+
+		return ips
+	}
+	assert.Equal(t, order(42), order(42))
+}
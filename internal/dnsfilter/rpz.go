@@ -0,0 +1,524 @@
+package dnsfilter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Response policy zones.
+//
+// See https://tools.ietf.org/html/draft-vixie-dnsop-dns-rpz-00.
+
+const (
+	// rpzRefreshInterval is the interval between the reloads of the response
+	// policy zones.
+	rpzRefreshInterval = 1 * time.Hour
+
+	// rpzTimeout is the timeout of fetching a response policy zone over the
+	// network.
+	rpzTimeout = 1 * time.Minute
+
+	// rpzAXFRScheme is the URL scheme of the response policy zones
+	// transferred from a primary server, for example
+	// "axfr://192.168.1.2/rpz.example".
+	rpzAXFRScheme = "axfr"
+
+	// rpzIPLabel is the label of the response IP address triggers.
+	rpzIPLabel = "rpz-ip"
+)
+
+// rpzAction is the action of a response policy.
+type rpzAction int
+
+// Response policy actions.
+const (
+	rpzActionNXDOMAIN rpzAction = iota
+	rpzActionNODATA
+	rpzActionPassthru
+	rpzActionCNAME
+)
+
+// rpzPolicy is a single policy of a response policy zone.
+type rpzPolicy struct {
+	// target is the target of the CNAME redirect.
+	target string
+
+	// text is the text of the record defining the policy.
+	text string
+
+	action rpzAction
+}
+
+// rpzIPPolicy is a policy with a response IP address trigger.
+type rpzIPPolicy struct {
+	subnet *net.IPNet
+	rpzPolicy
+}
+
+// rpzZone is a parsed response policy zone.
+type rpzZone struct {
+	// qnames are the policies with the QNAME triggers for exact names.
+	qnames map[string]*rpzPolicy
+
+	// wildcards are the policies with the QNAME triggers for the
+	// subdomains of the names.  The keys are the names without "*.".
+	wildcards map[string]*rpzPolicy
+
+	// ips are the policies with the response IP address triggers.
+	ips []*rpzIPPolicy
+
+	// origin is the lowercased FQDN of the zone.
+	origin string
+
+	// source is the URL or the file path the zone has been loaded from.
+	source string
+}
+
+// newRPZZone returns a new empty response policy zone with the origin.
+func newRPZZone(origin string) (z *rpzZone) {
+	return &rpzZone{
+		qnames:    map[string]*rpzPolicy{},
+		wildcards: map[string]*rpzPolicy{},
+		origin:    strings.ToLower(dns.Fqdn(origin)),
+	}
+}
+
+// parseRPZ parses the response policy zone in the master file format from r.
+// If origin is empty, the owner of the first SOA record is used.
+func parseRPZ(r io.Reader, origin string) (z *rpzZone, err error) {
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(r, dns.Fqdn(origin), "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+
+	err = zp.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return rpzFromRRs(rrs, origin)
+}
+
+// rpzFromRRs returns the response policy zone with the records rrs.  If
+// origin is empty, the owner of the first SOA record is used.
+func rpzFromRRs(rrs []dns.RR, origin string) (z *rpzZone, err error) {
+	if origin == "" {
+		for _, rr := range rrs {
+			if soa, ok := rr.(*dns.SOA); ok {
+				origin = soa.Hdr.Name
+
+				break
+			}
+		}
+
+		if origin == "" {
+			return nil, agherr.Error("no origin and no soa record")
+		}
+	}
+
+	z = newRPZZone(origin)
+	for _, rr := range rrs {
+		err = z.add(rr)
+		if err != nil {
+			log.Debug("rpz %s: skipping %q: %s", z.origin, rr, err)
+		}
+	}
+
+	return z, nil
+}
+
+// add adds the policy defined by rr to z.
+func (z *rpzZone) add(rr dns.RR) (err error) {
+	switch rr.(type) {
+	case *dns.SOA, *dns.NS:
+		return nil
+	}
+
+	owner := strings.ToLower(rr.Header().Name)
+	if !strings.HasSuffix(owner, "."+z.origin) {
+		return agherr.Error("owner is out of zone")
+	}
+
+	trigger := strings.TrimSuffix(owner, "."+z.origin)
+
+	cname, ok := rr.(*dns.CNAME)
+	if !ok {
+		return fmt.Errorf("unsupported record type %s", dns.Type(rr.Header().Rrtype))
+	}
+
+	p := rpzPolicy{
+		text: strings.Join(strings.Fields(rr.String()), " "),
+	}
+
+	switch target := strings.ToLower(cname.Target); target {
+	case ".":
+		p.action = rpzActionNXDOMAIN
+	case "*.":
+		p.action = rpzActionNODATA
+	case "rpz-passthru.":
+		p.action = rpzActionPassthru
+	default:
+		if strings.HasPrefix(target, "rpz-") {
+			return fmt.Errorf("unsupported action %q", target)
+		}
+
+		p.action = rpzActionCNAME
+		p.target = strings.TrimSuffix(target, ".")
+	}
+
+	if strings.HasSuffix(trigger, "."+rpzIPLabel) {
+		// The response IP address policies are applied to the responses
+		// which have already been received, so there is nothing to
+		// redirect them to.
+		if p.action == rpzActionCNAME {
+			return agherr.Error("cname redirect isn't supported for ip triggers")
+		}
+
+		var n *net.IPNet
+		n, err = parseRPZIP(strings.TrimSuffix(trigger, "."+rpzIPLabel))
+		if err != nil {
+			return err
+		}
+
+		z.ips = append(z.ips, &rpzIPPolicy{
+			subnet:    n,
+			rpzPolicy: p,
+		})
+	} else if strings.HasPrefix(trigger, "*.") {
+		z.wildcards[trigger[2:]] = &p
+	} else {
+		z.qnames[trigger] = &p
+	}
+
+	return nil
+}
+
+// parseRPZIP parses the network from the labels of a response IP address
+// trigger, for example "24.0.2.0.192" for 192.0.2.0/24 or "48.zz.db8.2001"
+// for 2001:db8::/48.
+func parseRPZIP(s string) (n *net.IPNet, err error) {
+	labels := strings.Split(s, ".")
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("bad ip trigger %q", s)
+	}
+
+	prefix, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad prefix length in ip trigger %q: %w", s, err)
+	}
+
+	labels = labels[1:]
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	addr := strings.Join(labels, ".")
+	if len(labels) != net.IPv4len || net.ParseIP(addr) == nil {
+		for i, l := range labels {
+			if l == "zz" {
+				labels[i] = ""
+			}
+		}
+
+		addr = strings.Join(labels, ":")
+		if strings.HasPrefix(addr, ":") {
+			addr = ":" + addr
+		}
+
+		if strings.HasSuffix(addr, ":") {
+			addr += ":"
+		}
+	}
+
+	_, n, err = net.ParseCIDR(fmt.Sprintf("%s/%d", addr, prefix))
+	if err != nil {
+		return nil, fmt.Errorf("bad ip trigger %q: %w", s, err)
+	}
+
+	return n, nil
+}
+
+// matchQNAME returns the policy for host or nil if there is none.  The exact
+// triggers win over the wildcard ones, and the longer wildcard triggers win
+// over the shorter ones.
+func (z *rpzZone) matchQNAME(host string) (p *rpzPolicy) {
+	if p = z.qnames[host]; p != nil {
+		return p
+	}
+
+	for h := host; ; {
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			return nil
+		}
+
+		h = h[i+1:]
+		if p = z.wildcards[h]; p != nil {
+			return p
+		}
+	}
+}
+
+// matchIP returns the policy for ip with the longest matching prefix or nil if
+// there is none.
+func (z *rpzZone) matchIP(ip net.IP) (p *rpzPolicy) {
+	best := -1
+	for _, ipp := range z.ips {
+		if !ipp.subnet.Contains(ip) {
+			continue
+		}
+
+		ones, _ := ipp.subnet.Mask.Size()
+		if ones > best {
+			best = ones
+			p = &ipp.rpzPolicy
+		}
+	}
+
+	return p
+}
+
+// result returns the filtering result of applying p.
+func (p *rpzPolicy) result() (res Result) {
+	res.Rules = []*ResultRule{{
+		Text: p.text,
+	}}
+
+	switch p.action {
+	case rpzActionNXDOMAIN:
+		res.Reason = RewrittenRule
+		res.DNSRewriteResult = &DNSRewriteResult{
+			RCode: dns.RcodeNameError,
+		}
+	case rpzActionNODATA:
+		res.Reason = RewrittenRule
+		res.DNSRewriteResult = &DNSRewriteResult{
+			RCode:    dns.RcodeSuccess,
+			Response: DNSRewriteResultResponse{},
+		}
+	case rpzActionPassthru:
+		res.Reason = NotFilteredAllowList
+	case rpzActionCNAME:
+		res.Reason = RewrittenRule
+		res.CanonName = p.target
+		res.CNAMEHops = 1
+	}
+
+	return res
+}
+
+// rpzCtx contains the loaded response policy zones.
+type rpzCtx struct {
+	// lock protects zones.
+	lock sync.RWMutex
+
+	// zones are the loaded zones in the order of the configuration.
+	zones []*rpzZone
+
+	// updaterCancel stops the updater, if it's started.  updaterWG is used
+	// to wait for it to exit.
+	updaterCancel context.CancelFunc
+	updaterWG     sync.WaitGroup
+}
+
+// matchRPZ returns the result of the first response policy zone which has a
+// QNAME policy for host.
+func (d *DNSFilter) matchRPZ(host string) (res Result) {
+	d.rpz.lock.RLock()
+	defer d.rpz.lock.RUnlock()
+
+	for _, z := range d.rpz.zones {
+		if p := z.matchQNAME(host); p != nil {
+			return p.result()
+		}
+	}
+
+	return Result{}
+}
+
+// CheckResponseIP returns the result of the first response policy zone which
+// has a response IP address policy for ip.  It's only set if the filtering is
+// enabled in setts.
+func (d *DNSFilter) CheckResponseIP(ip net.IP, setts *RequestFilteringSettings) (res Result) {
+	if !setts.FilteringEnabled || !isClassIN(setts.QClass) {
+		return Result{}
+	}
+
+	d.rpz.lock.RLock()
+	defer d.rpz.lock.RUnlock()
+
+	for _, z := range d.rpz.zones {
+		if p := z.matchIP(ip); p != nil {
+			return p.result()
+		}
+	}
+
+	return Result{}
+}
+
+// startRPZUpdater starts the goroutine which reloads the response policy zones
+// every ivl.  Close stops it.
+func (d *DNSFilter) startRPZUpdater(ivl time.Duration) {
+	var ctx context.Context
+	ctx, d.rpz.updaterCancel = context.WithCancel(context.Background())
+
+	d.rpz.updaterWG.Add(1)
+	go d.rpzUpdater(ctx, ivl)
+}
+
+// stopRPZUpdater stops the goroutine started by startRPZUpdater, if any, and
+// waits for it to exit.
+func (d *DNSFilter) stopRPZUpdater() {
+	if d.rpz.updaterCancel == nil {
+		return
+	}
+
+	d.rpz.updaterCancel()
+	d.rpz.updaterWG.Wait()
+}
+
+// rpzUpdater loads the response policy zones right away and then every ivl
+// until ctx is canceled.
+func (d *DNSFilter) rpzUpdater(ctx context.Context, ivl time.Duration) {
+	defer d.rpz.updaterWG.Done()
+
+	t := time.NewTicker(ivl)
+	defer t.Stop()
+
+	for {
+		d.loadRPZZones()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			// Go on.
+		}
+	}
+}
+
+// loadRPZZones loads the zones from RPZZones.  If a zone can't be loaded, the
+// previously loaded version of it is kept.
+func (d *DNSFilter) loadRPZZones() {
+	d.rpz.lock.RLock()
+	prev := map[string]*rpzZone{}
+	for _, z := range d.rpz.zones {
+		prev[z.source] = z
+	}
+	d.rpz.lock.RUnlock()
+
+	zones := make([]*rpzZone, 0, len(d.RPZZones))
+	for _, u := range d.RPZZones {
+		z, err := fetchRPZ(u)
+		if err != nil {
+			log.Error("dnsfilter: loading rpz %s: %s", u, err)
+
+			z = prev[u]
+			if z == nil {
+				continue
+			}
+		} else {
+			z.source = u
+			log.Debug("dnsfilter: loaded rpz %s: %d names, %d wildcards, %d ips",
+				u, len(z.qnames), len(z.wildcards), len(z.ips))
+		}
+
+		zones = append(zones, z)
+	}
+
+	d.rpz.lock.Lock()
+	d.rpz.zones = zones
+	d.rpz.lock.Unlock()
+}
+
+// fetchRPZ loads the response policy zone from rawurl, which is either an AXFR
+// URL, an HTTP(S) URL, or a file path.
+func fetchRPZ(rawurl string) (z *rpzZone, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		var f *os.File
+		f, err = os.Open(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return parseRPZ(f, "")
+	}
+
+	switch u.Scheme {
+	case rpzAXFRScheme:
+		return transferRPZ(u)
+	case "http", "https":
+		c := &http.Client{
+			Timeout: rpzTimeout,
+		}
+
+		var resp *http.Response
+		resp, err = c.Get(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("got status code %d", resp.StatusCode)
+		}
+
+		return parseRPZ(resp.Body, "")
+	default:
+		return nil, fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+}
+
+// transferRPZ transfers the response policy zone using AXFR from the primary
+// server in u.
+func transferRPZ(u *url.URL) (z *rpzZone, err error) {
+	zone := strings.Trim(u.Path, "/")
+	if zone == "" {
+		return nil, agherr.Error("no zone in axfr url")
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(strings.Trim(u.Host, "[]"), "53")
+	}
+
+	req := &dns.Msg{}
+	req.SetAxfr(dns.Fqdn(zone))
+
+	t := &dns.Transfer{
+		DialTimeout: rpzTimeout,
+		ReadTimeout: rpzTimeout,
+	}
+
+	envs, err := t.In(req, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var rrs []dns.RR
+	for env := range envs {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+
+		rrs = append(rrs, env.RR...)
+	}
+
+	return rpzFromRRs(rrs, zone)
+}
@@ -0,0 +1,282 @@
+package dnsfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRPZ = `$TTL 300
+@ IN SOA localhost. root.localhost. 1 3600 600 86400 300
+@ IN NS localhost.
+
+blocked.example     CNAME .
+nodata.example      CNAME *.
+*.wild.example      CNAME .
+allowed.wild.example CNAME rpz-passthru.
+exempt.example      CNAME rpz-passthru.
+redirect.example    CNAME safe.example.
+drop.example        CNAME rpz-drop.
+local.example       A 1.2.3.4
+
+32.4.2.0.192.rpz-ip CNAME .
+24.0.2.0.192.rpz-ip CNAME *.
+32.5.2.0.192.rpz-ip CNAME rpz-passthru.
+48.zz.db8.2001.rpz-ip CNAME .
+32.9.3.0.192.rpz-ip CNAME safe.example.
+`
+
+func newTestRPZ(t *testing.T) (z *rpzZone) {
+	t.Helper()
+
+	z, err := parseRPZ(strings.NewReader(testRPZ), "rpz.example")
+	assert.Nil(t, err)
+
+	return z
+}
+
+func TestParseRPZ(t *testing.T) {
+	z := newTestRPZ(t)
+
+	assert.Equal(t, "rpz.example.", z.origin)
+	assert.Len(t, z.qnames, 5)
+	assert.Len(t, z.wildcards, 1)
+	assert.Len(t, z.ips, 4)
+
+	t.Run("soa_origin", func(t *testing.T) {
+		text := "$ORIGIN rpz.example.\n" + testRPZ
+		sz, err := parseRPZ(strings.NewReader(text), "")
+		assert.Nil(t, err)
+		if assert.NotNil(t, sz) {
+			assert.Equal(t, "rpz.example.", sz.origin)
+		}
+	})
+
+	t.Run("no_origin", func(t *testing.T) {
+		_, err := parseRPZ(strings.NewReader("blocked.example. CNAME .\n"), "")
+		assert.NotNil(t, err)
+	})
+}
+
+func TestParseRPZIP(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want string
+	}{{
+		in:   "32.4.2.0.192",
+		want: "192.0.2.4/32",
+	}, {
+		in:   "24.0.2.0.192",
+		want: "192.0.2.0/24",
+	}, {
+		in:   "48.zz.db8.2001",
+		want: "2001:db8::/48",
+	}, {
+		in:   "128.1.zz",
+		want: "::1/128",
+	}, {
+		in:   "64.zz.4.3.2.1",
+		want: "1:2:3:4::/64",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.in, func(t *testing.T) {
+			n, err := parseRPZIP(tc.in)
+			assert.Nil(t, err)
+			if assert.NotNil(t, n) {
+				assert.Equal(t, tc.want, n.String())
+			}
+		})
+	}
+
+	_, err := parseRPZIP("bad.1.2.3.4")
+	assert.NotNil(t, err)
+}
+
+func TestDNSFilter_RPZ(t *testing.T) {
+	d := NewForTest(nil, []Filter{{
+		ID: 0, Data: []byte("||exempt.example^\n||allowed.wild.example^\n"),
+	}})
+	defer d.Close()
+
+	d.rpz.zones = []*rpzZone{newTestRPZ(t)}
+
+	testCases := []struct {
+		name       string
+		host       string
+		wantReason Reason
+		wantRCode  int
+		wantCNAME  string
+	}{{
+		name:       "nxdomain",
+		host:       "blocked.example",
+		wantReason: RewrittenRule,
+		wantRCode:  dns.RcodeNameError,
+	}, {
+		name:       "nxdomain_subdomain",
+		host:       "sub.blocked.example",
+		wantReason: NotFilteredNotFound,
+	}, {
+		name:       "nodata",
+		host:       "nodata.example",
+		wantReason: RewrittenRule,
+		wantRCode:  dns.RcodeSuccess,
+	}, {
+		name:       "wildcard",
+		host:       "a.b.wild.example",
+		wantReason: RewrittenRule,
+		wantRCode:  dns.RcodeNameError,
+	}, {
+		name:       "wildcard_apex",
+		host:       "wild.example",
+		wantReason: NotFilteredNotFound,
+	}, {
+		name:       "passthru_exact_over_wildcard",
+		host:       "allowed.wild.example",
+		wantReason: NotFilteredAllowList,
+	}, {
+		name:       "passthru",
+		host:       "exempt.example",
+		wantReason: NotFilteredAllowList,
+	}, {
+		name:       "cname",
+		host:       "redirect.example",
+		wantReason: RewrittenRule,
+		wantCNAME:  "safe.example",
+	}, {
+		name:       "unsupported",
+		host:       "drop.example",
+		wantReason: NotFilteredNotFound,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.CheckHost(tc.host, dns.TypeA, &setts)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.wantReason, res.Reason)
+			assert.Equal(t, tc.wantCNAME, res.CanonName)
+			if tc.wantReason == RewrittenRule && tc.wantCNAME == "" {
+				if assert.NotNil(t, res.DNSRewriteResult) {
+					assert.Equal(t, tc.wantRCode, res.DNSRewriteResult.RCode)
+					assert.Empty(t, res.DNSRewriteResult.Response)
+				}
+			}
+		})
+	}
+
+	t.Run("filtering_disabled", func(t *testing.T) {
+		s := setts
+		s.FilteringEnabled = false
+
+		res, err := d.CheckHost("blocked.example", dns.TypeA, &s)
+		assert.Nil(t, err)
+		assert.Equal(t, NotFilteredNotFound, res.Reason)
+	})
+}
+
+func TestDNSFilter_CheckResponseIP(t *testing.T) {
+	d := NewForTest(nil, nil)
+	defer d.Close()
+
+	d.rpz.zones = []*rpzZone{newTestRPZ(t)}
+
+	testCases := []struct {
+		name       string
+		ip         net.IP
+		wantReason Reason
+		wantRCode  int
+	}{{
+		name:       "nxdomain",
+		ip:         net.IP{192, 0, 2, 4},
+		wantReason: RewrittenRule,
+		wantRCode:  dns.RcodeNameError,
+	}, {
+		name:       "nodata_subnet",
+		ip:         net.IP{192, 0, 2, 10},
+		wantReason: RewrittenRule,
+		wantRCode:  dns.RcodeSuccess,
+	}, {
+		name:       "passthru_longest_prefix",
+		ip:         net.IP{192, 0, 2, 5},
+		wantReason: NotFilteredAllowList,
+	}, {
+		name:       "ipv6",
+		ip:         net.ParseIP("2001:db8::1"),
+		wantReason: RewrittenRule,
+		wantRCode:  dns.RcodeNameError,
+	}, {
+		name:       "not_found",
+		ip:         net.IP{192, 0, 3, 1},
+		wantReason: NotFilteredNotFound,
+	}, {
+		name:       "cname_unsupported",
+		ip:         net.IP{192, 0, 3, 9},
+		wantReason: NotFilteredNotFound,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := d.CheckResponseIP(tc.ip, &setts)
+			assert.Equal(t, tc.wantReason, res.Reason)
+			if tc.wantReason == RewrittenRule && assert.NotNil(t, res.DNSRewriteResult) {
+				assert.Equal(t, tc.wantRCode, res.DNSRewriteResult.RCode)
+			}
+		})
+	}
+}
+
+func TestDNSFilter_loadRPZZones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsfilter")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "rpz.zone")
+	text := "$ORIGIN rpz.example.\n" + testRPZ
+	assert.Nil(t, ioutil.WriteFile(path, []byte(text), 0o644))
+
+	d := NewForTest(&Config{
+		RPZZones: []string{path, filepath.Join(dir, "non-existent.zone")},
+	}, nil)
+	defer d.Close()
+
+	d.loadRPZZones()
+	if assert.Len(t, d.rpz.zones, 1) {
+		assert.Equal(t, path, d.rpz.zones[0].source)
+	}
+
+	// The previously loaded zone is kept if it can't be reloaded.
+	assert.Nil(t, os.Remove(path))
+	d.loadRPZZones()
+	assert.Len(t, d.rpz.zones, 1)
+
+	res, err := d.CheckHost("blocked.example", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.Equal(t, RewrittenRule, res.Reason)
+}
+
+func TestDNSFilter_Close_rpzUpdater(t *testing.T) {
+	d := NewForTest(&Config{
+		RPZZones: []string{"non-existent.zone"},
+	}, nil)
+	d.startRPZUpdater(time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		d.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		// Go on.
+	case <-time.After(5 * time.Second):
+		t.Fatal("the rpz updater isn't stopped")
+	}
+}
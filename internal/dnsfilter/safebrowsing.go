@@ -2,6 +2,7 @@ package dnsfilter
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -93,21 +94,28 @@ func (c *sbCtx) getCached() int {
 	for k, v := range c.hashToHost {
 		key := k[0:2]
 		val := c.cache.Get(key)
-		if val == nil || now >= int64(binary.BigEndian.Uint32(val)) {
+		if val == nil {
+			hashesToRequest[k] = v
+			continue
+		} else if now >= int64(binary.BigEndian.Uint32(val)) {
+			c.counters.expire()
 			hashesToRequest[k] = v
 			continue
 		}
 		if hash32, found := c.findInHash(val); found {
 			log.Debug("%s: found in cache: %s: blocked by %v", c.svc, c.host, hash32)
+			c.counters.hit()
 			return 1
 		}
 	}
 
 	if len(hashesToRequest) == 0 {
 		log.Debug("%s: found in cache: %s: not blocked", c.svc, c.host)
+		c.counters.hit()
 		return -1
 	}
 
+	c.counters.miss()
 	c.hashToHost = hashesToRequest
 	return 0
 }
@@ -117,7 +125,12 @@ type sbCtx struct {
 	svc        string
 	hashToHost map[[32]byte]string
 	cache      cache.Cache
+	counters   *cacheCounters
 	cacheTime  uint
+
+	// db is the local hash-prefix database.  If it's not nil, the upstream
+	// is only used to confirm the hashes of the colliding prefixes.
+	db *hashPrefixDB
 }
 
 func hostnameToHashes(host string) map[[32]byte]string {
@@ -257,8 +270,47 @@ func (c *sbCtx) storeCache(hashes [][]byte) {
 	}
 }
 
-func check(c *sbCtx, r Result, u upstream.Upstream) (Result, error) {
+// exchangeContext sends req to u and returns the response.  If ctx is done
+// before the response is received, it returns the error of ctx without waiting
+// for the exchange to complete.
+func exchangeContext(ctx context.Context, u upstream.Upstream, req *dns.Msg) (resp *dns.Msg, err error) {
+	if ctx.Done() == nil {
+		return u.Exchange(req)
+	}
+
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		r, rerr := u.Exchange(req)
+		ch <- result{resp: r, err: rerr}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-ch:
+		return r.resp, r.err
+	}
+}
+
+func check(ctx context.Context, c *sbCtx, r Result, u upstream.Upstream) (Result, error) {
 	c.hashToHost = hostnameToHashes(c.host)
+	if c.db != nil {
+		matched, unconfirmed := c.db.match(c.hashToHost)
+		if matched {
+			log.Debug("%s: found in local database: %s", c.svc, c.host)
+			return r, nil
+		} else if len(unconfirmed) == 0 {
+			return Result{}, nil
+		}
+
+		c.hashToHost = unconfirmed
+	}
+
 	switch c.getCached() {
 	case -1:
 		return Result{}, nil
@@ -271,7 +323,7 @@ func check(c *sbCtx, r Result, u upstream.Upstream) (Result, error) {
 	log.Tracef("%s: checking %s: %s", c.svc, c.host, question)
 	req := (&dns.Msg{}).SetQuestion(question, dns.TypeTXT)
 
-	resp, err := u.Exchange(req)
+	resp, err := exchangeContext(ctx, u, req)
 	if err != nil {
 		return Result{}, err
 	}
@@ -286,16 +338,18 @@ func check(c *sbCtx, r Result, u upstream.Upstream) (Result, error) {
 	return Result{}, nil
 }
 
-func (d *DNSFilter) checkSafeBrowsing(host string) (Result, error) {
+func (d *DNSFilter) checkSafeBrowsing(ctx context.Context, host string) (Result, error) {
 	if log.GetLevel() >= log.DEBUG {
 		timer := log.StartTimer()
 		defer timer.LogElapsed("SafeBrowsing lookup for %s", host)
 	}
-	ctx := &sbCtx{
+	sctx := &sbCtx{
 		host:      host,
 		svc:       "SafeBrowsing",
 		cache:     gctx.safebrowsingCache,
+		counters:  &gctx.safebrowsingCounters,
 		cacheTime: d.Config.CacheTime,
+		db:        d.safeBrowsingDB,
 	}
 	res := Result{
 		IsFiltered: true,
@@ -304,19 +358,21 @@ func (d *DNSFilter) checkSafeBrowsing(host string) (Result, error) {
 			Text: "adguard-malware-shavar",
 		}},
 	}
-	return check(ctx, res, d.safeBrowsingUpstream)
+	return check(ctx, sctx, res, d.safeBrowsingUpstream)
 }
 
-func (d *DNSFilter) checkParental(host string) (Result, error) {
+func (d *DNSFilter) checkParental(ctx context.Context, host string) (Result, error) {
 	if log.GetLevel() >= log.DEBUG {
 		timer := log.StartTimer()
 		defer timer.LogElapsed("Parental lookup for %s", host)
 	}
-	ctx := &sbCtx{
+	sctx := &sbCtx{
 		host:      host,
 		svc:       "Parental",
 		cache:     gctx.parentalCache,
+		counters:  &gctx.parentalCounters,
 		cacheTime: d.Config.CacheTime,
+		db:        d.parentalDB,
 	}
 	res := Result{
 		IsFiltered: true,
@@ -325,7 +381,7 @@ func (d *DNSFilter) checkParental(host string) (Result, error) {
 			Text: "parental CATEGORY_BLACKLISTED",
 		}},
 	}
-	return check(ctx, res, d.parentalUpstream)
+	return check(ctx, sctx, res, d.parentalUpstream)
 }
 
 func httpError(r *http.Request, w http.ResponseWriter, code int, format string, args ...interface{}) {
@@ -392,4 +448,6 @@ func (d *DNSFilter) registerSecurityHandlers() {
 	d.Config.HTTPRegister("POST", "/control/safesearch/enable", d.handleSafeSearchEnable)
 	d.Config.HTTPRegister("POST", "/control/safesearch/disable", d.handleSafeSearchDisable)
 	d.Config.HTTPRegister("GET", "/control/safesearch/status", d.handleSafeSearchStatus)
+
+	d.Config.HTTPRegister("GET", "/control/lookup_caches/stats", d.handleCachesStats)
 }
@@ -1,10 +1,12 @@
 package dnsfilter
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
 	"github.com/AdguardTeam/golibs/cache"
@@ -129,10 +131,10 @@ func TestSBPC_checkErrorUpstream(t *testing.T) {
 	d.safeBrowsingUpstream = ups
 	d.parentalUpstream = ups
 
-	_, err := d.checkSafeBrowsing("smthng.com")
+	_, err := d.checkSafeBrowsing(context.Background(), "smthng.com")
 	assert.NotNil(t, err)
 
-	_, err = d.checkParental("smthng.com")
+	_, err = d.checkParental(context.Background(), "smthng.com")
 	assert.NotNil(t, err)
 }
 
@@ -188,7 +190,7 @@ func TestSBPC_sbValidResponse(t *testing.T) {
 	ups.requestsCount = 0
 
 	// First - check that the request is not blocked
-	res, err := d.checkSafeBrowsing("example.org")
+	res, err := d.checkSafeBrowsing(context.Background(), "example.org")
 	assert.Nil(t, err)
 	assert.False(t, res.IsFiltered)
 
@@ -200,7 +202,7 @@ func TestSBPC_sbValidResponse(t *testing.T) {
 	assert.Equal(t, 1, ups.requestsCount)
 
 	// Now make the same request to check that the cache was used
-	res, err = d.checkSafeBrowsing("example.org")
+	res, err = d.checkSafeBrowsing(context.Background(), "example.org")
 	assert.Nil(t, err)
 	assert.False(t, res.IsFiltered)
 
@@ -227,7 +229,7 @@ func TestSBPC_pcBlockedResponse(t *testing.T) {
 	ups.requestsCount = 0
 
 	// Make a lookup
-	res, err := d.checkParental("example.com")
+	res, err := d.checkParental(context.Background(), "example.com")
 	assert.Nil(t, err)
 	assert.True(t, res.IsFiltered)
 	assert.Len(t, res.Rules, 1)
@@ -240,7 +242,7 @@ func TestSBPC_pcBlockedResponse(t *testing.T) {
 	assert.Equal(t, 1, ups.requestsCount)
 
 	// Make a second lookup for the same domain
-	res, err = d.checkParental("example.com")
+	res, err = d.checkParental(context.Background(), "example.com")
 	assert.Nil(t, err)
 	assert.True(t, res.IsFiltered)
 	assert.Len(t, res.Rules, 1)
@@ -252,3 +254,60 @@ func TestSBPC_pcBlockedResponse(t *testing.T) {
 	// Check that there were no additional requests
 	assert.Equal(t, 1, ups.requestsCount)
 }
+
+// testBlockingUpstream implements upstream.Upstream interface for replacing
+// real upstream in tests.  Its Exchange blocks until unblock is closed.
+type testBlockingUpstream struct {
+	unblock chan struct{}
+}
+
+// Exchange blocks until u.unblock is closed and returns an empty message.
+func (u *testBlockingUpstream) Exchange(_ *dns.Msg) (*dns.Msg, error) {
+	<-u.unblock
+
+	return &dns.Msg{}, nil
+}
+
+func (u *testBlockingUpstream) Address() string {
+	return ""
+}
+
+func TestDNSFilter_CheckHostContext(t *testing.T) {
+	d := NewForTest(&Config{SafeBrowsingEnabled: true, ParentalEnabled: true}, nil)
+	defer d.Close()
+
+	ups := &testBlockingUpstream{unblock: make(chan struct{})}
+	t.Cleanup(func() { close(ups.unblock) })
+
+	d.safeBrowsingUpstream = ups
+	d.parentalUpstream = ups
+
+	testCases := []struct {
+		name  string
+		setts *RequestFilteringSettings
+	}{{
+		name: "safebrowsing",
+		setts: &RequestFilteringSettings{
+			FilteringEnabled:    true,
+			SafeBrowsingEnabled: true,
+		},
+	}, {
+		name: "parental",
+		setts: &RequestFilteringSettings{
+			FilteringEnabled: true,
+			ParentalEnabled:  true,
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			_, err := d.CheckHostContext(ctx, "blocking.example", dns.TypeA, tc.setts)
+			assert.Equal(t, context.DeadlineExceeded, err)
+			assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+		})
+	}
+}
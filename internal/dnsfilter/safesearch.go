@@ -2,6 +2,7 @@ package dnsfilter
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
@@ -37,15 +38,18 @@ func (d *DNSFilter) setCacheResult(cache cache.Cache, host string, res Result) i
 	return len(val)
 }
 
-func getCachedResult(cache cache.Cache, host string) (Result, bool) {
+func getCachedResult(cache cache.Cache, cnt *cacheCounters, host string) (Result, bool) {
 	data := cache.Get([]byte(host))
 	if data == nil {
+		cnt.miss()
 		return Result{}, false
 	}
 
 	exp := int(binary.BigEndian.Uint32(data[:4]))
 	if exp <= int(time.Now().Unix()) {
 		cache.Del([]byte(host))
+		cnt.expire()
+		cnt.miss()
 		return Result{}, false
 	}
 
@@ -56,63 +60,122 @@ func getCachedResult(cache cache.Cache, host string) (Result, bool) {
 	err := dec.Decode(&r)
 	if err != nil {
 		log.Debug("gob.Decode(): %s", err)
+		cnt.miss()
 		return Result{}, false
 	}
 
+	cnt.hit()
+
 	return r, true
 }
 
+// YouTube Restricted Mode levels.
+const (
+	// YouTubeRestrictOff means that the YouTube hosts aren't rewritten even
+	// if the safe search is enabled.
+	YouTubeRestrictOff = "off"
+
+	// YouTubeRestrictModerate means that the YouTube hosts are rewritten to
+	// youTubeModerateHost.  It's the default.
+	YouTubeRestrictModerate = "moderate"
+
+	// YouTubeRestrictStrict means that the YouTube hosts are rewritten to
+	// youTubeStrictHost.
+	YouTubeRestrictStrict = "strict"
+)
+
+// The hosts enforcing the YouTube Restricted Mode levels.
+const (
+	youTubeModerateHost = "restrictmoderate.youtube.com"
+	youTubeStrictHost   = "restrict.youtube.com"
+)
+
+// ValidateYouTubeRestrictLevel returns an error if level isn't a valid YouTube
+// Restricted Mode level.  An empty level is valid and means
+// YouTubeRestrictModerate.
+func ValidateYouTubeRestrictLevel(level string) (err error) {
+	switch level {
+	case "", YouTubeRestrictOff, YouTubeRestrictModerate, YouTubeRestrictStrict:
+		return nil
+	default:
+		return fmt.Errorf("invalid youtube restrict level %q", level)
+	}
+}
+
 // SafeSearchDomain returns replacement address for search engine
 func (d *DNSFilter) SafeSearchDomain(host string) (string, bool) {
+	if _, ok := youTubeDomains[host]; ok {
+		switch d.YouTubeRestrictLevel {
+		case YouTubeRestrictOff:
+			return "", false
+		case YouTubeRestrictStrict:
+			return youTubeStrictHost, true
+		default:
+			return youTubeModerateHost, true
+		}
+	}
+
 	val, ok := safeSearchDomains[host]
 	return val, ok
 }
 
-func (d *DNSFilter) checkSafeSearch(host string) (Result, error) {
+func (d *DNSFilter) checkSafeSearch(ctx context.Context, host string) (Result, error) {
 	if log.GetLevel() >= log.DEBUG {
 		timer := log.StartTimer()
 		defer timer.LogElapsed("SafeSearch: lookup for %s", host)
 	}
 
+	safeHost, ok := d.SafeSearchDomain(host)
+	if !ok {
+		return Result{}, nil
+	}
+
+	// The target of the YouTube hosts depends on the restriction level, so
+	// it's a part of the cache key.
+	cacheKey := host
+	if _, ok = youTubeDomains[host]; ok {
+		cacheKey = host + "/" + safeHost
+	}
+
 	// Check cache. Return cached result if it was found
-	cachedValue, isFound := getCachedResult(gctx.safeSearchCache, host)
+	cachedValue, isFound := getCachedResult(gctx.safeSearchCache, &gctx.safeSearchCounters, cacheKey)
 	if isFound {
 		// atomic.AddUint64(&gctx.stats.Safesearch.CacheHits, 1)
 		log.Tracef("SafeSearch: found in cache: %s", host)
 		return cachedValue, nil
 	}
 
-	safeHost, ok := d.SafeSearchDomain(host)
-	if !ok {
-		return Result{}, nil
-	}
-
 	res := Result{
 		IsFiltered: true,
 		Reason:     FilteredSafeSearch,
 		Rules:      []*ResultRule{{}},
 	}
 
-	if ip := net.ParseIP(safeHost); ip != nil {
+	ip := d.safeSearchCustomIP(safeHost)
+	if ip == nil {
+		ip = net.ParseIP(safeHost)
+	}
+
+	if ip != nil {
 		res.Rules[0].IP = ip
-		valLen := d.setCacheResult(gctx.safeSearchCache, host, res)
+		valLen := d.setCacheResult(gctx.safeSearchCache, cacheKey, res)
 		log.Debug("SafeSearch: stored in cache: %s (%d bytes)", host, valLen)
 
 		return res, nil
 	}
 
 	// TODO this address should be resolved with upstream that was configured in dnsforward
-	ips, err := net.LookupIP(safeHost)
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, safeHost)
 	if err != nil {
 		log.Tracef("SafeSearchDomain for %s was found but failed to lookup for %s cause %s", host, safeHost, err)
 		return Result{}, err
 	}
 
-	for _, ip := range ips {
-		if ipv4 := ip.To4(); ipv4 != nil {
+	for _, addr := range addrs {
+		if ipv4 := addr.IP.To4(); ipv4 != nil {
 			res.Rules[0].IP = ipv4
 
-			l := d.setCacheResult(gctx.safeSearchCache, host, res)
+			l := d.setCacheResult(gctx.safeSearchCache, cacheKey, res)
 			log.Debug("SafeSearch: stored in cache: %s (%d bytes)", host, l)
 
 			return res, nil
@@ -145,6 +208,31 @@ func (d *DNSFilter) handleSafeSearchStatus(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// safeSearchEngines maps the safe search hosts and addresses from
+// safeSearchDomains to the names of the search engines used as the keys of
+// Config.SafeSearchCustomIPs.
+var safeSearchEngines = map[string]string{
+	"213.180.193.56":             "yandex",
+	"strict.bing.com":            "bing",
+	"safe.duckduckgo.com":        "duckduckgo",
+	"forcesafesearch.google.com": "google",
+	youTubeModerateHost:          "youtube",
+	youTubeStrictHost:            "youtube",
+	"safesearch.pixabay.com":     "pixabay",
+}
+
+// safeSearchCustomIP returns the custom address configured for the search
+// engine with the safe search host or address safeHost.  It returns nil if
+// there is none.
+func (d *DNSFilter) safeSearchCustomIP(safeHost string) (ip net.IP) {
+	engine, ok := safeSearchEngines[safeHost]
+	if !ok {
+		return nil
+	}
+
+	return d.SafeSearchCustomIPs[engine]
+}
+
 var safeSearchDomains = map[string]string{
 	"yandex.com":     "213.180.193.56",
 	"yandex.ru":      "213.180.193.56",
@@ -157,6 +245,7 @@ var safeSearchDomains = map[string]string{
 	"www.yandex.by":  "213.180.193.56",
 	"www.yandex.kz":  "213.180.193.56",
 
+	"bing.com":     "strict.bing.com",
 	"www.bing.com": "strict.bing.com",
 
 	"duckduckgo.com":       "safe.duckduckgo.com",
@@ -353,11 +442,16 @@ var safeSearchDomains = map[string]string{
 	"www.google.ws":     "forcesafesearch.google.com",
 	"www.google.rs":     "forcesafesearch.google.com",
 
-	"www.youtube.com":          "restrictmoderate.youtube.com",
-	"m.youtube.com":            "restrictmoderate.youtube.com",
-	"youtubei.googleapis.com":  "restrictmoderate.youtube.com",
-	"youtube.googleapis.com":   "restrictmoderate.youtube.com",
-	"www.youtube-nocookie.com": "restrictmoderate.youtube.com",
-
 	"pixabay.com": "safesearch.pixabay.com",
 }
+
+// youTubeDomains are the YouTube hosts rewritten depending on
+// Config.YouTubeRestrictLevel.
+var youTubeDomains = map[string]struct{}{
+	"youtube.com":              {},
+	"www.youtube.com":          {},
+	"m.youtube.com":            {},
+	"youtubei.googleapis.com":  {},
+	"youtube.googleapis.com":   {},
+	"www.youtube-nocookie.com": {},
+}
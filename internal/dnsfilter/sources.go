@@ -0,0 +1,88 @@
+package dnsfilter
+
+import (
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/AdguardTeam/urlfilter/filterlist"
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/miekg/dns"
+)
+
+// MatchAllRules returns all rules from the blocklists, the monitor-only
+// blocklists, and the allowlists which match host.  Unlike the filtering
+// itself, it doesn't stop at the first matching rule, so it's useful to find
+// all lists which block host.  The rules with client-specific modifiers are
+// matched as for a query without any client information.
+func (d *DNSFilter) MatchAllRules(host string) (matched []*ResultRule) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	req := rules.NewRequestForHostname(host)
+	req.DNSType = dns.TypeA
+
+	d.engineLock.RLock()
+	defer d.engineLock.RUnlock()
+
+	return d.matchAllStorages(host, req)
+}
+
+// matchAllStorages returns all rules from the blocklists, the monitor-only
+// blocklists, and the allowlists which match host.  req must be the request for
+// host.  It scans the whole rule storages, so it's only used by MatchAllRules
+// and, if RequestFilteringSettings.AllMatches is set, by the filtering.
+//
+// d.engineLock is expected to be locked.
+func (d *DNSFilter) matchAllStorages(host string, req *rules.Request) (matched []*ResultRule) {
+	storages := append(d.blockStorages(), d.rulesStorageMonitor, d.rulesStorageAllow)
+	for _, s := range storages {
+		if s != nil {
+			matched = append(matched, matchStorage(s, host, req)...)
+		}
+	}
+	setRulesListNames(matched, d.filterNames)
+
+	return matched
+}
+
+// newRulesRequest returns the request to match the single rules against, which
+// is the same as ureq.
+func newRulesRequest(ureq urlfilter.DNSRequest) (req *rules.Request) {
+	req = rules.NewRequestForHostname(ureq.Hostname)
+	req.SortedClientTags = ureq.SortedClientTags
+	req.ClientIP = ureq.ClientIP
+	req.ClientName = ureq.ClientName
+	req.DNSType = ureq.DNSType
+
+	return req
+}
+
+// matchStorage returns all rules from s which match host.  req must be the
+// request for host.  The IP addresses of the matched hosts rules are set as
+// well.
+func matchStorage(s *filterlist.RuleStorage, host string, req *rules.Request) (matched []*ResultRule) {
+	sc := s.NewRuleStorageScanner()
+	for sc.Scan() {
+		r, _ := sc.Rule()
+
+		var ok bool
+		var ip net.IP
+		switch r := r.(type) {
+		case *rules.NetworkRule:
+			ok = r.Match(req)
+		case *rules.HostRule:
+			ok = r.Match(host)
+			ip = r.IP
+		}
+
+		if ok {
+			matched = append(matched, &ResultRule{
+				FilterListID: int64(r.GetFilterListID()),
+				Text:         r.Text(),
+				IP:           ip,
+			})
+		}
+	}
+
+	return matched
+}
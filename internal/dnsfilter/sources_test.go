@@ -0,0 +1,36 @@
+package dnsfilter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSFilter_MatchAllRules(t *testing.T) {
+	d := NewForTest(nil, []Filter{{
+		ID:   1,
+		Data: []byte("||example.org^\n||other.example^\n"),
+	}, {
+		ID:   2,
+		Data: []byte("0.0.0.0 www.example.org\n||example.net^\n"),
+	}, {
+		ID:   3,
+		Data: []byte("||example.org^$important\n"),
+	}})
+	t.Cleanup(d.Close)
+
+	assert.Equal(t, []*ResultRule{{
+		FilterListID: 1,
+		Text:         "||example.org^",
+	}, {
+		FilterListID: 2,
+		Text:         "0.0.0.0 www.example.org",
+		IP:           net.IP{0, 0, 0, 0},
+	}, {
+		FilterListID: 3,
+		Text:         "||example.org^$important",
+	}}, d.MatchAllRules("www.example.org."))
+
+	assert.Empty(t, d.MatchAllRules("example.com"))
+}
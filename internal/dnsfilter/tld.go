@@ -0,0 +1,59 @@
+package dnsfilter
+
+import (
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/publicsuffix"
+)
+
+// prepareAllowedTLDs normalizes d.AllowedTLDs and builds the set used by
+// checkTLD.
+func (d *DNSFilter) prepareAllowedTLDs() {
+	d.allowedTLDs = nil
+	if len(d.AllowedTLDs) == 0 {
+		return
+	}
+
+	d.allowedTLDs = make(map[string]struct{}, len(d.AllowedTLDs))
+	for _, tld := range d.AllowedTLDs {
+		tld = strings.ToLower(strings.Trim(tld, "."))
+		if tld == "" {
+			log.Debug("dnsfilter: skipping empty allowed tld")
+
+			continue
+		}
+
+		d.allowedTLDs[tld] = struct{}{}
+	}
+}
+
+// checkTLD returns a result with the FilteredTLD reason if the allowed TLDs
+// are configured and host doesn't belong to any of them.  The TLD of host is
+// its public suffix, so that both "co.uk" and "uk" could be allowed.  For
+// suffixes absent from the public suffix list the last label is used.
+func (d *DNSFilter) checkTLD(host string) (res Result) {
+	if d.allowedTLDs == nil {
+		return Result{}
+	}
+
+	host = strings.TrimSuffix(host, ".")
+	suffix, _ := publicsuffix.PublicSuffix(host)
+	for {
+		if _, ok := d.allowedTLDs[suffix]; ok {
+			return Result{}
+		}
+
+		i := strings.IndexByte(suffix, '.')
+		if i < 0 {
+			break
+		}
+
+		suffix = suffix[i+1:]
+	}
+
+	return Result{
+		IsFiltered: true,
+		Reason:     FilteredTLD,
+	}
+}
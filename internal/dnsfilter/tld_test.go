@@ -0,0 +1,70 @@
+package dnsfilter
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowedTLDs(t *testing.T) {
+	filters := []Filter{{
+		ID: 0, Data: []byte("@@||allowed.xyz^\n"),
+	}}
+	d := NewForTest(&Config{
+		AllowedTLDs: []string{"com", ".org", "LAN", "co.uk"},
+	}, filters)
+	defer d.Close()
+
+	testCases := []struct {
+		name   string
+		host   string
+		reason Reason
+	}{{
+		name:   "com",
+		host:   "example.com",
+		reason: NotFilteredNotFound,
+	}, {
+		name:   "org_dot",
+		host:   "example.org",
+		reason: NotFilteredNotFound,
+	}, {
+		name:   "not_in_psl",
+		host:   "printer.lan",
+		reason: NotFilteredNotFound,
+	}, {
+		name:   "multi_label",
+		host:   "example.co.uk",
+		reason: NotFilteredNotFound,
+	}, {
+		name:   "other_uk",
+		host:   "example.org.uk",
+		reason: FilteredTLD,
+	}, {
+		name:   "xyz",
+		host:   "example.xyz",
+		reason: FilteredTLD,
+	}, {
+		name:   "allowlist",
+		host:   "allowed.xyz",
+		reason: NotFilteredAllowList,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.CheckHost(tc.host, dns.TypeA, &setts)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.reason, res.Reason)
+			assert.Equal(t, tc.reason == FilteredTLD, res.IsFiltered)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		dd := NewForTest(&Config{}, nil)
+		defer dd.Close()
+
+		res, err := dd.CheckHost("example.xyz", dns.TypeA, &setts)
+		assert.Nil(t, err)
+		assert.False(t, res.IsFiltered)
+	})
+}
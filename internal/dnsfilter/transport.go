@@ -0,0 +1,57 @@
+package dnsfilter
+
+import "sort"
+
+// transportTagPrefix is the prefix of the client tags which are added to the
+// request depending on its transport.  Rules like
+//
+//	||ads.example^$ctag=transport_udp
+//
+// only block the requests sent over that transport.
+const transportTagPrefix = "transport_"
+
+// interfaceTagPrefix is the prefix of the client tags which are added to the
+// request depending on the network interface on which it has been received.
+// Rules like
+//
+//	||ads.example^$ctag=iface_tun0
+//
+// only block the requests received on that interface.
+const interfaceTagPrefix = "iface_"
+
+// Transports of the requests.
+const (
+	TransportUDP      = "udp"
+	TransportTCP      = "tcp"
+	TransportDoT      = "dot"
+	TransportDoH      = "doh"
+	TransportDoQ      = "doq"
+	TransportDNSCrypt = "dnscrypt"
+)
+
+// requestClientTags returns the sorted client tags of the request including
+// the tags of its transport, inbound interface, and class, if any.
+func requestClientTags(setts *RequestFilteringSettings) (tags []string) {
+	ctag := classTag(setts.QClass)
+	if setts.Transport == "" && setts.Interface == "" && ctag == "" {
+		return setts.ClientTags
+	}
+
+	tags = make([]string, 0, len(setts.ClientTags)+3)
+	tags = append(tags, setts.ClientTags...)
+	if setts.Transport != "" {
+		tags = append(tags, transportTagPrefix+setts.Transport)
+	}
+
+	if setts.Interface != "" {
+		tags = append(tags, interfaceTagPrefix+setts.Interface)
+	}
+
+	if ctag != "" {
+		tags = append(tags, ctag)
+	}
+
+	sort.Strings(tags)
+
+	return tags
+}
@@ -0,0 +1,127 @@
+package dnsfilter
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransportRules(t *testing.T) {
+	const text = "||udp.example^$ctag=transport_udp\n" +
+		"||plain.example^$ctag=transport_udp|transport_tcp\n" +
+		"||child.example^$ctag=user_child|transport_doh\n"
+	d := NewForTest(nil, []Filter{{
+		ID: 0, Data: []byte(text),
+	}})
+	defer d.Close()
+
+	testCases := []struct {
+		name      string
+		host      string
+		transport string
+		tags      []string
+		want      bool
+	}{{
+		name:      "udp",
+		host:      "udp.example",
+		transport: TransportUDP,
+		want:      true,
+	}, {
+		name:      "doh",
+		host:      "udp.example",
+		transport: TransportDoH,
+		want:      false,
+	}, {
+		name:      "unknown",
+		host:      "udp.example",
+		transport: "",
+		want:      false,
+	}, {
+		name:      "plain_tcp",
+		host:      "plain.example",
+		transport: TransportTCP,
+		want:      true,
+	}, {
+		name:      "plain_dot",
+		host:      "plain.example",
+		transport: TransportDoT,
+		want:      false,
+	}, {
+		name:      "client_tag",
+		host:      "child.example",
+		transport: TransportUDP,
+		tags:      []string{"user_child"},
+		want:      true,
+	}, {
+		name:      "transport_tag",
+		host:      "child.example",
+		transport: TransportDoH,
+		tags:      []string{"user_admin"},
+		want:      true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := setts
+			s.ClientTags = tc.tags
+			s.Transport = tc.transport
+
+			res, err := d.CheckHost(tc.host, dns.TypeA, &s)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, res.IsFiltered)
+		})
+	}
+}
+
+func TestInterfaceRules(t *testing.T) {
+	const text = "||vpn.example^$ctag=iface_tun0\n" +
+		"||lan.example^$ctag=iface_eth0\n"
+	d := NewForTest(nil, []Filter{{
+		ID: 0, Data: []byte(text),
+	}})
+	defer d.Close()
+
+	testCases := []struct {
+		name  string
+		host  string
+		iface string
+		want  bool
+	}{{
+		name:  "vpn",
+		host:  "vpn.example",
+		iface: "tun0",
+		want:  true,
+	}, {
+		name:  "vpn_lan",
+		host:  "vpn.example",
+		iface: "eth0",
+		want:  false,
+	}, {
+		name:  "vpn_unknown",
+		host:  "vpn.example",
+		iface: "",
+		want:  false,
+	}, {
+		name:  "lan",
+		host:  "lan.example",
+		iface: "eth0",
+		want:  true,
+	}, {
+		name:  "lan_vpn",
+		host:  "lan.example",
+		iface: "tun0",
+		want:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := setts
+			s.Interface = tc.iface
+
+			res, err := d.CheckHost(tc.host, dns.TypeA, &s)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, res.IsFiltered)
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSFilter_UpdateFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsfilter")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	newFilter := func(id int64, text string) (f Filter) {
+		f = Filter{
+			ID:       id,
+			FilePath: filepath.Join(dir, fmt.Sprintf("%d.txt", id)),
+		}
+		assert.Nil(t, ioutil.WriteFile(f.FilePath, []byte(text), 0o644))
+
+		return f
+	}
+
+	blockFilters := []Filter{
+		newFilter(1, "||one.example^\n"),
+		newFilter(2, "||two.example^\n"),
+	}
+	allowFilters := []Filter{
+		newFilter(3, "||allowed.two.example^\n"),
+	}
+
+	d := NewForTest(nil, nil)
+	defer d.Close()
+	assert.Nil(t, d.SetFilters(blockFilters, allowFilters, false))
+
+	check := func(t *testing.T, want map[string]bool) {
+		t.Helper()
+
+		for host, filtered := range want {
+			res, cerr := d.CheckHost(host, dns.TypeA, &setts)
+			assert.Nil(t, cerr)
+			assert.Equal(t, filtered, res.IsFiltered, host)
+		}
+	}
+
+	check(t, map[string]bool{
+		"one.example":         true,
+		"two.example":         true,
+		"allowed.two.example": false,
+	})
+
+	t.Run("block", func(t *testing.T) {
+		blockStorage, allowStorage := d.rulesStorage, d.rulesStorageAllow
+
+		// The lists have the same priority, so a change in the list 1
+		// rebuilds the common engine for all blocklists, reloading the
+		// list 2 too, although it isn't in changed.
+		newFilter(1, "||uno.example^\n")
+		newFilter(2, "||dos.example^\n")
+		assert.Nil(t, d.UpdateFilters(blockFilters, allowFilters, []int64{1}, false))
+
+		assert.NotSame(t, blockStorage, d.rulesStorage)
+		assert.Same(t, allowStorage, d.rulesStorageAllow)
+		check(t, map[string]bool{
+			"one.example":         false,
+			"uno.example":         true,
+			"two.example":         false,
+			"dos.example":         true,
+			"allowed.two.example": false,
+		})
+	})
+
+	t.Run("allow", func(t *testing.T) {
+		blockStorage, allowStorage := d.rulesStorage, d.rulesStorageAllow
+
+		newFilter(3, "||allowed.uno.example^\n")
+		assert.Nil(t, d.UpdateFilters(blockFilters, allowFilters, []int64{3}, false))
+
+		assert.Same(t, blockStorage, d.rulesStorage)
+		assert.NotSame(t, allowStorage, d.rulesStorageAllow)
+		check(t, map[string]bool{
+			"uno.example":         true,
+			"allowed.uno.example": false,
+			"dos.example":         true,
+			"allowed.two.example": false,
+		})
+	})
+
+	t.Run("unchanged", func(t *testing.T) {
+		blockStorage, allowStorage := d.rulesStorage, d.rulesStorageAllow
+
+		assert.Nil(t, d.UpdateFilters(blockFilters, allowFilters, []int64{}, false))
+
+		assert.Same(t, blockStorage, d.rulesStorage)
+		assert.Same(t, allowStorage, d.rulesStorageAllow)
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		blockStorage, allowStorage := d.rulesStorage, d.rulesStorageAllow
+
+		assert.Nil(t, d.UpdateFilters(blockFilters[1:], allowFilters, []int64{}, false))
+
+		assert.NotSame(t, blockStorage, d.rulesStorage)
+		assert.Same(t, allowStorage, d.rulesStorageAllow)
+		check(t, map[string]bool{
+			"uno.example": false,
+			"dos.example": true,
+		})
+	})
+}
+
+func TestDNSFilter_UpdateFilters_priority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsfilter")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	newFilter := func(id int64, prio int, text string) (f Filter) {
+		f = Filter{
+			ID:       id,
+			FilePath: filepath.Join(dir, fmt.Sprintf("%d.txt", id)),
+			Priority: prio,
+		}
+		assert.Nil(t, ioutil.WriteFile(f.FilePath, []byte(text), 0o644))
+
+		return f
+	}
+
+	blockFilters := []Filter{
+		newFilter(1, 0, "||one.example^\n"),
+		newFilter(2, 10, "||two.example^\n"),
+	}
+
+	d := NewForTest(nil, nil)
+	defer d.Close()
+	assert.Nil(t, d.SetFilters(blockFilters, nil, false))
+	if !assert.Len(t, d.priorityEngines, 2) {
+		return
+	}
+
+	// The engines are sorted by descending priority.
+	high, low := d.priorityEngines[0], d.priorityEngines[1]
+
+	// Change both files, but only report the list 1 as changed, so that
+	// the list 2 would only be reloaded with its engine.
+	newFilter(1, 0, "||uno.example^\n")
+	newFilter(2, 10, "||dos.example^\n")
+	assert.Nil(t, d.UpdateFilters(blockFilters, nil, []int64{1}, false))
+
+	if assert.Len(t, d.priorityEngines, 2) {
+		assert.Same(t, high.rulesStorage, d.priorityEngines[0].rulesStorage)
+		assert.NotSame(t, low.rulesStorage, d.priorityEngines[1].rulesStorage)
+	}
+
+	for host, filtered := range map[string]bool{
+		"one.example": false,
+		"uno.example": true,
+		"two.example": true,
+		"dos.example": false,
+	} {
+		res, cerr := d.CheckHost(host, dns.TypeA, &setts)
+		assert.Nil(t, cerr)
+		assert.Equal(t, filtered, res.IsFiltered, host)
+	}
+
+	// Changing the priority of a list moves it to another group and
+	// recreates the engines of both groups.
+	blockFilters[1].Priority = 5
+	high, low = d.priorityEngines[0], d.priorityEngines[1]
+	assert.Nil(t, d.UpdateFilters(blockFilters, nil, []int64{}, false))
+	if assert.Len(t, d.priorityEngines, 2) {
+		assert.Equal(t, 5, d.priorityEngines[0].priority)
+		assert.NotSame(t, high.rulesStorage, d.priorityEngines[0].rulesStorage)
+		assert.Same(t, low.rulesStorage, d.priorityEngines[1].rulesStorage)
+	}
+}
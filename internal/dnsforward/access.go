@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"regexp"
 	"strings"
 	"sync"
 
@@ -16,26 +17,43 @@ import (
 type accessCtx struct {
 	lock sync.Mutex
 
-	allowedClients    map[string]bool // IP addresses of whitelist clients
-	disallowedClients map[string]bool // IP addresses of clients that should be blocked
+	allowedClients    map[string]bool // IP addresses and ClientIDs of whitelist clients
+	disallowedClients map[string]bool // IP addresses and ClientIDs of clients that should be blocked
 
 	allowedClientsIPNet    []net.IPNet // CIDRs of whitelist clients
 	disallowedClientsIPNet []net.IPNet // CIDRs of clients that should be blocked
 
+	allowedClientIDRules    []clientIDRule // ClientID patterns of whitelist clients
+	disallowedClientIDRules []clientIDRule // ClientID patterns of clients that should be blocked
+
+	allowedHostRules    []clientIDRule // hostname patterns of whitelist clients
+	disallowedHostRules []clientIDRule // hostname patterns of clients that should be blocked
+
+	withClientIDs bool // true if the lists above contain any ClientIDs
+
 	blockedHostsEngine *urlfilter.DNSEngine // finds hosts that should be blocked
 }
 
 func (a *accessCtx) Init(allowedClients, disallowedClients, blockedHosts []string) error {
-	err := processIPCIDRArray(&a.allowedClients, &a.allowedClientsIPNet, allowedClients)
+	err := processIPCIDRArray(&a.allowedClients, &a.allowedClientsIPNet, &a.allowedClientIDRules, &a.allowedHostRules, allowedClients)
 	if err != nil {
 		return err
 	}
 
-	err = processIPCIDRArray(&a.disallowedClients, &a.disallowedClientsIPNet, disallowedClients)
+	err = processIPCIDRArray(&a.disallowedClients, &a.disallowedClientsIPNet, &a.disallowedClientIDRules, &a.disallowedHostRules, disallowedClients)
 	if err != nil {
 		return err
 	}
 
+	a.withClientIDs = len(a.allowedClientIDRules) != 0 || len(a.disallowedClientIDRules) != 0
+	for _, list := range [][]string{allowedClients, disallowedClients} {
+		for _, s := range list {
+			if net.ParseIP(s) == nil && !strings.Contains(s, "/") && !strings.HasPrefix(s, hostRulePrefix) {
+				a.withClientIDs = true
+			}
+		}
+	}
+
 	buf := strings.Builder{}
 	for _, s := range blockedHosts {
 		buf.WriteString(s)
@@ -58,11 +76,152 @@ func (a *accessCtx) Init(allowedClients, disallowedClients, blockedHosts []strin
 	return nil
 }
 
-// Split array of IP or CIDR into 2 containers for fast search
-func processIPCIDRArray(dst *map[string]bool, dstIPNet *[]net.IPNet, src []string) error {
+// hostRulePrefix is the prefix of the access list entries which match the
+// hostnames of the clients instead of their ClientIDs, for example
+// "host:*.lan" or "host:/^tv-[0-9]+$/".
+const hostRulePrefix = "host:"
+
+// clientIDRule is a compiled ClientID or hostname pattern from an access list.
+type clientIDRule struct {
+	// text is the pattern as written in the list.
+	text string
+	// re matches the ClientIDs.
+	re *regexp.Regexp
+}
+
+// isSlashRegexp returns true if s is a regular expression enclosed in slashes.
+func isSlashRegexp(s string) (ok bool) {
+	return len(s) > 2 && s[0] == '/' && s[len(s)-1] == '/'
+}
+
+// globRegexp returns the regular expression matching the strings which match
+// the glob pattern s, where "*" matches any number of characters and "?"
+// matches a single one.
+func globRegexp(s string) (re *regexp.Regexp) {
+	b := &strings.Builder{}
+	b.WriteByte('^')
+	for _, c := range s {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteByte('.')
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteByte('$')
+
+	return regexp.MustCompile(b.String())
+}
+
+// newClientIDRule compiles s into a ClientID rule.  s is either a glob pattern,
+// where "*" matches any number of characters and "?" matches a single one, or a
+// regular expression enclosed in slashes, for example "/^office-[0-9]+$/".  ok
+// is false if s is a plain ClientID without any wildcards.
+func newClientIDRule(s string) (r clientIDRule, ok bool, err error) {
+	if isSlashRegexp(s) {
+		var re *regexp.Regexp
+		re, err = regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return r, false, fmt.Errorf("bad client id regexp %q: %w", s, err)
+		}
+
+		return clientIDRule{text: s, re: re}, true, nil
+	}
+
+	// Check the characters of the glob as if the wildcards were valid
+	// ClientID characters.
+	err = ValidateClientID(strings.NewReplacer("*", "a", "?", "a").Replace(s))
+	if err != nil {
+		return r, false, err
+	}
+
+	if !strings.ContainsAny(s, "*?") {
+		return r, false, nil
+	}
+
+	return clientIDRule{text: s, re: globRegexp(s)}, true, nil
+}
+
+// newHostRule compiles s, which starts with hostRulePrefix, into a hostname
+// rule.  The rest of s is either a glob pattern or a regular expression
+// enclosed in slashes, like in newClientIDRule.  The rules match the lowercased
+// hostnames.
+func newHostRule(s string) (r clientIDRule, err error) {
+	pat := s[len(hostRulePrefix):]
+	if isSlashRegexp(pat) {
+		var re *regexp.Regexp
+		re, err = regexp.Compile(pat[1 : len(pat)-1])
+		if err != nil {
+			return r, fmt.Errorf("bad hostname regexp %q: %w", s, err)
+		}
+
+		return clientIDRule{text: s, re: re}, nil
+	}
+
+	if pat == "" {
+		return r, fmt.Errorf("empty hostname pattern %q", s)
+	}
+
+	for _, c := range pat {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.ContainsRune("-_.*?", c)) {
+			return r, fmt.Errorf("bad hostname pattern %q: bad char %q", s, c)
+		}
+	}
+
+	return clientIDRule{text: s, re: globRegexp(strings.ToLower(pat))}, nil
+}
+
+// matchClientIDRules returns the text of the first rule from rules matching
+// clientID.  ok is false if there is no such rule.
+func matchClientIDRules(rules []clientIDRule, clientID string) (text string, ok bool) {
+	for _, r := range rules {
+		if r.re.MatchString(clientID) {
+			return r.text, true
+		}
+	}
+
+	return "", false
+}
+
+// matchHostRules returns the text of the first rule from rules matching any of
+// hosts.  ok is false if there is no such rule.
+func matchHostRules(rules []clientIDRule, hosts []string) (text string, ok bool) {
+	for _, h := range hosts {
+		text, ok = matchClientIDRules(rules, strings.ToLower(h))
+		if ok {
+			return text, true
+		}
+	}
+
+	return "", false
+}
+
+// Split array of IP, CIDR, ClientID, ClientID pattern, or hostname pattern into
+// 4 containers for fast search
+func processIPCIDRArray(
+	dst *map[string]bool,
+	dstIPNet *[]net.IPNet,
+	dstRules *[]clientIDRule,
+	dstHostRules *[]clientIDRule,
+	src []string,
+) error {
 	*dst = make(map[string]bool)
 
 	for _, s := range src {
+		if strings.HasPrefix(s, hostRulePrefix) {
+			r, err := newHostRule(s)
+			if err != nil {
+				return err
+			}
+
+			*dstHostRules = append(*dstHostRules, r)
+
+			continue
+		}
+
 		ip := net.ParseIP(s)
 		if ip != nil {
 			(*dst)[s] = true
@@ -70,10 +229,23 @@ func processIPCIDRArray(dst *map[string]bool, dstIPNet *[]net.IPNet, src []strin
 		}
 
 		_, ipnet, err := net.ParseCIDR(s)
+		if err == nil {
+			*dstIPNet = append(*dstIPNet, *ipnet)
+			continue
+		}
+
+		r, ok, err := newClientIDRule(s)
 		if err != nil {
-			return err
+			return fmt.Errorf("%q is not an ip, cidr, or client id: %w", s, err)
+		}
+
+		if ok {
+			*dstRules = append(*dstRules, r)
+		} else {
+			// ClientIDs can't contain dots or colons, so they never
+			// collide with IP addresses.
+			(*dst)[s] = true
 		}
-		*dstIPNet = append(*dstIPNet, *ipnet)
 	}
 
 	return nil
@@ -84,12 +256,38 @@ func processIPCIDRArray(dst *map[string]bool, dstIPNet *[]net.IPNet, src []strin
 // If it returns TRUE and an empty string, it means that the "allowedClients" is not empty,
 // but the ip does not belong to it.
 func (a *accessCtx) IsBlockedIP(ip net.IP) (bool, string) {
+	return a.IsBlockedClient(ip, "", nil)
+}
+
+// hasHostRules returns true if any of the client lists contain hostname
+// patterns, so the hostnames of the client are required to check the access.
+func (a *accessCtx) hasHostRules() (ok bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return len(a.allowedHostRules) != 0 || len(a.disallowedHostRules) != 0
+}
+
+// hasClientIDs returns true if any of the client lists contain ClientIDs or
+// ClientID patterns, so the ClientID is required to check the access.
+func (a *accessCtx) hasClientIDs() (ok bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.withClientIDs
+}
+
+// IsBlockedClient is like IsBlockedIP, but it also checks the client's
+// ClientID, if any, against the ClientIDs and ClientID patterns of the lists,
+// and the client's hostnames, if any, against the hostname patterns.
+func (a *accessCtx) IsBlockedClient(ip net.IP, clientID string, hosts []string) (bool, string) {
 	ipStr := ip.String()
 
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
-	if len(a.allowedClients) != 0 || len(a.allowedClientsIPNet) != 0 {
+	if len(a.allowedClients) != 0 || len(a.allowedClientsIPNet) != 0 ||
+		len(a.allowedClientIDRules) != 0 || len(a.allowedHostRules) != 0 {
 		_, ok := a.allowedClients[ipStr]
 		if ok {
 			return false, ""
@@ -103,6 +301,20 @@ func (a *accessCtx) IsBlockedIP(ip net.IP) (bool, string) {
 			}
 		}
 
+		if clientID != "" {
+			if a.allowedClients[clientID] {
+				return false, ""
+			}
+
+			if _, ok = matchClientIDRules(a.allowedClientIDRules, clientID); ok {
+				return false, ""
+			}
+		}
+
+		if _, ok = matchHostRules(a.allowedHostRules, hosts); ok {
+			return false, ""
+		}
+
 		return true, ""
 	}
 
@@ -119,6 +331,20 @@ func (a *accessCtx) IsBlockedIP(ip net.IP) (bool, string) {
 		}
 	}
 
+	if clientID != "" {
+		if a.disallowedClients[clientID] {
+			return true, clientID
+		}
+
+		if text, matched := matchClientIDRules(a.disallowedClientIDRules, clientID); matched {
+			return true, text
+		}
+	}
+
+	if text, matched := matchHostRules(a.disallowedHostRules, hosts); matched {
+		return true, text
+	}
+
 	return false, ""
 }
 
@@ -154,19 +380,11 @@ func (s *Server) handleAccessList(w http.ResponseWriter, r *http.Request) {
 }
 
 func checkIPCIDRArray(src []string) error {
-	for _, s := range src {
-		ip := net.ParseIP(s)
-		if ip != nil {
-			continue
-		}
-
-		_, _, err := net.ParseCIDR(s)
-		if err != nil {
-			return err
-		}
-	}
+	var ips map[string]bool
+	var ipnets []net.IPNet
+	var rules, hostRules []clientIDRule
 
-	return nil
+	return processIPCIDRArray(&ips, &ipnets, &rules, &hostRules, src)
 }
 
 func (s *Server) handleAccessSet(w http.ResponseWriter, r *http.Request) {
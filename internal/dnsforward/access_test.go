@@ -73,3 +73,116 @@ func TestIsBlockedIPBlockedDomain(t *testing.T) {
 	assert.True(t, a.IsBlockedDomain("host3.com"))
 	assert.True(t, a.IsBlockedDomain("asdf.host3.com"))
 }
+
+func TestIsBlockedClientID(t *testing.T) {
+	t.Run("allowed", func(t *testing.T) {
+		a := &accessCtx{}
+		assert.Nil(t, a.Init([]string{"1.1.1.1", "office-*", "home", "/^lab-[0-9]+$/"}, nil, nil))
+		assert.True(t, a.hasClientIDs())
+
+		ip := net.IPv4(1, 1, 1, 2)
+		testCases := []struct {
+			clientID   string
+			disallowed bool
+		}{
+			{clientID: "office-1", disallowed: false},
+			{clientID: "office-", disallowed: false},
+			{clientID: "home", disallowed: false},
+			{clientID: "lab-42", disallowed: false},
+			{clientID: "lab-x", disallowed: true},
+			{clientID: "my-office-1", disallowed: true},
+			{clientID: "", disallowed: true},
+		}
+
+		for _, tc := range testCases {
+			disallowed, disallowedRule := a.IsBlockedClient(ip, tc.clientID, nil)
+			assert.Equal(t, tc.disallowed, disallowed, tc.clientID)
+			assert.Empty(t, disallowedRule)
+		}
+	})
+
+	t.Run("disallowed", func(t *testing.T) {
+		a := &accessCtx{}
+		assert.Nil(t, a.Init(nil, []string{"guest-??", "kid"}, nil))
+
+		ip := net.IPv4(1, 1, 1, 1)
+		disallowed, disallowedRule := a.IsBlockedClient(ip, "guest-01", nil)
+		assert.True(t, disallowed)
+		assert.Equal(t, "guest-??", disallowedRule)
+
+		disallowed, disallowedRule = a.IsBlockedClient(ip, "kid", nil)
+		assert.True(t, disallowed)
+		assert.Equal(t, "kid", disallowedRule)
+
+		disallowed, disallowedRule = a.IsBlockedClient(ip, "guest-1", nil)
+		assert.False(t, disallowed)
+		assert.Empty(t, disallowedRule)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		a := &accessCtx{}
+		assert.NotNil(t, a.Init([]string{"Office_*"}, nil, nil))
+		assert.NotNil(t, a.Init([]string{"/lab-[/"}, nil, nil))
+		assert.NotNil(t, checkIPCIDRArray([]string{"1.2.3.4/99"}))
+	})
+
+	t.Run("ip_only", func(t *testing.T) {
+		a := &accessCtx{}
+		assert.Nil(t, a.Init([]string{"1.1.1.1", "2.2.0.0/16"}, nil, nil))
+		assert.False(t, a.hasClientIDs())
+	})
+}
+
+func TestIsBlockedClientHost(t *testing.T) {
+	ip := net.IPv4(1, 1, 1, 1)
+
+	t.Run("allowed", func(t *testing.T) {
+		a := &accessCtx{}
+		assert.Nil(t, a.Init([]string{"host:*.lan", "host:/^tv-[0-9]+$/"}, nil, nil))
+		assert.True(t, a.hasHostRules())
+		assert.False(t, a.hasClientIDs())
+
+		testCases := []struct {
+			name       string
+			hosts      []string
+			disallowed bool
+		}{
+			{name: "glob", hosts: []string{"Laptop.LAN"}, disallowed: false},
+			{name: "regexp", hosts: []string{"tv-1"}, disallowed: false},
+			{name: "second", hosts: []string{"client1", "tv-2"}, disallowed: false},
+			{name: "no_match", hosts: []string{"laptop.home"}, disallowed: true},
+			{name: "none", hosts: nil, disallowed: true},
+		}
+
+		for _, tc := range testCases {
+			disallowed, disallowedRule := a.IsBlockedClient(ip, "", tc.hosts)
+			assert.Equal(t, tc.disallowed, disallowed, tc.name)
+			assert.Empty(t, disallowedRule, tc.name)
+		}
+	})
+
+	t.Run("disallowed", func(t *testing.T) {
+		a := &accessCtx{}
+		assert.Nil(t, a.Init(nil, []string{"host:guest-??"}, nil))
+
+		disallowed, disallowedRule := a.IsBlockedClient(ip, "", []string{"guest-01"})
+		assert.True(t, disallowed)
+		assert.Equal(t, "host:guest-??", disallowedRule)
+
+		disallowed, disallowedRule = a.IsBlockedClient(ip, "", []string{"guest-1"})
+		assert.False(t, disallowed)
+		assert.Empty(t, disallowedRule)
+
+		// The hostname patterns don't match the ClientIDs.
+		disallowed, _ = a.IsBlockedClient(ip, "guest-01", nil)
+		assert.False(t, disallowed)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		a := &accessCtx{}
+		assert.NotNil(t, a.Init([]string{"host:"}, nil, nil))
+		assert.NotNil(t, a.Init([]string{"host:bad host"}, nil, nil))
+		assert.NotNil(t, a.Init([]string{"host:/tv-[/"}, nil, nil))
+		assert.Nil(t, checkIPCIDRArray([]string{"host:*.lan"}))
+	})
+}
@@ -0,0 +1,120 @@
+package dnsforward
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Orders of the records of the answers.
+const (
+	answerOrderUpstream   = "upstream"
+	answerOrderRoundRobin = "round_robin"
+	answerOrderRandom     = "random"
+)
+
+// maxAnswerRotations is the maximum number of RRsets which rotation offsets
+// are kept.  The offsets are reset when it's reached, so that the queries for
+// many different names don't make them grow without limit.
+const maxAnswerRotations = 10000
+
+// answerRotationKey is the key of the rotation offsets of the RRsets.
+type answerRotationKey struct {
+	name   string
+	rrtype uint16
+}
+
+// answerRotations are the rotation offsets of the RRsets rotated with the
+// round_robin answer order.  The zero value is ready to use.
+type answerRotations struct {
+	// offsets are the offsets of the next rotations by the names and the
+	// types of the RRsets.  It's created on first use.
+	offsets map[answerRotationKey]uint32
+	lock    sync.Mutex
+}
+
+// next returns the offset of the rotation of the RRset with name and rrtype,
+// which has size records, and advances it.
+func (r *answerRotations) next(name string, rrtype uint16, size int) (n int) {
+	k := answerRotationKey{
+		name:   strings.ToLower(name),
+		rrtype: rrtype,
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.offsets == nil || len(r.offsets) >= maxAnswerRotations {
+		r.offsets = map[answerRotationKey]uint32{}
+	}
+
+	off := r.offsets[k] % uint32(size)
+	r.offsets[k] = off + 1
+
+	return int(off)
+}
+
+// rrsetRuns calls f for each run of the consecutive records of rrs with the
+// same name and type which has more than one record.
+func rrsetRuns(rrs []dns.RR, f func(run []dns.RR)) {
+	for start := 0; start < len(rrs); {
+		hdr := rrs[start].Header()
+		end := start + 1
+		for end < len(rrs) {
+			next := rrs[end].Header()
+			if next.Rrtype != hdr.Rrtype || !strings.EqualFold(next.Name, hdr.Name) {
+				break
+			}
+
+			end++
+		}
+
+		if end-start > 1 {
+			f(rrs[start:end])
+		}
+
+		start = end
+	}
+}
+
+// rotate rotates rrs to the left by n records.
+func rotate(rrs []dns.RR, n int) {
+	n %= len(rrs)
+	if n == 0 {
+		return
+	}
+
+	rotated := append(append(make([]dns.RR, 0, len(rrs)), rrs[n:]...), rrs[:n]...)
+	copy(rrs, rotated)
+}
+
+// processAnswerOrder changes the order of the records of each RRset in the
+// answer section according to the configured answer order, so that the
+// clients which always use the first address spread the load across all of
+// them.  The RRsets themselves, for example the CNAME chains, keep their
+// order.
+func processAnswerOrder(ctx *dnsContext) (rc resultCode) {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Res == nil || len(d.Res.Answer) < 2 {
+		return resultCodeSuccess
+	}
+
+	switch s.conf.AnswerOrder {
+	case answerOrderRoundRobin:
+		rrsetRuns(d.Res.Answer, func(run []dns.RR) {
+			hdr := run[0].Header()
+			rotate(run, s.answerRotations.next(hdr.Name, hdr.Rrtype, len(run)))
+		})
+	case answerOrderRandom:
+		rrsetRuns(d.Res.Answer, func(run []dns.RR) {
+			rand.Shuffle(len(run), func(i, j int) { run[i], run[j] = run[j], run[i] })
+		})
+	default:
+		// Keep the order of the upstream response.
+	}
+
+	return resultCodeSuccess
+}
@@ -0,0 +1,133 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newOrderTestResp returns a response with a CNAME record followed by the A
+// records with the addresses from 1.2.3.1 to 1.2.3.n.
+func newOrderTestResp(n int) (resp *dns.Msg) {
+	req := createTestMessage("www.example.org.")
+	resp = &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   "www.example.org.",
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+		},
+		Target: "example.org.",
+	})
+
+	for i := 1; i <= n; i++ {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   "example.org.",
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+			},
+			A: net.IP{1, 2, 3, byte(i)},
+		})
+	}
+
+	return resp
+}
+
+// answerIPs returns the last octets of the addresses of the A records of resp
+// in their order.
+func answerIPs(t *testing.T, resp *dns.Msg) (octets []byte) {
+	t.Helper()
+
+	_, ok := resp.Answer[0].(*dns.CNAME)
+	assert.True(t, ok)
+
+	for _, rr := range resp.Answer[1:] {
+		a, ok := rr.(*dns.A)
+		if assert.True(t, ok) {
+			octets = append(octets, a.A[3])
+		}
+	}
+
+	return octets
+}
+
+func TestProcessAnswerOrder(t *testing.T) {
+	newCtx := func(s *Server) (dctx *dnsContext) {
+		return &dnsContext{
+			srv: s,
+			proxyCtx: &proxy.DNSContext{
+				Res: newOrderTestResp(3),
+			},
+		}
+	}
+
+	t.Run("upstream", func(t *testing.T) {
+		s := &Server{}
+		s.conf.AnswerOrder = answerOrderUpstream
+
+		for i := 0; i < 3; i++ {
+			dctx := newCtx(s)
+			assert.Equal(t, resultCodeSuccess, processAnswerOrder(dctx))
+			assert.Equal(t, []byte{1, 2, 3}, answerIPs(t, dctx.proxyCtx.Res))
+		}
+	})
+
+	t.Run("round_robin", func(t *testing.T) {
+		s := &Server{}
+		s.conf.AnswerOrder = answerOrderRoundRobin
+
+		want := [][]byte{{1, 2, 3}, {2, 3, 1}, {3, 1, 2}, {1, 2, 3}}
+		for _, w := range want {
+			dctx := newCtx(s)
+			assert.Equal(t, resultCodeSuccess, processAnswerOrder(dctx))
+			assert.Equal(t, w, answerIPs(t, dctx.proxyCtx.Res))
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		s := &Server{}
+		s.conf.AnswerOrder = answerOrderRandom
+
+		dctx := newCtx(s)
+		assert.Equal(t, resultCodeSuccess, processAnswerOrder(dctx))
+		assert.ElementsMatch(t, []byte{1, 2, 3}, answerIPs(t, dctx.proxyCtx.Res))
+	})
+}
+
+func TestAnswerRotations_next(t *testing.T) {
+	r := &answerRotations{}
+
+	// The RRsets with different names or types are rotated independently,
+	// and the names are case-insensitive.
+	assert.Equal(t, 0, r.next("a.example.", dns.TypeA, 3))
+	assert.Equal(t, 0, r.next("b.example.", dns.TypeA, 3))
+	assert.Equal(t, 0, r.next("a.example.", dns.TypeAAAA, 3))
+	assert.Equal(t, 1, r.next("A.Example.", dns.TypeA, 3))
+	assert.Equal(t, 2, r.next("a.example.", dns.TypeA, 3))
+	assert.Equal(t, 0, r.next("a.example.", dns.TypeA, 3))
+	assert.Equal(t, 1, r.next("b.example.", dns.TypeA, 3))
+
+	// The offset wraps around the current size of the RRset.
+	assert.Equal(t, 0, r.next("b.example.", dns.TypeA, 2))
+
+	r.offsets = make(map[answerRotationKey]uint32, maxAnswerRotations)
+	for i := uint16(0); i < maxAnswerRotations; i++ {
+		r.offsets[answerRotationKey{name: "c.example.", rrtype: i}] = 1
+	}
+
+	assert.Equal(t, 0, r.next("c.example.", 0, 3))
+	assert.Len(t, r.offsets, 1)
+}
+
+func TestServer_Prepare_answerOrder(t *testing.T) {
+	s := createTestServer(t)
+	conf := s.conf
+	conf.AnswerOrder = "sorted"
+
+	assert.NotNil(t, s.Prepare(&conf))
+}
@@ -0,0 +1,32 @@
+package dnsforward
+
+// processClientBlockedTTL sets the TTL of the records in the blocked response
+// to the one configured for the client, if there is one, so that some clients
+// may re-check the blocked hosts sooner or later than the others.  The TTL
+// from the matched rule in the /etc/hosts syntax, if any, takes precedence.
+func processClientBlockedTTL(ctx *dnsContext) (rc resultCode) {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Res == nil ||
+		ctx.result == nil ||
+		!ctx.result.IsFiltered ||
+		ctx.result.TTL != 0 ||
+		s.conf.GetBlockedTTLByClient == nil {
+		return resultCodeSuccess
+	}
+
+	ttl := s.conf.GetBlockedTTLByClient(IPFromAddr(d.Addr), ctx.clientID)
+	if ttl == 0 {
+		return resultCodeSuccess
+	}
+
+	for _, rr := range d.Res.Answer {
+		rr.Header().Ttl = ttl
+	}
+
+	for _, rr := range d.Res.Ns {
+		rr.Header().Ttl = ttl
+	}
+
+	return resultCodeSuccess
+}
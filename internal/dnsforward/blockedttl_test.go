@@ -0,0 +1,93 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_clientBlockedTTL(t *testing.T) {
+	const clientTTL = 10
+
+	testCases := []struct {
+		name     string
+		clientIP net.IP
+		wantTTL  func(s *Server) (ttl uint32)
+	}{{
+		name:     "configured_client",
+		clientIP: net.IP{127, 0, 0, 1},
+		wantTTL:  func(_ *Server) (ttl uint32) { return clientTTL },
+	}, {
+		name:     "other_client",
+		clientIP: net.IP{192, 168, 0, 2},
+		wantTTL:  func(s *Server) (ttl uint32) { return s.conf.BlockedResponseTTL },
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := createTestServer(t)
+			s.conf.GetBlockedTTLByClient = func(clientAddr net.IP, _ string) (ttl uint32) {
+				if clientAddr.Equal(tc.clientIP) {
+					return clientTTL
+				}
+
+				return 0
+			}
+			assert.Nil(t, s.startWithUpstream(&testUpstream{
+				ipv4: map[string][]net.IP{"host.": {{1, 2, 3, 4}}},
+			}))
+			t.Cleanup(func() { _ = s.Stop() })
+
+			addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+			reply, err := dns.Exchange(createTestMessage("null.example.org."), addr)
+			assert.Nil(t, err)
+			if assert.NotNil(t, reply) && assert.Len(t, reply.Answer, 1) {
+				assert.Equal(t, tc.wantTTL(s), reply.Answer[0].Header().Ttl)
+			}
+
+			// The answers which aren't blocked keep their TTLs.
+			reply, err = dns.Exchange(createTestMessage("host."), addr)
+			assert.Nil(t, err)
+			if assert.NotNil(t, reply) && assert.Len(t, reply.Answer, 1) {
+				assert.NotEqual(t, uint32(clientTTL), reply.Answer[0].Header().Ttl)
+			}
+		})
+	}
+}
+
+func TestServer_hostsRuleTTL(t *testing.T) {
+	s := &Server{}
+	s.conf.BlockedResponseTTL = 3600
+	s.conf.GetBlockedTTLByClient = func(_ net.IP, _ string) (ttl uint32) { return 10 }
+
+	res := &dnsfilter.Result{
+		IsFiltered: true,
+		Reason:     dnsfilter.FilteredBlockList,
+		Rules: []*dnsfilter.ResultRule{{
+			Text: "0.0.0.0 block.example 300",
+			IP:   net.IP{0, 0, 0, 0},
+		}},
+		TTL: 300,
+	}
+
+	d := &proxy.DNSContext{
+		Req:  createTestMessage("block.example."),
+		Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+	}
+	d.Res = s.genDNSFilterMessage(d, res)
+
+	// The TTL of the rule takes precedence over the client's one.
+	assert.Equal(t, resultCodeSuccess, processClientBlockedTTL(&dnsContext{
+		srv:      s,
+		proxyCtx: d,
+		result:   res,
+	}))
+	if assert.Len(t, d.Res.Answer, 1) {
+		assert.Equal(t, uint32(300), d.Res.Answer[0].Header().Ttl)
+	}
+}
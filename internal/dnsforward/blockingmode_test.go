@@ -0,0 +1,70 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_clientBlockingMode(t *testing.T) {
+	testCases := []struct {
+		name      string
+		clientIP  net.IP
+		wantRcode int
+		wantIP    net.IP
+	}{{
+		name:      "configured_client",
+		clientIP:  net.IP{127, 0, 0, 1},
+		wantRcode: dns.RcodeNameError,
+		wantIP:    nil,
+	}, {
+		name:      "other_client",
+		clientIP:  net.IP{192, 168, 0, 2},
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IPv4zero,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := createTestServer(t)
+			s.conf.BlockingMode = dnsfilter.BlockingModeNullIP
+			s.conf.FilterHandler = func(
+				clientAddr net.IP,
+				_ string,
+				setts *dnsfilter.RequestFilteringSettings,
+			) {
+				if clientAddr.Equal(tc.clientIP) {
+					setts.BlockingMode = dnsfilter.BlockingModeNXDomain
+				}
+			}
+			assert.Nil(t, s.startWithUpstream(&testUpstream{}))
+			t.Cleanup(func() { _ = s.Stop() })
+
+			addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+			reply, err := dns.Exchange(createTestMessage("null.example.org."), addr)
+			assert.Nil(t, err)
+			if !assert.NotNil(t, reply) {
+				return
+			}
+
+			assert.Equal(t, tc.wantRcode, reply.Rcode)
+			if tc.wantIP == nil {
+				assert.Empty(t, reply.Answer)
+
+				return
+			}
+
+			if assert.Len(t, reply.Answer, 1) {
+				a, ok := reply.Answer[0].(*dns.A)
+				if assert.True(t, ok) {
+					assert.True(t, tc.wantIP.Equal(a.A), a.A)
+				}
+			}
+		})
+	}
+}
@@ -20,6 +20,9 @@ import (
 
 // FilteringConfig represents the DNS filtering configuration of AdGuard Home
 // The zero FilteringConfig is empty and ready for use.
+//
+// The upstreams of a persistent client take precedence over the ones of the
+// inbound interface, which take precedence over the ones of DefaultPolicy.
 type FilteringConfig struct {
 	// Callbacks for other modules
 	// --
@@ -33,6 +36,33 @@ type FilteringConfig struct {
 	// TODO(e.burkov): Replace argument type with net.IP.
 	GetCustomUpstreamByClient func(clientAddr string) *proxy.UpstreamConfig `yaml:"-"`
 
+	// GetUDPSizeByClient is an optional callback which returns the maximum
+	// size of the UDP responses to the client.  Zero means that there is no
+	// limit other than the one advertised by the client.
+	GetUDPSizeByClient func(clientAddr net.IP, clientID string) (size uint16) `yaml:"-"`
+
+	// GetBlockedTTLByClient is an optional callback which returns the TTL
+	// of the blocked responses to the client.  Zero means that
+	// BlockedResponseTTL is used.
+	GetBlockedTTLByClient func(clientAddr net.IP, clientID string) (ttl uint32) `yaml:"-"`
+
+	// GetAllowedQTypesByClient is an optional callback which returns the
+	// query types the client may issue.  The queries of the other types are
+	// answered with RestrictedQTypeRcode.  A nil slice means that all types
+	// are allowed.
+	GetAllowedQTypesByClient func(clientAddr net.IP, clientID string) (qtypes []uint16) `yaml:"-"`
+
+	// GetHostnamesByClient is an optional callback which returns the
+	// hostnames of the client, such as the name of the persistent client
+	// and the one from the reverse DNS.  It's required for the hostname
+	// patterns in the access lists to work.
+	GetHostnamesByClient func(clientAddr net.IP, clientID string) (hosts []string) `yaml:"-"`
+
+	// GetIPCountry is an optional callback which returns the ISO 3166-1
+	// alpha-2 code of the country where ip is located or an empty string
+	// if it's unknown.  It's required for GeoBlockedCountries to work.
+	GetIPCountry func(ip net.IP) (country string) `yaml:"-"`
+
 	// Protection configuration
 	// --
 
@@ -53,6 +83,18 @@ type FilteringConfig struct {
 	RatelimitWhitelist []string `yaml:"ratelimit_whitelist"` // a list of whitelisted client IP addresses
 	RefuseAny          bool     `yaml:"refuse_any"`          // if true, refuse ANY requests
 
+	// RatelimitMode is the handling of the queries exceeding Ratelimit,
+	// "drop" or "delay".  In the "delay" mode, the queries are delayed
+	// until they fit the rate limit, but no longer than RatelimitMaxDelay.
+	// If empty, "drop" is used.
+	RatelimitMode string `yaml:"ratelimit_mode"`
+
+	// RatelimitMaxDelay is the maximum delay of the queries in the "delay"
+	// RatelimitMode in milliseconds.  The queries which would be delayed
+	// for longer are dropped.  If zero, the default of 500 milliseconds is
+	// used.
+	RatelimitMaxDelay uint32 `yaml:"ratelimit_max_delay"`
+
 	// Upstream DNS servers configuration
 	// --
 
@@ -62,6 +104,79 @@ type FilteringConfig struct {
 	AllServers          bool     `yaml:"all_servers"`   // if true, parallel queries to all configured upstream servers are enabled
 	FastestAddr         bool     `yaml:"fastest_addr"`  // use Fastest Address algorithm
 
+	// QNAMEMinimizationUpstreams are the addresses of the plain DNS
+	// upstream servers which are authoritative, for example the root
+	// servers.  The QNAME minimization described in RFC 7816 is only used
+	// toward these upstream servers and the servers they delegate the
+	// zones to, since the full resolvers see the whole query name anyway.
+	// The addresses must also be in the upstream servers list.
+	QNAMEMinimizationUpstreams []string `yaml:"qname_minimization_upstreams"`
+
+	// InterfaceUpstreams maps the names of network interfaces to the
+	// upstream servers used for the requests received on them, which
+	// allows split-horizon setups on multi-homed machines.  The per-client
+	// upstreams take precedence.
+	InterfaceUpstreams map[string][]string `yaml:"interface_upstreams"`
+
+	// InterfaceFiltering makes the requests tagged with the names of the
+	// network interfaces on which they have been received, so that the
+	// filtering rules with the $ctag=iface_<name> modifiers only apply to
+	// the requests received on those interfaces.
+	InterfaceFiltering bool `yaml:"interface_filtering"`
+
+	// ViaUpstreams maps names to the upstream servers which the trusted
+	// clients can force for a single query by prefixing its name with a
+	// "_via-<name>" label, for example "_via-cloudflare.example.com".  The
+	// label is stripped before the query is forwarded.
+	ViaUpstreams map[string][]string `yaml:"via_upstreams"`
+
+	// ViaTrustedClients are the IP addresses, CIDRs, and ClientIDs of the
+	// clients which may use ViaUpstreams.  If empty, no clients may.
+	ViaTrustedClients []string `yaml:"via_trusted_clients"`
+
+	// UpstreamPools, if not empty, replace the default upstream servers.
+	// The most preferred pool which passes the periodic health checks is
+	// used, so that a standby pool takes over when the primary one fails.
+	// The per-client and per-interface upstreams take precedence.
+	UpstreamPools []UpstreamPool `yaml:"upstream_pools"`
+
+	// UpstreamPoolsCheckInterval is the interval between the health checks
+	// of UpstreamPools in seconds.  If zero, the default of 10 seconds is
+	// used.
+	UpstreamPoolsCheckInterval uint32 `yaml:"upstream_pools_check_interval"`
+
+	// UpstreamPoolsRecoverySeconds is the number of seconds during which a
+	// failed pool must stay healthy before it's used again.  If zero, the
+	// default of 60 seconds is used.
+	UpstreamPoolsRecoverySeconds uint32 `yaml:"upstream_pools_recovery_seconds"`
+
+	// UpstreamQTypes restrict the query types sent to the upstream
+	// servers.  The requests are only sent to the selected upstream
+	// servers which accept their types.
+	UpstreamQTypes []UpstreamQTypes `yaml:"upstream_qtypes"`
+
+	// UpstreamQTypesFallbackDNS are the upstream servers used when none of
+	// the selected ones accepts the query type.  If empty, such queries
+	// are answered with NOTIMP.
+	UpstreamQTypesFallbackDNS []string `yaml:"upstream_qtypes_fallback_dns"`
+
+	// MalformedResponseRetries is the number of times a request is resent to
+	// the next upstream server after the upstream servers have returned a
+	// response which couldn't be parsed, for example a truncated one.  The
+	// upstream servers which have just failed aren't retried, but the ones
+	// of the other upstream pools are.  If zero, such requests fail right
+	// away.
+	MalformedResponseRetries uint32 `yaml:"malformed_response_retries"`
+
+	// GeoBlockedCountries are the ISO 3166-1 alpha-2 codes of the
+	// countries.  The responses with the IP addresses located in them are
+	// blocked.
+	GeoBlockedCountries []string `yaml:"geo_blocked_countries"`
+
+	// GeoBlockExemptDomains are the domains which, along with their
+	// subdomains, are never blocked by GeoBlockedCountries.
+	GeoBlockExemptDomains []string `yaml:"geo_block_exempt_domains"`
+
 	// Access settings
 	// --
 
@@ -76,6 +191,13 @@ type FilteringConfig struct {
 	CacheMinTTL uint32 `yaml:"cache_ttl_min"` // override TTL value (minimum) received from upstream server
 	CacheMaxTTL uint32 `yaml:"cache_ttl_max"` // override TTL value (maximum) received from upstream server
 
+	// MaxStaleSeconds is the maximum number of seconds during which an
+	// expired upstream response may still be served while the fresh one is
+	// looked up in the background.  Responses with shorter TTLs are served
+	// stale for no longer than their TTL.  If zero, expired responses are
+	// never served.
+	MaxStaleSeconds uint32 `yaml:"cache_max_stale_seconds"`
+
 	// Other settings
 	// --
 
@@ -83,12 +205,106 @@ type FilteringConfig struct {
 	AAAADisabled           bool     `yaml:"aaaa_disabled"`      // Respond with an empty answer to all AAAA requests
 	EnableDNSSEC           bool     `yaml:"enable_dnssec"`      // Set DNSSEC flag in outcoming DNS request
 	EnableEDNSClientSubnet bool     `yaml:"edns_client_subnet"` // Enable EDNS Client Subnet option
+	EnableEDE              bool     `yaml:"enable_ede"`         // Add Extended DNS Errors to SERVFAIL responses
 	MaxGoroutines          uint32   `yaml:"max_goroutines"`     // Max. number of parallel goroutines for processing incoming requests
 
+	// ECSClientMatching makes the $client rules match the subnet from the
+	// EDNS Client Subnet option of the query instead of the address of the
+	// client, which is useful when the queries come from a downstream
+	// forwarder.  The access lists are checked against both the address
+	// and the subnet, and the query is refused if either is disallowed.
+	// Clients can spoof this option, so it should only be enabled if they
+	// are trusted.
+	ECSClientMatching bool `yaml:"edns_client_subnet_matching"`
+
+	// NonRDMode defines what happens to the queries with the RD bit
+	// cleared, which expect an iterative resolution.  It is either
+	// "forward", which is the default and forwards them as is, "refuse",
+	// which refuses them, or "cache_only", which only answers them from the
+	// cache and refuses them otherwise.  The cache isn't used with the
+	// per-client upstreams, so such queries are refused in the "cache_only"
+	// mode then.
+	NonRDMode string `yaml:"non_rd_mode"`
+
+	// ECSPolicy defines what happens to the EDNS Client Subnet option sent
+	// by the client when the query is forwarded.  It is either "honor",
+	// which is the default and keeps it, "override", which replaces it with
+	// the subnet of the real source address if it's a public one, or
+	// "strip", which removes it and disables adding one.  The stale cache is
+	// keyed by the forwarded option.  See applyECSPolicy.
+	ECSPolicy string `yaml:"edns_client_subnet_policy"`
+
+	// AnswerOrder is the order of the records of each RRset in the
+	// answers.  It is either "upstream", which is the default and keeps the
+	// order of the upstream response, "round_robin", which rotates the
+	// records on each query, or "random", which shuffles them.
+	AnswerOrder string `yaml:"answer_order"`
+
+	// RestrictedQTypeRcode is the response code of the answers to the
+	// queries of the types a client isn't allowed to issue.  It is either
+	// "refused", which is the default, or "notimp".  See
+	// GetAllowedQTypesByClient.
+	RestrictedQTypeRcode string `yaml:"restricted_qtype_rcode"`
+
+	// EDNSPadding enables the EDNS(0) padding of the responses sent over
+	// the encrypted transports, DNS-over-TLS, DNS-over-HTTPS, and
+	// DNS-over-QUIC, to the queries which support EDNS.  See RFC 7830 and
+	// RFC 8467.
+	EDNSPadding bool `yaml:"edns_padding"`
+
+	// EDNSPaddingBlockSize is the block size to the multiple of which the
+	// responses are padded.  If zero, the default of 468 bytes recommended
+	// by RFC 8467 is used.
+	EDNSPaddingBlockSize uint16 `yaml:"edns_padding_block_size"`
+
+	// DHCP-only mode settings
+	// --
+
+	// ProcessingDisabled disables the processing of DNS queries, which is
+	// useful when AdGuard Home is mostly used as a DHCP server.  The DNS
+	// listeners still answer the queries according to DisabledMode.
+	ProcessingDisabled bool `yaml:"dns_processing_disabled"`
+
+	// DisabledMode is how queries are answered when ProcessingDisabled is
+	// true.  It is either "refuse", which is the default, or
+	// "transparent_forward", in which case the queries are forwarded to the
+	// upstream servers without any filtering.
+	DisabledMode string `yaml:"dns_disabled_mode"`
+
+	// ShutdownGraceSeconds is the maximum number of seconds during which
+	// the server waits for the queries being processed to complete on
+	// shutdown and reconfiguration.  The new queries are refused in the
+	// meantime, and the listeners are stopped afterwards.  If zero, the
+	// server stops immediately.
+	ShutdownGraceSeconds uint32 `yaml:"shutdown_grace_seconds"`
+
 	// IPSET configuration - add IP addresses of the specified domain names to an ipset list
 	// Syntax:
 	// "DOMAIN[,DOMAIN].../IPSET_NAME"
 	IPSETList []string `yaml:"ipset"`
+
+	// LocalServices are the SRV and NAPTR records answered locally, for
+	// example for the VoIP services on the LAN.
+	LocalServices []LocalService `yaml:"local_services"`
+
+	// SecondaryZones are the zones transferred from the primary servers
+	// and answered authoritatively.  They are refreshed according to their
+	// SOA records and on NOTIFY from the primary servers.
+	SecondaryZones []SecondaryZone `yaml:"secondary_zones"`
+
+	// DefaultPolicy is the fallback handling of the queries which match
+	// neither the policy of a persistent client nor the upstreams of an
+	// interface.
+	DefaultPolicy DefaultPolicy `yaml:"default_policy"`
+
+	// SpecialUseDomains are the overrides of the policies for the
+	// special-use domain names and their subdomains, which are answered
+	// locally instead of being forwarded.  The policies are "loopback",
+	// "nxdomain", "refuse", and "forward".  By default, "localhost" is
+	// answered with the loopback addresses, "invalid" with NXDOMAIN, and
+	// "onion" and "local" with REFUSED, except for the domains which have
+	// their own upstreams in UpstreamDNS.
+	SpecialUseDomains map[string]string `yaml:"special_use_domains"`
 }
 
 // TLSConfig is the TLS configuration for HTTPS, DNS-over-HTTPS, and DNS-over-TLS
@@ -126,6 +342,10 @@ type DNSCryptConfig struct {
 	ProviderName  string
 	ResolverCert  *dnscrypt.Cert
 	Enabled       bool
+
+	// ResolverConfig, if not nil, is used to create a new ResolverCert
+	// when half of the validity period of the current one has passed.
+	ResolverConfig *dnscrypt.ResolverConfig
 }
 
 // ServerConfig represents server configuration.
@@ -136,6 +356,16 @@ type ServerConfig struct {
 	UpstreamConfig *proxy.UpstreamConfig // Upstream DNS servers config
 	OnDNSRequest   func(d *proxy.DNSContext)
 
+	// LocalDomainName is the local search domain of the DHCP leases, for
+	// example "lan".  The single-label queries from the local clients are
+	// resolved as if it was appended to them.  If empty, "lan" is used.
+	LocalDomainName string
+
+	// QueryLogVerbose makes the server pass the names of the EDNS options of
+	// the requests and the responses to the query log.  See
+	// querylog.Config.Verbose.
+	QueryLogVerbose bool
+
 	FilteringConfig
 	TLSConfig
 	DNSCryptConfig
@@ -161,9 +391,9 @@ var defaultValues = ServerConfig{
 // createProxyConfig creates and validates configuration for the main proxy
 func (s *Server) createProxyConfig() (proxy.Config, error) {
 	proxyConfig := proxy.Config{
-		UDPListenAddr:          []*net.UDPAddr{s.conf.UDPListenAddr},
+		UDPListenAddr:          s.iface.udpListenAddrs(s.conf.UDPListenAddr),
 		TCPListenAddr:          []*net.TCPAddr{s.conf.TCPListenAddr},
-		Ratelimit:              int(s.conf.Ratelimit),
+		Ratelimit:              s.proxyRatelimit(),
 		RatelimitWhitelist:     s.conf.RatelimitWhitelist,
 		RefuseAny:              s.conf.RefuseAny,
 		CacheMinTTL:            s.conf.CacheMinTTL,
@@ -171,7 +401,7 @@ func (s *Server) createProxyConfig() (proxy.Config, error) {
 		UpstreamConfig:         s.conf.UpstreamConfig,
 		BeforeRequestHandler:   s.beforeRequestHandler,
 		RequestHandler:         s.handleDNSRequest,
-		EnableEDNSClientSubnet: s.conf.EnableEDNSClientSubnet,
+		EnableEDNSClientSubnet: s.conf.EnableEDNSClientSubnet && s.conf.ECSPolicy != ecsPolicyStrip,
 		MaxGoroutines:          int(s.conf.MaxGoroutines),
 	}
 
@@ -204,13 +434,6 @@ func (s *Server) createProxyConfig() (proxy.Config, error) {
 		return proxyConfig, err
 	}
 
-	if s.conf.DNSCryptConfig.Enabled {
-		proxyConfig.DNSCryptUDPListenAddr = []*net.UDPAddr{s.conf.DNSCryptConfig.UDPListenAddr}
-		proxyConfig.DNSCryptTCPListenAddr = []*net.TCPAddr{s.conf.DNSCryptConfig.TCPListenAddr}
-		proxyConfig.DNSCryptProviderName = s.conf.DNSCryptConfig.ProviderName
-		proxyConfig.DNSCryptResolverCert = s.conf.DNSCryptConfig.ResolverCert
-	}
-
 	// Validate proxy config
 	if proxyConfig.UpstreamConfig == nil || len(proxyConfig.UpstreamConfig.Upstreams) == 0 {
 		return proxyConfig, errors.New("no default upstream servers configured")
@@ -226,7 +449,7 @@ func (s *Server) initDefaultSettings() {
 		s.conf.UpstreamDNS = defaultDNS
 	}
 	if len(s.conf.BootstrapDNS) == 0 {
-		s.conf.BootstrapDNS = defaultBootstrap
+		s.conf.BootstrapDNS = DefaultBootstrap
 	}
 	if len(s.conf.ParentalBlockHost) == 0 {
 		s.conf.ParentalBlockHost = parentalBlockHost
@@ -243,6 +466,9 @@ func (s *Server) initDefaultSettings() {
 	if len(s.conf.BlockedHosts) == 0 {
 		s.conf.BlockedHosts = defaultBlockedHosts
 	}
+	if s.conf.LocalDomainName == "" {
+		s.conf.LocalDomainName = defaultLocalDomainName
+	}
 }
 
 // prepareUpstreamSettings - prepares upstream DNS server settings
@@ -259,9 +485,20 @@ func (s *Server) prepareUpstreamSettings() error {
 		upstream.CipherSuites = s.conf.TLSCiphers
 	}
 
-	// Load upstreams either from the file, or from the settings
+	if len(s.upstreams) != 0 {
+		s.conf.UpstreamConfig = &proxy.UpstreamConfig{
+			Upstreams: s.nonRDUpstreams(s.qminUpstreams(s.upstreams)),
+		}
+
+		return nil
+	}
+
+	// Load upstreams either from the default policy, from the file, or from
+	// the settings
 	var upstreams []string
-	if s.conf.UpstreamDNSFileName != "" {
+	if len(s.conf.DefaultPolicy.Upstreams) != 0 {
+		upstreams = s.conf.DefaultPolicy.Upstreams
+	} else if s.conf.UpstreamDNSFileName != "" {
 		data, err := ioutil.ReadFile(s.conf.UpstreamDNSFileName)
 		if err != nil {
 			return err
@@ -290,6 +527,8 @@ func (s *Server) prepareUpstreamSettings() error {
 		upstreamConfig.Upstreams = uc.Upstreams
 	}
 
+	upstreamConfig.Upstreams = s.qminUpstreams(upstreamConfig.Upstreams)
+	s.nonRDUpstreamConfig(&upstreamConfig)
 	s.conf.UpstreamConfig = &upstreamConfig
 	return nil
 }
@@ -0,0 +1,75 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+)
+
+// DefaultPolicy is the handling of the queries which don't match a more
+// specific policy.  It's configured separately from the policies of the
+// persistent clients and the interfaces, so that there is always a
+// well-defined baseline.
+type DefaultPolicy struct {
+	// Upstreams are the upstream servers used when neither the client nor
+	// the interface the query has been received on has its own ones.  If
+	// empty, UpstreamDNS is used.  UpstreamPools, if any, replace them as
+	// they replace UpstreamDNS.
+	Upstreams []string `yaml:"upstreams"`
+
+	// FilteringEnabled, SafeBrowsingEnabled, ParentalEnabled, and
+	// SafeSearchEnabled, if not nil, override the global filtering settings
+	// for the queries from the clients which aren't persistent ones.
+	FilteringEnabled    *bool `yaml:"filtering_enabled"`
+	SafeBrowsingEnabled *bool `yaml:"safebrowsing_enabled"`
+	ParentalEnabled     *bool `yaml:"parental_enabled"`
+	SafeSearchEnabled   *bool `yaml:"safesearch_enabled"`
+
+	// BlockingMode, if not empty, overrides the global blocking mode for
+	// the queries from the clients which aren't persistent ones.
+	// BlockingIPv4 and BlockingIPv6 are its IP addresses for the
+	// "custom_ip" mode.
+	BlockingMode string `yaml:"blocking_mode"`
+	BlockingIPv4 net.IP `yaml:"blocking_ipv4"`
+	BlockingIPv6 net.IP `yaml:"blocking_ipv6"`
+}
+
+// validate returns an error if p is invalid.
+func (p *DefaultPolicy) validate() (err error) {
+	err = dnsfilter.ValidateBlockingMode(p.BlockingMode, p.BlockingIPv4, p.BlockingIPv6)
+	if err != nil {
+		return fmt.Errorf("default policy: %w", err)
+	}
+
+	return nil
+}
+
+// apply applies p to the filtering settings of a query.  The queries from the
+// persistent clients, which have the client names set by
+// FilteringConfig.FilterHandler, are left alone.
+func (p *DefaultPolicy) apply(setts *dnsfilter.RequestFilteringSettings) {
+	if setts.ClientName != "" {
+		return
+	}
+
+	for _, o := range []struct {
+		val  *bool
+		sett *bool
+	}{
+		{val: p.FilteringEnabled, sett: &setts.FilteringEnabled},
+		{val: p.SafeBrowsingEnabled, sett: &setts.SafeBrowsingEnabled},
+		{val: p.ParentalEnabled, sett: &setts.ParentalEnabled},
+		{val: p.SafeSearchEnabled, sett: &setts.SafeSearchEnabled},
+	} {
+		if o.val != nil {
+			*o.sett = *o.val
+		}
+	}
+
+	if p.BlockingMode != "" {
+		setts.BlockingMode = p.BlockingMode
+		setts.BlockingIPv4 = p.BlockingIPv4
+		setts.BlockingIPv6 = p.BlockingIPv6
+	}
+}
@@ -0,0 +1,27 @@
+package dnsforward
+
+import (
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Modes of answering the queries when the DNS processing is disabled.
+const (
+	disabledModeRefuse             = "refuse"
+	disabledModeTransparentForward = "transparent_forward"
+)
+
+// handleDisabled answers the query when the DNS processing is disabled.
+// Depending on the configured mode, the query is either refused or forwarded to
+// the upstream servers as is, without filtering, logging, or statistics.
+func (s *Server) handleDisabled(d *proxy.DNSContext) (err error) {
+	if s.conf.DisabledMode != disabledModeTransparentForward {
+		d.Res = s.makeResponseREFUSED(d.Req)
+
+		return nil
+	}
+
+	log.Debug("dns: processing disabled, forwarding %s", d.Req.Question[0].Name)
+
+	return s.dnsProxy.Resolve(d)
+}
@@ -0,0 +1,69 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_ProcessingDisabled(t *testing.T) {
+	// The host is blocked by the rules of the test server.
+	const host = "nxdomain.example.org."
+
+	testCases := []struct {
+		name  string
+		mode  string
+		rcode int
+		ip    net.IP
+	}{{
+		name:  "default",
+		mode:  "",
+		rcode: dns.RcodeRefused,
+		ip:    nil,
+	}, {
+		name:  "refuse",
+		mode:  disabledModeRefuse,
+		rcode: dns.RcodeRefused,
+		ip:    nil,
+	}, {
+		name:  "transparent_forward",
+		mode:  disabledModeTransparentForward,
+		rcode: dns.RcodeSuccess,
+		ip:    net.IP{1, 2, 3, 4},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := createTestServer(t)
+			s.conf.ProcessingDisabled = true
+			s.conf.DisabledMode = tc.mode
+			err := s.startWithUpstream(&testUpstream{
+				ipv4: map[string][]net.IP{
+					host: {{1, 2, 3, 4}},
+				},
+			})
+			assert.Nil(t, err)
+			t.Cleanup(func() { _ = s.Stop() })
+
+			req := createTestMessage(host)
+			reply, err := dns.Exchange(req, s.dnsProxy.Addr(proxy.ProtoUDP).String())
+			assert.Nil(t, err)
+			assert.Equal(t, tc.rcode, reply.Rcode)
+
+			if tc.ip == nil {
+				assert.Empty(t, reply.Answer)
+
+				return
+			}
+
+			if assert.Len(t, reply.Answer, 1) {
+				a, ok := reply.Answer[0].(*dns.A)
+				assert.True(t, ok)
+				assert.True(t, tc.ip.Equal(a.A))
+			}
+		})
+	}
+}
@@ -44,6 +44,24 @@ type dnsContext struct {
 	// origReqDNSSEC shows if the DNSSEC flag in the original request from
 	// the client is set.
 	origReqDNSSEC bool
+	// iface is the name of the network interface on which the request has
+	// been received, if it is known and there are per-interface settings.
+	iface string
+	// viaQuestion is the question received from the client.  It is set
+	// when the upstreams are forced with the via prefix, which is stripped
+	// from the request.
+	viaQuestion dns.Question
+	// viaUpstreams are the upstreams forced with the via prefix.  It is nil
+	// if the via prefix isn't used.
+	viaUpstreams *proxy.UpstreamConfig
+	// reqEDNSOptions are the names of the EDNS options of the request
+	// received from the client, before it's modified for the upstreams.
+	// They're only gathered if ServerConfig.QueryLogVerbose is true.
+	reqEDNSOptions []string
+	// origReq is the request received from the client.  It is set when
+	// the request is replaced with a modified copy for the upstreams, see
+	// applyECSPolicy.
+	origReq *dns.Msg
 }
 
 // resultCode is the result of a request processing function.
@@ -63,6 +81,18 @@ const (
 
 // handleDNSRequest filters the incoming DNS requests and writes them to the query log
 func (s *Server) handleDNSRequest(_ *proxy.Proxy, d *proxy.DNSContext) error {
+	if !s.inflight.begin() {
+		log.Debug("dns: draining, refusing %s", d.Req.Question[0].Name)
+		d.Res = s.makeResponseREFUSED(d.Req)
+
+		return nil
+	}
+	defer s.inflight.end()
+
+	if s.conf.ProcessingDisabled {
+		return s.handleDisabled(d)
+	}
+
 	ctx := &dnsContext{
 		srv:       s,
 		proxyCtx:  d,
@@ -80,15 +110,30 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, d *proxy.DNSContext) error {
 	mods := []modProcessFunc{
 		processInitial,
 		processInternalHosts,
+		processLocalServices,
+		processSecondaryZones,
 		processInternalIPAddrs,
 		processClientID,
+		processVia,
+		processClientQTypes,
 		processFilteringBeforeRequest,
+		processSpecialUseNames,
 		processUpstream,
 		processDNSSECAfterResponse,
 		processFilteringAfterResponse,
+		processClientBlockedTTL,
+		processAnswerOrder,
 		s.ipset.process,
+		processRestoreVia,
+		processClientUDPSize,
+		processEDNSPadding,
 		processQueryLogsAndStats,
 	}
+
+	// Restore the question received from the client for the requests which
+	// don't reach processRestoreVia.
+	defer restoreVia(ctx)
+
 	for _, process := range mods {
 		r := process(ctx)
 		switch r {
@@ -122,6 +167,11 @@ func processInitial(ctx *dnsContext) (rc resultCode) {
 		s.conf.OnDNSRequest(d)
 	}
 
+	ctx.iface = s.iface.inboundInterface(d)
+	if s.conf.QueryLogVerbose {
+		ctx.reqEDNSOptions = ednsOptions(d.Req)
+	}
+
 	// disable Mozilla DoH
 	// https://support.mozilla.org/en-US/kb/canary-domain-use-application-dnsnet
 	if (d.Req.Question[0].Qtype == dns.TypeA || d.Req.Question[0].Qtype == dns.TypeAAAA) &&
@@ -169,10 +219,20 @@ func (s *Server) onDHCPLeaseChanged(flags int) {
 
 		lowhost := strings.ToLower(l.Hostname)
 
+		// The reverse lookups work for both DHCPv4 and DHCPv6 leases,
+		// since util.DNSUnreverseAddr parses both in-addr.arpa and
+		// ip6.arpa names.
 		m[l.IP.String()] = lowhost
 
+		ip4 := l.IP.To4()
+		if ip4 == nil {
+			// Only A records are answered for the leased hosts, so
+			// don't let the DHCPv6 leases shadow the DHCPv4 ones.
+			continue
+		}
+
 		ip := make(net.IP, 4)
-		copy(ip, l.IP.To4())
+		copy(ip, ip4)
 		hostToIP[lowhost] = ip
 	}
 
@@ -195,12 +255,10 @@ func processInternalHosts(ctx *dnsContext) (rc resultCode) {
 		return resultCodeSuccess
 	}
 
-	host := req.Question[0].Name
-	host = strings.ToLower(host)
-	if !strings.HasSuffix(host, ".lan.") {
+	host, qualified, ok := s.leaseHost(req.Question[0].Name, IPFromAddr(ctx.proxyCtx.Addr))
+	if !ok {
 		return resultCodeSuccess
 	}
-	host = strings.TrimSuffix(host, ".lan.")
 
 	s.tableHostToIPLock.Lock()
 	if s.tableHostToIP == nil {
@@ -217,10 +275,27 @@ func processInternalHosts(ctx *dnsContext) (rc resultCode) {
 
 	resp := s.makeResponse(req)
 
+	name := req.Question[0].Name
+	if qualified {
+		// Point the single-label name to the qualified one, so that
+		// the answer is consistent with the search domain from DHCP.
+		target := host + "." + s.conf.LocalDomainName + "."
+		resp.Answer = append(resp.Answer, &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeCNAME,
+				Ttl:    s.conf.BlockedResponseTTL,
+				Class:  dns.ClassINET,
+			},
+			Target: target,
+		})
+		name = target
+	}
+
 	if req.Question[0].Qtype == dns.TypeA {
 		a := &dns.A{}
 		a.Hdr = dns.RR_Header{
-			Name:   req.Question[0].Name,
+			Name:   name,
 			Rrtype: dns.TypeA,
 			Ttl:    s.conf.BlockedResponseTTL,
 			Class:  dns.ClassINET,
@@ -228,6 +303,11 @@ func processInternalHosts(ctx *dnsContext) (rc resultCode) {
 		a.A = make([]byte, 4)
 		copy(a.A, ip)
 		resp.Answer = append(resp.Answer, a)
+	} else {
+		// The leases only have IPv4 addresses, so answer AAAA with
+		// NODATA and an SOA record, which allows the clients to cache
+		// the negative answer instead of retrying.
+		resp.Ns = s.genSOA(req)
 	}
 
 	ctx.proxyCtx.Res = resp
@@ -465,7 +545,18 @@ func processUpstream(ctx *dnsContext) (rc resultCode) {
 		return resultCodeSuccess // response is already set - nothing to do
 	}
 
-	if d.Addr != nil && s.conf.GetCustomUpstreamByClient != nil {
+	if !d.Req.RecursionDesired && s.conf.NonRDMode == nonRDModeRefuse {
+		log.Debug("dns: refusing non-recursive query for %s", d.Req.Question[0].Name)
+		d.Res = s.makeResponseREFUSED(d.Req)
+
+		return resultCodeSuccess
+	}
+
+	if ctx.viaUpstreams != nil {
+		d.CustomUpstreamConfig = ctx.viaUpstreams
+	}
+
+	if d.CustomUpstreamConfig == nil && d.Addr != nil && s.conf.GetCustomUpstreamByClient != nil {
 		clientIP := IPStringFromAddr(d.Addr)
 		upstreamsConf := s.conf.GetCustomUpstreamByClient(clientIP)
 		if upstreamsConf != nil {
@@ -474,6 +565,41 @@ func processUpstream(ctx *dnsContext) (rc resultCode) {
 		}
 	}
 
+	if d.CustomUpstreamConfig == nil {
+		if uc := s.iface.upstreamsFor(ctx.iface); uc != nil {
+			log.Debug("Using upstreams for interface %s", ctx.iface)
+			d.CustomUpstreamConfig = uc
+		}
+	}
+
+	// The stale responses are only cached for the default upstreams,
+	// including the ones of the active upstream pool.
+	useStale := d.CustomUpstreamConfig == nil
+
+	// The proxy only uses its cache for the default upstreams, so use them
+	// explicitly to bypass it for the evicted names.
+	if d.CustomUpstreamConfig == nil && s.evicted != nil && s.evicted.has(d.Req) {
+		log.Debug("dns: bypassing cache for evicted %s", d.Req.Question[0].Name)
+		d.CustomUpstreamConfig = s.defaultUpstreamConfig()
+	}
+
+	cacheOnly := s.isCacheOnly(d.Req)
+	if cacheOnly && d.CustomUpstreamConfig != nil {
+		log.Debug("dns: no cache for non-recursive query for %s", d.Req.Question[0].Name)
+		d.Res = s.makeResponseREFUSED(d.Req)
+
+		return resultCodeSuccess
+	}
+
+	if !s.restrictUpstreams(d) {
+		resp := &dns.Msg{}
+		resp.SetRcode(d.Req, dns.RcodeNotImplemented)
+		resp.RecursionAvailable = true
+		d.Res = resp
+
+		return resultCodeSuccess
+	}
+
 	if s.conf.EnableDNSSEC {
 		opt := d.Req.IsEdns0()
 		if opt == nil {
@@ -486,13 +612,60 @@ func processUpstream(ctx *dnsContext) (rc resultCode) {
 		}
 	}
 
+	s.applyECSPolicy(ctx)
+
+	stale := s.stale
+	if stale != nil && useStale {
+		resp, revalidate := stale.get(d.Req)
+		if resp != nil {
+			log.Debug("dns: serving stale response for %s", d.Req.Question[0].Name)
+			if revalidate {
+				go s.revalidateStale(stale, d.Req.Copy())
+			}
+
+			d.Res = resp
+			ctx.responseFromUpstream = true
+
+			return resultCodeSuccess
+		}
+	}
+
 	// request was not filtered so let it be processed further
 	err := s.dnsProxy.Resolve(d)
+	if err != nil && isMalformedResponse(err) {
+		err = s.retryMalformed(d, err)
+	}
+
+	if err != nil && cacheOnly {
+		log.Debug("dns: refusing non-recursive query for %s: %s", d.Req.Question[0].Name, err)
+		d.Res = s.makeResponseREFUSED(d.Req)
+
+		return resultCodeSuccess
+	}
+
 	if err != nil {
 		ctx.err = err
+		if s.conf.EnableEDE {
+			d.Res = s.genServerFailureEDE(d.Req, err)
+		}
+
 		return resultCodeError
 	}
 
+	if s.conf.EnableEDE && s.conf.EnableDNSSEC {
+		s.addBogusEDE(d)
+	}
+
+	if stale != nil && useStale {
+		stale.set(d.Req, d.Res)
+	}
+
+	// The responses from the default upstreams which aren't served from the
+	// cache are stored in it.
+	if d.CustomUpstreamConfig == nil && d.Upstream != nil && s.evicted != nil {
+		s.evicted.store(d.Res)
+	}
+
 	ctx.responseFromUpstream = true
 	return resultCodeSuccess
 }
@@ -550,6 +723,19 @@ func processFilteringAfterResponse(ctx *dnsContext) (rc resultCode) {
 	res := ctx.result
 	var err error
 
+	if ctx.responseFromUpstream && s.dnsFilter != nil {
+		if depthRes := s.dnsFilter.CheckResolutionDepth(res, d.Res); depthRes != nil {
+			if len(ctx.origQuestion.Name) != 0 {
+				d.Req.Question[0] = ctx.origQuestion
+			}
+
+			ctx.result = depthRes
+			d.Res = s.genServerFailure(d.Req)
+
+			return resultCodeSuccess
+		}
+	}
+
 	switch res.Reason {
 	case dnsfilter.Rewritten,
 		dnsfilter.RewrittenRule:
@@ -578,15 +764,20 @@ func processFilteringAfterResponse(ctx *dnsContext) (rc resultCode) {
 			break
 		}
 		origResp2 := d.Res
+		monitorRules := res.MonitorRules
 		ctx.result, err = s.filterDNSResponse(ctx)
 		if err != nil {
 			ctx.err = err
 			return resultCodeError
 		}
+		if ctx.result == nil {
+			ctx.result = s.filterGeo(ctx)
+		}
 		if ctx.result != nil {
 			ctx.origResp = origResp2 // matched by response
 		} else {
-			ctx.result = &dnsfilter.Result{}
+			// Keep the matches of the monitor-only lists.
+			ctx.result = &dnsfilter.Result{MonitorRules: monitorRules}
 		}
 	}
 
@@ -9,6 +9,7 @@ import (
 
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/lucas-clemente/quic-go"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -233,3 +234,64 @@ func TestProcessClientID_https(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_processInternalHosts(t *testing.T) {
+	ups := &recordUpstream{}
+	s := createTestServer(t)
+	assert.Nil(t, s.startWithUpstream(ups))
+	t.Cleanup(func() { _ = s.Stop() })
+
+	s.tableHostToIPLock.Lock()
+	s.tableHostToIP = map[string]net.IP{
+		"leased": {192, 168, 0, 10},
+	}
+	s.tableHostToIPLock.Unlock()
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	t.Run("a", func(t *testing.T) {
+		resp, err := dns.Exchange(createTestMessageWithType("leased.lan.", dns.TypeA), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		if assert.Len(t, resp.Answer, 1) {
+			a, ok := resp.Answer[0].(*dns.A)
+			if assert.True(t, ok) {
+				assert.True(t, net.IP{192, 168, 0, 10}.Equal(a.A))
+			}
+		}
+	})
+
+	t.Run("aaaa", func(t *testing.T) {
+		resp, err := dns.Exchange(createTestMessageWithType("LEASED.lan.", dns.TypeAAAA), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Empty(t, resp.Answer)
+		if assert.Len(t, resp.Ns, 1) {
+			soa, ok := resp.Ns[0].(*dns.SOA)
+			if assert.True(t, ok) {
+				assert.Equal(t, "LEASED.lan.", soa.Hdr.Name)
+			}
+		}
+	})
+
+	t.Run("single_label", func(t *testing.T) {
+		resp, err := dns.Exchange(createTestMessageWithType("leased.", dns.TypeA), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		if assert.Len(t, resp.Answer, 2) {
+			cname, ok := resp.Answer[0].(*dns.CNAME)
+			if assert.True(t, ok) {
+				assert.Equal(t, "leased.", cname.Hdr.Name)
+				assert.Equal(t, "leased.lan.", cname.Target)
+			}
+
+			a, ok := resp.Answer[1].(*dns.A)
+			if assert.True(t, ok) {
+				assert.Equal(t, "leased.lan.", a.Hdr.Name)
+				assert.True(t, net.IP{192, 168, 0, 10}.Equal(a.A))
+			}
+		}
+	})
+
+	assert.Empty(t, ups.received())
+}
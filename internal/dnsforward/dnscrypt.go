@@ -0,0 +1,262 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/dnscrypt/v2"
+)
+
+const (
+	// minDNSCryptRotationDelay is the minimum time between the rotations of
+	// the DNSCrypt certificate.
+	minDNSCryptRotationDelay = 1 * time.Minute
+
+	// dnsCryptRotationRetry is the interval between the attempts to create
+	// a new DNSCrypt certificate after a failed one.
+	dnsCryptRotationRetry = 5 * time.Minute
+)
+
+// dnsCryptCtx runs the DNSCrypt server and rotates its certificate.
+//
+// The DNSCrypt server is a separate proxy which only has the DNSCrypt
+// listeners and passes the queries to the same handlers as the main one.  The
+// DNSCrypt server of dnsproxy reads its certificate on each query without any
+// synchronization, so the certificate is never changed in place.  Instead, the
+// DNSCrypt proxy is rebuilt with the new certificate, while the main proxy
+// along with its listeners and cache keeps running.
+type dnsCryptCtx struct {
+	// conf is the configuration of the DNSCrypt proxy without the
+	// certificate.
+	conf proxy.Config
+
+	// rc is used to create the new certificates.  It's nil if the
+	// certificate isn't rotated.
+	rc *dnscrypt.ResolverConfig
+
+	// lock protects cert and proxy.
+	lock sync.Mutex
+
+	// cert is the certificate of the DNSCrypt server.  It's nil if the
+	// DNSCrypt server is disabled.
+	cert *dnscrypt.Cert
+
+	// proxy is the running DNSCrypt proxy.  It's nil if it isn't running.
+	proxy *proxy.Proxy
+
+	// notBefore and notAfter are the validity period of the current
+	// certificate.
+	notBefore time.Time
+	notAfter  time.Time
+
+	// done is closed to stop the rotation loop.
+	done chan struct{}
+
+	// wg is used to wait for the rotation loop to exit.
+	wg sync.WaitGroup
+}
+
+// init initializes c from conf.  base is the configuration of the main proxy,
+// which the DNSCrypt proxy shares the handlers and the limits with.
+func (c *dnsCryptCtx) init(conf DNSCryptConfig, base proxy.Config) {
+	c.rc, c.cert = nil, nil
+	if !conf.Enabled || conf.ResolverCert == nil {
+		return
+	}
+
+	c.conf = proxy.Config{
+		DNSCryptUDPListenAddr: []*net.UDPAddr{conf.UDPListenAddr},
+		DNSCryptTCPListenAddr: []*net.TCPAddr{conf.TCPListenAddr},
+		DNSCryptProviderName:  conf.ProviderName,
+		Ratelimit:             base.Ratelimit,
+		RatelimitWhitelist:    base.RatelimitWhitelist,
+		RefuseAny:             base.RefuseAny,
+		UpstreamConfig:        base.UpstreamConfig,
+		BeforeRequestHandler:  base.BeforeRequestHandler,
+		RequestHandler:        base.RequestHandler,
+		MaxGoroutines:         base.MaxGoroutines,
+	}
+
+	c.rc = conf.ResolverConfig
+	c.cert = conf.ResolverCert
+	c.setValidity(c.cert)
+}
+
+// setValidity sets the validity period of the current certificate from cert.
+func (c *dnsCryptCtx) setValidity(cert *dnscrypt.Cert) {
+	c.notBefore = time.Unix(int64(cert.NotBefore), 0)
+	c.notAfter = time.Unix(int64(cert.NotAfter), 0)
+}
+
+// rotationDelay returns the time to wait before replacing the current
+// certificate.  The certificate is replaced when half of its validity period
+// has passed, so that the clients have enough time to fetch the new one.
+func (c *dnsCryptCtx) rotationDelay(now time.Time) (d time.Duration) {
+	half := c.notAfter.Sub(c.notBefore) / 2
+	d = c.notBefore.Add(half).Sub(now)
+	if d < minDNSCryptRotationDelay {
+		return minDNSCryptRotationDelay
+	}
+
+	return d
+}
+
+// restart replaces the running DNSCrypt proxy, if any, with a new one using
+// cert.  The previous proxy is stopped first, since both listen on the same
+// addresses.  If the new proxy fails to start, the previous certificate is
+// kept and restart tries to start a proxy with it again.
+func (c *dnsCryptCtx) restart(cert *dnscrypt.Cert) (err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.proxy != nil {
+		err = c.proxy.Stop()
+		c.proxy = nil
+		if err != nil {
+			return fmt.Errorf("stopping dnscrypt server: %w", err)
+		}
+	}
+
+	conf := c.conf
+	conf.DNSCryptResolverCert = cert
+	p := &proxy.Proxy{Config: conf}
+	err = p.Start()
+	if err == nil {
+		c.cert, c.proxy = cert, p
+
+		return nil
+	}
+
+	err = fmt.Errorf("starting dnscrypt server: %w", err)
+	if cert == c.cert {
+		return err
+	}
+
+	conf.DNSCryptResolverCert = c.cert
+	p = &proxy.Proxy{Config: conf}
+	if prevErr := p.Start(); prevErr != nil {
+		log.Error("dns: restoring dnscrypt server: %s", prevErr)
+	} else {
+		c.proxy = p
+	}
+
+	return err
+}
+
+// startDNSCrypt starts the DNSCrypt server and the certificate rotation loop if
+// they're configured.
+func (s *Server) startDNSCrypt() (err error) {
+	c := &s.dnscrypt
+
+	c.lock.Lock()
+	cert := c.cert
+	c.lock.Unlock()
+	if cert == nil {
+		return nil
+	}
+
+	err = c.restart(cert)
+	if err != nil {
+		return err
+	}
+
+	if c.rc == nil || c.done != nil {
+		return nil
+	}
+
+	c.done = make(chan struct{})
+	c.wg.Add(1)
+	go s.dnsCryptLoop(c.done, c.rotationDelay(time.Now()))
+
+	return nil
+}
+
+// stopDNSCrypt stops the certificate rotation loop, waits for it to exit, and
+// stops the DNSCrypt server.
+func (s *Server) stopDNSCrypt() (err error) {
+	c := &s.dnscrypt
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
+		c.wg.Wait()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.proxy == nil {
+		return nil
+	}
+
+	err = c.proxy.Stop()
+	c.proxy = nil
+	if err != nil {
+		return fmt.Errorf("stopping dnscrypt server: %w", err)
+	}
+
+	return nil
+}
+
+// dnsCryptLoop waits for delay and replaces the certificate of the running
+// server with a new one until done is closed.
+func (s *Server) dnsCryptLoop(done chan struct{}, delay time.Duration) {
+	defer s.dnscrypt.wg.Done()
+
+	for {
+		t := time.NewTimer(delay)
+		select {
+		case <-done:
+			t.Stop()
+
+			return
+		case <-t.C:
+			// Go on.
+		}
+
+		delay = dnsCryptRotationRetry
+		if s.rotateDNSCryptCert() {
+			delay = s.dnscrypt.rotationDelay(time.Now())
+		}
+	}
+}
+
+// rotateDNSCryptCert creates a new DNSCrypt certificate and restarts the
+// DNSCrypt server with it.  It returns false if the rotation should be retried
+// later.
+//
+// Only the DNSCrypt proxy is restarted, so the main listeners and the cache are
+// kept.  The new certificate is created from the same resolver configuration,
+// so it has the same resolver key pair and client magic as the previous one,
+// and the clients which still use the previous certificate keep working until
+// it expires.  Since the certificate is replaced when only half of its validity
+// period has passed, the clients have the other half to fetch the new one.
+//
+// It doesn't lock s, since stopDNSCrypt waits for the loop with s locked.  The
+// rotation state is only changed by init, which is only called when the loop
+// isn't running.
+func (s *Server) rotateDNSCryptCert() (ok bool) {
+	c := &s.dnscrypt
+	cert, err := c.rc.CreateCert()
+	if err != nil {
+		log.Error("dns: creating dnscrypt cert: %s", err)
+
+		return false
+	}
+
+	err = c.restart(cert)
+	if err != nil {
+		log.Error("dns: rotating dnscrypt cert: %s", err)
+
+		return false
+	}
+
+	c.setValidity(cert)
+
+	log.Info("dns: rotated dnscrypt cert, valid until %s", c.notAfter)
+
+	return true
+}
@@ -0,0 +1,256 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDNSCryptHandler answers all queries with a single A record.
+type testDNSCryptHandler struct{}
+
+// ServeDNS implements the dnscrypt.Handler interface for testDNSCryptHandler.
+func (testDNSCryptHandler) ServeDNS(rw dnscrypt.ResponseWriter, r *dns.Msg) error {
+	resp := &dns.Msg{}
+	resp.SetReply(r)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   r.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		A: net.IP{1, 2, 3, 4},
+	}}
+
+	return rw.WriteMsg(resp)
+}
+
+// newTestResolverConfig returns a new DNSCrypt resolver configuration and a
+// certificate created from it.
+func newTestResolverConfig(t *testing.T) (rc *dnscrypt.ResolverConfig, cert *dnscrypt.Cert) {
+	t.Helper()
+
+	conf, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	assert.Nil(t, err)
+
+	cert, err = conf.CreateCert()
+	assert.Nil(t, err)
+
+	return &conf, cert
+}
+
+func TestServer_DNSCryptUpstream(t *testing.T) {
+	rc, cert := newTestResolverConfig(t)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	assert.Nil(t, err)
+
+	stub := &dnscrypt.Server{
+		ProviderName: rc.ProviderName,
+		ResolverCert: cert,
+		Handler:      testDNSCryptHandler{},
+	}
+	go func() {
+		_ = stub.ServeUDP(conn)
+	}()
+	defer conn.Close()
+
+	stamp, err := rc.CreateStamp(conn.LocalAddr().String())
+	assert.Nil(t, err)
+
+	s := createTestServer(t)
+	s.conf.UpstreamDNS = []string{stamp.String()}
+	err = s.Prepare(nil)
+	assert.Nil(t, err)
+
+	err = s.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, s.Stop())
+	}()
+
+	req := createTestMessage("dnscrypt.example.org.")
+	resp, err := dns.Exchange(req, s.dnsProxy.Addr(proxy.ProtoUDP).String())
+	assert.Nil(t, err)
+	if assert.Len(t, resp.Answer, 1) {
+		a, ok := resp.Answer[0].(*dns.A)
+		if assert.True(t, ok) {
+			assert.Equal(t, net.IP{1, 2, 3, 4}, a.A.To4())
+		}
+	}
+}
+
+// startDNSCryptServer starts a DNS server with a DNSCrypt listener using cert,
+// which is rotated using rc.  It returns the server, a DNSCrypt client, and the
+// stamp of the listener.
+func startDNSCryptServer(
+	t *testing.T,
+	rc *dnscrypt.ResolverConfig,
+	cert *dnscrypt.Cert,
+) (s *Server, client *dnscrypt.Client, stamp string) {
+	t.Helper()
+
+	s = createTestServer(t)
+	s.conf.DNSCryptConfig = DNSCryptConfig{
+		UDPListenAddr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		TCPListenAddr: &net.TCPAddr{IP: net.IP{127, 0, 0, 1}},
+		ProviderName:  rc.ProviderName,
+		ResolverCert:  cert,
+		Enabled:       true,
+
+		ResolverConfig: rc,
+	}
+	s.upstreams = []upstream.Upstream{&recordUpstream{}}
+	err := s.Prepare(nil)
+	assert.Nil(t, err)
+
+	err = s.Start()
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		assert.Nil(t, s.Stop())
+	})
+
+	// The DNSCrypt server listens on the random port, which is kept after
+	// the rotations.
+	s.dnscrypt.lock.Lock()
+	addr := s.dnscrypt.proxy.Addr(proxy.ProtoDNSCrypt).(*net.UDPAddr)
+	s.dnscrypt.lock.Unlock()
+	s.dnscrypt.conf.DNSCryptUDPListenAddr = []*net.UDPAddr{addr}
+	s.dnscrypt.conf.DNSCryptTCPListenAddr = []*net.TCPAddr{{IP: addr.IP, Port: addr.Port}}
+
+	st, err := rc.CreateStamp(addr.String())
+	assert.Nil(t, err)
+
+	client = &dnscrypt.Client{
+		Net:     "udp",
+		Timeout: time.Second,
+	}
+
+	return s, client, st.String()
+}
+
+// dnsCryptExchange checks the response to a query sent to the DNSCrypt server
+// described by ri.
+func dnsCryptExchange(t *testing.T, client *dnscrypt.Client, ri *dnscrypt.ResolverInfo) {
+	t.Helper()
+
+	req := createTestMessage("dnscrypt.example.org.")
+	resp, err := client.Exchange(req, ri)
+	assert.Nil(t, err)
+	if assert.NotNil(t, resp) && assert.Len(t, resp.Answer, 1) {
+		a, ok := resp.Answer[0].(*dns.A)
+		if assert.True(t, ok) {
+			assert.Equal(t, net.IP{1, 2, 3, 4}, a.A.To4())
+		}
+	}
+}
+
+func TestServer_DNSCryptServer(t *testing.T) {
+	rc, cert := newTestResolverConfig(t)
+	s, client, stamp := startDNSCryptServer(t, rc, cert)
+
+	assert.NotNil(t, s.dnscrypt.done)
+
+	ri, err := client.Dial(stamp)
+	assert.Nil(t, err)
+
+	dnsCryptExchange(t, client, ri)
+
+	// Rotate the certificate without restarting the main proxy.
+	p := s.dnsProxy
+	addr := p.Addr(proxy.ProtoUDP).String()
+
+	assert.True(t, s.rotateDNSCryptCert())
+	assert.Same(t, p, s.dnsProxy)
+	assert.Equal(t, addr, s.dnsProxy.Addr(proxy.ProtoUDP).String())
+	assert.Equal(t, int64(s.dnscrypt.cert.NotAfter), s.dnscrypt.notAfter.Unix())
+
+	// The clients which still use the previous certificate keep working.
+	dnsCryptExchange(t, client, ri)
+
+	newRI, err := client.Dial(stamp)
+	assert.Nil(t, err)
+	assert.Equal(t, s.dnscrypt.cert.Serial, newRI.ResolverCert.Serial)
+
+	dnsCryptExchange(t, client, newRI)
+}
+
+func TestServer_rotateDNSCryptCert_race(t *testing.T) {
+	rc, cert := newTestResolverConfig(t)
+	s, client, stamp := startDNSCryptServer(t, rc, cert)
+
+	ri, err := client.Dial(stamp)
+	assert.Nil(t, err)
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+
+		qclient := &dnscrypt.Client{
+			Net:     "udp",
+			Timeout: 100 * time.Millisecond,
+		}
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				// The queries sent while the DNSCrypt server is
+				// restarted may fail, only the data races matter.
+				_, _ = qclient.Exchange(createTestMessage("dnscrypt.example.org."), ri)
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, s.rotateDNSCryptCert())
+	}
+
+	close(stop)
+	<-done
+
+	dnsCryptExchange(t, client, ri)
+}
+
+func TestDNSCryptCtx_rotationDelay(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := &dnsCryptCtx{
+		notBefore: now,
+		notAfter:  now.Add(24 * time.Hour),
+	}
+
+	assert.Equal(t, 12*time.Hour, c.rotationDelay(now))
+	assert.Equal(t, 2*time.Hour, c.rotationDelay(now.Add(10*time.Hour)))
+	assert.Equal(t, minDNSCryptRotationDelay, c.rotationDelay(now.Add(12*time.Hour)))
+	assert.Equal(t, minDNSCryptRotationDelay, c.rotationDelay(now.Add(48*time.Hour)))
+}
+
+func TestDNSCryptCtx_init(t *testing.T) {
+	rc, cert := newTestResolverConfig(t)
+
+	c := &dnsCryptCtx{}
+	c.init(DNSCryptConfig{
+		ResolverCert:   cert,
+		ResolverConfig: rc,
+	}, proxy.Config{})
+	assert.Nil(t, c.rc)
+	assert.Nil(t, c.cert)
+
+	c.init(DNSCryptConfig{
+		ResolverCert:   cert,
+		Enabled:        true,
+		ResolverConfig: rc,
+	}, proxy.Config{RefuseAny: true})
+	assert.Equal(t, rc, c.rc)
+	assert.Same(t, cert, c.cert)
+	assert.True(t, c.conf.RefuseAny)
+	assert.Nil(t, c.conf.DNSCryptResolverCert)
+	assert.Equal(t, int64(cert.NotAfter), c.notAfter.Unix())
+}
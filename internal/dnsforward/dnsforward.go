@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
 	"github.com/AdguardTeam/AdGuardHome/internal/stats"
 	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
@@ -29,7 +31,10 @@ const (
 var defaultDNS = []string{
 	"https://dns10.quad9.net/dns-query",
 }
-var defaultBootstrap = []string{"9.9.9.10", "149.112.112.10", "2620:fe::10", "2620:fe::fe:10"}
+
+// DefaultBootstrap are the plain DNS servers used to resolve the hostnames of
+// the upstream servers when none are configured.
+var DefaultBootstrap = []string{"9.9.9.10", "149.112.112.10", "2620:fe::10", "2620:fe::fe:10"}
 
 // Often requested by all kinds of DNS probes
 var defaultBlockedHosts = []string{"version.bind", "id.server", "hostname.bind"}
@@ -54,8 +59,62 @@ type Server struct {
 	stats      stats.Stats
 	access     *accessCtx
 
+	// stale is the cache of expired responses.  It is nil if serving
+	// stale responses is disabled.
+	stale *staleCache
+
+	// evicted are the names evicted from the cache of dnsproxy.  It is
+	// recreated along with the cache.
+	evicted *evictedNames
+
+	// ratelimit delays the queries exceeding the rate limit.  It is nil
+	// unless the rate limit is in the "delay" mode, since otherwise the
+	// proxy drops such queries itself.
+	ratelimit *rateLimiter
+
 	ipset ipsetCtx
 
+	// iface selects the upstreams depending on the inbound network
+	// interface.
+	iface ifaceCtx
+
+	// via allows the trusted clients to force the upstreams for single
+	// queries.
+	via viaCtx
+
+	// pools selects the upstream pool depending on the health of the
+	// pools.
+	pools poolsCtx
+
+	// upstreamQTypes excludes the upstreams which don't accept the query
+	// types of the requests.
+	upstreamQTypes upstreamQTypesCtx
+
+	// services answers the queries for the locally configured SRV and
+	// NAPTR records.
+	services servicesCtx
+
+	// secondary answers the queries for the zones transferred from the
+	// primary servers.
+	secondary secondaryCtx
+
+	// specialUse answers the queries for the special-use domain names.
+	specialUse specialUseCtx
+
+	// dnscrypt runs the DNSCrypt server and rotates its certificate.
+	dnscrypt dnsCryptCtx
+
+	// upstreams, if not empty, replace the configured upstream servers.
+	upstreams []upstream.Upstream
+
+	// inflight tracks the queries being processed for draining them on
+	// shutdown.
+	inflight drainCtx
+
+	// answerRotations are the rotation offsets of the RRsets rotated with
+	// the round_robin answer order.
+	answerRotations answerRotations
+
 	tableHostToIP     map[string]net.IP // "hostname -> IP" table for internal addresses (DHCP)
 	tableHostToIPLock sync.Mutex
 
@@ -78,6 +137,11 @@ type DNSCreateParams struct {
 	Stats      stats.Stats
 	QueryLog   querylog.QueryLog
 	DHCPServer dhcpd.ServerInterface
+
+	// Upstreams, if not empty, replace the upstream servers from the
+	// configuration, including the default ones.  It's mostly useful for
+	// testing the whole request path without the network.
+	Upstreams []upstream.Upstream
 }
 
 // NewServer creates a new instance of the dnsforward.Server
@@ -87,6 +151,7 @@ func NewServer(p DNSCreateParams) *Server {
 	s.dnsFilter = p.DNSFilter
 	s.stats = p.Stats
 	s.queryLog = p.QueryLog
+	s.upstreams = p.Upstreams
 
 	if p.DHCPServer != nil {
 		s.dhcpServer = p.DHCPServer
@@ -96,7 +161,7 @@ func NewServer(p DNSCreateParams) *Server {
 
 	if runtime.GOARCH == "mips" || runtime.GOARCH == "mipsle" {
 		// Use plain DNS on MIPS, encryption is too slow
-		defaultDNS = defaultBootstrap
+		defaultDNS = DefaultBootstrap
 	}
 	return s
 }
@@ -108,6 +173,7 @@ func (s *Server) Close() {
 	s.stats = nil
 	s.queryLog = nil
 	s.dnsProxy = nil
+	s.upstreamQTypes.close()
 	s.Unlock()
 }
 
@@ -164,9 +230,14 @@ func (s *Server) Start() error {
 
 // startInternal starts without locking
 func (s *Server) startInternal() error {
+	s.inflight.reset()
 	err := s.dnsProxy.Start()
 	if err == nil {
 		s.isRunning = true
+		s.iface.start()
+		s.pools.start()
+		s.secondary.start()
+		err = s.startDNSCrypt()
 	}
 	return err
 }
@@ -182,6 +253,64 @@ func (s *Server) Prepare(config *ServerConfig) error {
 				return fmt.Errorf("dns: invalid custom blocking IP address specified")
 			}
 		}
+
+		switch s.conf.DisabledMode {
+		case "", disabledModeRefuse, disabledModeTransparentForward:
+			// Go on.
+		default:
+			return fmt.Errorf("dns: invalid disabled mode %q", s.conf.DisabledMode)
+		}
+
+		switch s.conf.AnswerOrder {
+		case "", answerOrderUpstream, answerOrderRoundRobin, answerOrderRandom:
+			// Go on.
+		default:
+			return fmt.Errorf("dns: invalid answer order %q", s.conf.AnswerOrder)
+		}
+
+		switch s.conf.RatelimitMode {
+		case "", rateLimitModeDrop, rateLimitModeDelay:
+			// Go on.
+		default:
+			return fmt.Errorf("dns: invalid ratelimit mode %q", s.conf.RatelimitMode)
+		}
+
+		switch s.conf.NonRDMode {
+		case "", nonRDModeForward, nonRDModeRefuse, nonRDModeCacheOnly:
+			// Go on.
+		default:
+			return fmt.Errorf("dns: invalid non-rd mode %q", s.conf.NonRDMode)
+		}
+
+		switch s.conf.ECSPolicy {
+		case "", ecsPolicyHonor, ecsPolicyOverride, ecsPolicyStrip:
+			// Go on.
+		default:
+			return fmt.Errorf("dns: invalid edns client subnet policy %q", s.conf.ECSPolicy)
+		}
+
+		switch s.conf.RestrictedQTypeRcode {
+		case "", restrictedQTypeRcodeRefused, restrictedQTypeRcodeNotImp:
+			// Go on.
+		default:
+			return fmt.Errorf("dns: invalid restricted qtype rcode %q", s.conf.RestrictedQTypeRcode)
+		}
+
+		if d := s.conf.LocalDomainName; d != "" {
+			if _, ok := dns.IsDomainName(d); !ok || strings.Trim(d, ".") != d {
+				return fmt.Errorf("dns: invalid local domain name %q", d)
+			}
+		}
+
+		err := validateQminUpstreams(s.conf.QNAMEMinimizationUpstreams)
+		if err != nil {
+			return fmt.Errorf("dns: %w", err)
+		}
+
+		err = s.conf.DefaultPolicy.validate()
+		if err != nil {
+			return fmt.Errorf("dns: %w", err)
+		}
 	}
 
 	// Set default values in the case if nothing is configured
@@ -192,9 +321,86 @@ func (s *Server) Prepare(config *ServerConfig) error {
 	// --
 	s.ipset.init(s.conf.IPSETList)
 
+	// Initialize per-interface upstreams
+	// --
+	err := s.iface.init(s.conf.InterfaceUpstreams, s.conf.InterfaceFiltering, s.conf.BootstrapDNS)
+	if err != nil {
+		return err
+	}
+
+	// Initialize per-query upstreams
+	// --
+	err = s.via.init(s.conf.ViaUpstreams, s.conf.ViaTrustedClients, s.conf.BootstrapDNS)
+	if err != nil {
+		return err
+	}
+
+	// Initialize upstream pools
+	// --
+	err = s.pools.init(
+		s.conf.UpstreamPools,
+		s.conf.BootstrapDNS,
+		s.conf.UpstreamPoolsCheckInterval,
+		s.conf.UpstreamPoolsRecoverySeconds,
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, uc := range s.pools.configs() {
+		s.nonRDUpstreamConfig(uc)
+	}
+
+	// Initialize query type restrictions of upstreams
+	// --
+	err = s.upstreamQTypes.init(s.conf.UpstreamQTypes, s.conf.UpstreamQTypesFallbackDNS, s.conf.BootstrapDNS)
+	if err != nil {
+		return err
+	}
+
+	// Initialize local services
+	// --
+	err = s.services.init(s.conf.LocalServices)
+	if err != nil {
+		return err
+	}
+
+	// Initialize secondary zones
+	// --
+	err = s.secondary.init(s.conf.SecondaryZones)
+	if err != nil {
+		return err
+	}
+
+	// Initialize the cache of stale responses
+	// --
+	s.stale = nil
+	if s.conf.MaxStaleSeconds > 0 {
+		s.stale = newStaleCache(s.conf.MaxStaleSeconds)
+	}
+
+	// Initialize the names evicted from the cache, which is recreated
+	// along with the proxy
+	// --
+	s.evicted = newEvictedNames(s.conf.CacheMinTTL, s.conf.CacheMaxTTL)
+
+	// Initialize the rate limiter of the delayed queries
+	// --
+	s.ratelimit = nil
+	if s.conf.Ratelimit > 0 && s.conf.RatelimitMode == rateLimitModeDelay {
+		s.ratelimit = newRateLimiter(s.conf.Ratelimit, s.conf.RatelimitMaxDelay, s.conf.RatelimitWhitelist)
+	}
+
 	// Prepare DNS servers settings
 	// --
-	err := s.prepareUpstreamSettings()
+	err = s.prepareUpstreamSettings()
+	if err != nil {
+		return err
+	}
+
+	// Initialize special-use domain names
+	// --
+	err = s.specialUse.init(s.conf.SpecialUseDomains, s.conf.UpstreamConfig.DomainReservedUpstreams)
 	if err != nil {
 		return err
 	}
@@ -207,6 +413,18 @@ func (s *Server) Prepare(config *ServerConfig) error {
 		return err
 	}
 
+	// Restart the server when the addresses of the network interfaces
+	// change, if it listens on each of them
+	// --
+	s.iface.onListenChange = nil
+	if len(proxyConfig.UDPListenAddr) > 1 {
+		s.iface.onListenChange = s.restartOnListenChange
+	}
+
+	// Initialize the DNSCrypt server and its certificate rotation
+	// --
+	s.dnscrypt.init(s.conf.DNSCryptConfig, proxyConfig)
+
 	// Prepare a DNS proxy instance that we use for internal DNS queries
 	// --
 	s.prepareIntlProxy()
@@ -229,20 +447,61 @@ func (s *Server) Prepare(config *ServerConfig) error {
 	// Create the main DNS proxy instance
 	// --
 	s.dnsProxy = &proxy.Proxy{Config: proxyConfig}
+	s.setProxyUpstreams(s.dnsProxy)
+
 	return nil
 }
 
-// Stop stops the DNS server
+// Stop stops the DNS server.  Before stopping, it stops receiving new queries
+// and waits for the ones being processed to complete, see drain.
 func (s *Server) Stop() error {
+	err := s.drain()
+	if err != nil {
+		return fmt.Errorf("could not stop the DNS server properly: %w", err)
+	}
+
 	s.Lock()
 	defer s.Unlock()
 	return s.stopInternal()
 }
 
-// stopInternal stops without locking
+// drain makes the DNS server refuse new queries and waits for the queries being
+// processed to complete, but no longer than ShutdownGraceSeconds.  The
+// listeners are kept open in the meantime, so that the responses to the queries
+// being processed, including the ones received over UDP, are still sent.  The
+// caller must stop the listeners afterwards.
+//
+// s must not be locked, since the queries being processed need the lock.
+func (s *Server) drain() (err error) {
+	s.RLock()
+	running := s.isRunning
+	grace := time.Duration(s.conf.ShutdownGraceSeconds) * time.Second
+	s.RUnlock()
+	if !running {
+		return nil
+	}
+
+	if !s.inflight.drain(grace) {
+		log.Info("dns: shutdown grace period of %s exceeded, stopping anyway", grace)
+	}
+
+	return nil
+}
+
+// stopInternal stops without locking.  It doesn't wait for the queries being
+// processed, see drain.
 func (s *Server) stopInternal() error {
-	if s.dnsProxy != nil {
-		err := s.dnsProxy.Stop()
+	s.iface.stop()
+	s.pools.stop()
+	s.secondary.stop()
+
+	err := s.stopDNSCrypt()
+	if err != nil {
+		return fmt.Errorf("could not stop the DNS server properly: %w", err)
+	}
+
+	if s.dnsProxy != nil && s.isRunning {
+		err = s.dnsProxy.Stop()
 		if err != nil {
 			return fmt.Errorf("could not stop the DNS server properly: %w", err)
 		}
@@ -259,11 +518,22 @@ func (s *Server) IsRunning() bool {
 	return s.isRunning
 }
 
-// Reconfigure applies the new configuration to the DNS server
+// Reconfigure applies the new configuration to the DNS server.  Before
+// restarting, it waits for the queries being processed to complete, see drain.
 func (s *Server) Reconfigure(config *ServerConfig) error {
+	err := s.drain()
+	if err != nil {
+		return fmt.Errorf("could not reconfigure the server: %w", err)
+	}
+
 	s.Lock()
 	defer s.Unlock()
 
+	return s.reconfigureInternal(config)
+}
+
+// reconfigureInternal applies the new configuration without locking.
+func (s *Server) reconfigureInternal(config *ServerConfig) error {
 	log.Print("Start reconfiguring the server")
 	err := s.stopInternal()
 	if err != nil {
@@ -297,6 +567,41 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ClearCache removes the responses for name of type qtype from the DNS caches.
+// If name is empty, all responses are removed.  If qtype is 0, the responses
+// of all types for name are removed.
+//
+// The cache of dnsproxy can't remove entries, so the queries for the removed
+// responses bypass it until these responses expire.
+func (s *Server) ClearCache(name string, qtype uint16) (err error) {
+	s.RLock()
+	stale := s.stale
+	evicted := s.evicted
+	proxyCache := s.conf.CacheSize != 0
+	s.RUnlock()
+
+	if stale != nil {
+		if name == "" {
+			stale.clear()
+		} else {
+			stale.remove(name, qtype)
+		}
+	}
+
+	if !proxyCache || evicted == nil {
+		return nil
+	}
+
+	if name == "" {
+		log.Debug("dns: clearing cache")
+		evicted.clear()
+	} else {
+		evicted.add(name, qtype)
+	}
+
+	return nil
+}
+
 // IsBlockedIP - return TRUE if this client should be blocked
 func (s *Server) IsBlockedIP(ip net.IP) (bool, string) {
 	return s.access.IsBlockedIP(ip)
@@ -13,8 +13,10 @@ import (
 	"math/big"
 	"net"
 	"os"
+	"path/filepath"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -23,6 +25,7 @@ import (
 
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
@@ -326,6 +329,109 @@ func TestServerCustomClientUpstream(t *testing.T) {
 	assert.Nil(t, s.Stop())
 }
 
+func TestServer_defaultPolicy(t *testing.T) {
+	s := createTestServer(t)
+
+	// The queries from the persistent clients don't use the default
+	// policy.
+	var persistent bool
+	s.conf.FilterHandler = func(_ net.IP, _ string, setts *dnsfilter.RequestFilteringSettings) {
+		if persistent {
+			setts.ClientName = "persistent"
+		}
+	}
+
+	assert.Nil(t, s.startWithUpstream(&testUpstream{
+		ipv4: map[string][]net.IP{
+			"null.example.org.": {{1, 2, 3, 4}},
+		},
+	}))
+	t.Cleanup(func() { _ = s.Stop() })
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	setPolicy := func(p DefaultPolicy, isPersistent bool) {
+		s.Lock()
+		defer s.Unlock()
+
+		s.conf.DefaultPolicy = p
+		persistent = isPersistent
+	}
+
+	exchange := func(t *testing.T) (reply *dns.Msg) {
+		t.Helper()
+
+		reply, err := dns.Exchange(createTestMessage("null.example.org."), addr)
+		assert.Nil(t, err)
+		assert.NotNil(t, reply)
+
+		return reply
+	}
+
+	assertA := func(t *testing.T, reply *dns.Msg, want net.IP) {
+		t.Helper()
+
+		if assert.Len(t, reply.Answer, 1) {
+			a, ok := reply.Answer[0].(*dns.A)
+			assert.True(t, ok)
+			assert.True(t, want.Equal(a.A))
+		}
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		setPolicy(DefaultPolicy{}, false)
+
+		reply := exchange(t)
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		assertA(t, reply, net.IPv4zero)
+	})
+
+	t.Run("blocking_mode", func(t *testing.T) {
+		setPolicy(DefaultPolicy{BlockingMode: "nxdomain"}, false)
+
+		reply := exchange(t)
+		assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+		assert.Empty(t, reply.Answer)
+	})
+
+	t.Run("filtering_disabled", func(t *testing.T) {
+		disabled := false
+		setPolicy(DefaultPolicy{FilteringEnabled: &disabled}, false)
+
+		reply := exchange(t)
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		assertA(t, reply, net.IP{1, 2, 3, 4})
+	})
+
+	t.Run("persistent_client", func(t *testing.T) {
+		disabled := false
+		setPolicy(DefaultPolicy{
+			FilteringEnabled: &disabled,
+			BlockingMode:     "nxdomain",
+		}, true)
+
+		reply := exchange(t)
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		assertA(t, reply, net.IPv4zero)
+	})
+}
+
+func TestServer_Prepare_defaultPolicyUpstreams(t *testing.T) {
+	s := createTestServer(t)
+
+	conf := s.conf
+	conf.UpstreamDNS = []string{"8.8.8.8:53"}
+	conf.DefaultPolicy.Upstreams = []string{"1.1.1.1:53"}
+	assert.Nil(t, s.Prepare(&conf))
+
+	if assert.Len(t, s.conf.UpstreamConfig.Upstreams, 1) {
+		assert.Equal(t, "1.1.1.1:53", s.conf.UpstreamConfig.Upstreams[0].Address())
+	}
+
+	conf.DefaultPolicy.BlockingMode = "custom_ip"
+	assert.NotNil(t, s.Prepare(&conf))
+}
+
 // testUpstream is a mock of real upstream.
 // specify fields with necessary values to simulate real upstream behaviour
 type testUpstream struct {
@@ -470,6 +576,46 @@ func TestBlockCNAME(t *testing.T) {
 	_ = s.Stop()
 }
 
+func TestBlockCNAME_onResult(t *testing.T) {
+	var mu sync.Mutex
+	var blocked []string
+	f := dnsfilter.New(&dnsfilter.Config{
+		OnResult: func(host string, _ uint16, res dnsfilter.Result, _ string) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if res.IsFiltered {
+				blocked = append(blocked, host)
+			}
+		},
+	}, []dnsfilter.Filter{{
+		ID: 0, Data: []byte("||null.example.org^\n||127.0.0.255\n"),
+	}})
+
+	s := NewServer(DNSCreateParams{DNSFilter: f})
+	s.conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	s.conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	s.conf.UpstreamDNS = []string{"8.8.8.8:53"}
+	s.conf.FilteringConfig.ProtectionEnabled = true
+	s.conf.ConfigModified = func() {}
+	assert.Nil(t, s.Prepare(nil))
+
+	err := s.startWithUpstream(&testUpstream{testCNAMEs, testIPv4, nil})
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = s.Stop() })
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+	for _, host := range []string{"badhost.", "example.org."} {
+		_, err = dns.Exchange(createTestMessage(host), addr.String())
+		assert.Nil(t, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, []string{"null.example.org", "127.0.0.255"}, blocked)
+}
+
 func TestClientRulesForCNAMEMatching(t *testing.T) {
 	s := createTestServer(t)
 	testUpstm := &testUpstream{testCNAMEs, testIPv4, nil}
@@ -691,6 +837,10 @@ func TestRewrite(t *testing.T) {
 			Answer: "example.org",
 			Type:   dns.TypeCNAME,
 		},
+		{
+			Domain: "multi.test.com",
+			Answer: "1.2.3.4, 1.2.3.5",
+		},
 	}
 
 	f := dnsfilter.New(&c, nil)
@@ -735,9 +885,131 @@ func TestRewrite(t *testing.T) {
 	assert.Equal(t, "example.org.", reply.Answer[0].(*dns.CNAME).Target)
 	assert.Equal(t, dns.TypeA, reply.Answer[1].Header().Rrtype)
 
+	req = createTestMessageWithType("multi.test.com.", dns.TypeA)
+	reply, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	if assert.Len(t, reply.Answer, 2) {
+		assert.True(t, net.IP{1, 2, 3, 4}.Equal(reply.Answer[0].(*dns.A).A))
+		assert.True(t, net.IP{1, 2, 3, 5}.Equal(reply.Answer[1].(*dns.A).A))
+	}
+
+	req = createTestMessageWithType("multi.test.com.", dns.TypeAAAA)
+	reply, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Empty(t, reply.Answer)
+
 	_ = s.Stop()
 }
 
+// cnameChainUpstream answers all queries with a chain of CNAME records
+// through names ending with an A record.
+type cnameChainUpstream struct {
+	names []string
+}
+
+// Exchange implements the upstream.Upstream interface for
+// *cnameChainUpstream.
+func (u *cnameChainUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+
+	name := m.Question[0].Name
+	for _, target := range u.names {
+		resp.Answer = append(resp.Answer, &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeCNAME,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			Target: target,
+		})
+		name = target
+	}
+
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		A: net.IP{1, 2, 3, 4},
+	})
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for
+// *cnameChainUpstream.
+func (u *cnameChainUpstream) Address() string {
+	return "cname-chain"
+}
+
+func TestMaxResolutionDepth(t *testing.T) {
+	ups := &cnameChainUpstream{
+		names: []string{"one.example.", "two.example."},
+	}
+
+	startServer := func(t *testing.T, depth uint32) (addr string) {
+		c := dnsfilter.Config{
+			MaxResolutionDepth: depth,
+			Rewrites: []dnsfilter.RewriteEntry{{
+				Domain: "alias.example",
+				Answer: "chain.example",
+			}},
+		}
+
+		s := NewServer(DNSCreateParams{DNSFilter: dnsfilter.New(&c, nil)})
+		s.conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+		s.conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+		s.conf.ProtectionEnabled = true
+
+		err := s.startWithUpstream(ups)
+		assert.Nil(t, err)
+		t.Cleanup(func() { _ = s.Stop() })
+
+		return s.dnsProxy.Addr(proxy.ProtoUDP).String()
+	}
+
+	// The rewrite adds one hop and the upstream answer adds two more.
+	testCases := []struct {
+		name     string
+		depth    uint32
+		wantCode int
+	}{{
+		name:     "unlimited",
+		depth:    0,
+		wantCode: dns.RcodeSuccess,
+	}, {
+		name:     "at_limit",
+		depth:    3,
+		wantCode: dns.RcodeSuccess,
+	}, {
+		name:     "past_limit",
+		depth:    2,
+		wantCode: dns.RcodeServerFailure,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := startServer(t, tc.depth)
+
+			req := createTestMessageWithType("alias.example.", dns.TypeA)
+			reply, err := dns.Exchange(req, addr)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.wantCode, reply.Rcode)
+			assert.Equal(t, "alias.example.", reply.Question[0].Name)
+			if tc.wantCode == dns.RcodeSuccess {
+				assert.Len(t, reply.Answer, 4)
+			} else {
+				assert.Empty(t, reply.Answer)
+			}
+		})
+	}
+}
+
 func createTestServer(t *testing.T) *Server {
 	rules := `||nxdomain.example.org
 ||null.example.org^
@@ -1073,6 +1345,76 @@ func TestPTRResponseFromDHCPLeases(t *testing.T) {
 	s.Close()
 }
 
+// testDHCPLeases is a DHCP server mock with the configurable leases.
+type testDHCPLeases struct {
+	leases []dhcpd.Lease
+}
+
+func (d *testDHCPLeases) Leases(_ int) []dhcpd.Lease {
+	return d.leases
+}
+
+func (d *testDHCPLeases) SetOnLeaseChanged(_ dhcpd.OnLeaseChangedT) {}
+
+func TestPTRResponseFromDHCPv6Leases(t *testing.T) {
+	leased := net.ParseIP("fd00::1:2")
+	dhcp := &testDHCPLeases{
+		leases: []dhcpd.Lease{{
+			IP:       net.IP{192, 168, 0, 2},
+			Hostname: "host6",
+		}, {
+			IP:       leased,
+			Hostname: "host6",
+		}},
+	}
+
+	ups := &recordUpstream{}
+	s := NewServer(DNSCreateParams{
+		DNSFilter:  dnsfilter.New(&dnsfilter.Config{}, nil),
+		DHCPServer: dhcp,
+	})
+	s.conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	s.conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	s.conf.UpstreamDNS = []string{"127.0.0.1:53"}
+	assert.Nil(t, s.startWithUpstream(ups))
+	t.Cleanup(func() { _ = s.Stop() })
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	arpa, err := dns.ReverseAddr(leased.String())
+	assert.Nil(t, err)
+	assert.Equal(t, "2.0.0.0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", arpa)
+
+	resp, err := dns.Exchange(createTestMessageWithType(arpa, dns.TypePTR), addr)
+	assert.Nil(t, err)
+	if assert.Len(t, resp.Answer, 1) {
+		ptr, ok := resp.Answer[0].(*dns.PTR)
+		if assert.True(t, ok) {
+			assert.Equal(t, arpa, ptr.Hdr.Name)
+			assert.Equal(t, "host6.", ptr.Ptr)
+		}
+	}
+	assert.Empty(t, ups.received())
+
+	// The DHCPv6 lease doesn't shadow the DHCPv4 one.
+	resp, err = dns.Exchange(createTestMessage("host6.lan."), addr)
+	assert.Nil(t, err)
+	if assert.Len(t, resp.Answer, 1) {
+		a, ok := resp.Answer[0].(*dns.A)
+		if assert.True(t, ok) {
+			assert.Equal(t, net.IP{192, 168, 0, 2}, a.A.To4())
+		}
+	}
+
+	// The queries for the addresses without leases are forwarded.
+	unleased, err := dns.ReverseAddr("fd00::1:3")
+	assert.Nil(t, err)
+
+	_, err = dns.Exchange(createTestMessageWithType(unleased, dns.TypePTR), addr)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{unleased}, ups.received())
+}
+
 func TestPTRResponseFromHosts(t *testing.T) {
 	c := dnsfilter.Config{
 		AutoHosts: &util.AutoHosts{},
@@ -1114,3 +1456,360 @@ func TestPTRResponseFromHosts(t *testing.T) {
 
 	s.Close()
 }
+
+// countUpstream is a testUpstream which counts the exchanges.
+type countUpstream struct {
+	testUpstream
+
+	n uint32
+}
+
+// Exchange implements the upstream.Upstream interface for *countUpstream.
+func (u *countUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddUint32(&u.n, 1)
+
+	resp, err := u.testUpstream.Exchange(m)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make the response cacheable.
+	for _, rr := range resp.Answer {
+		rr.Header().Ttl = 60
+	}
+
+	return resp, nil
+}
+
+func TestServer_ClearCache(t *testing.T) {
+	u := &countUpstream{
+		testUpstream: testUpstream{
+			ipv4: map[string][]net.IP{
+				"example.org.": {{1, 2, 3, 4}},
+				"example.net.": {{1, 2, 3, 5}},
+			},
+		},
+	}
+
+	s := createTestServer(t)
+	s.conf.CacheSize = 4096
+	assert.Nil(t, s.startWithUpstream(u))
+	t.Cleanup(func() { _ = s.Stop() })
+
+	exchange := func(name string) {
+		req := createTestMessage(name)
+		reply, err := dns.Exchange(req, s.dnsProxy.Addr(proxy.ProtoUDP).String())
+		assert.Nil(t, err)
+		assert.Len(t, reply.Answer, 1)
+	}
+
+	exchange("example.org.")
+	exchange("example.org.")
+	exchange("example.net.")
+	assert.Equal(t, uint32(2), atomic.LoadUint32(&u.n))
+
+	// Only the evicted name is looked up again.
+	assert.Nil(t, s.ClearCache("example.org", dns.TypeA))
+
+	exchange("example.org.")
+	exchange("example.net.")
+	assert.Equal(t, uint32(3), atomic.LoadUint32(&u.n))
+
+	// The whole cache is cleared without restarting the server.
+	p := s.dnsProxy
+	assert.Nil(t, s.ClearCache("", 0))
+	assert.Same(t, p, s.dnsProxy)
+
+	exchange("example.net.")
+	exchange("example.org.")
+	assert.Equal(t, uint32(5), atomic.LoadUint32(&u.n))
+}
+
+func TestEvictedNames(t *testing.T) {
+	now := time.Now()
+	e := newEvictedNames(0, 60)
+	e.now = func() time.Time { return now }
+
+	newReq := func(name string, qtype uint16) (req *dns.Msg) {
+		req = &dns.Msg{}
+		req.SetQuestion(name, qtype)
+
+		return req
+	}
+
+	newResp := func(name string, qtype uint16, ttl uint32) (resp *dns.Msg) {
+		resp = &dns.Msg{}
+		resp.SetReply(newReq(name, qtype))
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			A: net.IP{1, 2, 3, 4},
+		}}
+
+		return resp
+	}
+
+	e.store(newResp("example.org.", dns.TypeA, 10))
+	e.store(newResp("example.org.", dns.TypeAAAA, 3600))
+	e.store(newResp("example.net.", dns.TypeA, 30))
+
+	assert.False(t, e.has(newReq("example.org.", dns.TypeA)))
+
+	e.add("Example.ORG", dns.TypeA)
+	e.add("example.net", 0)
+	e.add("example.com", 0)
+
+	assert.True(t, e.has(newReq("example.org.", dns.TypeA)))
+	assert.False(t, e.has(newReq("example.org.", dns.TypeAAAA)))
+	assert.True(t, e.has(newReq("example.net.", dns.TypeA)))
+	assert.False(t, e.has(newReq("sub.example.net.", dns.TypeA)))
+	assert.False(t, e.has(newReq("example.com.", dns.TypeA)))
+
+	// The evicted response for example.org has expired, but the one for
+	// example.net hasn't yet.
+	now = now.Add(11 * time.Second)
+	assert.False(t, e.has(newReq("example.org.", dns.TypeA)))
+	assert.True(t, e.has(newReq("example.net.", dns.TypeA)))
+	_, ok := e.items[evictedKey{name: "example.org.", qtype: dns.TypeA}]
+	assert.False(t, ok)
+
+	// The TTL of the AAAA response is limited by the cache settings.
+	e.clear()
+	assert.True(t, e.has(newReq("example.org.", dns.TypeAAAA)))
+
+	now = now.Add(50 * time.Second)
+	assert.False(t, e.has(newReq("example.org.", dns.TypeAAAA)))
+	assert.False(t, e.has(newReq("example.net.", dns.TypeA)))
+}
+
+func TestServer_upstreamsParam(t *testing.T) {
+	u := &countUpstream{
+		testUpstream: testUpstream{
+			ipv4: map[string][]net.IP{
+				"example.org.":         {{1, 2, 3, 4}},
+				"blocked.example.org.": {{1, 2, 3, 5}},
+			},
+		},
+	}
+
+	f := dnsfilter.New(&dnsfilter.Config{}, []dnsfilter.Filter{{
+		Data: []byte("||blocked.example.org^\n"),
+	}})
+	s := NewServer(DNSCreateParams{
+		DNSFilter: f,
+		Upstreams: []upstream.Upstream{u},
+	})
+
+	conf := ServerConfig{}
+	conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	conf.ProtectionEnabled = true
+	conf.CacheSize = 4096
+	assert.Nil(t, s.Prepare(&conf))
+	assert.Nil(t, s.Start())
+	t.Cleanup(func() { _ = s.Stop() })
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+	for i := 0; i < 2; i++ {
+		reply, err := dns.Exchange(createTestMessage("example.org."), addr)
+		assert.Nil(t, err)
+		if assert.Len(t, reply.Answer, 1) {
+			a, ok := reply.Answer[0].(*dns.A)
+			assert.True(t, ok)
+			assert.True(t, net.IP{1, 2, 3, 4}.Equal(a.A))
+		}
+	}
+
+	// The second response is taken from the cache.
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&u.n))
+
+	reply, err := dns.Exchange(createTestMessage("blocked.example.org."), addr)
+	assert.Nil(t, err)
+	if assert.Len(t, reply.Answer, 1) {
+		a, ok := reply.Answer[0].(*dns.A)
+		assert.True(t, ok)
+		assert.True(t, net.IPv4zero.Equal(a.A))
+	}
+
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&u.n))
+}
+
+// chanQueryLog is a querylog.QueryLog implementation for tests which sends
+// the added entries into a channel.
+type chanQueryLog struct {
+	// QueryLog is embedded here simply to make chanQueryLog a
+	// querylog.QueryLog without actually implementing all methods.
+	querylog.QueryLog
+
+	ch chan querylog.AddParams
+}
+
+// Add implements the querylog.QueryLog interface for *chanQueryLog.
+func (l *chanQueryLog) Add(p querylog.AddParams) {
+	l.ch <- p
+}
+
+func TestServer_monitorOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsforward")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	filePath := filepath.Join(dir, "1.txt")
+	err = ioutil.WriteFile(filePath, []byte("||monitored.example.org^\n"), 0o644)
+	assert.Nil(t, err)
+
+	f := dnsfilter.New(&dnsfilter.Config{}, []dnsfilter.Filter{{
+		ID:          1,
+		FilePath:    filePath,
+		MonitorOnly: true,
+	}})
+	ql := &chanQueryLog{
+		ch: make(chan querylog.AddParams, 1),
+	}
+	s := NewServer(DNSCreateParams{
+		DNSFilter: f,
+		QueryLog:  ql,
+		Upstreams: []upstream.Upstream{&testUpstream{
+			ipv4: map[string][]net.IP{
+				"monitored.example.org.": {{1, 2, 3, 4}},
+			},
+		}},
+	})
+
+	conf := ServerConfig{}
+	conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	conf.ProtectionEnabled = true
+	assert.Nil(t, s.Prepare(&conf))
+	assert.Nil(t, s.Start())
+	t.Cleanup(func() { _ = s.Stop() })
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+	reply, err := dns.Exchange(createTestMessage("monitored.example.org."), addr)
+	assert.Nil(t, err)
+	if assert.Len(t, reply.Answer, 1) {
+		a, ok := reply.Answer[0].(*dns.A)
+		assert.True(t, ok)
+		assert.True(t, net.IP{1, 2, 3, 4}.Equal(a.A))
+	}
+
+	select {
+	case p := <-ql.ch:
+		assert.False(t, p.Result.IsFiltered)
+		if assert.Len(t, p.Result.MonitorRules, 1) {
+			assert.Equal(t, "||monitored.example.org^", p.Result.MonitorRules[0].Text)
+			assert.Equal(t, int64(1), p.Result.MonitorRules[0].FilterListID)
+		}
+	case <-time.After(time.Second):
+		t.Error("no query log entry")
+	}
+}
+
+func TestServer_filterCNAMETarget(t *testing.T) {
+	s := createTestServer(t)
+	ql := &chanQueryLog{
+		ch: make(chan querylog.AddParams, 1),
+	}
+	s.queryLog = ql
+	u := &testUpstream{
+		cn: map[string]string{
+			"badhost.":  "null.example.org.",
+			"goodhost.": "cdn.example.net.",
+		},
+		ipv4: map[string][]net.IP{
+			"badhost.":  {{1, 2, 3, 4}},
+			"goodhost.": {{1, 2, 3, 5}},
+		},
+	}
+	assert.Nil(t, s.startWithUpstream(u))
+	t.Cleanup(func() { _ = s.Stop() })
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	testCases := []struct {
+		name       string
+		host       string
+		wantIP     net.IP
+		wantTarget string
+	}{{
+		name:       "blocked",
+		host:       "badhost.",
+		wantIP:     net.IPv4zero,
+		wantTarget: "null.example.org",
+	}, {
+		name:       "clean",
+		host:       "goodhost.",
+		wantIP:     net.IP{1, 2, 3, 5},
+		wantTarget: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reply, err := dns.Exchange(createTestMessage(tc.host), addr)
+			assert.Nil(t, err)
+
+			var ip net.IP
+			for _, rr := range reply.Answer {
+				if a, ok := rr.(*dns.A); ok {
+					ip = a.A
+				}
+			}
+			assert.True(t, tc.wantIP.Equal(ip))
+
+			select {
+			case p := <-ql.ch:
+				assert.Equal(t, tc.wantTarget, p.Result.CNAMETarget)
+				assert.Equal(t, tc.wantTarget != "", p.Result.IsFiltered)
+			case <-time.After(time.Second):
+				t.Error("no query log entry")
+			}
+		})
+	}
+}
+
+func TestServer_transportRules(t *testing.T) {
+	f := dnsfilter.New(&dnsfilter.Config{}, []dnsfilter.Filter{{
+		Data: []byte("||transport.example.org^$ctag=transport_udp\n"),
+	}})
+	defer f.Close()
+
+	s := NewServer(DNSCreateParams{DNSFilter: f})
+
+	testCases := []struct {
+		name  string
+		proto proxy.Proto
+		want  bool
+	}{{
+		name:  "udp",
+		proto: proxy.ProtoUDP,
+		want:  true,
+	}, {
+		name:  "doh",
+		proto: proxy.ProtoHTTPS,
+		want:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := &dnsContext{
+				srv: s,
+				proxyCtx: &proxy.DNSContext{
+					Proto: tc.proto,
+					Req:   createTestMessage("transport.example.org."),
+					Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 53},
+				},
+			}
+			ctx.setts = s.getClientRequestFilteringSettings(ctx)
+
+			res, err := s.filterDNSRequest(ctx)
+			assert.Nil(t, err)
+			if assert.NotNil(t, res) {
+				assert.Equal(t, tc.want, res.IsFiltered)
+			}
+		})
+	}
+}
@@ -95,6 +95,17 @@ func TestServer_FilterDNSRewrite(t *testing.T) {
 		}
 	})
 
+	t.Run("noerror_other_type", func(t *testing.T) {
+		req := makeQ(dns.TypeAAAA)
+		res := makeRes(dns.RcodeSuccess, dns.TypeA, ip4)
+		d := &proxy.DNSContext{}
+
+		err := srv.filterDNSRewrite(req, res, d)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+		assert.Empty(t, d.Res.Answer)
+	})
+
 	t.Run("noerror_ptr", func(t *testing.T) {
 		req := makeQ(dns.TypePTR)
 		res := makeRes(dns.RcodeSuccess, dns.TypePTR, domain)
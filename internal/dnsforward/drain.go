@@ -0,0 +1,95 @@
+package dnsforward
+
+import (
+	"sync"
+	"time"
+)
+
+// drainCtx tracks the queries being processed so that the server could wait
+// for them to complete on shutdown.  The zero value is ready for use.
+type drainCtx struct {
+	// mu protects all fields below.
+	mu sync.Mutex
+
+	// idle, if not nil, is closed when the last query being processed
+	// completes.
+	idle chan struct{}
+
+	// n is the number of queries being processed.
+	n int
+
+	// draining is true if new queries must be refused.
+	draining bool
+}
+
+// begin registers a new query.  ok is false if the server is draining, in
+// which case the query must be refused and end mustn't be called.
+func (c *drainCtx) begin() (ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.draining {
+		return false
+	}
+
+	c.n++
+
+	return true
+}
+
+// end unregisters a query registered with begin.
+func (c *drainCtx) end() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.n--
+	if c.n == 0 && c.idle != nil {
+		close(c.idle)
+		c.idle = nil
+	}
+}
+
+// drain makes c refuse new queries and waits for the ones being processed to
+// complete, but no longer than timeout.  ok is false if the timeout has been
+// reached.
+func (c *drainCtx) drain(timeout time.Duration) (ok bool) {
+	c.mu.Lock()
+	c.draining = true
+	if c.n == 0 {
+		c.mu.Unlock()
+
+		return true
+	}
+
+	if c.idle == nil {
+		c.idle = make(chan struct{})
+	}
+	idle := c.idle
+	c.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-idle:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// reset makes c accept new queries again.
+func (c *drainCtx) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.draining = false
+}
+
+// isDraining returns true if c refuses new queries.
+func (c *drainCtx) isDraining() (ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.draining
+}
@@ -0,0 +1,192 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockUpstream is a testUpstream which doesn't respond until released.
+type blockUpstream struct {
+	testUpstream
+
+	started chan struct{}
+	release chan struct{}
+}
+
+// Exchange implements the upstream.Upstream interface for *blockUpstream.
+func (u *blockUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	u.started <- struct{}{}
+	<-u.release
+
+	return u.testUpstream.Exchange(m)
+}
+
+// startDrainTestServer starts a server with the shutdown grace period of
+// grace seconds which uses u as the upstream.
+func startDrainTestServer(t *testing.T, u upstream.Upstream, grace uint32) (s *Server) {
+	s = NewServer(DNSCreateParams{
+		DNSFilter: dnsfilter.New(&dnsfilter.Config{}, nil),
+		Upstreams: []upstream.Upstream{u},
+	})
+
+	conf := ServerConfig{}
+	conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	conf.ShutdownGraceSeconds = grace
+	assert.Nil(t, s.Prepare(&conf))
+	assert.Nil(t, s.Start())
+
+	return s
+}
+
+// newDrainTestUpstream returns a new *blockUpstream for the drain tests.
+func newDrainTestUpstream() (u *blockUpstream) {
+	return &blockUpstream{
+		testUpstream: testUpstream{
+			ipv4: map[string][]net.IP{
+				"example.org.": {{1, 2, 3, 4}},
+			},
+		},
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+}
+
+// drainTestResult is the result of the query being processed while the server
+// is drained.
+type drainTestResult struct {
+	reply *dns.Msg
+	err   error
+}
+
+// exchangeInflight sends a query to s over network, which is either "udp" or
+// "tcp", and waits for u to receive it.
+func exchangeInflight(s *Server, u *blockUpstream, network string) (inflight chan drainTestResult) {
+	addr := s.dnsProxy.Addr(network).String()
+	inflight = make(chan drainTestResult, 1)
+	go func() {
+		c := &dns.Client{Net: network, Timeout: 10 * time.Second}
+		reply, _, err := c.Exchange(createTestMessage("example.org."), addr)
+		inflight <- drainTestResult{reply, err}
+	}()
+	<-u.started
+
+	return inflight
+}
+
+// assertDrained checks that the server is drained while the query being
+// processed blocks in u, and then that done receives a nil error after the
+// query has been answered.
+func assertDrained(
+	t *testing.T,
+	s *Server,
+	network string,
+	u *blockUpstream,
+	inflight chan drainTestResult,
+	done chan error,
+) {
+	t.Helper()
+
+	assert.Eventually(t, s.inflight.isDraining, time.Second, 10*time.Millisecond)
+
+	// The new queries are refused while draining.
+	addr := s.dnsProxy.Addr(network).String()
+	c := &dns.Client{Net: network, Timeout: time.Second}
+	reply, _, err := c.Exchange(createTestMessage("example.org."), addr)
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("done before the query being processed completed")
+	default:
+		// Go on.
+	}
+
+	close(u.release)
+
+	res := <-inflight
+	assert.Nil(t, res.err)
+	if assert.NotNil(t, res.reply) && assert.Len(t, res.reply.Answer, 1) {
+		a, ok := res.reply.Answer[0].(*dns.A)
+		assert.True(t, ok)
+		assert.True(t, net.IP{1, 2, 3, 4}.Equal(a.A))
+	}
+
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not done after the query being processed completed")
+	}
+
+	// The listeners are stopped after draining.
+	if network == proxy.ProtoTCP {
+		_, _, err = c.Exchange(createTestMessage("example.org."), addr)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestServer_Stop_drain(t *testing.T) {
+	for _, network := range []string{proxy.ProtoUDP, proxy.ProtoTCP} {
+		t.Run(network, func(t *testing.T) {
+			u := newDrainTestUpstream()
+			s := startDrainTestServer(t, u, 10)
+
+			inflight := exchangeInflight(s, u, network)
+
+			stopped := make(chan error, 1)
+			go func() { stopped <- s.Stop() }()
+
+			assertDrained(t, s, network, u, inflight, stopped)
+			assert.False(t, s.IsRunning())
+		})
+	}
+}
+
+func TestServer_Reconfigure_drain(t *testing.T) {
+	u := newDrainTestUpstream()
+	s := startDrainTestServer(t, u, 10)
+	t.Cleanup(func() { _ = s.Stop() })
+
+	inflight := exchangeInflight(s, u, proxy.ProtoUDP)
+
+	reconfigured := make(chan error, 1)
+	go func() { reconfigured <- s.Reconfigure(nil) }()
+
+	assertDrained(t, s, proxy.ProtoUDP, u, inflight, reconfigured)
+	assert.True(t, s.IsRunning())
+	assert.False(t, s.inflight.isDraining())
+}
+
+func TestServer_Stop_drainTimeout(t *testing.T) {
+	u := &blockUpstream{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	defer close(u.release)
+
+	s := startDrainTestServer(t, u, 1)
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	go func() {
+		_, _ = dns.Exchange(createTestMessage("example.org."), addr)
+	}()
+	<-u.started
+
+	start := time.Now()
+	err := s.Stop()
+	elapsed := time.Since(start)
+
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, int64(elapsed), int64(time.Second))
+	assert.Less(t, int64(elapsed), int64(5*time.Second))
+}
@@ -0,0 +1,182 @@
+package dnsforward
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ecsSubnet returns the subnet from the EDNS Client Subnet option of req.  It
+// returns nil if there is no such option or if it's invalid.
+func ecsSubnet(req *dns.Msg) (subnet *net.IPNet) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		e, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+
+		var bits int
+		var ip net.IP
+		switch e.Family {
+		case 1:
+			bits, ip = net.IPv4len*8, e.Address.To4()
+		case 2:
+			bits, ip = net.IPv6len*8, e.Address.To16()
+		default:
+			return nil
+		}
+
+		if ip == nil || int(e.SourceNetmask) > bits {
+			return nil
+		}
+
+		mask := net.CIDRMask(int(e.SourceNetmask), bits)
+
+		return &net.IPNet{
+			IP:   ip.Mask(mask),
+			Mask: mask,
+		}
+	}
+
+	return nil
+}
+
+// clientSubnet returns the subnet from the EDNS Client Subnet option of req if
+// matching the clients by it is enabled.
+func (s *Server) clientSubnet(req *dns.Msg) (subnet *net.IPNet) {
+	if !s.conf.ECSClientMatching {
+		return nil
+	}
+
+	return ecsSubnet(req)
+}
+
+// EDNS Client Subnet policies, see FilteringConfig.ECSPolicy.
+const (
+	ecsPolicyHonor    = "honor"
+	ecsPolicyOverride = "override"
+	ecsPolicyStrip    = "strip"
+)
+
+// The prefix lengths of the subnets of the real source addresses sent in the
+// EDNS Client Subnet option.  They are the same as the ones of dnsproxy.
+const (
+	ecsIPv4PrefixLen = 24
+	ecsIPv6PrefixLen = 56
+)
+
+// removeECS removes the EDNS Client Subnet options from req.
+func removeECS(req *dns.Msg) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	opts := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			opts = append(opts, o)
+		}
+	}
+	opt.Option = opts
+}
+
+// setECS replaces the EDNS Client Subnet option of req with the one containing
+// the subnet of ip.
+func setECS(req *dns.Msg, ip net.IP) {
+	e := &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET,
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		e.Family = 1
+		e.SourceNetmask = ecsIPv4PrefixLen
+		e.Address = ip4.Mask(net.CIDRMask(ecsIPv4PrefixLen, net.IPv4len*8))
+	} else {
+		e.Family = 2
+		e.SourceNetmask = ecsIPv6PrefixLen
+		e.Address = ip.Mask(net.CIDRMask(ecsIPv6PrefixLen, net.IPv6len*8))
+	}
+
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+	} else {
+		removeECS(req)
+	}
+
+	opt.Option = append(opt.Option, e)
+}
+
+// hasECS returns true if req has an EDNS Client Subnet option, even an
+// invalid one.
+func hasECS(req *dns.Msg) (ok bool) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0SUBNET {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isPublicIP returns true if ip is a global unicast address which isn't from
+// a local network.  Only the subnets of such addresses are sent to the
+// upstreams.
+func isPublicIP(ip net.IP) (ok bool) {
+	return ip != nil && ip.IsGlobalUnicast() && !isLocalClient(ip)
+}
+
+// applyECSPolicy changes the EDNS Client Subnet option of the request of ctx
+// before it's forwarded according to the configured policy.  With the "honor"
+// policy the request is left to dnsproxy, which keeps the option sent by the
+// client and adds the one with the subnet of the real source address if there
+// is none and sending it is enabled.  With the "override" policy the option
+// sent by the client is replaced with the one of the real source address if
+// sending it is enabled and the address is public, or removed otherwise.  With
+// the "strip" policy the option is removed.
+//
+// The request is copied before it's changed, so that the query log records the
+// one received from the client.
+func (s *Server) applyECSPolicy(ctx *dnsContext) {
+	policy := s.conf.ECSPolicy
+	if policy != ecsPolicyOverride && policy != ecsPolicyStrip {
+		return
+	}
+
+	d := ctx.proxyCtx
+
+	var ip net.IP
+	if policy == ecsPolicyOverride && s.conf.EnableEDNSClientSubnet {
+		ip = IPFromAddr(d.Addr)
+		if !isPublicIP(ip) {
+			ip = nil
+		}
+	}
+
+	if ip == nil && !hasECS(d.Req) {
+		return
+	}
+
+	if ctx.origReq == nil {
+		ctx.origReq = d.Req
+	}
+	d.Req = d.Req.Copy()
+
+	if ip == nil {
+		removeECS(d.Req)
+	} else {
+		setECS(d.Req, ip)
+	}
+}
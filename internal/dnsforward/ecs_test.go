@@ -0,0 +1,294 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// createTestMessageWithECS returns a new A query for host with the EDNS
+// Client Subnet option set to subnet.
+func createTestMessageWithECS(host string, subnet *net.IPNet) (req *dns.Msg) {
+	req = createTestMessage(host)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	ones, _ := subnet.Mask.Size()
+	e := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(ones),
+		Address:       subnet.IP,
+	}
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, e)
+
+	return req
+}
+
+func TestECSSubnet(t *testing.T) {
+	subnet := &net.IPNet{
+		IP:   net.IP{1, 2, 3, 0},
+		Mask: net.CIDRMask(24, 32),
+	}
+
+	assert.Nil(t, ecsSubnet(createTestMessage("example.org.")))
+	assert.Equal(t, subnet, ecsSubnet(createTestMessageWithECS("example.org.", subnet)))
+
+	req := createTestMessageWithECS("example.org.", &net.IPNet{
+		IP:   net.IP{1, 2, 3, 4},
+		Mask: net.CIDRMask(24, 32),
+	})
+	assert.Equal(t, subnet, ecsSubnet(req))
+}
+
+func TestServer_ECSClientMatching(t *testing.T) {
+	const host = "ecs.example.org."
+
+	subnet := &net.IPNet{
+		IP:   net.IP{1, 2, 3, 0},
+		Mask: net.CIDRMask(24, 32),
+	}
+
+	testCases := []struct {
+		name    string
+		req     *dns.Msg
+		enabled bool
+		want    net.IP
+	}{{
+		name:    "ecs_enabled",
+		req:     createTestMessageWithECS(host, subnet),
+		enabled: true,
+		want:    net.IP{0, 0, 0, 0},
+	}, {
+		name:    "ecs_disabled",
+		req:     createTestMessageWithECS(host, subnet),
+		enabled: false,
+		want:    net.IP{1, 2, 3, 4},
+	}, {
+		name:    "no_ecs",
+		req:     createTestMessage(host),
+		enabled: true,
+		want:    net.IP{1, 2, 3, 4},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := dnsfilter.New(&dnsfilter.Config{}, []dnsfilter.Filter{{
+				Data: []byte("||ecs.example.org^$client=1.2.3.0/24\n"),
+			}})
+			s := NewServer(DNSCreateParams{DNSFilter: f})
+			s.conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+			s.conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+			s.conf.UpstreamDNS = []string{"8.8.8.8:53"}
+			s.conf.FilteringConfig.ProtectionEnabled = true
+			s.conf.ECSClientMatching = tc.enabled
+			s.conf.ConfigModified = func() {}
+
+			assert.Nil(t, s.startWithUpstream(&recordUpstream{}))
+			t.Cleanup(func() { _ = s.Stop() })
+
+			reply, err := dns.Exchange(tc.req, s.dnsProxy.Addr(proxy.ProtoUDP).String())
+			assert.Nil(t, err)
+			if assert.Len(t, reply.Answer, 1) {
+				a, ok := reply.Answer[0].(*dns.A)
+				assert.True(t, ok)
+				assert.True(t, tc.want.Equal(a.A), a.A)
+			}
+		})
+	}
+}
+
+func TestServer_ECSAccess(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.DisallowedClients = []string{"1.2.3.0/24"}
+	s.conf.ECSClientMatching = true
+	assert.Nil(t, s.Prepare(nil))
+
+	subnet := &net.IPNet{
+		IP:   net.IP{1, 2, 3, 0},
+		Mask: net.CIDRMask(24, 32),
+	}
+	d := &proxy.DNSContext{
+		Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 53},
+		Req:  createTestMessageWithECS("example.org.", subnet),
+	}
+
+	ok, err := s.beforeRequestHandler(nil, d)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	d.Req = createTestMessage("example.org.")
+	ok, err = s.beforeRequestHandler(nil, d)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	s.conf.ECSClientMatching = false
+	d.Req = createTestMessageWithECS("example.org.", subnet)
+	ok, err = s.beforeRequestHandler(nil, d)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// The source address is always checked, so the clients can't bypass
+	// the access lists with the option.
+	s.conf.ECSClientMatching = true
+	d.Addr = &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 53}
+	d.Req = createTestMessageWithECS("example.org.", &net.IPNet{
+		IP:   net.IP{4, 3, 2, 0},
+		Mask: net.CIDRMask(24, 32),
+	})
+	ok, err = s.beforeRequestHandler(nil, d)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestServer_applyECSPolicy(t *testing.T) {
+	clientSubnet := &net.IPNet{
+		IP:   net.IP{1, 2, 3, 0},
+		Mask: net.CIDRMask(24, 32),
+	}
+	sourceSubnet := &net.IPNet{
+		IP:   net.IP{5, 6, 7, 0},
+		Mask: net.CIDRMask(24, 32),
+	}
+	sourceAddr := &net.UDPAddr{IP: net.IP{5, 6, 7, 8}, Port: 53}
+
+	testCases := []struct {
+		name      string
+		policy    string
+		clientECS bool
+		enabled   bool
+		want      *net.IPNet
+	}{{
+		name:      "honor_client",
+		policy:    ecsPolicyHonor,
+		clientECS: true,
+		enabled:   true,
+		want:      clientSubnet,
+	}, {
+		// dnsproxy adds the option in this case.
+		name:      "honor_no_client",
+		policy:    ecsPolicyHonor,
+		clientECS: false,
+		enabled:   true,
+		want:      nil,
+	}, {
+		name:      "default_client",
+		policy:    "",
+		clientECS: true,
+		enabled:   true,
+		want:      clientSubnet,
+	}, {
+		name:      "honor_disabled",
+		policy:    ecsPolicyHonor,
+		clientECS: false,
+		enabled:   false,
+		want:      nil,
+	}, {
+		name:      "override_client",
+		policy:    ecsPolicyOverride,
+		clientECS: true,
+		enabled:   true,
+		want:      sourceSubnet,
+	}, {
+		name:      "override_disabled",
+		policy:    ecsPolicyOverride,
+		clientECS: true,
+		enabled:   false,
+		want:      nil,
+	}, {
+		name:      "strip_client",
+		policy:    ecsPolicyStrip,
+		clientECS: true,
+		enabled:   true,
+		want:      nil,
+	}, {
+		name:      "strip_no_client",
+		policy:    ecsPolicyStrip,
+		clientECS: false,
+		enabled:   true,
+		want:      nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{}
+			s.conf.ECSPolicy = tc.policy
+			s.conf.EnableEDNSClientSubnet = tc.enabled
+
+			req := createTestMessage("example.org.")
+			if tc.clientECS {
+				req = createTestMessageWithECS("example.org.", clientSubnet)
+			}
+
+			d := &proxy.DNSContext{
+				Addr: sourceAddr,
+				Req:  req,
+			}
+			ctx := &dnsContext{proxyCtx: d}
+			s.applyECSPolicy(ctx)
+
+			assert.Equal(t, tc.want, ecsSubnet(d.Req))
+
+			// The request received from the client is never changed.
+			if tc.clientECS {
+				assert.Equal(t, clientSubnet, ecsSubnet(req))
+			} else {
+				assert.Nil(t, ecsSubnet(req))
+			}
+
+			if d.Req != req {
+				assert.Same(t, req, ctx.origReq)
+			}
+
+			wantKey := ""
+			if tc.want != nil {
+				wantKey = tc.want.String()
+			}
+			assert.Equal(t, wantKey, staleKeyFromMsg(d.Req).ecs)
+
+			if tc.want != nil {
+				return
+			}
+
+			// Make sure that the option is removed entirely.
+			if opt := d.Req.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					assert.NotEqual(t, uint16(dns.EDNS0SUBNET), o.Option())
+				}
+			}
+		})
+	}
+
+	for _, ip := range []net.IP{
+		{127, 0, 0, 1},
+		{192, 168, 1, 2},
+		{10, 1, 2, 3},
+		net.ParseIP("fd00::1"),
+	} {
+		t.Run("non_public_"+ip.String(), func(t *testing.T) {
+			s := &Server{}
+			s.conf.ECSPolicy = ecsPolicyOverride
+			s.conf.EnableEDNSClientSubnet = true
+
+			req := createTestMessage("example.org.")
+			d := &proxy.DNSContext{
+				Addr: &net.UDPAddr{IP: ip, Port: 53},
+				Req:  req,
+			}
+			s.applyECSPolicy(&dnsContext{proxyCtx: d})
+
+			assert.Nil(t, ecsSubnet(d.Req))
+			assert.False(t, hasECS(d.Req))
+			assert.Same(t, req, d.Req)
+
+			d.Req = createTestMessageWithECS("example.org.", clientSubnet)
+			s.applyECSPolicy(&dnsContext{proxyCtx: d})
+
+			assert.False(t, hasECS(d.Req))
+		})
+	}
+}
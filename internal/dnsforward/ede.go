@@ -0,0 +1,135 @@
+package dnsforward
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// edeOptCode is the code of the Extended DNS Error EDNS0 option.  miekg/dns
+// doesn't support it yet, so it is sent as a local option.
+//
+// See RFC 8914.
+const edeOptCode = 15
+
+// Extended DNS Error info codes.
+//
+// See RFC 8914.
+const (
+	edeDNSSECBogus          uint16 = 6
+	edeNoReachableAuthority uint16 = 22
+	edeNetworkError         uint16 = 23
+)
+
+// edeFromError returns the Extended DNS Error info code and the extra text
+// describing the error returned by the upstream servers.
+func edeFromError(err error) (code uint16, text string) {
+	if errors.Is(err, errMalformedResponse) || isMalformedResponse(err) {
+		return edeNetworkError, string(errMalformedResponse)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return edeNetworkError, "upstream timeout"
+		}
+
+		return edeNetworkError, "upstream network error"
+	}
+
+	return edeNoReachableAuthority, "no upstream servers could be reached"
+}
+
+// setEDE adds the Extended DNS Error option to resp.  It does nothing if req
+// doesn't have an OPT record, since EDNS0 options must not be sent to such
+// clients.
+func setEDE(req, resp *dns.Msg, code uint16, text string) {
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		opt = resp.IsEdns0()
+	}
+
+	data := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	copy(data[2:], text)
+
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: edeOptCode,
+		Data: data,
+	})
+}
+
+// hasEDE returns true if m has an Extended DNS Error option.
+func hasEDE(m *dns.Msg) (ok bool) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, o := range opt.Option {
+		if o.Option() == edeOptCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// genServerFailureEDE generates a SERVFAIL response to req with an Extended DNS
+// Error describing err.
+func (s *Server) genServerFailureEDE(req *dns.Msg, err error) (resp *dns.Msg) {
+	resp = s.genServerFailure(req)
+
+	code, text := edeFromError(err)
+	setEDE(req, resp, code, text)
+
+	return resp
+}
+
+// addBogusEDE checks if the SERVFAIL response from the upstream servers is
+// caused by a DNSSEC validation failure, and if it is, adds the corresponding
+// Extended DNS Error to the response.  The check is performed by re-sending the
+// request with the CD bit set.  If the upstream servers are able to answer it,
+// the original data is bogus.
+func (s *Server) addBogusEDE(d *proxy.DNSContext) {
+	if d.Res == nil ||
+		d.Res.Rcode != dns.RcodeServerFailure ||
+		d.Req.CheckingDisabled ||
+		hasEDE(d.Res) {
+		return
+	}
+
+	req := d.Req.Copy()
+	req.CheckingDisabled = true
+	cdCtx := &proxy.DNSContext{
+		Proto:                d.Proto,
+		Addr:                 d.Addr,
+		Req:                  req,
+		StartTime:            time.Now(),
+		CustomUpstreamConfig: d.CustomUpstreamConfig,
+	}
+
+	err := s.dnsProxy.Resolve(cdCtx)
+	if err != nil {
+		log.Debug("dns: checking servfail with cd bit: %s", err)
+
+		return
+	}
+
+	if cdCtx.Res == nil || cdCtx.Res.Rcode == dns.RcodeServerFailure {
+		return
+	}
+
+	setEDE(d.Req, d.Res, edeDNSSECBogus, "dnssec validation failed")
+}
@@ -0,0 +1,165 @@
+package dnsforward
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testTimeoutError is a net.Error which is always a timeout.
+type testTimeoutError struct{}
+
+// Error implements the net.Error interface for testTimeoutError.
+func (testTimeoutError) Error() string { return "test timeout" }
+
+// Timeout implements the net.Error interface for testTimeoutError.
+func (testTimeoutError) Timeout() bool { return true }
+
+// Temporary implements the net.Error interface for testTimeoutError.
+func (testTimeoutError) Temporary() bool { return true }
+
+// testErrUpstream is an upstream which always returns an error.
+type testErrUpstream struct {
+	err error
+}
+
+// Exchange implements the upstream.Upstream interface for *testErrUpstream.
+func (u *testErrUpstream) Exchange(_ *dns.Msg) (*dns.Msg, error) {
+	return nil, u.err
+}
+
+// Address implements the upstream.Upstream interface for *testErrUpstream.
+func (u *testErrUpstream) Address() string {
+	return "test-err"
+}
+
+// testBogusUpstream is an upstream which responds with SERVFAIL unless the CD
+// bit is set, like a validating resolver does with DNSSEC-bogus data.
+type testBogusUpstream struct{}
+
+// Exchange implements the upstream.Upstream interface for *testBogusUpstream.
+func (u *testBogusUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	if !m.CheckingDisabled {
+		resp.SetRcode(m, dns.RcodeServerFailure)
+
+		return resp, nil
+	}
+
+	resp.SetReply(m)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   m.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		A: []byte{1, 2, 3, 4},
+	}}
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for *testBogusUpstream.
+func (u *testBogusUpstream) Address() string {
+	return "test-bogus"
+}
+
+// edeCode returns the Extended DNS Error info code from m.  ok is false if
+// there is none.
+func edeCode(m *dns.Msg) (code uint16, ok bool) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+
+	for _, o := range opt.Option {
+		l, isLocal := o.(*dns.EDNS0_LOCAL)
+		if isLocal && l.Code == edeOptCode && len(l.Data) >= 2 {
+			return binary.BigEndian.Uint16(l.Data), true
+		}
+	}
+
+	return 0, false
+}
+
+func TestEDEFromError(t *testing.T) {
+	code, _ := edeFromError(testTimeoutError{})
+	assert.Equal(t, edeNetworkError, code)
+
+	code, _ = edeFromError(errors.New("no upstreams"))
+	assert.Equal(t, edeNoReachableAuthority, code)
+}
+
+func TestSetEDE(t *testing.T) {
+	req := createTestMessage("example.org.")
+	resp := &dns.Msg{}
+	resp.SetRcode(req, dns.RcodeServerFailure)
+
+	setEDE(req, resp, edeNetworkError, "")
+	assert.False(t, hasEDE(resp))
+
+	req.SetEdns0(4096, false)
+	setEDE(req, resp, edeNetworkError, "timeout")
+	assert.True(t, hasEDE(resp))
+
+	code, ok := edeCode(resp)
+	assert.True(t, ok)
+	assert.Equal(t, edeNetworkError, code)
+}
+
+func TestServer_ServFailEDE(t *testing.T) {
+	t.Run("timeout", func(t *testing.T) {
+		s := createTestServer(t)
+		s.conf.EnableEDE = true
+		err := s.startWithUpstream(&testErrUpstream{err: testTimeoutError{}})
+		assert.Nil(t, err)
+		t.Cleanup(func() { _ = s.Stop() })
+
+		req := createTestMessage("example.org.")
+		req.SetEdns0(4096, false)
+		reply, err := dns.Exchange(req, s.dnsProxy.Addr(proxy.ProtoUDP).String())
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeServerFailure, reply.Rcode)
+
+		code, ok := edeCode(reply)
+		assert.True(t, ok)
+		assert.Equal(t, edeNetworkError, code)
+	})
+
+	t.Run("bogus", func(t *testing.T) {
+		s := createTestServer(t)
+		s.conf.EnableEDE = true
+		s.conf.EnableDNSSEC = true
+		err := s.startWithUpstream(&testBogusUpstream{})
+		assert.Nil(t, err)
+		t.Cleanup(func() { _ = s.Stop() })
+
+		req := createTestMessage("example.org.")
+		reply, err := dns.Exchange(req, s.dnsProxy.Addr(proxy.ProtoUDP).String())
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeServerFailure, reply.Rcode)
+
+		code, ok := edeCode(reply)
+		assert.True(t, ok)
+		assert.Equal(t, edeDNSSECBogus, code)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		s := createTestServer(t)
+		err := s.startWithUpstream(&testErrUpstream{err: testTimeoutError{}})
+		assert.Nil(t, err)
+		t.Cleanup(func() { _ = s.Stop() })
+
+		req := createTestMessage("example.org.")
+		req.SetEdns0(4096, false)
+		reply, err := dns.Exchange(req, s.dnsProxy.Addr(proxy.ProtoUDP).String())
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeServerFailure, reply.Rcode)
+		assert.False(t, hasEDE(reply))
+	})
+}
@@ -0,0 +1,54 @@
+package dnsforward
+
+import (
+	"strconv"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/util"
+	"github.com/miekg/dns"
+)
+
+// maxEDNSOptionNames is the maximum number of the distinct EDNS option names
+// recorded for a single message.
+const maxEDNSOptionNames = 8
+
+// ednsOptionNames maps the codes of the known EDNS options to their names used
+// in the query log.
+var ednsOptionNames = map[uint16]string{
+	dns.EDNS0NSID:         "nsid",
+	dns.EDNS0SUBNET:       "ecs",
+	dns.EDNS0EXPIRE:       "expire",
+	dns.EDNS0COOKIE:       "cookie",
+	dns.EDNS0TCPKEEPALIVE: "tcp_keepalive",
+	dns.EDNS0PADDING:      "padding",
+	edeOptCode:            "ede",
+}
+
+// ednsOptions returns the names of the distinct EDNS options of m in the order
+// of their appearance.  The options not in ednsOptionNames are named by their
+// codes, for example "opt65001".  It returns nil if m has no options.
+func ednsOptions(m *dns.Msg) (names []string) {
+	if m == nil {
+		return nil
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		name, ok := ednsOptionNames[o.Option()]
+		if !ok {
+			name = "opt" + strconv.Itoa(int(o.Option()))
+		}
+
+		if !util.ContainsString(names, name) {
+			names = append(names, name)
+			if len(names) == maxEDNSOptionNames {
+				break
+			}
+		}
+	}
+
+	return names
+}
@@ -0,0 +1,133 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEDNSOptions_queryLog(t *testing.T) {
+	ecsCookieReq := createTestMessage("example.org.")
+	ecsCookieReq.SetEdns0(4096, false)
+	opt := ecsCookieReq.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.IP{1, 2, 3, 0},
+	}, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: "0123456789abcdef",
+	}, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.IP{1, 2, 4, 0},
+	})
+
+	paddedResp := &dns.Msg{}
+	paddedResp.SetEdns0(4096, false)
+	opt = paddedResp.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 16)})
+
+	paddingReq := createTestMessage("example.org.")
+	paddingReq.SetEdns0(4096, false)
+
+	testCases := []struct {
+		name     string
+		req      *dns.Msg
+		resp     *dns.Msg
+		proto    string
+		wantReq  []string
+		wantResp []string
+		verbose  bool
+	}{{
+		name:     "ecs_cookie",
+		req:      ecsCookieReq,
+		resp:     paddedResp,
+		proto:    proxy.ProtoUDP,
+		wantReq:  []string{"ecs", "cookie"},
+		wantResp: []string{"padding"},
+		verbose:  true,
+	}, {
+		name:     "plain",
+		req:      createTestMessage("example.org."),
+		resp:     &dns.Msg{},
+		proto:    proxy.ProtoUDP,
+		wantReq:  nil,
+		wantResp: nil,
+		verbose:  true,
+	}, {
+		name:     "padded_by_server",
+		req:      paddingReq,
+		resp:     (&dns.Msg{}).SetReply(paddingReq),
+		proto:    proxy.ProtoHTTPS,
+		wantReq:  nil,
+		wantResp: []string{"padding"},
+		verbose:  true,
+	}, {
+		name:     "not_verbose",
+		req:      ecsCookieReq,
+		resp:     paddedResp,
+		proto:    proxy.ProtoUDP,
+		wantReq:  nil,
+		wantResp: nil,
+		verbose:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ql := &testQueryLog{}
+			dctx := &dnsContext{
+				srv: &Server{
+					conf: ServerConfig{
+						QueryLogVerbose: tc.verbose,
+						FilteringConfig: FilteringConfig{
+							EDNSPadding: true,
+						},
+					},
+					queryLog: ql,
+					stats:    &testStats{},
+				},
+				proxyCtx: &proxy.DNSContext{
+					Proto: tc.proto,
+					Req:   tc.req,
+					Addr:  &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 1234},
+				},
+				startTime: time.Now(),
+				result:    &dnsfilter.Result{},
+			}
+
+			assert.Equal(t, resultCodeSuccess, processInitial(dctx))
+
+			dctx.proxyCtx.Res = tc.resp
+			assert.Equal(t, resultCodeSuccess, processEDNSPadding(dctx))
+			assert.Equal(t, resultCodeSuccess, processQueryLogsAndStats(dctx))
+
+			assert.Equal(t, tc.wantReq, ql.lastParams.ReqEDNSOptions)
+			assert.Equal(t, tc.wantResp, ql.lastParams.RespEDNSOptions)
+		})
+	}
+}
+
+func TestEDNSOptions_unknown(t *testing.T) {
+	m := &dns.Msg{}
+	m.SetEdns0(4096, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1}})
+	for i := 0; i < maxEDNSOptionNames+2; i++ {
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+			Code: uint16(65100 + i),
+			Data: []byte{1},
+		})
+	}
+
+	names := ednsOptions(m)
+	assert.Len(t, names, maxEDNSOptionNames)
+	assert.Equal(t, "opt65001", names[0])
+}
@@ -0,0 +1,242 @@
+package dnsforward
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxCachedNames is the maximum number of the names and types of the cached
+// responses tracked by evictedNames.
+const maxCachedNames = 100000
+
+// evictedKey is the key of an evictedNames item.
+type evictedKey struct {
+	name string
+	// qtype is the type of the evicted responses.  Zero means all types.
+	qtype uint16
+}
+
+// evictedNames contains the names evicted from the cache of dnsproxy.  That
+// cache can't remove single entries, so the queries for these names bypass it
+// until the evicted responses expire.
+//
+// To know when they expire, evictedNames tracks the expiration times of the
+// responses stored in the cache by their names and types.
+type evictedNames struct {
+	// items are the times when the evicted responses expire by the names
+	// and the types.
+	items map[evictedKey]time.Time
+
+	// cached are the times when the responses in the cache expire by the
+	// names and the types.
+	cached map[evictedKey]time.Time
+
+	// untracked is the time when all the cached responses which aren't in
+	// cached, because there were too many of them, expire.
+	untracked time.Time
+
+	// all is the time until which all the queries bypass the cache, since
+	// it has been cleared while some responses weren't tracked.
+	all time.Time
+
+	lock sync.Mutex
+
+	// minTTL and maxTTL are the limits of the TTLs of the cached responses
+	// in seconds.  Zero means no limit.
+	minTTL uint32
+	maxTTL uint32
+
+	// now returns the current time.  It is time.Now unless tests replace
+	// it.
+	now func() time.Time
+}
+
+// newEvictedNames returns a new properly initialized *evictedNames for the
+// cache with the minimum and the maximum TTLs of minTTL and maxTTL seconds, if
+// they're not zero.
+func newEvictedNames(minTTL, maxTTL uint32) (e *evictedNames) {
+	return &evictedNames{
+		items:  map[evictedKey]time.Time{},
+		cached: map[evictedKey]time.Time{},
+		minTTL: minTTL,
+		maxTTL: maxTTL,
+		now:    time.Now,
+	}
+}
+
+// cacheTTL returns the time for which dnsproxy caches resp, which is the lowest
+// TTL of its records limited by the configured TTLs.  ok is false if resp has
+// no records with TTLs.
+func (e *evictedNames) cacheTTL(resp *dns.Msg) (ttl time.Duration, ok bool) {
+	var lowest uint32
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range rrs {
+			hdrTTL := rr.Header().Ttl
+			if !ok || hdrTTL < lowest {
+				lowest = hdrTTL
+				ok = true
+			}
+		}
+	}
+
+	if !ok {
+		return 0, false
+	}
+
+	if e.minTTL != 0 && lowest < e.minTTL {
+		lowest = e.minTTL
+	} else if e.maxTTL != 0 && lowest > e.maxTTL {
+		lowest = e.maxTTL
+	}
+
+	return time.Duration(lowest) * time.Second, true
+}
+
+// store records the expiration time of resp, which has been received from the
+// default upstreams and stored in the cache.
+func (e *evictedNames) store(resp *dns.Msg) {
+	if len(resp.Question) == 0 {
+		return
+	}
+
+	ttl, ok := e.cacheTTL(resp)
+	if !ok {
+		return
+	}
+
+	q := resp.Question[0]
+	k := evictedKey{
+		name:  strings.ToLower(q.Name),
+		qtype: q.Qtype,
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	now := e.now()
+	expire := now.Add(ttl)
+	if prev, found := e.cached[k]; found {
+		// The responses to the requests with different options are
+		// cached separately, so keep the latest expiration time.
+		if prev.After(expire) {
+			expire = prev
+		}
+	} else if len(e.cached) >= maxCachedNames {
+		removeExpired(e.cached, now)
+	}
+
+	if len(e.cached) >= maxCachedNames {
+		if expire.After(e.untracked) {
+			e.untracked = expire
+		}
+
+		return
+	}
+
+	e.cached[k] = expire
+}
+
+// removeExpired removes the items which have expired by now from m.
+func removeExpired(m map[evictedKey]time.Time, now time.Time) {
+	for k, expire := range m {
+		if now.After(expire) {
+			delete(m, k)
+		}
+	}
+}
+
+// evict makes the queries for k bypass the cache until expire.  It must be
+// called with e.lock held.
+func (e *evictedNames) evict(k evictedKey, expire time.Time) {
+	if prev, found := e.items[k]; !found || expire.After(prev) {
+		e.items[k] = expire
+	}
+}
+
+// add evicts the responses for name of type qtype.  If qtype is 0, the
+// responses of all types are evicted.  The queries for them bypass the cache
+// until the evicted responses expire.
+func (e *evictedNames) add(name string, qtype uint16) {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	now := e.now()
+	removeExpired(e.items, now)
+	removeExpired(e.cached, now)
+
+	for k, expire := range e.cached {
+		if k.name == name && (qtype == 0 || k.qtype == qtype) {
+			e.evict(k, expire)
+			delete(e.cached, k)
+		}
+	}
+
+	if now.Before(e.untracked) {
+		e.evict(evictedKey{name: name, qtype: qtype}, e.untracked)
+	}
+}
+
+// clear evicts all the responses in the cache.
+func (e *evictedNames) clear() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	now := e.now()
+	removeExpired(e.items, now)
+
+	for k, expire := range e.cached {
+		if now.Before(expire) {
+			e.evict(k, expire)
+		}
+	}
+
+	e.cached = map[evictedKey]time.Time{}
+
+	if now.Before(e.untracked) && e.untracked.After(e.all) {
+		e.all = e.untracked
+	}
+
+	e.untracked = time.Time{}
+}
+
+// has returns true if the response to req may be an evicted one.
+func (e *evictedNames) has(req *dns.Msg) (ok bool) {
+	if len(req.Question) == 0 {
+		return false
+	}
+
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	now := e.now()
+	if now.Before(e.all) {
+		return true
+	}
+
+	if len(e.items) == 0 {
+		return false
+	}
+
+	for _, k := range []evictedKey{{name, q.Qtype}, {name, 0}} {
+		expire, found := e.items[k]
+		if !found {
+			continue
+		} else if now.After(expire) {
+			delete(e.items, k)
+
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
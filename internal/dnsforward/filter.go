@@ -2,7 +2,9 @@ package dnsforward
 
 import (
 	"fmt"
+	"net"
 	"strings"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/dnsproxy/proxy"
@@ -13,12 +15,43 @@ import (
 
 func (s *Server) beforeRequestHandler(_ *proxy.Proxy, d *proxy.DNSContext) (bool, error) {
 	ip := IPFromAddr(d.Addr)
-	disallowed, _ := s.access.IsBlockedIP(ip)
+	if s.ratelimit != nil && !s.ratelimit.wait(ip) {
+		log.Tracef("Client IP %s has exceeded the rate limit", ip)
+		return false, nil
+	}
+
+	clientID := ""
+	if s.access.hasClientIDs() {
+		// The ClientID is normally extracted later, so do it in
+		// advance, since the access lists need it.  Invalid ClientIDs
+		// are reported later, during the processing of the request.
+		ctx := &dnsContext{srv: s, proxyCtx: d}
+		if processClientID(ctx) == resultCodeSuccess {
+			clientID = ctx.clientID
+		}
+	}
+
+	var hosts []string
+	if s.conf.GetHostnamesByClient != nil && s.access.hasHostRules() {
+		hosts = s.conf.GetHostnamesByClient(ip, clientID)
+	}
+
+	disallowed, _ := s.access.IsBlockedClient(ip, clientID, hosts)
 	if disallowed {
-		log.Tracef("Client IP %s is blocked by settings", ip)
+		log.Tracef("Client IP %s with client id %q is blocked by settings", ip, clientID)
 		return false, nil
 	}
 
+	// The subnet from the EDNS Client Subnet option can only restrict the
+	// access further, since the clients can spoof it.
+	if subnet := s.clientSubnet(d.Req); subnet != nil {
+		disallowed, _ = s.access.IsBlockedClient(subnet.IP, clientID, hosts)
+		if disallowed {
+			log.Tracef("Client subnet %s with client id %q is blocked by settings", subnet, clientID)
+			return false, nil
+		}
+	}
+
 	if len(d.Req.Question) == 1 {
 		host := strings.TrimSuffix(d.Req.Question[0].Name, ".")
 		if s.access.IsBlockedDomain(host) {
@@ -31,17 +64,55 @@ func (s *Server) beforeRequestHandler(_ *proxy.Proxy, d *proxy.DNSContext) (bool
 }
 
 // getClientRequestFilteringSettings looks up client filtering settings using
-// the client's IP address and ID, if any, from ctx.
+// the client's IP address and ID, if any, from ctx.  It also sets the subnet
+// from the EDNS Client Subnet option if matching the clients by it is enabled.
 func (s *Server) getClientRequestFilteringSettings(ctx *dnsContext) *dnsfilter.RequestFilteringSettings {
 	setts := s.dnsFilter.GetConfig()
 	setts.FilteringEnabled = true
+
+	// Set the subnet first, since the clients may be identified by it.
+	setts.ClientSubnet = s.clientSubnet(ctx.proxyCtx.Req)
 	if s.conf.FilterHandler != nil {
 		s.conf.FilterHandler(IPFromAddr(ctx.proxyCtx.Addr), ctx.clientID, &setts)
 	}
+	s.conf.DefaultPolicy.apply(&setts)
+	if setts.BlockingMode == "" {
+		s.RLock()
+		setts.BlockingMode = s.conf.BlockingMode
+		setts.BlockingIPv4 = s.conf.BlockingIPv4
+		setts.BlockingIPv6 = s.conf.BlockingIPv6
+		s.RUnlock()
+	}
+
+	setts.Transport = transport(ctx.proxyCtx.Proto)
+	setts.Interface = ctx.iface
+	if req := ctx.proxyCtx.Req; len(req.Question) == 1 {
+		setts.QClass = req.Question[0].Qclass
+	}
 
 	return &setts
 }
 
+// transport returns the dnsfilter transport for the proxy protocol.
+func transport(proto proxy.Proto) (t string) {
+	switch proto {
+	case proxy.ProtoUDP:
+		return dnsfilter.TransportUDP
+	case proxy.ProtoTCP:
+		return dnsfilter.TransportTCP
+	case proxy.ProtoTLS:
+		return dnsfilter.TransportDoT
+	case proxy.ProtoHTTPS:
+		return dnsfilter.TransportDoH
+	case proxy.ProtoQUIC:
+		return dnsfilter.TransportDoQ
+	case proxy.ProtoDNSCrypt:
+		return dnsfilter.TransportDNSCrypt
+	default:
+		return ""
+	}
+}
+
 // filterDNSRequest applies the dnsFilter and sets d.Res if the request
 // was filtered.
 func (s *Server) filterDNSRequest(ctx *dnsContext) (*dnsfilter.Result, error) {
@@ -55,6 +126,8 @@ func (s *Server) filterDNSRequest(ctx *dnsContext) (*dnsfilter.Result, error) {
 	} else if res.IsFiltered {
 		log.Tracef("Host %s is filtered, reason - %q, matched rule: %q", host, res.Reason, res.Rules[0].Text)
 		d.Res = s.genDNSFilterMessage(d, &res)
+	} else if res.Reason == dnsfilter.ResolutionDepthExceeded {
+		d.Res = s.genServerFailure(req)
 	} else if res.Reason.In(dnsfilter.Rewritten, dnsfilter.RewrittenRule) &&
 		res.CanonName != "" &&
 		len(res.IPList) == 0 {
@@ -118,13 +191,17 @@ func (s *Server) filterDNSRequest(ctx *dnsContext) (*dnsfilter.Result, error) {
 // If this is a match, we set a new response in d.Res and return.
 func (s *Server) filterDNSResponse(ctx *dnsContext) (*dnsfilter.Result, error) {
 	d := ctx.proxyCtx
+	qtype := d.Req.Question[0].Qtype
+	start := time.Now()
 	for _, a := range d.Res.Answer {
 		host := ""
+		isCNAME := false
 
 		switch v := a.(type) {
 		case *dns.CNAME:
 			log.Debug("DNSFwd: Checking CNAME %s for %s", v.Target, v.Hdr.Name)
-			host = strings.TrimSuffix(v.Target, ".")
+			host = v.Target
+			isCNAME = true
 
 		case *dns.A:
 			host = v.A.String()
@@ -145,7 +222,38 @@ func (s *Server) filterDNSResponse(ctx *dnsContext) (*dnsfilter.Result, error) {
 			s.RUnlock()
 			continue
 		}
-		res, err := s.dnsFilter.CheckHostRules(host, d.Req.Question[0].Qtype, ctx.setts)
+		var res dnsfilter.Result
+		var err error
+		if isCNAME {
+			res, err = s.dnsFilter.CheckCNAMETarget(host, qtype, ctx.setts)
+		} else {
+			res = s.dnsFilter.CheckResponseIP(net.ParseIP(host), ctx.setts)
+			if res.Reason == dnsfilter.NotFilteredAllowList {
+				// The address is exempted by a passthru policy.
+				s.RUnlock()
+
+				continue
+			} else if res.DNSRewriteResult != nil {
+				s.dnsFilter.FinishResponseCheck(host, qtype, res, ctx.setts, start)
+				s.RUnlock()
+
+				return s.applyResponseIPPolicy(d, res, host)
+			}
+
+			res, err = s.dnsFilter.CheckHostRules(host, qtype, ctx.setts)
+		}
+
+		if err == nil && res.IsFiltered {
+			checked := host
+			if isCNAME {
+				checked = res.CNAMETarget
+			}
+
+			// The response-side results aren't reported by the
+			// checks themselves, so report the one which blocks the
+			// response.
+			s.dnsFilter.FinishResponseCheck(checked, qtype, res, ctx.setts, start)
+		}
 		s.RUnlock()
 
 		if err != nil {
@@ -159,3 +267,20 @@ func (s *Server) filterDNSResponse(ctx *dnsContext) (*dnsfilter.Result, error) {
 
 	return nil, nil
 }
+
+// applyResponseIPPolicy sets the response from the NXDOMAIN or NODATA policy
+// of a response policy zone for the response IP address ip.
+func (s *Server) applyResponseIPPolicy(
+	d *proxy.DNSContext,
+	res dnsfilter.Result,
+	ip string,
+) (r *dnsfilter.Result, err error) {
+	err = s.filterDNSRewrite(d.Req, res, d)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("DNSFwd: Matched %s by response ip policy: %s", d.Req.Question[0].Name, ip)
+
+	return &res, nil
+}
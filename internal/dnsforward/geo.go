@@ -0,0 +1,81 @@
+package dnsforward
+
+import (
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// filterGeo blocks the response if any of its IP addresses is located in one
+// of the blocked countries, unless the requested host is exempt.  It returns
+// nil if the response isn't blocked.
+func (s *Server) filterGeo(ctx *dnsContext) (res *dnsfilter.Result) {
+	d := ctx.proxyCtx
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.conf.GetIPCountry == nil || len(s.conf.GeoBlockedCountries) == 0 {
+		return nil
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(d.Req.Question[0].Name, "."))
+	if isGeoExempt(host, s.conf.GeoBlockExemptDomains) {
+		return nil
+	}
+
+	for _, a := range d.Res.Answer {
+		var ip net.IP
+		switch v := a.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		default:
+			continue
+		}
+
+		country := s.conf.GetIPCountry(ip)
+		if country == "" || !containsFold(s.conf.GeoBlockedCountries, country) {
+			continue
+		}
+
+		log.Debug("dns: geo: blocking %s: %s is located in %s", host, ip, country)
+
+		res = &dnsfilter.Result{
+			IsFiltered: true,
+			Reason:     dnsfilter.FilteredGeo,
+		}
+		d.Res = s.genDNSFilterMessage(d, res)
+
+		return res
+	}
+
+	return nil
+}
+
+// isGeoExempt returns true if host is one of domains or their subdomain.
+func isGeoExempt(host string, domains []string) (ok bool) {
+	for _, dom := range domains {
+		dom = strings.ToLower(strings.TrimSuffix(dom, "."))
+		if host == dom || strings.HasSuffix(host, "."+dom) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containsFold returns true if strs contains s, ignoring the case.
+func containsFold(strs []string, s string) (ok bool) {
+	for _, str := range strs {
+		if strings.EqualFold(str, s) {
+			return true
+		}
+	}
+
+	return false
+}
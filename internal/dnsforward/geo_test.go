@@ -0,0 +1,75 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_filterGeo(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.GeoBlockedCountries = []string{"xx"}
+	s.conf.GeoBlockExemptDomains = []string{"exempt.example."}
+	s.conf.GetIPCountry = func(ip net.IP) (country string) {
+		switch {
+		case ip.Equal(net.IP{1, 2, 3, 4}):
+			return "XX"
+		case ip.Equal(net.IP{5, 6, 7, 8}):
+			return "YY"
+		default:
+			return ""
+		}
+	}
+
+	assert.Nil(t, s.startWithUpstream(&testUpstream{
+		ipv4: map[string][]net.IP{
+			"blocked.example.":     {{5, 6, 7, 8}, {1, 2, 3, 4}},
+			"exempt.example.":      {{1, 2, 3, 4}},
+			"sub.exempt.example.":  {{1, 2, 3, 4}},
+			"allowed.example.":     {{5, 6, 7, 8}},
+			"unknown.example.":     {{9, 9, 9, 9}},
+			"notexempt-exempt.ex.": {{1, 2, 3, 4}},
+		},
+	}))
+	t.Cleanup(func() { _ = s.Stop() })
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	testCases := []struct {
+		host string
+		want net.IP
+	}{{
+		host: "blocked.example.",
+		want: net.IPv4zero,
+	}, {
+		host: "exempt.example.",
+		want: net.IP{1, 2, 3, 4},
+	}, {
+		host: "sub.exempt.example.",
+		want: net.IP{1, 2, 3, 4},
+	}, {
+		host: "allowed.example.",
+		want: net.IP{5, 6, 7, 8},
+	}, {
+		host: "unknown.example.",
+		want: net.IP{9, 9, 9, 9},
+	}, {
+		host: "notexempt-exempt.ex.",
+		want: net.IPv4zero,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			reply, err := dns.Exchange(createTestMessage(tc.host), addr)
+			assert.Nil(t, err)
+			if assert.NotNil(t, reply) && assert.NotEmpty(t, reply.Answer) {
+				a, ok := reply.Answer[0].(*dns.A)
+				assert.True(t, ok)
+				assert.True(t, tc.want.Equal(a.A), a.A)
+			}
+		})
+	}
+}
@@ -2,7 +2,9 @@ package dnsforward
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strconv"
@@ -423,17 +425,7 @@ func (s *Server) handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result := map[string]string{}
-
-	for _, host := range req.Upstreams {
-		err = checkDNS(host, req.BootstrapDNS)
-		if err != nil {
-			log.Info("%v", err)
-			result[host] = err.Error()
-		} else {
-			result[host] = "OK"
-		}
-	}
+	result := CheckUpstreams(req.Upstreams, req.BootstrapDNS)
 
 	jsonVal, err := json.Marshal(result)
 	if err != nil {
@@ -449,6 +441,23 @@ func (s *Server) handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// CheckUpstreams checks if the upstreams work using the bootstrap servers.  The
+// results map the upstreams to either "OK" or the error messages.
+func CheckUpstreams(upstreams, bootstrap []string) (results map[string]string) {
+	results = map[string]string{}
+	for _, host := range upstreams {
+		err := checkDNS(host, bootstrap)
+		if err != nil {
+			log.Info("%v", err)
+			results[host] = err.Error()
+		} else {
+			results[host] = "OK"
+		}
+	}
+
+	return results
+}
+
 func checkDNS(input string, bootstrap []string) error {
 	if !isUpstream(input) {
 		return nil
@@ -470,7 +479,7 @@ func checkDNS(input string, bootstrap []string) error {
 	}
 
 	if len(bootstrap) == 0 {
-		bootstrap = defaultBootstrap
+		bootstrap = DefaultBootstrap
 	}
 
 	log.Debug("checking if dns %s works...", input)
@@ -521,11 +530,56 @@ func (s *Server) handleDOH(w http.ResponseWriter, r *http.Request) {
 	s.ServeHTTP(w, r)
 }
 
+// cacheClearJSON is the request to clear the DNS cache.  Both fields are
+// optional.
+type cacheClearJSON struct {
+	Name  string `json:"name"`
+	QType string `json:"qtype"`
+}
+
+func (s *Server) handleCacheClear(w http.ResponseWriter, r *http.Request) {
+	req := cacheClearJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	}
+
+	var qtype uint16
+	if req.QType != "" {
+		if req.Name == "" {
+			httpError(r, w, http.StatusBadRequest, "qtype requires name")
+
+			return
+		}
+
+		var ok bool
+		qtype, ok = dns.StringToType[strings.ToUpper(req.QType)]
+		if !ok {
+			httpError(r, w, http.StatusBadRequest, "unknown qtype %q", req.QType)
+
+			return
+		}
+	}
+
+	err = s.ClearCache(req.Name, qtype)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "clearing cache: %s", err)
+
+		return
+	}
+
+	log.Debug("dns: cleared cache for %q, qtype %q", req.Name, req.QType)
+}
+
 func (s *Server) registerHandlers() {
 	s.conf.HTTPRegister(http.MethodGet, "/control/dns_info", s.handleGetConfig)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dns_config", s.handleSetConfig)
 	s.conf.HTTPRegister(http.MethodPost, "/control/test_upstream_dns", s.handleTestUpstreamDNS)
 
+	s.conf.HTTPRegister(http.MethodPost, "/control/cache/clear", s.handleCacheClear)
+
 	s.conf.HTTPRegister(http.MethodGet, "/control/access/list", s.handleAccessList)
 	s.conf.HTTPRegister(http.MethodPost, "/control/access/set", s.handleAccessSet)
 
@@ -0,0 +1,289 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// ifaceRefreshInterval is the interval between the refreshes of the addresses
+// of the network interfaces.
+const ifaceRefreshInterval = 1 * time.Minute
+
+// ifaceCtx determines the network interface on which the request has been
+// received and selects the upstream servers depending on it.
+type ifaceCtx struct {
+	// lock protects addrs and done.
+	lock sync.RWMutex
+
+	// addrs maps the IP addresses of the machine's network interfaces to
+	// their names.  It's refreshed periodically, see loop.
+	addrs map[string]string
+
+	// listenIPs are the addresses on which the plain DNS over UDP is
+	// served, if the server is configured to listen on all of them.  See
+	// udpListenAddrs.
+	listenIPs []net.IP
+
+	// upstreams maps the names of the network interfaces to the upstream
+	// configurations used for the requests received on them.
+	upstreams map[string]*proxy.UpstreamConfig
+
+	// onListenChange, if not nil, is called from the refresh loop once the
+	// addresses of the interfaces no longer match listenIPs.  It must not
+	// wait for the loop to stop.
+	onListenChange func()
+
+	// done stops the refresh loop.  It's nil if the loop isn't running.
+	done chan struct{}
+
+	// wg is used to wait for the refresh loop to exit.
+	wg sync.WaitGroup
+
+	// filtering shows if the requests are tagged with their inbound
+	// interfaces for the filtering rules.
+	filtering bool
+}
+
+// init parses the per-interface upstream configuration and gathers the
+// addresses of the network interfaces.  filtering shows if the requests must
+// be tagged with their inbound interfaces.
+func (c *ifaceCtx) init(ifaceUpstreams map[string][]string, filtering bool, bootstrap []string) (err error) {
+	c.stop()
+
+	c.addrs = nil
+	c.listenIPs = nil
+	c.upstreams = nil
+	c.filtering = filtering
+	if len(ifaceUpstreams) == 0 && !filtering {
+		return nil
+	}
+
+	c.upstreams = make(map[string]*proxy.UpstreamConfig, len(ifaceUpstreams))
+	for name, ups := range ifaceUpstreams {
+		var uc proxy.UpstreamConfig
+		uc, err = proxy.ParseUpstreamsConfig(ups, bootstrap, DefaultTimeout)
+		if err != nil {
+			return fmt.Errorf("dns: upstreams for interface %q: %w", name, err)
+		}
+
+		c.upstreams[name] = &uc
+	}
+
+	c.addrs = interfaceAddrs()
+	c.listenIPs = listenIPs(c.addrs)
+
+	return nil
+}
+
+// enabled returns true if the inbound interfaces of the requests are needed.
+func (c *ifaceCtx) enabled() (ok bool) {
+	return len(c.upstreams) > 0 || c.filtering
+}
+
+// interfaceAddrs returns the names of the network interfaces which are up by
+// their IP addresses.  The interfaces which may appear later, for example the
+// VPN ones, are picked up by the refresh loop.
+func interfaceAddrs() (addrs map[string]string) {
+	addrs = map[string]string{}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Info("dns: getting interfaces: %s", err)
+
+		return addrs
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		var ifaceAddrs []net.Addr
+		ifaceAddrs, err = iface.Addrs()
+		if err != nil {
+			log.Info("dns: getting addresses of interface %q: %s", iface.Name, err)
+
+			continue
+		}
+
+		for _, a := range ifaceAddrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				addrs[ipnet.IP.String()] = iface.Name
+			}
+		}
+	}
+
+	return addrs
+}
+
+// listenIPs returns the sorted addresses of addrs which can be listened on
+// without specifying the zone, so the IPv6 link-local ones are skipped.
+func listenIPs(addrs map[string]string) (ips []net.IP) {
+	for a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil || ip.To4() == nil && ip.IsLinkLocalUnicast() {
+			continue
+		}
+
+		ips = append(ips, ip)
+	}
+
+	sort.Slice(ips, func(i, j int) bool {
+		return ips[i].String() < ips[j].String()
+	})
+
+	return ips
+}
+
+// sameIPs returns true if a and b contain the same addresses in the same order.
+func sameIPs(a, b []net.IP) (ok bool) {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// udpListenAddrs returns the addresses to listen for plain DNS over UDP on
+// instead of addr.  The local address of a UDP listener on all addresses
+// doesn't tell the destination address of the requests, unlike the one of an
+// accepted TCP connection, and dnsproxy doesn't pass the destination address
+// from the packet control messages to the handlers.  So when the inbound
+// interfaces are needed, a UDP listener is made for each address of the
+// network interfaces instead.
+func (c *ifaceCtx) udpListenAddrs(addr *net.UDPAddr) (addrs []*net.UDPAddr) {
+	if !c.enabled() || addr == nil || len(addr.IP) != 0 && !addr.IP.IsUnspecified() || len(c.listenIPs) == 0 {
+		return []*net.UDPAddr{addr}
+	}
+
+	addrs = make([]*net.UDPAddr, 0, len(c.listenIPs))
+	for _, ip := range c.listenIPs {
+		addrs = append(addrs, &net.UDPAddr{IP: ip, Port: addr.Port})
+	}
+
+	return addrs
+}
+
+// refresh updates the addresses of the network interfaces.  It returns true if
+// the addresses to listen on have changed.
+func (c *ifaceCtx) refresh() (changed bool) {
+	addrs := interfaceAddrs()
+	ips := listenIPs(addrs)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.addrs = addrs
+
+	return !sameIPs(ips, c.listenIPs)
+}
+
+// start starts the periodic refreshes of the addresses of the network
+// interfaces.
+func (c *ifaceCtx) start() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.enabled() || c.done != nil {
+		return
+	}
+
+	c.done = make(chan struct{})
+	c.wg.Add(1)
+	go c.loop(c.done)
+}
+
+// stop stops the periodic refreshes and waits for the loop to exit.
+func (c *ifaceCtx) stop() {
+	c.lock.Lock()
+	done := c.done
+	c.done = nil
+	c.lock.Unlock()
+
+	if done == nil {
+		return
+	}
+
+	close(done)
+	c.wg.Wait()
+}
+
+// loop refreshes the addresses of the network interfaces every
+// ifaceRefreshInterval until done is closed.  Once the addresses to listen on
+// change, it calls onListenChange and exits, since the listeners are recreated
+// along with the loop.
+func (c *ifaceCtx) loop(done chan struct{}) {
+	defer c.wg.Done()
+
+	t := time.NewTicker(ifaceRefreshInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			// Go on.
+		}
+
+		if c.refresh() && c.onListenChange != nil {
+			log.Info("dns: addresses of the network interfaces have changed")
+			c.onListenChange()
+
+			return
+		}
+	}
+}
+
+// inboundInterface returns the name of the network interface on which the
+// request has been received, if it is known.  The interface is determined by
+// the local address of the connection, see udpListenAddrs.
+func (c *ifaceCtx) inboundInterface(d *proxy.DNSContext) (name string) {
+	if !c.enabled() || d.Conn == nil {
+		return ""
+	}
+
+	ip := IPFromAddr(d.Conn.LocalAddr())
+	if ip == nil || ip.IsUnspecified() {
+		return ""
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.addrs[ip.String()]
+}
+
+// upstreamsFor returns the upstream configuration for the requests received on
+// the interface with the given name.  It returns nil if there is none.
+func (c *ifaceCtx) upstreamsFor(name string) (uc *proxy.UpstreamConfig) {
+	if name == "" {
+		return nil
+	}
+
+	return c.upstreams[name]
+}
+
+// restartOnListenChange restarts the server, so that it listens on the current
+// addresses of the network interfaces.
+func (s *Server) restartOnListenChange() {
+	// Don't block the refresh loop, since the restart stops it.
+	go func() {
+		err := s.Reconfigure(nil)
+		if err != nil {
+			log.Error("dns: restarting on interface changes: %s", err)
+		}
+	}()
+}
@@ -0,0 +1,164 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// testConn is a net.Conn with a fixed local address.
+type testConn struct {
+	// Conn is embedded here simply to make testConn a net.Conn without
+	// actually implementing all methods.
+	net.Conn
+
+	localAddr net.Addr
+}
+
+// LocalAddr implements the net.Conn interface for *testConn.
+func (c *testConn) LocalAddr() (addr net.Addr) {
+	return c.localAddr
+}
+
+func TestIfaceCtx(t *testing.T) {
+	c := ifaceCtx{}
+	err := c.init(map[string][]string{
+		"tun0": {"1.1.1.1:53"},
+		"eth0": {"8.8.8.8:53"},
+	}, false, nil)
+	assert.Nil(t, err)
+
+	// Replace the real addresses with the test ones.
+	c.addrs = map[string]string{
+		"10.8.0.1":    "tun0",
+		"192.168.1.1": "eth0",
+	}
+
+	s := &Server{iface: c}
+
+	testCases := []struct {
+		name      string
+		localAddr net.Addr
+		wantIface string
+		wantUps   string
+	}{{
+		name:      "vpn",
+		localAddr: &net.TCPAddr{IP: net.IP{10, 8, 0, 1}, Port: 53},
+		wantIface: "tun0",
+		wantUps:   "1.1.1.1:53",
+	}, {
+		name:      "lan",
+		localAddr: &net.UDPAddr{IP: net.IP{192, 168, 1, 1}, Port: 53},
+		wantIface: "eth0",
+		wantUps:   "8.8.8.8:53",
+	}, {
+		name:      "unspecified",
+		localAddr: &net.UDPAddr{IP: net.IPv4zero, Port: 53},
+		wantIface: "",
+		wantUps:   "",
+	}, {
+		name:      "unknown",
+		localAddr: &net.TCPAddr{IP: net.IP{172, 16, 0, 1}, Port: 53},
+		wantIface: "",
+		wantUps:   "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := &dnsContext{
+				srv: s,
+				proxyCtx: &proxy.DNSContext{
+					Req:  createTestMessage("example.org."),
+					Conn: &testConn{localAddr: tc.localAddr},
+				},
+			}
+
+			rc := processInitial(ctx)
+			assert.Equal(t, resultCodeSuccess, rc)
+			assert.Equal(t, tc.wantIface, ctx.iface)
+
+			uc := s.iface.upstreamsFor(ctx.iface)
+			if tc.wantUps == "" {
+				assert.Nil(t, uc)
+
+				return
+			}
+
+			if assert.NotNil(t, uc) && assert.Len(t, uc.Upstreams, 1) {
+				assert.Equal(t, tc.wantUps, uc.Upstreams[0].Address())
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		err = (&ifaceCtx{}).init(map[string][]string{
+			"tun0": {"bad://upstream"},
+		}, false, nil)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestIfaceCtx_filtering(t *testing.T) {
+	s := createTestServer(t)
+	err := s.iface.init(nil, true, nil)
+	assert.Nil(t, err)
+
+	s.iface.addrs = map[string]string{"10.8.0.1": "tun0"}
+
+	ctx := &dnsContext{
+		srv: s,
+		proxyCtx: &proxy.DNSContext{
+			Req:  createTestMessage("example.org."),
+			Conn: &testConn{localAddr: &net.UDPAddr{IP: net.IP{10, 8, 0, 1}, Port: 53}},
+		},
+	}
+
+	assert.Equal(t, resultCodeSuccess, processInitial(ctx))
+	assert.Equal(t, "tun0", ctx.iface)
+	assert.Nil(t, s.iface.upstreamsFor(ctx.iface))
+
+	setts := s.getClientRequestFilteringSettings(ctx)
+	assert.Equal(t, "tun0", setts.Interface)
+}
+
+func TestIfaceCtx_udpListenAddrs(t *testing.T) {
+	c := &ifaceCtx{
+		listenIPs: listenIPs(map[string]string{
+			"10.8.0.1":    "tun0",
+			"192.168.1.1": "eth0",
+			"fe80::1":     "eth0",
+			"::1":         "lo",
+		}),
+		filtering: true,
+	}
+
+	assert.Equal(t, []*net.UDPAddr{
+		{IP: net.ParseIP("10.8.0.1"), Port: 53},
+		{IP: net.ParseIP("192.168.1.1"), Port: 53},
+		{IP: net.ParseIP("::1"), Port: 53},
+	}, c.udpListenAddrs(&net.UDPAddr{Port: 53}))
+	assert.Len(t, c.udpListenAddrs(&net.UDPAddr{IP: net.IPv4zero, Port: 53}), 3)
+
+	// The particular address is kept.
+	addr := &net.UDPAddr{IP: net.IP{192, 168, 1, 1}, Port: 53}
+	assert.Equal(t, []*net.UDPAddr{addr}, c.udpListenAddrs(addr))
+
+	// As well as all addresses if the interfaces aren't needed.
+	c.filtering = false
+	addr = &net.UDPAddr{Port: 53}
+	assert.Equal(t, []*net.UDPAddr{addr}, c.udpListenAddrs(addr))
+}
+
+func TestIfaceCtx_refresh(t *testing.T) {
+	c := &ifaceCtx{filtering: true}
+
+	// The addresses to listen on differ from the real ones.
+	c.listenIPs = []net.IP{{192, 0, 2, 1}}
+	assert.True(t, c.refresh())
+	assert.NotNil(t, c.addrs)
+
+	c.listenIPs = listenIPs(c.addrs)
+	assert.False(t, c.refresh())
+}
@@ -0,0 +1,71 @@
+package dnsforward
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// defaultLocalDomainName is the default local search domain of the DHCP
+// leases.
+const defaultLocalDomainName = "lan"
+
+// localNets are the networks of the local clients except the loopback and the
+// link-local ones.  See isLocalClient.
+var localNets = func() (nets []*net.IPNet) {
+	for _, s := range []string{
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"fc00::/7",
+	} {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets
+}()
+
+// isLocalClient returns true if ip is an address from a local network.
+func isLocalClient(ip net.IP) (ok bool) {
+	if ip == nil {
+		return false
+	}
+
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+
+	for _, n := range localNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// leaseHost returns the lowercased hostname of a lease which the question
+// name qname refers to.  The names within the local domain refer to the leases
+// for all clients.  The single-label names refer to them only for the local
+// clients, as if the local domain, which is the search domain they get from
+// the DHCP server, was appended to them, in which case qualified is true.
+func (s *Server) leaseHost(qname string, clientIP net.IP) (host string, qualified, ok bool) {
+	host = strings.ToLower(qname)
+	suffix := "." + strings.ToLower(s.conf.LocalDomainName) + "."
+	if strings.HasSuffix(host, suffix) {
+		return strings.TrimSuffix(host, suffix), false, true
+	}
+
+	if dns.CountLabel(host) == 1 && isLocalClient(clientIP) {
+		return strings.TrimSuffix(host, "."), true, true
+	}
+
+	return "", false, false
+}
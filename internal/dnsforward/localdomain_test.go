@@ -0,0 +1,66 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_leaseHost(t *testing.T) {
+	s := &Server{}
+	s.conf.LocalDomainName = "Home.Arpa"
+
+	testCases := []struct {
+		name          string
+		qname         string
+		clientIP      net.IP
+		wantHost      string
+		wantQualified bool
+		wantOK        bool
+	}{{
+		name:          "qualified",
+		qname:         "Laptop.home.arpa.",
+		clientIP:      net.IP{1, 2, 3, 4},
+		wantHost:      "laptop",
+		wantQualified: false,
+		wantOK:        true,
+	}, {
+		name:          "single_label_local",
+		qname:         "laptop.",
+		clientIP:      net.IP{192, 168, 1, 2},
+		wantHost:      "laptop",
+		wantQualified: true,
+		wantOK:        true,
+	}, {
+		name:          "single_label_local_ipv6",
+		qname:         "laptop.",
+		clientIP:      net.ParseIP("fd00::2"),
+		wantHost:      "laptop",
+		wantQualified: true,
+		wantOK:        true,
+	}, {
+		name:          "single_label_external",
+		qname:         "laptop.",
+		clientIP:      net.IP{1, 2, 3, 4},
+		wantHost:      "",
+		wantQualified: false,
+		wantOK:        false,
+	}, {
+		name:          "other_domain",
+		qname:         "laptop.lan.",
+		clientIP:      net.IP{192, 168, 1, 2},
+		wantHost:      "",
+		wantQualified: false,
+		wantOK:        false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			host, qualified, ok := s.leaseHost(tc.qname, tc.clientIP)
+			assert.Equal(t, tc.wantHost, host)
+			assert.Equal(t, tc.wantQualified, qualified)
+			assert.Equal(t, tc.wantOK, ok)
+		})
+	}
+}
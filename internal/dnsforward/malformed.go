@@ -0,0 +1,145 @@
+package dnsforward
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// errMalformedResponse is returned when the upstream servers have returned
+// the responses which couldn't be parsed and the retries haven't helped.
+const errMalformedResponse agherr.Error = "malformed upstream response"
+
+// isMalformedResponse returns true if err is caused by a response which
+// couldn't be parsed, for example a truncated one or one with a bad
+// compression pointer.
+func isMalformedResponse(err error) (ok bool) {
+	var dnsErr *dns.Error
+
+	return errors.As(err, &dnsErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// upstreamsForDomain returns the upstream servers from uc used for the
+// requests for host, which is a fully qualified domain name.
+func upstreamsForDomain(uc *proxy.UpstreamConfig, host string) (ups []upstream.Upstream) {
+	host = strings.ToLower(host)
+	for name := host; name != ""; {
+		if reserved, ok := uc.DomainReservedUpstreams[name]; ok {
+			if len(reserved) == 0 {
+				// The domain is excluded from the reserved
+				// upstreams, so the default ones are used.
+				break
+			}
+
+			return reserved
+		}
+
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+
+		name = name[i+1:]
+	}
+
+	return uc.Upstreams
+}
+
+// failedUpstreams returns the upstream servers from uc which have just failed
+// to answer the request of d.  dnsproxy only sets d.Upstream on success, and
+// it tries all the upstream servers for the request before returning an error,
+// so all of them are considered failed unless d.Upstream is set.
+func failedUpstreams(d *proxy.DNSContext, uc *proxy.UpstreamConfig) (failed []upstream.Upstream) {
+	if d.Upstream != nil {
+		return []upstream.Upstream{d.Upstream}
+	}
+
+	if uc == nil {
+		return nil
+	}
+
+	return upstreamsForDomain(uc, d.Req.Question[0].Name)
+}
+
+// retryCandidates returns the upstream servers for the request of d from uc
+// and the upstream pools which aren't in failed.
+func (s *Server) retryCandidates(d *proxy.DNSContext, uc *proxy.UpstreamConfig, failed []upstream.Upstream) (ups []upstream.Upstream) {
+	seen := map[upstream.Upstream]bool{}
+	for _, u := range failed {
+		seen[u] = true
+	}
+
+	ucs := append([]*proxy.UpstreamConfig{uc}, s.pools.configs()...)
+	for _, c := range ucs {
+		if c == nil {
+			continue
+		}
+
+		for _, u := range upstreamsForDomain(c, d.Req.Question[0].Name) {
+			if !seen[u] {
+				seen[u] = true
+				ups = append(ups, u)
+			}
+		}
+	}
+
+	return ups
+}
+
+// retryMalformed handles err, which is a malformed response returned by
+// dnsproxy for the request of d.  The upstream servers which have just failed
+// are reported to the upstream pools as failed, and the request is resent to
+// the other upstream servers, including the ones of the other pools, one by
+// one, until a parseable response is received or s.conf.MalformedResponseRetries
+// attempts are made.  The upstream servers which have just failed aren't
+// retried.
+func (s *Server) retryMalformed(d *proxy.DNSContext, err error) (retryErr error) {
+	uc := d.CustomUpstreamConfig
+	if uc == nil {
+		uc = s.defaultUpstreamConfig()
+	}
+
+	failed := failedUpstreams(d, uc)
+	for _, u := range failed {
+		s.pools.reportFailure(u)
+	}
+
+	if s.conf.MalformedResponseRetries == 0 {
+		return err
+	}
+
+	ups := s.retryCandidates(d, uc, failed)
+	if len(ups) == 0 {
+		return fmt.Errorf("%w: no other upstreams to retry, last error: %s", errMalformedResponse, err)
+	}
+
+	retries := int(s.conf.MalformedResponseRetries)
+	if retries > len(ups) {
+		retries = len(ups)
+	}
+
+	for _, u := range ups[:retries] {
+		var resp *dns.Msg
+		resp, err = u.Exchange(d.Req.Copy())
+		if err == nil {
+			d.Res = resp
+			d.Upstream = u
+
+			return nil
+		}
+
+		log.Debug("dns: retrying malformed response with %s: %s", u.Address(), err)
+		if isMalformedResponse(err) {
+			s.pools.reportFailure(u)
+		}
+	}
+
+	return fmt.Errorf("%w: %d retries failed, last error: %s", errMalformedResponse, retries, err)
+}
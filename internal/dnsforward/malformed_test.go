@@ -0,0 +1,209 @@
+package dnsforward
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// garbageUpstream is an upstream which always responds with the data which
+// can't be parsed.
+type garbageUpstream struct {
+	calls uint32
+}
+
+// Exchange implements the upstream.Upstream interface for *garbageUpstream.
+func (u *garbageUpstream) Exchange(_ *dns.Msg) (*dns.Msg, error) {
+	atomic.AddUint32(&u.calls, 1)
+
+	resp := &dns.Msg{}
+	err := resp.Unpack([]byte{0x12, 0x34, 0x81, 0x80, 0x00, 0x01, 0x00})
+
+	return nil, err
+}
+
+// Address implements the upstream.Upstream interface for *garbageUpstream.
+func (u *garbageUpstream) Address() string {
+	return "garbage"
+}
+
+func TestIsMalformedResponse(t *testing.T) {
+	_, err := (&garbageUpstream{}).Exchange(nil)
+	assert.True(t, isMalformedResponse(err))
+
+	assert.False(t, isMalformedResponse(testTimeoutError{}))
+}
+
+func TestUpstreamsForDomain(t *testing.T) {
+	def, reserved := &recordUpstream{}, &recordUpstream{}
+	uc := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{def},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"example.org.":     {reserved},
+			"pub.example.org.": nil,
+		},
+	}
+
+	ups := upstreamsForDomain(uc, "WWW.Example.org.")
+	if assert.Len(t, ups, 1) {
+		assert.Same(t, reserved, ups[0])
+	}
+
+	ups = upstreamsForDomain(uc, "www.pub.example.org.")
+	if assert.Len(t, ups, 1) {
+		assert.Same(t, def, ups[0])
+	}
+
+	ups = upstreamsForDomain(uc, "example.com.")
+	if assert.Len(t, ups, 1) {
+		assert.Same(t, def, ups[0])
+	}
+}
+
+func TestServer_retryMalformed(t *testing.T) {
+	garbage, healthy := &garbageUpstream{}, &recordUpstream{}
+
+	s := createTestServer(t)
+	s.conf.MalformedResponseRetries = 2
+	err := s.Prepare(nil)
+	assert.Nil(t, err)
+	s.dnsProxy.UpstreamConfig = &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{garbage, healthy},
+	}
+
+	_, malformed := garbage.Exchange(nil)
+	atomic.StoreUint32(&garbage.calls, 0)
+
+	d := &proxy.DNSContext{
+		Req:      createTestMessage("example.org."),
+		Upstream: garbage,
+	}
+
+	err = s.retryMalformed(d, malformed)
+	assert.Nil(t, err)
+	assert.Same(t, healthy, d.Upstream)
+	if assert.NotNil(t, d.Res) {
+		assert.Len(t, d.Res.Answer, 1)
+	}
+
+	// The failed upstream isn't retried.
+	assert.Equal(t, uint32(0), atomic.LoadUint32(&garbage.calls))
+	assert.Equal(t, []string{"example.org."}, healthy.received())
+
+	// All upstreams have failed if the failed one isn't known.
+	d = &proxy.DNSContext{
+		Req: createTestMessage("example.org."),
+	}
+
+	err = s.retryMalformed(d, malformed)
+	assert.True(t, errors.Is(err, errMalformedResponse))
+	assert.Nil(t, d.Res)
+	assert.Equal(t, uint32(0), atomic.LoadUint32(&garbage.calls))
+	assert.Equal(t, []string{"example.org."}, healthy.received())
+}
+
+func TestServer_malformedResponse(t *testing.T) {
+	t.Run("retry", func(t *testing.T) {
+		garbage1, garbage2, healthy := &garbageUpstream{}, &garbageUpstream{}, &recordUpstream{}
+
+		s := createTestServer(t)
+		s.conf.MalformedResponseRetries = 2
+		s.conf.UpstreamPools = []UpstreamPool{{
+			Name:      "primary",
+			Upstreams: []string{"127.0.0.1:1", "127.0.0.1:2"},
+			Priority:  1,
+		}, {
+			Name:      "secondary",
+			Upstreams: []string{"127.0.0.1:3"},
+			Priority:  2,
+		}}
+		err := s.Prepare(nil)
+		assert.Nil(t, err)
+
+		ucs := s.pools.configs()
+		if !assert.Len(t, ucs, 2) {
+			return
+		}
+		ucs[0].Upstreams = []upstream.Upstream{garbage1, garbage2}
+		ucs[1].Upstreams = []upstream.Upstream{healthy}
+
+		err = s.dnsProxy.Start()
+		assert.Nil(t, err)
+		t.Cleanup(func() { _ = s.Stop() })
+
+		req := createTestMessage("example.org.")
+		reply, err := dns.Exchange(req, s.dnsProxy.Addr(proxy.ProtoUDP).String())
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		assert.Len(t, reply.Answer, 1)
+
+		// Both upstreams of the primary pool have failed, so they
+		// aren't retried, and the request is resent to the secondary
+		// one.
+		assert.Equal(t, uint32(1), atomic.LoadUint32(&garbage1.calls))
+		assert.Equal(t, uint32(1), atomic.LoadUint32(&garbage2.calls))
+		assert.Equal(t, []string{"example.org."}, healthy.received())
+
+		s.pools.lock.Lock()
+		failed := s.pools.pools[0].failed
+		s.pools.lock.Unlock()
+		assert.True(t, failed)
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		garbage := &garbageUpstream{}
+
+		s := createTestServer(t)
+		s.conf.EnableEDE = true
+		s.conf.MalformedResponseRetries = 2
+		err := s.startWithUpstream(garbage)
+		assert.Nil(t, err)
+		t.Cleanup(func() { _ = s.Stop() })
+
+		req := createTestMessage("example.org.")
+		req.SetEdns0(4096, false)
+		reply, err := dns.Exchange(req, s.dnsProxy.Addr(proxy.ProtoUDP).String())
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeServerFailure, reply.Rcode)
+
+		code, ok := edeCode(reply)
+		assert.True(t, ok)
+		assert.Equal(t, edeNetworkError, code)
+
+		// The only upstream has failed, so there is nothing to retry.
+		assert.Equal(t, uint32(1), atomic.LoadUint32(&garbage.calls))
+	})
+}
+
+func TestPoolsCtx_reportFailure(t *testing.T) {
+	u := &healthUpstream{}
+	c := &poolsCtx{
+		pools: []*upstreamPool{{
+			conf:    &proxy.UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+			name:    "primary",
+			healthy: true,
+		}},
+	}
+	c.active = c.pools[0]
+
+	c.reportFailure(&healthUpstream{})
+	assert.False(t, c.pools[0].failed)
+
+	c.reportFailure(u)
+	assert.True(t, c.pools[0].failed)
+
+	// The malformed response fails the health check even though the
+	// upstream answers it.
+	c.update(time.Now())
+	assert.False(t, c.pools[0].healthy)
+	assert.False(t, c.pools[0].failed)
+
+	c.update(time.Now())
+	assert.True(t, c.pools[0].healthy)
+}
@@ -30,8 +30,13 @@ func (s *Server) makeResponse(req *dns.Msg) (resp *dns.Msg) {
 func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Result) *dns.Msg {
 	m := d.Req
 
+	mode := result.BlockingMode
+	if mode == "" {
+		mode = s.conf.BlockingMode
+	}
+
 	if m.Question[0].Qtype != dns.TypeA && m.Question[0].Qtype != dns.TypeAAAA {
-		if s.conf.BlockingMode == "null_ip" {
+		if mode == "null_ip" {
 			return s.makeResponse(m)
 		}
 		return s.genNXDomain(m)
@@ -52,33 +57,48 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 			return s.genResponseWithIP(m, result.Rules[0].IP)
 		}
 
-		if s.conf.BlockingMode == "null_ip" {
+		if mode == "null_ip" {
 			// it means that we should return 0.0.0.0 or :: for any blocked request
 			return s.makeResponseNullIP(m)
-		} else if s.conf.BlockingMode == "custom_ip" {
+		} else if mode == "custom_ip" {
 			// means that we should return custom IP for any blocked request
 
+			if result.BlockingMode != "" {
+				if len(result.BlockingIPs) == 0 {
+					return s.makeResponse(m)
+				}
+
+				return s.genResponseWithIP(m, result.BlockingIPs[0])
+			}
+
 			switch m.Question[0].Qtype {
 			case dns.TypeA:
 				return s.genARecord(m, s.conf.BlockingIPv4)
 			case dns.TypeAAAA:
 				return s.genAAAARecord(m, s.conf.BlockingIPv6)
 			}
-		} else if s.conf.BlockingMode == "nxdomain" {
+		} else if mode == "nxdomain" {
 			// means that we should return NXDOMAIN for any blocked request
 
 			return s.genNXDomain(m)
-		} else if s.conf.BlockingMode == "refused" {
+		} else if mode == "refused" {
 			// means that we should return NXDOMAIN for any blocked request
 
 			return s.makeResponseREFUSED(m)
 		}
 
 		// Default blocking mode
-		// If there's an IP specified in the rule, return it
+		// If there are IPs specified in the rules, return them
 		// For host-type rules, return null IP
 		if len(result.Rules) > 0 && result.Rules[0].IP != nil {
-			return s.genResponseWithIP(m, result.Rules[0].IP)
+			resp := s.genResponseWithRulesIPs(m, result.Rules)
+			if result.TTL != 0 {
+				for _, ans := range resp.Answer {
+					ans.Header().Ttl = result.TTL
+				}
+			}
+
+			return resp
 		}
 
 		return s.makeResponseNullIP(m)
@@ -170,6 +190,29 @@ func (s *Server) genResponseWithIP(req *dns.Msg, ip net.IP) *dns.Msg {
 	return resp
 }
 
+// genResponseWithRulesIPs returns a response with the IP addresses of the
+// rules, which match the question type.  There may be several such rules in
+// the /etc/hosts syntax, depending on the dnsfilter.Config.EtcHostsDuplicates
+// and dnsfilter.Config.HostsRoundRobin.
+func (s *Server) genResponseWithRulesIPs(req *dns.Msg, rules []*dnsfilter.ResultRule) (resp *dns.Msg) {
+	resp = s.makeResponse(req)
+	for _, r := range rules {
+		ip := r.IP
+		switch req.Question[0].Qtype {
+		case dns.TypeA:
+			if ip4 := ip.To4(); ip4 != nil {
+				resp.Answer = append(resp.Answer, s.genAnswerA(req, ip4))
+			}
+		case dns.TypeAAAA:
+			if len(ip) == net.IPv6len && ip.To4() == nil {
+				resp.Answer = append(resp.Answer, s.genAnswerAAAA(req, ip))
+			}
+		}
+	}
+
+	return resp
+}
+
 // Respond with 0.0.0.0 for A, :: for AAAA, empty response for other types
 func (s *Server) makeResponseNullIP(req *dns.Msg) *dns.Msg {
 	if req.Question[0].Qtype == dns.TypeA {
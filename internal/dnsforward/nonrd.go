@@ -0,0 +1,73 @@
+package dnsforward
+
+import (
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// Modes of handling the queries with the RD bit cleared, see
+// FilteringConfig.NonRDMode.
+const (
+	// nonRDModeForward means that such queries are forwarded as is.  It's
+	// the default.
+	nonRDModeForward = "forward"
+
+	// nonRDModeRefuse means that such queries are refused.
+	nonRDModeRefuse = "refuse"
+
+	// nonRDModeCacheOnly means that such queries are only answered from the
+	// cache and refused if the response isn't cached.
+	nonRDModeCacheOnly = "cache_only"
+)
+
+// errNotCached is returned by cacheOnlyUpstream for the queries which must
+// only be answered from the cache.
+const errNotCached agherr.Error = "no cached response for non-recursive query"
+
+// cacheOnlyUpstream is an upstream which doesn't forward the queries with the
+// RD bit cleared, so that they're only answered from the cache of the proxy.
+type cacheOnlyUpstream struct {
+	upstream.Upstream
+}
+
+// Exchange implements the upstream.Upstream interface for *cacheOnlyUpstream.
+func (u *cacheOnlyUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	if !req.RecursionDesired {
+		return nil, errNotCached
+	}
+
+	return u.Upstream.Exchange(req)
+}
+
+// nonRDUpstreams wraps ups into the upstreams which don't forward the
+// non-recursive queries if they must only be answered from the cache.  Empty
+// ups are returned as is, since nil ones have a special meaning for the
+// reserved domains.
+func (s *Server) nonRDUpstreams(ups []upstream.Upstream) (res []upstream.Upstream) {
+	if s.conf.NonRDMode != nonRDModeCacheOnly || len(ups) == 0 {
+		return ups
+	}
+
+	res = make([]upstream.Upstream, len(ups))
+	for i, u := range ups {
+		res[i] = &cacheOnlyUpstream{Upstream: u}
+	}
+
+	return res
+}
+
+// nonRDUpstreamConfig wraps both the general and the reserved domains'
+// upstreams of uc using nonRDUpstreams.
+func (s *Server) nonRDUpstreamConfig(uc *proxy.UpstreamConfig) {
+	uc.Upstreams = s.nonRDUpstreams(uc.Upstreams)
+	for d, ups := range uc.DomainReservedUpstreams {
+		uc.DomainReservedUpstreams[d] = s.nonRDUpstreams(ups)
+	}
+}
+
+// isCacheOnly returns true if req must only be answered from the cache.
+func (s *Server) isCacheOnly(req *dns.Msg) (ok bool) {
+	return !req.RecursionDesired && s.conf.NonRDMode == nonRDModeCacheOnly
+}
@@ -0,0 +1,121 @@
+package dnsforward
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_nonRDMode(t *testing.T) {
+	// reserved is the upstream for reserved.example.
+	reserved := &recordUpstream{}
+
+	startServer := func(t *testing.T, mode string, u upstream.Upstream) (addr string) {
+		t.Helper()
+
+		s := createTestServer(t)
+		s.conf.NonRDMode = mode
+		s.conf.CacheSize = 4096
+		err := s.Prepare(nil)
+		assert.Nil(t, err)
+		uc := &proxy.UpstreamConfig{
+			Upstreams: []upstream.Upstream{u},
+			DomainReservedUpstreams: map[string][]upstream.Upstream{
+				"reserved.example.": {reserved},
+			},
+		}
+		s.nonRDUpstreamConfig(uc)
+		s.dnsProxy.UpstreamConfig = uc
+		err = s.dnsProxy.Start()
+		assert.Nil(t, err)
+		t.Cleanup(func() { _ = s.Stop() })
+
+		return s.dnsProxy.Addr(proxy.ProtoUDP).String()
+	}
+
+	newReq := func(name string, rd bool) (req *dns.Msg) {
+		req = createTestMessage(name)
+		req.RecursionDesired = rd
+
+		return req
+	}
+
+	t.Run("refuse", func(t *testing.T) {
+		u := &recordUpstream{}
+		addr := startServer(t, nonRDModeRefuse, u)
+
+		reply, err := dns.Exchange(newReq("example.org.", false), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+		assert.Empty(t, u.names)
+
+		reply, err = dns.Exchange(newReq("example.org.", true), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		assert.Len(t, u.names, 1)
+	})
+
+	t.Run("forward", func(t *testing.T) {
+		u := &recordUpstream{}
+		addr := startServer(t, nonRDModeForward, u)
+
+		reply, err := dns.Exchange(newReq("example.org.", false), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		assert.Len(t, reply.Answer, 1)
+		assert.Equal(t, []string{"example.org."}, u.names)
+	})
+
+	t.Run("cache_only", func(t *testing.T) {
+		u := &recordUpstream{}
+		addr := startServer(t, nonRDModeCacheOnly, u)
+
+		reply, err := dns.Exchange(newReq("example.org.", false), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+		assert.Empty(t, u.names)
+
+		// Put the response into the cache.
+		reply, err = dns.Exchange(newReq("example.org.", true), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+
+		reply, err = dns.Exchange(newReq("example.org.", false), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		assert.Len(t, reply.Answer, 1)
+		assert.Len(t, u.names, 1)
+
+		// The upstreams for the reserved domains don't forward them
+		// either.
+		reply, err = dns.Exchange(newReq("reserved.example.", false), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+		assert.Empty(t, reserved.names)
+		assert.Len(t, u.names, 1)
+	})
+}
+
+func TestServer_nonRDUpstreamConfig(t *testing.T) {
+	s := &Server{}
+	s.conf.NonRDMode = nonRDModeCacheOnly
+
+	u := &recordUpstream{}
+	uc := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{u},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"reserved.example.":          {u},
+			"excluded.reserved.example.": nil,
+		},
+	}
+	s.nonRDUpstreamConfig(uc)
+
+	assert.IsType(t, &cacheOnlyUpstream{}, uc.Upstreams[0])
+	if ups := uc.DomainReservedUpstreams["reserved.example."]; assert.Len(t, ups, 1) {
+		assert.IsType(t, &cacheOnlyUpstream{}, ups[0])
+	}
+	assert.Nil(t, uc.DomainReservedUpstreams["excluded.reserved.example."])
+}
@@ -0,0 +1,70 @@
+package dnsforward
+
+import (
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// defaultEDNSPaddingBlockSize is the block size recommended for the responses
+// by RFC 8467.
+const defaultEDNSPaddingBlockSize = 468
+
+// paddingOptLen is the length of the header of the EDNS padding option.
+const paddingOptLen = 4
+
+// isEncryptedProto returns true if the queries received over proto are
+// encrypted.  DNSCrypt is not included, since it has its own padding.
+func isEncryptedProto(proto string) (ok bool) {
+	return proto == proxy.ProtoTLS || proto == proxy.ProtoHTTPS || proto == proxy.ProtoQUIC
+}
+
+// padResponse pads resp with the EDNS padding option, so that its length
+// becomes a multiple of blockSize.  The previous padding, if any, is removed.
+// reqOpt is the OPT record of the request.
+func padResponse(resp *dns.Msg, reqOpt *dns.OPT, blockSize int) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		opt = resp.IsEdns0()
+	}
+
+	opts := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0PADDING {
+			opts = append(opts, o)
+		}
+	}
+	opt.Option = opts
+
+	l := resp.Len() + paddingOptLen
+	padLen := (blockSize - l%blockSize) % blockSize
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, padLen)})
+}
+
+// processEDNSPadding pads the response sent over an encrypted transport to the
+// configured block size, if the request supports EDNS.  It must be the last
+// one to modify the response, since any later change would break the
+// padding.
+func processEDNSPadding(ctx *dnsContext) (rc resultCode) {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if !s.conf.EDNSPadding || d.Res == nil || !isEncryptedProto(d.Proto) {
+		return resultCodeSuccess
+	}
+
+	reqOpt := d.Req.IsEdns0()
+	if reqOpt == nil {
+		return resultCodeSuccess
+	}
+
+	blockSize := int(s.conf.EDNSPaddingBlockSize)
+	if blockSize == 0 {
+		blockSize = defaultEDNSPaddingBlockSize
+	}
+
+	// The response is sent compressed, so compute the length accordingly.
+	d.Res.Compress = true
+	padResponse(d.Res, reqOpt, blockSize)
+
+	return resultCodeSuccess
+}
@@ -0,0 +1,116 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessEDNSPadding(t *testing.T) {
+	const blockSize = 128
+
+	newResp := func(req *dns.Msg) (resp *dns.Msg) {
+		resp = &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   req.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			A: net.IP{1, 2, 3, 4},
+		}}
+
+		return resp
+	}
+
+	ednsReq := createTestMessage("example.org.")
+	ednsReq.SetEdns0(4096, false)
+
+	testCases := []struct {
+		name       string
+		proto      string
+		req        *dns.Msg
+		wantPadded bool
+	}{{
+		name:       "tls",
+		proto:      proxy.ProtoTLS,
+		req:        ednsReq,
+		wantPadded: true,
+	}, {
+		name:       "https",
+		proto:      proxy.ProtoHTTPS,
+		req:        ednsReq,
+		wantPadded: true,
+	}, {
+		name:       "udp",
+		proto:      proxy.ProtoUDP,
+		req:        ednsReq,
+		wantPadded: false,
+	}, {
+		name:       "tls_no_edns",
+		proto:      proxy.ProtoTLS,
+		req:        createTestMessage("example.org."),
+		wantPadded: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &dnsContext{
+				srv: &Server{
+					conf: ServerConfig{
+						FilteringConfig: FilteringConfig{
+							EDNSPadding:          true,
+							EDNSPaddingBlockSize: blockSize,
+						},
+					},
+				},
+				proxyCtx: &proxy.DNSContext{
+					Proto: tc.proto,
+					Req:   tc.req,
+					Res:   newResp(tc.req),
+				},
+			}
+
+			assert.Equal(t, resultCodeSuccess, processEDNSPadding(dctx))
+
+			packed, err := dctx.proxyCtx.Res.Pack()
+			assert.Nil(t, err)
+
+			padded := false
+			if opt := dctx.proxyCtx.Res.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					padded = padded || o.Option() == dns.EDNS0PADDING
+				}
+			}
+
+			assert.Equal(t, tc.wantPadded, padded)
+			if tc.wantPadded {
+				assert.Zero(t, len(packed)%blockSize)
+			}
+		})
+	}
+}
+
+func TestPadResponse_replace(t *testing.T) {
+	req := createTestMessage("example.org.")
+	req.SetEdns0(4096, false)
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Compress = true
+	resp.SetEdns0(4096, false)
+	opt := resp.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 1000)})
+
+	padResponse(resp, req.IsEdns0(), defaultEDNSPaddingBlockSize)
+
+	packed, err := resp.Pack()
+	assert.Nil(t, err)
+	assert.Len(t, packed, defaultEDNSPaddingBlockSize)
+	assert.Len(t, resp.IsEdns0().Option, 1)
+}
@@ -0,0 +1,369 @@
+package dnsforward
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Default settings of the upstream pools health checks.
+const (
+	defaultPoolsCheckInterval = 10 * time.Second
+	defaultPoolsRecovery      = 60 * time.Second
+)
+
+// UpstreamPool is a group of upstream servers used instead of the default ones
+// while it's the most preferred healthy pool.
+type UpstreamPool struct {
+	// Name is the name of the pool used in the logs.
+	Name string `yaml:"name"`
+
+	// Upstreams are the upstream servers of the pool.
+	Upstreams []string `yaml:"upstreams"`
+
+	// Priority is the priority of the pool.  The pools with lower values
+	// are preferred.
+	Priority int `yaml:"priority"`
+}
+
+// upstreamPool is a parsed UpstreamPool along with its health state.
+type upstreamPool struct {
+	conf *proxy.UpstreamConfig
+
+	// healthySince is the time of the first successful health check after
+	// the last failed one.  It's zero if the pool has never failed.
+	healthySince time.Time
+
+	name     string
+	priority int
+	healthy  bool
+
+	// failed is true if an upstream of the pool has returned a malformed
+	// response since the last health check, which makes the pool fail it.
+	failed bool
+}
+
+// poolsCtx selects the upstream pool depending on the health of the pools.  The
+// most preferred pool which is healthy is used, but a pool which has failed is
+// only promoted back after it has stayed healthy during the recovery window.
+type poolsCtx struct {
+	// lock protects pools, active, the health state of the pools, and done.
+	lock sync.Mutex
+
+	// pools are sorted by priority.
+	pools  []*upstreamPool
+	active *upstreamPool
+
+	// done stops the health checks loop.  It's nil if the loop isn't
+	// running.
+	done chan struct{}
+
+	// wg is used to wait for the health checks loop to exit.
+	wg sync.WaitGroup
+
+	// onSwitch, if not nil, is called with the upstream configuration of
+	// the new active pool each time the active pool changes.  It's called
+	// from the health checks loop without the lock held.
+	onSwitch func(uc *proxy.UpstreamConfig)
+
+	interval time.Duration
+	recovery time.Duration
+}
+
+// init parses the pools configuration.  intervalSec and recoverySec are the
+// interval of the health checks and the recovery window in seconds, zero
+// values mean the defaults.  The health checks are stopped and the upstreams
+// of the previous pools are closed.
+func (c *poolsCtx) init(pools []UpstreamPool, bootstrap []string, intervalSec, recoverySec uint32) (err error) {
+	c.stop()
+
+	var parsed []*upstreamPool
+	defer func() {
+		if err != nil {
+			for _, p := range parsed {
+				closeUpstreams(p.conf.Upstreams)
+			}
+
+			parsed = nil
+		}
+
+		c.lock.Lock()
+		prev := c.pools
+		c.pools, c.active = parsed, nil
+		if len(parsed) > 0 {
+			c.active = parsed[0]
+		}
+		c.lock.Unlock()
+
+		for _, p := range prev {
+			closeUpstreams(p.conf.Upstreams)
+		}
+	}()
+
+	if len(pools) == 0 {
+		return nil
+	}
+
+	c.interval = defaultPoolsCheckInterval
+	if intervalSec != 0 {
+		c.interval = time.Duration(intervalSec) * time.Second
+	}
+
+	c.recovery = defaultPoolsRecovery
+	if recoverySec != 0 {
+		c.recovery = time.Duration(recoverySec) * time.Second
+	}
+
+	for i, p := range pools {
+		if len(p.Upstreams) == 0 {
+			return fmt.Errorf("dns: upstream pool %q at index %d: no upstreams", p.Name, i)
+		}
+
+		var uc proxy.UpstreamConfig
+		uc, err = proxy.ParseUpstreamsConfig(p.Upstreams, bootstrap, DefaultTimeout)
+		if err != nil {
+			return fmt.Errorf("dns: upstream pool %q at index %d: %w", p.Name, i, err)
+		}
+
+		parsed = append(parsed, &upstreamPool{
+			conf:     &uc,
+			name:     p.Name,
+			priority: p.Priority,
+			healthy:  true,
+		})
+	}
+
+	sort.SliceStable(parsed, func(i, j int) bool {
+		return parsed[i].priority < parsed[j].priority
+	})
+
+	return nil
+}
+
+// upstreamConfig returns the upstream configuration of the active pool.  It
+// returns nil if there are no pools.
+func (c *poolsCtx) upstreamConfig() (uc *proxy.UpstreamConfig) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.active == nil {
+		return nil
+	}
+
+	return c.active.conf
+}
+
+// configs returns the upstream configurations of all pools.
+func (c *poolsCtx) configs() (ucs []*proxy.UpstreamConfig) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, p := range c.pools {
+		ucs = append(ucs, p.conf)
+	}
+
+	return ucs
+}
+
+// defaultUpstreamConfig returns the upstream configuration which the proxy
+// uses for the queries without custom upstreams, that is the configuration of
+// the active upstream pool, if there are pools, or the configured one.
+func (s *Server) defaultUpstreamConfig() (uc *proxy.UpstreamConfig) {
+	uc = s.pools.upstreamConfig()
+	if uc != nil {
+		return uc
+	}
+
+	return s.dnsProxy.UpstreamConfig
+}
+
+// setProxyUpstreams makes the active upstream pool the default upstreams of
+// p, so that the queries are still answered from the cache of p, which it only
+// uses for the default upstreams.
+func (s *Server) setProxyUpstreams(p *proxy.Proxy) {
+	s.pools.onSwitch = nil
+
+	uc := s.pools.upstreamConfig()
+	if uc == nil {
+		return
+	}
+
+	p.UpstreamConfig = uc
+	s.pools.onSwitch = func(uc *proxy.UpstreamConfig) {
+		p.Lock()
+		defer p.Unlock()
+
+		p.UpstreamConfig = uc
+	}
+}
+
+// checkUpstreams returns true if at least one of ups answers the health check
+// query.
+func checkUpstreams(ups []upstream.Upstream) (ok bool) {
+	req := &dns.Msg{}
+	req.SetQuestion(".", dns.TypeNS)
+
+	for _, u := range ups {
+		_, err := u.Exchange(req.Copy())
+		if err == nil {
+			return true
+		}
+
+		log.Debug("dns: health check of upstream %s: %s", u.Address(), err)
+	}
+
+	return false
+}
+
+// reportFailure marks the pool containing u as failed until the next health
+// check.  It does nothing if u doesn't belong to any pool.
+func (c *poolsCtx) reportFailure(u upstream.Upstream) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, p := range c.pools {
+		for _, pu := range p.conf.Upstreams {
+			if pu == u {
+				p.failed = true
+
+				return
+			}
+		}
+	}
+}
+
+// update checks the health of the pools and selects the active one.  now is the
+// time of the check.
+func (c *poolsCtx) update(now time.Time) {
+	// Don't hold the lock during the health checks, since the queries
+	// need it to get the active pool.
+	c.lock.Lock()
+	pools := c.pools
+	c.lock.Unlock()
+
+	// Call onSwitch after the lock is released, see below.
+	var switched *proxy.UpstreamConfig
+	defer func() {
+		if switched != nil && c.onSwitch != nil {
+			c.onSwitch(switched)
+		}
+	}()
+
+	results := make([]bool, len(pools))
+	for i, p := range pools {
+		results[i] = checkUpstreams(p.conf.Upstreams)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !samePools(pools, c.pools) {
+		// The pools have been replaced during the checks.
+		return
+	}
+
+	for i, p := range c.pools {
+		if p.failed {
+			log.Debug("dns: upstream pool %q has returned malformed responses", p.name)
+			results[i] = false
+			p.failed = false
+		}
+
+		switch ok := results[i]; {
+		case ok && !p.healthy:
+			log.Info("dns: upstream pool %q has recovered", p.name)
+			p.healthySince = now
+		case !ok && p.healthy:
+			log.Info("dns: upstream pool %q has failed the health check", p.name)
+		}
+
+		p.healthy = results[i]
+	}
+
+	for _, p := range c.pools {
+		if !p.healthy {
+			continue
+		}
+
+		stable := p.healthySince.IsZero() || now.Sub(p.healthySince) >= c.recovery
+		if p == c.active || stable {
+			if p != c.active {
+				log.Info("dns: switching to upstream pool %q", p.name)
+				c.active = p
+				switched = p.conf
+			}
+
+			return
+		}
+	}
+
+	// None of the pools is healthy, so keep the active one.
+}
+
+// samePools returns true if a and b are the same pools.
+func samePools(a, b []*upstreamPool) (ok bool) {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// start starts the periodic health checks.
+func (c *poolsCtx) start() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.pools) == 0 || c.done != nil {
+		return
+	}
+
+	c.done = make(chan struct{})
+	c.wg.Add(1)
+	go c.loop(c.done, c.interval)
+}
+
+// stop stops the periodic health checks and waits for the check being
+// performed, if any, to finish.
+func (c *poolsCtx) stop() {
+	c.lock.Lock()
+	done := c.done
+	c.done = nil
+	c.lock.Unlock()
+
+	if done == nil {
+		return
+	}
+
+	close(done)
+	c.wg.Wait()
+}
+
+// loop performs the health checks every interval until done is closed.
+func (c *poolsCtx) loop(done chan struct{}, interval time.Duration) {
+	defer c.wg.Done()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-t.C:
+			c.update(now)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package dnsforward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// healthUpstream is an upstream which fails all queries while down is true.
+type healthUpstream struct {
+	recordUpstream
+	down bool
+}
+
+// Exchange implements the upstream.Upstream interface for *healthUpstream.
+func (u *healthUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if u.down {
+		return nil, agherr.Error("upstream is down")
+	}
+
+	return u.recordUpstream.Exchange(m)
+}
+
+func TestPoolsCtx_init(t *testing.T) {
+	c := &poolsCtx{}
+
+	err := c.init(nil, nil, 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, c.upstreamConfig())
+
+	err = c.init([]UpstreamPool{{
+		Name:      "secondary",
+		Upstreams: []string{"9.9.9.9"},
+		Priority:  2,
+	}, {
+		Name:      "primary",
+		Upstreams: []string{"1.1.1.1"},
+		Priority:  1,
+	}}, nil, 0, 0)
+	assert.Nil(t, err)
+	if assert.Len(t, c.pools, 2) {
+		assert.Equal(t, "primary", c.pools[0].name)
+		assert.Same(t, c.pools[0].conf, c.upstreamConfig())
+	}
+	assert.Equal(t, defaultPoolsCheckInterval, c.interval)
+	assert.Equal(t, defaultPoolsRecovery, c.recovery)
+
+	err = c.init([]UpstreamPool{{Name: "empty"}}, nil, 0, 0)
+	assert.NotNil(t, err)
+}
+
+func TestPoolsCtx_update(t *testing.T) {
+	primary, secondary := &healthUpstream{}, &healthUpstream{}
+	primaryConf := &proxy.UpstreamConfig{Upstreams: []upstream.Upstream{primary}}
+	secondaryConf := &proxy.UpstreamConfig{Upstreams: []upstream.Upstream{secondary}}
+
+	c := &poolsCtx{
+		pools: []*upstreamPool{{
+			conf:     primaryConf,
+			name:     "primary",
+			priority: 1,
+			healthy:  true,
+		}, {
+			conf:     secondaryConf,
+			name:     "secondary",
+			priority: 2,
+			healthy:  true,
+		}},
+		recovery: time.Minute,
+	}
+	c.active = c.pools[0]
+
+	// query sends a query using the active pool and returns the upstream
+	// which has answered it.
+	query := func() (u *healthUpstream) {
+		uc := c.upstreamConfig()
+		if !assert.Len(t, uc.Upstreams, 1) {
+			return nil
+		}
+
+		req := createTestMessage("example.org.")
+		_, err := uc.Upstreams[0].Exchange(req)
+		assert.Nil(t, err)
+
+		return uc.Upstreams[0].(*healthUpstream)
+	}
+
+	now := time.Now()
+
+	c.update(now)
+	assert.Same(t, primary, query())
+
+	primary.down = true
+	now = now.Add(10 * time.Second)
+	c.update(now)
+	assert.Same(t, secondary, query())
+
+	// The primary pool has recovered, but it isn't used until it stays
+	// healthy during the recovery window.
+	primary.down = false
+	now = now.Add(10 * time.Second)
+	c.update(now)
+	assert.Same(t, secondary, query())
+
+	now = now.Add(30 * time.Second)
+	c.update(now)
+	assert.Same(t, secondary, query())
+
+	// A flap restarts the recovery window.
+	primary.down = true
+	now = now.Add(10 * time.Second)
+	c.update(now)
+	assert.Same(t, secondary, query())
+
+	primary.down = false
+	now = now.Add(10 * time.Second)
+	c.update(now)
+	assert.Same(t, secondary, query())
+
+	now = now.Add(30 * time.Second)
+	c.update(now)
+	assert.Same(t, secondary, query())
+
+	now = now.Add(30 * time.Second)
+	c.update(now)
+	assert.Same(t, primary, query())
+
+	// Both pools are down, so the active one is kept.
+	primary.down, secondary.down = true, true
+	now = now.Add(10 * time.Second)
+	c.update(now)
+	assert.Same(t, primaryConf, c.upstreamConfig())
+}
+
+// closeUpstream is an upstream which blocks the health checks until released
+// and records if it has been closed.
+type closeUpstream struct {
+	recordUpstream
+
+	started chan struct{}
+	release chan struct{}
+	closed  bool
+}
+
+// Exchange implements the upstream.Upstream interface for *closeUpstream.
+func (u *closeUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	u.started <- struct{}{}
+	<-u.release
+
+	return u.recordUpstream.Exchange(m)
+}
+
+// Close implements the io.Closer interface for *closeUpstream.
+func (u *closeUpstream) Close() (err error) {
+	u.closed = true
+
+	return nil
+}
+
+func TestPoolsCtx_stop(t *testing.T) {
+	u := &closeUpstream{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+
+	c := &poolsCtx{
+		pools: []*upstreamPool{{
+			conf:    &proxy.UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+			name:    "pool",
+			healthy: true,
+		}},
+		interval: 10 * time.Millisecond,
+		recovery: time.Minute,
+	}
+	c.active = c.pools[0]
+
+	c.start()
+	<-u.started
+
+	stopped := make(chan struct{})
+	go func() {
+		c.stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("stopped before the health check completed")
+	case <-time.After(100 * time.Millisecond):
+		// Go on.
+	}
+
+	close(u.release)
+
+	select {
+	case <-stopped:
+		// Go on.
+	case <-time.After(5 * time.Second):
+		t.Fatal("not stopped after the health check completed")
+	}
+
+	assert.False(t, u.closed)
+
+	// The upstreams of the replaced pools are closed.
+	assert.Nil(t, c.init(nil, nil, 0, 0))
+	assert.True(t, u.closed)
+	assert.Nil(t, c.upstreamConfig())
+}
+
+func TestServer_pools_cache(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.CacheSize = 4096
+	s.conf.NonRDMode = nonRDModeCacheOnly
+	s.conf.UpstreamPools = []UpstreamPool{{
+		Name:      "primary",
+		Upstreams: []string{"127.0.0.1:1"},
+		Priority:  1,
+	}, {
+		Name:      "secondary",
+		Upstreams: []string{"127.0.0.1:2"},
+		Priority:  2,
+	}}
+	err := s.Prepare(nil)
+	assert.Nil(t, err)
+
+	primary, secondary := &healthUpstream{}, &healthUpstream{}
+	ucs := s.pools.configs()
+	if !assert.Len(t, ucs, 2) {
+		return
+	}
+	ucs[0].Upstreams = s.nonRDUpstreams([]upstream.Upstream{primary})
+	ucs[1].Upstreams = s.nonRDUpstreams([]upstream.Upstream{secondary})
+
+	err = s.dnsProxy.Start()
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = s.Stop() })
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+	exchange := func(name string, rd bool) {
+		t.Helper()
+
+		req := createTestMessage(name)
+		req.RecursionDesired = rd
+		reply, exchErr := dns.Exchange(req, addr)
+		if assert.Nil(t, exchErr) {
+			assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+			assert.Len(t, reply.Answer, 1)
+		}
+	}
+
+	// The repeated queries are answered from the cache, including the
+	// non-recursive ones.
+	exchange("example.org.", true)
+	exchange("example.org.", true)
+	exchange("example.org.", false)
+	assert.Equal(t, []string{"example.org."}, primary.names)
+
+	// The cache is still used after switching to another pool.
+	primary.down = true
+	s.pools.update(time.Now())
+	assert.Same(t, ucs[1], s.pools.upstreamConfig())
+
+	exchange("example.net.", true)
+	exchange("example.net.", true)
+	exchange("example.org.", true)
+	assert.Equal(t, []string{".", "example.net."}, secondary.names)
+	assert.Equal(t, []string{"example.org."}, primary.names)
+}
@@ -0,0 +1,399 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// qminMaxSteps is the maximum number of minimized queries sent before the
+// full one.  See RFC 9156, section 2.3.
+const qminMaxSteps = 10
+
+// qminMaxCNAMEs is the maximum number of the CNAME targets outside of the zone
+// resolved for a single query.
+const qminMaxCNAMEs = 8
+
+// qminGlueMax is the maximum number of the upstreams for the glue addresses
+// kept by a qminUpstream.  qminGlueTTL is the time after which such an
+// upstream is created anew.
+const (
+	qminGlueMax = 1024
+	qminGlueTTL = 1 * time.Hour
+)
+
+// qminUpstream is an upstream which implements the QNAME minimization
+// described in RFC 7816.  It starts with an authoritative upstream, for
+// example a root server, and reveals only one more label of the query name to
+// the servers of each zone, following the referrals.  The full query is only
+// sent to the servers of the closest zone found.
+//
+// The referrals are only followed if they have glue addresses within the
+// delegated zone.  Otherwise, the full query is sent to the servers of the last
+// zone found.  The answer records outside of the zone of the servers are
+// dropped, and the CNAME targets which aren't answered by them are resolved
+// the same way.  The servers
+// from the glue records are queried over plain DNS, so only the plain DNS
+// upstreams are wrapped, see qminUpstreams.
+type qminUpstream struct {
+	// start is the upstream the resolution starts with.
+	start upstream.Upstream
+
+	// newUpstream creates an upstream for the address of a server from the
+	// glue records.
+	newUpstream func(addr string) (u upstream.Upstream, err error)
+
+	// mu protects ups.
+	mu sync.Mutex
+
+	// ups are the upstreams created for the addresses from the glue records.
+	// There are no more than qminGlueMax of them.
+	ups map[string]qminGlue
+}
+
+// qminGlue is an upstream created for the address from the glue records.
+type qminGlue struct {
+	// u is the upstream itself.
+	u upstream.Upstream
+
+	// expires is the time after which u is created anew.
+	expires time.Time
+}
+
+// newQminUpstream returns a new QNAME minimizing upstream starting with u.
+func newQminUpstream(u upstream.Upstream) (qu *qminUpstream) {
+	return &qminUpstream{
+		start: u,
+		newUpstream: func(addr string) (upstream.Upstream, error) {
+			return upstream.AddressToUpstream(addr, upstream.Options{Timeout: DefaultTimeout})
+		},
+		ups: map[string]qminGlue{},
+	}
+}
+
+// validateQminUpstreams returns an error if any of addrs isn't a plain DNS
+// upstream address.  See FilteringConfig.QNAMEMinimizationUpstreams.
+func validateQminUpstreams(addrs []string) (err error) {
+	for _, addr := range addrs {
+		if strings.Contains(addr, "://") &&
+			!strings.HasPrefix(addr, "udp://") &&
+			!strings.HasPrefix(addr, "tcp://") {
+			return fmt.Errorf("qname minimization upstream %q: only plain dns is supported", addr)
+		}
+
+		_, err = upstream.AddressToUpstream(addr, upstream.Options{Timeout: DefaultTimeout})
+		if err != nil {
+			return fmt.Errorf("qname minimization upstream %q: %w", addr, err)
+		}
+	}
+
+	return nil
+}
+
+// qminUpstreams wraps the upstreams from ups which are listed in
+// QNAMEMinimizationUpstreams into QNAME minimizing upstreams.  The other
+// upstreams are returned as is.
+func (s *Server) qminUpstreams(ups []upstream.Upstream) (res []upstream.Upstream) {
+	if len(s.conf.QNAMEMinimizationUpstreams) == 0 {
+		return ups
+	}
+
+	// Compare the addresses the way the upstreams print them, since the
+	// configured ones may omit the port, for example.
+	auth := map[string]bool{}
+	for _, addr := range s.conf.QNAMEMinimizationUpstreams {
+		u, err := upstream.AddressToUpstream(addr, upstream.Options{Timeout: DefaultTimeout})
+		if err != nil {
+			// Shouldn't happen, since the addresses are validated
+			// in Prepare.
+			log.Error("dns: qname minimization upstream %q: %s", addr, err)
+
+			continue
+		}
+
+		auth[u.Address()] = true
+	}
+
+	res = make([]upstream.Upstream, len(ups))
+	for i, u := range ups {
+		if auth[u.Address()] {
+			res[i] = newQminUpstream(u)
+		} else {
+			res[i] = u
+		}
+	}
+
+	return res
+}
+
+// Address implements the upstream.Upstream interface for *qminUpstream.
+func (u *qminUpstream) Address() (addr string) {
+	return u.start.Address()
+}
+
+// Exchange implements the upstream.Upstream interface for *qminUpstream.
+func (u *qminUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	var zone string
+	resp, zone, err = u.resolve(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only trust the servers of a zone with the records within it.
+	resp.Answer = inZone(resp.Answer, zone)
+
+	q := req.Question[0]
+	for i := 0; ; i++ {
+		target := cnameTarget(resp.Answer, q.Name, q.Qtype)
+		if target == "" {
+			return resp, nil
+		} else if i == qminMaxCNAMEs {
+			log.Debug("dns: qname minimization: %s: too many cnames", q.Name)
+
+			return resp, nil
+		}
+
+		treq := req.Copy()
+		treq.Question[0].Name = target
+
+		var tresp *dns.Msg
+		tresp, zone, err = u.resolve(treq)
+		if err != nil {
+			return nil, fmt.Errorf("qname minimization: cname target %s: %w", target, err)
+		}
+
+		resp.Answer = append(resp.Answer, inZone(tresp.Answer, zone)...)
+		resp.Ns = tresp.Ns
+		resp.Rcode = tresp.Rcode
+	}
+}
+
+// resolve follows the referrals for the name of req and sends the full query
+// to the servers of the closest zone found, which is also returned.
+func (u *qminUpstream) resolve(req *dns.Msg) (resp *dns.Msg, zone string, err error) {
+	labels := dns.SplitDomainName(req.Question[0].Name)
+	steps := len(labels) - 1
+	if steps > qminMaxSteps {
+		steps = qminMaxSteps
+	}
+
+	zone = "."
+	servers := []upstream.Upstream{u.start}
+	for i := 1; i <= steps; i++ {
+		name := dns.Fqdn(strings.Join(labels[len(labels)-i:], "."))
+
+		mreq := &dns.Msg{}
+		mreq.SetQuestion(name, dns.TypeNS)
+		mreq.RecursionDesired = req.RecursionDesired
+
+		resp, err = exchangeAny(servers, mreq)
+		if err != nil {
+			return nil, "", fmt.Errorf("qname minimization: %s: %w", name, err)
+		}
+
+		switch resp.Rcode {
+		case dns.RcodeSuccess:
+			// Go on.
+		case dns.RcodeNameError:
+			// There is nothing under a name which doesn't exist.  See
+			// RFC 8020.
+			resp = resp.SetRcode(req, dns.RcodeNameError)
+			resp.Answer = nil
+
+			return resp, zone, nil
+		default:
+			// The servers may not handle the minimized queries, so
+			// send them the full one.
+			log.Debug("dns: qname minimization: %s: %s", name, dns.RcodeToString[resp.Rcode])
+
+			resp, err = exchangeAny(servers, req)
+
+			return resp, zone, err
+		}
+
+		var next []upstream.Upstream
+		next, err = u.referral(name, resp)
+		if err != nil {
+			return nil, "", fmt.Errorf("qname minimization: %s: %w", name, err)
+		} else if next != nil {
+			servers, zone = next, name
+		}
+	}
+
+	resp, err = exchangeAny(servers, req)
+
+	return resp, zone, err
+}
+
+// inZone returns the records from rrs which belong to zone or its subzones.
+func inZone(rrs []dns.RR, zone string) (res []dns.RR) {
+	for _, rr := range rrs {
+		if dns.IsSubDomain(zone, rr.Header().Name) {
+			res = append(res, rr)
+		} else {
+			log.Debug("dns: qname minimization: ignoring %s outside of %s", rr.Header().Name, zone)
+		}
+	}
+
+	return res
+}
+
+// cnameTarget returns the name which the CNAME chain for name in answer leads
+// to, if answer has no records of type qtype for it.  Otherwise, it returns an
+// empty string.
+func cnameTarget(answer []dns.RR, name string, qtype uint16) (target string) {
+	if qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return ""
+	}
+
+	target = name
+	// Each record is used in the chain at most once, so it can't be longer.
+	for range answer {
+		next := ""
+		for _, rr := range answer {
+			hdr := rr.Header()
+			if !strings.EqualFold(hdr.Name, target) {
+				continue
+			}
+
+			if hdr.Rrtype == qtype {
+				return ""
+			} else if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			}
+		}
+
+		if next == "" {
+			break
+		}
+
+		target = next
+	}
+
+	if strings.EqualFold(target, name) {
+		return ""
+	}
+
+	return target
+}
+
+// referral returns the upstreams for the servers of zone if resp is a
+// delegation of it with glue addresses.  Otherwise, it returns nil.  Only the
+// glue for the servers within zone is used, since the ones outside of it may
+// be spoofed by the servers of the parent zone.
+func (u *qminUpstream) referral(zone string, resp *dns.Msg) (ups []upstream.Upstream, err error) {
+	nsNames := map[string]bool{}
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range rrs {
+			ns, ok := rr.(*dns.NS)
+			if !ok || !strings.EqualFold(ns.Hdr.Name, zone) {
+				continue
+			}
+
+			if dns.IsSubDomain(zone, ns.Ns) {
+				nsNames[strings.ToLower(ns.Ns)] = true
+			} else {
+				log.Debug("dns: qname minimization: ignoring glue for %s outside of %s", ns.Ns, zone)
+			}
+		}
+	}
+
+	if len(nsNames) == 0 {
+		return nil, nil
+	}
+
+	for _, rr := range resp.Extra {
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		default:
+			continue
+		}
+
+		if !nsNames[strings.ToLower(rr.Header().Name)] {
+			continue
+		}
+
+		var gu upstream.Upstream
+		gu, err = u.glueUpstream(net.JoinHostPort(ip.String(), "53"))
+		if err != nil {
+			return nil, err
+		}
+
+		ups = append(ups, gu)
+	}
+
+	if ups == nil {
+		log.Debug("dns: qname minimization: no glue for %s", zone)
+	}
+
+	return ups, nil
+}
+
+// glueUpstream returns the upstream for addr, creating it if necessary.
+func (u *qminUpstream) glueUpstream(addr string) (gu upstream.Upstream, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	g, ok := u.ups[addr]
+	if ok && now.Before(g.expires) {
+		return g.u, nil
+	}
+
+	gu, err = u.newUpstream(addr)
+	if err != nil {
+		return nil, fmt.Errorf("creating upstream for %s: %w", addr, err)
+	}
+
+	if !ok && len(u.ups) >= qminGlueMax {
+		u.evictGlue(now)
+	}
+
+	u.ups[addr] = qminGlue{
+		u:       gu,
+		expires: now.Add(qminGlueTTL),
+	}
+
+	return gu, nil
+}
+
+// evictGlue removes the expired upstreams from u.ups and then, if there are
+// still too many of them, random ones, so that a new one could be added.
+// u.mu is expected to be locked.
+func (u *qminUpstream) evictGlue(now time.Time) {
+	for addr, g := range u.ups {
+		if !now.Before(g.expires) {
+			delete(u.ups, addr)
+		}
+	}
+
+	for addr := range u.ups {
+		if len(u.ups) < qminGlueMax {
+			break
+		}
+
+		delete(u.ups, addr)
+	}
+}
+
+// exchangeAny sends req to ups in order until one of them responds.
+func exchangeAny(ups []upstream.Upstream, req *dns.Msg) (resp *dns.Msg, err error) {
+	for _, u := range ups {
+		resp, err = u.Exchange(req)
+		if err == nil {
+			return resp, nil
+		}
+	}
+
+	return nil, err
+}
@@ -0,0 +1,342 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// authUpstream is a mock of an authoritative server.  It delegates the
+// subzones to the servers with the glue addresses, answers the A queries for
+// the known names, and responds with NODATA to the other queries for the
+// names within the zone.
+type authUpstream struct {
+	zone string
+
+	// delegations maps the subzones to the glue addresses of their name
+	// servers.
+	delegations map[string]net.IP
+
+	// nsNames maps the subzones to the names of their name servers, if
+	// these aren't "ns." followed by the subzone.
+	nsNames map[string]string
+
+	// names maps the names to their IPv4 addresses.
+	names map[string]net.IP
+
+	// cnames maps the names to their CNAME targets.
+	cnames map[string]string
+
+	// forged, if not nil, is the address added for the CNAME targets, as
+	// if the server tried to spoof them.
+	forged net.IP
+
+	mu *sync.Mutex
+	// queries are the questions received.
+	queries []string
+}
+
+// Exchange implements the upstream.Upstream interface for *authUpstream.
+func (u *authUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	q := m.Question[0]
+
+	u.mu.Lock()
+	u.queries = append(u.queries, fmt.Sprintf("%s %s", q.Name, dns.TypeToString[q.Qtype]))
+	u.mu.Unlock()
+
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+
+	name := strings.ToLower(q.Name)
+	for sub, ip := range u.delegations {
+		if !dns.IsSubDomain(sub, name) {
+			continue
+		}
+
+		nsName, ok := u.nsNames[sub]
+		if !ok {
+			nsName = "ns." + sub
+		}
+
+		resp.Ns = []dns.RR{&dns.NS{
+			Hdr: dns.RR_Header{Name: sub, Rrtype: dns.TypeNS, Class: dns.ClassINET},
+			Ns:  nsName,
+		}}
+		resp.Extra = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: nsName, Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   ip,
+		}}
+
+		return resp, nil
+	}
+
+	resp.Authoritative = true
+	if target, ok := u.cnames[name]; ok {
+		resp.Answer = []dns.RR{&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET},
+			Target: target,
+		}}
+		if u.forged != nil {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET},
+				A:   u.forged,
+			})
+		}
+	} else if ip, ok := u.names[name]; ok && q.Qtype == dns.TypeA {
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   ip,
+		}}
+	} else if !u.hasName(name) {
+		resp.Rcode = dns.RcodeNameError
+	}
+
+	return resp, nil
+}
+
+// hasName returns true if name or any of its subdomains exists in the zone.
+func (u *authUpstream) hasName(name string) (ok bool) {
+	for n := range u.names {
+		if dns.IsSubDomain(name, n) {
+			return true
+		}
+	}
+
+	for n := range u.cnames {
+		if dns.IsSubDomain(name, n) {
+			return true
+		}
+	}
+
+	return name == u.zone
+}
+
+// Address implements the upstream.Upstream interface for *authUpstream.
+func (u *authUpstream) Address() (addr string) {
+	return "auth:" + u.zone
+}
+
+func TestQminUpstream(t *testing.T) {
+	root := &authUpstream{
+		zone: ".",
+		delegations: map[string]net.IP{
+			"org.": {192, 0, 2, 1},
+			"net.": {192, 0, 2, 3},
+		},
+		mu: &sync.Mutex{},
+	}
+	org := &authUpstream{
+		zone: "org.",
+		delegations: map[string]net.IP{
+			"example.org.": {192, 0, 2, 2},
+			"evil.org.":    {192, 0, 2, 66},
+		},
+		nsNames: map[string]string{
+			"evil.org.": "ns.example.net.",
+		},
+		mu: &sync.Mutex{},
+	}
+	example := &authUpstream{
+		zone: "example.org.",
+		names: map[string]net.IP{
+			"www.sub.example.org.": {1, 2, 3, 4},
+		},
+		cnames: map[string]string{
+			"alias.example.org.": "www.example.net.",
+		},
+		forged: net.IP{6, 6, 6, 6},
+		mu:     &sync.Mutex{},
+	}
+	netTLD := &authUpstream{
+		zone: "net.",
+		names: map[string]net.IP{
+			"www.example.net.": {1, 2, 3, 5},
+		},
+		mu: &sync.Mutex{},
+	}
+
+	glue := map[string]upstream.Upstream{
+		"192.0.2.1:53": org,
+		"192.0.2.2:53": example,
+		"192.0.2.3:53": netTLD,
+	}
+
+	u := newQminUpstream(root)
+	u.newUpstream = func(addr string) (upstream.Upstream, error) {
+		gu, ok := glue[addr]
+		if !ok {
+			return nil, fmt.Errorf("unexpected address %s", addr)
+		}
+
+		return gu, nil
+	}
+
+	reset := func() {
+		root.queries, org.queries, example.queries = nil, nil, nil
+		netTLD.queries = nil
+	}
+
+	t.Run("success", func(t *testing.T) {
+		reset()
+
+		resp, err := u.Exchange(createTestMessage("www.sub.example.org."))
+		assert.Nil(t, err)
+		if assert.NotNil(t, resp) && assert.Len(t, resp.Answer, 1) {
+			a, ok := resp.Answer[0].(*dns.A)
+			assert.True(t, ok)
+			assert.True(t, net.IP{1, 2, 3, 4}.Equal(a.A))
+		}
+
+		assert.Equal(t, []string{"org. NS"}, root.queries)
+		assert.Equal(t, []string{"example.org. NS"}, org.queries)
+		assert.Equal(t, []string{
+			"sub.example.org. NS",
+			"www.sub.example.org. A",
+		}, example.queries)
+	})
+
+	t.Run("nxdomain", func(t *testing.T) {
+		reset()
+
+		req := createTestMessage("a.b.nonexistent.example.org.")
+		resp, err := u.Exchange(req)
+		assert.Nil(t, err)
+		if assert.NotNil(t, resp) {
+			assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+			assert.Equal(t, req.Question, resp.Question)
+		}
+
+		// The rest of the labels are never revealed.
+		assert.Equal(t, []string{"nonexistent.example.org. NS"}, example.queries)
+	})
+
+	t.Run("out_of_zone_glue", func(t *testing.T) {
+		reset()
+
+		resp, err := u.Exchange(createTestMessage("www.evil.org."))
+		assert.Nil(t, err)
+		if assert.NotNil(t, resp) {
+			assert.Empty(t, resp.Answer)
+		}
+
+		// The glue for ns.example.net isn't used, so the full query is
+		// sent to the servers of org.
+		assert.Equal(t, []string{
+			"evil.org. NS",
+			"www.evil.org. A",
+		}, org.queries)
+	})
+
+	t.Run("cname", func(t *testing.T) {
+		reset()
+
+		resp, err := u.Exchange(createTestMessage("alias.example.org."))
+		assert.Nil(t, err)
+		if assert.NotNil(t, resp) && assert.Len(t, resp.Answer, 2) {
+			cname, ok := resp.Answer[0].(*dns.CNAME)
+			if assert.True(t, ok) {
+				assert.Equal(t, "www.example.net.", cname.Target)
+			}
+
+			// The forged address from the servers of example.org is
+			// replaced with the one from the servers of net.
+			a, ok := resp.Answer[1].(*dns.A)
+			if assert.True(t, ok) {
+				assert.Equal(t, "www.example.net.", a.Hdr.Name)
+				assert.True(t, net.IP{1, 2, 3, 5}.Equal(a.A))
+			}
+		}
+
+		assert.Equal(t, []string{
+			"example.net. NS",
+			"www.example.net. A",
+		}, netTLD.queries)
+	})
+
+	t.Run("single_label", func(t *testing.T) {
+		reset()
+
+		_, err := u.Exchange(createTestMessage("org."))
+		assert.Nil(t, err)
+
+		assert.Equal(t, []string{"org. A"}, root.queries)
+	})
+}
+
+func TestQminUpstream_glueUpstream(t *testing.T) {
+	var created int
+	u := newQminUpstream(&testUpstream{})
+	u.newUpstream = func(_ string) (upstream.Upstream, error) {
+		created++
+
+		return &testUpstream{}, nil
+	}
+
+	_, err := u.glueUpstream("192.0.2.1:53")
+	assert.Nil(t, err)
+	_, err = u.glueUpstream("192.0.2.1:53")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, created)
+
+	t.Run("expired", func(t *testing.T) {
+		g := u.ups["192.0.2.1:53"]
+		g.expires = time.Now().Add(-time.Second)
+		u.ups["192.0.2.1:53"] = g
+
+		_, err = u.glueUpstream("192.0.2.1:53")
+		assert.Nil(t, err)
+		assert.Equal(t, 2, created)
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		for i := 0; i < 2*qminGlueMax; i++ {
+			ip := net.IP{10, 0, byte(i >> 8), byte(i)}
+			_, err = u.glueUpstream(net.JoinHostPort(ip.String(), "53"))
+			assert.Nil(t, err)
+		}
+
+		assert.LessOrEqual(t, len(u.ups), qminGlueMax)
+	})
+}
+
+func TestServer_qminUpstreams(t *testing.T) {
+	s := NewServer(DNSCreateParams{})
+	s.conf.UpstreamDNS = []string{"192.0.2.1", "tls://192.0.2.2"}
+	s.conf.QNAMEMinimizationUpstreams = []string{"192.0.2.1"}
+	assert.Nil(t, s.prepareUpstreamSettings())
+
+	ups := s.conf.UpstreamConfig.Upstreams
+	if assert.Len(t, ups, 2) {
+		// Only the listed authoritative upstream is wrapped.
+		qu, ok := ups[0].(*qminUpstream)
+		if assert.True(t, ok) {
+			assert.Equal(t, "192.0.2.1:53", qu.start.Address())
+		}
+
+		_, ok = ups[1].(*qminUpstream)
+		assert.False(t, ok)
+	}
+
+	s.conf.QNAMEMinimizationUpstreams = nil
+	assert.Nil(t, s.prepareUpstreamSettings())
+	for _, u := range s.conf.UpstreamConfig.Upstreams {
+		_, ok := u.(*qminUpstream)
+		assert.False(t, ok)
+	}
+}
+
+func TestValidateQminUpstreams(t *testing.T) {
+	assert.Nil(t, validateQminUpstreams([]string{"192.0.2.1", "udp://192.0.2.1:53", "tcp://192.0.2.1"}))
+
+	// The servers from the glue records are queried over plain DNS, so
+	// the encrypted upstreams aren't allowed.
+	assert.NotNil(t, validateQminUpstreams([]string{"tls://192.0.2.1"}))
+	assert.NotNil(t, validateQminUpstreams([]string{"https://192.0.2.1/dns-query"}))
+}
@@ -0,0 +1,57 @@
+package dnsforward
+
+import (
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Response codes of the answers to the queries of the restricted types, see
+// FilteringConfig.RestrictedQTypeRcode.
+const (
+	restrictedQTypeRcodeRefused = "refused"
+	restrictedQTypeRcodeNotImp  = "notimp"
+)
+
+// containsQType returns true if qtypes contain qtype.
+func containsQType(qtypes []uint16, qtype uint16) (ok bool) {
+	for _, qt := range qtypes {
+		if qt == qtype {
+			return true
+		}
+	}
+
+	return false
+}
+
+// processClientQTypes answers the queries of the types which the client isn't
+// allowed to issue with REFUSED or NOTIMP, so that, for example, the IoT
+// devices couldn't exfiltrate data using the TXT queries.  The following
+// processing is skipped since the response is set, but such queries are still
+// logged and counted.
+func processClientQTypes(ctx *dnsContext) (rc resultCode) {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if s.conf.GetAllowedQTypesByClient == nil {
+		return resultCodeSuccess
+	}
+
+	qtypes := s.conf.GetAllowedQTypesByClient(IPFromAddr(d.Addr), ctx.clientID)
+	q := d.Req.Question[0]
+	if qtypes == nil || containsQType(qtypes, q.Qtype) {
+		return resultCodeSuccess
+	}
+
+	log.Debug("dns: query type %s of %s is not allowed for the client", dns.Type(q.Qtype), q.Name)
+
+	rcode := dns.RcodeRefused
+	if s.conf.RestrictedQTypeRcode == restrictedQTypeRcodeNotImp {
+		rcode = dns.RcodeNotImplemented
+	}
+
+	resp := &dns.Msg{}
+	resp.SetRcode(d.Req, rcode)
+	resp.RecursionAvailable = true
+	d.Res = resp
+
+	return resultCodeSuccess
+}
@@ -0,0 +1,88 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_clientQTypes(t *testing.T) {
+	restrictedIP := net.IP{127, 0, 0, 1}
+
+	testCases := []struct {
+		name      string
+		clientIP  net.IP
+		conf      string
+		wantRcode int
+	}{{
+		name:      "restricted_refused",
+		clientIP:  restrictedIP,
+		conf:      "",
+		wantRcode: dns.RcodeRefused,
+	}, {
+		name:      "restricted_notimp",
+		clientIP:  restrictedIP,
+		conf:      restrictedQTypeRcodeNotImp,
+		wantRcode: dns.RcodeNotImplemented,
+	}, {
+		name:      "unrestricted",
+		clientIP:  net.IP{192, 168, 0, 2},
+		conf:      "",
+		wantRcode: dns.RcodeNameError,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ql := &chanQueryLog{
+				ch: make(chan querylog.AddParams, 2),
+			}
+			s := createTestServer(t)
+			s.queryLog = ql
+			s.conf.RestrictedQTypeRcode = tc.conf
+			s.conf.GetAllowedQTypesByClient = func(clientAddr net.IP, _ string) (qtypes []uint16) {
+				if clientAddr.Equal(tc.clientIP) && tc.clientIP.Equal(restrictedIP) {
+					return []uint16{dns.TypeA, dns.TypeAAAA, dns.TypePTR}
+				}
+
+				return nil
+			}
+			assert.Nil(t, s.startWithUpstream(&testUpstream{
+				ipv4: map[string][]net.IP{"host.": {{1, 2, 3, 4}}},
+			}))
+			t.Cleanup(func() { _ = s.Stop() })
+
+			addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+			reply, err := dns.Exchange(createTestMessageWithType("host.", dns.TypeTXT), addr)
+			assert.Nil(t, err)
+			if assert.NotNil(t, reply) {
+				assert.Equal(t, tc.wantRcode, reply.Rcode)
+				assert.Empty(t, reply.Answer)
+			}
+
+			// The restricted queries are logged as well.
+			select {
+			case p := <-ql.ch:
+				assert.Equal(t, dns.TypeTXT, p.Question.Question[0].Qtype)
+				if assert.NotNil(t, p.Answer) {
+					assert.Equal(t, tc.wantRcode, p.Answer.Rcode)
+				}
+			case <-time.After(time.Second):
+				t.Error("no query log entry")
+			}
+
+			// The allowed query types are always resolved.
+			reply, err = dns.Exchange(createTestMessageWithType("host.", dns.TypeA), addr)
+			assert.Nil(t, err)
+			if assert.NotNil(t, reply) {
+				assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+				assert.Len(t, reply.Answer, 1)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package dnsforward
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Modes of handling the queries exceeding the rate limit.
+const (
+	// rateLimitModeDrop means that the queries are dropped by the proxy.
+	// It's the default.
+	rateLimitModeDrop = "drop"
+
+	// rateLimitModeDelay means that the queries are delayed until they fit
+	// the rate limit, but no longer than the maximum delay, and dropped
+	// afterwards.
+	rateLimitModeDelay = "delay"
+)
+
+const (
+	// defaultRateLimitMaxDelay is the default maximum delay of the queries
+	// in rateLimitModeDelay.
+	defaultRateLimitMaxDelay = 500 * time.Millisecond
+
+	// rateLimitMaxDelayed is the maximum number of the queries which are
+	// delayed at the same time, so that the delayed queries don't tie up
+	// the goroutines of the proxy.  The queries exceeding it are dropped.
+	rateLimitMaxDelayed = 64
+
+	// rateLimitSweepSize is the number of the clients after which the
+	// limiter forgets the clients which haven't sent queries recently.
+	rateLimitSweepSize = 4096
+)
+
+// rateLimiter smooths the queries of each client to the rate limit using the
+// leaky bucket algorithm.  The client may send up to a second's worth of
+// queries at once, and the excess ones are delayed.
+type rateLimiter struct {
+	// lock protects tats.
+	lock sync.Mutex
+
+	// tats are the theoretical arrival times of the next query of the
+	// clients by their IP addresses, see the generic cell rate algorithm.
+	tats map[string]time.Time
+
+	// whitelist are the IP addresses of the clients which aren't limited.
+	whitelist map[string]struct{}
+
+	// delayed limits the number of the queries delayed at the same time.
+	delayed chan struct{}
+
+	// now returns the current time.  It's replaced in tests.
+	now func() time.Time
+
+	// interval is the interval between the queries at the rate limit.
+	interval time.Duration
+
+	// burst is the period during which the queries may be sent at once.
+	burst time.Duration
+
+	// maxDelay is the maximum delay of a query.
+	maxDelay time.Duration
+}
+
+// proxyRatelimit returns the rate limit for the proxy, which is zero if the
+// queries exceeding it are delayed by s.ratelimit instead of being dropped.
+func (s *Server) proxyRatelimit() (rps int) {
+	if s.conf.RatelimitMode == rateLimitModeDelay {
+		return 0
+	}
+
+	return int(s.conf.Ratelimit)
+}
+
+// newRateLimiter returns a limiter of rps queries per second from each client
+// except the whitelisted ones.  maxDelayMs is the maximum delay of a query in
+// milliseconds, zero means the default.
+func newRateLimiter(rps uint32, maxDelayMs uint32, whitelist []string) (l *rateLimiter) {
+	l = &rateLimiter{
+		tats:      map[string]time.Time{},
+		whitelist: make(map[string]struct{}, len(whitelist)),
+		delayed:   make(chan struct{}, rateLimitMaxDelayed),
+		now:       time.Now,
+		interval:  time.Second / time.Duration(rps),
+		burst:     time.Second,
+		maxDelay:  defaultRateLimitMaxDelay,
+	}
+
+	if maxDelayMs != 0 {
+		l.maxDelay = time.Duration(maxDelayMs) * time.Millisecond
+	}
+
+	for _, addr := range whitelist {
+		if ip := net.ParseIP(addr); ip != nil {
+			l.whitelist[ip.String()] = struct{}{}
+		}
+	}
+
+	return l
+}
+
+// reserve returns the delay after which the query from the client with ip
+// fits the rate limit.  ok is false if the query should be dropped, because
+// the delay would exceed the maximum one.
+func (l *rateLimiter) reserve(ip net.IP) (delay time.Duration, ok bool) {
+	key := ip.String()
+	if _, ok = l.whitelist[key]; ok {
+		return 0, true
+	}
+
+	now := l.now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.tats) >= rateLimitSweepSize {
+		l.sweep(now)
+	}
+
+	tat := l.tats[key]
+	if tat.Before(now) {
+		tat = now
+	}
+
+	next := tat.Add(l.interval)
+	delay = next.Add(-l.burst).Sub(now)
+	if delay < 0 {
+		delay = 0
+	} else if delay > l.maxDelay {
+		return 0, false
+	}
+
+	l.tats[key] = next
+
+	return delay, true
+}
+
+// sweep removes the clients which fit the rate limit again at now.
+// l.lock is expected to be locked.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, tat := range l.tats {
+		if tat.Before(now) {
+			delete(l.tats, key)
+		}
+	}
+}
+
+// cancel returns the slot reserved for the query from the client with ip back
+// to the bucket.
+func (l *rateLimiter) cancel(ip net.IP) {
+	key := ip.String()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if tat, ok := l.tats[key]; ok {
+		l.tats[key] = tat.Add(-l.interval)
+	}
+}
+
+// wait blocks until the query from the client with ip fits the rate limit.
+// ok is false if the query should be dropped, either because it would be
+// delayed for too long or because too many queries are delayed already.
+func (l *rateLimiter) wait(ip net.IP) (ok bool) {
+	delay, ok := l.reserve(ip)
+	if !ok {
+		return false
+	} else if delay == 0 {
+		return true
+	}
+
+	select {
+	case l.delayed <- struct{}{}:
+		defer func() { <-l.delayed }()
+	default:
+		l.cancel(ip)
+
+		return false
+	}
+
+	time.Sleep(delay)
+
+	return true
+}
@@ -0,0 +1,127 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter_reserve(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newRateLimiter(2, 600, []string{"192.168.1.1"})
+	l.now = func() time.Time { return now }
+
+	ip := net.IP{192, 168, 1, 2}
+
+	// A second's worth of queries is served at once.
+	for i := 0; i < 2; i++ {
+		delay, ok := l.reserve(ip)
+		assert.True(t, ok)
+		assert.Zero(t, delay)
+	}
+
+	delay, ok := l.reserve(ip)
+	assert.True(t, ok)
+	assert.Equal(t, 500*time.Millisecond, delay)
+
+	// The next one would be delayed for longer than the maximum delay.
+	_, ok = l.reserve(ip)
+	assert.False(t, ok)
+
+	// The other clients aren't affected.
+	delay, ok = l.reserve(net.IP{192, 168, 1, 3})
+	assert.True(t, ok)
+	assert.Zero(t, delay)
+
+	// Neither are the whitelisted ones.
+	for i := 0; i < 10; i++ {
+		delay, ok = l.reserve(net.IP{192, 168, 1, 1})
+		assert.True(t, ok)
+		assert.Zero(t, delay)
+	}
+
+	now = now.Add(time.Second)
+	delay, ok = l.reserve(ip)
+	assert.True(t, ok)
+	assert.Zero(t, delay)
+}
+
+func TestRateLimiter_wait(t *testing.T) {
+	l := newRateLimiter(10, 1000, nil)
+	ip := net.IP{192, 168, 1, 2}
+
+	for i := 0; i < 10; i++ {
+		assert.True(t, l.wait(ip))
+	}
+
+	// Occupy all slots of the delayed queries.
+	for i := 0; i < rateLimitMaxDelayed; i++ {
+		l.delayed <- struct{}{}
+	}
+
+	assert.False(t, l.wait(ip))
+
+	for i := 0; i < rateLimitMaxDelayed; i++ {
+		<-l.delayed
+	}
+
+	// The dropped query hasn't taken a slot of the bucket, so the next one
+	// is only delayed by a single interval.
+	start := time.Now()
+	assert.True(t, l.wait(ip))
+	elapsed := time.Since(start)
+	assert.True(t, elapsed > 0 && elapsed < 500*time.Millisecond, elapsed)
+	assert.Empty(t, l.delayed)
+}
+
+func TestServer_ratelimitMode(t *testing.T) {
+	t.Run("delay", func(t *testing.T) {
+		s := createTestServer(t)
+		s.conf.Ratelimit = 10
+		s.conf.RatelimitMode = rateLimitModeDelay
+		s.conf.RatelimitMaxDelay = 1000
+		err := s.startWithUpstream(&recordUpstream{})
+		assert.Nil(t, err)
+		t.Cleanup(func() { _ = s.Stop() })
+
+		addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+		for i := 0; i < 10; i++ {
+			reply, qerr := dns.Exchange(createTestMessage("example.org."), addr)
+			assert.Nil(t, qerr)
+			assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		}
+
+		// The over-limit query is served after a bounded delay.
+		start := time.Now()
+		reply, err := dns.Exchange(createTestMessage("example.org."), addr)
+		elapsed := time.Since(start)
+		assert.Nil(t, err)
+		if assert.NotNil(t, reply) {
+			assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		}
+		assert.True(t, elapsed < time.Second, elapsed)
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		s := createTestServer(t)
+		s.conf.Ratelimit = 1
+		s.conf.RatelimitMode = rateLimitModeDrop
+		err := s.startWithUpstream(&recordUpstream{})
+		assert.Nil(t, err)
+		t.Cleanup(func() { _ = s.Stop() })
+		assert.Nil(t, s.ratelimit)
+
+		addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+		c := &dns.Client{Timeout: 300 * time.Millisecond}
+
+		_, _, err = c.Exchange(createTestMessage("example.org."), addr)
+		assert.Nil(t, err)
+
+		_, _, err = c.Exchange(createTestMessage("example.org."), addr)
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,571 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// defaultSecondaryRetry is the interval between the attempts to transfer a
+// zone which has never been transferred.
+const defaultSecondaryRetry = 30 * time.Second
+
+// SecondaryZone is a zone which is transferred from a primary server using
+// AXFR or IXFR and answered authoritatively.
+type SecondaryZone struct {
+	// Zone is the name of the zone, for example "lan".
+	Zone string `yaml:"zone"`
+
+	// Primary is the address of the primary server, for example
+	// "192.168.1.2".  The port is 53 unless specified.
+	Primary string `yaml:"primary"`
+}
+
+// secondaryZone is the in-memory authoritative store of a SecondaryZone.
+type secondaryZone struct {
+	// lock protects soa, records, and transferred.
+	lock sync.RWMutex
+
+	// soa is the SOA record of the zone.  It's nil until the first
+	// successful transfer.
+	soa *dns.SOA
+
+	// records maps the lowercased owner names to the records of the zone
+	// except for the SOA one.
+	records map[string][]dns.RR
+
+	// transferred is the time of the last successful transfer or of the
+	// last check that the zone is up to date.
+	transferred time.Time
+
+	// refresh triggers a refresh of the zone, for example after a NOTIFY
+	// from the primary server.
+	refresh chan struct{}
+
+	// name is the lowercased FQDN of the zone.
+	name string
+
+	// primary is the address of the primary server with the port.
+	primary string
+}
+
+// secondaryCtx answers the queries for the secondary zones.
+type secondaryCtx struct {
+	zones []*secondaryZone
+
+	// done stops the refresh loops.  It's nil if the loops aren't running.
+	done chan struct{}
+}
+
+// init validates the secondary zones configuration.
+func (c *secondaryCtx) init(zones []SecondaryZone) (err error) {
+	c.zones = nil
+	for i, sz := range zones {
+		if _, ok := dns.IsDomainName(sz.Zone); !ok || sz.Zone == "" {
+			return fmt.Errorf("dns: secondary zone at index %d: invalid zone %q", i, sz.Zone)
+		}
+
+		primary := sz.Primary
+		if _, _, err = net.SplitHostPort(primary); err != nil {
+			primary = net.JoinHostPort(primary, "53")
+		}
+
+		host, _, _ := net.SplitHostPort(primary)
+		if host == "" {
+			return fmt.Errorf("dns: secondary zone %q: invalid primary %q", sz.Zone, sz.Primary)
+		}
+
+		c.zones = append(c.zones, &secondaryZone{
+			refresh: make(chan struct{}, 1),
+			name:    strings.ToLower(dns.Fqdn(sz.Zone)),
+			primary: primary,
+		})
+	}
+
+	return nil
+}
+
+// find returns the most specific zone containing name.  It returns nil if
+// there is none.
+func (c *secondaryCtx) find(name string) (z *secondaryZone) {
+	name = strings.ToLower(name)
+	for _, cur := range c.zones {
+		if dns.IsSubDomain(cur.name, name) && (z == nil || len(cur.name) > len(z.name)) {
+			z = cur
+		}
+	}
+
+	return z
+}
+
+// start starts the refresh loops of the zones.
+func (c *secondaryCtx) start() {
+	if len(c.zones) == 0 || c.done != nil {
+		return
+	}
+
+	c.done = make(chan struct{})
+	for _, z := range c.zones {
+		go z.loop(c.done)
+	}
+}
+
+// stop stops the refresh loops of the zones.
+func (c *secondaryCtx) stop() {
+	if c.done == nil {
+		return
+	}
+
+	close(c.done)
+	c.done = nil
+}
+
+// loop transfers the zone according to the timers from its SOA record and on
+// NOTIFY until done is closed.
+func (z *secondaryZone) loop(done chan struct{}) {
+	for {
+		err := z.transfer()
+		if err != nil {
+			log.Info("dns: secondary zone %s: %s", z.name, err)
+		}
+
+		t := time.NewTimer(z.nextRefresh(err != nil))
+		select {
+		case <-done:
+			t.Stop()
+
+			return
+		case <-z.refresh:
+			t.Stop()
+		case <-t.C:
+			// Go on.
+		}
+	}
+}
+
+// nextRefresh returns the time until the next refresh of the zone.
+func (z *secondaryZone) nextRefresh(failed bool) (d time.Duration) {
+	z.lock.RLock()
+	defer z.lock.RUnlock()
+
+	switch {
+	case z.soa == nil:
+		return defaultSecondaryRetry
+	case failed:
+		return time.Duration(z.soa.Retry) * time.Second
+	default:
+		return time.Duration(z.soa.Refresh) * time.Second
+	}
+}
+
+// transfer requests the zone from the primary server.  If the zone has been
+// transferred before, IXFR is used.
+func (z *secondaryZone) transfer() (err error) {
+	req := &dns.Msg{}
+
+	z.lock.RLock()
+	if z.soa != nil {
+		req.SetIxfr(z.name, z.soa.Serial, z.soa.Ns, z.soa.Mbox)
+	} else {
+		req.SetAxfr(z.name)
+	}
+	z.lock.RUnlock()
+
+	tr := &dns.Transfer{
+		DialTimeout:  DefaultTimeout,
+		ReadTimeout:  DefaultTimeout,
+		WriteTimeout: DefaultTimeout,
+	}
+
+	envs, err := tr.In(req, z.primary)
+	if err != nil {
+		return fmt.Errorf("transferring from %s: %w", z.primary, err)
+	}
+
+	var rrs []dns.RR
+	for env := range envs {
+		if env.Error != nil {
+			err = env.Error
+
+			continue
+		}
+
+		rrs = append(rrs, env.RR...)
+	}
+
+	if err != nil {
+		return fmt.Errorf("transferring from %s: %w", z.primary, err)
+	}
+
+	return z.apply(rrs)
+}
+
+// apply updates the zone using the records of an AXFR or IXFR response.
+func (z *secondaryZone) apply(rrs []dns.RR) (err error) {
+	if len(rrs) == 0 {
+		return agherr.Error("empty transfer")
+	}
+
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return agherr.Error("transfer doesn't start with soa")
+	}
+
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	switch {
+	case len(rrs) == 1:
+		// The IXFR response with only the SOA record means that the
+		// zone is up to date.
+		if z.soa == nil || z.soa.Serial != soa.Serial {
+			return agherr.Error("truncated transfer")
+		}
+	case len(rrs) >= 4 && z.soa != nil && rrs[1].Header().Rrtype == dns.TypeSOA:
+		z.records = applyIncremental(z.records, rrs[1:len(rrs)-1])
+		log.Debug("dns: secondary zone %s: incremental transfer of serial %d", z.name, soa.Serial)
+	default:
+		z.records = map[string][]dns.RR{}
+		for _, rr := range rrs[1 : len(rrs)-1] {
+			addZoneRecord(z.records, rr)
+		}
+		log.Debug("dns: secondary zone %s: full transfer of serial %d", z.name, soa.Serial)
+	}
+
+	z.soa = soa
+	z.transferred = time.Now()
+
+	return nil
+}
+
+// applyIncremental returns a copy of records with the changes from the IXFR
+// response applied.  rrs are the records between the leading and the trailing
+// SOA records, each sequence of deletions and each sequence of additions is
+// started with a SOA record.
+func applyIncremental(records map[string][]dns.RR, rrs []dns.RR) (updated map[string][]dns.RR) {
+	updated = make(map[string][]dns.RR, len(records))
+	for name, nrrs := range records {
+		updated[name] = append([]dns.RR(nil), nrrs...)
+	}
+
+	deleting := false
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			deleting = !deleting
+
+			continue
+		}
+
+		if !deleting {
+			addZoneRecord(updated, rr)
+
+			continue
+		}
+
+		name := strings.ToLower(rr.Header().Name)
+		nrrs := updated[name]
+		for i, cur := range nrrs {
+			if dns.IsDuplicate(cur, rr) {
+				nrrs = append(nrrs[:i:i], nrrs[i+1:]...)
+
+				break
+			}
+		}
+
+		if len(nrrs) == 0 {
+			delete(updated, name)
+		} else {
+			updated[name] = nrrs
+		}
+	}
+
+	return updated
+}
+
+// addZoneRecord adds rr to records unless there is the same record already.
+// The SOA records are skipped.
+func addZoneRecord(records map[string][]dns.RR, rr dns.RR) {
+	if rr.Header().Rrtype == dns.TypeSOA {
+		return
+	}
+
+	name := strings.ToLower(rr.Header().Name)
+	for _, cur := range records[name] {
+		if dns.IsDuplicate(cur, rr) {
+			return
+		}
+	}
+
+	records[name] = append(records[name], rr)
+}
+
+// hasDescendants returns true if there are records below name.  z.lock is
+// expected to be locked.
+func (z *secondaryZone) hasDescendants(name string) (ok bool) {
+	for n := range z.records {
+		if n != name && dns.IsSubDomain(name, n) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// exists returns true if name has records or is an empty non-terminal, that is
+// it only has records below it.  z.lock is expected to be locked.
+func (z *secondaryZone) exists(name string) (ok bool) {
+	if _, ok = z.records[name]; ok {
+		return true
+	}
+
+	return name == z.name || z.hasDescendants(name)
+}
+
+// parentName returns the name of the parent of name within the zone.
+func parentName(name string) (parent string) {
+	i := strings.IndexByte(name, '.')
+	if i < 0 || i == len(name)-1 {
+		return "."
+	}
+
+	return name[i+1:]
+}
+
+// delegation returns the name of the zone cut below the apex which name is at
+// or below, if any.  The DS records of a zone cut belong to the parent zone,
+// so the DS queries for the cut itself aren't delegated.  z.lock is expected
+// to be locked.
+func (z *secondaryZone) delegation(name string, qtype uint16) (cut string) {
+	for n := name; n != z.name && n != "."; n = parentName(n) {
+		if n == name && qtype == dns.TypeDS {
+			continue
+		}
+
+		for _, rr := range z.records[n] {
+			if rr.Header().Rrtype == dns.TypeNS {
+				// Keep looking, since the highest zone cut is
+				// the one which counts.
+				cut = n
+
+				break
+			}
+		}
+	}
+
+	return cut
+}
+
+// setReferral makes resp a referral to the servers of the zone cut.  The
+// addresses of the servers within the zone are added as glue.  z.lock is
+// expected to be locked.
+func (z *secondaryZone) setReferral(resp *dns.Msg, cut string) {
+	resp.Authoritative = false
+	for _, rr := range z.records[cut] {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		resp.Ns = append(resp.Ns, dns.Copy(ns))
+
+		target := strings.ToLower(ns.Ns)
+		if !dns.IsSubDomain(z.name, target) {
+			continue
+		}
+
+		for _, glue := range z.records[target] {
+			switch glue.Header().Rrtype {
+			case dns.TypeA, dns.TypeAAAA:
+				resp.Extra = append(resp.Extra, dns.Copy(glue))
+			}
+		}
+	}
+}
+
+// wildcard returns the name of the wildcard records which the records for
+// name, which doesn't exist, are synthesized from.  It's the wildcard child of
+// the closest encloser of name, see RFC 4592.  It returns an empty string if
+// there is no such wildcard.  z.lock is expected to be locked.
+func (z *secondaryZone) wildcard(name string) (wname string) {
+	for n := parentName(name); dns.IsSubDomain(z.name, n); n = parentName(n) {
+		if !z.exists(n) {
+			continue
+		}
+
+		wname = "*." + n
+		if _, ok := z.records[wname]; ok {
+			return wname
+		}
+
+		return ""
+	}
+
+	return ""
+}
+
+// negativeSOA returns the SOA record for the negative responses.  Its TTL is
+// the lesser of the TTL of the SOA record and its MINIMUM field, see RFC 2308.
+// z.lock is expected to be locked.
+func (z *secondaryZone) negativeSOA() (soa dns.RR) {
+	c := dns.Copy(z.soa).(*dns.SOA)
+	if c.Minttl < c.Hdr.Ttl {
+		c.Hdr.Ttl = c.Minttl
+	}
+
+	return c
+}
+
+// answer returns the authoritative response to req.  It returns nil if the
+// zone hasn't been transferred or if it has expired.  The queries for the
+// names at or below the zone cuts are answered with referrals, and the records
+// of the names which don't exist are synthesized from the wildcards.
+func (z *secondaryZone) answer(s *Server, req *dns.Msg) (resp *dns.Msg) {
+	z.lock.RLock()
+	defer z.lock.RUnlock()
+
+	if z.soa == nil {
+		return nil
+	}
+
+	expire := time.Duration(z.soa.Expire) * time.Second
+	if expire != 0 && time.Since(z.transferred) > expire {
+		return nil
+	}
+
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	resp = s.makeResponse(req)
+
+	if cut := z.delegation(name, q.Qtype); cut != "" {
+		z.setReferral(resp, cut)
+
+		return resp
+	}
+
+	resp.Authoritative = true
+
+	if name == z.name && (q.Qtype == dns.TypeSOA || q.Qtype == dns.TypeANY) {
+		resp.Answer = append(resp.Answer, copyOwnedRR(z.soa, q.Name))
+	}
+
+	rrs := z.records[name]
+	if !z.exists(name) {
+		wname := z.wildcard(name)
+		if wname == "" {
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = []dns.RR{z.negativeSOA()}
+
+			return resp
+		}
+
+		rrs = z.records[wname]
+	}
+
+	var cname dns.RR
+	for _, rr := range rrs {
+		switch rrType := rr.Header().Rrtype; {
+		case rrType == q.Qtype || q.Qtype == dns.TypeANY:
+			resp.Answer = append(resp.Answer, copyOwnedRR(rr, q.Name))
+		case rrType == dns.TypeCNAME:
+			cname = rr
+		}
+	}
+
+	if len(resp.Answer) == 0 && cname != nil {
+		resp.Answer = append(resp.Answer, copyOwnedRR(cname, q.Name))
+	}
+
+	if len(resp.Answer) == 0 {
+		resp.Ns = []dns.RR{z.negativeSOA()}
+	}
+
+	return resp
+}
+
+// copyOwnedRR returns a copy of rr with the owner name set to name, so that
+// the case of the question is preserved.
+func copyOwnedRR(rr dns.RR, name string) (c dns.RR) {
+	c = dns.Copy(rr)
+	c.Header().Name = name
+
+	return c
+}
+
+// handleNotify handles the NOTIFY message req from the client with the address
+// clientIP.  Only the primary server of the zone may trigger a refresh.
+func (c *secondaryCtx) handleNotify(s *Server, req *dns.Msg, clientIP string) (resp *dns.Msg) {
+	z := c.find(req.Question[0].Name)
+	if z == nil || strings.ToLower(req.Question[0].Name) != z.name {
+		return s.genRcodeResponse(req, dns.RcodeNotAuth)
+	}
+
+	host, _, _ := net.SplitHostPort(z.primary)
+	if ip := net.ParseIP(host); ip == nil || !ip.Equal(net.ParseIP(clientIP)) {
+		log.Debug("dns: secondary zone %s: refusing notify from %s", z.name, clientIP)
+
+		return s.genRcodeResponse(req, dns.RcodeRefused)
+	}
+
+	select {
+	case z.refresh <- struct{}{}:
+	default:
+		// A refresh is already pending.
+	}
+
+	resp = s.makeResponse(req)
+	resp.Authoritative = true
+
+	return resp
+}
+
+// genRcodeResponse returns an empty response to req with the rcode.
+func (s *Server) genRcodeResponse(req *dns.Msg, rcode int) (resp *dns.Msg) {
+	resp = s.makeResponse(req)
+	resp.Rcode = rcode
+
+	return resp
+}
+
+// processSecondaryZones answers the queries for the secondary zones
+// authoritatively and handles the NOTIFY messages for them.  The zones are only
+// served to the local clients.  The other queries are processed further.
+func processSecondaryZones(ctx *dnsContext) (rc resultCode) {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Res != nil || len(s.secondary.zones) == 0 {
+		return resultCodeSuccess
+	}
+
+	if d.Req.Opcode == dns.OpcodeNotify {
+		d.Res = s.secondary.handleNotify(s, d.Req, IPStringFromAddr(d.Addr))
+
+		return resultCodeFinish
+	}
+
+	if !isLocalClient(IPFromAddr(d.Addr)) {
+		return resultCodeSuccess
+	}
+
+	z := s.secondary.find(d.Req.Question[0].Name)
+	if z == nil {
+		return resultCodeSuccess
+	}
+
+	resp := z.answer(s, d.Req)
+	if resp == nil {
+		log.Debug("dns: secondary zone %s isn't available", z.name)
+
+		return resultCodeSuccess
+	}
+
+	d.Res = resp
+
+	return resultCodeSuccess
+}
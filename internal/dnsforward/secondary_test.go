@@ -0,0 +1,456 @@
+package dnsforward
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testPrimary is a stub primary server for the zone "lan.".  It answers AXFR
+// with the full zone and IXFR from serial 1 with the change of the address of
+// "host.lan." from 192.168.0.1 to 192.168.0.2 if its serial is 2.
+type testPrimary struct {
+	lock   sync.Mutex
+	serial uint32
+}
+
+// soa returns the SOA record of the zone with the serial.
+func (p *testPrimary) soa(serial uint32) (soa *dns.SOA) {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   "lan.",
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Ns:      "ns.lan.",
+		Mbox:    "admin.lan.",
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  60,
+	}
+}
+
+// a returns the A record of "host.lan." with the address ip.
+func (p *testPrimary) a(ip net.IP) (a *dns.A) {
+	return &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   "host.lan.",
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		A: ip,
+	}
+}
+
+// ServeDNS implements the dns.Handler interface for *testPrimary.
+func (p *testPrimary) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	p.lock.Lock()
+	serial := p.serial
+	p.lock.Unlock()
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+
+	cname := &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   "www.lan.",
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Target: "host.lan.",
+	}
+
+	hostIP := net.IP{192, 168, 0, 1}
+	if serial == 2 {
+		hostIP = net.IP{192, 168, 0, 2}
+	}
+
+	soa := p.soa(serial)
+	switch req.Question[0].Qtype {
+	case dns.TypeAXFR:
+		resp.Answer = []dns.RR{soa, p.a(hostIP), cname, soa}
+	case dns.TypeIXFR:
+		if req.Ns[0].(*dns.SOA).Serial == serial {
+			resp.Answer = []dns.RR{soa}
+		} else {
+			resp.Answer = []dns.RR{
+				soa,
+				p.soa(1), p.a(net.IP{192, 168, 0, 1}),
+				soa, p.a(hostIP),
+				soa,
+			}
+		}
+	default:
+		resp.Rcode = dns.RcodeRefused
+	}
+
+	_ = w.WriteMsg(resp)
+}
+
+// startTestPrimary starts p and returns its address.
+func startTestPrimary(t *testing.T, p *testPrimary) (addr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	srv := &dns.Server{
+		Listener: l,
+		Handler:  p,
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	return l.Addr().String()
+}
+
+func TestSecondaryZone_transfer(t *testing.T) {
+	p := &testPrimary{serial: 1}
+	addr := startTestPrimary(t, p)
+
+	c := &secondaryCtx{}
+	err := c.init([]SecondaryZone{{Zone: "lan", Primary: addr}})
+	assert.Nil(t, err)
+	if !assert.Len(t, c.zones, 1) {
+		return
+	}
+
+	z := c.zones[0]
+	err = z.transfer()
+	assert.Nil(t, err)
+
+	hostIP := func() (ip net.IP) {
+		z.lock.RLock()
+		defer z.lock.RUnlock()
+
+		if !assert.Len(t, z.records["host.lan."], 1) {
+			return nil
+		}
+
+		return z.records["host.lan."][0].(*dns.A).A
+	}
+
+	assert.Equal(t, uint32(1), z.soa.Serial)
+	assert.Len(t, z.records, 2)
+	assert.True(t, net.IP{192, 168, 0, 1}.Equal(hostIP()))
+
+	// The zone is up to date.
+	err = z.transfer()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), z.soa.Serial)
+
+	p.lock.Lock()
+	p.serial = 2
+	p.lock.Unlock()
+
+	err = z.transfer()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), z.soa.Serial)
+	assert.Len(t, z.records, 2)
+	assert.True(t, net.IP{192, 168, 0, 2}.Equal(hostIP()))
+}
+
+func TestServer_secondaryZones(t *testing.T) {
+	addr := startTestPrimary(t, &testPrimary{serial: 1})
+	ups := &recordUpstream{}
+
+	s := createTestServer(t)
+	s.conf.SecondaryZones = []SecondaryZone{{Zone: "lan", Primary: addr}}
+	assert.Nil(t, s.startWithUpstream(ups))
+	t.Cleanup(func() { _ = s.Stop() })
+
+	srvAddr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	// The zone isn't transferred yet, so the query is forwarded.
+	req := createTestMessageWithType("host.lan.", dns.TypeA)
+	_, err := dns.Exchange(req, srvAddr)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"host.lan."}, ups.received())
+
+	if !assert.Len(t, s.secondary.zones, 1) {
+		return
+	}
+	assert.Nil(t, s.secondary.zones[0].transfer())
+
+	testCases := []struct {
+		name      string
+		host      string
+		qtype     uint16
+		wantRcode int
+		wantAns   int
+		wantNs    int
+	}{{
+		name:      "a",
+		host:      "HOST.lan.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   1,
+		wantNs:    0,
+	}, {
+		name:      "cname",
+		host:      "www.lan.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   1,
+		wantNs:    0,
+	}, {
+		name:      "soa",
+		host:      "lan.",
+		qtype:     dns.TypeSOA,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   1,
+		wantNs:    0,
+	}, {
+		name:      "nodata",
+		host:      "host.lan.",
+		qtype:     dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   0,
+		wantNs:    1,
+	}, {
+		name:      "nxdomain",
+		host:      "unknown.lan.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+		wantAns:   0,
+		wantNs:    1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req = createTestMessageWithType(tc.host, tc.qtype)
+			reply, eerr := dns.Exchange(req, srvAddr)
+			assert.Nil(t, eerr)
+			assert.True(t, reply.Authoritative)
+			assert.Equal(t, tc.wantRcode, reply.Rcode)
+			assert.Len(t, reply.Answer, tc.wantAns)
+			assert.Len(t, reply.Ns, tc.wantNs)
+			if tc.wantAns > 0 {
+				assert.Equal(t, tc.host, reply.Answer[0].Header().Name)
+			}
+
+			// The negative answers use the MINIMUM field of the
+			// SOA record as its TTL.
+			if tc.wantNs > 0 {
+				assert.Equal(t, uint32(60), reply.Ns[0].Header().Ttl)
+			}
+		})
+	}
+
+	assert.Equal(t, []string{"host.lan."}, ups.received())
+}
+
+// newTestSecondaryZone returns a new secondary zone "lan." with a wildcard
+// below "dev.lan." and a delegation of "sub.lan.".
+func newTestSecondaryZone(t *testing.T) (z *secondaryZone) {
+	t.Helper()
+
+	newA := func(name string, ip net.IP) (a *dns.A) {
+		return &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    3600,
+			},
+			A: ip,
+		}
+	}
+
+	newNS := func(name, target string) (ns *dns.NS) {
+		return &dns.NS{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+				Ttl:    3600,
+			},
+			Ns: target,
+		}
+	}
+
+	soa := (&testPrimary{}).soa(1)
+	z = &secondaryZone{name: "lan."}
+	err := z.apply([]dns.RR{
+		soa,
+		newA("host.lan.", net.IP{192, 168, 0, 1}),
+		newA("*.dev.lan.", net.IP{192, 168, 1, 1}),
+		newNS("sub.lan.", "ns.sub.lan."),
+		newNS("sub.lan.", "ns.example.com."),
+		newA("ns.sub.lan.", net.IP{192, 168, 2, 53}),
+		newA("www.sub.lan.", net.IP{192, 168, 2, 1}),
+		soa,
+	})
+	assert.Nil(t, err)
+
+	return z
+}
+
+func TestSecondaryZone_answer(t *testing.T) {
+	s := &Server{}
+	z := newTestSecondaryZone(t)
+
+	testCases := []struct {
+		name      string
+		host      string
+		qtype     uint16
+		wantAuth  bool
+		wantRcode int
+		wantAns   int
+		wantNs    int
+		wantExtra int
+	}{{
+		name:      "wildcard",
+		host:      "a.dev.lan.",
+		qtype:     dns.TypeA,
+		wantAuth:  true,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   1,
+	}, {
+		name:      "wildcard_deep",
+		host:      "b.a.dev.lan.",
+		qtype:     dns.TypeA,
+		wantAuth:  true,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   1,
+	}, {
+		name:      "wildcard_nodata",
+		host:      "a.dev.lan.",
+		qtype:     dns.TypeAAAA,
+		wantAuth:  true,
+		wantRcode: dns.RcodeSuccess,
+		wantNs:    1,
+	}, {
+		name:      "empty_non_terminal",
+		host:      "dev.lan.",
+		qtype:     dns.TypeA,
+		wantAuth:  true,
+		wantRcode: dns.RcodeSuccess,
+		wantNs:    1,
+	}, {
+		name:      "nxdomain",
+		host:      "a.host.lan.",
+		qtype:     dns.TypeA,
+		wantAuth:  true,
+		wantRcode: dns.RcodeNameError,
+		wantNs:    1,
+	}, {
+		name:      "referral",
+		host:      "www.sub.lan.",
+		qtype:     dns.TypeA,
+		wantAuth:  false,
+		wantRcode: dns.RcodeSuccess,
+		wantNs:    2,
+		wantExtra: 1,
+	}, {
+		name:      "referral_cut",
+		host:      "sub.lan.",
+		qtype:     dns.TypeNS,
+		wantAuth:  false,
+		wantRcode: dns.RcodeSuccess,
+		wantNs:    2,
+		wantExtra: 1,
+	}, {
+		name:      "ds",
+		host:      "sub.lan.",
+		qtype:     dns.TypeDS,
+		wantAuth:  true,
+		wantRcode: dns.RcodeSuccess,
+		wantNs:    1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := z.answer(s, createTestMessageWithType(tc.host, tc.qtype))
+			if !assert.NotNil(t, resp) {
+				return
+			}
+
+			assert.Equal(t, tc.wantAuth, resp.Authoritative)
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			assert.Len(t, resp.Answer, tc.wantAns)
+			assert.Len(t, resp.Ns, tc.wantNs)
+			assert.Len(t, resp.Extra, tc.wantExtra)
+
+			if tc.wantAns > 0 {
+				// The wildcard records are synthesized for
+				// the name from the question.
+				assert.Equal(t, tc.host, resp.Answer[0].Header().Name)
+			}
+
+			if tc.wantAuth && tc.wantNs > 0 {
+				soa, ok := resp.Ns[0].(*dns.SOA)
+				if assert.True(t, ok) {
+					assert.Equal(t, uint32(60), soa.Hdr.Ttl)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessSecondaryZones_local(t *testing.T) {
+	s := &Server{}
+	s.secondary.zones = []*secondaryZone{newTestSecondaryZone(t)}
+
+	testCases := []struct {
+		name    string
+		ip      net.IP
+		wantRes bool
+	}{{
+		name:    "local",
+		ip:      net.IP{192, 168, 0, 10},
+		wantRes: true,
+	}, {
+		name:    "loopback",
+		ip:      net.IP{127, 0, 0, 1},
+		wantRes: true,
+	}, {
+		name:    "public",
+		ip:      net.IP{8, 8, 8, 8},
+		wantRes: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &proxy.DNSContext{
+				Req:  createTestMessageWithType("host.lan.", dns.TypeA),
+				Addr: &net.UDPAddr{IP: tc.ip, Port: 53},
+			}
+			ctx := &dnsContext{srv: s, proxyCtx: d}
+
+			assert.Equal(t, resultCodeSuccess, processSecondaryZones(ctx))
+			assert.Equal(t, tc.wantRes, d.Res != nil)
+		})
+	}
+}
+
+func TestSecondaryCtx_handleNotify(t *testing.T) {
+	s := &Server{}
+	c := &secondaryCtx{}
+	err := c.init([]SecondaryZone{{Zone: "lan", Primary: "192.168.0.53"}})
+	assert.Nil(t, err)
+
+	req := &dns.Msg{}
+	req.SetNotify("lan.")
+
+	resp := c.handleNotify(s, req, "192.168.0.1")
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	assert.Len(t, c.zones[0].refresh, 0)
+
+	resp = c.handleNotify(s, req, "192.168.0.53")
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.True(t, resp.Authoritative)
+	assert.Equal(t, dns.OpcodeNotify, resp.Opcode)
+	assert.Len(t, c.zones[0].refresh, 1)
+
+	req.SetNotify("other.")
+	resp = c.handleNotify(s, req, "192.168.0.53")
+	assert.Equal(t, dns.RcodeNotAuth, resp.Rcode)
+}
@@ -0,0 +1,189 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Types of the local services.
+const (
+	localServiceSRV   = "SRV"
+	localServiceNAPTR = "NAPTR"
+)
+
+// LocalService is an SRV or a NAPTR record which is answered locally instead
+// of being forwarded to the upstream servers.
+type LocalService struct {
+	// Name is the domain name of the record, for example "_sip._udp.lan".
+	Name string `yaml:"name"`
+
+	// Type is either "SRV" or "NAPTR".
+	Type string `yaml:"type"`
+
+	// Priority, Weight, Port, and Target are the fields of an SRV record.
+	// See RFC 2782.
+	Priority uint16 `yaml:"priority,omitempty"`
+	Weight   uint16 `yaml:"weight,omitempty"`
+	Port     uint16 `yaml:"port,omitempty"`
+	Target   string `yaml:"target,omitempty"`
+
+	// Order, Preference, Flags, Service, Regexp, and Replacement are the
+	// fields of a NAPTR record.  See RFC 3403.
+	Order       uint16 `yaml:"order,omitempty"`
+	Preference  uint16 `yaml:"preference,omitempty"`
+	Flags       string `yaml:"flags,omitempty"`
+	Service     string `yaml:"service,omitempty"`
+	Regexp      string `yaml:"regexp,omitempty"`
+	Replacement string `yaml:"replacement,omitempty"`
+}
+
+// validate returns an error if the fields of svc are invalid.
+func (svc *LocalService) validate() (err error) {
+	if _, ok := dns.IsDomainName(svc.Name); !ok || svc.Name == "" {
+		return fmt.Errorf("invalid name %q", svc.Name)
+	}
+
+	switch strings.ToUpper(svc.Type) {
+	case localServiceSRV:
+		if _, ok := dns.IsDomainName(svc.Target); !ok || svc.Target == "" {
+			return fmt.Errorf("invalid target %q", svc.Target)
+		}
+
+		// A target of "." means that the service is decidedly not
+		// available, so the port doesn't matter.
+		if svc.Port == 0 && svc.Target != "." {
+			return fmt.Errorf("invalid port %d", svc.Port)
+		}
+	case localServiceNAPTR:
+		for _, c := range svc.Flags {
+			if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+				return fmt.Errorf("invalid flags %q", svc.Flags)
+			}
+		}
+
+		repl := svc.Replacement
+		if repl == "" {
+			repl = "."
+		}
+
+		if _, ok := dns.IsDomainName(repl); !ok {
+			return fmt.Errorf("invalid replacement %q", repl)
+		}
+
+		if svc.Regexp != "" && repl != "." {
+			return fmt.Errorf("regexp and replacement are mutually exclusive")
+		}
+	default:
+		return fmt.Errorf("invalid type %q", svc.Type)
+	}
+
+	return nil
+}
+
+// servicesCtx answers the SRV and NAPTR queries for the locally configured
+// services.
+type servicesCtx struct {
+	// services maps the lowercased FQDNs of the services to their records.
+	services map[string][]*LocalService
+}
+
+// init validates and indexes the local services.
+func (c *servicesCtx) init(services []LocalService) (err error) {
+	c.services = nil
+	if len(services) == 0 {
+		return nil
+	}
+
+	c.services = make(map[string][]*LocalService, len(services))
+	for i := range services {
+		svc := services[i]
+		err = svc.validate()
+		if err != nil {
+			return fmt.Errorf("dns: local service at index %d: %w", i, err)
+		}
+
+		svc.Type = strings.ToUpper(svc.Type)
+		if svc.Type == localServiceNAPTR {
+			svc.Replacement = dns.Fqdn(svc.Replacement)
+		} else {
+			svc.Target = dns.Fqdn(svc.Target)
+		}
+
+		name := strings.ToLower(dns.Fqdn(svc.Name))
+		c.services[name] = append(c.services[name], &svc)
+	}
+
+	return nil
+}
+
+// answer returns the resource records answering the question of req if there
+// are local services for it.
+func (c *servicesCtx) answer(s *Server, req *dns.Msg) (ans []dns.RR) {
+	q := req.Question[0]
+
+	var typ string
+	switch q.Qtype {
+	case dns.TypeSRV:
+		typ = localServiceSRV
+	case dns.TypeNAPTR:
+		typ = localServiceNAPTR
+	default:
+		return nil
+	}
+
+	for _, svc := range c.services[strings.ToLower(q.Name)] {
+		if svc.Type != typ {
+			continue
+		}
+
+		if typ == localServiceSRV {
+			ans = append(ans, &dns.SRV{
+				Hdr:      s.hdr(req, dns.TypeSRV),
+				Priority: svc.Priority,
+				Weight:   svc.Weight,
+				Port:     svc.Port,
+				Target:   svc.Target,
+			})
+
+			continue
+		}
+
+		ans = append(ans, &dns.NAPTR{
+			Hdr:         s.hdr(req, dns.TypeNAPTR),
+			Order:       svc.Order,
+			Preference:  svc.Preference,
+			Flags:       svc.Flags,
+			Service:     svc.Service,
+			Regexp:      svc.Regexp,
+			Replacement: svc.Replacement,
+		})
+	}
+
+	return ans
+}
+
+// processLocalServices answers the SRV and NAPTR queries for the locally
+// configured services.  The other queries are processed further.
+func processLocalServices(ctx *dnsContext) (rc resultCode) {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Res != nil || len(s.services.services) == 0 {
+		return resultCodeSuccess
+	}
+
+	ans := s.services.answer(s, d.Req)
+	if len(ans) == 0 {
+		return resultCodeSuccess
+	}
+
+	log.Debug("dns: local service: %s", d.Req.Question[0].Name)
+
+	resp := s.makeResponse(d.Req)
+	resp.Answer = ans
+	d.Res = resp
+
+	return resultCodeSuccess
+}
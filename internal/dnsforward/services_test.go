@@ -0,0 +1,157 @@
+package dnsforward
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalService_validate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		svc     LocalService
+		wantErr bool
+	}{{
+		name: "srv",
+		svc: LocalService{
+			Name:     "_sip._udp.lan",
+			Type:     "srv",
+			Priority: 10,
+			Weight:   5,
+			Port:     5060,
+			Target:   "pbx.lan",
+		},
+		wantErr: false,
+	}, {
+		name: "srv_no_service",
+		svc: LocalService{
+			Name:   "_sip._udp.lan",
+			Type:   "SRV",
+			Target: ".",
+		},
+		wantErr: false,
+	}, {
+		name: "srv_no_port",
+		svc: LocalService{
+			Name:   "_sip._udp.lan",
+			Type:   "SRV",
+			Target: "pbx.lan",
+		},
+		wantErr: true,
+	}, {
+		name: "srv_no_target",
+		svc: LocalService{
+			Name: "_sip._udp.lan",
+			Type: "SRV",
+			Port: 5060,
+		},
+		wantErr: true,
+	}, {
+		name: "naptr",
+		svc: LocalService{
+			Name:        "lan",
+			Type:        "NAPTR",
+			Order:       10,
+			Preference:  100,
+			Flags:       "S",
+			Service:     "SIP+D2U",
+			Replacement: "_sip._udp.lan",
+		},
+		wantErr: false,
+	}, {
+		name: "naptr_bad_flags",
+		svc: LocalService{
+			Name:  "lan",
+			Type:  "NAPTR",
+			Flags: "S!",
+		},
+		wantErr: true,
+	}, {
+		name: "naptr_regexp_and_replacement",
+		svc: LocalService{
+			Name:        "lan",
+			Type:        "NAPTR",
+			Flags:       "U",
+			Regexp:      "!^.*$!sip:info@example.com!",
+			Replacement: "_sip._udp.lan",
+		},
+		wantErr: true,
+	}, {
+		name: "bad_type",
+		svc: LocalService{
+			Name: "lan",
+			Type: "MX",
+		},
+		wantErr: true,
+	}, {
+		name: "no_name",
+		svc: LocalService{
+			Type:   "SRV",
+			Port:   5060,
+			Target: "pbx.lan",
+		},
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.svc.validate()
+			if tc.wantErr {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestServer_localServices(t *testing.T) {
+	ups := &recordUpstream{}
+
+	s := createTestServer(t)
+	s.conf.LocalServices = []LocalService{{
+		Name:     "_sip._udp.lan",
+		Type:     "SRV",
+		Priority: 10,
+		Weight:   5,
+		Port:     5060,
+		Target:   "pbx.lan",
+	}}
+	assert.Nil(t, s.startWithUpstream(ups))
+	t.Cleanup(func() { _ = s.Stop() })
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	req := createTestMessageWithType("_SIP._udp.lan.", dns.TypeSRV)
+	reply, err := dns.Exchange(req, addr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	if assert.Len(t, reply.Answer, 1) {
+		srv, ok := reply.Answer[0].(*dns.SRV)
+		if assert.True(t, ok) {
+			assert.Equal(t, "_SIP._udp.lan.", srv.Hdr.Name)
+			assert.Equal(t, uint16(10), srv.Priority)
+			assert.Equal(t, uint16(5), srv.Weight)
+			assert.Equal(t, uint16(5060), srv.Port)
+			assert.Equal(t, "pbx.lan.", srv.Target)
+		}
+	}
+	assert.Empty(t, ups.received())
+
+	req = createTestMessageWithType("_xmpp._tcp.lan.", dns.TypeSRV)
+	_, err = dns.Exchange(req, addr)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"_xmpp._tcp.lan."}, ups.received())
+}
+
+func TestServer_Prepare_localServices(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.LocalServices = []LocalService{{
+		Name: "_sip._udp.lan",
+		Type: "SRV",
+	}}
+
+	assert.NotNil(t, s.Prepare(nil))
+}
@@ -0,0 +1,164 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Policies for the special-use domain names.  See
+// FilteringConfig.SpecialUseDomains.
+const (
+	// specialUseLoopback means that the A and AAAA queries are answered
+	// with the loopback addresses and the others with NODATA.
+	specialUseLoopback = "loopback"
+
+	// specialUseNXDomain means that the queries are answered with
+	// NXDOMAIN.
+	specialUseNXDomain = "nxdomain"
+
+	// specialUseRefuse means that the queries are answered with REFUSED.
+	specialUseRefuse = "refuse"
+
+	// specialUseForward means that the queries are forwarded to the
+	// upstream servers like any other ones.
+	specialUseForward = "forward"
+)
+
+// defaultSpecialUseDomains are the default policies for the special-use domain
+// names from RFC 6761 and RFC 7686 and for the mDNS domain from RFC 6762,
+// which shouldn't be leaked to the upstream servers.  "test" isn't there,
+// since it's commonly served by the local upstreams in the test environments.
+var defaultSpecialUseDomains = map[string]string{
+	"localhost": specialUseLoopback,
+	"invalid":   specialUseNXDomain,
+	"onion":     specialUseRefuse,
+	"local":     specialUseRefuse,
+}
+
+// specialUseCtx answers the queries for the special-use domain names locally.
+type specialUseCtx struct {
+	// policies maps the lowercased domains without the trailing dot to their
+	// policies.  The policies for the subdomains are inherited from the
+	// domains.
+	policies map[string]string
+}
+
+// init validates the overrides of the default policies and merges them.  The
+// domains which have their own upstreams in reserved, like the ones from
+// "[/local/]192.168.1.1", are forwarded unless they're overridden explicitly.
+func (c *specialUseCtx) init(
+	overrides map[string]string,
+	reserved map[string][]upstream.Upstream,
+) (err error) {
+	policies := make(map[string]string, len(defaultSpecialUseDomains)+len(overrides))
+	for domain, policy := range defaultSpecialUseDomains {
+		policies[domain] = policy
+	}
+
+	for domain, policy := range overrides {
+		if _, ok := dns.IsDomainName(domain); !ok || strings.Trim(domain, ".") == "" {
+			return fmt.Errorf("dns: special-use domain: invalid domain %q", domain)
+		}
+
+		switch policy {
+		case specialUseLoopback, specialUseNXDomain, specialUseRefuse, specialUseForward:
+			// Go on.
+		default:
+			return fmt.Errorf("dns: special-use domain %q: invalid policy %q", domain, policy)
+		}
+
+		policies[strings.ToLower(strings.Trim(domain, "."))] = policy
+	}
+
+	c.policies = make(map[string]string, len(policies)+len(reserved))
+	for domain, ups := range reserved {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if _, ok := policies[domain]; ok {
+			continue
+		}
+
+		// The domains without upstreams are the ones excluded from the
+		// reserved upstreams of their parent domains, so they get the
+		// policies they would have without them.
+		policy := specialUseForward
+		if len(ups) == 0 {
+			policy = domainPolicy(policies, domain)
+		}
+
+		c.policies[domain] = policy
+	}
+
+	for domain, policy := range policies {
+		c.policies[domain] = policy
+	}
+
+	return nil
+}
+
+// policy returns the policy for the question name qname.  The policy of the
+// most specific domain wins.  It returns specialUseForward if there is none.
+func (c *specialUseCtx) policy(qname string) (policy string) {
+	return domainPolicy(c.policies, qname)
+}
+
+// domainPolicy returns the policy for the question name qname from policies.
+// The policy of the most specific domain wins.  It returns specialUseForward
+// if there is none.
+func domainPolicy(policies map[string]string, qname string) (policy string) {
+	name := strings.ToLower(strings.TrimSuffix(qname, "."))
+	for name != "" {
+		if p, ok := policies[name]; ok {
+			return p
+		}
+
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+
+		name = name[i+1:]
+	}
+
+	return specialUseForward
+}
+
+// processSpecialUseNames answers the queries for the special-use domain names,
+// like "localhost" or "invalid", according to their policies instead of
+// forwarding them.  It's called after the filtering, so the DNS rewrites, the
+// hosts rules, and the blocklists still apply to such names.
+func processSpecialUseNames(ctx *dnsContext) (rc resultCode) {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Res != nil {
+		return resultCodeSuccess
+	}
+
+	req := d.Req
+	policy := s.specialUse.policy(req.Question[0].Name)
+	switch policy {
+	case specialUseLoopback:
+		switch req.Question[0].Qtype {
+		case dns.TypeA:
+			d.Res = s.genARecord(req, []byte{127, 0, 0, 1})
+		case dns.TypeAAAA:
+			d.Res = s.genAAAARecord(req, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1})
+		default:
+			d.Res = s.makeResponse(req)
+			d.Res.Ns = s.genSOA(req)
+		}
+	case specialUseNXDomain:
+		d.Res = s.genNXDomain(req)
+	case specialUseRefuse:
+		d.Res = s.makeResponseREFUSED(req)
+	default:
+		return resultCodeSuccess
+	}
+
+	log.Debug("dns: special-use name %s: %s", req.Question[0].Name, policy)
+
+	return resultCodeSuccess
+}
@@ -0,0 +1,190 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_processSpecialUseNames(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.SpecialUseDomains = map[string]string{
+		"forwarded.invalid": specialUseForward,
+		"blocked.local":     specialUseNXDomain,
+	}
+	s.conf.UpstreamDNS = []string{"8.8.8.8:53", "[/home.local/]192.168.1.1:53"}
+	assert.Nil(t, s.dnsFilter.SetFilters([]dnsfilter.Filter{{
+		Data: []byte("1.2.3.7 hosts.local\n||blocked.onion^\n"),
+	}}, nil, false))
+	assert.Nil(t, s.startWithUpstream(&testUpstream{
+		ipv4: map[string][]net.IP{
+			"host.":                   {{1, 2, 3, 4}},
+			"example.test.":           {{1, 2, 3, 5}},
+			"host.forwarded.invalid.": {{1, 2, 3, 6}},
+			"nas.home.local.":         {{192, 168, 1, 2}},
+		},
+	}))
+	t.Cleanup(func() { _ = s.Stop() })
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	testCases := []struct {
+		name      string
+		host      string
+		qtype     uint16
+		wantRcode int
+		wantIP    net.IP
+	}{{
+		name:      "localhost_a",
+		host:      "localhost.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IP{127, 0, 0, 1},
+	}, {
+		name:      "localhost_aaaa",
+		host:      "LocalHost.",
+		qtype:     dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IPv6loopback,
+	}, {
+		name:      "localhost_subdomain",
+		host:      "sub.localhost.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IP{127, 0, 0, 1},
+	}, {
+		name:      "localhost_other_type",
+		host:      "localhost.",
+		qtype:     dns.TypeMX,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    nil,
+	}, {
+		name:      "invalid",
+		host:      "host.invalid.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+		wantIP:    nil,
+	}, {
+		name:      "onion",
+		host:      "example.onion.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeRefused,
+		wantIP:    nil,
+	}, {
+		name:      "local",
+		host:      "printer.local.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeRefused,
+		wantIP:    nil,
+	}, {
+		name:      "override_subdomain",
+		host:      "a.blocked.local.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+		wantIP:    nil,
+	}, {
+		name:      "override_forward",
+		host:      "host.forwarded.invalid.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IP{1, 2, 3, 6},
+	}, {
+		name:      "test_forwarded",
+		host:      "example.test.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IP{1, 2, 3, 5},
+	}, {
+		name:      "reserved_upstreams",
+		host:      "nas.home.local.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IP{192, 168, 1, 2},
+	}, {
+		name:      "hosts_rule",
+		host:      "hosts.local.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IP{1, 2, 3, 7},
+	}, {
+		name:      "blocklist",
+		host:      "blocked.onion.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IP{0, 0, 0, 0},
+	}, {
+		name:      "normal",
+		host:      "host.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IP{1, 2, 3, 4},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reply, err := dns.Exchange(createTestMessageWithType(tc.host, tc.qtype), addr)
+			assert.Nil(t, err)
+			if !assert.NotNil(t, reply) {
+				return
+			}
+
+			assert.Equal(t, tc.wantRcode, reply.Rcode)
+			if tc.wantIP == nil {
+				assert.Empty(t, reply.Answer)
+
+				return
+			}
+
+			if !assert.Len(t, reply.Answer, 1) {
+				return
+			}
+
+			switch ans := reply.Answer[0].(type) {
+			case *dns.A:
+				assert.True(t, tc.wantIP.Equal(ans.A))
+			case *dns.AAAA:
+				assert.True(t, tc.wantIP.Equal(ans.AAAA))
+			default:
+				t.Errorf("unexpected answer %s", ans)
+			}
+		})
+	}
+}
+
+func TestSpecialUseCtx_init(t *testing.T) {
+	c := &specialUseCtx{}
+
+	assert.Nil(t, c.init(nil, nil))
+	assert.Equal(t, specialUseLoopback, c.policy("localhost."))
+	assert.Equal(t, specialUseForward, c.policy("example.org."))
+	assert.Equal(t, specialUseForward, c.policy("example.test."))
+	assert.Equal(t, specialUseForward, c.policy("."))
+
+	assert.Nil(t, c.init(map[string]string{"Localhost.": specialUseRefuse}, nil))
+	assert.Equal(t, specialUseRefuse, c.policy("localhost."))
+
+	reserved := map[string][]upstream.Upstream{
+		"home.local.":     {&testUpstream{}},
+		"tv.home.local.":  nil,
+		"router.onion.":   {&testUpstream{}},
+		"blocked.onion.":  {&testUpstream{}},
+		"example.local.":  {&testUpstream{}},
+		"example.invalid": {&testUpstream{}},
+	}
+	assert.Nil(t, c.init(map[string]string{"blocked.onion": specialUseNXDomain}, reserved))
+	assert.Equal(t, specialUseForward, c.policy("nas.home.local."))
+	assert.Equal(t, specialUseRefuse, c.policy("tv.home.local."))
+	assert.Equal(t, specialUseRefuse, c.policy("printer.local."))
+	assert.Equal(t, specialUseForward, c.policy("router.onion."))
+	assert.Equal(t, specialUseNXDomain, c.policy("blocked.onion."))
+	assert.Equal(t, specialUseForward, c.policy("host.example.invalid."))
+
+	assert.NotNil(t, c.init(map[string]string{"onion": "drop"}, nil))
+	assert.NotNil(t, c.init(map[string]string{"": specialUseRefuse}, nil))
+	assert.NotNil(t, c.init(map[string]string{".": specialUseRefuse}, nil))
+}
@@ -0,0 +1,262 @@
+package dnsforward
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// staleTTL is the TTL of the records in responses served stale.  The value is
+// the one recommended by RFC 8767.
+const staleTTL = 30
+
+// staleCacheMaxItems is the maximum number of responses kept by staleCache.
+const staleCacheMaxItems = 10000
+
+// staleKey is the key of a staleCache item.
+type staleKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+
+	// ecs is the subnet from the EDNS Client Subnet option of the request
+	// or an empty string if there is none.  The responses may depend on it.
+	ecs string
+
+	// do is true if the request has the DNSSEC OK flag set.  The responses
+	// to such requests contain the DNSSEC records, so they are kept apart
+	// from the ones to the other requests.
+	do bool
+}
+
+// staleItem is a response stored in staleCache.
+type staleItem struct {
+	resp *dns.Msg
+	// expire is the time when the TTL of resp runs out.
+	expire time.Time
+	// window is the period of time after expire during which resp may
+	// still be served.
+	window time.Duration
+	// revalidating is true if there is a background lookup refreshing
+	// this item.
+	revalidating bool
+}
+
+// staleCache keeps the responses received from upstream servers so that they
+// can be served after their TTLs run out, while the fresh ones are looked up in
+// the background.
+type staleCache struct {
+	items map[staleKey]*staleItem
+	lock  sync.Mutex
+
+	// maxStale is the longest period of time during which an expired
+	// response may be served.
+	maxStale time.Duration
+
+	// now returns the current time.  It is time.Now unless tests replace
+	// it.
+	now func() time.Time
+}
+
+// newStaleCache returns a new properly initialized *staleCache.
+func newStaleCache(maxStaleSec uint32) (c *staleCache) {
+	return &staleCache{
+		items:    map[staleKey]*staleItem{},
+		maxStale: time.Duration(maxStaleSec) * time.Second,
+		now:      time.Now,
+	}
+}
+
+// staleKeyFromMsg returns the key for m.  m must have a question.
+func staleKeyFromMsg(m *dns.Msg) (k staleKey) {
+	q := m.Question[0]
+	opt := m.IsEdns0()
+
+	k = staleKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+		do:     opt != nil && opt.Do(),
+	}
+
+	if subnet := ecsSubnet(m); subnet != nil {
+		k.ecs = subnet.String()
+	}
+
+	return k
+}
+
+// minTTL returns the lowest TTL of the answer records in resp.  ok is false if
+// there are no answer records.
+func minTTL(resp *dns.Msg) (ttl uint32, ok bool) {
+	for i, rr := range resp.Answer {
+		hdrTTL := rr.Header().Ttl
+		if i == 0 || hdrTTL < ttl {
+			ttl = hdrTTL
+		}
+	}
+
+	return ttl, len(resp.Answer) != 0
+}
+
+// set stores the response to req.  Only successful responses with answers are
+// stored.  The stale window of the response is the lower of the configured
+// maximum and the response's own TTL, so that volatile records with short TTLs
+// aren't served stale for too long.
+func (c *staleCache) set(req, resp *dns.Msg) {
+	if resp == nil || resp.Rcode != dns.RcodeSuccess || len(req.Question) == 0 {
+		return
+	}
+
+	ttl, ok := minTTL(resp)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	ttlDur := time.Duration(ttl) * time.Second
+	window := c.maxStale
+	if ttlDur < window {
+		window = ttlDur
+	}
+
+	k := staleKeyFromMsg(req)
+	now := c.now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok = c.items[k]; !ok && len(c.items) >= staleCacheMaxItems {
+		c.removeExpiredLocked(now)
+		if len(c.items) >= staleCacheMaxItems {
+			log.Debug("dns: stale cache is full, not storing %s", k.name)
+
+			return
+		}
+	}
+
+	c.items[k] = &staleItem{
+		resp:   resp.Copy(),
+		expire: now.Add(ttlDur),
+		window: window,
+	}
+}
+
+// removeExpiredLocked removes the items which can't be served anymore.  c.lock
+// is expected to be locked.
+func (c *staleCache) removeExpiredLocked(now time.Time) {
+	for k, it := range c.items {
+		if now.After(it.expire.Add(it.window)) {
+			delete(c.items, k)
+		}
+	}
+}
+
+// get returns a copy of the response to req if it has expired, but is still
+// within its stale window.  revalidate is true if the caller must look up the
+// fresh response and update the cache, since there is no other lookup in
+// progress.  If resp is nil, the response is either absent, still fresh, or
+// too stale, and the caller must perform a regular lookup.
+func (c *staleCache) get(req *dns.Msg) (resp *dns.Msg, revalidate bool) {
+	if len(req.Question) == 0 {
+		return nil, false
+	}
+
+	k := staleKeyFromMsg(req)
+	now := c.now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	it, ok := c.items[k]
+	if !ok || now.Before(it.expire) {
+		return nil, false
+	}
+
+	if now.After(it.expire.Add(it.window)) {
+		delete(c.items, k)
+
+		return nil, false
+	}
+
+	revalidate = !it.revalidating
+	it.revalidating = true
+
+	resp = it.resp.Copy()
+	resp.Id = req.Id
+	for _, rr := range resp.Answer {
+		rr.Header().Ttl = staleTTL
+	}
+
+	return resp, revalidate
+}
+
+// unmark resets the revalidation flag of the item for req, so that the next
+// request triggers another revalidation.
+func (c *staleCache) unmark(req *dns.Msg) {
+	k := staleKeyFromMsg(req)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if it, ok := c.items[k]; ok {
+		it.revalidating = false
+	}
+}
+
+// remove removes the responses for name of type qtype, both with and without
+// the DNSSEC records and for any client subnet.  If qtype is 0, the responses
+// of all types are removed.
+func (c *staleCache) remove(name string, qtype uint16) {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for k := range c.items {
+		if k.name == name && (qtype == 0 || k.qtype == qtype) {
+			delete(c.items, k)
+		}
+	}
+}
+
+// clear removes all responses.
+func (c *staleCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.items = map[staleKey]*staleItem{}
+}
+
+// revalidateStale looks up the fresh response to req and updates the stale
+// cache.  It is intended to be used as a goroutine.
+func (s *Server) revalidateStale(c *staleCache, req *dns.Msg) {
+	s.RLock()
+	p := s.dnsProxy
+	s.RUnlock()
+	if p == nil {
+		return
+	}
+
+	pctx := &proxy.DNSContext{
+		Proto:     proxy.ProtoUDP,
+		Req:       req,
+		StartTime: time.Now(),
+
+		CustomUpstreamConfig: s.pools.upstreamConfig(),
+	}
+
+	err := p.Resolve(pctx)
+	if err != nil {
+		log.Debug("dns: revalidating stale response for %s: %s", req.Question[0].Name, err)
+	} else {
+		c.set(req, pctx.Res)
+	}
+
+	// If the fresh response hasn't replaced the stale one, let the next
+	// request try again.
+	c.unmark(req)
+}
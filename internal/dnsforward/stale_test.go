@@ -0,0 +1,231 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaleCache(t *testing.T) {
+	const ttl = 10
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newStaleCache(60)
+	c.now = func() time.Time { return now }
+
+	req := createTestMessage("example.org.")
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   "example.org.",
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		A: net.IP{1, 2, 3, 4},
+	}}
+
+	c.set(req, resp)
+
+	t.Run("fresh", func(t *testing.T) {
+		got, revalidate := c.get(req)
+		assert.Nil(t, got)
+		assert.False(t, revalidate)
+	})
+
+	t.Run("within_window", func(t *testing.T) {
+		now = now.Add((ttl + 5) * time.Second)
+
+		got, revalidate := c.get(req)
+		assert.NotNil(t, got)
+		assert.True(t, revalidate)
+		assert.Len(t, got.Answer, 1)
+		assert.Equal(t, uint32(staleTTL), got.Answer[0].Header().Ttl)
+
+		// The revalidation is already in progress, so the response
+		// must be served stale without another one.
+		got, revalidate = c.get(req)
+		assert.NotNil(t, got)
+		assert.False(t, revalidate)
+
+		c.unmark(req)
+		_, revalidate = c.get(req)
+		assert.True(t, revalidate)
+	})
+
+	t.Run("beyond_window", func(t *testing.T) {
+		// The window is limited by the TTL of the response, which is
+		// lower than the configured maximum.
+		now = now.Add(ttl * time.Second)
+
+		got, revalidate := c.get(req)
+		assert.Nil(t, got)
+		assert.False(t, revalidate)
+		assert.Empty(t, c.items)
+	})
+
+	t.Run("revalidated", func(t *testing.T) {
+		c.set(req, resp)
+		now = now.Add((ttl + 1) * time.Second)
+
+		_, revalidate := c.get(req)
+		assert.True(t, revalidate)
+
+		c.set(req, resp)
+		got, _ := c.get(req)
+		assert.Nil(t, got)
+	})
+}
+
+func TestStaleCache_set(t *testing.T) {
+	c := newStaleCache(60)
+	req := createTestMessage("example.org.")
+
+	t.Run("nxdomain", func(t *testing.T) {
+		resp := &dns.Msg{}
+		resp.SetRcode(req, dns.RcodeNameError)
+
+		c.set(req, resp)
+		assert.Empty(t, c.items)
+	})
+
+	t.Run("no_answer", func(t *testing.T) {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+
+		c.set(req, resp)
+		assert.Empty(t, c.items)
+	})
+}
+
+func TestStaleCache_remove(t *testing.T) {
+	c := newStaleCache(60)
+
+	newResp := func(req *dns.Msg) (resp *dns.Msg) {
+		resp = &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   req.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    10,
+			},
+			A: net.IP{1, 2, 3, 4},
+		}}
+
+		return resp
+	}
+
+	reqA := createTestMessage("example.org.")
+	reqAAAA := createTestMessageWithType("example.org.", dns.TypeAAAA)
+	reqOther := createTestMessage("example.com.")
+	for _, req := range []*dns.Msg{reqA, reqAAAA, reqOther} {
+		c.set(req, newResp(req))
+	}
+	assert.Len(t, c.items, 3)
+
+	c.remove("EXAMPLE.org", dns.TypeA)
+	assert.Len(t, c.items, 2)
+	assert.NotContains(t, c.items, staleKeyFromMsg(reqA))
+	assert.Contains(t, c.items, staleKeyFromMsg(reqAAAA))
+	assert.Contains(t, c.items, staleKeyFromMsg(reqOther))
+
+	c.set(reqA, newResp(reqA))
+	c.remove("example.org.", 0)
+	assert.Len(t, c.items, 1)
+	assert.Contains(t, c.items, staleKeyFromMsg(reqOther))
+
+	c.clear()
+	assert.Empty(t, c.items)
+}
+
+func TestStaleCache_do(t *testing.T) {
+	const ttl = 10
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newStaleCache(60)
+	c.now = func() time.Time { return now }
+
+	a := &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   "example.org.",
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		A: net.IP{1, 2, 3, 4},
+	}
+	sig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Name:   "example.org.",
+			Rrtype: dns.TypeRRSIG,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		TypeCovered: dns.TypeA,
+	}
+
+	reqDO := createTestMessage("example.org.")
+	reqDO.SetEdns0(4096, true)
+	respDO := &dns.Msg{}
+	respDO.SetReply(reqDO)
+	respDO.Answer = []dns.RR{a, sig}
+
+	reqNoDO := createTestMessage("example.org.")
+	reqNoDO.SetEdns0(4096, false)
+	respNoDO := &dns.Msg{}
+	respNoDO.SetReply(reqNoDO)
+	respNoDO.Answer = []dns.RR{dns.Copy(a)}
+
+	reqPlain := createTestMessage("example.org.")
+
+	t.Run("do_only", func(t *testing.T) {
+		c.set(reqDO, respDO)
+		now = now.Add((ttl + 1) * time.Second)
+
+		got, _ := c.get(reqNoDO)
+		assert.Nil(t, got)
+
+		got, _ = c.get(reqPlain)
+		assert.Nil(t, got)
+
+		got, _ = c.get(reqDO)
+		if assert.NotNil(t, got) {
+			assert.Len(t, got.Answer, 2)
+		}
+	})
+
+	t.Run("both", func(t *testing.T) {
+		c.set(reqDO, respDO)
+		c.set(reqNoDO, respNoDO)
+		now = now.Add((ttl + 1) * time.Second)
+
+		got, _ := c.get(reqNoDO)
+		if assert.NotNil(t, got) {
+			assert.Len(t, got.Answer, 1)
+			assert.IsType(t, &dns.A{}, got.Answer[0])
+		}
+
+		// The request without the OPT record shares the response with
+		// the one with the DO flag cleared.
+		got, _ = c.get(reqPlain)
+		if assert.NotNil(t, got) {
+			assert.Len(t, got.Answer, 1)
+		}
+
+		got, _ = c.get(reqDO)
+		if assert.NotNil(t, got) {
+			assert.Len(t, got.Answer, 2)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		c.remove("example.org", dns.TypeA)
+		assert.Empty(t, c.items)
+	})
+}
@@ -19,6 +19,9 @@ func processQueryLogsAndStats(ctx *dnsContext) (rc resultCode) {
 
 	shouldLog := true
 	msg := pctx.Req
+	if ctx.origReq != nil {
+		msg = ctx.origReq
+	}
 
 	// don't log ANY request if refuseAny is enabled
 	if len(msg.Question) >= 1 && msg.Question[0].Qtype == dns.TypeANY && s.conf.RefuseAny {
@@ -39,6 +42,13 @@ func processQueryLogsAndStats(ctx *dnsContext) (rc resultCode) {
 			ClientID:   ctx.clientID,
 		}
 
+		if s.conf.QueryLogVerbose {
+			// The response is already padded, so the padding is
+			// logged as well.
+			p.ReqEDNSOptions = ctx.reqEDNSOptions
+			p.RespEDNSOptions = ednsOptions(pctx.Res)
+		}
+
 		switch pctx.Proto {
 		case proxy.ProtoHTTPS:
 			p.ClientProto = querylog.ClientProtoDOH
@@ -84,6 +94,7 @@ func (s *Server) updateStats(ctx *dnsContext, elapsed time.Duration, res dnsfilt
 
 	e.Time = uint32(elapsed / 1000)
 	e.Result = stats.RNotFiltered
+	e.MonitorListIDs = ruleFilterListIDs(res.MonitorRules)
 
 	switch res.Reason {
 	case dnsfilter.FilteredSafeBrowsing:
@@ -93,12 +104,40 @@ func (s *Server) updateStats(ctx *dnsContext, elapsed time.Duration, res dnsfilt
 	case dnsfilter.FilteredSafeSearch:
 		e.Result = stats.RSafeSearch
 	case dnsfilter.FilteredBlockList:
+		e.FilterListIDs = ruleFilterListIDs(res.Rules)
+
 		fallthrough
 	case dnsfilter.FilteredInvalid:
 		fallthrough
+	case dnsfilter.FilteredTLD:
+		fallthrough
+	case dnsfilter.FilteredDGA:
+		fallthrough
+	case dnsfilter.FilteredGeo:
+		fallthrough
 	case dnsfilter.FilteredBlockedService:
 		e.Result = stats.RFiltered
 	}
 
 	s.stats.Update(e)
 }
+
+// ruleFilterListIDs returns the unique IDs of the filter lists of rules.
+func ruleFilterListIDs(rules []*dnsfilter.ResultRule) (ids []int64) {
+	for _, r := range rules {
+		seen := false
+		for _, id := range ids {
+			if id == r.FilterListID {
+				seen = true
+
+				break
+			}
+		}
+
+		if !seen {
+			ids = append(ids, r.FilterListID)
+		}
+	}
+
+	return ids
+}
@@ -196,3 +196,50 @@ func TestProcessQueryLogsAndStats(t *testing.T) {
 		})
 	}
 }
+
+func TestRuleFilterListIDs(t *testing.T) {
+	rules := []*dnsfilter.ResultRule{{
+		FilterListID: 1,
+	}, {
+		FilterListID: 2,
+	}, {
+		FilterListID: 1,
+	}}
+
+	assert.Equal(t, []int64{1, 2}, ruleFilterListIDs(rules))
+	assert.Empty(t, ruleFilterListIDs(nil))
+}
+
+func TestProcessQueryLogsAndStats_unlogged(t *testing.T) {
+	ql := querylog.New(querylog.Config{
+		Enabled:          true,
+		Interval:         1,
+		MemSize:          100,
+		AllowedCountOnly: true,
+	})
+	st := &testStats{}
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	dctx := &dnsContext{
+		srv: &Server{
+			queryLog: ql,
+			stats:    st,
+		},
+		proxyCtx: &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Req:   req,
+			Res:   &dns.Msg{},
+			Addr:  &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 1234},
+		},
+		startTime: time.Now(),
+		result:    &dnsfilter.Result{},
+	}
+
+	code := processQueryLogsAndStats(dctx)
+	assert.Equal(t, resultCodeSuccess, code)
+
+	// The query isn't logged, but it must still be counted.
+	assert.Equal(t, "1.2.3.4", st.lastEntry.Client)
+	assert.Equal(t, stats.RNotFiltered, st.lastEntry.Result)
+}
@@ -0,0 +1,46 @@
+package dnsforward
+
+import (
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// processClientUDPSize truncates the UDP response to the maximum size
+// configured for the client, which makes the client retry over TCP.  It's
+// useful for the older clients which can't handle large UDP responses
+// despite advertising a larger buffer.
+func processClientUDPSize(ctx *dnsContext) (rc resultCode) {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Proto != proxy.ProtoUDP || d.Res == nil || s.conf.GetUDPSizeByClient == nil {
+		return resultCodeSuccess
+	}
+
+	limit := s.conf.GetUDPSizeByClient(IPFromAddr(d.Addr), ctx.clientID)
+	if limit == 0 {
+		return resultCodeSuccess
+	} else if limit < dns.MinMsgSize {
+		limit = dns.MinMsgSize
+	}
+
+	size := uint16(dns.MinMsgSize)
+	if opt := d.Req.IsEdns0(); opt != nil && opt.UDPSize() > size {
+		size = opt.UDPSize()
+	}
+
+	if size > limit {
+		size = limit
+	}
+
+	if opt := d.Res.IsEdns0(); opt != nil {
+		opt.SetUDPSize(size)
+	}
+
+	d.Res.Truncate(int(size))
+	if d.Res.Truncated {
+		log.Debug("dns: truncated response to %s to %d bytes", d.Req.Question[0].Name, size)
+	}
+
+	return resultCodeSuccess
+}
@@ -0,0 +1,102 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessClientUDPSize(t *testing.T) {
+	smallIP := net.IP{192, 168, 0, 2}
+	s := &Server{}
+	s.conf.GetUDPSizeByClient = func(clientAddr net.IP, clientID string) (size uint16) {
+		if clientAddr.Equal(smallIP) || clientID == "small" {
+			return 512
+		}
+
+		return 0
+	}
+
+	newResp := func(req *dns.Msg) (resp *dns.Msg) {
+		resp = &dns.Msg{}
+		resp.SetReply(req)
+		for i := 0; i < 64; i++ {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: net.IP{10, 0, 0, byte(i)},
+			})
+		}
+		resp.SetEdns0(4096, false)
+
+		return resp
+	}
+
+	testCases := []struct {
+		name          string
+		addr          net.Addr
+		clientID      string
+		proto         proxy.Proto
+		wantTruncated bool
+	}{{
+		name:          "small_ip",
+		addr:          &net.UDPAddr{IP: smallIP, Port: 53},
+		proto:         proxy.ProtoUDP,
+		wantTruncated: true,
+	}, {
+		name:          "small_id",
+		addr:          &net.UDPAddr{IP: net.IP{192, 168, 0, 3}, Port: 53},
+		clientID:      "small",
+		proto:         proxy.ProtoUDP,
+		wantTruncated: true,
+	}, {
+		name:          "other",
+		addr:          &net.UDPAddr{IP: net.IP{192, 168, 0, 3}, Port: 53},
+		proto:         proxy.ProtoUDP,
+		wantTruncated: false,
+	}, {
+		name:          "small_tcp",
+		addr:          &net.TCPAddr{IP: smallIP, Port: 53},
+		proto:         proxy.ProtoTCP,
+		wantTruncated: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestMessage("example.org.")
+			req.SetEdns0(4096, false)
+
+			d := &proxy.DNSContext{
+				Proto: tc.proto,
+				Req:   req,
+				Res:   newResp(req),
+				Addr:  tc.addr,
+			}
+			ctx := &dnsContext{
+				srv:      s,
+				proxyCtx: d,
+				clientID: tc.clientID,
+			}
+
+			assert.Equal(t, resultCodeSuccess, processClientUDPSize(ctx))
+			assert.Equal(t, tc.wantTruncated, d.Res.Truncated)
+
+			if tc.wantTruncated {
+				assert.LessOrEqual(t, d.Res.Len(), 512)
+				assert.Less(t, len(d.Res.Answer), 64)
+				if opt := d.Res.IsEdns0(); assert.NotNil(t, opt) {
+					assert.Equal(t, uint16(512), opt.UDPSize())
+				}
+			} else {
+				assert.Len(t, d.Res.Answer, 64)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// UpstreamQTypes restricts the query types sent to an upstream server.
+type UpstreamQTypes struct {
+	// Upstream is the address of the upstream server as it's written in
+	// the upstream configuration, but without the domains.
+	Upstream string `yaml:"upstream"`
+
+	// Allowed are the names of the query types, for example "PTR", which
+	// may be sent to the upstream server.  If empty, all types are allowed
+	// except the denied ones.
+	Allowed []string `yaml:"allowed"`
+
+	// Denied are the names of the query types which are never sent to the
+	// upstream server.
+	Denied []string `yaml:"denied"`
+}
+
+// qtypeSet is a set of query types.
+type qtypeSet map[uint16]struct{}
+
+// parseQTypeSet returns the set of the query types with names.
+func parseQTypeSet(names []string) (set qtypeSet, err error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	set = make(qtypeSet, len(names))
+	for _, name := range names {
+		qt, ok := dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown query type %q", name)
+		}
+
+		set[qt] = struct{}{}
+	}
+
+	return set, nil
+}
+
+// upstreamQTypes is a parsed UpstreamQTypes.
+type upstreamQTypes struct {
+	// allowed is nil if all types are allowed.
+	allowed qtypeSet
+	denied  qtypeSet
+}
+
+// allows returns true if the query of qtype may be sent to the upstream.
+func (q *upstreamQTypes) allows(qtype uint16) (ok bool) {
+	if _, ok = q.denied[qtype]; ok {
+		return false
+	}
+
+	if q.allowed == nil {
+		return true
+	}
+
+	_, ok = q.allowed[qtype]
+
+	return ok
+}
+
+// upstreamQTypesCtx excludes the upstream servers which don't accept the query
+// type of the request from the upstreams it's sent to.
+type upstreamQTypesCtx struct {
+	// upstreams are the restrictions of the upstream servers by their
+	// addresses as returned by the Address method.
+	upstreams map[string]*upstreamQTypes
+
+	// fallback are the upstream servers used when none of the selected
+	// ones accepts the query type.  It is nil if such queries are answered
+	// with NOTIMP.
+	fallback *proxy.UpstreamConfig
+}
+
+// init parses the restrictions of the upstream servers and the fallback
+// upstream servers.  The previous fallback upstream servers are closed.
+func (c *upstreamQTypesCtx) init(confs []UpstreamQTypes, fallback, bootstrap []string) (err error) {
+	c.close()
+	if len(confs) == 0 {
+		return nil
+	}
+
+	upstreams := make(map[string]*upstreamQTypes, len(confs))
+	for i, conf := range confs {
+		var addr string
+		addr, err = upstreamAddress(conf.Upstream)
+		if err != nil {
+			return fmt.Errorf("dns: upstream qtypes at index %d: %w", i, err)
+		}
+
+		q := &upstreamQTypes{}
+		q.allowed, err = parseQTypeSet(conf.Allowed)
+		if err != nil {
+			return fmt.Errorf("dns: allowed qtypes of upstream %q: %w", conf.Upstream, err)
+		}
+
+		q.denied, err = parseQTypeSet(conf.Denied)
+		if err != nil {
+			return fmt.Errorf("dns: denied qtypes of upstream %q: %w", conf.Upstream, err)
+		}
+
+		upstreams[addr] = q
+	}
+
+	if len(fallback) > 0 {
+		var uc proxy.UpstreamConfig
+		uc, err = proxy.ParseUpstreamsConfig(fallback, bootstrap, DefaultTimeout)
+		if err != nil {
+			return fmt.Errorf("dns: upstream qtypes fallback: %w", err)
+		}
+
+		c.fallback = &uc
+	}
+
+	c.upstreams = upstreams
+
+	return nil
+}
+
+// close closes the fallback upstream servers and removes the restrictions.
+func (c *upstreamQTypesCtx) close() {
+	if c.fallback != nil {
+		closeUpstreams(c.fallback.Upstreams)
+		for _, ups := range c.fallback.DomainReservedUpstreams {
+			closeUpstreams(ups)
+		}
+	}
+
+	c.upstreams = nil
+	c.fallback = nil
+}
+
+// upstreamDefaultPorts are the default ports of the upstream servers by the
+// schemes of their URLs.
+var upstreamDefaultPorts = map[string]string{
+	"dns":   "53",
+	"tcp":   "53",
+	"tls":   "853",
+	"https": "443",
+	"quic":  "784",
+}
+
+// upstreamAddress returns the address of the upstream server with addr, as
+// it's written in the upstream configuration, the same way the Address method
+// of the upstream.Upstream created for it does, without creating it.
+func upstreamAddress(addr string) (ua string, err error) {
+	if !strings.Contains(addr, "://") {
+		if _, _, err = net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+
+		return addr, nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme == "sdns" {
+		return u.String(), nil
+	}
+
+	port, ok := upstreamDefaultPorts[u.Scheme]
+	if !ok {
+		return "", fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	switch u.Scheme {
+	case "dns":
+		return u.Host, nil
+	case "tcp":
+		return "tcp://" + u.Host, nil
+	default:
+		return u.String(), nil
+	}
+}
+
+// allows returns true if the query of qtype may be sent to u.
+func (c *upstreamQTypesCtx) allows(u upstream.Upstream, qtype uint16) (ok bool) {
+	q, ok := c.upstreams[u.Address()]
+
+	return !ok || q.allows(qtype)
+}
+
+// restrictUpstreams sets the upstream servers of d to the ones accepting the
+// query type of the request, if some of the upstream servers selected for it
+// don't.  If none of them does, the fallback upstream servers are used.  ok is
+// false if there are no fallback upstream servers either, so the request must
+// be answered with NOTIMP.
+func (s *Server) restrictUpstreams(d *proxy.DNSContext) (ok bool) {
+	c := &s.upstreamQTypes
+	if len(c.upstreams) == 0 || len(d.Req.Question) == 0 {
+		return true
+	}
+
+	uc := d.CustomUpstreamConfig
+	if uc == nil {
+		uc = s.defaultUpstreamConfig()
+	}
+
+	if uc == nil {
+		return true
+	}
+
+	q := d.Req.Question[0]
+	ups := upstreamsForDomain(uc, q.Name)
+	allowed := make([]upstream.Upstream, 0, len(ups))
+	for _, u := range ups {
+		if c.allows(u, q.Qtype) {
+			allowed = append(allowed, u)
+		}
+	}
+
+	switch {
+	case len(allowed) == len(ups):
+		return true
+	case len(allowed) > 0:
+		d.CustomUpstreamConfig = &proxy.UpstreamConfig{Upstreams: allowed}
+	case c.fallback != nil:
+		log.Debug("dns: no upstreams accept qtype %s, using fallback", dns.Type(q.Qtype))
+		d.CustomUpstreamConfig = c.fallback
+	default:
+		log.Debug("dns: no upstreams accept qtype %s", dns.Type(q.Qtype))
+
+		return false
+	}
+
+	return true
+}
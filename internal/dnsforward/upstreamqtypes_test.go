@@ -0,0 +1,147 @@
+package dnsforward
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// addrUpstream is a recordUpstream with a custom address.
+type addrUpstream struct {
+	recordUpstream
+
+	addr string
+}
+
+// Address implements the upstream.Upstream interface for *addrUpstream.
+func (u *addrUpstream) Address() string {
+	return u.addr
+}
+
+// newUpstreamAddress returns the address of the upstream created from addr.
+func newUpstreamAddress(t *testing.T, addr string) (upsAddr string) {
+	t.Helper()
+
+	u, err := upstream.AddressToUpstream(addr, upstream.Options{})
+	assert.Nil(t, err)
+
+	return u.Address()
+}
+
+func TestUpstreamAddress(t *testing.T) {
+	for _, addr := range []string{
+		"1.1.1.1",
+		"1.1.1.1:5353",
+		"::1",
+		"[::1]:5353",
+		"dns://1.1.1.1",
+		"tcp://1.1.1.1",
+		"tcp://[::1]:5353",
+		"tls://dns.example",
+		"tls://dns.example:8853",
+		"https://dns.example/dns-query",
+		"https://dns.example:8443/dns-query",
+		"quic://dns.example",
+	} {
+		got, err := upstreamAddress(addr)
+		assert.Nil(t, err, addr)
+		assert.Equal(t, newUpstreamAddress(t, addr), got, addr)
+	}
+
+	_, err := upstreamAddress("bad://1.1.1.1")
+	assert.NotNil(t, err)
+}
+
+func TestUpstreamQTypes_allows(t *testing.T) {
+	c := &upstreamQTypesCtx{}
+	err := c.init([]UpstreamQTypes{{
+		Upstream: "1.1.1.1",
+		Allowed:  []string{"a", "AAAA"},
+	}, {
+		Upstream: "8.8.8.8",
+		Denied:   []string{"PTR"},
+	}}, nil, nil)
+	assert.Nil(t, err)
+
+	only := &addrUpstream{addr: newUpstreamAddress(t, "1.1.1.1")}
+	assert.True(t, c.allows(only, dns.TypeA))
+	assert.True(t, c.allows(only, dns.TypeAAAA))
+	assert.False(t, c.allows(only, dns.TypeTXT))
+
+	denying := &addrUpstream{addr: newUpstreamAddress(t, "8.8.8.8")}
+	assert.True(t, c.allows(denying, dns.TypeA))
+	assert.False(t, c.allows(denying, dns.TypePTR))
+
+	other := &addrUpstream{addr: newUpstreamAddress(t, "9.9.9.9")}
+	assert.True(t, c.allows(other, dns.TypePTR))
+
+	err = c.init([]UpstreamQTypes{{
+		Upstream: "1.1.1.1",
+		Denied:   []string{"BAD"},
+	}}, nil, nil)
+	assert.NotNil(t, err)
+}
+
+func TestServer_upstreamQTypes(t *testing.T) {
+	denying := &addrUpstream{addr: newUpstreamAddress(t, "1.1.1.1")}
+	allowing := &addrUpstream{addr: newUpstreamAddress(t, "8.8.8.8")}
+
+	startServer := func(t *testing.T, conf []UpstreamQTypes) (addr string) {
+		t.Helper()
+
+		s := createTestServer(t)
+		s.conf.UpstreamQTypes = conf
+		err := s.Prepare(nil)
+		assert.Nil(t, err)
+		s.dnsProxy.UpstreamConfig = &proxy.UpstreamConfig{
+			Upstreams: []upstream.Upstream{denying, allowing},
+		}
+		err = s.dnsProxy.Start()
+		assert.Nil(t, err)
+		t.Cleanup(func() { _ = s.Stop() })
+
+		return s.dnsProxy.Addr(proxy.ProtoUDP).String()
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		addr := startServer(t, []UpstreamQTypes{{
+			Upstream: "1.1.1.1",
+			Denied:   []string{"PTR"},
+		}, {
+			Upstream: "8.8.8.8",
+			Allowed:  []string{"PTR"},
+		}})
+
+		// Use different names to bypass the cache.
+		for i := 0; i < 10; i++ {
+			req := &dns.Msg{}
+			req.SetQuestion(fmt.Sprintf("%d.8.8.8.in-addr.arpa.", i), dns.TypePTR)
+			reply, err := dns.Exchange(req, addr)
+			assert.Nil(t, err)
+			assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		}
+
+		assert.Empty(t, denying.names)
+		assert.Len(t, allowing.names, 10)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		addr := startServer(t, []UpstreamQTypes{{
+			Upstream: "1.1.1.1",
+			Denied:   []string{"TXT"},
+		}, {
+			Upstream: "8.8.8.8",
+			Denied:   []string{"TXT"},
+		}})
+
+		req := &dns.Msg{}
+		req.SetQuestion("example.org.", dns.TypeTXT)
+		reply, err := dns.Exchange(req, addr)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeNotImplemented, reply.Rcode)
+	})
+}
@@ -1,10 +1,13 @@
 package dnsforward
 
 import (
+	"io"
 	"net"
 	"sort"
 	"strings"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/utils"
 )
 
@@ -30,6 +33,22 @@ func IPStringFromAddr(addr net.Addr) (ipStr string) {
 	return ""
 }
 
+// closeUpstreams closes the upstreams from ups which hold resources, like the
+// connections of the DNS-over-TLS and DNS-over-QUIC ones.
+func closeUpstreams(ups []upstream.Upstream) {
+	for _, u := range ups {
+		c, ok := u.(io.Closer)
+		if !ok {
+			continue
+		}
+
+		err := c.Close()
+		if err != nil {
+			log.Debug("dns: closing upstream %s: %s", u.Address(), err)
+		}
+	}
+}
+
 func stringArrayDup(a []string) []string {
 	a2 := make([]string, len(a))
 	copy(a2, a)
@@ -0,0 +1,154 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// viaPrefix is the prefix of the first label of the query name which forces
+// the upstream for this query, for example "_via-cloudflare.example.com".
+const viaPrefix = "_via-"
+
+// viaCtx allows the trusted clients to force the upstream servers for a single
+// query, which helps to debug the differences between resolvers.
+type viaCtx struct {
+	// upstreams maps the names used in the prefixes to the upstream
+	// configurations.
+	upstreams map[string]*proxy.UpstreamConfig
+
+	// trusted contains the clients which are allowed to force the
+	// upstreams.  It is nil if there are none.
+	trusted *accessCtx
+}
+
+// init parses the named upstreams and the list of trusted clients.
+func (c *viaCtx) init(viaUpstreams map[string][]string, trusted, bootstrap []string) (err error) {
+	c.upstreams = nil
+	c.trusted = nil
+	if len(viaUpstreams) == 0 || len(trusted) == 0 {
+		return nil
+	}
+
+	c.upstreams = make(map[string]*proxy.UpstreamConfig, len(viaUpstreams))
+	for name, ups := range viaUpstreams {
+		var uc proxy.UpstreamConfig
+		uc, err = proxy.ParseUpstreamsConfig(ups, bootstrap, DefaultTimeout)
+		if err != nil {
+			return fmt.Errorf("dns: via upstreams %q: %w", name, err)
+		}
+
+		c.upstreams[strings.ToLower(name)] = &uc
+	}
+
+	c.trusted = &accessCtx{}
+	err = c.trusted.Init(trusted, nil, nil)
+	if err != nil {
+		return fmt.Errorf("dns: via trusted clients: %w", err)
+	}
+
+	return nil
+}
+
+// isTrusted returns true if the client is allowed to force the upstreams.
+func (c *viaCtx) isTrusted(ip net.IP, clientID string) (ok bool) {
+	if c.trusted == nil {
+		return false
+	}
+
+	blocked, _ := c.trusted.IsBlockedClient(ip, clientID, nil)
+
+	return !blocked
+}
+
+// processVia checks if the query name has the via prefix, and if it has and
+// the client is trusted, strips the prefix and selects the named upstreams for
+// the request.  The prefix is stripped before the filtering, so that the rules
+// and the rewrites match the actual name.  The query is processed as is
+// otherwise.
+func processVia(ctx *dnsContext) (rc resultCode) {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if len(s.via.upstreams) == 0 {
+		return resultCodeSuccess
+	}
+
+	q := d.Req.Question[0]
+	dot := strings.IndexByte(q.Name, '.')
+	if dot <= 0 || dot == len(q.Name)-1 {
+		return resultCodeSuccess
+	}
+
+	label := strings.ToLower(q.Name[:dot])
+	if !strings.HasPrefix(label, viaPrefix) {
+		return resultCodeSuccess
+	}
+
+	name := label[len(viaPrefix):]
+	uc, ok := s.via.upstreams[name]
+	if !ok {
+		return resultCodeSuccess
+	}
+
+	ip := IPFromAddr(d.Addr)
+	if !s.via.isTrusted(ip, ctx.clientID) {
+		log.Debug("dns: via: client %s is not trusted, ignoring %q", ip, label)
+
+		return resultCodeSuccess
+	}
+
+	log.Debug("dns: via: forwarding %s to upstreams %q", q.Name, name)
+
+	ctx.viaQuestion = q
+	ctx.viaUpstreams = uc
+	d.Req.Question[0].Name = q.Name[dot+1:]
+
+	return resultCodeSuccess
+}
+
+// processRestoreVia restores the question received from the client before the
+// response is logged and sent, see restoreVia.
+func processRestoreVia(ctx *dnsContext) (rc resultCode) {
+	restoreVia(ctx)
+
+	return resultCodeSuccess
+}
+
+// restoreVia restores the original question in the request and the response
+// if the via prefix has been stripped by processVia.  It only does that once,
+// so it's safe to call it again for the requests which haven't passed all the
+// processing steps.
+func restoreVia(ctx *dnsContext) {
+	orig := ctx.viaQuestion
+	if orig.Name == "" {
+		return
+	}
+
+	ctx.viaQuestion = dns.Question{}
+
+	d := ctx.proxyCtx
+	stripped := d.Req.Question[0].Name
+	d.Req.Question[0] = orig
+	if ctx.origReq != nil {
+		ctx.origReq.Question[0] = orig
+	}
+
+	if d.Res == nil {
+		return
+	}
+
+	if len(d.Res.Question) != 0 {
+		d.Res.Question[0] = orig
+	}
+
+	for _, rr := range d.Res.Answer {
+		hdr := rr.Header()
+		if strings.EqualFold(hdr.Name, stripped) {
+			hdr.Name = orig.Name
+		}
+	}
+}
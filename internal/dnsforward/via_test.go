@@ -0,0 +1,141 @@
+package dnsforward
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordUpstream is an upstream which records the names of the questions it
+// receives and answers any A query with the same address.
+type recordUpstream struct {
+	lock  sync.Mutex
+	names []string
+}
+
+// Exchange implements the upstream.Upstream interface for *recordUpstream.
+func (u *recordUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	u.lock.Lock()
+	u.names = append(u.names, m.Question[0].Name)
+	u.lock.Unlock()
+
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   m.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		A: net.IP{1, 2, 3, 4},
+	}}
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for *recordUpstream.
+func (u *recordUpstream) Address() string {
+	return "record"
+}
+
+// received returns the names received by u.
+func (u *recordUpstream) received() (names []string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return append([]string(nil), u.names...)
+}
+
+func TestServer_Via(t *testing.T) {
+	const (
+		viaName = "_via-test.example.org."
+		name    = "example.org."
+	)
+
+	testCases := []struct {
+		name        string
+		trusted     string
+		wantDefault []string
+		wantVia     []string
+	}{{
+		name:        "trusted",
+		trusted:     "127.0.0.0/8",
+		wantDefault: nil,
+		wantVia:     []string{name},
+	}, {
+		name:        "untrusted",
+		trusted:     "1.2.3.4",
+		wantDefault: []string{viaName},
+		wantVia:     nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			defUps := &recordUpstream{}
+			viaUps := &recordUpstream{}
+
+			s := createTestServer(t)
+			s.conf.ViaUpstreams = map[string][]string{"test": {"127.0.0.1:53"}}
+			s.conf.ViaTrustedClients = []string{tc.trusted}
+			assert.Nil(t, s.startWithUpstream(defUps))
+			t.Cleanup(func() { _ = s.Stop() })
+
+			s.Lock()
+			s.via.upstreams["test"] = &proxy.UpstreamConfig{
+				Upstreams: []upstream.Upstream{viaUps},
+			}
+			s.Unlock()
+
+			req := createTestMessage(viaName)
+			reply, err := dns.Exchange(req, s.dnsProxy.Addr(proxy.ProtoUDP).String())
+			assert.Nil(t, err)
+			assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+			assert.Equal(t, viaName, reply.Question[0].Name)
+			if assert.Len(t, reply.Answer, 1) {
+				assert.Equal(t, viaName, reply.Answer[0].Header().Name)
+			}
+
+			assert.Equal(t, tc.wantDefault, defUps.received())
+			assert.Equal(t, tc.wantVia, viaUps.received())
+		})
+	}
+}
+
+func TestServer_Via_filtering(t *testing.T) {
+	const viaName = "_via-test.host.example.org."
+
+	viaUps := &recordUpstream{}
+
+	s := createTestServer(t)
+	s.conf.ViaUpstreams = map[string][]string{"test": {"127.0.0.1:53"}}
+	s.conf.ViaTrustedClients = []string{"127.0.0.0/8"}
+	assert.Nil(t, s.startWithUpstream(&recordUpstream{}))
+	t.Cleanup(func() { _ = s.Stop() })
+
+	s.Lock()
+	s.via.upstreams["test"] = &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{viaUps},
+	}
+	s.Unlock()
+
+	req := createTestMessage(viaName)
+	reply, err := dns.Exchange(req, s.dnsProxy.Addr(proxy.ProtoUDP).String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, viaName, reply.Question[0].Name)
+	if assert.Len(t, reply.Answer, 1) {
+		a, ok := reply.Answer[0].(*dns.A)
+		if assert.True(t, ok) {
+			assert.Equal(t, viaName, a.Hdr.Name)
+			assert.True(t, a.A.Equal(net.IP{127, 0, 0, 1}))
+		}
+	}
+
+	assert.Empty(t, viaUps.received())
+}
@@ -0,0 +1,95 @@
+package home
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// errBootstrap is returned when the hostname couldn't be resolved using the
+// bootstrap DNS servers.
+const errBootstrap agherr.Error = "bootstrap resolving failed"
+
+// bootstrapServers returns the addresses of the bootstrap DNS servers.  If
+// there are none in the configuration, dnsforward.DefaultBootstrap is used.
+func bootstrapServers() (addrs []string) {
+	config.RLock()
+	servers := config.DNS.BootstrapDNS
+	config.RUnlock()
+
+	if len(servers) == 0 {
+		servers = dnsforward.DefaultBootstrap
+	}
+
+	for _, s := range servers {
+		if net.ParseIP(s) != nil {
+			s = net.JoinHostPort(s, "53")
+		} else if _, _, err := net.SplitHostPort(s); err != nil {
+			log.Debug("bootstrap: skipping %q: not a plain dns server", s)
+
+			continue
+		}
+
+		addrs = append(addrs, s)
+	}
+
+	return addrs
+}
+
+// bootstrapResolve resolves host using the bootstrap DNS servers.  It doesn't
+// depend on the DNS server of AdGuard Home, so it can be used before the
+// latter is ready.  All errors wrap errBootstrap.
+func bootstrapResolve(ctx context.Context, host string) (addrs []net.IPAddr, err error) {
+	servers := bootstrapServers()
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("%w: %s: no servers", errBootstrap, host)
+	}
+
+	c := &dns.Client{
+		Timeout: dnsforward.DefaultTimeout,
+	}
+
+	var errs []error
+	for _, srv := range servers {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			req := &dns.Msg{}
+			req.SetQuestion(dns.Fqdn(host), qtype)
+
+			var resp *dns.Msg
+			resp, _, err = c.ExchangeContext(ctx, req, srv)
+			if err != nil {
+				errs = append(errs, err)
+
+				continue
+			}
+
+			for _, rr := range resp.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					addrs = append(addrs, net.IPAddr{IP: rr.A})
+				case *dns.AAAA:
+					addrs = append(addrs, net.IPAddr{IP: rr.AAAA})
+				}
+			}
+		}
+
+		if len(addrs) > 0 {
+			log.Debug("bootstrap: %s resolved by %s: %v", host, srv, addrs)
+
+			return addrs, nil
+		}
+	}
+
+	if len(errs) > 0 {
+		err = agherr.Many(fmt.Sprintf("resolving %s", host), errs...)
+
+		return nil, fmt.Errorf("%w: %s", errBootstrap, err)
+	}
+
+	return nil, fmt.Errorf("%w: %s: no addresses", errBootstrap, host)
+}
@@ -0,0 +1,107 @@
+package home
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startBootstrapServer starts a plain DNS server which resolves host to
+// 127.0.0.1 and answers NXDOMAIN to the other queries.  It returns the
+// address of the server.
+func startBootstrapServer(t *testing.T, host string) (addr string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := &dns.Msg{}
+			resp.SetReply(req)
+
+			q := req.Question[0]
+			if q.Name != dns.Fqdn(host) {
+				resp.Rcode = dns.RcodeNameError
+			} else if q.Qtype == dns.TypeA {
+				resp.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{
+						Name:   q.Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    60,
+					},
+					A: net.IP{127, 0, 0, 1},
+				}}
+			}
+
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	return pc.LocalAddr().String()
+}
+
+func TestFilters_bootstrap(t *testing.T) {
+	const host = "filters.example"
+
+	l := testStartFilterListener()
+	t.Cleanup(func() { _ = l.Close() })
+
+	dir := prepareTestDir()
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.client = &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: customDialContext,
+		},
+	}
+	Context.filters.Init()
+
+	prevBootstrap, prevPort := config.DNS.BootstrapDNS, config.DNS.Port
+	t.Cleanup(func() {
+		config.DNS.BootstrapDNS, config.DNS.Port = prevBootstrap, prevPort
+	})
+
+	// The main DNS server isn't configured, so only the bootstrap server is
+	// able to resolve the host.
+	config.DNS.BootstrapDNS = []string{startBootstrapServer(t, host)}
+	config.DNS.Port = 53
+
+	port := l.Addr().(*net.TCPAddr).Port
+
+	t.Run("success", func(t *testing.T) {
+		f := filter{
+			URL: fmt.Sprintf("http://%s:%d/filters/1.txt", host, port),
+		}
+
+		ok, err := Context.filters.update(&f)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, 3, f.RulesCount)
+
+		f.unload()
+		_ = os.Remove(f.Path())
+	})
+
+	t.Run("bootstrap_failure", func(t *testing.T) {
+		f := filter{
+			URL: fmt.Sprintf("http://unknown.example:%d/filters/1.txt", port),
+		}
+
+		ok, err := Context.filters.update(&f)
+		assert.False(t, ok)
+		assert.True(t, errors.Is(err, errBootstrap))
+	})
+}
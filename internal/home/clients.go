@@ -19,6 +19,7 @@ import (
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/utils"
+	"github.com/miekg/dns"
 )
 
 const clientsUpdatePeriod = 10 * time.Minute
@@ -41,6 +42,34 @@ type Client struct {
 
 	Upstreams []string // list of upstream servers to be used for the client's requests
 
+	// UDPSize is the maximum size of the UDP responses to the client, which
+	// helps the older clients which can't handle large UDP responses.  Zero
+	// means that there is no limit.
+	UDPSize uint16
+
+	// BlockedResponseTTL is the TTL of the blocked responses to the client,
+	// which overrides the global one.  Zero means that the global one is
+	// used.
+	BlockedResponseTTL uint32
+
+	// BlockingMode is the blocking mode of the client's blocked requests,
+	// which overrides the global one, see dnsfilter.BlockingModeDefault and
+	// the other modes.  Empty means that the global one is used.
+	// BlockingIPv4 and BlockingIPv6 are the IP addresses of the
+	// dnsfilter.BlockingModeCustomIP mode.
+	BlockingMode string
+	BlockingIPv4 net.IP
+	BlockingIPv6 net.IP
+
+	// BypassReasons are the names of the filtering reasons, for example
+	// "FilteredSafeBrowsing", which don't block the client's requests.
+	BypassReasons []string
+
+	// AllowedQTypes are the names of the query types, for example "A", which
+	// the client may issue.  The queries of the other types are refused.  An
+	// empty slice means that all types are allowed.
+	AllowedQTypes []string
+
 	// Custom upstream config for this client
 	// nil: not yet initialized
 	// not nil, but empty: initialized, no good upstreams
@@ -59,6 +88,22 @@ const (
 	ClientSourceHostsFile
 )
 
+// String implements the fmt.Stringer interface for clientSource.
+func (cs clientSource) String() (s string) {
+	switch cs {
+	case ClientSourceWHOIS:
+		return "WHOIS"
+	case ClientSourceRDNS:
+		return "rDNS"
+	case ClientSourceDHCP:
+		return "DHCP"
+	case ClientSourceARP:
+		return "ARP"
+	default:
+		return "etc/hosts"
+	}
+}
+
 // ClientHost information
 type ClientHost struct {
 	Host      string
@@ -84,6 +129,10 @@ type clientsContainer struct {
 
 	autoHosts *util.AutoHosts // get entries from system hosts-files
 
+	// idOrder is the order of the client identification methods used by
+	// FindByOrder.  If it's empty, defaultClientIDOrder is used.
+	idOrder []string
+
 	testing bool // if TRUE, this object is used for internal tests
 }
 
@@ -146,6 +195,18 @@ type clientObject struct {
 	BlockedServices          []string `yaml:"blocked_services"`
 
 	Upstreams []string `yaml:"upstreams"`
+
+	UDPSize uint16 `yaml:"udp_size"`
+
+	BlockedResponseTTL uint32 `yaml:"blocked_response_ttl"`
+
+	BlockingMode string `yaml:"blocking_mode"`
+	BlockingIPv4 net.IP `yaml:"blocking_ipv4"`
+	BlockingIPv6 net.IP `yaml:"blocking_ipv6"`
+
+	BypassReasons []string `yaml:"bypass_reasons"`
+
+	AllowedQTypes []string `yaml:"allowed_qtypes"`
 }
 
 func (clients *clientsContainer) tagKnown(tag string) bool {
@@ -167,6 +228,18 @@ func (clients *clientsContainer) addFromConfig(objects []clientObject) {
 			UseOwnBlockedServices: !cy.UseGlobalBlockedServices,
 
 			Upstreams: cy.Upstreams,
+
+			UDPSize: cy.UDPSize,
+
+			BlockedResponseTTL: cy.BlockedResponseTTL,
+
+			BlockingMode: cy.BlockingMode,
+			BlockingIPv4: cy.BlockingIPv4,
+			BlockingIPv6: cy.BlockingIPv6,
+
+			BypassReasons: cy.BypassReasons,
+
+			AllowedQTypes: cy.AllowedQTypes,
 		}
 
 		for _, s := range cy.BlockedServices {
@@ -205,12 +278,19 @@ func (clients *clientsContainer) WriteDiskConfig(objects *[]clientObject) {
 			SafeSearchEnabled:        cli.SafeSearchEnabled,
 			SafeBrowsingEnabled:      cli.SafeBrowsingEnabled,
 			UseGlobalBlockedServices: !cli.UseOwnBlockedServices,
+			UDPSize:                  cli.UDPSize,
+			BlockedResponseTTL:       cli.BlockedResponseTTL,
+			BlockingMode:             cli.BlockingMode,
+			BlockingIPv4:             cli.BlockingIPv4,
+			BlockingIPv6:             cli.BlockingIPv6,
 		}
 
 		cy.Tags = copyStrings(cli.Tags)
 		cy.IDs = copyStrings(cli.IDs)
 		cy.BlockedServices = copyStrings(cli.BlockedServices)
 		cy.Upstreams = copyStrings(cli.Upstreams)
+		cy.BypassReasons = copyStrings(cli.BypassReasons)
+		cy.AllowedQTypes = copyStrings(cli.AllowedQTypes)
 
 		*objects = append(*objects, cy)
 	}
@@ -275,9 +355,174 @@ func (clients *clientsContainer) Find(id string) (c *Client, ok bool) {
 	c.Tags = copyStrings(c.Tags)
 	c.BlockedServices = copyStrings(c.BlockedServices)
 	c.Upstreams = copyStrings(c.Upstreams)
+	c.BypassReasons = copyStrings(c.BypassReasons)
+	c.AllowedQTypes = copyStrings(c.AllowedQTypes)
+	return c, true
+}
+
+// Client identification methods.
+const (
+	clientIDMethodClientID = "client_id"
+	clientIDMethodIP       = "ip"
+	clientIDMethodMAC      = "mac"
+	clientIDMethodECS      = "ecs"
+)
+
+// defaultClientIDOrder is the default order of the client identification
+// methods.
+var defaultClientIDOrder = []string{
+	clientIDMethodClientID,
+	clientIDMethodIP,
+	clientIDMethodMAC,
+}
+
+// validateClientIDOrder returns an error if order contains unknown or
+// repeated client identification methods.
+func validateClientIDOrder(order []string) (err error) {
+	seen := map[string]bool{}
+	for _, m := range order {
+		switch m {
+		case clientIDMethodClientID, clientIDMethodIP, clientIDMethodMAC, clientIDMethodECS:
+			// Go on.
+		default:
+			return fmt.Errorf("unknown client identification method %q", m)
+		}
+
+		if seen[m] {
+			return fmt.Errorf("repeated client identification method %q", m)
+		}
+
+		seen[m] = true
+	}
+
+	return nil
+}
+
+// FindByOrder searches for a client by its ClientID, IP address, and the
+// address from the EDNS Client Subnet option of its request, ecsIP, trying the
+// identification methods in the configured order.  The methods not in the
+// order aren't used.  ecsIP is nil unless matching the clients by that option
+// is enabled.
+func (clients *clientsContainer) FindByOrder(ip net.IP, clientID string, ecsIP net.IP) (c *Client, ok bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok = clients.findByOrderLocked(ip, clientID, ecsIP)
+	if !ok {
+		return nil, false
+	}
+
+	c.IDs = copyStrings(c.IDs)
+	c.Tags = copyStrings(c.Tags)
+	c.BlockedServices = copyStrings(c.BlockedServices)
+	c.Upstreams = copyStrings(c.Upstreams)
+	c.BypassReasons = copyStrings(c.BypassReasons)
+	c.AllowedQTypes = copyStrings(c.AllowedQTypes)
 	return c, true
 }
 
+// findByOrderLocked is FindByOrder for internal use only.
+func (clients *clientsContainer) findByOrderLocked(ip net.IP, clientID string, ecsIP net.IP) (c *Client, ok bool) {
+	order := clients.idOrder
+	if len(order) == 0 {
+		order = defaultClientIDOrder
+	}
+
+	for _, m := range order {
+		switch {
+		case m == clientIDMethodClientID && clientID != "":
+			c, ok = clients.idIndex[clientID]
+		case m == clientIDMethodIP && ip != nil:
+			c, ok = clients.findByIPLocked(ip)
+		case m == clientIDMethodMAC && ip != nil:
+			c, ok = clients.findByMACLocked(ip)
+		case m == clientIDMethodECS && ecsIP != nil:
+			c, ok = clients.findByIPLocked(ecsIP)
+		}
+
+		if ok {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+// FindUDPSize returns the maximum size of the UDP responses to the client with
+// the ID clientID or the IP address ip.  It returns zero if there is no such
+// client or no limit.
+func (clients *clientsContainer) FindUDPSize(ip net.IP, clientID string) (size uint16) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.findByOrderLocked(ip, clientID, nil)
+	if !ok {
+		return 0
+	}
+
+	return c.UDPSize
+}
+
+// FindBlockedTTL returns the TTL of the blocked responses to the client with
+// the ID clientID or the IP address ip.  It returns zero if there is no such
+// client or it uses the global TTL.
+func (clients *clientsContainer) FindBlockedTTL(ip net.IP, clientID string) (ttl uint32) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.findByOrderLocked(ip, clientID, nil)
+	if !ok {
+		return 0
+	}
+
+	return c.BlockedResponseTTL
+}
+
+// FindAllowedQTypes returns the query types which the client with the ID
+// clientID or the IP address ip may issue.  It returns nil if there is no such
+// client or all types are allowed.
+func (clients *clientsContainer) FindAllowedQTypes(ip net.IP, clientID string) (qtypes []uint16) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.findByOrderLocked(ip, clientID, nil)
+	if !ok || len(c.AllowedQTypes) == 0 {
+		return nil
+	}
+
+	qtypes = make([]uint16, 0, len(c.AllowedQTypes))
+	for _, name := range c.AllowedQTypes {
+		// The names are validated in check.
+		qtypes = append(qtypes, dns.StringToType[strings.ToUpper(name)])
+	}
+
+	return qtypes
+}
+
+// FindHostnames returns the names of the client with the ID clientID or the IP
+// address ip: the name of the persistent client, if any, and the hostname of
+// the runtime client, for example the one from the reverse DNS, if any.
+func (clients *clientsContainer) FindHostnames(ip net.IP, clientID string) (hosts []string) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.findByOrderLocked(ip, clientID, nil)
+	if ok && c.Name != "" {
+		hosts = append(hosts, c.Name)
+	}
+
+	if ip == nil {
+		return hosts
+	}
+
+	ch, ok := clients.ipHost[ip.String()]
+	if ok && ch.Host != "" {
+		hosts = append(hosts, ch.Host)
+	}
+
+	return hosts
+}
+
 // FindUpstreams looks for upstreams configured for the client
 // If no client found for this IP, or if no custom upstreams are configured,
 // this method returns nil
@@ -285,7 +530,7 @@ func (clients *clientsContainer) FindUpstreams(ip string) *proxy.UpstreamConfig
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
 
-	c, ok := clients.findLocked(ip)
+	c, ok := clients.findByOrderLocked(net.ParseIP(ip), "", nil)
 	if !ok {
 		return nil
 	}
@@ -316,6 +561,22 @@ func (clients *clientsContainer) findLocked(id string) (c *Client, ok bool) {
 		return nil, false
 	}
 
+	c, ok = clients.findByIPLocked(ip)
+	if ok {
+		return c, true
+	}
+
+	return clients.findByMACLocked(ip)
+}
+
+// findByIPLocked searches for a client by its IP address or a CIDR containing
+// it.  For internal use only.
+func (clients *clientsContainer) findByIPLocked(ip net.IP) (c *Client, ok bool) {
+	c, ok = clients.idIndex[ip.String()]
+	if ok {
+		return c, true
+	}
+
 	for _, c = range clients.list {
 		for _, id := range c.IDs {
 			_, ipnet, err := net.ParseCIDR(id)
@@ -329,6 +590,12 @@ func (clients *clientsContainer) findLocked(id string) (c *Client, ok bool) {
 		}
 	}
 
+	return nil, false
+}
+
+// findByMACLocked searches for a client by the MAC address of the DHCP lease
+// with the IP address ip.  For internal use only.
+func (clients *clientsContainer) findByMACLocked(ip net.IP) (c *Client, ok bool) {
 	if clients.dhcpServer == nil {
 		return nil, false
 	}
@@ -371,6 +638,98 @@ func (clients *clientsContainer) FindAutoClient(ip string) (ClientHost, bool) {
 	return ClientHost{}, false
 }
 
+// runtimeClients returns the runtime clients, which aren't covered by any
+// persistent client, sorted by their IP addresses.
+func (clients *clientsContainer) runtimeClients() (rcs []runtimeClientJSON) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	rcs = []runtimeClientJSON{}
+	for ip, ch := range clients.ipHost {
+		if _, ok := clients.findLocked(ip); ok {
+			continue
+		}
+
+		rc := runtimeClientJSON{
+			IP:        ip,
+			Name:      ch.Host,
+			Source:    ch.Source.String(),
+			WhoisInfo: map[string]string{},
+		}
+
+		if mac := clients.macByIPLocked(net.ParseIP(ip)); mac != nil {
+			rc.MAC = mac.String()
+		}
+
+		for _, wi := range ch.WhoisInfo {
+			rc.WhoisInfo[wi[0]] = wi[1]
+		}
+
+		rcs = append(rcs, rc)
+	}
+
+	sort.Slice(rcs, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(rcs[i].IP), net.ParseIP(rcs[j].IP)) < 0
+	})
+
+	return rcs
+}
+
+// macByIPLocked returns the MAC address of the DHCP lease with the IP address
+// ip or nil if there is none.  For internal use only.
+func (clients *clientsContainer) macByIPLocked(ip net.IP) (mac net.HardwareAddr) {
+	if clients.dhcpServer == nil || ip == nil {
+		return nil
+	}
+
+	return clients.dhcpServer.FindMACbyIP(ip)
+}
+
+// promote adds a persistent client created from the runtime client with the
+// IP address ip.  The client is identified by the IP address and by the MAC
+// address, if it's known.  name, if not empty, overrides the detected name.
+func (clients *clientsContainer) promote(ip, name string, tags []string) (c *Client, err error) {
+	clients.lock.Lock()
+	ch, ok := clients.ipHost[ip]
+	var host string
+	var mac net.HardwareAddr
+	if ok {
+		host = ch.Host
+		mac = clients.macByIPLocked(net.ParseIP(ip))
+	}
+	clients.lock.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("runtime client %q not found", ip)
+	}
+
+	if name == "" {
+		name = host
+	}
+
+	if name == "" {
+		name = ip
+	}
+
+	c = &Client{
+		IDs:  []string{ip},
+		Tags: tags,
+		Name: name,
+	}
+	if mac != nil {
+		c.IDs = append(c.IDs, mac.String())
+	}
+
+	ok, err = clients.Add(c)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("client %q already exists", name)
+	}
+
+	return c, nil
+}
+
 // check validates the client.
 func (clients *clientsContainer) check(c *Client) (err error) {
 	switch {
@@ -416,6 +775,28 @@ func (clients *clientsContainer) check(c *Client) (err error) {
 		return fmt.Errorf("invalid upstream servers: %w", err)
 	}
 
+	if c.UDPSize != 0 && c.UDPSize < dns.MinMsgSize {
+		return fmt.Errorf("invalid udp size %d: must be zero or at least %d", c.UDPSize, dns.MinMsgSize)
+	}
+
+	err = dnsfilter.ValidateBlockingMode(c.BlockingMode, c.BlockingIPv4, c.BlockingIPv6)
+	if err != nil {
+		return fmt.Errorf("client blocking mode: %w", err)
+	}
+
+	for _, r := range c.BypassReasons {
+		_, err = dnsfilter.ParseBypassReason(r)
+		if err != nil {
+			return fmt.Errorf("invalid bypass reason: %w", err)
+		}
+	}
+
+	for _, name := range c.AllowedQTypes {
+		if _, ok := dns.StringToType[strings.ToUpper(name)]; !ok {
+			return fmt.Errorf("invalid query type %q", name)
+		}
+	}
+
 	return nil
 }
 
@@ -430,6 +811,12 @@ func (clients *clientsContainer) Add(c *Client) (ok bool, err error) {
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
 
+	return clients.addLocked(c)
+}
+
+// addLocked adds a new client object which has already been checked.
+// clients.lock is expected to be locked.
+func (clients *clientsContainer) addLocked(c *Client) (ok bool, err error) {
 	// check Name index
 	_, ok = clients.list[c.Name]
 	if ok {
@@ -505,6 +892,12 @@ func (clients *clientsContainer) Update(name string, c *Client) (err error) {
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
 
+	return clients.updateLocked(name, c)
+}
+
+// updateLocked updates a client which has already been checked by its name.
+// clients.lock is expected to be locked.
+func (clients *clientsContainer) updateLocked(name string, c *Client) (err error) {
 	prev, ok := clients.list[name]
 	if !ok {
 		return agherr.Error("client not found")
@@ -550,6 +943,25 @@ func (clients *clientsContainer) Update(name string, c *Client) (err error) {
 	return nil
 }
 
+// WhoisInfo returns the WHOIS information of the runtime client with the IP
+// address ip or nil if there is none.
+func (clients *clientsContainer) WhoisInfo(ip string) (info map[string]string) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	ch, ok := clients.ipHost[ip]
+	if !ok || len(ch.WhoisInfo) == 0 {
+		return nil
+	}
+
+	info = make(map[string]string, len(ch.WhoisInfo))
+	for _, wi := range ch.WhoisInfo {
+		info[wi[0]] = wi[1]
+	}
+
+	return info
+}
+
 // SetWhoisInfo sets the WHOIS information for a client.
 //
 // TODO(a.garipov): Perhaps replace [][]string with map[string]string.
@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/miekg/dns"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -203,6 +205,13 @@ func TestClientsWhois(t *testing.T) {
 	clients.SetWhoisInfo("1.1.1.2", whois)
 	assert.Nil(t, clients.ipHost["1.1.1.2"])
 	_ = clients.Del("client1")
+
+	assert.Equal(t, map[string]string{
+		"orgname": "orgname-val",
+		"country": "country-val",
+	}, clients.WhoisInfo("1.1.1.1"))
+	assert.Nil(t, clients.WhoisInfo("1.1.1.2"))
+	assert.Nil(t, clients.WhoisInfo("1.1.1.3"))
 }
 
 func TestClientsAddExisting(t *testing.T) {
@@ -290,3 +299,352 @@ func TestClientsCustomUpstream(t *testing.T) {
 	assert.Equal(t, 1, len(config.Upstreams))
 	assert.Equal(t, 1, len(config.DomainReservedUpstreams))
 }
+
+func TestClientsUDPSize(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+
+	clients.Init(nil, nil, nil)
+
+	ok, err := clients.Add(&Client{
+		IDs:     []string{"1.1.1.1", "cli1"},
+		Name:    "client1",
+		UDPSize: 1232,
+	})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	assert.Equal(t, uint16(1232), clients.FindUDPSize(net.IP{1, 1, 1, 1}, ""))
+	assert.Equal(t, uint16(1232), clients.FindUDPSize(net.IP{1, 2, 3, 4}, "cli1"))
+	assert.Equal(t, uint16(0), clients.FindUDPSize(net.IP{1, 2, 3, 4}, ""))
+
+	ok, err = clients.Add(&Client{
+		IDs:     []string{"2.2.2.2"},
+		Name:    "client2",
+		UDPSize: 100,
+	})
+	assert.NotNil(t, err)
+	assert.False(t, ok)
+}
+
+func TestClientsAllowedQTypes(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+
+	clients.Init(nil, nil, nil)
+
+	ok, err := clients.Add(&Client{
+		IDs:           []string{"1.1.1.1", "cli1"},
+		Name:          "client1",
+		AllowedQTypes: []string{"A", "aaaa", "PTR"},
+	})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	want := []uint16{dns.TypeA, dns.TypeAAAA, dns.TypePTR}
+	assert.Equal(t, want, clients.FindAllowedQTypes(net.IP{1, 1, 1, 1}, ""))
+	assert.Equal(t, want, clients.FindAllowedQTypes(net.IP{1, 2, 3, 4}, "cli1"))
+	assert.Nil(t, clients.FindAllowedQTypes(net.IP{1, 2, 3, 4}, ""))
+
+	ok, err = clients.Add(&Client{
+		IDs:           []string{"2.2.2.2"},
+		Name:          "client2",
+		AllowedQTypes: []string{"A", "BAD"},
+	})
+	assert.NotNil(t, err)
+	assert.False(t, ok)
+}
+
+func TestClientsFindHostnames(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+
+	clients.Init(nil, nil, nil)
+
+	ok, err := clients.Add(&Client{
+		IDs:  []string{"1.1.1.1", "cli1"},
+		Name: "client1",
+	})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	_, _ = clients.AddHost("1.1.1.2", "laptop.lan", ClientSourceRDNS)
+
+	assert.Equal(t, []string{"client1"}, clients.FindHostnames(net.IP{1, 1, 1, 1}, ""))
+	assert.Equal(t, []string{"client1", "laptop.lan"}, clients.FindHostnames(net.IP{1, 1, 1, 2}, "cli1"))
+	assert.Equal(t, []string{"laptop.lan"}, clients.FindHostnames(net.IP{1, 1, 1, 2}, ""))
+	assert.Empty(t, clients.FindHostnames(net.IP{1, 1, 1, 3}, ""))
+}
+
+func TestClientsFindByOrder(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+
+	clients.Init(nil, nil, nil)
+
+	ok, err := clients.Add(&Client{
+		IDs:  []string{"cli1"},
+		Name: "client1",
+	})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = clients.Add(&Client{
+		IDs:  []string{"1.1.1.1"},
+		Name: "client2",
+	})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ip := net.IP{1, 1, 1, 1}
+
+	c, ok := clients.FindByOrder(ip, "cli1", nil)
+	assert.True(t, ok)
+	assert.Equal(t, "client1", c.Name)
+
+	clients.idOrder = []string{clientIDMethodIP, clientIDMethodClientID}
+
+	c, ok = clients.FindByOrder(ip, "cli1", nil)
+	assert.True(t, ok)
+	assert.Equal(t, "client2", c.Name)
+
+	c, ok = clients.FindByOrder(net.IP{1, 2, 3, 4}, "cli1", nil)
+	assert.True(t, ok)
+	assert.Equal(t, "client1", c.Name)
+
+	clients.idOrder = []string{clientIDMethodIP}
+
+	_, ok = clients.FindByOrder(net.IP{1, 2, 3, 4}, "cli1", nil)
+	assert.False(t, ok)
+
+	t.Run("ecs", func(t *testing.T) {
+		ok, err = clients.Add(&Client{
+			IDs:  []string{"10.0.0.0/24"},
+			Name: "client3",
+		})
+		assert.Nil(t, err)
+		assert.True(t, ok)
+
+		ecsIP := net.IP{10, 0, 0, 0}
+
+		clients.idOrder = []string{clientIDMethodECS, clientIDMethodIP}
+
+		c, ok = clients.FindByOrder(ip, "", ecsIP)
+		assert.True(t, ok)
+		assert.Equal(t, "client3", c.Name)
+
+		// Without the option, the client is identified by its
+		// address.
+		c, ok = clients.FindByOrder(ip, "", nil)
+		assert.True(t, ok)
+		assert.Equal(t, "client2", c.Name)
+
+		clients.idOrder = []string{clientIDMethodIP, clientIDMethodECS}
+
+		c, ok = clients.FindByOrder(ip, "", ecsIP)
+		assert.True(t, ok)
+		assert.Equal(t, "client2", c.Name)
+
+		c, ok = clients.FindByOrder(net.IP{1, 2, 3, 4}, "", ecsIP)
+		assert.True(t, ok)
+		assert.Equal(t, "client3", c.Name)
+
+		// The method isn't used unless it's in the order.
+		clients.idOrder = []string{clientIDMethodIP}
+
+		_, ok = clients.FindByOrder(net.IP{1, 2, 3, 4}, "", ecsIP)
+		assert.False(t, ok)
+	})
+}
+
+func TestValidateClientIDOrder(t *testing.T) {
+	assert.Nil(t, validateClientIDOrder(nil))
+	assert.Nil(t, validateClientIDOrder(defaultClientIDOrder))
+	assert.Nil(t, validateClientIDOrder([]string{clientIDMethodMAC, clientIDMethodIP}))
+	assert.NotNil(t, validateClientIDOrder([]string{"ecs"}))
+	assert.NotNil(t, validateClientIDOrder([]string{clientIDMethodIP, clientIDMethodIP}))
+}
+
+func TestClientsBypassReasons(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+
+	clients.Init(nil, nil, nil)
+
+	ok, err := clients.Add(&Client{
+		IDs:           []string{"1.1.1.1"},
+		Name:          "invalid",
+		BypassReasons: []string{"Rewrite"},
+	})
+	assert.NotNil(t, err)
+	assert.False(t, ok)
+
+	ok, err = clients.Add(&Client{
+		IDs:           []string{"1.2.3.4"},
+		Name:          "sandbox",
+		BypassReasons: []string{"FilteredSafeBrowsing"},
+	})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	c, ok := clients.Find("1.2.3.4")
+	assert.True(t, ok)
+
+	setts := &dnsfilter.RequestFilteringSettings{
+		FilteringEnabled:    true,
+		SafeBrowsingEnabled: true,
+	}
+	applyClientSettings(c, setts)
+	assert.Equal(t, []dnsfilter.Reason{dnsfilter.FilteredSafeBrowsing}, setts.BypassReasons)
+	assert.True(t, setts.SafeBrowsingEnabled)
+}
+
+func TestClientsEffectiveSettings(t *testing.T) {
+	dnsfilter.InitModule()
+	Context.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, nil)
+	t.Cleanup(func() { Context.dnsFilter = nil })
+
+	prevUps := config.DNS.UpstreamDNS
+	config.DNS.UpstreamDNS = []string{"1.1.1.1"}
+	t.Cleanup(func() { config.DNS.UpstreamDNS = prevUps })
+
+	clients := clientsContainer{}
+	clients.testing = true
+
+	clients.Init(nil, nil, nil)
+
+	ok, err := clients.Add(&Client{
+		IDs:  []string{"1.2.3.4"},
+		Tags: []string{"device_other"},
+		Name: "inherits",
+	})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	ok, err = clients.Add(&Client{
+		IDs:                   []string{"5.6.7.8"},
+		Name:                  "overrides",
+		UseOwnSettings:        true,
+		FilteringEnabled:      false,
+		ParentalEnabled:       true,
+		UseOwnBlockedServices: true,
+		BlockedServices:       []string{"youtube"},
+		Upstreams:             []string{"8.8.8.8"},
+	})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	globalSetts := func() (setts *dnsfilter.RequestFilteringSettings) {
+		setts = &dnsfilter.RequestFilteringSettings{
+			FilteringEnabled:    true,
+			SafeBrowsingEnabled: true,
+		}
+		setts.ServicesRules = []dnsfilter.ServiceEntry{{Name: "facebook"}}
+
+		return setts
+	}
+
+	t.Run("inherits", func(t *testing.T) {
+		ej := clients.effectiveSettings("1.2.3.4", globalSetts())
+		assert.Equal(t, "inherits", ej.Name)
+		assert.True(t, ej.UseGlobalSettings)
+		assert.True(t, ej.FilteringEnabled)
+		assert.True(t, ej.SafeBrowsingEnabled)
+		assert.False(t, ej.ParentalEnabled)
+		assert.Equal(t, []string{"device_other"}, ej.Tags)
+		assert.Equal(t, []string{"facebook"}, ej.BlockedServices)
+		assert.Equal(t, []string{"1.1.1.1"}, ej.Upstreams)
+	})
+
+	t.Run("overrides", func(t *testing.T) {
+		ej := clients.effectiveSettings("5.6.7.8", globalSetts())
+		assert.Equal(t, "overrides", ej.Name)
+		assert.False(t, ej.UseGlobalSettings)
+		assert.False(t, ej.FilteringEnabled)
+		assert.False(t, ej.SafeBrowsingEnabled)
+		assert.True(t, ej.ParentalEnabled)
+		assert.Empty(t, ej.FilterListIDs)
+		assert.Equal(t, []string{"youtube"}, ej.BlockedServices)
+		assert.Equal(t, []string{"8.8.8.8"}, ej.Upstreams)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		ej := clients.effectiveSettings("9.9.9.9", globalSetts())
+		assert.Empty(t, ej.Name)
+		assert.True(t, ej.UseGlobalSettings)
+		assert.True(t, ej.FilteringEnabled)
+		assert.Equal(t, []string{"facebook"}, ej.BlockedServices)
+	})
+}
+
+func TestClientsRuntime(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil, nil)
+
+	_, _ = clients.AddHost("1.1.1.2", "laptop", ClientSourceRDNS)
+	_, _ = clients.AddHost("1.1.1.1", "tablet", ClientSourceDHCP)
+	clients.SetWhoisInfo("1.1.1.3", [][]string{{"country", "AU"}})
+
+	ok, err := clients.Add(&Client{
+		IDs:  []string{"1.1.1.4"},
+		Name: "persistent",
+	})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	_, _ = clients.AddHost("1.1.1.4", "persistent-host", ClientSourceRDNS)
+
+	t.Run("list", func(t *testing.T) {
+		rcs := clients.runtimeClients()
+		if !assert.Len(t, rcs, 3) {
+			return
+		}
+
+		assert.Equal(t, "1.1.1.1", rcs[0].IP)
+		assert.Equal(t, "tablet", rcs[0].Name)
+		assert.Equal(t, "DHCP", rcs[0].Source)
+
+		assert.Equal(t, "1.1.1.2", rcs[1].IP)
+		assert.Equal(t, "laptop", rcs[1].Name)
+		assert.Equal(t, "rDNS", rcs[1].Source)
+
+		assert.Equal(t, "1.1.1.3", rcs[2].IP)
+		assert.Equal(t, "WHOIS", rcs[2].Source)
+		assert.Equal(t, "AU", rcs[2].WhoisInfo["country"])
+	})
+
+	t.Run("promote", func(t *testing.T) {
+		c, perr := clients.promote("1.1.1.1", "", []string{"device_tablet"})
+		assert.Nil(t, perr)
+		if assert.NotNil(t, c) {
+			assert.Equal(t, "tablet", c.Name)
+			assert.Equal(t, []string{"1.1.1.1"}, c.IDs)
+			assert.Equal(t, []string{"device_tablet"}, c.Tags)
+		}
+
+		c, ok = clients.Find("1.1.1.1")
+		assert.True(t, ok)
+		assert.Equal(t, "tablet", c.Name)
+
+		rcs := clients.runtimeClients()
+		assert.Len(t, rcs, 2)
+	})
+
+	t.Run("promote_name", func(t *testing.T) {
+		c, perr := clients.promote("1.1.1.3", "router", nil)
+		assert.Nil(t, perr)
+		if assert.NotNil(t, c) {
+			assert.Equal(t, "router", c.Name)
+		}
+	})
+
+	t.Run("promote_unknown", func(t *testing.T) {
+		_, perr := clients.promote("1.1.1.5", "", nil)
+		assert.NotNil(t, perr)
+	})
+
+	t.Run("promote_existing_name", func(t *testing.T) {
+		_, perr := clients.promote("1.1.1.2", "persistent", nil)
+		assert.NotNil(t, perr)
+	})
+}
@@ -0,0 +1,264 @@
+package home
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// clientStatsGetter returns the filtering statistics of the clients by their
+// names.  It's implemented by *dnsfilter.DNSFilter.
+type clientStatsGetter interface {
+	ClientStats(name string) (s dnsfilter.ClientStat)
+}
+
+// clientStatsSetter restores and renames the filtering statistics of the
+// clients.  It's implemented by *dnsfilter.DNSFilter.
+type clientStatsSetter interface {
+	SetClientStats(s dnsfilter.ClientStat)
+	RenameClientStats(prev, name string)
+}
+
+// clientExportJSON is a persistent client in the export of the clients list.
+type clientExportJSON struct {
+	clientJSON
+
+	// Stats is the snapshot of the client's filtering statistics.  It's nil
+	// unless the statistics are exported.  The query statistics collected
+	// by the statistics module are kept by the clients' addresses and
+	// aren't exported.
+	Stats *dnsfilter.ClientStat `json:"stats,omitempty"`
+}
+
+// clientsExportJSON is the export of the clients list.
+type clientsExportJSON struct {
+	Clients []clientExportJSON `json:"clients"`
+}
+
+// clientsImportJSON is the request to import the clients list.
+type clientsImportJSON struct {
+	Clients []clientExportJSON `json:"clients"`
+
+	// ImportStats makes the filtering statistics of the clients, if they
+	// have been exported, restored as well.
+	ImportStats bool `json:"import_stats"`
+}
+
+// clientImportFailureJSON is a client which couldn't be imported.
+type clientImportFailureJSON struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// clientsImportResultJSON is the response to the import of the clients list.
+type clientsImportResultJSON struct {
+	Failed  []clientImportFailureJSON `json:"failed"`
+	Added   int                       `json:"added"`
+	Updated int                       `json:"updated"`
+}
+
+// export returns the persistent clients sorted by their names.  If stats isn't
+// nil, the snapshots of their filtering statistics are included.
+func (clients *clientsContainer) export(stats clientStatsGetter) (exp clientsExportJSON) {
+	clients.lock.Lock()
+	exp.Clients = make([]clientExportJSON, 0, len(clients.list))
+	for _, c := range clients.list {
+		exp.Clients = append(exp.Clients, clientExportJSON{
+			clientJSON: clientToJSON(c),
+		})
+	}
+	clients.lock.Unlock()
+
+	sort.Slice(exp.Clients, func(i, j int) bool {
+		return exp.Clients[i].Name < exp.Clients[j].Name
+	})
+
+	if stats == nil {
+		return exp
+	}
+
+	for i := range exp.Clients {
+		s := stats.ClientStats(exp.Clients[i].Name)
+		exp.Clients[i].Stats = &s
+	}
+
+	return exp
+}
+
+// stableClientID returns the normalized id if it's a MAC address or a
+// ClientID, which identify the client regardless of its IP address.
+func stableClientID(id string) (norm string, ok bool) {
+	if net.ParseIP(id) != nil {
+		return "", false
+	} else if _, _, err := net.ParseCIDR(id); err == nil {
+		return "", false
+	} else if mac, err := net.ParseMAC(id); err == nil {
+		return mac.String(), true
+	} else if err = dnsforward.ValidateClientID(id); err == nil {
+		return id, true
+	}
+
+	return "", false
+}
+
+// reconcileLocked returns the name of the persistent client which the
+// imported client c corresponds to.  The clients are reconciled by their MAC
+// addresses and ClientIDs and, if c has none of them, by their names.
+// clients.lock is expected to be locked.
+func (clients *clientsContainer) reconcileLocked(c *Client) (name string, ok bool) {
+	hasStable := false
+	for _, id := range c.IDs {
+		norm, isStable := stableClientID(id)
+		if !isStable {
+			continue
+		}
+
+		hasStable = true
+		if prev, found := clients.idIndex[norm]; found {
+			return prev.Name, true
+		}
+	}
+
+	if hasStable {
+		return "", false
+	}
+
+	_, ok = clients.list[c.Name]
+
+	return c.Name, ok
+}
+
+// importClients adds the imported clients or updates the persistent ones they
+// correspond to, see reconcileLocked.  If stats isn't nil, the filtering
+// statistics of the renamed clients are moved to their new names and, if
+// importStats is true, the exported ones are restored.  The failure of a client
+// doesn't prevent the others from being imported.
+func (clients *clientsContainer) importClients(
+	imported []clientExportJSON,
+	stats clientStatsSetter,
+	importStats bool,
+) (res clientsImportResultJSON) {
+	res.Failed = []clientImportFailureJSON{}
+	for _, ce := range imported {
+		c := jsonToClient(ce.clientJSON)
+		prevName, exists, err := clients.importClient(c)
+		if err != nil {
+			log.Info("clients: importing %q: %s", ce.Name, err)
+			res.Failed = append(res.Failed, clientImportFailureJSON{
+				Name:  ce.Name,
+				Error: err.Error(),
+			})
+
+			continue
+		}
+
+		if exists {
+			res.Updated++
+		} else {
+			res.Added++
+		}
+
+		if stats == nil {
+			continue
+		}
+
+		if exists && prevName != c.Name {
+			stats.RenameClientStats(prevName, c.Name)
+		}
+
+		if importStats && ce.Stats != nil {
+			s := *ce.Stats
+			s.Name = c.Name
+			stats.SetClientStats(s)
+		}
+	}
+
+	return res
+}
+
+// importClient adds the imported client c or updates the persistent client
+// with the name prevName it corresponds to, in which case exists is true.
+func (clients *clientsContainer) importClient(c *Client) (prevName string, exists bool, err error) {
+	err = clients.check(c)
+	if err != nil {
+		return "", false, err
+	}
+
+	// Reconcile and modify the clients at once, so that a concurrent
+	// change doesn't break the correspondence.
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	prevName, exists = clients.reconcileLocked(c)
+	if exists {
+		return prevName, true, clients.updateLocked(prevName, c)
+	}
+
+	ok, err := clients.addLocked(c)
+	if err == nil && !ok {
+		err = agherr.Error("client already exists")
+	}
+
+	return "", false, err
+}
+
+// handleExportClients responds with the persistent clients and, if the stats
+// query parameter is true, the snapshots of their filtering statistics.
+func (clients *clientsContainer) handleExportClients(w http.ResponseWriter, r *http.Request) {
+	var withStats bool
+	if s := r.URL.Query().Get("stats"); s != "" {
+		var err error
+		withStats, err = strconv.ParseBool(s)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "invalid stats parameter: %s", err)
+
+			return
+		}
+	}
+
+	var stats clientStatsGetter
+	if withStats && Context.dnsFilter != nil {
+		stats = Context.dnsFilter
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(clients.export(stats))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write response: %s", err)
+	}
+}
+
+// handleImportClients imports the clients list and, if requested, their
+// filtering statistics.
+func (clients *clientsContainer) handleImportClients(w http.ResponseWriter, r *http.Request) {
+	ij := clientsImportJSON{}
+	err := json.NewDecoder(r.Body).Decode(&ij)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	var stats clientStatsSetter
+	if Context.dnsFilter != nil {
+		stats = Context.dnsFilter
+	}
+
+	res := clients.importClients(ij.Clients, stats, ij.ImportStats)
+	if res.Added+res.Updated != 0 {
+		onConfigModified()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write response: %s", err)
+	}
+}
@@ -0,0 +1,184 @@
+package home
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+// testClientStats is a clientStatsGetter and a clientStatsSetter for tests.
+type testClientStats map[string]dnsfilter.ClientStat
+
+// ClientStats implements the clientStatsGetter interface for testClientStats.
+func (stats testClientStats) ClientStats(name string) (s dnsfilter.ClientStat) {
+	s, ok := stats[name]
+	if !ok {
+		return dnsfilter.ClientStat{Name: name}
+	}
+
+	return s
+}
+
+// SetClientStats implements the clientStatsSetter interface for
+// testClientStats.
+func (stats testClientStats) SetClientStats(s dnsfilter.ClientStat) {
+	stats[s.Name] = s
+}
+
+// RenameClientStats implements the clientStatsSetter interface for
+// testClientStats.
+func (stats testClientStats) RenameClientStats(prev, name string) {
+	s, ok := stats[prev]
+	if !ok || prev == name {
+		return
+	}
+
+	delete(stats, prev)
+	s.Name = name
+	stats[name] = s
+}
+
+func newTestClientsContainer(t *testing.T, cs ...*Client) (clients *clientsContainer) {
+	clients = &clientsContainer{testing: true}
+	clients.Init(nil, nil, nil)
+
+	for _, c := range cs {
+		ok, err := clients.Add(c)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+
+	return clients
+}
+
+func TestClientsContainer_exportImport(t *testing.T) {
+	src := newTestClientsContainer(t, &Client{
+		Name: "laptop",
+		IDs:  []string{"aa:aa:aa:aa:aa:aa", "192.168.1.2"},
+	}, &Client{
+		Name:    "phone",
+		IDs:     []string{"phone-id"},
+		UDPSize: 1232,
+	}, &Client{
+		Name:           "printer",
+		IDs:            []string{"192.168.1.3"},
+		UseOwnSettings: true,
+	})
+
+	srcStats := testClientStats{
+		"laptop": {
+			Name:               "laptop",
+			Requests:           100,
+			Blocked:            10,
+			BlockedByBlockList: 10,
+		},
+		"phone": {
+			Name:     "phone",
+			Requests: 5,
+		},
+	}
+
+	// Pass the export through JSON, like between the instances.
+	b, err := json.Marshal(src.export(srcStats))
+	assert.Nil(t, err)
+
+	exp := clientsExportJSON{}
+	assert.Nil(t, json.Unmarshal(b, &exp))
+	if !assert.Len(t, exp.Clients, 3) {
+		return
+	}
+	assert.Equal(t, "laptop", exp.Clients[0].Name)
+	if assert.NotNil(t, exp.Clients[2].Stats) {
+		assert.Equal(t, dnsfilter.ClientStat{Name: "printer"}, *exp.Clients[2].Stats)
+	}
+
+	t.Run("with_stats", func(t *testing.T) {
+		dst := newTestClientsContainer(t, &Client{
+			// The same MAC address in another format.
+			Name: "old-laptop",
+			IDs:  []string{"AA-AA-AA-AA-AA-AA"},
+		}, &Client{
+			// No stable IDs, so reconciled by the name.
+			Name: "printer",
+			IDs:  []string{"192.168.1.30"},
+		})
+		dstStats := testClientStats{}
+
+		res := dst.importClients(exp.Clients, dstStats, true)
+		assert.Empty(t, res.Failed)
+		assert.Equal(t, 1, res.Added)
+		assert.Equal(t, 2, res.Updated)
+
+		assert.Len(t, dst.list, 3)
+		assert.NotContains(t, dst.list, "old-laptop")
+		if c, ok := dst.list["laptop"]; assert.True(t, ok) {
+			assert.Equal(t, []string{"aa:aa:aa:aa:aa:aa", "192.168.1.2"}, c.IDs)
+		}
+		if c, ok := dst.list["phone"]; assert.True(t, ok) {
+			assert.Equal(t, uint16(1232), c.UDPSize)
+		}
+		if c, ok := dst.list["printer"]; assert.True(t, ok) {
+			assert.Equal(t, []string{"192.168.1.3"}, c.IDs)
+			assert.True(t, c.UseOwnSettings)
+		}
+
+		assert.Equal(t, srcStats["laptop"], dstStats["laptop"])
+		assert.Equal(t, srcStats["phone"], dstStats["phone"])
+		assert.Equal(t, dnsfilter.ClientStat{Name: "printer"}, dstStats["printer"])
+	})
+
+	t.Run("without_stats", func(t *testing.T) {
+		dst := newTestClientsContainer(t)
+
+		res := dst.importClients(exp.Clients, nil, false)
+		assert.Empty(t, res.Failed)
+		assert.Equal(t, 3, res.Added)
+		assert.Equal(t, 0, res.Updated)
+
+		plain := src.export(nil)
+		for i := range plain.Clients {
+			assert.Nil(t, plain.Clients[i].Stats)
+		}
+		assert.Equal(t, plain, dst.export(nil))
+	})
+
+	t.Run("rename_stats", func(t *testing.T) {
+		dst := newTestClientsContainer(t, &Client{
+			Name: "old-laptop",
+			IDs:  []string{"aa:aa:aa:aa:aa:aa"},
+		})
+		dstStats := testClientStats{
+			"old-laptop": {Name: "old-laptop", Requests: 7},
+		}
+
+		res := dst.importClients(exp.Clients, dstStats, false)
+		assert.Empty(t, res.Failed)
+		assert.Equal(t, 1, res.Updated)
+
+		// The statistics follow the renamed client without being
+		// replaced by the exported ones.
+		assert.NotContains(t, dstStats, "old-laptop")
+		assert.Equal(t, dnsfilter.ClientStat{
+			Name:     "laptop",
+			Requests: 7,
+		}, dstStats["laptop"])
+		assert.NotContains(t, dstStats, "phone")
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		dst := newTestClientsContainer(t, &Client{
+			// Another client with the laptop's IP address.
+			Name: "desktop",
+			IDs:  []string{"192.168.1.2"},
+		})
+
+		res := dst.importClients(exp.Clients, nil, false)
+		if assert.Len(t, res.Failed, 1) {
+			assert.Equal(t, "laptop", res.Failed[0].Name)
+		}
+		assert.Equal(t, 2, res.Added)
+		assert.Contains(t, dst.list, "desktop")
+	})
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 )
 
 type clientJSON struct {
@@ -22,6 +24,18 @@ type clientJSON struct {
 
 	Upstreams []string `json:"upstreams"`
 
+	UDPSize uint16 `json:"udp_size"`
+
+	BlockedResponseTTL uint32 `json:"blocked_response_ttl"`
+
+	BlockingMode string `json:"blocking_mode"`
+	BlockingIPv4 net.IP `json:"blocking_ipv4"`
+	BlockingIPv6 net.IP `json:"blocking_ipv6"`
+
+	BypassReasons []string `json:"bypass_reasons"`
+
+	AllowedQTypes []string `json:"allowed_qtypes"`
+
 	WhoisInfo map[string]string `json:"whois_info"`
 
 	// Disallowed - if true -- client's IP is not disallowed
@@ -42,12 +56,59 @@ type clientHostJSON struct {
 	WhoisInfo map[string]string `json:"whois_info"`
 }
 
+// runtimeClientJSON is the JSON representation of a runtime client, which is
+// discovered automatically.
+type runtimeClientJSON struct {
+	IP     string `json:"ip"`
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	// MAC is the MAC address of the client's DHCP lease, if any.
+	MAC string `json:"mac,omitempty"`
+
+	WhoisInfo map[string]string `json:"whois_info"`
+}
+
+// promoteJSON is the request to promote a runtime client into a persistent
+// one.
+type promoteJSON struct {
+	IP string `json:"ip"`
+	// Name, if not empty, overrides the detected name of the client.
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
 type clientListJSON struct {
 	Clients     []clientJSON     `json:"clients"`
 	AutoClients []clientHostJSON `json:"auto_clients"`
 	Tags        []string         `json:"supported_tags"`
 }
 
+// clientEffectiveJSON is the JSON representation of the settings which are
+// actually applied to the requests of a client.
+type clientEffectiveJSON struct {
+	ID string `json:"id"`
+	// Name is the name of the persistent client.  It is empty if there is no
+	// persistent client with such ID, in which case the global settings are
+	// used.
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+
+	UseGlobalSettings   bool `json:"use_global_settings"`
+	FilteringEnabled    bool `json:"filtering_enabled"`
+	ParentalEnabled     bool `json:"parental_enabled"`
+	SafeSearchEnabled   bool `json:"safesearch_enabled"`
+	SafeBrowsingEnabled bool `json:"safebrowsing_enabled"`
+
+	UseGlobalBlockedServices bool     `json:"use_global_blocked_services"`
+	BlockedServices          []string `json:"blocked_services"`
+
+	// FilterListIDs are the IDs of the enabled filter lists, which are
+	// applied to the client's requests.
+	FilterListIDs []int64 `json:"filter_list_ids"`
+
+	Upstreams []string `json:"upstreams"`
+}
+
 // respond with information about configured clients
 func (clients *clientsContainer) handleGetClients(w http.ResponseWriter, _ *http.Request) {
 	data := clientListJSON{}
@@ -59,20 +120,9 @@ func (clients *clientsContainer) handleGetClients(w http.ResponseWriter, _ *http
 	}
 	for ip, ch := range clients.ipHost {
 		cj := clientHostJSON{
-			IP:   ip,
-			Name: ch.Host,
-		}
-
-		cj.Source = "etc/hosts"
-		switch ch.Source {
-		case ClientSourceDHCP:
-			cj.Source = "DHCP"
-		case ClientSourceRDNS:
-			cj.Source = "rDNS"
-		case ClientSourceARP:
-			cj.Source = "ARP"
-		case ClientSourceWHOIS:
-			cj.Source = "WHOIS"
+			IP:     ip,
+			Name:   ch.Host,
+			Source: ch.Source.String(),
 		}
 
 		cj.WhoisInfo = map[string]string{}
@@ -110,6 +160,18 @@ func jsonToClient(cj clientJSON) (c *Client) {
 		BlockedServices:       cj.BlockedServices,
 
 		Upstreams: cj.Upstreams,
+
+		UDPSize: cj.UDPSize,
+
+		BlockedResponseTTL: cj.BlockedResponseTTL,
+
+		BlockingMode: cj.BlockingMode,
+		BlockingIPv4: cj.BlockingIPv4,
+		BlockingIPv6: cj.BlockingIPv6,
+
+		BypassReasons: cj.BypassReasons,
+
+		AllowedQTypes: cj.AllowedQTypes,
 	}
 }
 
@@ -129,6 +191,18 @@ func clientToJSON(c *Client) clientJSON {
 		BlockedServices:          c.BlockedServices,
 
 		Upstreams: c.Upstreams,
+
+		UDPSize: c.UDPSize,
+
+		BlockedResponseTTL: c.BlockedResponseTTL,
+
+		BlockingMode: c.BlockingMode,
+		BlockingIPv4: c.BlockingIPv4,
+		BlockingIPv6: c.BlockingIPv6,
+
+		BypassReasons: c.BypassReasons,
+
+		AllowedQTypes: c.AllowedQTypes,
 	}
 	return cj
 }
@@ -222,6 +296,10 @@ func (clients *clientsContainer) handleUpdateClient(w http.ResponseWriter, r *ht
 		return
 	}
 
+	if Context.dnsFilter != nil {
+		Context.dnsFilter.RenameClientStats(dj.Name, c.Name)
+	}
+
 	onConfigModified()
 }
 
@@ -295,6 +373,127 @@ func (clients *clientsContainer) findTemporary(ip net.IP, idStr string) (cj clie
 	return cj, true
 }
 
+// effectiveSettings returns the settings which are applied to the requests of
+// the client with the given ID.  setts must contain the global filtering
+// settings.  It uses the same resolution logic as the DNS server.
+func (clients *clientsContainer) effectiveSettings(id string, setts *dnsfilter.RequestFilteringSettings) (ej clientEffectiveJSON) {
+	ej = clientEffectiveJSON{
+		ID:                       id,
+		UseGlobalSettings:        true,
+		UseGlobalBlockedServices: true,
+	}
+
+	if ip := net.ParseIP(id); ip != nil {
+		setts.ClientIP = ip
+	}
+
+	c, ok := clients.Find(id)
+	if ok {
+		applyClientSettings(c, setts)
+
+		ej.Name = c.Name
+		ej.UseGlobalSettings = !c.UseOwnSettings
+		ej.UseGlobalBlockedServices = !c.UseOwnBlockedServices
+		ej.Upstreams = c.Upstreams
+	}
+
+	ej.Tags = setts.ClientTags
+	ej.ParentalEnabled = setts.ParentalEnabled
+	ej.SafeSearchEnabled = setts.SafeSearchEnabled
+	ej.SafeBrowsingEnabled = setts.SafeBrowsingEnabled
+	for _, s := range setts.ServicesRules {
+		ej.BlockedServices = append(ej.BlockedServices, s.Name)
+	}
+
+	config.RLock()
+	defer config.RUnlock()
+
+	ej.FilteringEnabled = setts.FilteringEnabled && config.DNS.FilteringEnabled
+	if ej.FilteringEnabled {
+		for _, filters := range [][]filter{config.Filters, config.WhitelistFilters} {
+			for _, f := range filters {
+				if f.Enabled {
+					ej.FilterListIDs = append(ej.FilterListIDs, f.ID)
+				}
+			}
+		}
+	}
+
+	if len(ej.Upstreams) == 0 {
+		ej.Upstreams = copyStrings(config.DNS.UpstreamDNS)
+	}
+
+	return ej
+}
+
+// handleGetEffectiveSettings responds with the settings which are actually
+// applied to the requests of the client with the ID from the "id" query
+// parameter.
+func (clients *clientsContainer) handleGetEffectiveSettings(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		httpError(w, http.StatusBadRequest, "no client id")
+
+		return
+	}
+
+	setts := Context.dnsFilter.GetConfig()
+	setts.FilteringEnabled = true
+	Context.dnsFilter.ApplyBlockedServices(&setts, nil, true)
+
+	ej := clients.effectiveSettings(id, &setts)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(ej)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write response: %s", err)
+	}
+}
+
+// handleGetRuntimeClients responds with the list of the runtime clients.
+func (clients *clientsContainer) handleGetRuntimeClients(w http.ResponseWriter, _ *http.Request) {
+	data := clients.runtimeClients()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write response: %s", err)
+	}
+}
+
+// handlePromoteRuntimeClient creates a persistent client from a runtime one
+// and responds with it.
+func (clients *clientsContainer) handlePromoteRuntimeClient(w http.ResponseWriter, r *http.Request) {
+	pj := promoteJSON{}
+	err := json.NewDecoder(r.Body).Decode(&pj)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	if net.ParseIP(pj.IP) == nil {
+		httpError(w, http.StatusBadRequest, "invalid ip %q", pj.IP)
+
+		return
+	}
+
+	c, err := clients.promote(pj.IP, pj.Name, pj.Tags)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(clientToJSON(c))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write response: %s", err)
+	}
+}
+
 // RegisterClientsHandlers registers HTTP handlers
 func (clients *clientsContainer) registerWebHandlers() {
 	httpRegister("GET", "/control/clients", clients.handleGetClients)
@@ -302,4 +501,9 @@ func (clients *clientsContainer) registerWebHandlers() {
 	httpRegister("POST", "/control/clients/delete", clients.handleDelClient)
 	httpRegister("POST", "/control/clients/update", clients.handleUpdateClient)
 	httpRegister("GET", "/control/clients/find", clients.handleFindClient)
+	httpRegister("GET", "/control/clients/effective", clients.handleGetEffectiveSettings)
+	httpRegister("GET", "/control/clients/runtime", clients.handleGetRuntimeClients)
+	httpRegister("POST", "/control/clients/runtime/promote", clients.handlePromoteRuntimeClient)
+	httpRegister("GET", "/control/clients/export", clients.handleExportClients)
+	httpRegister("POST", "/control/clients/import", clients.handleImportClients)
 }
@@ -62,11 +62,28 @@ type configuration struct {
 	WhitelistFilters []filter `yaml:"whitelist_filters"`
 	UserRules        []string `yaml:"user_rules"`
 
+	// UserRulesDisableExpired makes the custom filtering rules with the
+	// expiration date in their metadata comments not loaded from that
+	// date.  See userRuleMetaPrefix.
+	UserRulesDisableExpired bool `yaml:"user_rules_disable_expired"`
+
+	// SafeMode disables the HTTP APIs which change the configuration and
+	// the writing of the configuration file.  See also the --safe-mode
+	// command-line option.
+	SafeMode bool `yaml:"safe_mode"`
+
 	DHCP dhcpd.ServerConfig `yaml:"dhcp"`
 
 	// Note: this array is filled only before file read/write and then it's cleared
 	Clients []clientObject `yaml:"clients"`
 
+	// ClientsIdentificationOrder is the order in which the client
+	// identification methods are tried.  The valid methods are "client_id",
+	// "ip", "mac", and "ecs".  The latter identifies the clients by the
+	// subnet from the EDNS Client Subnet option of their filtered requests
+	// if edns_client_subnet_matching is enabled.
+	ClientsIdentificationOrder []string `yaml:"clients_identification_order"`
+
 	logSettings `yaml:",inline"`
 
 	sync.RWMutex `yaml:"-"`
@@ -88,11 +105,59 @@ type dnsConfig struct {
 	QueryLogMemSize     uint32 `yaml:"querylog_size_memory"`  // number of entries kept in memory before they are flushed to disk
 	AnonymizeClientIP   bool   `yaml:"anonymize_client_ip"`   // anonymize clients' IP addresses in logs and stats
 
+	// QueryLogAllowedSampleRate is the rate at which the queries which
+	// haven't matched anything are sampled into the query log.  See
+	// querylog.Config.AllowedSampleRate.
+	QueryLogAllowedSampleRate uint32 `yaml:"querylog_allowed_sample_rate"`
+	// QueryLogAllowedCountOnly disables logging of the queries which
+	// haven't matched anything.  See querylog.Config.AllowedCountOnly.
+	QueryLogAllowedCountOnly bool `yaml:"querylog_allowed_count_only"`
+	// QueryLogDedupBlockedSeconds is the window within which the repeated
+	// identical blocked queries are collapsed into a single query log
+	// entry.  See querylog.Config.DedupBlockedSeconds.
+	QueryLogDedupBlockedSeconds uint32 `yaml:"querylog_dedup_blocked_seconds"`
+	// QueryLogVerbose makes the query log record the protocol details of
+	// the queries.  See querylog.Config.Verbose.
+	QueryLogVerbose bool `yaml:"querylog_verbose"`
+
 	dnsforward.FilteringConfig `yaml:",inline"`
 
 	FilteringEnabled           bool             `yaml:"filtering_enabled"`       // whether or not use filter lists
 	FiltersUpdateIntervalHours uint32           `yaml:"filters_update_interval"` // time period to update filters (in hours)
 	DnsfilterConf              dnsfilter.Config `yaml:",inline"`
+
+	// SelfTestInterval is the interval between the filtering self-tests in
+	// minutes.  If it is 0, the self-tests are disabled.
+	SelfTestInterval uint32 `yaml:"selftest_interval"`
+	// SelfTestBlockedHost is the host which must be blocked by the filters
+	// for the self-test to pass.
+	SelfTestBlockedHost string `yaml:"selftest_blocked_host"`
+	// SelfTestAllowedHost is the host which must not be blocked by the
+	// filters for the self-test to pass.
+	SelfTestAllowedHost string `yaml:"selftest_allowed_host"`
+
+	// GeoIPFile is the path to the CSV IP geolocation database used for
+	// geo_blocked_countries.  See newGeoIPDB.
+	GeoIPFile string `yaml:"geoip_file"`
+
+	// WhoisEnabled shows if the WHOIS information about the public IP
+	// addresses of the clients is requested.  It's disabled by default for
+	// privacy.
+	WhoisEnabled bool `yaml:"whois_enabled"`
+
+	// WhoisRatelimit is the maximum number of the WHOIS queries per minute.
+	// If it is 0, the queries aren't limited.
+	WhoisRatelimit uint32 `yaml:"whois_ratelimit"`
+
+	// StartupDHCPWait is the maximum time in seconds the DNS server waits
+	// for the DHCP server, if it's enabled, to load its leases and start
+	// before starting itself.  If it is 0, the DNS server doesn't wait.
+	StartupDHCPWait uint32 `yaml:"startup_dhcp_wait"`
+
+	// RecommendedFiltersURL is the URL of the index of the recommended
+	// filter lists used by /control/filtering/add_recommended.  See
+	// recommendedIndex for the format.
+	RecommendedFiltersURL string `yaml:"recommended_filters_url"`
 }
 
 type tlsConfigSettings struct {
@@ -116,6 +181,15 @@ type tlsConfigSettings struct {
 	// Allow DOH queries via unencrypted HTTP (e.g. for reverse proxying)
 	AllowUnencryptedDOH bool `yaml:"allow_unencrypted_doh" json:"allow_unencrypted_doh"`
 
+	// MaxHTTPSConnections is the maximum number of the concurrently open
+	// connections to the HTTPS server, which also serves DNS-over-HTTPS.
+	// The connections exceeding it are rejected.  If zero, the number
+	// isn't limited.
+	//
+	// The DNS-over-TLS and DNS-over-QUIC connections aren't limited, since
+	// their listeners are created by dnsproxy.
+	MaxHTTPSConnections uint32 `yaml:"max_https_connections" json:"-"`
+
 	dnsforward.TLSConfig `yaml:",inline" json:",inline"`
 }
 
@@ -141,9 +215,14 @@ var config = configuration{
 			// https://github.com/AdguardTeam/AdGuardHome/issues/2015#issuecomment-674041912
 			// was later increased to 300 due to https://github.com/AdguardTeam/AdGuardHome/issues/2257
 			MaxGoroutines: 300,
+
+			ShutdownGraceSeconds: 5,
+
+			MalformedResponseRetries: 2,
 		},
 		FilteringEnabled:           true, // whether or not use filter lists
 		FiltersUpdateIntervalHours: 24,
+		WhoisRatelimit:             30,
 	},
 	TLS: tlsConfigSettings{
 		PortHTTPS:       443,
@@ -157,7 +236,8 @@ var config = configuration{
 		LogMaxSize:    100,
 		LogMaxAge:     3,
 	},
-	SchemaVersion: currentSchemaVersion,
+	ClientsIdentificationOrder: defaultClientIDOrder,
+	SchemaVersion:              currentSchemaVersion,
 }
 
 // initConfig initializes default configuration for the current OS&ARCH
@@ -175,7 +255,9 @@ func initConfig() {
 	config.DNS.DnsfilterConf.ParentalCacheSize = 1 * 1024 * 1024
 	config.DNS.DnsfilterConf.CacheTime = 30
 	config.Filters = defaultFilters()
+	config.DNS.RecommendedFiltersURL = defaultRecommendedFiltersURL
 
+	config.DHCP.LocalDomainName = "lan"
 	config.DHCP.Conf4.LeaseDuration = 86400
 	config.DHCP.Conf4.ICMPTimeout = 1000
 	config.DHCP.Conf6.LeaseDuration = 86400
@@ -234,6 +316,24 @@ func parseConfig() error {
 		config.DNS.FiltersUpdateIntervalHours = 24
 	}
 
+	err = validateClientIDOrder(config.ClientsIdentificationOrder)
+	if err != nil {
+		log.Error("Invalid clients_identification_order: %s", err)
+		return err
+	}
+
+	err = dnsfilter.ValidateEtcHostsDuplicates(config.DNS.DnsfilterConf.EtcHostsDuplicates)
+	if err != nil {
+		log.Error("Invalid etc_hosts_duplicates: %s", err)
+		return err
+	}
+
+	err = dnsfilter.ValidateYouTubeRestrictLevel(config.DNS.DnsfilterConf.YouTubeRestrictLevel)
+	if err != nil {
+		log.Error("Invalid youtube_restrict_level: %s", err)
+		return err
+	}
+
 	return nil
 }
 
@@ -254,6 +354,12 @@ func readConfigFile() ([]byte, error) {
 
 // Saves configuration to the YAML file and also saves the user filter contents to a file
 func (c *configuration) write() error {
+	if Context.safeMode {
+		log.Debug("safe mode: not writing the configuration file")
+
+		return nil
+	}
+
 	c.Lock()
 	defer c.Unlock()
 
@@ -281,6 +387,10 @@ func (c *configuration) write() error {
 		config.DNS.QueryLogFileEnabled = dc.FileEnabled
 		config.DNS.QueryLogInterval = dc.Interval
 		config.DNS.QueryLogMemSize = dc.MemSize
+		config.DNS.QueryLogAllowedSampleRate = dc.AllowedSampleRate
+		config.DNS.QueryLogAllowedCountOnly = dc.AllowedCountOnly
+		config.DNS.QueryLogDedupBlockedSeconds = dc.DedupBlockedSeconds
+		config.DNS.QueryLogVerbose = dc.Verbose
 		config.DNS.AnonymizeClientIP = dc.AnonymizeClientIP
 	}
 
@@ -310,7 +420,13 @@ func (c *configuration) write() error {
 		log.Error("Couldn't generate YAML file: %s", err)
 		return err
 	}
-	err = file.SafeWrite(configFile, yamlText)
+	if hasFilterHeaders(config.Filters, config.WhitelistFilters) {
+		// The headers of the filter lists usually contain secrets,
+		// so only the owner may read the file.
+		err = safeWritePrivate(configFile, yamlText)
+	} else {
+		err = file.SafeWrite(configFile, yamlText)
+	}
 	if err != nil {
 		log.Error("Couldn't save YAML config: %s", err)
 		return err
@@ -318,3 +434,37 @@ func (c *configuration) write() error {
 
 	return nil
 }
+
+// safeWritePrivate is like file.SafeWrite, but the written file is only
+// readable and writable by its owner, including while it's being written.
+func safeWritePrivate(path string, data []byte) (err error) {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	// The temporary file may be left from a previous write with other
+	// permissions.
+	err = f.Chmod(0o600)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(tmpPath)
+
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,150 @@
+package home
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// errConnLimit is returned to the TLS clients which connections are rejected
+// because there are too many open connections.
+const errConnLimit agherr.Error = "too many connections"
+
+// connRejectTimeout is the time given to a rejected client to send its
+// ClientHello and receive the TLS alert.
+const connRejectTimeout = 1 * time.Second
+
+// rejectedCounter is the number of the connections rejected by the listeners
+// by their names.  It's safe for concurrent use.
+type rejectedCounter struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+// inc increments the number of connections rejected by the listener named
+// name and returns the new value.
+func (c *rejectedCounter) inc(name string) (n uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.counts[name]++
+
+	return c.counts[name]
+}
+
+// get returns the number of connections rejected by the listener named name.
+func (c *rejectedCounter) get(name string) (n uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.counts[name]
+}
+
+// write writes the counters to w in the Prometheus text exposition format.
+func (c *rejectedCounter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, 0, len(c.counts))
+	for name := range c.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const metric = "adguard_home_conns_rejected_total"
+	_, _ = fmt.Fprintf(w, "# HELP %s The number of the connections rejected because of the connection limit.\n", metric)
+	_, _ = fmt.Fprintf(w, "# TYPE %s counter\n", metric)
+	for _, name := range names {
+		_, _ = fmt.Fprintf(w, "%s{listener=%q} %d\n", metric, name, c.counts[name])
+	}
+}
+
+// connsRejected is the number of the connections rejected because of the
+// connection limit.  It survives the restarts of the listeners.
+var connsRejected = &rejectedCounter{counts: map[string]uint64{}}
+
+// connLimitListener is a net.Listener which limits the number of the
+// concurrently open TLS connections.  The connections exceeding the limit are
+// rejected with a TLS alert, so that the clients see a clean close instead of
+// a reset.
+type connLimitListener struct {
+	net.Listener
+
+	// slots has a value for each open connection.
+	slots chan struct{}
+
+	// name is the name of the listener used in the logs and in
+	// connsRejected.
+	name string
+}
+
+// newConnLimitListener returns l limited to max concurrently open connections.
+// If max is zero, l is returned as is.
+func newConnLimitListener(l net.Listener, name string, max uint32) (ll net.Listener) {
+	if max == 0 {
+		return l
+	}
+
+	return &connLimitListener{
+		Listener: l,
+		slots:    make(chan struct{}, max),
+		name:     name,
+	}
+}
+
+// Accept implements the net.Listener interface for *connLimitListener.
+func (l *connLimitListener) Accept() (c net.Conn, err error) {
+	for {
+		c, err = l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case l.slots <- struct{}{}:
+			return &limitedConn{Conn: c, slots: l.slots}, nil
+		default:
+			n := connsRejected.inc(l.name)
+			log.Debug("%s: too many connections, rejecting %s, %d rejected so far", l.name, c.RemoteAddr(), n)
+
+			go rejectTLS(c)
+		}
+	}
+}
+
+// rejectTLS rejects the TLS handshake of c with an alert and closes it.
+func rejectTLS(c net.Conn) {
+	tc := tls.Server(c, &tls.Config{
+		GetConfigForClient: func(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+			return nil, errConnLimit
+		},
+	})
+
+	_ = tc.SetDeadline(time.Now().Add(connRejectTimeout))
+	_ = tc.Handshake()
+	_ = tc.Close()
+}
+
+// limitedConn is a connection accepted by connLimitListener.  It frees its slot
+// when it's closed.
+type limitedConn struct {
+	net.Conn
+
+	slots chan struct{}
+	once  sync.Once
+}
+
+// Close implements the net.Conn interface for *limitedConn.
+func (c *limitedConn) Close() (err error) {
+	err = c.Conn.Close()
+	c.once.Do(func() { <-c.slots })
+
+	return err
+}
@@ -0,0 +1,83 @@
+package home
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnLimitListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	ll := newConnLimitListener(l, "test", 1)
+	t.Cleanup(func() { _ = ll.Close() })
+
+	accepted := make(chan net.Conn)
+	go func() {
+		defer close(accepted)
+
+		for {
+			c, aerr := ll.Accept()
+			if aerr != nil {
+				return
+			}
+
+			accepted <- c
+		}
+	}()
+
+	addr := l.Addr().String()
+	accept := func(t *testing.T) (c net.Conn) {
+		t.Helper()
+
+		select {
+		case c = <-accepted:
+			return c
+		case <-time.After(time.Second):
+			assert.FailNow(t, "connection not accepted")
+
+			return nil
+		}
+	}
+
+	first, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = first.Close() })
+	srvFirst := accept(t)
+
+	before := connsRejected.get("test")
+
+	// The connection exceeding the limit is rejected with a TLS alert.
+	_, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "internal error")
+	}
+	assert.Equal(t, before+1, connsRejected.get("test"))
+
+	// Closing the first connection frees its slot.
+	assert.Nil(t, srvFirst.Close())
+	// Closing it again doesn't free another one.
+	_ = srvFirst.Close()
+
+	second, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = second.Close() })
+	srvSecond := accept(t)
+	t.Cleanup(func() { _ = srvSecond.Close() })
+
+	_, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	assert.NotNil(t, err)
+	assert.Equal(t, before+2, connsRejected.get("test"))
+}
+
+func TestNewConnLimitListener_noLimit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	assert.Same(t, l, newConnLimitListener(l, "test", 0))
+}
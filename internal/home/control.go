@@ -56,6 +56,18 @@ type statusResponse struct {
 	IsRunning       bool   `json:"running"`
 	Version         string `json:"version"`
 	Language        string `json:"language"`
+
+	// SelfTest is the result of the last filtering self-test.  It is nil
+	// if there were none.
+	SelfTest *selfTestResult `json:"self_test,omitempty"`
+
+	// SafeMode is true if the configuration can't be changed with the HTTP
+	// API.
+	SafeMode bool `json:"safe_mode"`
+
+	// FilteringDegraded is true if the filtering is enabled, but the
+	// blocklists have no rules.  See dnsfilter.DNSFilter.Degraded.
+	FilteringDegraded bool `json:"filtering_degraded"`
 }
 
 func handleStatus(w http.ResponseWriter, _ *http.Request) {
@@ -66,6 +78,12 @@ func handleStatus(w http.ResponseWriter, _ *http.Request) {
 		IsRunning: isRunning(),
 		Version:   version.Version(),
 		Language:  config.Language,
+		SelfTest:  Context.selfTest.result(),
+		SafeMode:  Context.safeMode,
+	}
+
+	if config.DNS.FilteringEnabled && Context.dnsFilter != nil {
+		resp.FilteringDegraded = Context.dnsFilter.Degraded()
 	}
 
 	var c *dnsforward.FilteringConfig
@@ -115,6 +133,8 @@ func registerControlHandlers() {
 	Context.mux.HandleFunc("/control/version.json", postInstall(optionalAuth(handleGetVersionJSON)))
 	httpRegister(http.MethodPost, "/control/update", handleUpdate)
 	httpRegister(http.MethodGet, "/control/profile", handleGetProfile)
+	httpRegister(http.MethodGet, "/control/diagnostics", handleDiagnostics)
+	httpRegister(http.MethodGet, "/metrics", handleMetrics)
 
 	// No auth is necessary for DOH/DOT configurations
 	Context.mux.HandleFunc("/apple/doh.mobileconfig", postInstall(handleMobileConfigDOH))
@@ -129,6 +149,7 @@ func httpRegister(method, url string, handler func(http.ResponseWriter, *http.Re
 		return
 	}
 
+	handler = safeMode(method, url, handler)
 	Context.mux.Handle(url, postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureHandler(method, handler)))))
 }
 
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/internal/util"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
@@ -35,9 +36,14 @@ func isValidURL(rawurl string) bool {
 }
 
 type filterAddJSON struct {
-	Name      string `json:"name"`
-	URL       string `json:"url"`
-	Whitelist bool   `json:"whitelist"`
+	Name       string   `json:"name"`
+	URL        string   `json:"url"`
+	Categories []string `json:"categories,omitempty"`
+	Whitelist  bool     `json:"whitelist"`
+
+	// Headers are the additional HTTP headers sent when downloading the
+	// list.  See filter.Headers.
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
 func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
@@ -53,6 +59,18 @@ func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	err = validateFilterCategories(fj.Categories)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	err = validateFilterHeaders(fj.Headers)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
 	// Check for duplicates
 	if filterExists(fj.URL) {
 		httpError(w, http.StatusBadRequest, "Filter URL already added -- %s", fj.URL)
@@ -67,6 +85,8 @@ func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request
 		white:   fj.Whitelist,
 	}
 	filt.ID = assignUniqueFilterID()
+	filt.Categories = fj.Categories
+	filt.Headers = fj.Headers
 
 	// Download the filter contents
 	ok, err := f.update(&filt)
@@ -152,6 +172,17 @@ type filterURLJSON struct {
 	Name    string `json:"name"`
 	URL     string `json:"url"`
 	Enabled bool   `json:"enabled"`
+
+	// UpdatePaused is nil if the update-paused state shouldn't be changed.
+	UpdatePaused *bool `json:"update_paused,omitempty"`
+
+	// Categories are nil if the categories shouldn't be changed.  An empty
+	// array removes the list from all categories.
+	Categories []string `json:"categories,omitempty"`
+
+	// Headers are nil if the headers shouldn't be changed.  An empty object
+	// removes all headers.
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
 type filterURLReq struct {
@@ -173,12 +204,26 @@ func (f *Filtering) handleFilteringSetURL(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	err = validateFilterCategories(fj.Data.Categories)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	err = validateFilterHeaders(fj.Data.Headers)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
 	filt := filter{
 		Enabled: fj.Data.Enabled,
 		Name:    fj.Data.Name,
 		URL:     fj.Data.URL,
 	}
-	status := f.filterSetProperties(fj.URL, filt, fj.Whitelist)
+	filt.Categories = fj.Data.Categories
+	filt.Headers = fj.Data.Headers
+	status := f.filterSetProperties(fj.URL, filt, fj.Whitelist, fj.Data.UpdatePaused)
 	if (status & statusFound) == 0 {
 		http.Error(w, "URL doesn't exist", http.StatusBadRequest)
 		return
@@ -200,7 +245,7 @@ func (f *Filtering) handleFilteringSetURL(w http.ResponseWriter, r *http.Request
 		if fj.Whitelist {
 			flags = filterRefreshAllowlists
 		}
-		nUpdated, _ := f.refreshFilters(flags, true)
+		nUpdated, _, _ := f.refreshFilters(flags, 0, true)
 		// if at least 1 filter has been updated, refreshFilters() restarts the filtering automatically
 		// if not - we restart the filtering ourselves
 		restart = false
@@ -229,9 +274,12 @@ func (f *Filtering) handleFilteringSetRules(w http.ResponseWriter, r *http.Reque
 func (f *Filtering) handleFilteringRefresh(w http.ResponseWriter, r *http.Request) {
 	type Req struct {
 		White bool `json:"whitelist"`
+		// ID, if not zero, is the ID of the only filter to refresh.
+		ID int64 `json:"id"`
 	}
 	type Resp struct {
-		Updated int `json:"updated"`
+		Updated int                   `json:"updated"`
+		Results []filterRefreshResult `json:"results"`
 	}
 	resp := Resp{}
 	var err error
@@ -248,7 +296,7 @@ func (f *Filtering) handleFilteringRefresh(w http.ResponseWriter, r *http.Reques
 	if req.White {
 		flags = filterRefreshAllowlists
 	}
-	resp.Updated, err = f.refreshFilters(flags|filterRefreshForce, false)
+	resp.Updated, resp.Results, err = f.refreshFilters(flags|filterRefreshForce, req.ID, false)
 	Context.controlLock.Lock()
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "%s", err)
@@ -265,12 +313,18 @@ func (f *Filtering) handleFilteringRefresh(w http.ResponseWriter, r *http.Reques
 }
 
 type filterJSON struct {
-	ID          int64  `json:"id"`
-	Enabled     bool   `json:"enabled"`
-	URL         string `json:"url"`
-	Name        string `json:"name"`
-	RulesCount  uint32 `json:"rules_count"`
-	LastUpdated string `json:"last_updated"`
+	ID           int64    `json:"id"`
+	Enabled      bool     `json:"enabled"`
+	URL          string   `json:"url"`
+	Name         string   `json:"name"`
+	RulesCount   uint32   `json:"rules_count"`
+	LastUpdated  string   `json:"last_updated"`
+	UpdatePaused bool     `json:"update_paused"`
+	Categories   []string `json:"categories,omitempty"`
+
+	// Headers are the names of the additional HTTP headers sent when
+	// downloading the list.  The values are never returned.
+	Headers []string `json:"headers,omitempty"`
 }
 
 type filteringConfig struct {
@@ -279,15 +333,26 @@ type filteringConfig struct {
 	Filters          []filterJSON `json:"filters"`
 	WhitelistFilters []filterJSON `json:"whitelist_filters"`
 	UserRules        []string     `json:"user_rules"`
+
+	// UserRulesMeta is the metadata of the custom filtering rules which
+	// have it.  It's ignored in requests.
+	UserRulesMeta []userRuleMeta `json:"user_rules_meta,omitempty"`
+
+	// TempAllowed are the domains allowlisted temporarily.  It's ignored
+	// in requests.
+	TempAllowed []tempAllowJSON `json:"temp_allowed,omitempty"`
 }
 
 func filterToJSON(f filter) filterJSON {
 	fj := filterJSON{
-		ID:         f.ID,
-		Enabled:    f.Enabled,
-		URL:        f.URL,
-		Name:       f.Name,
-		RulesCount: uint32(f.RulesCount),
+		ID:           f.ID,
+		Enabled:      f.Enabled,
+		URL:          f.URL,
+		Name:         f.Name,
+		RulesCount:   uint32(f.RulesCount),
+		UpdatePaused: f.UpdatePaused,
+		Categories:   f.Categories,
+		Headers:      filterHeaderNames(f.Headers),
 	}
 
 	if !f.LastUpdated.IsZero() {
@@ -312,6 +377,8 @@ func (f *Filtering) handleFilteringStatus(w http.ResponseWriter, r *http.Request
 		resp.WhitelistFilters = append(resp.WhitelistFilters, fj)
 	}
 	resp.UserRules = config.UserRules
+	_, resp.UserRulesMeta = scanUserRules(config.UserRules, time.Now())
+	resp.TempAllowed = f.tempAllow.domains(time.Now())
 	config.RUnlock()
 
 	jsonVal, err := json.Marshal(resp)
@@ -347,8 +414,9 @@ func (f *Filtering) handleFilteringConfig(w http.ResponseWriter, r *http.Request
 }
 
 type checkHostRespRule struct {
-	FilterListID int64  `json:"filter_list_id"`
-	Text         string `json:"text"`
+	FilterListID   int64  `json:"filter_list_id"`
+	FilterListName string `json:"filter_list_name,omitempty"`
+	Text           string `json:"text"`
 }
 
 type checkHostResp struct {
@@ -366,6 +434,10 @@ type checkHostResp struct {
 
 	Rules []*checkHostRespRule `json:"rules"`
 
+	// AllRules are all matching rules from the filter lists.  They're only
+	// set if the return_all_matches setting is enabled.
+	AllRules []*checkHostRespRule `json:"all_rules,omitempty"`
+
 	// for FilteredBlockedService:
 	SvcName string `json:"service_name"`
 
@@ -381,7 +453,7 @@ func (f *Filtering) handleCheckHost(w http.ResponseWriter, r *http.Request) {
 	setts := Context.dnsFilter.GetConfig()
 	setts.FilteringEnabled = true
 	Context.dnsFilter.ApplyBlockedServices(&setts, nil, true)
-	result, err := Context.dnsFilter.CheckHost(host, dns.TypeA, &setts)
+	result, err := Context.dnsFilter.CheckHostContext(r.Context(), host, dns.TypeA, &setts)
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "couldn't apply filtering: %s: %s", host, err)
 		return
@@ -398,23 +470,117 @@ func (f *Filtering) handleCheckHost(w http.ResponseWriter, r *http.Request) {
 		resp.Rule = result.Rules[0].Text
 	}
 
-	resp.Rules = make([]*checkHostRespRule, len(result.Rules))
-	for i, r := range result.Rules {
-		resp.Rules[i] = &checkHostRespRule{
-			FilterListID: r.FilterListID,
-			Text:         r.Text,
+	resp.Rules = toCheckHostRespRules(result.Rules)
+	if len(result.AllRules) > 0 {
+		resp.AllRules = toCheckHostRespRules(result.AllRules)
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// toCheckHostRespRules converts the rules of the filtering result into the
+// rules of the host checking response.
+func toCheckHostRespRules(rules []*dnsfilter.ResultRule) (respRules []*checkHostRespRule) {
+	respRules = make([]*checkHostRespRule, len(rules))
+	for i, r := range rules {
+		respRules[i] = &checkHostRespRule{
+			FilterListID:   r.FilterListID,
+			FilterListName: r.FilterListName,
+			Text:           r.Text,
 		}
 	}
 
+	return respRules
+}
+
+// filterSource is a filter list which has rules matching a host.
+type filterSource struct {
+	ID        int64    `json:"id"`
+	Name      string   `json:"name"`
+	URL       string   `json:"url"`
+	Whitelist bool     `json:"whitelist"`
+	Rules     []string `json:"rules"`
+}
+
+// handleFilteringSources responds with all filter lists which have rules
+// matching the host along with those rules.  Unlike handleCheckHost, it
+// doesn't stop at the first matching rule.
+func (f *Filtering) handleFilteringSources(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		httpError(w, http.StatusBadRequest, "host is required")
+
+		return
+	}
+
+	matched := Context.dnsFilter.MatchAllRules(host)
+
+	sources := []*filterSource{}
+	byID := map[int64]*filterSource{}
+
+	config.RLock()
+	for _, rule := range matched {
+		src, ok := byID[rule.FilterListID]
+		if !ok {
+			src = newFilterSourceLocked(rule.FilterListID)
+			byID[rule.FilterListID] = src
+			sources = append(sources, src)
+		}
+
+		src.Rules = append(src.Rules, rule.Text)
+	}
+	config.RUnlock()
+
+	resp := struct {
+		Sources []*filterSource `json:"sources"`
+	}{
+		Sources: sources,
+	}
+
 	js, err := json.Marshal(resp)
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+
 		return
 	}
+
 	w.Header().Set("Content-Type", "application/json")
 	_, _ = w.Write(js)
 }
 
+// newFilterSourceLocked returns a filterSource for the filter list with the
+// ID id filled with the properties of the list.  The ID of the user rules is
+// zero.  config must be locked.
+func newFilterSourceLocked(id int64) (src *filterSource) {
+	src = &filterSource{
+		ID: id,
+	}
+
+	for _, fl := range config.Filters {
+		if fl.ID == id {
+			src.Name, src.URL = fl.Name, fl.URL
+
+			return src
+		}
+	}
+
+	for _, fl := range config.WhitelistFilters {
+		if fl.ID == id {
+			src.Name, src.URL, src.Whitelist = fl.Name, fl.URL, true
+
+			return src
+		}
+	}
+
+	return src
+}
+
 // RegisterFilteringHandlers - register handlers
 func (f *Filtering) RegisterFilteringHandlers() {
 	httpRegister("GET", "/control/filtering/status", f.handleFilteringStatus)
@@ -425,6 +591,11 @@ func (f *Filtering) RegisterFilteringHandlers() {
 	httpRegister("POST", "/control/filtering/refresh", f.handleFilteringRefresh)
 	httpRegister("POST", "/control/filtering/set_rules", f.handleFilteringSetRules)
 	httpRegister("GET", "/control/filtering/check_host", f.handleCheckHost)
+	httpRegister("POST", "/control/filtering/sources", f.handleFilteringSources)
+	httpRegister("POST", "/control/filtering/temp_allow", f.handleFilteringTempAllow)
+	httpRegister("GET", "/control/filtering/categories", f.handleFilteringCategories)
+	httpRegister("POST", "/control/filtering/categories/set", f.handleFilteringCategoriesSet)
+	httpRegister("POST", "/control/filtering/add_recommended", f.handleFilteringAddRecommended)
 }
 
 func checkFiltersUpdateIntervalHours(i uint32) bool {
@@ -0,0 +1,302 @@
+package home
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"github.com/AdguardTeam/AdGuardHome/internal/version"
+	"github.com/AdguardTeam/golibs/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// maxDiagnosticsLogSize is the maximum size of the tail of the log file
+// included into the diagnostics bundle.
+const maxDiagnosticsLogSize = 1 << 20
+
+// diagnosticsRedacted replaces the values of the secrets in the diagnostics
+// bundle.
+const diagnosticsRedacted = "<redacted>"
+
+// diagnosticsSecretKeys are the keys of the configuration file values of
+// which are redacted in the diagnostics bundle.
+var diagnosticsSecretKeys = map[string]bool{
+	"headers":     true,
+	"http_proxy":  true,
+	"password":    true,
+	"private_key": true,
+}
+
+// diagnosticsURLKeys are the keys of the configuration file values of which
+// contain URLs, such as the upstream servers and the filter lists, the paths
+// and the queries of which are redacted in the diagnostics bundle.
+var diagnosticsURLKeys = map[string]bool{
+	"bootstrap_dns":                true,
+	"interface_upstreams":          true,
+	"qname_minimization_upstreams": true,
+	"recommended_filters_url":      true,
+	"upstream":                     true,
+	"upstream_dns":                 true,
+	"upstream_qtypes_fallback_dns": true,
+	"upstreams":                    true,
+	"url":                          true,
+	"via_upstreams":                true,
+}
+
+// urlRe matches the HTTP and HTTPS URLs, like the DoH URLs and the URLs of the
+// filter lists.  Their user information, paths, and queries may contain the
+// tokens of the users, like "https://dns.example/token".  The first submatch
+// is the scheme, the second one is the user information, the third one is the
+// host, and the fourth one is the path with the query.
+var urlRe = regexp.MustCompile(`(https?://)([^@/?\s"']*@)?([^/?\s"']+)([/?][^\s"']*)?`)
+
+// redactURLs replaces the user information, the paths, and the queries of the
+// HTTP and HTTPS URLs in data with diagnosticsRedacted.
+func redactURLs(data []byte) (redacted []byte) {
+	return urlRe.ReplaceAllFunc(data, func(u []byte) (r []byte) {
+		m := urlRe.FindSubmatch(u)
+		if len(m[2]) == 0 && len(m[4]) == 0 {
+			return u
+		}
+
+		r = append(r, m[1]...)
+		if len(m[2]) != 0 {
+			r = append(r, diagnosticsRedacted+"@"...)
+		}
+
+		r = append(r, m[3]...)
+		if len(m[4]) != 0 {
+			r = append(r, "/"+diagnosticsRedacted...)
+		}
+
+		return r
+	})
+}
+
+// redactURLValues returns v, which is a value of diagnosticsURLKeys, with the
+// URLs redacted.
+func redactURLValues(v interface{}) (redacted interface{}) {
+	switch v := v.(type) {
+	case string:
+		return string(redactURLs([]byte(v)))
+	case map[interface{}]interface{}:
+		for k, val := range v {
+			v[k] = redactURLValues(val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = redactURLValues(val)
+		}
+	default:
+		// Go on.
+	}
+
+	return v
+}
+
+// redactSecrets replaces the non-empty values of diagnosticsSecretKeys in v,
+// which is a YAML document decoded into an interface{}, with
+// diagnosticsRedacted.  The URLs in the values of diagnosticsURLKeys are
+// redacted with redactURLs.
+func redactSecrets(v interface{}) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		for k, val := range v {
+			key, _ := k.(string)
+			if diagnosticsSecretKeys[key] && val != nil && val != "" {
+				v[k] = diagnosticsRedacted
+
+				continue
+			} else if diagnosticsURLKeys[key] {
+				v[k] = redactURLValues(val)
+
+				continue
+			}
+
+			redactSecrets(val)
+		}
+	case []interface{}:
+		for _, val := range v {
+			redactSecrets(val)
+		}
+	default:
+		// Go on.
+	}
+}
+
+// diagnosticsConfig returns the current configuration in the YAML format with
+// the secrets redacted.
+func diagnosticsConfig() (data []byte, err error) {
+	config.RLock()
+	data, err = yaml.Marshal(&config)
+	config.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("encoding config: %w", err)
+	}
+
+	var doc interface{}
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("decoding config: %w", err)
+	}
+
+	redactSecrets(doc)
+
+	return yaml.Marshal(doc)
+}
+
+// diagnosticsLog returns at most maxDiagnosticsLogSize last bytes of the log
+// file with the URLs redacted.
+func diagnosticsLog() (data []byte, err error) {
+	if Context.logFilePath == "" {
+		return []byte("The log is not written to a file.\n"), nil
+	}
+
+	f, err := os.Open(Context.logFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("opening log: %w", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("opening log: %w", err)
+	}
+
+	if off := fi.Size() - maxDiagnosticsLogSize; off > 0 {
+		_, err = f.Seek(off, io.SeekStart)
+		if err != nil {
+			return nil, fmt.Errorf("reading log: %w", err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	_, err = io.Copy(buf, io.LimitReader(f, maxDiagnosticsLogSize))
+	if err != nil {
+		return nil, fmt.Errorf("reading log: %w", err)
+	}
+
+	return redactURLs(buf.Bytes()), nil
+}
+
+// diagnosticsFilters returns the status of the filter lists with the URLs
+// redacted.
+func diagnosticsFilters() (data []byte, err error) {
+	resp := filteringConfig{}
+
+	config.RLock()
+	resp.Enabled = config.DNS.FilteringEnabled
+	resp.Interval = config.DNS.FiltersUpdateIntervalHours
+	for _, f := range config.Filters {
+		resp.Filters = append(resp.Filters, filterToJSON(f))
+	}
+	for _, f := range config.WhitelistFilters {
+		resp.WhitelistFilters = append(resp.WhitelistFilters, filterToJSON(f))
+	}
+	config.RUnlock()
+
+	data, err = json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return redactURLs(data), nil
+}
+
+// diagnosticsUpstreams returns the results of the checks of the upstreams with
+// the URLs redacted.
+func diagnosticsUpstreams() (data []byte, err error) {
+	config.RLock()
+	upstreams := append([]string{}, config.DNS.UpstreamDNS...)
+	bootstrap := append([]string{}, config.DNS.BootstrapDNS...)
+	config.RUnlock()
+
+	data, err = json.MarshalIndent(dnsforward.CheckUpstreams(upstreams, bootstrap), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return redactURLs(data), nil
+}
+
+// diagnosticsVersion returns the version and the build information.
+func diagnosticsVersion() (data []byte, err error) {
+	return json.MarshalIndent(map[string]string{
+		"version":    version.Version(),
+		"channel":    version.Channel(),
+		"full":       version.Full(),
+		"go_version": runtime.Version(),
+		"goos":       runtime.GOOS,
+		"goarch":     runtime.GOARCH,
+		"goarm":      version.GOARM(),
+		"gomips":     version.GOMIPS(),
+	}, "", "  ")
+}
+
+// writeDiagnostics writes the diagnostics bundle into w as a ZIP archive.
+func writeDiagnostics(w io.Writer) (err error) {
+	entries := []struct {
+		name string
+		gen  func() ([]byte, error)
+	}{
+		{name: "version.json", gen: diagnosticsVersion},
+		{name: "config.yaml", gen: diagnosticsConfig},
+		{name: "filters.json", gen: diagnosticsFilters},
+		{name: "upstreams.json", gen: diagnosticsUpstreams},
+		{name: "log.txt", gen: diagnosticsLog},
+	}
+
+	zw := zip.NewWriter(w)
+	for _, e := range entries {
+		var data []byte
+		data, err = e.gen()
+		if err != nil {
+			// Include the error instead of the entry, so that the
+			// rest of the bundle is still useful.
+			log.Info("diagnostics: %s: %s", e.name, err)
+			data = []byte(err.Error())
+		}
+
+		var fw io.Writer
+		fw, err = zw.CreateHeader(&zip.FileHeader{
+			Name:     e.name,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			return fmt.Errorf("creating %s: %w", e.name, err)
+		}
+
+		_, err = fw.Write(data)
+		if err != nil {
+			return fmt.Errorf("writing %s: %w", e.name, err)
+		}
+	}
+
+	return zw.Close()
+}
+
+// handleDiagnostics is the handler for the GET /control/diagnostics HTTP API.
+// It responds with a ZIP archive containing the information useful for the
+// bug reports.
+func handleDiagnostics(w http.ResponseWriter, _ *http.Request) {
+	buf := &bytes.Buffer{}
+	err := writeDiagnostics(buf)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "diagnostics: %s", err)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="adguardhome-diagnostics.zip"`)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -36,6 +36,7 @@ func initDNSServer() error {
 		Filename:          filepath.Join(baseDir, "stats.db"),
 		LimitDays:         config.DNS.StatsInterval,
 		AnonymizeClientIP: config.DNS.AnonymizeClientIP,
+		ClientWhois:       Context.clients.WhoisInfo,
 		ConfigModified:    onConfigModified,
 		HTTPRegister:      httpRegister,
 	}
@@ -50,8 +51,13 @@ func initDNSServer() error {
 		Interval:          config.DNS.QueryLogInterval,
 		MemSize:           config.DNS.QueryLogMemSize,
 		AnonymizeClientIP: config.DNS.AnonymizeClientIP,
+		AllowedSampleRate: config.DNS.QueryLogAllowedSampleRate,
+		AllowedCountOnly:  config.DNS.QueryLogAllowedCountOnly,
 		ConfigModified:    onConfigModified,
 		HTTPRegister:      httpRegister,
+
+		DedupBlockedSeconds: config.DNS.QueryLogDedupBlockedSeconds,
+		Verbose:             config.DNS.QueryLogVerbose,
 	}
 	Context.queryLog = querylog.New(conf)
 
@@ -64,7 +70,27 @@ func initDNSServer() error {
 	filterConf.AutoHosts = &Context.autoHosts
 	filterConf.ConfigModified = onConfigModified
 	filterConf.HTTPRegister = httpRegister
+	filterConf.HTTPClient = Context.client
+
+	err = validateLocalDBs(&filterConf)
+	if err != nil {
+		closeDNSServer()
+		return err
+	}
+
 	Context.dnsFilter = dnsfilter.New(&filterConf, nil)
+	if Context.dnsFilter == nil {
+		closeDNSServer()
+		return fmt.Errorf("couldn't initialize filtering, see the log for details")
+	}
+
+	if config.DNS.GeoIPFile != "" {
+		Context.geoIP, err = newGeoIPDB(config.DNS.GeoIPFile)
+		if err != nil {
+			closeDNSServer()
+			return fmt.Errorf("loading geoip database: %w", err)
+		}
+	}
 
 	p := dnsforward.DNSCreateParams{
 		DNSFilter: Context.dnsFilter,
@@ -89,12 +115,47 @@ func initDNSServer() error {
 	}
 
 	Context.rdns = InitRDNS(Context.dnsServer, &Context.clients)
-	Context.whois = initWhois(&Context.clients)
+	Context.whois = nil
+	if config.DNS.WhoisEnabled {
+		Context.whois = initWhois(&Context.clients, Context.ipDetector, config.DNS.WhoisRatelimit)
+	}
 
 	Context.filters.Init()
 	return nil
 }
 
+// validateLocalDBs returns an error if the local hash-prefix databases set in
+// conf can't be read, so that the startup fails with it instead of leaving the
+// filtering uninitialized.
+func validateLocalDBs(conf *dnsfilter.Config) (err error) {
+	for _, db := range []struct {
+		name string
+		path string
+	}{{
+		name: "safebrowsing_local_db",
+		path: conf.SafeBrowsingLocalDB,
+	}, {
+		name: "parental_local_db",
+		path: conf.ParentalLocalDB,
+	}} {
+		if db.path == "" {
+			continue
+		}
+
+		var fi os.FileInfo
+		fi, err = os.Stat(db.path)
+		if err != nil {
+			return fmt.Errorf("checking %s: %w", db.name, err)
+		}
+
+		if fi.IsDir() {
+			return fmt.Errorf("checking %s: %q is a directory", db.name, db.path)
+		}
+	}
+
+	return nil
+}
+
 func isRunning() bool {
 	return Context.dnsServer != nil && Context.dnsServer.IsRunning()
 }
@@ -109,7 +170,7 @@ func onDNSRequest(d *proxy.DNSContext) {
 	if !ip.IsLoopback() {
 		Context.rdns.Begin(ip)
 	}
-	if !Context.ipDetector.detectSpecialNetwork(ip) {
+	if Context.whois != nil {
 		Context.whois.Begin(ip)
 	}
 }
@@ -157,9 +218,18 @@ func generateServerConfig() (newconfig dnsforward.ServerConfig, err error) {
 	newconfig.TLSv12Roots = Context.tlsRoots
 	newconfig.TLSCiphers = Context.tlsCiphers
 	newconfig.TLSAllowUnencryptedDOH = tlsConf.AllowUnencryptedDOH
+	newconfig.LocalDomainName = config.DHCP.LocalDomainName
+	newconfig.QueryLogVerbose = config.DNS.QueryLogVerbose
 
 	newconfig.FilterHandler = applyAdditionalFiltering
 	newconfig.GetCustomUpstreamByClient = Context.clients.FindUpstreams
+	newconfig.GetUDPSizeByClient = Context.clients.FindUDPSize
+	newconfig.GetBlockedTTLByClient = Context.clients.FindBlockedTTL
+	newconfig.GetAllowedQTypesByClient = Context.clients.FindAllowedQTypes
+	newconfig.GetHostnamesByClient = Context.clients.FindHostnames
+	if Context.geoIP != nil {
+		newconfig.GetIPCountry = Context.geoIP.country
+	}
 
 	return newconfig, nil
 }
@@ -201,6 +271,8 @@ func newDNSCrypt(bindHost net.IP, tlsConf tlsConfigSettings) (dnscc dnsforward.D
 		ResolverCert:  cert,
 		ProviderName:  rc.ProviderName,
 		Enabled:       true,
+
+		ResolverConfig: rc,
 	}, nil
 }
 
@@ -293,16 +365,24 @@ func applyAdditionalFiltering(clientAddr net.IP, clientID string, setts *dnsfilt
 
 	setts.ClientIP = clientAddr
 
-	c, ok := Context.clients.Find(clientID)
+	var ecsIP net.IP
+	if setts.ClientSubnet != nil {
+		ecsIP = setts.ClientSubnet.IP
+	}
+
+	c, ok := Context.clients.FindByOrder(clientAddr, clientID, ecsIP)
 	if !ok {
-		c, ok = Context.clients.Find(clientAddr.String())
-		if !ok {
-			return
-		}
+		return
 	}
 
 	log.Debug("using settings for client %s with ip %s and id %q", c.Name, clientAddr, clientID)
 
+	applyClientSettings(c, setts)
+}
+
+// applyClientSettings overrides the global settings in setts with the settings
+// of the persistent client c.
+func applyClientSettings(c *Client, setts *dnsfilter.RequestFilteringSettings) {
 	if c.UseOwnBlockedServices {
 		Context.dnsFilter.ApplyBlockedServices(setts, c.BlockedServices, false)
 	}
@@ -310,6 +390,18 @@ func applyAdditionalFiltering(clientAddr net.IP, clientID string, setts *dnsfilt
 	setts.ClientName = c.Name
 	setts.ClientTags = c.Tags
 
+	for _, name := range c.BypassReasons {
+		// The reasons are validated when the client is added.
+		r, _ := dnsfilter.ParseBypassReason(name)
+		setts.BypassReasons = append(setts.BypassReasons, r)
+	}
+
+	if c.BlockingMode != "" {
+		setts.BlockingMode = c.BlockingMode
+		setts.BlockingIPv4 = c.BlockingIPv4
+		setts.BlockingIPv6 = c.BlockingIPv6
+	}
+
 	if !c.UseOwnSettings {
 		return
 	}
@@ -336,6 +428,7 @@ func startDNSServer() error {
 
 	Context.dnsFilter.Start()
 	Context.filters.Start()
+	Context.selfTest.start()
 	Context.stats.Start()
 	Context.queryLog.Start()
 
@@ -344,7 +437,7 @@ func startDNSServer() error {
 		if !ip.IsLoopback() {
 			Context.rdns.Begin(ip)
 		}
-		if !Context.ipDetector.detectSpecialNetwork(ip) {
+		if Context.whois != nil {
 			Context.whois.Begin(ip)
 		}
 	}
@@ -382,6 +475,9 @@ func stopDNSServer() error {
 }
 
 func closeDNSServer() {
+	// The self-tests use the DNS server, so stop them first.
+	Context.selfTest.stop()
+
 	// DNS forward module must be closed BEFORE stats or queryLog because it depends on them
 	if Context.dnsServer != nil {
 		Context.dnsServer.Close()
@@ -393,6 +489,8 @@ func closeDNSServer() {
 		Context.dnsFilter = nil
 	}
 
+	Context.geoIP = nil
+
 	if Context.stats != nil {
 		Context.stats.Close()
 		Context.stats = nil
@@ -0,0 +1,36 @@
+package home
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateLocalDBs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aghtest")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	db := filepath.Join(dir, "safebrowsing.db")
+	assert.Nil(t, ioutil.WriteFile(db, nil, 0o644))
+
+	assert.Nil(t, validateLocalDBs(&dnsfilter.Config{}))
+	assert.Nil(t, validateLocalDBs(&dnsfilter.Config{SafeBrowsingLocalDB: db}))
+
+	err = validateLocalDBs(&dnsfilter.Config{
+		SafeBrowsingLocalDB: db,
+		ParentalLocalDB:     filepath.Join(dir, "none.db"),
+	})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "parental_local_db")
+	}
+
+	err = validateLocalDBs(&dnsfilter.Config{SafeBrowsingLocalDB: dir})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "is a directory")
+	}
+}
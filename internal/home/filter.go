@@ -2,8 +2,12 @@ package home
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -17,6 +21,7 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/internal/util"
 	"github.com/AdguardTeam/golibs/log"
 )
 
@@ -28,11 +33,16 @@ type Filtering struct {
 	refreshStatus     uint32 // 0:none; 1:in progress
 	refreshLock       sync.Mutex
 	filterTitleRegexp *regexp.Regexp
+
+	// tempAllow are the domains allowlisted temporarily with the
+	// /control/filtering/temp_allow HTTP API.
+	tempAllow tempAllowlist
 }
 
 // Init - initialize the module
 func (f *Filtering) Init() {
 	f.filterTitleRegexp = regexp.MustCompile(`^! Title: +(.*)$`)
+	f.tempAllow.onExpire = func() { enableFiltersChanged(true, []int64{0}) }
 	_ = os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0o755)
 	f.loadFilters(config.Filters)
 	f.loadFilters(config.WhitelistFilters)
@@ -65,12 +75,13 @@ func defaultFilters() []filter {
 
 // field ordering is important -- yaml fields will mirror ordering from here
 type filter struct {
-	Enabled     bool
-	URL         string    // URL or a file path
-	Name        string    `yaml:"name"`
+	Enabled      bool
+	URL          string // URL or a file path
+	Name         string `yaml:"name"`
+	UpdatePaused bool   `yaml:"update_paused"` // don't update, but use the cached rules
+
 	RulesCount  int       `yaml:"-"`
 	LastUpdated time.Time `yaml:"-"`
-	checksum    uint32    // checksum of the file data
 	white       bool
 
 	dnsfilter.Filter `yaml:",inline"`
@@ -82,7 +93,17 @@ func userFilter() filter {
 		// User filter always has constant ID=0
 		Enabled: true,
 	}
-	f.Filter.Data = []byte(strings.Join(config.UserRules, "\n"))
+	now := time.Now()
+	rules := config.UserRules
+	if config.UserRulesDisableExpired {
+		rules, _ = scanUserRules(rules, now)
+	}
+
+	if tempRules := Context.filters.tempAllow.rules(now); len(tempRules) > 0 {
+		rules = append(append([]string{}, rules...), tempRules...)
+	}
+
+	f.Filter.Data = []byte(strings.Join(rules, "\n"))
 	return f
 }
 
@@ -96,7 +117,10 @@ const (
 
 // Update properties for a filter specified by its URL
 // Return status* flags.
-func (f *Filtering) filterSetProperties(url string, newf filter, whitelist bool) int {
+//
+// If updatePaused is nil, the update-paused state isn't changed.  If
+// newf.Categories is nil, the categories aren't changed.
+func (f *Filtering) filterSetProperties(url string, newf filter, whitelist bool, updatePaused *bool) int {
 	r := 0
 	config.Lock()
 	defer config.Unlock()
@@ -115,6 +139,18 @@ func (f *Filtering) filterSetProperties(url string, newf filter, whitelist bool)
 		log.Debug("filter: set properties: %s: {%s %s %v}",
 			filt.URL, newf.Name, newf.URL, newf.Enabled)
 		filt.Name = newf.Name
+		if updatePaused != nil {
+			filt.UpdatePaused = *updatePaused
+		}
+
+		if newf.Categories != nil {
+			filt.Categories = newf.Categories
+		}
+
+		if newf.Headers != nil {
+			filt.Headers = newf.Headers
+			r |= statusUpdateRequired
+		}
 
 		if filt.URL != newf.URL {
 			r |= statusURLChanged | statusUpdateRequired
@@ -122,9 +158,16 @@ func (f *Filtering) filterSetProperties(url string, newf filter, whitelist bool)
 				return statusURLExists
 			}
 			filt.URL = newf.URL
+			if newf.Headers == nil {
+				// Don't send the secrets meant for the previous
+				// URL to the new one.
+				filt.Headers = nil
+			}
 			filt.unload()
 			filt.LastUpdated = time.Time{}
-			filt.checksum = 0
+			filt.ETag = ""
+			filt.LastModified = ""
+			filt.Checksum = ""
 			filt.RulesCount = 0
 		}
 
@@ -138,7 +181,7 @@ func (f *Filtering) filterSetProperties(url string, newf filter, whitelist bool)
 						// This isn't a fatal error,
 						//  because it may occur when someone removes the file from disk.
 						filt.LastUpdated = time.Time{}
-						filt.checksum = 0
+						filt.Checksum = ""
 						filt.RulesCount = 0
 						r |= statusUpdateRequired
 					}
@@ -255,7 +298,7 @@ func (f *Filtering) periodicallyRefreshFilters() {
 		isNetworkErr := false
 		if config.DNS.FiltersUpdateIntervalHours != 0 && atomic.CompareAndSwapUint32(&f.refreshStatus, 0, 1) {
 			f.refreshLock.Lock()
-			_, isNetworkErr = f.refreshFiltersIfNecessary(filterRefreshBlocklists | filterRefreshAllowlists)
+			_, _, isNetworkErr = f.refreshFiltersIfNecessary(filterRefreshBlocklists|filterRefreshAllowlists, 0)
 			f.refreshLock.Unlock()
 			f.refreshStatus = 0
 			if !isNetworkErr {
@@ -276,31 +319,54 @@ func (f *Filtering) periodicallyRefreshFilters() {
 
 // Refresh filters
 // flags: filterRefresh*
+// id: if not zero, only the filter with this ID is refreshed
 // important:
 //  TRUE: ignore the fact that we're currently updating the filters
-func (f *Filtering) refreshFilters(flags int, important bool) (int, error) {
+func (f *Filtering) refreshFilters(flags int, id int64, important bool) (int, []filterRefreshResult, error) {
 	set := atomic.CompareAndSwapUint32(&f.refreshStatus, 0, 1)
 	if !important && !set {
-		return 0, fmt.Errorf("filters update procedure is already running")
+		return 0, nil, fmt.Errorf("filters update procedure is already running")
 	}
 
 	f.refreshLock.Lock()
-	nUpdated, _ := f.refreshFiltersIfNecessary(flags)
+	nUpdated, results, _ := f.refreshFiltersIfNecessary(flags, id)
 	f.refreshLock.Unlock()
 	f.refreshStatus = 0
-	return nUpdated, nil
+	return nUpdated, results, nil
 }
 
-func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []filter, []bool, bool) {
+// Statuses of the filter refresh results.
+const (
+	filterRefreshChanged   = "changed"
+	filterRefreshUnchanged = "unchanged"
+	filterRefreshFailed    = "failed"
+)
+
+// filterRefreshResult is the result of refreshing a single filter.
+type filterRefreshResult struct {
+	ID     int64  `json:"id"`
+	URL    string `json:"url"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool, id int64) (int, []filter, []bool, []filterRefreshResult, bool) {
 	var updateFilters []filter
 	var updateFlags []bool // 'true' if filter data has changed
+	var results []filterRefreshResult
 
 	now := time.Now()
 	config.RLock()
 	for i := range *filters {
 		f := &(*filters)[i] // otherwise we will be operating on a copy
 
-		if !f.Enabled {
+		if !f.Enabled || (id != 0 && f.ID != id) {
+			continue
+		}
+
+		if f.UpdatePaused {
+			log.Debug("filter: updates of filter #%d are paused", f.ID)
+
 			continue
 		}
 
@@ -313,13 +379,16 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 		uf.ID = f.ID
 		uf.URL = f.URL
 		uf.Name = f.Name
-		uf.checksum = f.checksum
+		uf.Checksum = f.Checksum
+		uf.ETag = f.ETag
+		uf.LastModified = f.LastModified
+		uf.Headers = f.Headers
 		updateFilters = append(updateFilters, uf)
 	}
 	config.RUnlock()
 
 	if len(updateFilters) == 0 {
-		return 0, nil, nil, false
+		return 0, nil, nil, nil, false
 	}
 
 	nfail := 0
@@ -327,15 +396,28 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 		uf := &updateFilters[i]
 		updated, err := f.update(uf)
 		updateFlags = append(updateFlags, updated)
+
+		res := filterRefreshResult{
+			ID:     uf.ID,
+			URL:    uf.URL,
+			Status: filterRefreshUnchanged,
+		}
+		if updated {
+			res.Status = filterRefreshChanged
+		}
+		results = append(results, res)
+
 		if err != nil {
 			nfail++
 			log.Printf("Failed to update filter %s: %s\n", uf.URL, err)
+			results[i].Status = filterRefreshFailed
+			results[i].Error = err.Error()
 			continue
 		}
 	}
 
 	if nfail == len(updateFilters) {
-		return 0, nil, nil, true
+		return 0, nil, nil, results, true
 	}
 
 	updateCount := 0
@@ -350,6 +432,8 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 				continue
 			}
 			f.LastUpdated = uf.LastUpdated
+			f.ETag = uf.ETag
+			f.LastModified = uf.LastModified
 			if !updated {
 				continue
 			}
@@ -358,13 +442,13 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 				f.ID, f.RulesCount, uf.RulesCount)
 			f.Name = uf.Name
 			f.RulesCount = uf.RulesCount
-			f.checksum = uf.checksum
+			f.Checksum = uf.Checksum
 			updateCount++
 		}
 		config.Unlock()
 	}
 
-	return updateCount, updateFilters, updateFlags, false
+	return updateCount, updateFilters, updateFlags, results, false
 }
 
 const (
@@ -376,6 +460,7 @@ const (
 // Checks filters updates if necessary
 // If force is true, it ignores the filter.LastUpdated field value
 // flags: filterRefresh*
+// id: if not zero, only the filter with this ID is refreshed
 //
 // Algorithm:
 // . Get the list of filters to be updated
@@ -391,13 +476,15 @@ const (
 //  . dnsfilter activates new filters
 //
 // Return the number of updated filters
+// Return the results of refreshing each filter
 // Return TRUE - there was a network error and nothing could be updated
-func (f *Filtering) refreshFiltersIfNecessary(flags int) (int, bool) {
+func (f *Filtering) refreshFiltersIfNecessary(flags int, id int64) (int, []filterRefreshResult, bool) {
 	log.Debug("Filters: updating...")
 
 	updateCount := 0
 	var updateFilters []filter
 	var updateFlags []bool
+	var results []filterRefreshResult
 	netError := false
 	netErrorW := false
 	force := false
@@ -405,23 +492,32 @@ func (f *Filtering) refreshFiltersIfNecessary(flags int) (int, bool) {
 		force = true
 	}
 	if (flags & filterRefreshBlocklists) != 0 {
-		updateCount, updateFilters, updateFlags, netError = f.refreshFiltersArray(&config.Filters, force)
+		updateCount, updateFilters, updateFlags, results, netError = f.refreshFiltersArray(&config.Filters, force, id)
 	}
 	if (flags & filterRefreshAllowlists) != 0 {
 		updateCountW := 0
 		var updateFiltersW []filter
 		var updateFlagsW []bool
-		updateCountW, updateFiltersW, updateFlagsW, netErrorW = f.refreshFiltersArray(&config.WhitelistFilters, force)
+		var resultsW []filterRefreshResult
+		updateCountW, updateFiltersW, updateFlagsW, resultsW, netErrorW = f.refreshFiltersArray(&config.WhitelistFilters, force, id)
 		updateCount += updateCountW
 		updateFilters = append(updateFilters, updateFiltersW...)
 		updateFlags = append(updateFlags, updateFlagsW...)
+		results = append(results, resultsW...)
 	}
 	if netError && netErrorW {
-		return 0, true
+		return 0, results, true
 	}
 
 	if updateCount != 0 {
-		enableFilters(false)
+		changed := []int64{}
+		for i := range updateFilters {
+			if updateFlags[i] {
+				changed = append(changed, updateFilters[i].ID)
+			}
+		}
+
+		enableFiltersChanged(false, changed)
 
 		for i := range updateFilters {
 			uf := &updateFilters[i]
@@ -434,32 +530,22 @@ func (f *Filtering) refreshFiltersIfNecessary(flags int) (int, bool) {
 	}
 
 	log.Debug("Filters: update finished")
-	return updateCount, false
-}
-
-// Allows printable UTF-8 text with CR, LF, TAB characters
-func isPrintableText(data []byte, len int) bool {
-	for i := 0; i < len; i++ {
-		c := data[i]
-		if (c >= ' ' && c != 0x7f) || c == '\n' || c == '\r' || c == '\t' {
-			continue
-		}
-		return false
-	}
-	return true
+	return updateCount, results, false
 }
 
-// A helper function that parses filter contents and returns a number of rules and a filter name (if there's any)
-func (f *Filtering) parseFilterContents(file io.Reader) (int, uint32, string) {
+// A helper function that parses filter contents and returns a number of rules,
+// the hex-encoded SHA256 checksum of the contents, and a filter name (if
+// there's any)
+func (f *Filtering) parseFilterContents(file io.Reader) (int, string, string) {
 	rulesCount := 0
 	name := ""
 	seenTitle := false
 	r := bufio.NewReader(file)
-	checksum := uint32(0)
+	h := sha256.New()
 
 	for {
 		line, err := r.ReadString('\n')
-		checksum = crc32.Update(checksum, crc32.IEEETable, []byte(line))
+		_, _ = h.Write([]byte(line))
 
 		line = strings.TrimSpace(line)
 		if len(line) == 0 {
@@ -482,7 +568,7 @@ func (f *Filtering) parseFilterContents(file io.Reader) (int, uint32, string) {
 		}
 	}
 
-	return rulesCount, checksum, name
+	return rulesCount, hex.EncodeToString(h.Sum(nil)), name
 }
 
 // Perform upgrade on a filter and update LastUpdated value
@@ -500,7 +586,7 @@ func (f *Filtering) update(filter *filter) (bool, error) {
 
 func (f *Filtering) read(reader io.Reader, tmpFile *os.File, filter *filter) (int, error) {
 	htmlTest := true
-	firstChunk := make([]byte, 4*1024)
+	firstChunk := make([]byte, dnsfilter.FilterHeadSize)
 	firstChunkLen := 0
 	buf := make([]byte, 64*1024)
 	total := 0
@@ -517,13 +603,9 @@ func (f *Filtering) read(reader io.Reader, tmpFile *os.File, filter *filter) (in
 			firstChunkLen += copied
 
 			if firstChunkLen == len(firstChunk) || err == io.EOF {
-				if !isPrintableText(firstChunk, firstChunkLen) {
-					return total, fmt.Errorf("data contains non-printable characters")
-				}
-
-				s := strings.ToLower(string(firstChunk))
-				if strings.Contains(s, "<html") || strings.Contains(s, "<!doctype") {
-					return total, fmt.Errorf("data is HTML, not plain text")
+				verr := dnsfilter.ValidateFilterHead(firstChunk[:firstChunkLen])
+				if verr != nil {
+					return total, verr
 				}
 
 				htmlTest = false
@@ -576,23 +658,48 @@ func (f *Filtering) updateIntl(filter *filter) (updated bool, err error) {
 		}
 		defer f.Close()
 		reader = f
-	} else {
-		resp, err := Context.client.Get(filter.URL)
-		if resp != nil && resp.Body != nil {
-			defer resp.Body.Close()
+	} else if zone, ok := txtFilterZone(filter.URL); ok {
+		if Context.dnsServer == nil {
+			return updated, fmt.Errorf("fetching filter from %s: dns server is not initialized", zone)
 		}
+
+		data, err := fetchTXTFilter(Context.dnsServer.Exchange, zone)
 		if err != nil {
+			log.Printf("Couldn't fetch filter from zone %s, skipping: %s", zone, err)
+			return updated, err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		// Only ask for a conditional update if the cached data is
+		// still there.
+		conditional := util.FileExists(filter.Path())
+		resp, err := dnsfilter.FetchFilter(context.Background(), Context.client, filter.URL, &filter.Filter, conditional)
+		if errors.Is(err, errBootstrap) {
+			log.Printf("Couldn't resolve the host of filter URL %s using bootstrap dns, skipping: %s", filter.URL, err)
+			return updated, err
+		} else if err != nil {
 			log.Printf("Couldn't request filter from URL %s, skipping: %s", filter.URL, err)
 			return updated, err
 		}
+		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("Got status code %d from URL %s, skipping", resp.StatusCode, filter.URL)
-			return updated, fmt.Errorf("got status code != 200: %d", resp.StatusCode)
+		if resp.StatusCode == http.StatusNotModified {
+			log.Tracef("Filter #%d at URL %s hasn't changed, not updating it", filter.ID, filter.URL)
+			return updated, nil
 		}
+
+		filter.ETag = resp.Header.Get("ETag")
+		filter.LastModified = resp.Header.Get("Last-Modified")
 		reader = resp.Body
 	}
 
+	// The lists may be served gzip-compressed, so store the decompressed
+	// contents.
+	reader, err = dnsfilter.NewFilterReader(reader)
+	if err != nil {
+		return updated, err
+	}
+
 	total, err := f.read(reader, tmpFile, filter)
 	if err != nil {
 		return updated, err
@@ -601,8 +708,10 @@ func (f *Filtering) updateIntl(filter *filter) (updated bool, err error) {
 	// Extract filter name and count number of rules
 	_, _ = tmpFile.Seek(0, io.SeekStart)
 	rulesCount, checksum, filterName := f.parseFilterContents(tmpFile)
-	// Check if the filter has been really changed
-	if filter.checksum == checksum {
+	// Check if the filter has been really changed.  The checksum may be
+	// restored from the configuration file, so make sure that the cached
+	// data is still there.
+	if filter.Checksum == checksum && util.FileExists(filter.Path()) {
 		log.Tracef("Filter #%d at URL %s hasn't changed, not updating it", filter.ID, filter.URL)
 		return updated, nil
 	}
@@ -613,7 +722,7 @@ func (f *Filtering) updateIntl(filter *filter) (updated bool, err error) {
 		filter.Name = filterName
 	}
 	filter.RulesCount = rulesCount
-	filter.checksum = checksum
+	filter.Checksum = checksum
 	filterFilePath := filter.Path()
 	log.Printf("Saving filter %d contents to: %s", filter.ID, filterFilePath)
 
@@ -651,7 +760,7 @@ func (f *Filtering) load(filter *filter) error {
 	rulesCount, checksum, _ := f.parseFilterContents(file)
 
 	filter.RulesCount = rulesCount
-	filter.checksum = checksum
+	filter.Checksum = checksum
 	filter.LastUpdated = filter.LastTimeUpdated()
 
 	return nil
@@ -660,7 +769,7 @@ func (f *Filtering) load(filter *filter) error {
 // Clear filter rules
 func (filter *filter) unload() {
 	filter.RulesCount = 0
-	filter.checksum = 0
+	filter.Checksum = ""
 }
 
 // Path to the filter contents
@@ -687,6 +796,14 @@ func (filter *filter) LastTimeUpdated() time.Time {
 }
 
 func enableFilters(async bool) {
+	enableFiltersChanged(async, nil)
+}
+
+// enableFiltersChanged is like enableFilters, but the filtering engines none of
+// which filters have the IDs from changed are kept, see
+// dnsfilter.DNSFilter.UpdateFilters.  If changed is nil, all of them are
+// recreated.
+func enableFiltersChanged(async bool, changed []int64) {
 	var filters []dnsfilter.Filter
 	var whiteFilters []dnsfilter.Filter
 	if config.DNS.FilteringEnabled {
@@ -704,8 +821,11 @@ func enableFilters(async bool) {
 				continue
 			}
 			f := dnsfilter.Filter{
-				ID:       filter.ID,
-				FilePath: filter.Path(),
+				ID:          filter.ID,
+				Name:        filter.Name,
+				FilePath:    filter.Path(),
+				Priority:    filter.Priority,
+				MonitorOnly: filter.MonitorOnly,
 			}
 			filters = append(filters, f)
 		}
@@ -715,11 +835,12 @@ func enableFilters(async bool) {
 			}
 			f := dnsfilter.Filter{
 				ID:       filter.ID,
+				Name:     filter.Name,
 				FilePath: filter.Path(),
 			}
 			whiteFilters = append(whiteFilters, f)
 		}
 	}
 
-	_ = Context.dnsFilter.SetFilters(filters, whiteFilters, async)
+	_ = Context.dnsFilter.UpdateFilters(filters, whiteFilters, changed, async)
 }
@@ -1,13 +1,22 @@
 package home
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -65,3 +74,473 @@ func TestFilters(t *testing.T) {
 	f.unload()
 	_ = os.Remove(f.Path())
 }
+
+func TestFilters_updatePaused(t *testing.T) {
+	l := testStartFilterListener()
+	defer func() { _ = l.Close() }()
+
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.client = &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	Context.filters.Init()
+
+	prevFilters, prevFilteringEnabled := config.Filters, config.DNS.FilteringEnabled
+	defer func() {
+		config.Filters, config.DNS.FilteringEnabled = prevFilters, prevFilteringEnabled
+	}()
+
+	config.Filters = []filter{{
+		Enabled:      true,
+		URL:          fmt.Sprintf("http://127.0.0.1:%d/filters/1.txt", l.Addr().(*net.TCPAddr).Port),
+		UpdatePaused: true,
+		Filter:       dnsfilter.Filter{ID: 1},
+	}}
+	f := &config.Filters[0]
+
+	// The cached content of the list.
+	err := ioutil.WriteFile(f.Path(), []byte("||cached.example^\n"), 0o644)
+	assert.Nil(t, err)
+
+	n, _, _, _, isNetErr := Context.filters.refreshFiltersArray(&config.Filters, true, 0)
+	assert.False(t, isNetErr)
+	assert.Equal(t, 0, n)
+	assert.True(t, f.LastUpdated.IsZero())
+
+	Context.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, nil)
+	defer func() {
+		Context.dnsFilter.Close()
+		Context.dnsFilter = nil
+	}()
+
+	config.DNS.FilteringEnabled = true
+	enableFilters(false)
+
+	setts := &dnsfilter.RequestFilteringSettings{
+		FilteringEnabled: true,
+	}
+	res, err := Context.dnsFilter.CheckHost("cached.example", dns.TypeA, setts)
+	assert.Nil(t, err)
+	assert.True(t, res.IsFiltered)
+
+	f.UpdatePaused = false
+	n, _, _, _, isNetErr = Context.filters.refreshFiltersArray(&config.Filters, true, 0)
+	assert.False(t, isNetErr)
+	assert.Equal(t, 1, n)
+	assert.False(t, f.LastUpdated.IsZero())
+	assert.Equal(t, 3, f.RulesCount)
+}
+
+func TestFilters_conditionalUpdate(t *testing.T) {
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	const content = "||plain.example^\n"
+
+	var notModifiedN, plainN uint32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/last-modified.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", lastModified)
+		if r.Header.Get("If-Modified-Since") == lastModified {
+			atomic.AddUint32(&notModifiedN, 1)
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		_, _ = w.Write([]byte("||last-modified.example^\n"))
+	})
+	mux.HandleFunc("/plain.txt", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&plainN, 1)
+		_, _ = w.Write([]byte(content))
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() { _ = http.Serve(l, mux) }()
+	defer func() { _ = l.Close() }()
+
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.client = &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	Context.filters.Init()
+
+	base := "http://" + l.Addr().String()
+
+	t.Run("not_modified", func(t *testing.T) {
+		f := filter{
+			URL:    base + "/last-modified.txt",
+			Filter: dnsfilter.Filter{ID: 1},
+		}
+
+		ok, uerr := Context.filters.update(&f)
+		assert.Nil(t, uerr)
+		assert.True(t, ok)
+		assert.Equal(t, lastModified, f.LastModified)
+
+		ok, uerr = Context.filters.update(&f)
+		assert.Nil(t, uerr)
+		assert.False(t, ok)
+		assert.Equal(t, uint32(1), atomic.LoadUint32(&notModifiedN))
+
+		// The validators restored from the configuration file are used
+		// as well.
+		restored := filter{
+			URL:    f.URL,
+			Filter: f.Filter,
+		}
+		ok, uerr = Context.filters.update(&restored)
+		assert.Nil(t, uerr)
+		assert.False(t, ok)
+		assert.Equal(t, uint32(2), atomic.LoadUint32(&notModifiedN))
+
+		// But not if the cached data is gone.
+		assert.Nil(t, os.Remove(f.Path()))
+		ok, uerr = Context.filters.update(&restored)
+		assert.Nil(t, uerr)
+		assert.True(t, ok)
+		assert.Equal(t, uint32(2), atomic.LoadUint32(&notModifiedN))
+	})
+
+	t.Run("same_checksum", func(t *testing.T) {
+		f := filter{
+			URL:    base + "/plain.txt",
+			Filter: dnsfilter.Filter{ID: 2},
+		}
+
+		ok, uerr := Context.filters.update(&f)
+		assert.Nil(t, uerr)
+		assert.True(t, ok)
+
+		sum := sha256.Sum256([]byte(content))
+		assert.Equal(t, hex.EncodeToString(sum[:]), f.Checksum)
+		assert.Empty(t, f.ETag)
+		assert.Empty(t, f.LastModified)
+
+		ok, uerr = Context.filters.update(&f)
+		assert.Nil(t, uerr)
+		assert.False(t, ok)
+		assert.Equal(t, uint32(2), atomic.LoadUint32(&plainN))
+	})
+}
+
+func TestFiltering_handleFilteringRefresh(t *testing.T) {
+	const etag = `"v1"`
+
+	var changedN, notModifiedN uint32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/changed.txt", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddUint32(&changedN, 1)
+		_, _ = fmt.Fprintf(w, "||changed-%d.example^\n", n)
+	})
+	mux.HandleFunc("/etag.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddUint32(&notModifiedN, 1)
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		_, _ = w.Write([]byte("||etag.example^\n"))
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() { _ = http.Serve(l, mux) }()
+	defer func() { _ = l.Close() }()
+
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.client = &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	Context.filters.Init()
+	Context.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, nil)
+	defer func() {
+		Context.dnsFilter.Close()
+		Context.dnsFilter = nil
+	}()
+
+	prevFilters := config.Filters
+	defer func() { config.Filters = prevFilters }()
+
+	base := "http://" + l.Addr().String()
+	config.Filters = []filter{{
+		Enabled: true,
+		URL:     base + "/changed.txt",
+		Filter:  dnsfilter.Filter{ID: 1},
+	}, {
+		Enabled: true,
+		URL:     base + "/etag.txt",
+		Filter:  dnsfilter.Filter{ID: 2},
+	}}
+
+	refresh := func(body string) (updated int, results []filterRefreshResult) {
+		r := httptest.NewRequest(http.MethodPost, "/control/filtering/refresh", strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		Context.controlLock.Lock()
+		Context.filters.handleFilteringRefresh(w, r)
+		Context.controlLock.Unlock()
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		resp := struct {
+			Updated int                   `json:"updated"`
+			Results []filterRefreshResult `json:"results"`
+		}{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+
+		return resp.Updated, resp.Results
+	}
+
+	// The first download of both lists.
+	updated, results := refresh(`{}`)
+	assert.Equal(t, 2, updated)
+	assert.Equal(t, []filterRefreshResult{{
+		ID:     1,
+		URL:    base + "/changed.txt",
+		Status: filterRefreshChanged,
+	}, {
+		ID:     2,
+		URL:    base + "/etag.txt",
+		Status: filterRefreshChanged,
+	}}, results)
+	assert.Equal(t, etag, config.Filters[1].ETag)
+
+	// The changed list is updated while the other one is not even
+	// downloaded again.
+	updated, results = refresh(`{}`)
+	assert.Equal(t, 1, updated)
+	assert.Equal(t, []filterRefreshResult{{
+		ID:     1,
+		URL:    base + "/changed.txt",
+		Status: filterRefreshChanged,
+	}, {
+		ID:     2,
+		URL:    base + "/etag.txt",
+		Status: filterRefreshUnchanged,
+	}}, results)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&notModifiedN))
+
+	// Refresh of a single list.
+	updated, results = refresh(`{"id":2}`)
+	assert.Equal(t, 0, updated)
+	assert.Equal(t, []filterRefreshResult{{
+		ID:     2,
+		URL:    base + "/etag.txt",
+		Status: filterRefreshUnchanged,
+	}}, results)
+	assert.Equal(t, uint32(2), atomic.LoadUint32(&changedN))
+	assert.Equal(t, uint32(2), atomic.LoadUint32(&notModifiedN))
+}
+
+func TestFiltering_handleFilteringSources(t *testing.T) {
+	Context.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, []dnsfilter.Filter{{
+		ID:   1,
+		Data: []byte("||example.org^\n"),
+	}, {
+		ID:   2,
+		Data: []byte("||example.net^\n0.0.0.0 example.org\n"),
+	}})
+	defer func() {
+		Context.dnsFilter.Close()
+		Context.dnsFilter = nil
+	}()
+
+	prevFilters := config.Filters
+	defer func() { config.Filters = prevFilters }()
+
+	config.Filters = []filter{{
+		Enabled: true,
+		Name:    "List 1",
+		URL:     "https://example.com/1.txt",
+		Filter:  dnsfilter.Filter{ID: 1},
+	}, {
+		Enabled: true,
+		Name:    "List 2",
+		URL:     "https://example.com/2.txt",
+		Filter:  dnsfilter.Filter{ID: 2},
+	}}
+
+	r := httptest.NewRequest(http.MethodPost, "/control/filtering/sources?host=example.org", nil)
+	w := httptest.NewRecorder()
+	Context.filters.handleFilteringSources(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	resp := struct {
+		Sources []*filterSource `json:"sources"`
+	}{}
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, []*filterSource{{
+		ID:    1,
+		Name:  "List 1",
+		URL:   "https://example.com/1.txt",
+		Rules: []string{"||example.org^"},
+	}, {
+		ID:    2,
+		Name:  "List 2",
+		URL:   "https://example.com/2.txt",
+		Rules: []string{"0.0.0.0 example.org"},
+	}}, resp.Sources)
+}
+
+func TestFilters_headers(t *testing.T) {
+	const token = "Bearer secret-token"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/private.txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		_, _ = w.Write([]byte("||private.example^\n" + r.Header.Get("X-List-Key") + "\n"))
+	})
+	mux.HandleFunc("/moved.txt", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/private.txt", http.StatusFound)
+	})
+
+	// The other server has another host, since its port differs.
+	otherMux := http.NewServeMux()
+	otherMux.HandleFunc("/public.txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" || r.Header.Get("X-List-Key") != "" {
+			_, _ = w.Write([]byte("||leaked.example^\n"))
+
+			return
+		}
+
+		_, _ = w.Write([]byte("||public.example^\n"))
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() { _ = http.Serve(l, mux) }()
+	defer func() { _ = l.Close() }()
+
+	otherL, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() { _ = http.Serve(otherL, otherMux) }()
+	defer func() { _ = otherL.Close() }()
+
+	otherURL := "http://" + otherL.Addr().String() + "/public.txt"
+	mux.HandleFunc("/away.txt", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, otherURL, http.StatusFound)
+	})
+
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.client = &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	Context.filters.Init()
+
+	url := "http://" + l.Addr().String() + "/private.txt"
+
+	t.Run("sent", func(t *testing.T) {
+		f := filter{
+			URL: url,
+			Filter: dnsfilter.Filter{
+				ID: 1,
+				Headers: map[string]string{
+					"authorization": token,
+					"X-List-Key":    "||key.example^",
+				},
+			},
+		}
+
+		ok, uerr := Context.filters.update(&f)
+		assert.Nil(t, uerr)
+		assert.True(t, ok)
+		assert.Equal(t, 2, f.RulesCount)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		f := filter{
+			URL: url,
+			Filter: dnsfilter.Filter{
+				ID: 2,
+				Headers: map[string]string{
+					"Authorization": "Bearer wrong-token",
+				},
+			},
+		}
+
+		ok, uerr := Context.filters.update(&f)
+		assert.False(t, ok)
+		if assert.NotNil(t, uerr) {
+			assert.Contains(t, uerr.Error(), "authorization failed")
+			assert.NotContains(t, uerr.Error(), "wrong-token")
+		}
+
+		f.Headers = nil
+		_, uerr = Context.filters.update(&f)
+		if assert.NotNil(t, uerr) {
+			assert.Contains(t, uerr.Error(), "status code 401")
+		}
+	})
+
+	headers := map[string]string{
+		"Authorization": token,
+		"X-List-Key":    "||key.example^",
+	}
+
+	t.Run("same_host_redirect", func(t *testing.T) {
+		f := filter{
+			URL:    "http://" + l.Addr().String() + "/moved.txt",
+			Filter: dnsfilter.Filter{ID: 3, Headers: headers},
+		}
+
+		ok, uerr := Context.filters.update(&f)
+		assert.Nil(t, uerr)
+		assert.True(t, ok)
+		assert.Equal(t, 2, f.RulesCount)
+	})
+
+	t.Run("other_host_redirect", func(t *testing.T) {
+		f := filter{
+			URL:    "http://" + l.Addr().String() + "/away.txt",
+			Filter: dnsfilter.Filter{ID: 4, Headers: headers},
+		}
+
+		ok, uerr := Context.filters.update(&f)
+		assert.Nil(t, uerr)
+		assert.True(t, ok)
+
+		data, rerr := ioutil.ReadFile(f.Path())
+		assert.Nil(t, rerr)
+		assert.Equal(t, "||public.example^\n", string(data))
+	})
+
+	t.Run("url_changed", func(t *testing.T) {
+		prevFilters := config.Filters
+		t.Cleanup(func() { config.Filters = prevFilters })
+
+		config.Filters = []filter{{
+			URL: url,
+			Filter: dnsfilter.Filter{
+				ID:       5,
+				Headers:  headers,
+				Checksum: "checksum",
+				ETag:     `"v1"`,
+			},
+		}}
+
+		status := Context.filters.filterSetProperties(url, filter{URL: otherURL}, false, nil)
+		assert.NotZero(t, status&statusURLChanged)
+		assert.Nil(t, config.Filters[0].Headers)
+		assert.Empty(t, config.Filters[0].Checksum)
+		assert.Empty(t, config.Filters[0].ETag)
+	})
+}
@@ -0,0 +1,220 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/util"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Filter list categories.
+const (
+	filterCategoryAds      = "ads"
+	filterCategoryTracking = "tracking"
+	filterCategoryMalware  = "malware"
+	filterCategoryParental = "parental"
+)
+
+// filterCategories are the supported filter list categories in the order in
+// which they're reported.
+var filterCategories = []string{
+	filterCategoryAds,
+	filterCategoryTracking,
+	filterCategoryMalware,
+	filterCategoryParental,
+}
+
+// validateFilterCategories returns an error if cats contain an unsupported or
+// a duplicated category.
+func validateFilterCategories(cats []string) (err error) {
+	seen := map[string]bool{}
+	for _, c := range cats {
+		if !util.ContainsString(filterCategories, c) {
+			return fmt.Errorf("unsupported filter category %q", c)
+		}
+
+		if seen[c] {
+			return fmt.Errorf("duplicated filter category %q", c)
+		}
+
+		seen[c] = true
+	}
+
+	return nil
+}
+
+// hasCategory returns true if the filter is in category cat.
+func (filter *filter) hasCategory(cat string) (ok bool) {
+	return util.ContainsString(filter.Categories, cat)
+}
+
+// filterCategoryJSON is the state of a filter list category.
+type filterCategoryJSON struct {
+	Name string `json:"name"`
+
+	// ListsNum is the number of the lists in the category, both
+	// blocklists and allowlists.
+	ListsNum int `json:"lists_num"`
+
+	// EnabledListsNum is the number of the enabled lists in the category.
+	EnabledListsNum int `json:"enabled_lists_num"`
+
+	// RulesCount is the total number of rules in the enabled lists.
+	RulesCount int `json:"rules_count"`
+
+	// NumBlocked is the number of requests blocked by the rules from the
+	// lists of the category during the statistics period.  A request
+	// blocked by the rules from several lists is counted for each of them.
+	NumBlocked uint64 `json:"num_blocked"`
+
+	// NumMonitored is the number of requests which the rules from the
+	// monitor-only lists of the category would have blocked during the
+	// statistics period.
+	NumMonitored uint64 `json:"num_monitored"`
+}
+
+// filterCategoriesStats returns the state of every category of the lists.
+// blocked and monitored are the numbers of blocked and monitored requests by
+// the list ID.
+func filterCategoriesStats(
+	lists []filter,
+	blocked map[int64]uint64,
+	monitored map[int64]uint64,
+) (cats []filterCategoryJSON) {
+	cats = make([]filterCategoryJSON, 0, len(filterCategories))
+	for _, name := range filterCategories {
+		c := filterCategoryJSON{
+			Name: name,
+		}
+
+		for i := range lists {
+			l := &lists[i]
+			if !l.hasCategory(name) {
+				continue
+			}
+
+			c.ListsNum++
+			c.NumBlocked += blocked[l.ID]
+			c.NumMonitored += monitored[l.ID]
+			if l.Enabled {
+				c.EnabledListsNum++
+				c.RulesCount += l.RulesCount
+			}
+		}
+
+		cats = append(cats, c)
+	}
+
+	return cats
+}
+
+// setCategoryEnabledLocked enables or disables all lists in category cat.  It
+// returns the IDs of the lists which state has changed and true if some of the
+// enabled lists must be downloaded.  config must be locked.
+func (f *Filtering) setCategoryEnabledLocked(cat string, enabled bool) (changed []int64, updateRequired bool) {
+	for _, filters := range []*[]filter{&config.Filters, &config.WhitelistFilters} {
+		for i := range *filters {
+			filt := &(*filters)[i]
+			if !filt.hasCategory(cat) || filt.Enabled == enabled {
+				continue
+			}
+
+			filt.Enabled = enabled
+			changed = append(changed, filt.ID)
+			if !enabled {
+				filt.unload()
+
+				continue
+			}
+
+			err := f.load(filt)
+			if err != nil {
+				// This isn't a fatal error, because it may occur
+				// when someone removes the file from disk.
+				filt.LastUpdated = time.Time{}
+				filt.Checksum = ""
+				filt.RulesCount = 0
+				updateRequired = true
+			}
+		}
+	}
+
+	return changed, updateRequired
+}
+
+// handleFilteringCategories is the handler for the GET
+// /control/filtering/categories HTTP API.
+func (f *Filtering) handleFilteringCategories(w http.ResponseWriter, r *http.Request) {
+	var blocked, monitored map[int64]uint64
+	if Context.stats != nil {
+		blocked = Context.stats.GetFilterListsBlocked()
+		monitored = Context.stats.GetFilterListsMonitored()
+	}
+
+	config.RLock()
+	lists := make([]filter, 0, len(config.Filters)+len(config.WhitelistFilters))
+	lists = append(lists, config.Filters...)
+	lists = append(lists, config.WhitelistFilters...)
+	config.RUnlock()
+
+	resp := struct {
+		Categories []filterCategoryJSON `json:"categories"`
+	}{
+		Categories: filterCategoriesStats(lists, blocked, monitored),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+	}
+}
+
+// handleFilteringCategoriesSet is the handler for the POST
+// /control/filtering/categories/set HTTP API.
+func (f *Filtering) handleFilteringCategoriesSet(w http.ResponseWriter, r *http.Request) {
+	type categorySetReq struct {
+		Name    string `json:"name"`
+		Enabled bool   `json:"enabled"`
+	}
+
+	req := categorySetReq{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	err = validateFilterCategories([]string{req.Name})
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	config.Lock()
+	changed, updateRequired := f.setCategoryEnabledLocked(req.Name, req.Enabled)
+	config.Unlock()
+
+	if len(changed) == 0 {
+		return
+	}
+
+	log.Info("filtering: set enabled to %t for %d lists in category %s", req.Enabled, len(changed), req.Name)
+
+	onConfigModified()
+	if updateRequired {
+		nUpdated, _, _ := f.refreshFilters(filterRefreshBlocklists|filterRefreshAllowlists, 0, true)
+		// If at least one filter has been updated, refreshFilters
+		// restarts the filtering.
+		if nUpdated != 0 {
+			return
+		}
+	}
+
+	enableFiltersChanged(true, changed)
+}
@@ -0,0 +1,171 @@
+package home
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateFilterCategories(t *testing.T) {
+	assert.Nil(t, validateFilterCategories(nil))
+	assert.Nil(t, validateFilterCategories([]string{"ads", "tracking"}))
+	assert.NotNil(t, validateFilterCategories([]string{"ads", "unknown"}))
+	assert.NotNil(t, validateFilterCategories([]string{"ads", "ads"}))
+}
+
+func TestFilterCategoriesStats(t *testing.T) {
+	lists := []filter{{
+		Enabled:    true,
+		RulesCount: 10,
+		Filter: dnsfilter.Filter{
+			ID:         1,
+			Categories: []string{filterCategoryAds},
+		},
+	}, {
+		Enabled:    true,
+		RulesCount: 20,
+		Filter: dnsfilter.Filter{
+			ID:         2,
+			Categories: []string{filterCategoryAds, filterCategoryTracking},
+		},
+	}, {
+		Enabled:    false,
+		RulesCount: 30,
+		Filter: dnsfilter.Filter{
+			ID:         3,
+			Categories: []string{filterCategoryTracking},
+		},
+	}, {
+		Enabled:    true,
+		RulesCount: 40,
+		Filter: dnsfilter.Filter{
+			ID: 4,
+		},
+	}}
+
+	blocked := map[int64]uint64{
+		1: 1,
+		2: 2,
+		3: 4,
+		4: 8,
+	}
+
+	monitored := map[int64]uint64{
+		2: 16,
+		3: 32,
+	}
+
+	assert.Equal(t, []filterCategoryJSON{{
+		Name:            filterCategoryAds,
+		ListsNum:        2,
+		EnabledListsNum: 2,
+		RulesCount:      30,
+		NumBlocked:      3,
+		NumMonitored:    16,
+	}, {
+		Name:            filterCategoryTracking,
+		ListsNum:        2,
+		EnabledListsNum: 1,
+		RulesCount:      20,
+		NumBlocked:      6,
+		NumMonitored:    48,
+	}, {
+		Name: filterCategoryMalware,
+	}, {
+		Name: filterCategoryParental,
+	}}, filterCategoriesStats(lists, blocked, monitored))
+}
+
+func TestFiltering_setCategoryEnabledLocked(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.filters.Init()
+
+	prevFilters, prevWhitelistFilters := config.Filters, config.WhitelistFilters
+	defer func() {
+		config.Filters, config.WhitelistFilters = prevFilters, prevWhitelistFilters
+	}()
+
+	config.Filters = []filter{{
+		Enabled: true,
+		URL:     "https://example.com/ads.txt",
+		Filter: dnsfilter.Filter{
+			ID:         1,
+			Categories: []string{filterCategoryAds},
+		},
+	}, {
+		Enabled: true,
+		URL:     "https://example.com/tracking.txt",
+		Filter: dnsfilter.Filter{
+			ID:         2,
+			Categories: []string{filterCategoryTracking},
+		},
+	}, {
+		Enabled: false,
+		URL:     "https://example.com/ads-tracking.txt",
+		Filter: dnsfilter.Filter{
+			ID:         3,
+			Categories: []string{filterCategoryAds, filterCategoryTracking},
+		},
+	}}
+	config.WhitelistFilters = []filter{{
+		Enabled: true,
+		URL:     "https://example.com/tracking-allow.txt",
+		Filter: dnsfilter.Filter{
+			ID:         4,
+			Categories: []string{filterCategoryTracking},
+		},
+	}}
+
+	for _, id := range []int64{1, 2, 3, 4} {
+		f := filter{Filter: dnsfilter.Filter{ID: id}}
+		err := ioutil.WriteFile(f.Path(), []byte("||example.org^\n"), 0o644)
+		assert.Nil(t, err)
+	}
+
+	enabled := func() (ids []int64) {
+		for _, fs := range [][]filter{config.Filters, config.WhitelistFilters} {
+			for _, f := range fs {
+				if f.Enabled {
+					ids = append(ids, f.ID)
+				}
+			}
+		}
+
+		return ids
+	}
+
+	changed, updateRequired := Context.filters.setCategoryEnabledLocked(filterCategoryTracking, false)
+	assert.Equal(t, []int64{2, 4}, changed)
+	assert.False(t, updateRequired)
+	assert.Equal(t, []int64{1}, enabled())
+
+	changed, updateRequired = Context.filters.setCategoryEnabledLocked(filterCategoryTracking, true)
+	assert.Equal(t, []int64{2, 3, 4}, changed)
+	assert.False(t, updateRequired)
+	assert.Equal(t, []int64{1, 2, 3, 4}, enabled())
+	assert.Equal(t, 1, config.Filters[2].RulesCount)
+
+	// Nothing changes if the lists are already enabled.
+	changed, updateRequired = Context.filters.setCategoryEnabledLocked(filterCategoryTracking, true)
+	assert.Empty(t, changed)
+	assert.False(t, updateRequired)
+
+	t.Run("update_required", func(t *testing.T) {
+		changed, updateRequired = Context.filters.setCategoryEnabledLocked(filterCategoryAds, false)
+		assert.Equal(t, []int64{1, 3}, changed)
+		assert.False(t, updateRequired)
+
+		assert.Nil(t, os.Remove(config.Filters[0].Path()))
+
+		changed, updateRequired = Context.filters.setCategoryEnabledLocked(filterCategoryAds, true)
+		assert.Equal(t, []int64{1, 3}, changed)
+		assert.True(t, updateRequired)
+		assert.True(t, config.Filters[0].LastUpdated.IsZero())
+	})
+}
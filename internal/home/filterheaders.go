@@ -0,0 +1,82 @@
+package home
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// validateFilterHeaders returns an error if headers contain a header which
+// can't be sent with the requests downloading the filter lists.  The error
+// never contains the values of the headers, since those are usually secret.
+func validateFilterHeaders(headers map[string]string) (err error) {
+	for name, val := range headers {
+		if !isHeaderName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+
+		switch http.CanonicalHeaderKey(name) {
+		case "Host", "If-Modified-Since", "If-None-Match":
+			return fmt.Errorf("header %q can't be set", name)
+		}
+
+		if strings.ContainsAny(val, "\r\n") {
+			return fmt.Errorf("invalid value of header %q", name)
+		}
+	}
+
+	return nil
+}
+
+// isHeaderName returns true if s is a valid HTTP header name, which is a token
+// as defined by RFC 7230.
+func isHeaderName(s string) (ok bool) {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z',
+			c >= 'A' && c <= 'Z',
+			c >= '0' && c <= '9',
+			strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+			// Go on.
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// filterHeaderNames returns the sorted names of headers, so that the HTTP API
+// could show which headers are set without revealing their values.
+func filterHeaderNames(headers map[string]string) (names []string) {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	names = make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// hasFilterHeaders returns true if any of the filter lists from lists have
+// additional HTTP headers, which are usually secret.
+func hasFilterHeaders(lists ...[]filter) (ok bool) {
+	for _, l := range lists {
+		for _, f := range l {
+			if len(f.Headers) != 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
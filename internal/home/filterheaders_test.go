@@ -0,0 +1,101 @@
+package home
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateFilterHeaders(t *testing.T) {
+	testCases := []struct {
+		name    string
+		headers map[string]string
+		wantErr bool
+	}{{
+		name:    "empty",
+		headers: nil,
+		wantErr: false,
+	}, {
+		name: "valid",
+		headers: map[string]string{
+			"Authorization": "Bearer token",
+			"X-Api-Key":     "key",
+		},
+		wantErr: false,
+	}, {
+		name:    "bad_name",
+		headers: map[string]string{"X Api Key": "key"},
+		wantErr: true,
+	}, {
+		name:    "bad_value",
+		headers: map[string]string{"X-Api-Key": "key\r\nHost: evil"},
+		wantErr: true,
+	}, {
+		name:    "conditional",
+		headers: map[string]string{"if-none-match": "etag"},
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateFilterHeaders(tc.headers)
+			if tc.wantErr {
+				assert.NotNil(t, err)
+				for _, v := range tc.headers {
+					assert.NotContains(t, err.Error(), v)
+				}
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestFilterHeaderNames(t *testing.T) {
+	assert.Nil(t, filterHeaderNames(nil))
+	assert.Equal(t, []string{"Authorization", "X-Api-Key"}, filterHeaderNames(map[string]string{
+		"x-api-key":     "key",
+		"Authorization": "Bearer token",
+	}))
+}
+
+func TestHasFilterHeaders(t *testing.T) {
+	plain := filter{}
+	withHeaders := filter{}
+	withHeaders.Headers = map[string]string{"Authorization": "Bearer token"}
+
+	assert.False(t, hasFilterHeaders(nil, []filter{plain}))
+	assert.True(t, hasFilterHeaders([]filter{plain}, []filter{withHeaders}))
+}
+
+func TestSafeWritePrivate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-config")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "AdGuardHome.yaml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("old"), 0o644))
+
+	// The leftover temporary file doesn't make the result readable.
+	assert.Nil(t, ioutil.WriteFile(path+".tmp", nil, 0o644))
+
+	assert.Nil(t, safeWritePrivate(path, []byte("new")))
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(data))
+
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	if runtime.GOOS != "windows" {
+		fi, serr := os.Stat(path)
+		if assert.Nil(t, serr) {
+			assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// defaultRecommendedFiltersURL is the default URL of the index of the
+// recommended filter lists, the registry of the filter lists maintained by
+// AdGuard.
+const defaultRecommendedFiltersURL = "https://adguardteam.github.io/HostlistsRegistry/assets/filters.json"
+
+// maxRecommendedIndexSize is the maximum size of the index of the recommended
+// filter lists.
+const maxRecommendedIndexSize = 1024 * 1024
+
+// recommendedIndex is the index of the recommended filter lists.
+type recommendedIndex struct {
+	Filters []recommendedFilter `json:"filters"`
+}
+
+// recommendedFilter is a filter list in the index of the recommended filter
+// lists.
+type recommendedFilter struct {
+	Name       string   `json:"name"`
+	URL        string   `json:"url"`
+	Categories []string `json:"categories,omitempty"`
+
+	// DownloadURL is the URL of the list in the format of the AdGuard's
+	// registry.  It's only used if URL is empty.
+	DownloadURL string `json:"downloadUrl,omitempty"`
+}
+
+// Statuses of the recommended filter lists in the response of
+// /control/filtering/add_recommended.
+const (
+	// recommendedStatusNew means that the list isn't added yet.  It's only
+	// used in the dry-run mode.
+	recommendedStatusNew = "new"
+	// recommendedStatusExists means that the list had already been added.
+	recommendedStatusExists = "exists"
+	// recommendedStatusAdded means that the list has been added.
+	recommendedStatusAdded = "added"
+	// recommendedStatusFailed means that the list couldn't be added.
+	recommendedStatusFailed = "failed"
+)
+
+// recommendedFilterJSON is a recommended filter list in the response of
+// /control/filtering/add_recommended.
+type recommendedFilterJSON struct {
+	recommendedFilter
+
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	RulesCount int    `json:"rules_count,omitempty"`
+}
+
+// addRecommendedJSON is the response of /control/filtering/add_recommended.
+type addRecommendedJSON struct {
+	Filters []recommendedFilterJSON `json:"filters"`
+}
+
+// fetchRecommendedIndex downloads and parses the index of the recommended
+// filter lists from indexURL.
+func fetchRecommendedIndex(indexURL string) (idx recommendedIndex, err error) {
+	resp, err := Context.client.Get(indexURL)
+	if err != nil {
+		return idx, fmt.Errorf("requesting index: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return idx, fmt.Errorf("requesting index: got status code %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxRecommendedIndexSize)).Decode(&idx)
+	if err != nil {
+		return idx, fmt.Errorf("decoding index: %w", err)
+	}
+
+	for i := range idx.Filters {
+		rf := &idx.Filters[i]
+		if rf.URL == "" {
+			rf.URL = rf.DownloadURL
+		}
+		rf.DownloadURL = ""
+	}
+
+	return idx, nil
+}
+
+// addRecommended subscribes to the recommended filter lists from the index at
+// indexURL which aren't added yet.  If dryRun is true, nothing is added, and
+// only the statuses of the lists are returned.  The failure of a list doesn't
+// prevent the others from being added.  added is the number of the added
+// lists.
+func (f *Filtering) addRecommended(indexURL string, dryRun bool) (resp addRecommendedJSON, added int, err error) {
+	idx, err := fetchRecommendedIndex(indexURL)
+	if err != nil {
+		return resp, 0, err
+	}
+
+	resp.Filters = make([]recommendedFilterJSON, 0, len(idx.Filters))
+	for _, rf := range idx.Filters {
+		fj := recommendedFilterJSON{
+			recommendedFilter: rf,
+		}
+
+		switch {
+		case filterExists(rf.URL):
+			fj.Status = recommendedStatusExists
+		case dryRun:
+			fj.Status = recommendedStatusNew
+		default:
+			fj.RulesCount, err = f.addRecommendedFilter(rf)
+			if err != nil {
+				log.Info("filtering: adding recommended list %s: %s", rf.URL, err)
+
+				fj.Status = recommendedStatusFailed
+				fj.Error = err.Error()
+			} else {
+				fj.Status = recommendedStatusAdded
+				added++
+			}
+		}
+
+		resp.Filters = append(resp.Filters, fj)
+	}
+
+	return resp, added, nil
+}
+
+// addRecommendedFilter downloads the recommended filter list rf and adds it to
+// the blocklists.
+func (f *Filtering) addRecommendedFilter(rf recommendedFilter) (rulesCount int, err error) {
+	if !isValidURL(rf.URL) {
+		return 0, fmt.Errorf("invalid url %q", rf.URL)
+	}
+
+	err = validateFilterCategories(rf.Categories)
+	if err != nil {
+		return 0, err
+	}
+
+	filt := filter{
+		Enabled: true,
+		URL:     rf.URL,
+		Name:    rf.Name,
+	}
+	filt.ID = assignUniqueFilterID()
+	filt.Categories = rf.Categories
+
+	ok, err := f.update(&filt)
+	if err != nil {
+		return 0, fmt.Errorf("fetching list: %w", err)
+	} else if !ok {
+		return 0, fmt.Errorf("list is invalid")
+	}
+
+	if !filterAdd(filt) {
+		return 0, fmt.Errorf("list already added")
+	}
+
+	return filt.RulesCount, nil
+}
+
+func (f *Filtering) handleFilteringAddRecommended(w http.ResponseWriter, r *http.Request) {
+	type addRecommendedReq struct {
+		DryRun bool `json:"dry_run"`
+	}
+
+	req := addRecommendedReq{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	config.RLock()
+	indexURL := config.DNS.RecommendedFiltersURL
+	config.RUnlock()
+
+	if indexURL == "" {
+		httpError(w, http.StatusNotImplemented, "recommended filters index url is not configured")
+
+		return
+	}
+
+	resp, added, err := f.addRecommended(indexURL, req.DryRun)
+	if err != nil {
+		httpError(w, http.StatusBadGateway, "getting recommended filters: %s", err)
+
+		return
+	}
+
+	if added != 0 {
+		log.Info("filtering: added %d recommended lists", added)
+
+		onConfigModified()
+		enableFilters(true)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+	}
+}
@@ -0,0 +1,120 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFiltering_addRecommended(t *testing.T) {
+	var srvURL string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/index.json", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(recommendedIndex{
+			Filters: []recommendedFilter{{
+				Name:       "Ads",
+				URL:        srvURL + "/ads.txt",
+				Categories: []string{filterCategoryAds},
+			}, {
+				Name: "Broken",
+				URL:  srvURL + "/broken.txt",
+			}, {
+				Name: "Existing",
+				URL:  srvURL + "/existing.txt",
+			}},
+		})
+	})
+	mux.HandleFunc("/registry.json", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"filters":[{"name":"Ads","downloadUrl":"` + srvURL + `/ads.txt"}]}`))
+	})
+	mux.HandleFunc("/ads.txt", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("||ads.example^\n||tracker.example^\n"))
+	})
+	mux.HandleFunc("/broken.txt", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	srvURL = srv.URL
+
+	dir := prepareTestDir()
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.client = &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	Context.filters.Init()
+
+	prevFilters, prevWhitelistFilters := config.Filters, config.WhitelistFilters
+	t.Cleanup(func() {
+		config.Filters, config.WhitelistFilters = prevFilters, prevWhitelistFilters
+	})
+
+	config.Filters = []filter{{
+		Enabled: true,
+		URL:     srvURL + "/existing.txt",
+		Name:    "Existing",
+	}}
+	config.WhitelistFilters = nil
+
+	indexURL := srvURL + "/index.json"
+
+	t.Run("dry_run", func(t *testing.T) {
+		resp, added, err := Context.filters.addRecommended(indexURL, true)
+		assert.Nil(t, err)
+		assert.Zero(t, added)
+
+		if assert.Len(t, resp.Filters, 3) {
+			assert.Equal(t, recommendedStatusNew, resp.Filters[0].Status)
+			assert.Equal(t, recommendedStatusNew, resp.Filters[1].Status)
+			assert.Equal(t, recommendedStatusExists, resp.Filters[2].Status)
+		}
+
+		assert.Len(t, config.Filters, 1)
+	})
+
+	t.Run("add", func(t *testing.T) {
+		resp, added, err := Context.filters.addRecommended(indexURL, false)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, added)
+
+		if assert.Len(t, resp.Filters, 3) {
+			assert.Equal(t, recommendedStatusAdded, resp.Filters[0].Status)
+			assert.Equal(t, 2, resp.Filters[0].RulesCount)
+			assert.Equal(t, recommendedStatusFailed, resp.Filters[1].Status)
+			assert.NotEmpty(t, resp.Filters[1].Error)
+			assert.Equal(t, recommendedStatusExists, resp.Filters[2].Status)
+		}
+
+		if assert.Len(t, config.Filters, 2) {
+			f := config.Filters[1]
+			assert.Equal(t, "Ads", f.Name)
+			assert.True(t, f.Enabled)
+			assert.Equal(t, []string{filterCategoryAds}, f.Categories)
+		}
+	})
+
+	t.Run("registry_format", func(t *testing.T) {
+		resp, added, err := Context.filters.addRecommended(srvURL+"/registry.json", true)
+		assert.Nil(t, err)
+		assert.Zero(t, added)
+
+		if assert.Len(t, resp.Filters, 1) {
+			assert.Equal(t, srvURL+"/ads.txt", resp.Filters[0].URL)
+			assert.Empty(t, resp.Filters[0].DownloadURL)
+			assert.Equal(t, recommendedStatusExists, resp.Filters[0].Status)
+		}
+	})
+
+	t.Run("bad_index", func(t *testing.T) {
+		_, _, err := Context.filters.addRecommended(srvURL+"/broken.txt", false)
+		assert.NotNil(t, err)
+	})
+}
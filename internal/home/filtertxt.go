@@ -0,0 +1,164 @@
+package home
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Filter lists may be distributed via DNS TXT records, which is useful when
+// only DNS traffic is allowed.  The URL of such a list is "dnstxt://<zone>".
+// The zone contains:
+//
+//   _meta.<zone>  TXT "v=1; chunks=<n>; sha256=<hex>"
+//   0.<zone>      TXT "<base64 of the first chunk of the rules>"
+//   ...
+//   <n-1>.<zone>  TXT "<base64 of the last chunk of the rules>"
+//
+// The character strings of a chunk's TXT record are concatenated and decoded,
+// and the chunks are concatenated in order.  The SHA-256 hash of the result
+// must match the one from the metadata.  Base64 is used, because the TXT
+// records may contain only a limited set of characters without escaping.
+
+// txtFilterScheme is the URL scheme of the filter lists distributed via DNS
+// TXT records.
+const txtFilterScheme = "dnstxt"
+
+// txtFilterMaxChunks is the maximum number of chunks of a filter list
+// distributed via DNS TXT records.
+const txtFilterMaxChunks = 100000
+
+// txtFilterMeta is the metadata of a filter list distributed via DNS TXT
+// records.
+type txtFilterMeta struct {
+	sum    []byte
+	chunks int
+}
+
+// txtFilterZone returns the zone of a filter list distributed via DNS TXT
+// records.  ok is false if rawurl isn't such a URL.
+func txtFilterZone(rawurl string) (zone string, ok bool) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != txtFilterScheme || u.Host == "" {
+		return "", false
+	}
+
+	return u.Host, true
+}
+
+// exchangeFunc sends a DNS request and returns the response.
+type exchangeFunc func(req *dns.Msg) (resp *dns.Msg, err error)
+
+// lookupTXT returns the concatenated character strings of the only TXT record
+// of name.
+func lookupTXT(exchange exchangeFunc, name string) (txt string, err error) {
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+
+	resp, err := exchange(req)
+	if err != nil {
+		return "", fmt.Errorf("looking up %s: %w", name, err)
+	} else if resp == nil {
+		return "", fmt.Errorf("looking up %s: no response", name)
+	} else if resp.Rcode != dns.RcodeSuccess {
+		return "", fmt.Errorf("looking up %s: %s", name, dns.RcodeToString[resp.Rcode])
+	}
+
+	var rr *dns.TXT
+	for _, ans := range resp.Answer {
+		t, ok := ans.(*dns.TXT)
+		if !ok {
+			continue
+		} else if rr != nil {
+			return "", fmt.Errorf("looking up %s: more than one txt record", name)
+		}
+
+		rr = t
+	}
+
+	if rr == nil {
+		return "", fmt.Errorf("looking up %s: no txt records", name)
+	}
+
+	return strings.Join(rr.Txt, ""), nil
+}
+
+// parseTXTFilterMeta parses the metadata of a filter list distributed via DNS
+// TXT records.
+func parseTXTFilterMeta(txt string) (meta txtFilterMeta, err error) {
+	var version string
+	for _, f := range strings.Split(txt, ";") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "v":
+			version = kv[1]
+		case "chunks":
+			meta.chunks, err = strconv.Atoi(kv[1])
+			if err != nil {
+				return meta, fmt.Errorf("bad chunks: %w", err)
+			}
+		case "sha256":
+			meta.sum, err = hex.DecodeString(kv[1])
+			if err != nil {
+				return meta, fmt.Errorf("bad sha256: %w", err)
+			}
+		}
+	}
+
+	if version != "1" {
+		return meta, fmt.Errorf("unsupported version %q", version)
+	} else if meta.chunks <= 0 || meta.chunks > txtFilterMaxChunks {
+		return meta, fmt.Errorf("bad number of chunks %d", meta.chunks)
+	} else if len(meta.sum) != sha256.Size {
+		return meta, fmt.Errorf("bad sha256 length %d", len(meta.sum))
+	}
+
+	return meta, nil
+}
+
+// fetchTXTFilter fetches the filter list distributed via DNS TXT records in
+// zone, reassembles it, and checks its hash.
+func fetchTXTFilter(exchange exchangeFunc, zone string) (data []byte, err error) {
+	txt, err := lookupTXT(exchange, "_meta."+zone)
+	if err != nil {
+		return nil, fmt.Errorf("fetching metadata: %w", err)
+	}
+
+	meta, err := parseTXTFilterMeta(txt)
+	if err != nil {
+		return nil, fmt.Errorf("parsing metadata: %w", err)
+	}
+
+	for i := 0; i < meta.chunks; i++ {
+		txt, err = lookupTXT(exchange, strconv.Itoa(i)+"."+zone)
+		if err != nil {
+			return nil, fmt.Errorf("fetching chunk %d: %w", i, err)
+		}
+
+		var chunk []byte
+		chunk, err = base64.StdEncoding.DecodeString(txt)
+		if err != nil {
+			return nil, fmt.Errorf("decoding chunk %d: %w", i, err)
+		}
+
+		data = append(data, chunk...)
+	}
+
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], meta.sum) {
+		return nil, fmt.Errorf("sha256 mismatch: got %x, want %x", sum, meta.sum)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,145 @@
+package home
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testTXTZone returns the TXT records of zone which distribute data in chunks
+// of chunkSize bytes.
+func testTXTZone(zone string, data []byte, chunkSize int) (records map[string][]string) {
+	records = map[string][]string{}
+
+	var n int
+	for ; len(data) > 0; n++ {
+		size := chunkSize
+		if size > len(data) {
+			size = len(data)
+		}
+
+		enc := base64.StdEncoding.EncodeToString(data[:size])
+		data = data[size:]
+
+		// Split into character strings of at most 255 bytes.
+		var strs []string
+		for len(enc) > 255 {
+			strs = append(strs, enc[:255])
+			enc = enc[255:]
+		}
+		strs = append(strs, enc)
+
+		records[dns.Fqdn(strconv.Itoa(n)+"."+zone)] = strs
+	}
+
+	return records
+}
+
+// startTestTXTServer starts a DNS server which answers with records and
+// returns its address.
+func startTestTXTServer(t *testing.T, records map[string][]string) (addr string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := &dns.Msg{}
+			resp.SetReply(req)
+
+			q := req.Question[0]
+			strs, ok := records[q.Name]
+			if !ok {
+				resp.Rcode = dns.RcodeNameError
+			} else {
+				resp.Answer = []dns.RR{&dns.TXT{
+					Hdr: dns.RR_Header{
+						Name:   q.Name,
+						Rrtype: dns.TypeTXT,
+						Class:  dns.ClassINET,
+						Ttl:    60,
+					},
+					Txt: strs,
+				}}
+			}
+
+			_ = w.WriteMsg(resp)
+		}),
+	}
+
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	return pc.LocalAddr().String()
+}
+
+func TestFetchTXTFilter(t *testing.T) {
+	const zone = "rules.example.org"
+
+	b := &strings.Builder{}
+	for i := 0; i < 50; i++ {
+		_, _ = fmt.Fprintf(b, "||blocked-%d.example.org^\n", i)
+	}
+	data := []byte(b.String())
+	sum := sha256.Sum256(data)
+
+	records := testTXTZone(zone, data, 300)
+	records[dns.Fqdn("_meta."+zone)] = []string{
+		fmt.Sprintf("v=1; chunks=%d; sha256=%x", len(records), sum),
+	}
+
+	fetch := func(records map[string][]string) (data []byte, err error) {
+		addr := startTestTXTServer(t, records)
+
+		return fetchTXTFilter(func(req *dns.Msg) (*dns.Msg, error) {
+			return dns.Exchange(req, addr)
+		}, zone)
+	}
+
+	got, err := fetch(records)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+
+	t.Run("tampered", func(t *testing.T) {
+		tampered := map[string][]string{}
+		for k, v := range records {
+			tampered[k] = v
+		}
+		tampered[dns.Fqdn("1."+zone)] = []string{
+			base64.StdEncoding.EncodeToString([]byte("@@||blocked-1.example.org^\n")),
+		}
+
+		_, err = fetch(tampered)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		missing := map[string][]string{}
+		for k, v := range records {
+			missing[k] = v
+		}
+		delete(missing, dns.Fqdn("2."+zone))
+
+		_, err = fetch(missing)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestTXTFilterZone(t *testing.T) {
+	zone, ok := txtFilterZone("dnstxt://rules.example.org")
+	assert.True(t, ok)
+	assert.Equal(t, "rules.example.org", zone)
+
+	_, ok = txtFilterZone("https://rules.example.org/list.txt")
+	assert.False(t, ok)
+
+	_, ok = txtFilterZone("/etc/rules.txt")
+	assert.False(t, ok)
+}
@@ -0,0 +1,104 @@
+package home
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// geoIPRange is a range of IP addresses located in a country.
+type geoIPRange struct {
+	// start and end are the first and the last addresses of the range in
+	// the 16-byte form.
+	start net.IP
+	end   net.IP
+
+	country string
+}
+
+// geoIPDB is an IP geolocation database.  The zero value is an empty
+// database.
+type geoIPDB struct {
+	// ranges are sorted by start.
+	ranges []geoIPRange
+}
+
+// newGeoIPDB loads the database from the CSV file at path.  Each record of it
+// has the first and the last IP addresses of a range and the ISO 3166-1
+// alpha-2 code of the country, which is the format of, for example, the
+// DB-IP's "IP to Country Lite" database.  The other fields are ignored.
+func newGeoIPDB(path string) (db *geoIPDB, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readGeoIPDB(f)
+}
+
+// readGeoIPDB reads the database in the format described in newGeoIPDB from
+// r.
+func readGeoIPDB(r io.Reader) (db *geoIPDB, err error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	db = &geoIPDB{}
+	for line := 1; ; line++ {
+		var rec []string
+		rec, err = cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(rec) < 3 {
+			return nil, fmt.Errorf("line %d: expected at least 3 fields, got %d", line, len(rec))
+		}
+
+		start := net.ParseIP(strings.TrimSpace(rec[0]))
+		end := net.ParseIP(strings.TrimSpace(rec[1]))
+		if start == nil || end == nil || bytes.Compare(start, end) > 0 {
+			return nil, fmt.Errorf("line %d: invalid range %q-%q", line, rec[0], rec[1])
+		}
+
+		db.ranges = append(db.ranges, geoIPRange{
+			start:   start.To16(),
+			end:     end.To16(),
+			country: strings.ToUpper(strings.TrimSpace(rec[2])),
+		})
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].start, db.ranges[j].start) < 0
+	})
+
+	return db, nil
+}
+
+// country returns the country code of ip or an empty string if it's not in
+// the database.
+func (db *geoIPDB) country(ip net.IP) (country string) {
+	ip = ip.To16()
+	if ip == nil {
+		return ""
+	}
+
+	// Find the last range starting before or at ip.
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].start, ip) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip, db.ranges[i].end) > 0 {
+		return ""
+	}
+
+	return db.ranges[i].country
+}
@@ -0,0 +1,64 @@
+package home
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoIPDB(t *testing.T) {
+	const data = `# A comment.
+1.0.0.0,1.0.0.255,au
+1.0.4.0,1.0.7.255,AU,Extra
+2.0.0.0,2.255.255.255,FR
+2001:db8::,2001:db8::ffff,NL
+`
+	db, err := readGeoIPDB(strings.NewReader(data))
+	assert.Nil(t, err)
+
+	testCases := []struct {
+		ip   net.IP
+		want string
+	}{{
+		ip:   net.IP{1, 0, 0, 0},
+		want: "AU",
+	}, {
+		ip:   net.IP{1, 0, 0, 255},
+		want: "AU",
+	}, {
+		ip:   net.IP{1, 0, 1, 0},
+		want: "",
+	}, {
+		ip:   net.IP{1, 0, 5, 1},
+		want: "AU",
+	}, {
+		ip:   net.IP{2, 1, 2, 3},
+		want: "FR",
+	}, {
+		ip:   net.IP{0, 0, 0, 1},
+		want: "",
+	}, {
+		ip:   net.IP{3, 0, 0, 1},
+		want: "",
+	}, {
+		ip:   net.ParseIP("2001:db8::1"),
+		want: "NL",
+	}, {
+		ip:   net.ParseIP("2001:db8::1:0"),
+		want: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.ip.String(), func(t *testing.T) {
+			assert.Equal(t, tc.want, db.country(tc.ip))
+		})
+	}
+
+	_, err = readGeoIPDB(strings.NewReader("1.0.0.0,1.0.0.255\n"))
+	assert.NotNil(t, err)
+
+	_, err = readGeoIPDB(strings.NewReader("1.0.0.255,1.0.0.0,AU\n"))
+	assert.NotNil(t, err)
+}
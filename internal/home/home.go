@@ -60,6 +60,12 @@ type homeContext struct {
 	autoHosts  util.AutoHosts       // IP-hostname pairs taken from system configuration (e.g. /etc/hosts) files
 	updater    *updater.Updater
 
+	// selfTest is the periodic filtering self-test.
+	selfTest selfTester
+
+	// geoIP is the IP geolocation database.  It's nil if there is none.
+	geoIP *geoIPDB
+
 	ipDetector *ipDetector
 
 	// mux is our custom http.ServeMux.
@@ -81,6 +87,14 @@ type homeContext struct {
 	appSignalChannel chan os.Signal // Channel for receiving OS signals by the console app
 	// runningAsService flag is set to true when options are passed from the service runner
 	runningAsService bool
+
+	// safeMode is true if the mutating HTTP APIs are disabled and the
+	// configuration file is never written.
+	safeMode bool
+
+	// logFilePath is the path to the log file.  It's empty if the log is
+	// written to stdout or syslog.
+	logFilePath string
 }
 
 // getDataDir returns path to the directory where we store databases and filters
@@ -130,8 +144,14 @@ func setupContext(args options) {
 	Context.disableUpdate = args.disableUpdate ||
 		version.Channel() == version.ChannelDevelopment
 
+	Context.safeMode = args.safeMode
+
 	Context.firstRun = detectFirstRun()
 	if Context.firstRun {
+		if Context.safeMode {
+			log.Fatal("The safe mode requires an existing configuration file")
+		}
+
 		log.Info("This is the first time AdGuard Home is launched")
 		checkPermissions()
 	}
@@ -166,6 +186,11 @@ func setupContext(args options) {
 			os.Exit(1)
 		}
 
+		Context.safeMode = Context.safeMode || config.SafeMode
+		if Context.safeMode {
+			log.Info("Running in the safe mode, the configuration can't be changed via the HTTP API")
+		}
+
 		if args.checkConfig {
 			log.Info("Configuration file is OK")
 			os.Exit(0)
@@ -200,6 +225,7 @@ func setupConfig(args options) {
 	})
 
 	Context.clients.Init(config.Clients, Context.dhcpServer, &Context.autoHosts)
+	Context.clients.idOrder = config.ClientsIdentificationOrder
 	config.Clients = nil
 
 	if (runtime.GOOS == "linux" || runtime.GOOS == "darwin") &&
@@ -304,6 +330,11 @@ func run(args options) {
 		log.Fatalf("Can't initialize Web module")
 	}
 
+	Context.ipDetector, err = newIPDetector()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if !Context.firstRun {
 		err := initDNSServer()
 		if err != nil {
@@ -313,6 +344,8 @@ func run(args options) {
 		Context.autoHosts.Start()
 
 		go func() {
+			waitDHCPStartup()
+
 			err := startDNSServer()
 			if err != nil {
 				log.Fatal(err)
@@ -324,11 +357,6 @@ func run(args options) {
 		}
 	}
 
-	Context.ipDetector, err = newIPDetector()
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	Context.web.Start()
 
 	// wait indefinitely for other go-routines to complete their job
@@ -489,6 +517,7 @@ func configureLogger(args options) {
 		if filepath.IsAbs(ls.LogFile) {
 			logFilePath = ls.LogFile
 		}
+		Context.logFilePath = logFilePath
 
 		_, err := os.OpenFile(logFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
 		if err != nil {
@@ -650,10 +679,18 @@ func customDialContext(ctx context.Context, network, addr string) (net.Conn, err
 		return con, err
 	}
 
-	addrs, e := Context.dnsServer.Resolve(host)
-	log.Debug("dnsServer.Resolve: %s: %v", host, addrs)
-	if e != nil {
-		return nil, e
+	var addrs []net.IPAddr
+	if Context.dnsServer != nil && Context.dnsServer.IsRunning() {
+		addrs, err = Context.dnsServer.Resolve(host)
+		log.Debug("dnsServer.Resolve: %s: %v", host, addrs)
+	} else {
+		// The DNS server isn't ready yet, for example when the filter
+		// lists are downloaded for the first time, so use the bootstrap
+		// servers directly.
+		addrs, err = bootstrapResolve(ctx, host)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	if len(addrs) == 0 {
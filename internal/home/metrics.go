@@ -0,0 +1,25 @@
+package home
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// handleMetrics is the handler for the GET /metrics HTTP API.  It serves the
+// metrics in the Prometheus text exposition format.
+func handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	buf := &bytes.Buffer{}
+	if Context.dnsFilter != nil {
+		err := Context.dnsFilter.WriteMetrics(buf)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "writing filtering metrics: %s", err)
+
+			return
+		}
+	}
+
+	connsRejected.write(buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,22 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleMetrics(t *testing.T) {
+	connsRejected.inc("metrics_test")
+
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	handleMetrics(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, w.Body.String(), "# TYPE adguard_home_conns_rejected_total counter\n")
+	assert.Contains(t, w.Body.String(), `adguard_home_conns_rejected_total{listener="metrics_test"} 1`)
+}
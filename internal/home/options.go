@@ -32,6 +32,9 @@ type options struct {
 	disableMemoryOptimization bool
 
 	glinetMode bool // Activate GL-Inet compatibility mode
+
+	// safeMode disables the HTTP APIs which change the configuration.
+	safeMode bool
 }
 
 // functions used for their side-effects
@@ -190,6 +193,13 @@ var glinetArg = arg{
 	func(o options) []string { return boolSliceOrNil(o.glinetMode) },
 }
 
+var safeModeArg = arg{
+	"Disable changing the configuration via the HTTP API",
+	"safe-mode", "",
+	nil, func(o options) (options, error) { o.safeMode = true; return o, nil }, nil,
+	func(o options) []string { return boolSliceOrNil(o.safeMode) },
+}
+
 var versionArg = arg{
 	"Show the version and exit",
 	"version", "",
@@ -222,6 +232,7 @@ func init() {
 		disableMemoryOptimizationArg,
 		verboseArg,
 		glinetArg,
+		safeModeArg,
 		versionArg,
 		helpArg,
 	}
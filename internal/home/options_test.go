@@ -171,6 +171,15 @@ func TestParseGLInet(t *testing.T) {
 	}
 }
 
+func TestParseSafeMode(t *testing.T) {
+	if testParseOk(t).safeMode {
+		t.Fatal("empty is not safe mode")
+	}
+	if !testParseOk(t, "--safe-mode").safeMode {
+		t.Fatal("--safe-mode is safe mode")
+	}
+}
+
 func TestParseUnknown(t *testing.T) {
 	testParseErr(t, "unknown word", "x")
 	testParseErr(t, "unknown short", "-x")
@@ -236,6 +245,10 @@ func TestSerializeGLInet(t *testing.T) {
 	testSerialize(t, options{glinetMode: true}, "--glinet")
 }
 
+func TestSerializeSafeMode(t *testing.T) {
+	testSerialize(t, options{safeMode: true}, "--safe-mode")
+}
+
 func TestSerializeDisableMemoryOptimization(t *testing.T) {
 	testSerialize(t, options{disableMemoryOptimization: true}, "--no-mem-optimization")
 }
@@ -0,0 +1,43 @@
+package home
+
+import (
+	"net/http"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// safeModeReadOnlyURLs are the URLs of the HTTP APIs which are registered with
+// a mutating method but don't change anything, so they're allowed in the safe
+// mode.
+var safeModeReadOnlyURLs = map[string]bool{
+	"/control/dhcp/find_active_dhcp": true,
+	"/control/filtering/sources":     true,
+	"/control/test_upstream_dns":     true,
+	"/control/tls/validate":          true,
+}
+
+// isMutatingMethod returns true if the HTTP APIs with method change the
+// configuration.
+func isMutatingMethod(method string) (ok bool) {
+	return method == http.MethodPost || method == http.MethodPut || method == http.MethodDelete
+}
+
+// safeMode rejects the requests to the mutating HTTP APIs with url when the
+// safe mode is enabled.  In the safe mode the configuration can only be changed
+// by editing the configuration file and restarting AdGuard Home.
+func safeMode(method, url string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	if !isMutatingMethod(method) || safeModeReadOnlyURLs[url] {
+		return handler
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if Context.safeMode {
+			log.Debug("safe mode: rejecting %s %s", r.Method, r.URL)
+			http.Error(w, "AdGuard Home is running in the safe mode", http.StatusForbidden)
+
+			return
+		}
+
+		handler(w, r)
+	}
+}
@@ -0,0 +1,139 @@
+package home
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafeMode(t *testing.T) {
+	prev := Context.safeMode
+	t.Cleanup(func() { Context.safeMode = prev })
+
+	called := false
+	handler := func(w http.ResponseWriter, _ *http.Request) {
+		called = true
+	}
+
+	testCases := []struct {
+		name     string
+		method   string
+		url      string
+		safeMode bool
+		wantCode int
+	}{{
+		name:     "put_safe",
+		method:   http.MethodPut,
+		url:      "/control/dns_config",
+		safeMode: true,
+		wantCode: http.StatusForbidden,
+	}, {
+		name:     "post_safe",
+		method:   http.MethodPost,
+		url:      "/control/dns_config",
+		safeMode: true,
+		wantCode: http.StatusForbidden,
+	}, {
+		name:     "get_safe",
+		method:   http.MethodGet,
+		url:      "/control/dns_info",
+		safeMode: true,
+		wantCode: http.StatusOK,
+	}, {
+		name:     "read_only_post_safe",
+		method:   http.MethodPost,
+		url:      "/control/test_upstream_dns",
+		safeMode: true,
+		wantCode: http.StatusOK,
+	}, {
+		name:     "put_normal",
+		method:   http.MethodPut,
+		url:      "/control/dns_config",
+		safeMode: false,
+		wantCode: http.StatusOK,
+	}, {
+		name:     "post_normal",
+		method:   http.MethodPost,
+		url:      "/control/dns_config",
+		safeMode: false,
+		wantCode: http.StatusOK,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			Context.safeMode = tc.safeMode
+			called = false
+
+			h := ensureHandler(tc.method, safeMode(tc.method, tc.url, handler))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.url, nil))
+
+			assert.Equal(t, tc.wantCode, w.Code)
+			assert.Equal(t, tc.wantCode == http.StatusOK, called)
+		})
+	}
+}
+
+func TestSafeMode_configWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "safemode")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	prevSafeMode, prevWorkDir, prevFilename := Context.safeMode, Context.workDir, Context.configFilename
+	t.Cleanup(func() {
+		Context.safeMode, Context.workDir, Context.configFilename = prevSafeMode, prevWorkDir, prevFilename
+	})
+
+	Context.safeMode = true
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+
+	assert.Nil(t, config.write())
+
+	_, err = os.Stat(filepath.Join(dir, "AdGuardHome.yaml"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSafeMode_upgradeConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "safemode")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	prevSafeMode, prevWorkDir, prevFilename := Context.safeMode, Context.workDir, Context.configFilename
+	prevFileData := config.fileData
+	t.Cleanup(func() {
+		Context.safeMode, Context.workDir, Context.configFilename = prevSafeMode, prevWorkDir, prevFilename
+		config.fileData = prevFileData
+	})
+
+	Context.safeMode = false
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	config.fileData = nil
+
+	const conf = "schema_version: 1\nsafe_mode: true\ncoredns:\n  bootstrap_dns: 1.1.1.1\n"
+	confPath := filepath.Join(dir, "AdGuardHome.yaml")
+	assert.Nil(t, ioutil.WriteFile(confPath, []byte(conf), 0o644))
+
+	coreFilePath := filepath.Join(dir, "Corefile")
+	assert.Nil(t, ioutil.WriteFile(coreFilePath, nil, 0o644))
+
+	assert.Nil(t, upgradeConfig())
+	assert.True(t, Context.safeMode)
+
+	// Neither the configuration file nor the obsolete files are changed.
+	data, err := ioutil.ReadFile(confPath)
+	assert.Nil(t, err)
+	assert.Equal(t, conf, string(data))
+
+	_, err = os.Stat(coreFilePath)
+	assert.Nil(t, err)
+
+	// The upgraded configuration is still used.
+	assert.Contains(t, string(config.fileData), "schema_version: 7")
+}
@@ -0,0 +1,253 @@
+package home
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Default hosts for the filtering self-test.  The blocked one is blocked by the
+// default AdGuard DNS filter.
+const (
+	defaultSelfTestBlockedHost = "doubleclick.net"
+	defaultSelfTestAllowedHost = "example.com"
+)
+
+// selfTestFirstDelay is the delay before the first self-test, which gives the
+// filters some time to load.
+const selfTestFirstDelay = 1 * time.Minute
+
+// selfTestResult is the result of a filtering self-test.
+type selfTestResult struct {
+	// Time is the time when the self-test was performed.
+	Time time.Time `json:"time"`
+	// Error describes the failure.  It is empty if the self-test passed.
+	Error string `json:"error,omitempty"`
+	// Passed is true if the filtering works.
+	Passed bool `json:"passed"`
+}
+
+// selfTestTimeout is the timeout of a single self-test query.
+const selfTestTimeout = 10 * time.Second
+
+// selfTester periodically checks that the DNS server actually blocks the hosts
+// it should block and doesn't block the others, which catches the silent
+// failures of loading the filters.
+type selfTester struct {
+	// lock protects last and done.
+	lock sync.Mutex
+	last *selfTestResult
+
+	// done is closed to stop the self-tests.  It's nil if they aren't
+	// started.  wg is used to wait for them to stop.
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// start starts the periodic self-tests if they are enabled and haven't been
+// started yet.
+func (st *selfTester) start() {
+	config.RLock()
+	interval := time.Duration(config.DNS.SelfTestInterval) * time.Minute
+	config.RUnlock()
+
+	if interval == 0 {
+		return
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.done != nil {
+		return
+	}
+	st.done = make(chan struct{})
+
+	st.wg.Add(1)
+	go st.loop(st.done, interval)
+}
+
+// stop stops the periodic self-tests, if they are started, and waits for the
+// one in progress, if any, to finish.
+func (st *selfTester) stop() {
+	st.lock.Lock()
+	done := st.done
+	st.done = nil
+	st.lock.Unlock()
+
+	if done == nil {
+		return
+	}
+
+	close(done)
+	st.wg.Wait()
+}
+
+// loop performs a self-test after selfTestFirstDelay and then every interval
+// until done is closed.
+func (st *selfTester) loop(done <-chan struct{}, interval time.Duration) {
+	defer st.wg.Done()
+
+	first := time.NewTimer(selfTestFirstDelay)
+	defer first.Stop()
+
+	select {
+	case <-done:
+		return
+	case <-first.C:
+		// Go on.
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		st.run()
+
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			// Go on.
+		}
+	}
+}
+
+// run performs a self-test using the running DNS server and stores the
+// result.
+func (st *selfTester) run() {
+	config.RLock()
+	blocked := config.DNS.SelfTestBlockedHost
+	if blocked == "" {
+		blocked = defaultSelfTestBlockedHost
+	}
+
+	allowed := config.DNS.SelfTestAllowedHost
+	if allowed == "" {
+		allowed = defaultSelfTestAllowedHost
+	}
+
+	bindhost := config.DNS.BindHost
+	if bindhost.IsUnspecified() {
+		bindhost = net.IPv4(127, 0, 0, 1)
+	}
+	addr := net.JoinHostPort(bindhost.String(), strconv.Itoa(config.DNS.Port))
+	blockingIP := config.DNS.BlockingIPv4
+	config.RUnlock()
+
+	res := runSelfTest(Context.dnsFilter, addr, blockingIP, blocked, allowed)
+	if !res.Passed {
+		log.Error("filtering self-test failed: %s", res.Error)
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	st.last = &res
+}
+
+// result returns the result of the last self-test.  It returns nil if there
+// were none.
+func (st *selfTester) result() (res *selfTestResult) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.last == nil {
+		return nil
+	}
+
+	r := *st.last
+
+	return &r
+}
+
+// runSelfTest checks that the DNS server listening on addr blocks blockedHost
+// and doesn't block allowedHost.  The queries go through the whole request
+// path, so they are also counted in the statistics and the query log.
+// blockingIP is the address of the custom IP blocking mode, if any.  d is only
+// used to report the filters which have no rules.
+func runSelfTest(
+	d *dnsfilter.DNSFilter,
+	addr string,
+	blockingIP net.IP,
+	blockedHost string,
+	allowedHost string,
+) (res selfTestResult) {
+	res.Time = time.Now()
+	if d == nil {
+		res.Error = "filtering is not initialized"
+
+		return res
+	}
+
+	if d.Degraded() {
+		res.Error = "filtering is enabled, but the blocklists have no rules"
+
+		return res
+	}
+
+	blocked, err := selfTestQuery(addr, blockedHost, blockingIP)
+	if err != nil {
+		res.Error = fmt.Sprintf("checking %q: %s", blockedHost, err)
+
+		return res
+	} else if !blocked {
+		res.Error = fmt.Sprintf("%q is not blocked", blockedHost)
+
+		return res
+	}
+
+	blocked, err = selfTestQuery(addr, allowedHost, blockingIP)
+	if err != nil {
+		res.Error = fmt.Sprintf("checking %q: %s", allowedHost, err)
+
+		return res
+	} else if blocked {
+		res.Error = fmt.Sprintf("%q is blocked", allowedHost)
+
+		return res
+	}
+
+	res.Passed = true
+
+	return res
+}
+
+// selfTestQuery sends an A query for host to the DNS server listening on addr
+// and returns true if the response looks like a blocked one, which is the
+// NXDOMAIN or REFUSED one or the one without any addresses other than the
+// unspecified, the loopback, and blockingIP ones.
+func selfTestQuery(addr, host string, blockingIP net.IP) (blocked bool, err error) {
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(host), dns.TypeA)
+
+	c := &dns.Client{Timeout: selfTestTimeout}
+	resp, _, err := c.Exchange(req, addr)
+	if err != nil {
+		return false, err
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeNameError, dns.RcodeRefused:
+		return true, nil
+	case dns.RcodeSuccess:
+		// Go on.
+	default:
+		return false, fmt.Errorf("got rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	for _, ans := range resp.Answer {
+		a, ok := ans.(*dns.A)
+		if ok && !a.A.IsUnspecified() && !a.A.IsLoopback() && !a.A.Equal(blockingIP) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,175 @@
+package home
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// selfTestUpstream is an upstream which answers all queries with 1.2.3.4.
+type selfTestUpstream struct{}
+
+// Exchange implements the upstream.Upstream interface for selfTestUpstream.
+func (selfTestUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   req.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		A: net.IP{1, 2, 3, 4},
+	}}
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for selfTestUpstream.
+func (selfTestUpstream) Address() (addr string) {
+	return "selftest"
+}
+
+// startSelfTestServer starts a DNS server filtering with d and returns the
+// address it listens on.
+func startSelfTestServer(t *testing.T, d *dnsfilter.DNSFilter, mode string) (addr string) {
+	t.Helper()
+
+	// Find a free port, since the server doesn't report the one it
+	// listens on.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	assert.Nil(t, conn.Close())
+
+	s := dnsforward.NewServer(dnsforward.DNSCreateParams{
+		DNSFilter: d,
+		Upstreams: []upstream.Upstream{selfTestUpstream{}},
+	})
+
+	conf := dnsforward.ServerConfig{
+		UDPListenAddr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: port},
+		TCPListenAddr: &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: port},
+	}
+	conf.ProtectionEnabled = true
+	conf.BlockingMode = mode
+	assert.Nil(t, s.Prepare(&conf))
+	assert.Nil(t, s.Start())
+	t.Cleanup(func() { _ = s.Stop() })
+
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+func TestRunSelfTest(t *testing.T) {
+	const (
+		blocked = "blocked.example"
+		allowed = "allowed.example"
+	)
+
+	newFilter := func(t *testing.T, rules string) (d *dnsfilter.DNSFilter) {
+		d = dnsfilter.New(&dnsfilter.Config{}, []dnsfilter.Filter{{
+			ID: 0, Data: []byte(rules),
+		}})
+		t.Cleanup(d.Close)
+
+		return d
+	}
+
+	t.Run("pass", func(t *testing.T) {
+		d := newFilter(t, "||blocked.example^\n")
+		addr := startSelfTestServer(t, d, "default")
+
+		res := runSelfTest(d, addr, nil, blocked, allowed)
+		assert.True(t, res.Passed)
+		assert.Empty(t, res.Error)
+		assert.False(t, res.Time.IsZero())
+	})
+
+	t.Run("pass_nxdomain", func(t *testing.T) {
+		d := newFilter(t, "||blocked.example^\n")
+		addr := startSelfTestServer(t, d, "nxdomain")
+
+		res := runSelfTest(d, addr, nil, blocked, allowed)
+		assert.True(t, res.Passed)
+	})
+
+	t.Run("blocking_ip", func(t *testing.T) {
+		d := newFilter(t, "||blocked.example^\n")
+		addr := startSelfTestServer(t, d, "default")
+
+		// The upstream address is considered the blocking one.
+		res := runSelfTest(d, addr, net.IP{1, 2, 3, 4}, blocked, allowed)
+		assert.False(t, res.Passed)
+		assert.Contains(t, res.Error, "is blocked")
+	})
+
+	t.Run("empty_engine", func(t *testing.T) {
+		d := dnsfilter.New(&dnsfilter.Config{}, nil)
+		t.Cleanup(d.Close)
+		addr := startSelfTestServer(t, d, "default")
+
+		res := runSelfTest(d, addr, nil, blocked, allowed)
+		assert.False(t, res.Passed)
+		assert.Contains(t, res.Error, "is not blocked")
+	})
+
+	t.Run("allowed_blocked", func(t *testing.T) {
+		d := newFilter(t, "||blocked.example^\n||allowed.example^\n")
+		addr := startSelfTestServer(t, d, "default")
+
+		res := runSelfTest(d, addr, nil, blocked, allowed)
+		assert.False(t, res.Passed)
+		assert.Contains(t, res.Error, "is blocked")
+	})
+
+	t.Run("degraded", func(t *testing.T) {
+		d := dnsfilter.New(&dnsfilter.Config{
+			NoRulesAction: dnsfilter.NoRulesActionFallback,
+		}, []dnsfilter.Filter{{
+			ID: 0, Data: []byte("! No rules.\n"),
+		}})
+		t.Cleanup(d.Close)
+
+		res := runSelfTest(d, "127.0.0.1:0", nil, "doubleclick.net", allowed)
+		assert.False(t, res.Passed)
+		assert.Contains(t, res.Error, "no rules")
+	})
+
+	t.Run("no_server", func(t *testing.T) {
+		d := newFilter(t, "||blocked.example^\n")
+
+		// Nothing listens on the discard port.
+		res := runSelfTest(d, "127.0.0.1:9", nil, blocked, allowed)
+		assert.False(t, res.Passed)
+		assert.Contains(t, res.Error, "checking")
+	})
+
+	t.Run("no_filter", func(t *testing.T) {
+		res := runSelfTest(nil, "127.0.0.1:0", nil, blocked, allowed)
+		assert.False(t, res.Passed)
+		assert.NotEmpty(t, res.Error)
+	})
+}
+
+func TestSelfTester_stop(t *testing.T) {
+	st := &selfTester{}
+
+	// Stopping the self-tests which aren't started does nothing.
+	st.stop()
+
+	st.done = make(chan struct{})
+	st.wg.Add(1)
+	go st.loop(st.done, selfTestFirstDelay)
+
+	st.stop()
+	assert.Nil(t, st.done)
+	assert.Nil(t, st.result())
+}
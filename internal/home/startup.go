@@ -0,0 +1,49 @@
+package home
+
+import (
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// dhcpReadiness is the part of the DHCP server the DNS server waits for on
+// startup.
+type dhcpReadiness interface {
+	// Ready returns a channel which is closed once the DHCP server has
+	// loaded its leases and started.
+	Ready() (ready <-chan struct{})
+}
+
+// waitForDHCP blocks until dhcp is ready or until timeout has passed.  It
+// doesn't block if the DHCP server isn't enabled.  ok is false if the timeout
+// has passed.
+func waitForDHCP(dhcp dhcpReadiness, enabled bool, timeout time.Duration) (ok bool) {
+	if !enabled {
+		return true
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-dhcp.Ready():
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// waitDHCPStartup defers the start of the DNS server until the DHCP server has
+// started, if that's configured.  See dnsConfig.StartupDHCPWait.
+func waitDHCPStartup() {
+	timeout := time.Duration(config.DNS.StartupDHCPWait) * time.Second
+	if timeout == 0 || Context.dhcpServer == nil {
+		return
+	}
+
+	log.Debug("dns: waiting for dhcp server for up to %s", timeout)
+
+	if !waitForDHCP(Context.dhcpServer, config.DHCP.Enabled, timeout) {
+		log.Info("dns: dhcp server hasn't started in %s, starting anyway", timeout)
+	}
+}
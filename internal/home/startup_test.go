@@ -0,0 +1,57 @@
+package home
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testDHCPReadiness is a dhcpReadiness for tests.
+type testDHCPReadiness struct {
+	ready chan struct{}
+}
+
+// Ready implements the dhcpReadiness interface for *testDHCPReadiness.
+func (r *testDHCPReadiness) Ready() (ready <-chan struct{}) {
+	return r.ready
+}
+
+func TestWaitForDHCP(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		dhcp := &testDHCPReadiness{ready: make(chan struct{})}
+
+		done := make(chan bool, 1)
+		go func() {
+			done <- waitForDHCP(dhcp, true, time.Minute)
+		}()
+
+		select {
+		case <-done:
+			assert.Fail(t, "dns readiness isn't deferred")
+		case <-time.After(50 * time.Millisecond):
+			// Go on.
+		}
+
+		close(dhcp.ready)
+
+		select {
+		case ok := <-done:
+			assert.True(t, ok)
+		case <-time.After(time.Second):
+			assert.Fail(t, "dns isn't ready after dhcp")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		dhcp := &testDHCPReadiness{ready: make(chan struct{})}
+
+		assert.True(t, waitForDHCP(dhcp, false, time.Minute))
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		dhcp := &testDHCPReadiness{ready: make(chan struct{})}
+
+		assert.False(t, waitForDHCP(dhcp, true, time.Millisecond))
+	})
+}
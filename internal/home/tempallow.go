@@ -0,0 +1,171 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// maxTempAllowDuration is the maximum duration of a temporary allowlisting.
+const maxTempAllowDuration = 24 * time.Hour
+
+// tempAllowlist is the set of the domains allowlisted temporarily.  They are
+// added to the custom filtering rules as the important allowlist rules until
+// they expire.  They aren't saved to the configuration file.
+type tempAllowlist struct {
+	lock sync.Mutex
+	// expires maps the domains to the times from which they aren't
+	// allowlisted anymore.
+	expires map[string]time.Time
+	// onExpire, if not nil, is called after the expired domains are
+	// removed.
+	onExpire func()
+}
+
+// tempAllowJSON is the temporarily allowlisted domain in the filtering status.
+type tempAllowJSON struct {
+	Domain string `json:"domain"`
+	// RemainingSeconds is the number of seconds left before the domain
+	// expires.
+	RemainingSeconds uint32 `json:"remaining_seconds"`
+}
+
+// validateTempAllowDomain returns an error if domain can't be allowlisted.
+// The domain must be in lowercase without the trailing dot.
+func validateTempAllowDomain(domain string) (err error) {
+	if domain == "" {
+		return fmt.Errorf("domain is empty")
+	}
+
+	for _, c := range domain {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return fmt.Errorf("invalid character %q in domain %q", c, domain)
+		}
+	}
+
+	return nil
+}
+
+// add allowlists domain for dur from now.  If domain is already allowlisted,
+// its expiration time is replaced.
+func (l *tempAllowlist) add(domain string, dur time.Duration, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.expires == nil {
+		l.expires = map[string]time.Time{}
+	}
+	l.expires[domain] = now.Add(dur)
+
+	time.AfterFunc(dur, l.expire)
+}
+
+// expire removes the expired domains and calls onExpire if there were any.
+func (l *tempAllowlist) expire() {
+	if !l.removeExpired(time.Now()) {
+		return
+	}
+
+	l.lock.Lock()
+	onExpire := l.onExpire
+	l.lock.Unlock()
+
+	if onExpire != nil {
+		onExpire()
+	}
+}
+
+// removeExpired removes the domains expired by now.  It returns true if any
+// were removed.
+func (l *tempAllowlist) removeExpired(now time.Time) (removed bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for domain, exp := range l.expires {
+		if !now.Before(exp) {
+			log.Debug("filtering: temporary allowlisting of %s expired", domain)
+			delete(l.expires, domain)
+			removed = true
+		}
+	}
+
+	return removed
+}
+
+// domains returns the domains allowlisted at now sorted alphabetically along
+// with their remaining times.
+func (l *tempAllowlist) domains(now time.Time) (tas []tempAllowJSON) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for domain, exp := range l.expires {
+		if !now.Before(exp) {
+			continue
+		}
+
+		// Round up, so that a domain is never reported with zero
+		// seconds left while it's still allowlisted.
+		rem := (exp.Sub(now) + time.Second - 1) / time.Second
+		tas = append(tas, tempAllowJSON{
+			Domain:           domain,
+			RemainingSeconds: uint32(rem),
+		})
+	}
+
+	sort.Slice(tas, func(i, j int) bool { return tas[i].Domain < tas[j].Domain })
+
+	return tas
+}
+
+// rules returns the filtering rules allowlisting the domains at now.
+func (l *tempAllowlist) rules(now time.Time) (rules []string) {
+	for _, ta := range l.domains(now) {
+		rules = append(rules, "@@||"+ta.Domain+"^$important")
+	}
+
+	return rules
+}
+
+// handleFilteringTempAllow is the handler for the POST
+// /control/filtering/temp_allow HTTP API.
+func (f *Filtering) handleFilteringTempAllow(w http.ResponseWriter, r *http.Request) {
+	type tempAllowReq struct {
+		Domain string `json:"domain"`
+		// Duration is the duration of the allowlisting in seconds.
+		Duration uint32 `json:"duration"`
+	}
+
+	req := tempAllowReq{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	domain := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(req.Domain)), ".")
+	err = validateTempAllowDomain(domain)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	dur := time.Duration(req.Duration) * time.Second
+	if dur <= 0 || dur > maxTempAllowDuration {
+		httpError(w, http.StatusBadRequest, "duration must be from 1 to %d seconds", maxTempAllowDuration/time.Second)
+
+		return
+	}
+
+	f.tempAllow.add(domain, dur, time.Now())
+	log.Info("filtering: allowlisted %s for %s", domain, dur)
+
+	enableFiltersChanged(true, []int64{0})
+}
@@ -0,0 +1,142 @@
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTempAllowlist_domains(t *testing.T) {
+	now := time.Now()
+	l := &tempAllowlist{}
+	l.add("b.example", time.Hour, now)
+	l.add("a.example", 90*time.Second, now)
+
+	assert.Equal(t, []tempAllowJSON{{
+		Domain:           "a.example",
+		RemainingSeconds: 60,
+	}, {
+		Domain:           "b.example",
+		RemainingSeconds: 3570,
+	}}, l.domains(now.Add(30*time.Second)))
+
+	assert.Equal(t, []string{"@@||b.example^$important"}, l.rules(now.Add(2*time.Minute)))
+
+	assert.True(t, l.removeExpired(now.Add(2*time.Minute)))
+	assert.False(t, l.removeExpired(now.Add(2*time.Minute)))
+	assert.Len(t, l.expires, 1)
+}
+
+// resetTempAllow removes all temporarily allowlisted domains of the global
+// filtering module.
+func resetTempAllow() {
+	l := &Context.filters.tempAllow
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.expires = nil
+	l.onExpire = nil
+}
+
+func TestFiltering_tempAllow(t *testing.T) {
+	prevRules := config.UserRules
+	t.Cleanup(func() {
+		config.UserRules = prevRules
+		resetTempAllow()
+	})
+
+	config.UserRules = []string{"||blocked.example^$important"}
+
+	expired := make(chan struct{}, 1)
+	Context.filters.tempAllow.onExpire = func() { expired <- struct{}{} }
+
+	setts := &dnsfilter.RequestFilteringSettings{FilteringEnabled: true}
+	isBlocked := func() (ok bool) {
+		d := dnsfilter.New(&dnsfilter.Config{}, []dnsfilter.Filter{userFilter().Filter})
+		defer d.Close()
+
+		res, err := d.CheckHost("blocked.example", dns.TypeA, setts)
+		assert.Nil(t, err)
+
+		return res.IsFiltered
+	}
+
+	assert.True(t, isBlocked())
+
+	Context.filters.tempAllow.add("blocked.example", 200*time.Millisecond, time.Now())
+	assert.False(t, isBlocked())
+
+	select {
+	case <-expired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("temporary allowlisting didn't expire")
+	}
+
+	assert.True(t, isBlocked())
+	assert.Empty(t, Context.filters.tempAllow.domains(time.Now()))
+}
+
+func TestFiltering_handleFilteringTempAllow(t *testing.T) {
+	prevEnabled := config.DNS.FilteringEnabled
+	t.Cleanup(func() {
+		config.DNS.FilteringEnabled = prevEnabled
+		resetTempAllow()
+	})
+
+	config.DNS.FilteringEnabled = false
+	Context.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, nil)
+	t.Cleanup(func() {
+		Context.dnsFilter.Close()
+		Context.dnsFilter = nil
+	})
+
+	testCases := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{{
+		name:     "ok",
+		body:     `{"domain":"Blocked.Example.","duration":3600}`,
+		wantCode: http.StatusOK,
+	}, {
+		name:     "bad_domain",
+		body:     `{"domain":"||blocked.example^","duration":3600}`,
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "zero_duration",
+		body:     `{"domain":"blocked.example","duration":0}`,
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "long_duration",
+		body:     `{"domain":"blocked.example","duration":86401}`,
+		wantCode: http.StatusBadRequest,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/control/filtering/temp_allow", bytes.NewBufferString(tc.body))
+			w := httptest.NewRecorder()
+			Context.filters.handleFilteringTempAllow(w, r)
+			assert.Equal(t, tc.wantCode, w.Code)
+		})
+	}
+
+	w := httptest.NewRecorder()
+	Context.filters.handleFilteringStatus(w, httptest.NewRequest(http.MethodGet, "/control/filtering/status", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	resp := filteringConfig{}
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+	if assert.Len(t, resp.TempAllowed, 1) {
+		assert.Equal(t, "blocked.example", resp.TempAllowed[0].Domain)
+		assert.Greater(t, resp.TempAllowed[0].RemainingSeconds, uint32(3590))
+		assert.LessOrEqual(t, resp.TempAllowed[0].RemainingSeconds, uint32(3600))
+	}
+}
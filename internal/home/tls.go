@@ -47,6 +47,7 @@ func tlsCreate(conf tlsConfigSettings) *TLSMod {
 				PortDNSOverTLS:      conf.PortDNSOverTLS,
 				PortDNSOverQUIC:     conf.PortDNSOverQUIC,
 				AllowUnencryptedDOH: conf.AllowUnencryptedDOH,
+				MaxHTTPSConnections: conf.MaxHTTPSConnections,
 			}}
 		}
 		t.setCertFileTime()
@@ -30,6 +30,12 @@ func upgradeConfig() error {
 		return err
 	}
 
+	// Apply the safe mode from the configuration file before the upgrade,
+	// so that nothing is written to disk.
+	if safeMode, _ := diskConfig["safe_mode"].(bool); safeMode {
+		Context.safeMode = true
+	}
+
 	schemaVersionInterface, ok := diskConfig["schema_version"]
 	log.Tracef("got schema version %v", schemaVersionInterface)
 	if !ok {
@@ -110,6 +116,12 @@ func upgradeConfigSchema(oldVersion int, diskConfig *map[string]interface{}) err
 	}
 
 	config.fileData = body
+	if Context.safeMode {
+		log.Info("Safe mode: the upgraded configuration is not saved")
+
+		return nil
+	}
+
 	err = file.SafeWrite(configFile, body)
 	if err != nil {
 		log.Printf("Couldn't save YAML config: %s", err)
@@ -125,7 +137,7 @@ func upgradeSchema0to1(diskConfig *map[string]interface{}) error {
 	log.Printf("%s(): called", funcName())
 
 	dnsFilterPath := filepath.Join(Context.workDir, "dnsfilter.txt")
-	if _, err := os.Stat(dnsFilterPath); !os.IsNotExist(err) {
+	if _, err := os.Stat(dnsFilterPath); !os.IsNotExist(err) && !Context.safeMode {
 		log.Printf("Deleting %s as we don't need it anymore", dnsFilterPath)
 		err = os.Remove(dnsFilterPath)
 		if err != nil {
@@ -146,7 +158,7 @@ func upgradeSchema1to2(diskConfig *map[string]interface{}) error {
 	log.Printf("%s(): called", funcName())
 
 	coreFilePath := filepath.Join(Context.workDir, "Corefile")
-	if _, err := os.Stat(coreFilePath); !os.IsNotExist(err) {
+	if _, err := os.Stat(coreFilePath); !os.IsNotExist(err) && !Context.safeMode {
 		log.Printf("Deleting %s as we don't need it anymore", coreFilePath)
 		err = os.Remove(coreFilePath)
 		if err != nil {
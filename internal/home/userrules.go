@@ -0,0 +1,112 @@
+package home
+
+import (
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// userRuleMetaPrefix is the prefix of the comments with the metadata of the
+// next custom filtering rule, for example "! meta: owner=alice
+// expires=2025-01-01".
+const userRuleMetaPrefix = "! meta:"
+
+// userRuleMetaExpires is the metadata key of the date from which the rule is
+// expired.
+const userRuleMetaExpires = "expires"
+
+// userRuleExpiresLayout is the layout of the values of userRuleMetaExpires.
+const userRuleExpiresLayout = "2006-01-02"
+
+// userRuleMeta is the metadata of a custom filtering rule.
+type userRuleMeta struct {
+	Meta    map[string]string `json:"meta"`
+	Rule    string            `json:"rule"`
+	Expired bool              `json:"expired"`
+}
+
+// isUserRule returns true if line is a filtering rule and not a comment or an
+// empty line.
+func isUserRule(line string) (ok bool) {
+	line = strings.TrimSpace(line)
+
+	return line != "" && line[0] != '!' && line[0] != '#'
+}
+
+// parseUserRuleMeta parses the key-value pairs of the metadata comment.
+func parseUserRuleMeta(comment string) (meta map[string]string) {
+	meta = map[string]string{}
+	for _, f := range strings.Fields(strings.TrimPrefix(comment, userRuleMetaPrefix)) {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			log.Debug("user rules: skipping invalid metadata field %q", f)
+
+			continue
+		}
+
+		meta[kv[0]] = kv[1]
+	}
+
+	return meta
+}
+
+// isExpired returns true if the expiration date in meta isn't after now.
+func isExpired(meta map[string]string, now time.Time) (ok bool) {
+	v, ok := meta[userRuleMetaExpires]
+	if !ok {
+		return false
+	}
+
+	exp, err := time.ParseInLocation(userRuleExpiresLayout, v, now.Location())
+	if err != nil {
+		log.Debug("user rules: invalid expiration date %q: %s", v, err)
+
+		return false
+	}
+
+	return !now.Before(exp)
+}
+
+// scanUserRules returns the metadata of the custom filtering rules in lines
+// which have it as well as lines without the expired rules and their
+// metadata comments.  A metadata comment belongs to the next rule.
+func scanUserRules(lines []string, now time.Time) (active []string, metas []userRuleMeta) {
+	active = make([]string, 0, len(lines))
+
+	metaIdx := -1
+	var meta map[string]string
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), userRuleMetaPrefix) {
+			metaIdx = len(active)
+			meta = parseUserRuleMeta(strings.TrimSpace(line))
+			active = append(active, line)
+
+			continue
+		}
+
+		if !isUserRule(line) || meta == nil {
+			active = append(active, line)
+
+			continue
+		}
+
+		m := userRuleMeta{
+			Meta:    meta,
+			Rule:    strings.TrimSpace(line),
+			Expired: isExpired(meta, now),
+		}
+		metas = append(metas, m)
+
+		if m.Expired {
+			// Remove the metadata comment as well.
+			active = append(active[:metaIdx], active[metaIdx+1:]...)
+		} else {
+			active = append(active, line)
+		}
+
+		metaIdx, meta = -1, nil
+	}
+
+	return active, metas
+}
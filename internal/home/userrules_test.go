@@ -0,0 +1,94 @@
+package home
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanUserRules(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	lines := []string{
+		"! meta: owner=alice expires=2025-01-01",
+		"||active.example^",
+		"! An ordinary comment.",
+		"||plain.example^",
+		"! meta: owner=bob expires=2024-06-01 bad",
+		"",
+		"||expired.example^",
+	}
+
+	active, metas := scanUserRules(lines, now)
+	assert.Equal(t, []string{
+		"! meta: owner=alice expires=2025-01-01",
+		"||active.example^",
+		"! An ordinary comment.",
+		"||plain.example^",
+		"",
+	}, active)
+	assert.Equal(t, []userRuleMeta{{
+		Meta: map[string]string{
+			"owner":   "alice",
+			"expires": "2025-01-01",
+		},
+		Rule:    "||active.example^",
+		Expired: false,
+	}, {
+		Meta: map[string]string{
+			"owner":   "bob",
+			"expires": "2024-06-01",
+		},
+		Rule:    "||expired.example^",
+		Expired: true,
+	}}, metas)
+}
+
+func TestUserFilter_expired(t *testing.T) {
+	prevRules, prevDisable := config.UserRules, config.UserRulesDisableExpired
+	t.Cleanup(func() {
+		config.UserRules, config.UserRulesDisableExpired = prevRules, prevDisable
+	})
+
+	config.UserRules = []string{
+		"! meta: owner=alice expires=2000-01-01",
+		"||expired.example^",
+		"! meta: owner=alice",
+		"||active.example^",
+	}
+
+	testCases := []struct {
+		name        string
+		disable     bool
+		wantExpired bool
+	}{{
+		name:        "disabled",
+		disable:     true,
+		wantExpired: false,
+	}, {
+		name:        "kept",
+		disable:     false,
+		wantExpired: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config.UserRulesDisableExpired = tc.disable
+
+			d := dnsfilter.New(&dnsfilter.Config{}, []dnsfilter.Filter{userFilter().Filter})
+			t.Cleanup(d.Close)
+
+			setts := &dnsfilter.RequestFilteringSettings{FilteringEnabled: true}
+
+			res, err := d.CheckHost("expired.example", dns.TypeA, setts)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.wantExpired, res.IsFiltered)
+
+			res, err = d.CheckHost("active.example", dns.TypeA, setts)
+			assert.Nil(t, err)
+			assert.True(t, res.IsFiltered)
+		})
+	}
+}
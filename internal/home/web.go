@@ -36,6 +36,11 @@ type webConfig struct {
 	BetaBindPort int
 	PortHTTPS    int
 
+	// MaxHTTPSConnections is the maximum number of the concurrently open
+	// connections to the HTTPS server.  See
+	// tlsConfigSettings.MaxHTTPSConnections.
+	MaxHTTPSConnections uint32
+
 	// ReadTimeout is an option to pass to http.Server for setting an
 	// appropriate field.
 	ReadTimeout time.Duration
@@ -127,6 +132,7 @@ func WebCheckPortAvailable(port int) bool {
 func (web *Web) TLSConfigChanged(ctx context.Context, tlsConf tlsConfigSettings) {
 	log.Debug("Web: applying new TLS configuration")
 	web.conf.PortHTTPS = tlsConf.PortHTTPS
+	web.conf.MaxHTTPSConnections = tlsConf.MaxHTTPSConnections
 	web.forceHTTPS = (tlsConf.ForceHTTPS && tlsConf.Enabled && tlsConf.PortHTTPS != 0)
 
 	enabled := tlsConf.Enabled &&
@@ -266,7 +272,14 @@ func (web *Web) tlsServerLoop() {
 		}
 
 		printHTTPAddresses("https")
-		err := web.httpsServer.server.ListenAndServeTLS("", "")
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			cleanupAlways()
+			log.Fatal(err)
+		}
+
+		l = newConnLimitListener(l, "https", web.conf.MaxHTTPSConnections)
+		err = web.httpsServer.server.ServeTLS(l, "", "")
 		if err != http.ErrServerClosed {
 			cleanupAlways()
 			log.Fatal(err)
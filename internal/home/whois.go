@@ -27,6 +27,17 @@ type Whois struct {
 	clients *clientsContainer
 	ipChan  chan net.IP
 
+	// ipDetector is used to skip the IP addresses from the special-purpose
+	// networks, such as the private ones, which have no WHOIS information.
+	ipDetector *ipDetector
+
+	// server is the address of the WHOIS server queried first.
+	server string
+
+	// interval is the minimum time between two WHOIS queries.  If it's
+	// zero, the queries aren't rate-limited.
+	interval time.Duration
+
 	// Contains IP addresses of clients
 	// An active IP address is resolved once again after it expires.
 	// If IP address couldn't be resolved, it stays here for some time to prevent further attempts to resolve the same IP.
@@ -36,11 +47,14 @@ type Whois struct {
 	timeoutMsec uint
 }
 
-// initWhois creates the Whois module context.
-func initWhois(clients *clientsContainer) *Whois {
+// initWhois creates the Whois module context.  ratelimit is the maximum
+// number of WHOIS queries per minute, zero means no limit.
+func initWhois(clients *clientsContainer, ipd *ipDetector, ratelimit uint32) *Whois {
 	w := Whois{
 		timeoutMsec: 5000,
 		clients:     clients,
+		ipDetector:  ipd,
+		server:      net.JoinHostPort(defaultServer, defaultPort),
 		ipAddrs: cache.New(cache.Config{
 			EnableLRU: true,
 			MaxCount:  10000,
@@ -48,6 +62,10 @@ func initWhois(clients *clientsContainer) *Whois {
 		ipChan: make(chan net.IP, 255),
 	}
 
+	if ratelimit > 0 {
+		w.interval = time.Minute / time.Duration(ratelimit)
+	}
+
 	go w.workerLoop()
 
 	return &w
@@ -156,7 +174,7 @@ func (w *Whois) query(ctx context.Context, target, serverAddr string) (string, e
 
 // Query WHOIS servers (handle redirects)
 func (w *Whois) queryAll(ctx context.Context, target string) (string, error) {
-	server := net.JoinHostPort(defaultServer, defaultPort)
+	server := w.server
 	const maxRedirects = 5
 	for i := 0; i != maxRedirects; i++ {
 		resp, err := w.query(ctx, target, server)
@@ -210,8 +228,13 @@ func (w *Whois) process(ctx context.Context, ip net.IP) [][]string {
 	return data
 }
 
-// Begin - begin requesting WHOIS info
+// Begin - begin requesting WHOIS info.  The IP addresses from the
+// special-purpose networks are skipped.
 func (w *Whois) Begin(ip net.IP) {
+	if w.ipDetector.detectSpecialNetwork(ip) {
+		return
+	}
+
 	now := uint64(time.Now().Unix())
 	expire := w.ipAddrs.Get([]byte(ip))
 	if len(expire) != 0 {
@@ -241,11 +264,13 @@ func (w *Whois) workerLoop() {
 		ip := <-w.ipChan
 
 		info := w.process(context.Background(), ip)
-		if len(info) == 0 {
-			continue
+		if len(info) != 0 {
+			id := ip.String()
+			w.clients.SetWhoisInfo(id, info)
 		}
 
-		id := ip.String()
-		w.clients.SetWhoisInfo(id, info)
+		// Keep within the rate limit.  The addresses coming in the
+		// meantime wait in the channel.
+		time.Sleep(w.interval)
 	}
 }
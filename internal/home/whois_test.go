@@ -1,10 +1,15 @@
 package home
 
 import (
+	"bufio"
 	"context"
+	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"github.com/AdguardTeam/golibs/cache"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,7 +24,10 @@ func prepareTestDNSServer() error {
 func TestWhois(t *testing.T) {
 	assert.Nil(t, prepareTestDNSServer())
 
-	w := Whois{timeoutMsec: 5000}
+	w := Whois{
+		timeoutMsec: 5000,
+		server:      net.JoinHostPort(defaultServer, defaultPort),
+	}
 	resp, err := w.queryAll(context.Background(), "8.8.8.8")
 	assert.Nil(t, err)
 	m := whoisParse(resp)
@@ -27,3 +35,89 @@ func TestWhois(t *testing.T) {
 	assert.Equal(t, "US", m["country"])
 	assert.Equal(t, "Mountain View", m["city"])
 }
+
+// startWhoisStub starts a WHOIS server which answers all queries with resp.
+// The queries it receives are sent to queries.
+func startWhoisStub(t *testing.T, resp string) (addr string, queries chan string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	queries = make(chan string, 16)
+	go func() {
+		for {
+			c, aerr := l.Accept()
+			if aerr != nil {
+				return
+			}
+
+			q, _ := bufio.NewReader(c).ReadString('\n')
+			queries <- strings.TrimSpace(q)
+
+			_, _ = c.Write([]byte(resp))
+			_ = c.Close()
+		}
+	}()
+
+	return l.Addr().String(), queries
+}
+
+func TestWhois_Begin(t *testing.T) {
+	const resp = "OrgName: Stub Org\nCountry: AU\nCity: Sydney\n"
+
+	addr, queries := startWhoisStub(t, resp)
+
+	clients := &clientsContainer{testing: true}
+	clients.Init(nil, nil, nil)
+
+	ipd, err := newIPDetector()
+	assert.Nil(t, err)
+
+	w := &Whois{
+		clients:     clients,
+		ipChan:      make(chan net.IP, 255),
+		ipDetector:  ipd,
+		server:      addr,
+		ipAddrs:     cache.New(cache.Config{EnableLRU: true, MaxCount: 10}),
+		timeoutMsec: 1000,
+	}
+	go w.workerLoop()
+
+	const (
+		privateIP = "192.168.1.1"
+		publicIP  = "1.2.3.4"
+	)
+
+	w.Begin(net.ParseIP(privateIP))
+	w.Begin(net.ParseIP(publicIP))
+
+	// The single worker processes the addresses in order, so the private
+	// address would have been queried first.
+	select {
+	case q := <-queries:
+		assert.Equal(t, publicIP, q)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "no whois query")
+	}
+
+	assert.Eventually(t, func() bool {
+		_, ok := clients.FindAutoClient(publicIP)
+
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ch, ok := clients.FindAutoClient(publicIP)
+	if assert.True(t, ok) {
+		assert.Equal(t, [][]string{
+			{"orgname", "Stub Org"},
+			{"country", "AU"},
+			{"city", "Sydney"},
+		}, ch.WhoisInfo)
+	}
+
+	_, ok = clients.FindAutoClient(privateIP)
+	assert.False(t, ok)
+	assert.Empty(t, queries)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,6 +28,26 @@ var logEntryHandlers = map[string]logEntryHandler{
 
 		return nil
 	},
+	"QE": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(string)
+		if !ok {
+			return nil
+		}
+
+		ent.ReqEDNS = v
+
+		return nil
+	},
+	"AE": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(string)
+		if !ok {
+			return nil
+		}
+
+		ent.RespEDNS = v
+
+		return nil
+	},
 	"IP": func(t json.Token, ent *logEntry) error {
 		v, ok := t.(string)
 		if !ok {
@@ -119,6 +140,21 @@ var logEntryHandlers = map[string]logEntryHandler{
 		ent.Elapsed = time.Duration(i)
 		return nil
 	},
+	"RC": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(json.Number)
+		if !ok {
+			return nil
+		}
+
+		n, err := strconv.ParseUint(string(v), 10, 32)
+		if err != nil {
+			return err
+		}
+
+		ent.Repeats = uint32(n)
+
+		return nil
+	},
 }
 
 var resultHandlers = map[string]logEntryHandler{
@@ -197,11 +233,21 @@ var resultHandlers = map[string]logEntryHandler{
 
 		ent.Result.CanonName = s
 
+		return nil
+	},
+	"CNAMETarget": func(t json.Token, ent *logEntry) error {
+		s, ok := t.(string)
+		if !ok {
+			return nil
+		}
+
+		ent.Result.CNAMETarget = s
+
 		return nil
 	},
 }
 
-func decodeResultRuleKey(key string, i int, dec *json.Decoder, ent *logEntry) {
+func decodeResultRuleKey(key string, i int, dec *json.Decoder, resRules *[]*dnsfilter.ResultRule) {
 	switch key {
 	case "FilterListID":
 		vToken, err := dec.Token()
@@ -213,12 +259,29 @@ func decodeResultRuleKey(key string, i int, dec *json.Decoder, ent *logEntry) {
 			return
 		}
 
-		if len(ent.Result.Rules) < i+1 {
-			ent.Result.Rules = append(ent.Result.Rules, &dnsfilter.ResultRule{})
+		if len(*resRules) < i+1 {
+			*resRules = append(*resRules, &dnsfilter.ResultRule{})
 		}
 
 		if n, ok := vToken.(json.Number); ok {
-			ent.Result.Rules[i].FilterListID, _ = n.Int64()
+			(*resRules)[i].FilterListID, _ = n.Int64()
+		}
+	case "FilterListName":
+		vToken, err := dec.Token()
+		if err != nil {
+			if err != io.EOF {
+				log.Debug("decodeResultRuleKey %s err: %s", key, err)
+			}
+
+			return
+		}
+
+		if len(*resRules) < i+1 {
+			*resRules = append(*resRules, &dnsfilter.ResultRule{})
+		}
+
+		if s, ok := vToken.(string); ok {
+			(*resRules)[i].FilterListName = s
 		}
 	case "IP":
 		vToken, err := dec.Token()
@@ -230,12 +293,12 @@ func decodeResultRuleKey(key string, i int, dec *json.Decoder, ent *logEntry) {
 			return
 		}
 
-		if len(ent.Result.Rules) < i+1 {
-			ent.Result.Rules = append(ent.Result.Rules, &dnsfilter.ResultRule{})
+		if len(*resRules) < i+1 {
+			*resRules = append(*resRules, &dnsfilter.ResultRule{})
 		}
 
 		if ipStr, ok := vToken.(string); ok {
-			ent.Result.Rules[i].IP = net.ParseIP(ipStr)
+			(*resRules)[i].IP = net.ParseIP(ipStr)
 		}
 	case "Text":
 		vToken, err := dec.Token()
@@ -247,19 +310,20 @@ func decodeResultRuleKey(key string, i int, dec *json.Decoder, ent *logEntry) {
 			return
 		}
 
-		if len(ent.Result.Rules) < i+1 {
-			ent.Result.Rules = append(ent.Result.Rules, &dnsfilter.ResultRule{})
+		if len(*resRules) < i+1 {
+			*resRules = append(*resRules, &dnsfilter.ResultRule{})
 		}
 
 		if s, ok := vToken.(string); ok {
-			ent.Result.Rules[i].Text = s
+			(*resRules)[i].Text = s
 		}
 	default:
 		// Go on.
 	}
 }
 
-func decodeResultRules(dec *json.Decoder, ent *logEntry) {
+// decodeResultRules decodes a JSON array of rules into resRules.
+func decodeResultRules(dec *json.Decoder, resRules *[]*dnsfilter.ResultRule) {
 	for {
 		delimToken, err := dec.Token()
 		if err != nil {
@@ -306,7 +370,7 @@ func decodeResultRules(dec *json.Decoder, ent *logEntry) {
 				return
 			}
 
-			decodeResultRuleKey(key, i, dec, ent)
+			decodeResultRuleKey(key, i, dec, resRules)
 		}
 	}
 }
@@ -497,7 +561,11 @@ func decodeResult(dec *json.Decoder, ent *logEntry) {
 
 			continue
 		case "Rules":
-			decodeResultRules(dec, ent)
+			decodeResultRules(dec, &ent.Result.Rules)
+
+			continue
+		case "MonitorRules":
+			decodeResultRules(dec, &ent.Result.MonitorRules)
 
 			continue
 		case "DNSRewriteResult":
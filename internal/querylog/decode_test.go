@@ -41,7 +41,9 @@ func TestDecodeLogEntry(t *testing.T) {
 			`{"FilterListID":43,"Text":"||an2.yandex.ru","IP":"127.0.0.3"}],` +
 			`"CanonName":"example.com",` +
 			`"ServiceName":"example.org",` +
-			`"DNSRewriteResult":{"RCode":0,"Response":{"1":["127.0.0.2"]}}},` +
+			`"CNAMETarget":"tracker.example.com",` +
+			`"DNSRewriteResult":{"RCode":0,"Response":{"1":["127.0.0.2"]}},` +
+			`"MonitorRules":[{"FilterListID":44,"Text":"||yandex.ru^"}]},` +
 			`"Elapsed":837429}`
 
 		ans, err := base64.StdEncoding.DecodeString(ansStr)
@@ -72,12 +74,17 @@ func TestDecodeLogEntry(t *testing.T) {
 				}},
 				CanonName:   "example.com",
 				ServiceName: "example.org",
+				CNAMETarget: "tracker.example.com",
 				DNSRewriteResult: &dnsfilter.DNSRewriteResult{
 					RCode: dns.RcodeSuccess,
 					Response: dnsfilter.DNSRewriteResultResponse{
 						dns.TypeA: []rules.RRValue{net.IPv4(127, 0, 0, 2)},
 					},
 				},
+				MonitorRules: []*dnsfilter.ResultRule{{
+					FilterListID: 44,
+					Text:         "||yandex.ru^",
+				}},
 			},
 			Elapsed: 837429,
 		}
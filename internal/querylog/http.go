@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/util"
@@ -20,12 +21,23 @@ type qlogConfig struct {
 	AnonymizeClientIP bool   `json:"anonymize_client_ip"`
 }
 
+// qlogInfo is the response of the query log info HTTP API.
+type qlogInfo struct {
+	qlogConfig
+
+	// AllowedUnlogged is the number of the queries which haven't matched
+	// anything and haven't been logged since the start or the last
+	// clearing of the log.
+	AllowedUnlogged uint64 `json:"allowed_unlogged"`
+}
+
 // Register web handlers
 func (l *queryLog) initWeb() {
 	l.conf.HTTPRegister("GET", "/control/querylog", l.handleQueryLog)
 	l.conf.HTTPRegister("GET", "/control/querylog_info", l.handleQueryLogInfo)
 	l.conf.HTTPRegister("POST", "/control/querylog_clear", l.handleQueryLogClear)
 	l.conf.HTTPRegister("POST", "/control/querylog_config", l.handleQueryLogConfig)
+	l.conf.HTTPRegister("GET", "/control/querylog_export", l.handleQueryLogExport)
 }
 
 func httpError(r *http.Request, w http.ResponseWriter, code int, format string, args ...interface{}) {
@@ -62,16 +74,43 @@ func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// maxExportEntries is the maximum number of the entries exported at once.
+const maxExportEntries = 1000000
+
+// handleQueryLogExport exports the query log in the format from the "format"
+// query parameter.  Currently, only "pihole" is supported, which is an SQLite
+// database in the format of the Pi-hole's long-term database.
+func (l *queryLog) handleQueryLogExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "pihole" {
+		httpError(r, w, http.StatusBadRequest, "unsupported format %q", format)
+		return
+	}
+
+	params := newSearchParams()
+	params.limit = maxExportEntries
+	params.maxFileScanEntries = 0
+	entries, _ := l.search(params)
+
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", `attachment; filename="pihole-FTL.db"`)
+	err := l.writePihole(w, entries)
+	if err != nil {
+		log.Info("QueryLog: %s %s: writing export: %s", r.Method, r.URL, err)
+	}
+}
+
 func (l *queryLog) handleQueryLogClear(_ http.ResponseWriter, _ *http.Request) {
 	l.clear()
 }
 
 // Get configuration
 func (l *queryLog) handleQueryLogInfo(w http.ResponseWriter, r *http.Request) {
-	resp := qlogConfig{}
+	resp := qlogInfo{}
 	resp.Enabled = l.conf.Enabled
 	resp.Interval = l.conf.Interval
 	resp.AnonymizeClientIP = l.conf.AnonymizeClientIP
+	resp.AllowedUnlogged = atomic.LoadUint64(&l.allowedUnlogged)
 
 	jsonVal, err := json.Marshal(resp)
 	if err != nil {
@@ -84,6 +84,18 @@ func (l *queryLog) logEntryToJSONEntry(entry *logEntry) (jsonEntry jobject) {
 		jsonEntry["client_id"] = entry.ClientID
 	}
 
+	if entry.Repeats != 0 {
+		jsonEntry["repeat_count"] = entry.Repeats
+	}
+
+	if entry.ReqEDNS != "" {
+		jsonEntry["request_edns_options"] = strings.Split(entry.ReqEDNS, ",")
+	}
+
+	if entry.RespEDNS != "" {
+		jsonEntry["response_edns_options"] = strings.Split(entry.RespEDNS, ",")
+	}
+
 	if msg != nil {
 		jsonEntry["status"] = dns.RcodeToString[msg.Rcode]
 
@@ -103,6 +115,18 @@ func (l *queryLog) logEntryToJSONEntry(entry *logEntry) (jsonEntry jobject) {
 		jsonEntry["filterId"] = entry.Result.Rules[0].FilterListID
 	}
 
+	if entry.Result.CNAMETarget != "" {
+		jsonEntry["cname_target"] = entry.Result.CNAMETarget
+	}
+
+	if len(entry.Result.MonitorRules) != 0 {
+		jsonEntry["monitor_rules"] = resultRulesToJSONRules(entry.Result.MonitorRules)
+	}
+
+	if len(entry.Result.AllRules) != 0 {
+		jsonEntry["all_rules"] = resultRulesToJSONRules(entry.Result.AllRules)
+	}
+
 	if len(entry.Result.ServiceName) != 0 {
 		jsonEntry["service_name"] = entry.Result.ServiceName
 	}
@@ -135,6 +159,9 @@ func resultRulesToJSONRules(rules []*dnsfilter.ResultRule) (jsonRules []jobject)
 			"filter_list_id": r.FilterListID,
 			"text":           r.Text,
 		}
+		if r.FilterListName != "" {
+			jsonRules[i]["filter_list_name"] = r.FilterListName
+		}
 	}
 
 	return jsonRules
@@ -0,0 +1,159 @@
+package querylog
+
+import (
+	"io"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+)
+
+// piholeSchema is the layout of the queries table of the Pi-hole's FTL
+// long-term database.
+const piholeSchema = `CREATE TABLE queries (` +
+	`id INTEGER PRIMARY KEY AUTOINCREMENT, ` +
+	`timestamp INTEGER NOT NULL, ` +
+	`type INTEGER NOT NULL, ` +
+	`status INTEGER NOT NULL, ` +
+	`domain TEXT NOT NULL, ` +
+	`client TEXT NOT NULL, ` +
+	`forward TEXT, ` +
+	`additional_info TEXT)`
+
+// sqliteSequenceSchema is the layout of the table in which SQLite keeps the
+// last rowids of the AUTOINCREMENT tables.
+const sqliteSequenceSchema = `CREATE TABLE sqlite_sequence(name,seq)`
+
+// Pi-hole query statuses.
+const (
+	piholeStatusUnknown      = 0
+	piholeStatusGravity      = 1
+	piholeStatusForwarded    = 2
+	piholeStatusCache        = 3
+	piholeStatusRegex        = 4
+	piholeStatusBlacklist    = 5
+	piholeStatusGravityCNAME = 9
+)
+
+// piholeTypes maps the query types to the Pi-hole ones.  The other types are
+// exported as OTHER.
+var piholeTypes = map[string]int{
+	"A":      1,
+	"AAAA":   2,
+	"ANY":    3,
+	"SRV":    4,
+	"SOA":    5,
+	"PTR":    6,
+	"TXT":    7,
+	"NAPTR":  8,
+	"MX":     9,
+	"DS":     10,
+	"RRSIG":  11,
+	"DNSKEY": 12,
+	"NS":     13,
+	"SVCB":   15,
+	"HTTPS":  16,
+}
+
+// piholeTypeOther is the Pi-hole type of the queries of the other types.
+const piholeTypeOther = 14
+
+// piholeStatus returns the Pi-hole status of the query.
+func piholeStatus(ent *logEntry) (status int) {
+	switch ent.Result.Reason {
+	case dnsfilter.NotFilteredNotFound,
+		dnsfilter.NotFilteredAllowList,
+		dnsfilter.NotFilteredError:
+		if ent.Upstream == "" {
+			return piholeStatusCache
+		}
+
+		return piholeStatusForwarded
+	case dnsfilter.FilteredBlockList,
+		dnsfilter.FilteredSafeBrowsing,
+		dnsfilter.FilteredParental,
+		dnsfilter.FilteredInvalid:
+		if ent.Result.CNAMETarget != "" {
+			return piholeStatusGravityCNAME
+		}
+
+		return piholeStatusGravity
+	case dnsfilter.FilteredBlockedService,
+		dnsfilter.FilteredGeo:
+		return piholeStatusBlacklist
+	case dnsfilter.FilteredTLD,
+		dnsfilter.FilteredDGA:
+		return piholeStatusRegex
+	case dnsfilter.FilteredSafeSearch,
+		dnsfilter.Rewritten,
+		dnsfilter.RewrittenAutoHosts,
+		dnsfilter.RewrittenRule:
+		// Pi-hole answers its local records from the cache.
+		return piholeStatusCache
+	default:
+		return piholeStatusUnknown
+	}
+}
+
+// piholeForward returns the upstream address in the Pi-hole's format, that
+// is "host#port".
+func piholeForward(upstream string) (fwd string) {
+	if strings.Contains(upstream, "://") {
+		return upstream
+	}
+
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return upstream
+	}
+
+	return host + "#" + port
+}
+
+// writePihole writes entries to w as an SQLite database with the queries
+// table of the Pi-hole's long-term database.  entries must be sorted from newer
+// to older ones, as returned by search.
+func (l *queryLog) writePihole(w io.Writer, entries []*logEntry) (err error) {
+	rows := make([][]interface{}, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		ent := entries[i]
+
+		typ, ok := piholeTypes[ent.QType]
+		if !ok {
+			typ = piholeTypeOther
+		}
+
+		var fwd interface{}
+		if ent.Upstream != "" {
+			fwd = piholeForward(ent.Upstream)
+		}
+
+		var client string
+		if ip := l.getClientIP(ent.IP); ip != nil {
+			client = ip.String()
+		}
+
+		rows = append(rows, []interface{}{
+			// id is the rowid.
+			nil,
+			ent.Time.Unix(),
+			int64(typ),
+			int64(piholeStatus(ent)),
+			ent.QHost,
+			client,
+			fwd,
+			// additional_info.
+			nil,
+		})
+	}
+
+	return writeSQLite(w, []sqliteTable{{
+		name: "queries",
+		sql:  piholeSchema,
+		rows: rows,
+	}, {
+		name: "sqlite_sequence",
+		sql:  sqliteSequenceSchema,
+		rows: [][]interface{}{{"queries", int64(len(rows))}},
+	}})
+}
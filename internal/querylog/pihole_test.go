@@ -0,0 +1,79 @@
+package querylog
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryLog_handleQueryLogExport(t *testing.T) {
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	add := func(host string, qtype uint16, client net.IP, upstream string, res *dnsfilter.Result) {
+		q := &dns.Msg{}
+		q.SetQuestion(host, qtype)
+		l.Add(AddParams{
+			Question: q,
+			Result:   res,
+			ClientIP: client,
+			Upstream: upstream,
+		})
+	}
+
+	add("forwarded.example.", dns.TypeA, net.IP{192, 168, 0, 1}, "8.8.8.8:53", nil)
+	add("blocked.example.", dns.TypeAAAA, net.IP{192, 168, 0, 2}, "", &dnsfilter.Result{
+		IsFiltered: true,
+		Reason:     dnsfilter.FilteredBlockList,
+	})
+	add("cname.example.", dns.TypeA, net.IP{192, 168, 0, 2}, "", &dnsfilter.Result{
+		IsFiltered:  true,
+		Reason:      dnsfilter.FilteredBlockList,
+		CNAMETarget: "tracker.example",
+	})
+	add("o'cached.example.", dns.TypeMX, net.ParseIP("2001:db8::1"), "", nil)
+	add("doh.example.", dns.TypeHTTPS, net.IP{192, 168, 0, 1}, "https://dns.example/dns-query", nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/control/querylog_export?format=pihole", nil)
+	w := httptest.NewRecorder()
+	l.handleQueryLogExport(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/vnd.sqlite3", w.Header().Get("Content-Type"))
+
+	db := newSQLiteReader(t, w.Body.Bytes())
+
+	schema := db.rows(1)
+	if assert.Len(t, schema, 2) {
+		assert.Equal(t, piholeSchema, schema[0][4])
+	}
+
+	ts := func(i int) int64 { return l.buffer[i].Time.Unix() }
+	// The columns are id, timestamp, type, status, domain, client, forward,
+	// and additional_info.
+	assert.Equal(t, [][]interface{}{
+		{int64(1), ts(0), int64(1), int64(2), "forwarded.example", "192.168.0.1", "8.8.8.8#53", nil},
+		{int64(2), ts(1), int64(2), int64(1), "blocked.example", "192.168.0.2", nil, nil},
+		{int64(3), ts(2), int64(1), int64(9), "cname.example", "192.168.0.2", nil, nil},
+		{int64(4), ts(3), int64(9), int64(3), "o'cached.example", "2001:db8::1", nil, nil},
+		{int64(5), ts(4), int64(16), int64(2), "doh.example", "192.168.0.1", "https://dns.example/dns-query", nil},
+	}, db.table("queries"))
+
+	assert.Equal(t, [][]interface{}{{"queries", int64(5)}}, db.table("sqlite_sequence"))
+
+	r = httptest.NewRequest(http.MethodGet, "/control/querylog_export?format=csv", nil)
+	w = httptest.NewRecorder()
+	l.handleQueryLogExport(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
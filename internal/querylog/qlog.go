@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
@@ -22,6 +23,17 @@ const (
 
 // queryLog is a structure that writes and reads the DNS query log
 type queryLog struct {
+	// allowedSeen is the number of queries which haven't matched anything.
+	// It is used for sampling and must only be accessed atomically.  It is
+	// the first field to keep it 64-bit aligned on 32-bit platforms.
+	allowedSeen uint64
+
+	// allowedUnlogged is the number of queries which haven't matched
+	// anything and haven't been logged because of AllowedCountOnly or
+	// AllowedSampleRate.  It must only be accessed atomically and is kept
+	// 64-bit aligned the same way allowedSeen is.
+	allowedUnlogged uint64
+
 	conf    *Config
 	lock    sync.Mutex
 	logFile string // path to the log file
@@ -79,6 +91,15 @@ type logEntry struct {
 	Result   dnsfilter.Result
 	Elapsed  time.Duration
 	Upstream string `json:",omitempty"` // if empty, means it was cached
+
+	// Repeats is the number of the identical blocked queries collapsed into
+	// this entry after it had been logged.  See Config.DedupBlockedSeconds.
+	Repeats uint32 `json:"RC,omitempty"`
+
+	// ReqEDNS and RespEDNS are the comma-separated names of the EDNS
+	// options of the query and the response.  See Config.Verbose.
+	ReqEDNS  string `json:"QE,omitempty"`
+	RespEDNS string `json:"AE,omitempty"`
 }
 
 // create a new instance of the query log
@@ -122,6 +143,8 @@ func (l *queryLog) clear() {
 	l.flushPending = false
 	l.bufferLock.Unlock()
 
+	atomic.StoreUint64(&l.allowedUnlogged, 0)
+
 	oldLogFile := l.logFile + ".1"
 	err := os.Remove(oldLogFile)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
@@ -150,6 +173,10 @@ func (l *queryLog) Add(params AddParams) {
 		params.Result = &dnsfilter.Result{}
 	}
 
+	if !l.admit(params.Result) {
+		return
+	}
+
 	now := time.Now()
 	entry := logEntry{
 		IP:   l.getClientIP(params.ClientIP),
@@ -161,6 +188,11 @@ func (l *queryLog) Add(params AddParams) {
 		ClientID:    params.ClientID,
 		ClientProto: params.ClientProto,
 	}
+	if l.conf.Verbose {
+		entry.ReqEDNS = strings.Join(params.ReqEDNSOptions, ",")
+		entry.RespEDNS = strings.Join(params.RespEDNSOptions, ",")
+	}
+
 	q := params.Question.Question[0]
 	entry.QHost = strings.ToLower(q.Name[:len(q.Name)-1]) // remove the last dot
 	entry.QType = dns.Type(q.Qtype).String()
@@ -185,13 +217,20 @@ func (l *queryLog) Add(params AddParams) {
 	}
 
 	l.bufferLock.Lock()
+	if l.collapseLocked(&entry) {
+		l.bufferLock.Unlock()
+
+		return
+	}
+
 	l.buffer = append(l.buffer, &entry)
 	needFlush := false
 
 	if !l.conf.FileEnabled {
-		if len(l.buffer) > int(l.conf.MemSize) {
-			// writing to file is disabled - just remove the oldest entry from array
-			l.buffer = l.buffer[1:]
+		if n := len(l.buffer) - int(l.conf.MemSize); n > 0 {
+			// writing to file is disabled - just remove the oldest entries
+			// from array
+			l.buffer = l.buffer[n:]
 		}
 	} else if !l.flushPending {
 		needFlush = len(l.buffer) >= int(l.conf.MemSize)
@@ -208,3 +247,77 @@ func (l *queryLog) Add(params AddParams) {
 		}()
 	}
 }
+
+// collapseLocked looks for the previous query of the same client in the
+// buffer and, if both queries are blocked queries for the same host and type
+// and the previous one is recent enough, increases its repeat count instead of
+// logging ent.  It returns true if ent has been collapsed.  The entries which
+// have already been flushed to the file aren't updated.  l.bufferLock is
+// expected to be locked.
+func (l *queryLog) collapseLocked(ent *logEntry) (ok bool) {
+	window := time.Duration(l.conf.DedupBlockedSeconds) * time.Second
+	if window == 0 || !ent.Result.IsFiltered {
+		return false
+	}
+
+	for i := len(l.buffer) - 1; i >= 0; i-- {
+		prev := l.buffer[i]
+		if ent.Time.Sub(prev.Time) >= window {
+			return false
+		}
+
+		if !prev.IP.Equal(ent.IP) || prev.ClientID != ent.ClientID {
+			continue
+		}
+
+		if !prev.Result.IsFiltered || prev.QHost != ent.QHost || prev.QType != ent.QType {
+			return false
+		}
+
+		// Replace the entry instead of updating it, since the search
+		// may be using it concurrently.
+		upd := *prev
+		upd.Repeats++
+		l.buffer[i] = &upd
+
+		return true
+	}
+
+	return false
+}
+
+// admit returns true if the query with the filtering result res should be
+// written to the log.  The queries which matched any filtering rules or
+// rewrites are always admitted, while the rest are sampled according to the
+// configuration.  The queries which aren't admitted are counted in
+// allowedUnlogged.  Note that the statistics are collected separately, so
+// they are counted there as well.
+func (l *queryLog) admit(res *dnsfilter.Result) (ok bool) {
+	if res.IsFiltered || res.Reason.Matched() {
+		return true
+	}
+
+	ok = l.admitAllowed()
+	if !ok {
+		atomic.AddUint64(&l.allowedUnlogged, 1)
+	}
+
+	return ok
+}
+
+// admitAllowed returns true if the query which hasn't matched anything should
+// be written to the log.
+func (l *queryLog) admitAllowed() (ok bool) {
+	if l.conf.AllowedCountOnly {
+		return false
+	}
+
+	rate := uint64(l.conf.AllowedSampleRate)
+	if rate <= 1 {
+		return true
+	}
+
+	n := atomic.AddUint64(&l.allowedSeen, 1)
+
+	return (n-1)%rate == 0
+}
@@ -1,6 +1,7 @@
 package querylog
 
 import (
+	"encoding/json"
 	"math/rand"
 	"net"
 	"os"
@@ -216,6 +217,72 @@ func TestQueryLogFileDisabled(t *testing.T) {
 	assert.Equal(t, "example2.org", ll[1].QHost)
 }
 
+func TestQueryLog_fileDisabledSearch(t *testing.T) {
+	conf := Config{
+		Enabled:     true,
+		FileEnabled: true,
+		Interval:    1,
+		MemSize:     100,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	addEntry(l, "disk.example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	assert.Nil(t, l.flushLogBuffer(true))
+
+	// Reopen the log with the file disabled.
+	conf.FileEnabled = false
+	conf.MemSize = 2
+	l = newQueryLog(conf)
+
+	addEntry(l, "mem1.example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "mem2.example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "mem3.example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+
+	entries, _ := l.search(newSearchParams())
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "mem3.example.org", entries[0].QHost)
+		assert.Equal(t, "mem2.example.org", entries[1].QHost)
+	}
+}
+
+func TestQueryLog_smallMemSize(t *testing.T) {
+	conf := Config{
+		Enabled:     true,
+		FileEnabled: true,
+		Interval:    1,
+		MemSize:     2,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	hosts := []string{
+		"1.example.org",
+		"2.example.org",
+		"3.example.org",
+		"4.example.org",
+		"5.example.org",
+	}
+	for _, h := range hosts {
+		addEntry(l, h, net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	}
+	assert.Nil(t, l.flushLogBuffer(true))
+
+	// The newest entry stays in memory.
+	addEntry(l, "6.example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	l.bufferLock.Lock()
+	assert.LessOrEqual(t, len(l.buffer), int(conf.MemSize))
+	l.bufferLock.Unlock()
+
+	entries, _ := l.search(newSearchParams())
+	if assert.Len(t, entries, 6) {
+		assert.Equal(t, "6.example.org", entries[0].QHost)
+		assert.Equal(t, "1.example.org", entries[5].QHost)
+	}
+}
+
 func addEntry(l *queryLog, host string, answerStr, client net.IP) {
 	q := dns.Msg{}
 	q.Question = append(q.Question, dns.Question{
@@ -337,3 +404,165 @@ func TestLogEntriesByTime_sort(t *testing.T) {
 			"%s %s", entries[i].Time, entries[i-1].Time)
 	}
 }
+
+func TestQueryLog_AllowedSampling(t *testing.T) {
+	add := func(l *queryLog, reason dnsfilter.Reason) {
+		q := &dns.Msg{}
+		q.SetQuestion("example.org.", dns.TypeA)
+		l.Add(AddParams{
+			Question: q,
+			Result: &dnsfilter.Result{
+				IsFiltered: reason == dnsfilter.FilteredBlockList,
+				Reason:     reason,
+			},
+			ClientIP: net.IP{1, 2, 3, 4},
+		})
+	}
+
+	newLog := func(rate uint32, countOnly bool) (l *queryLog) {
+		return newQueryLog(Config{
+			Enabled:           true,
+			Interval:          1,
+			MemSize:           100,
+			AllowedSampleRate: rate,
+			AllowedCountOnly:  countOnly,
+		})
+	}
+
+	t.Run("blocked_always", func(t *testing.T) {
+		l := newLog(10, false)
+		for i := 0; i < 5; i++ {
+			add(l, dnsfilter.FilteredBlockList)
+			add(l, dnsfilter.Rewritten)
+		}
+		assert.Len(t, l.buffer, 10)
+	})
+
+	t.Run("allowed_sampled", func(t *testing.T) {
+		l := newLog(10, false)
+		for i := 0; i < 30; i++ {
+			add(l, dnsfilter.NotFilteredNotFound)
+		}
+		assert.Len(t, l.buffer, 3)
+		assert.Equal(t, uint64(27), l.allowedUnlogged)
+	})
+
+	t.Run("allowed_all", func(t *testing.T) {
+		l := newLog(0, false)
+		for i := 0; i < 30; i++ {
+			add(l, dnsfilter.NotFilteredNotFound)
+		}
+		assert.Len(t, l.buffer, 30)
+	})
+
+	t.Run("allowed_count_only", func(t *testing.T) {
+		l := newLog(10, true)
+		for i := 0; i < 30; i++ {
+			add(l, dnsfilter.NotFilteredNotFound)
+		}
+		add(l, dnsfilter.FilteredBlockList)
+		assert.Len(t, l.buffer, 1)
+		assert.Equal(t, uint64(30), l.allowedUnlogged)
+
+		l.clear()
+		assert.Zero(t, l.allowedUnlogged)
+	})
+}
+
+func TestQueryLog_DedupBlocked(t *testing.T) {
+	add := func(l *queryLog, host string, blocked bool) {
+		q := &dns.Msg{}
+		q.SetQuestion(host, dns.TypeA)
+		l.Add(AddParams{
+			Question: q,
+			Result: &dnsfilter.Result{
+				IsFiltered: blocked,
+				Reason:     dnsfilter.FilteredBlockList,
+			},
+			ClientIP: net.IP{1, 2, 3, 4},
+		})
+	}
+
+	l := newQueryLog(Config{
+		Enabled:             true,
+		Interval:            1,
+		MemSize:             100,
+		DedupBlockedSeconds: 60,
+	})
+
+	for i := 0; i < 5; i++ {
+		add(l, "example.org.", true)
+	}
+
+	if assert.Len(t, l.buffer, 1) {
+		assert.Equal(t, uint32(4), l.buffer[0].Repeats)
+	}
+
+	add(l, "example.net.", true)
+	add(l, "example.org.", true)
+	add(l, "example.org.", true)
+
+	if assert.Len(t, l.buffer, 3) {
+		assert.Equal(t, "example.net", l.buffer[1].QHost)
+		assert.Equal(t, uint32(0), l.buffer[1].Repeats)
+		assert.Equal(t, "example.org", l.buffer[2].QHost)
+		assert.Equal(t, uint32(1), l.buffer[2].Repeats)
+	}
+
+	data, err := json.Marshal(l.buffer[0])
+	assert.Nil(t, err)
+
+	ent := &logEntry{}
+	decodeLogEntry(ent, string(data))
+	assert.Equal(t, uint32(4), ent.Repeats)
+}
+
+func TestQueryLog_VerboseEDNS(t *testing.T) {
+	params := func() (p AddParams) {
+		q := &dns.Msg{}
+		q.SetQuestion("example.org.", dns.TypeA)
+
+		return AddParams{
+			Question:        q,
+			ClientIP:        net.IP{1, 2, 3, 4},
+			ReqEDNSOptions:  []string{"ecs", "cookie"},
+			RespEDNSOptions: []string{"padding"},
+		}
+	}
+
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+	}
+
+	l := newQueryLog(conf)
+	l.Add(params())
+	if assert.Len(t, l.buffer, 1) {
+		assert.Empty(t, l.buffer[0].ReqEDNS)
+		assert.Empty(t, l.buffer[0].RespEDNS)
+
+		jent := l.logEntryToJSONEntry(l.buffer[0])
+		assert.NotContains(t, jent, "request_edns_options")
+		assert.NotContains(t, jent, "response_edns_options")
+	}
+
+	conf.Verbose = true
+	l = newQueryLog(conf)
+	l.Add(params())
+	if !assert.Len(t, l.buffer, 1) {
+		return
+	}
+
+	data, err := json.Marshal(l.buffer[0])
+	assert.Nil(t, err)
+
+	ent := &logEntry{}
+	decodeLogEntry(ent, string(data))
+	assert.Equal(t, "ecs,cookie", ent.ReqEDNS)
+	assert.Equal(t, "padding", ent.RespEDNS)
+
+	jent := l.logEntryToJSONEntry(ent)
+	assert.Equal(t, []string{"ecs", "cookie"}, jent["request_edns_options"])
+	assert.Equal(t, []string{"padding"}, jent["response_edns_options"])
+}
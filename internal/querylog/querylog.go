@@ -26,12 +26,36 @@ type QueryLog interface {
 // Config - configuration object
 type Config struct {
 	Enabled           bool   // enable the module
-	FileEnabled       bool   // write logs to file
+	FileEnabled       bool   // write logs to file; if false, only the last MemSize entries are kept and searched
 	BaseDir           string // directory where log file is stored
 	Interval          uint32 // interval to rotate logs (in days)
 	MemSize           uint32 // number of entries kept in memory before they are flushed to disk
 	AnonymizeClientIP bool   // anonymize clients' IP addresses
 
+	// AllowedSampleRate makes the query log keep only one of every
+	// AllowedSampleRate queries which haven't matched any filtering rules or
+	// rewrites.  Blocked, allowlisted, and rewritten queries are always
+	// logged.  If it is 0 or 1, all queries are logged.
+	AllowedSampleRate uint32
+
+	// AllowedCountOnly makes the query log only count the queries which
+	// haven't matched any filtering rules or rewrites instead of logging
+	// them.  It takes precedence over AllowedSampleRate.  The number of
+	// such queries, including the ones skipped by the sampling, is
+	// reported by the query log info HTTP API.
+	AllowedCountOnly bool
+
+	// DedupBlockedSeconds, if not zero, makes the query log collapse the
+	// blocked queries repeating the client's previous blocked query for the
+	// same host and type within this many seconds into the entry of that
+	// previous query, increasing its repeat count.  The statistics still
+	// count every query.
+	DedupBlockedSeconds uint32
+
+	// Verbose makes the query log record the names of the EDNS options of
+	// the queries and the responses.
+	Verbose bool
+
 	// Called when the configuration is changed by HTTP request
 	ConfigModified func()
 
@@ -50,6 +74,12 @@ type AddParams struct {
 	ClientIP    net.IP
 	Upstream    string // Upstream server URL
 	ClientProto ClientProto
+
+	// ReqEDNSOptions and RespEDNSOptions are the names of the EDNS options
+	// of the query received from the client and of the response.  They are
+	// only logged if Config.Verbose is true.
+	ReqEDNSOptions  []string
+	RespEDNSOptions []string
 }
 
 // New - create a new instance of the query log
@@ -18,8 +18,14 @@ func (l *queryLog) search(params *searchParams) ([]*logEntry, time.Time) {
 		return []*logEntry{}, time.Time{}
 	}
 
-	// add from file
-	fileEntries, oldest, total := l.searchFiles(params)
+	// add from file, unless writing to it is disabled, in which case only the
+	// in-memory entries are kept
+	var fileEntries []*logEntry
+	var oldest time.Time
+	var total int
+	if l.conf.FileEnabled {
+		fileEntries, oldest, total = l.searchFiles(params)
+	}
 
 	// add from memory buffer
 	l.bufferLock.Lock()
@@ -134,7 +134,13 @@ func (c *searchCriteria) ctFilteringStatusCase(res dnsfilter.Result) bool {
 
 	case filteringStatusBlocked:
 		return res.IsFiltered &&
-			res.Reason.In(dnsfilter.FilteredBlockList, dnsfilter.FilteredBlockedService)
+			res.Reason.In(
+				dnsfilter.FilteredBlockList,
+				dnsfilter.FilteredBlockedService,
+				dnsfilter.FilteredTLD,
+				dnsfilter.FilteredDGA,
+				dnsfilter.FilteredGeo,
+			)
 
 	case filteringStatusBlockedService:
 		return res.IsFiltered && res.Reason == dnsfilter.FilteredBlockedService
@@ -162,6 +168,9 @@ func (c *searchCriteria) ctFilteringStatusCase(res dnsfilter.Result) bool {
 		return !res.Reason.In(
 			dnsfilter.FilteredBlockList,
 			dnsfilter.FilteredBlockedService,
+			dnsfilter.FilteredTLD,
+			dnsfilter.FilteredDGA,
+			dnsfilter.FilteredGeo,
 			dnsfilter.NotFilteredAllowList,
 		)
 
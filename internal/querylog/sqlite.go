@@ -0,0 +1,358 @@
+package querylog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// This file contains a minimal writer of the SQLite database files.  It only
+// supports writing whole databases of rowid tables at once, which is enough
+// for the exports, and doesn't require cgo.  See
+// https://www.sqlite.org/fileformat2.html.
+
+// sqlitePageSize is the size of the pages of the written databases.
+const sqlitePageSize = 4096
+
+// sqliteMaxPayload is the maximum size of a record which fits into a table
+// leaf page without overflow pages, which aren't supported.
+const sqliteMaxPayload = sqlitePageSize - 35
+
+// The types of the b-tree pages.
+const (
+	sqlitePageTableInterior = 0x05
+	sqlitePageTableLeaf     = 0x0d
+)
+
+// sqliteTable is a rowid table to write.
+type sqliteTable struct {
+	// name is the name of the table.
+	name string
+
+	// sql is the CREATE TABLE statement of the table.
+	sql string
+
+	// rows are the rows of the table.  Their rowids are their indexes plus
+	// one.  The values must be of types int64, string, or nil.  The
+	// INTEGER PRIMARY KEY columns, which are aliases for the rowid, must be
+	// nil.
+	rows [][]interface{}
+}
+
+// sqliteChild is a page of a b-tree with the largest rowid on it.
+type sqliteChild struct {
+	page   uint32
+	maxKey int64
+}
+
+// sqliteWriter builds the pages of a database.
+type sqliteWriter struct {
+	// pages are the pages starting from the second one, since the first
+	// one is written last.
+	pages [][]byte
+}
+
+// writeSQLite writes a database with tables to w.
+func writeSQLite(w io.Writer, tables []sqliteTable) (err error) {
+	sw := &sqliteWriter{}
+
+	master := sqliteTable{
+		rows: make([][]interface{}, len(tables)),
+	}
+	for i, t := range tables {
+		var root uint32
+		root, err = sw.writeTable(t.rows)
+		if err != nil {
+			return fmt.Errorf("table %s: %w", t.name, err)
+		}
+
+		master.rows[i] = []interface{}{"table", t.name, t.name, int64(root), t.sql}
+	}
+
+	cells, err := sqliteLeafCells(master.rows)
+	if err != nil {
+		return fmt.Errorf("schema: %w", err)
+	}
+
+	first := make([]byte, sqlitePageSize)
+	if !sqliteFillPage(first, 100, sqlitePageTableLeaf, cells, 0) {
+		return fmt.Errorf("schema: too many tables")
+	}
+	sqliteWriteHeader(first, uint32(len(sw.pages)+1))
+
+	_, err = w.Write(first)
+	for _, p := range sw.pages {
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(p)
+	}
+
+	return err
+}
+
+// writeTable writes the b-tree of the table with rows and returns the number
+// of its root page.
+func (sw *sqliteWriter) writeTable(rows [][]interface{}) (root uint32, err error) {
+	cells, err := sqliteLeafCells(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	var children []sqliteChild
+	for start := 0; start < len(cells) || len(children) == 0; {
+		page := make([]byte, sqlitePageSize)
+		n := sqliteFitCells(cells[start:], sqlitePageSize-8)
+		sqliteFillPage(page, 0, sqlitePageTableLeaf, cells[start:start+n], 0)
+		start += n
+
+		children = append(children, sqliteChild{
+			page:   sw.addPage(page),
+			maxKey: int64(start),
+		})
+	}
+
+	for len(children) > 1 {
+		children = sw.writeInterior(children)
+	}
+
+	return children[0].page, nil
+}
+
+// writeInterior writes the interior pages pointing to children and returns
+// them.
+func (sw *sqliteWriter) writeInterior(children []sqliteChild) (parents []sqliteChild) {
+	// A cell of an interior page is a four-byte page number and a varint
+	// rowid of at most nine bytes, plus its two-byte pointer.
+	const maxChildren = (sqlitePageSize-12)/(4+9+2) + 1
+
+	// Distribute the children evenly, so that each page has at least one
+	// cell in addition to the right-most pointer.
+	n := (len(children) + maxChildren - 1) / maxChildren
+	per := (len(children) + n - 1) / n
+	for start := 0; start < len(children); start += per {
+		end := start + per
+		if end > len(children) {
+			end = len(children)
+		}
+
+		chunk := children[start:end]
+		last := chunk[len(chunk)-1]
+
+		cells := make([][]byte, len(chunk)-1)
+		for i, c := range chunk[:len(chunk)-1] {
+			cell := make([]byte, 4, 4+9)
+			binary.BigEndian.PutUint32(cell, c.page)
+			cells[i] = sqliteAppendVarint(cell, uint64(c.maxKey))
+		}
+
+		page := make([]byte, sqlitePageSize)
+		sqliteFillPage(page, 0, sqlitePageTableInterior, cells, last.page)
+
+		parents = append(parents, sqliteChild{
+			page:   sw.addPage(page),
+			maxKey: last.maxKey,
+		})
+	}
+
+	return parents
+}
+
+// addPage adds page and returns its number.
+func (sw *sqliteWriter) addPage(page []byte) (num uint32) {
+	sw.pages = append(sw.pages, page)
+
+	// The first page is the schema one.
+	return uint32(len(sw.pages) + 1)
+}
+
+// sqliteFitCells returns the number of the first cells which fit into the
+// space of a page.
+func sqliteFitCells(cells [][]byte, space int) (n int) {
+	for _, c := range cells {
+		space -= len(c) + 2
+		if space < 0 {
+			break
+		}
+
+		n++
+	}
+
+	return n
+}
+
+// sqliteFillPage writes the b-tree page header starting at off and cells into
+// page.  right is the right-most pointer of the interior pages.  It returns
+// false if the cells don't fit into page.
+func sqliteFillPage(page []byte, off int, typ byte, cells [][]byte, right uint32) (ok bool) {
+	hdrLen := 8
+	if typ == sqlitePageTableInterior {
+		hdrLen = 12
+	}
+
+	if sqliteFitCells(cells, len(page)-off-hdrLen) != len(cells) {
+		return false
+	}
+
+	page[off] = typ
+	binary.BigEndian.PutUint16(page[off+3:], uint16(len(cells)))
+	if typ == sqlitePageTableInterior {
+		binary.BigEndian.PutUint32(page[off+8:], right)
+	}
+
+	content := len(page)
+	ptr := off + hdrLen
+	for _, c := range cells {
+		content -= len(c)
+		copy(page[content:], c)
+		binary.BigEndian.PutUint16(page[ptr:], uint16(content))
+		ptr += 2
+	}
+
+	// Zero means 65536, which is never the case for the pages of this size.
+	binary.BigEndian.PutUint16(page[off+5:], uint16(content))
+
+	return true
+}
+
+// sqliteWriteHeader writes the database header into the first page of a
+// database of size pages.
+func sqliteWriteHeader(page []byte, size uint32) {
+	copy(page, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(page[16:], sqlitePageSize)
+	// File format write and read versions, legacy.
+	page[18], page[19] = 1, 1
+	// Maximum and minimum embedded payload fractions and leaf payload
+	// fraction, which must be these values.
+	page[21], page[22], page[23] = 64, 32, 32
+	// File change counter.
+	binary.BigEndian.PutUint32(page[24:], 1)
+	binary.BigEndian.PutUint32(page[28:], size)
+	// Schema cookie.
+	binary.BigEndian.PutUint32(page[40:], 1)
+	// Schema format number.
+	binary.BigEndian.PutUint32(page[44:], 4)
+	// Text encoding, UTF-8.
+	binary.BigEndian.PutUint32(page[56:], 1)
+	// Version-valid-for number, the same as the file change counter.
+	binary.BigEndian.PutUint32(page[92:], 1)
+	// SQLite version number, 3.8.0 since the format hasn't changed since.
+	binary.BigEndian.PutUint32(page[96:], 3008000)
+}
+
+// sqliteLeafCells returns the cells of the table leaf pages for rows.
+func sqliteLeafCells(rows [][]interface{}) (cells [][]byte, err error) {
+	cells = make([][]byte, len(rows))
+	for i, row := range rows {
+		var rec []byte
+		rec, err = sqliteRecord(row)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", i+1, err)
+		}
+
+		if len(rec) > sqliteMaxPayload {
+			return nil, fmt.Errorf("row %d: record of %d bytes is too large", i+1, len(rec))
+		}
+
+		cell := make([]byte, 0, 9+9+len(rec))
+		cell = sqliteAppendVarint(cell, uint64(len(rec)))
+		cell = sqliteAppendVarint(cell, uint64(i+1))
+		cells[i] = append(cell, rec...)
+	}
+
+	return cells, nil
+}
+
+// sqliteRecord returns the record of the values.
+func sqliteRecord(vals []interface{}) (rec []byte, err error) {
+	var types, body []byte
+	for _, v := range vals {
+		switch v := v.(type) {
+		case nil:
+			types = sqliteAppendVarint(types, 0)
+		case int64:
+			typ, b := sqliteInt(v)
+			types = sqliteAppendVarint(types, typ)
+			body = append(body, b...)
+		case string:
+			types = sqliteAppendVarint(types, uint64(len(v))*2+13)
+			body = append(body, v...)
+		default:
+			return nil, fmt.Errorf("unsupported value type %T", v)
+		}
+	}
+
+	// The size of the header includes the varint of the size itself.
+	hdrLen := uint64(len(types)) + 1
+	if hdrLen >= 0x80 {
+		hdrLen++
+	}
+
+	rec = sqliteAppendVarint(rec, hdrLen)
+	rec = append(rec, types...)
+
+	return append(rec, body...), nil
+}
+
+// sqliteInt returns the serial type and the big-endian bytes of the smallest
+// representation of v.
+func sqliteInt(v int64) (typ uint64, b []byte) {
+	switch {
+	case v == 0:
+		return 8, nil
+	case v == 1:
+		return 9, nil
+	}
+
+	for _, s := range []struct {
+		typ  uint64
+		size uint
+	}{
+		{1, 1}, {2, 2}, {3, 3}, {4, 4}, {5, 6},
+	} {
+		bits := s.size * 8
+		if v >= -1<<(bits-1) && v < 1<<(bits-1) {
+			return s.typ, sqliteBigEndian(v, s.size)
+		}
+	}
+
+	return 6, sqliteBigEndian(v, 8)
+}
+
+// sqliteBigEndian returns the size lower bytes of v in the big-endian order.
+func sqliteBigEndian(v int64, size uint) (b []byte) {
+	b = make([]byte, size)
+	for i := range b {
+		b[i] = byte(uint64(v) >> (8 * (size - 1 - uint(i))))
+	}
+
+	return b
+}
+
+// sqliteAppendVarint appends the SQLite varint encoding of v to b.  Unlike the
+// encoding/binary varints, these are big-endian and the ninth byte, if any,
+// has all eight bits of the value.
+func sqliteAppendVarint(b []byte, v uint64) (res []byte) {
+	if v > 1<<56-1 {
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+
+		return append(b, buf[:]...)
+	}
+
+	var buf [8]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+	for v >>= 7; v != 0; v >>= 7 {
+		i--
+		buf[i] = byte(v&0x7f) | 0x80
+	}
+
+	return append(b, buf[i:]...)
+}
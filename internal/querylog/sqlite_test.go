@@ -0,0 +1,207 @@
+package querylog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sqliteReader reads the rowid tables of an SQLite database.  It only supports
+// what sqliteWriter writes, but doesn't share any code with it, so that the
+// written databases are checked against the file format and not against the
+// writer itself.
+type sqliteReader struct {
+	t    *testing.T
+	data []byte
+	size int
+}
+
+// newSQLiteReader returns a new reader of the database in data.
+func newSQLiteReader(t *testing.T, data []byte) (r *sqliteReader) {
+	t.Helper()
+
+	if len(data) < 100 || string(data[:16]) != "SQLite format 3\x00" {
+		t.Fatal("no database header")
+	}
+
+	size := int(binary.BigEndian.Uint16(data[16:]))
+	if pages := int(binary.BigEndian.Uint32(data[28:])); len(data) != size*pages {
+		t.Fatalf("got %d bytes, want %d pages of %d bytes", len(data), pages, size)
+	}
+
+	return &sqliteReader{t: t, data: data, size: size}
+}
+
+// table returns the rows of the table with name.
+func (r *sqliteReader) table(name string) (rows [][]interface{}) {
+	r.t.Helper()
+
+	for _, row := range r.rows(1) {
+		if row[0] == "table" && row[1] == name {
+			return r.rows(int(row[3].(int64)))
+		}
+	}
+
+	r.t.Fatalf("no table %q", name)
+
+	return nil
+}
+
+// rows returns the rows from the b-tree with the root page num.  The rowid
+// is set as the value of the first column if it's nil.
+func (r *sqliteReader) rows(num int) (rows [][]interface{}) {
+	r.t.Helper()
+
+	page := r.data[(num-1)*r.size : num*r.size]
+	off := 0
+	if num == 1 {
+		off = 100
+	}
+
+	hdrLen := 8
+	typ := page[off]
+	if typ == sqlitePageTableInterior {
+		hdrLen = 12
+	} else if typ != sqlitePageTableLeaf {
+		r.t.Fatalf("page %d: unexpected type %#x", num, typ)
+	}
+
+	n := int(binary.BigEndian.Uint16(page[off+3:]))
+	for i := 0; i < n; i++ {
+		cell := page[binary.BigEndian.Uint16(page[off+hdrLen+2*i:]):]
+		if typ == sqlitePageTableInterior {
+			rows = append(rows, r.rows(int(binary.BigEndian.Uint32(cell)))...)
+
+			continue
+		}
+
+		payloadLen, l := readSQLiteVarint(cell)
+		cell = cell[l:]
+		rowid, l := readSQLiteVarint(cell)
+		cell = cell[l:]
+
+		row := readSQLiteRecord(r.t, cell[:payloadLen])
+		if len(row) > 0 && row[0] == nil {
+			row[0] = int64(rowid)
+		}
+
+		rows = append(rows, row)
+	}
+
+	if typ == sqlitePageTableInterior {
+		rows = append(rows, r.rows(int(binary.BigEndian.Uint32(page[off+8:])))...)
+	}
+
+	return rows
+}
+
+// readSQLiteRecord decodes the values of rec.
+func readSQLiteRecord(t *testing.T, rec []byte) (vals []interface{}) {
+	t.Helper()
+
+	hdrLen, l := readSQLiteVarint(rec)
+	hdr, body := rec[l:hdrLen], rec[hdrLen:]
+	for len(hdr) > 0 {
+		var st uint64
+		st, l = readSQLiteVarint(hdr)
+		hdr = hdr[l:]
+
+		intSizes := []int{0, 1, 2, 3, 4, 6, 8}
+		switch {
+		case st == 0:
+			vals = append(vals, nil)
+		case st <= 6:
+			size := intSizes[st]
+			v := int64(int8(body[0]))
+			for _, b := range body[1:size] {
+				v = v<<8 | int64(b)
+			}
+			body = body[size:]
+			vals = append(vals, v)
+		case st == 8, st == 9:
+			vals = append(vals, int64(st-8))
+		case st >= 13 && st%2 == 1:
+			size := int(st-13) / 2
+			vals = append(vals, string(body[:size]))
+			body = body[size:]
+		default:
+			t.Fatalf("unexpected serial type %d", st)
+		}
+	}
+
+	assert.Empty(t, body)
+
+	return vals
+}
+
+// readSQLiteVarint decodes the SQLite varint from the beginning of b.
+func readSQLiteVarint(b []byte) (v uint64, n int) {
+	for n = 0; n < 8; n++ {
+		v = v<<7 | uint64(b[n]&0x7f)
+		if b[n] < 0x80 {
+			return v, n + 1
+		}
+	}
+
+	return v<<8 | uint64(b[8]), 9
+}
+
+func TestWriteSQLite(t *testing.T) {
+	// Enough rows for two levels of interior pages.
+	const n = 100000
+
+	rows := make([][]interface{}, n)
+	for i := range rows {
+		rows[i] = []interface{}{nil, int64(i) * 1000003, fmt.Sprintf("row %d", i), nil}
+	}
+
+	rows[1][1] = int64(-1 << 40)
+	rows[2][1] = int64(1<<63 - 1)
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, writeSQLite(buf, []sqliteTable{{
+		name: "rows",
+		sql:  "CREATE TABLE rows (id INTEGER PRIMARY KEY, num INTEGER, text TEXT, extra)",
+		rows: rows,
+	}, {
+		name: "empty",
+		sql:  "CREATE TABLE empty (a)",
+	}}))
+
+	r := newSQLiteReader(t, buf.Bytes())
+	got := r.table("rows")
+	if !assert.Len(t, got, n) {
+		return
+	}
+	for i, row := range got {
+		rows[i][0] = int64(i + 1)
+		if !assert.Equal(t, rows[i], row) {
+			break
+		}
+	}
+
+	assert.Empty(t, r.table("empty"))
+
+	err := writeSQLite(&bytes.Buffer{}, []sqliteTable{{
+		name: "large",
+		sql:  "CREATE TABLE large (a)",
+		rows: [][]interface{}{{string(make([]byte, sqlitePageSize))}},
+	}})
+	assert.NotNil(t, err)
+}
+
+func TestSQLiteAppendVarint(t *testing.T) {
+	for _, v := range []uint64{
+		0, 1, 0x7f, 0x80, 0x3fff, 0x4000, 1<<56 - 1, 1 << 56, 1<<64 - 1,
+	} {
+		b := sqliteAppendVarint(nil, v)
+		got, n := readSQLiteVarint(b)
+		assert.Equal(t, v, got)
+		assert.Equal(t, len(b), n)
+	}
+
+	assert.Len(t, sqliteAppendVarint(nil, 1<<64-1), 9)
+}
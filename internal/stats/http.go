@@ -35,6 +35,10 @@ type statsResponse struct {
 	TopClients []map[string]uint64 `json:"top_clients"`
 	TopBlocked []map[string]uint64 `json:"top_blocked_domains"`
 
+	// TopClientsWhois is the WHOIS information of the top clients which
+	// have it, by the clients.  See Config.ClientWhois.
+	TopClientsWhois map[string]map[string]string `json:"top_clients_whois,omitempty"`
+
 	DNSQueries []uint64 `json:"dns_queries"`
 
 	BlockedFiltering     []uint64 `json:"blocked_filtering"`
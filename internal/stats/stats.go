@@ -21,6 +21,11 @@ type Config struct {
 	UnitID            unitIDCallback // user function to get the current unit ID.  If nil, the current time hour is used.
 	AnonymizeClientIP bool           // anonymize clients' IP addresses
 
+	// ClientWhois, if not nil, returns the WHOIS information of the client,
+	// like its country and organization, or nil if there is none.  It's
+	// used to show the WHOIS information of the top clients.
+	ClientWhois func(client string) (info map[string]string)
+
 	// Called when the configuration is changed by HTTP request
 	ConfigModified func()
 
@@ -50,6 +55,15 @@ type Stats interface {
 	// Get IP addresses of the clients with the most number of requests
 	GetTopClientsIP(limit uint) []net.IP
 
+	// GetFilterListsBlocked returns the numbers of the requests blocked by
+	// the rules from each filter list, by the list ID.
+	GetFilterListsBlocked() (blocked map[int64]uint64)
+
+	// GetFilterListsMonitored returns the numbers of the requests which
+	// the rules from each monitor-only filter list would have blocked, by
+	// the list ID.
+	GetFilterListsMonitored() (monitored map[int64]uint64)
+
 	// WriteDiskConfig - write configuration
 	WriteDiskConfig(dc *DiskConfig)
 }
@@ -86,4 +100,12 @@ type Entry struct {
 	Domain string
 	Result Result
 	Time   uint32 // processing time (msec)
+
+	// FilterListIDs are the IDs of the filter lists which rules blocked the
+	// request.
+	FilterListIDs []int64
+
+	// MonitorListIDs are the IDs of the monitor-only filter lists which
+	// rules would have blocked the request.
+	MonitorListIDs []int64
 }
@@ -42,12 +42,15 @@ func TestStats(t *testing.T) {
 	e.Client = "127.0.0.1"
 	e.Result = RFiltered
 	e.Time = 123456
+	e.FilterListIDs = []int64{1, 2}
 	s.Update(e)
 
 	e.Domain = "domain"
 	e.Client = "127.0.0.1"
 	e.Result = RNotFiltered
 	e.Time = 123456
+	e.FilterListIDs = nil
+	e.MonitorListIDs = []int64{3}
 	s.Update(e)
 
 	d, ok := s.getData()
@@ -84,11 +87,49 @@ func TestStats(t *testing.T) {
 	topClients := s.GetTopClientsIP(2)
 	assert.True(t, net.IP{127, 0, 0, 1}.Equal(topClients[0]))
 
+	assert.Equal(t, map[int64]uint64{1: 1, 2: 1}, s.GetFilterListsBlocked())
+	assert.Equal(t, map[int64]uint64{3: 1}, s.GetFilterListsMonitored())
+
 	s.clear()
 	s.Close()
 	os.Remove(conf.Filename)
 }
 
+func TestStats_topClientsWhois(t *testing.T) {
+	conf := Config{
+		Filename:  "./stats.db",
+		LimitDays: 1,
+		ClientWhois: func(client string) (info map[string]string) {
+			if client == "1.2.3.4" {
+				return map[string]string{"country": "AU"}
+			}
+
+			return nil
+		},
+	}
+	s, err := createObject(conf)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		s.Close()
+		_ = os.Remove(conf.Filename)
+	})
+
+	for _, client := range []string{"1.2.3.4", "192.168.0.1"} {
+		s.Update(Entry{
+			Domain: "example.org",
+			Client: client,
+			Result: RNotFiltered,
+		})
+	}
+
+	d, ok := s.getData()
+	assert.True(t, ok)
+	assert.Len(t, d.TopClients, 2)
+	assert.Equal(t, map[string]map[string]string{
+		"1.2.3.4": {"country": "AU"},
+	}, d.TopClientsWhois)
+}
+
 func TestLargeNumbers(t *testing.T) {
 	var hour int32 = 1
 	newID := func() uint32 {
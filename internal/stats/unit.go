@@ -41,6 +41,9 @@ type unit struct {
 	domains        map[string]uint64 // number of requests per domain
 	blockedDomains map[string]uint64 // number of blocked requests per domain
 	clients        map[string]uint64 // number of requests per client
+
+	filterLists  map[int64]uint64 // number of blocked requests per filter list
+	monitorLists map[int64]uint64 // number of monitored requests per filter list
 }
 
 // name-count pair
@@ -58,6 +61,13 @@ type unitDB struct {
 	BlockedDomains []countPair
 	Clients        []countPair
 
+	// FilterLists is the number of blocked requests per filter list ID.
+	FilterLists map[int64]uint64
+
+	// MonitorLists is the number of requests which would have been blocked
+	// per monitor-only filter list ID.
+	MonitorLists map[int64]uint64
+
 	TimeAvg uint32 // usec
 }
 
@@ -165,6 +175,8 @@ func (s *statsCtx) initUnit(u *unit, id uint32) {
 	u.domains = make(map[string]uint64)
 	u.blockedDomains = make(map[string]uint64)
 	u.clients = make(map[string]uint64)
+	u.filterLists = make(map[int64]uint64)
+	u.monitorLists = make(map[int64]uint64)
 }
 
 // Open a DB transaction
@@ -309,6 +321,16 @@ func serialize(u *unit) *unitDB {
 	udb.BlockedDomains = convertMapToSlice(u.blockedDomains, maxDomains)
 	udb.Clients = convertMapToSlice(u.clients, maxClients)
 
+	udb.FilterLists = make(map[int64]uint64, len(u.filterLists))
+	for id, n := range u.filterLists {
+		udb.FilterLists[id] = n
+	}
+
+	udb.MonitorLists = make(map[int64]uint64, len(u.monitorLists))
+	for id, n := range u.monitorLists {
+		udb.MonitorLists[id] = n
+	}
+
 	return &udb
 }
 
@@ -326,6 +348,14 @@ func deserialize(u *unit, udb *unitDB) {
 	u.domains = convertSliceToMap(udb.Domains)
 	u.blockedDomains = convertSliceToMap(udb.BlockedDomains)
 	u.clients = convertSliceToMap(udb.Clients)
+	u.filterLists = make(map[int64]uint64, len(udb.FilterLists))
+	for id, n := range udb.FilterLists {
+		u.filterLists[id] = n
+	}
+	u.monitorLists = make(map[int64]uint64, len(udb.MonitorLists))
+	for id, n := range udb.MonitorLists {
+		u.monitorLists[id] = n
+	}
 	u.timeSum = uint64(udb.TimeAvg) * u.nTotal
 }
 
@@ -490,6 +520,12 @@ func (s *statsCtx) Update(e Entry) {
 	}
 
 	u.clients[clientID]++
+	for _, id := range e.FilterListIDs {
+		u.filterLists[id]++
+	}
+	for _, id := range e.MonitorListIDs {
+		u.monitorLists[id]++
+	}
 	u.timeSum += uint64(e.Time)
 	u.nTotal++
 }
@@ -623,6 +659,8 @@ func (s *statsCtx) getData() (statsResponse, bool) {
 		TopClients:           topsCollector(maxClients, func(u *unitDB) (pairs []countPair) { return u.Clients }),
 	}
 
+	data.TopClientsWhois = s.topClientsWhois(data.TopClients)
+
 	// total counters:
 
 	sum := unitDB{}
@@ -658,6 +696,31 @@ func (s *statsCtx) getData() (statsResponse, bool) {
 	return data, true
 }
 
+// topClientsWhois returns the WHOIS information of the clients from
+// topClients which have it.  It returns nil if there is none.
+func (s *statsCtx) topClientsWhois(topClients []map[string]uint64) (infos map[string]map[string]string) {
+	if s.conf.ClientWhois == nil {
+		return nil
+	}
+
+	for _, top := range topClients {
+		for client := range top {
+			info := s.conf.ClientWhois(client)
+			if len(info) == 0 {
+				continue
+			}
+
+			if infos == nil {
+				infos = map[string]map[string]string{}
+			}
+
+			infos[client] = info
+		}
+	}
+
+	return infos
+}
+
 func (s *statsCtx) GetTopClientsIP(maxCount uint) []net.IP {
 	units, _ := s.loadUnits(s.conf.limit)
 	if units == nil {
@@ -678,3 +741,31 @@ func (s *statsCtx) GetTopClientsIP(maxCount uint) []net.IP {
 	}
 	return d
 }
+
+// GetFilterListsBlocked implements the Stats interface for *statsCtx.
+func (s *statsCtx) GetFilterListsBlocked() (blocked map[int64]uint64) {
+	return s.sumFilterLists(func(u *unitDB) (lists map[int64]uint64) { return u.FilterLists })
+}
+
+// GetFilterListsMonitored implements the Stats interface for *statsCtx.
+func (s *statsCtx) GetFilterListsMonitored() (monitored map[int64]uint64) {
+	return s.sumFilterLists(func(u *unitDB) (lists map[int64]uint64) { return u.MonitorLists })
+}
+
+// sumFilterLists returns the sums of the per-list numbers of requests which
+// lists returns for every unit of the statistics period.
+func (s *statsCtx) sumFilterLists(lists func(u *unitDB) map[int64]uint64) (sums map[int64]uint64) {
+	units, _ := s.loadUnits(s.conf.limit)
+	if units == nil {
+		return nil
+	}
+
+	sums = map[int64]uint64{}
+	for _, u := range units {
+		for id, n := range lists(u) {
+			sums[id] += n
+		}
+	}
+
+	return sums
+}
@@ -2,6 +2,7 @@ package util
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
@@ -217,6 +218,37 @@ func (a *AutoHosts) updateTableRev(tableRev map[string][]string, newHost string,
 	log.Debug("AutoHosts: added reverse-address %s -> %s", ipStr, newHost)
 }
 
+// parseHostsLine parses a line of a hosts-file.  The leading and trailing
+// whitespace, the comments starting with '#', and the IPv6 zone of the address,
+// as in "fe80::1%eth0", are ignored.  ip and hosts are nil if the line contains
+// no data.  err is not nil if the line is malformed.
+func parseHostsLine(line string) (ip net.IP, hosts []string, err error) {
+	if sharp := strings.IndexByte(line, '#'); sharp >= 0 {
+		line = line[:sharp]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, nil, nil
+	}
+
+	addr := fields[0]
+	if zone := strings.IndexByte(addr, '%'); zone >= 0 {
+		addr = addr[:zone]
+	}
+
+	ip = net.ParseIP(addr)
+	if ip == nil {
+		return nil, nil, fmt.Errorf("invalid ip address %q", fields[0])
+	}
+
+	if len(fields) < 2 {
+		return nil, nil, fmt.Errorf("no hostnames for ip address %q", fields[0])
+	}
+
+	return ip, fields[1:], nil
+}
+
 // Read IP-hostname pairs from file
 // Multiple hostnames per line (per one IP) is supported.
 func (a *AutoHosts) load(table map[string][]net.IP, tableRev map[string][]string, fn string) {
@@ -230,7 +262,7 @@ func (a *AutoHosts) load(table map[string][]net.IP, tableRev map[string][]string
 	log.Debug("AutoHosts: loading hosts from file %s", fn)
 
 	finish := false
-	for !finish {
+	for lineNum := 1; !finish; lineNum++ {
 		line, err := r.ReadString('\n')
 		if err == io.EOF {
 			finish = true
@@ -238,37 +270,17 @@ func (a *AutoHosts) load(table map[string][]net.IP, tableRev map[string][]string
 			log.Error("AutoHosts: %s", err)
 			return
 		}
-		line = strings.TrimSpace(line)
-		if len(line) == 0 || line[0] == '#' {
-			continue
-		}
 
-		fields := strings.Fields(line)
-		if len(fields) < 2 {
-			continue
-		}
+		ipAddr, hosts, err := parseHostsLine(line)
+		if err != nil {
+			log.Info("AutoHosts: skipping line %d of %s: %s", lineNum, fn, err)
 
-		ipAddr := net.ParseIP(fields[0])
-		if ipAddr == nil {
 			continue
 		}
-		for i := 1; i != len(fields); i++ {
-			host := fields[i]
-			if len(host) == 0 {
-				break
-			}
-			sharp := strings.IndexByte(host, '#')
-			if sharp == 0 {
-				break // skip the rest of the line after #
-			} else if sharp > 0 {
-				host = host[:sharp]
-			}
 
+		for _, host := range hosts {
 			a.updateTable(table, host, ipAddr)
 			a.updateTableRev(tableRev, host, ipAddr)
-			if sharp >= 0 {
-				break // skip the rest of the line after #
-			}
 		}
 	}
 }
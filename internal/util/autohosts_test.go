@@ -75,6 +75,126 @@ func TestAutoHostsResolution(t *testing.T) {
 	}
 }
 
+func TestParseHostsLine(t *testing.T) {
+	testCases := []struct {
+		name      string
+		line      string
+		wantIP    net.IP
+		wantHosts []string
+		wantErr   bool
+	}{{
+		name:      "crlf",
+		line:      "1.2.3.4 host\r\n",
+		wantIP:    net.IP{1, 2, 3, 4},
+		wantHosts: []string{"host"},
+	}, {
+		name:      "tabs",
+		line:      "\t1.2.3.4\thost1\t\thost2\n",
+		wantIP:    net.IP{1, 2, 3, 4},
+		wantHosts: []string{"host1", "host2"},
+	}, {
+		name:      "zone",
+		line:      "fe80::1%eth0 host\n",
+		wantIP:    net.ParseIP("fe80::1"),
+		wantHosts: []string{"host"},
+	}, {
+		name:      "comment",
+		line:      "  1.2.3.4 host1 host2#comment host3\n",
+		wantIP:    net.IP{1, 2, 3, 4},
+		wantHosts: []string{"host1", "host2"},
+	}, {
+		name: "empty",
+		line: " \t\r\n",
+	}, {
+		name: "comment_only",
+		line: "# 1.2.3.4 host\n",
+	}, {
+		name:    "bad_ip",
+		line:    "1.2.3 host\n",
+		wantErr: true,
+	}, {
+		name:    "no_hosts",
+		line:    "1.2.3.4 # host\n",
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ip, hosts, err := parseHostsLine(tc.line)
+			if tc.wantErr {
+				assert.NotNil(t, err)
+
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.True(t, tc.wantIP.Equal(ip))
+			assert.Equal(t, tc.wantHosts, hosts)
+		})
+	}
+}
+
+func TestAutoHostsResolution_formats(t *testing.T) {
+	ah := AutoHosts{}
+
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	f, _ := ioutil.TempFile(dir, "")
+	defer func() { _ = os.Remove(f.Name()) }()
+	defer f.Close()
+
+	_, _ = f.WriteString("1.2.3.4 crlf.example\r\n")
+	_, _ = f.WriteString("\t1.2.3.5\ttab.example\r\n")
+	_, _ = f.WriteString("malformed.example\r\n")
+	_, _ = f.WriteString("fe80::1%eth0 zone.example\n")
+	_, _ = f.WriteString("1.2.3.6 first.example second.example third.example # comment\n")
+
+	ah.Init(f.Name())
+
+	testCases := []struct {
+		host  string
+		qtype uint16
+		want  net.IP
+	}{{
+		host:  "crlf.example",
+		qtype: dns.TypeA,
+		want:  net.IP{1, 2, 3, 4},
+	}, {
+		host:  "tab.example",
+		qtype: dns.TypeA,
+		want:  net.IP{1, 2, 3, 5},
+	}, {
+		host:  "zone.example",
+		qtype: dns.TypeAAAA,
+		want:  net.ParseIP("fe80::1"),
+	}, {
+		host:  "first.example",
+		qtype: dns.TypeA,
+		want:  net.IP{1, 2, 3, 6},
+	}, {
+		host:  "second.example",
+		qtype: dns.TypeA,
+		want:  net.IP{1, 2, 3, 6},
+	}, {
+		host:  "third.example",
+		qtype: dns.TypeA,
+		want:  net.IP{1, 2, 3, 6},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			ips := ah.Process(tc.host, tc.qtype)
+			if assert.Len(t, ips, 1) {
+				assert.True(t, tc.want.Equal(ips[0]))
+			}
+		})
+	}
+
+	assert.Nil(t, ah.Process("malformed.example", dns.TypeA))
+	assert.Nil(t, ah.Process("comment", dns.TypeA))
+}
+
 func TestAutoHostsFSNotify(t *testing.T) {
 	ah := AutoHosts{}
 